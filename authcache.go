@@ -0,0 +1,194 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const defaultAuthCacheSize = 1024 * 64 // the default maximum number of cached acl decisions
+
+// AuthCacheOptions contains the configuration of the acl decision cache.
+type AuthCacheOptions struct {
+	TTL  int64 `yaml:"ttl" json:"ttl"`   // milliseconds a decision is cached for, disabled if 0
+	Size int   `yaml:"size" json:"size"` // maximum number of cached decisions, 65536 if 0
+}
+
+// authCacheKey identifies a cached acl decision.
+type authCacheKey struct {
+	client   string
+	username string
+	topic    string
+	write    bool
+}
+
+// authCacheEntry is a cached acl decision.
+type authCacheEntry struct {
+	key     authCacheKey
+	allow   bool
+	expires int64 // unix nanoseconds
+}
+
+// AuthCache is a size-bounded cache of OnACLCheck decisions, keyed on client id, username,
+// topic and access, which saves repeating expensive acl checks (such as those made by http,
+// ldap or database backed auth hooks) on every publish. Decisions expire after a TTL, and
+// the least recently used decisions are evicted when the cache is full. Hooks whose rules
+// change should invalidate the affected decisions, using the cache in their HookOptions.
+// The methods of a nil AuthCache are no-ops.
+type AuthCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	size    int
+	order   *list.List // most recently used first
+	entries map[authCacheKey]*list.Element
+}
+
+// NewAuthCache returns a new acl decision cache.
+func NewAuthCache(opts AuthCacheOptions) *AuthCache {
+	if opts.Size <= 0 {
+		opts.Size = defaultAuthCacheSize
+	}
+
+	return &AuthCache{
+		ttl:     time.Duration(opts.TTL) * time.Millisecond,
+		size:    opts.Size,
+		order:   list.New(),
+		entries: map[authCacheKey]*list.Element{},
+	}
+}
+
+// Get returns the cached decision for a client to read or write a topic, and true if
+// an unexpired decision was cached.
+func (c *AuthCache) Get(cl *Client, topic string, write bool) (allow bool, ok bool) {
+	if c == nil {
+		return false, false
+	}
+
+	key := newAuthCacheKey(cl, topic, write)
+	c.Lock()
+	defer c.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return false, false
+	}
+
+	entry := el.Value.(*authCacheEntry)
+	if time.Now().UnixNano() >= entry.expires {
+		c.remove(el)
+		return false, false
+	}
+
+	c.order.MoveToFront(el)
+	return entry.allow, true
+}
+
+// Set caches the decision for a client to read or write a topic.
+func (c *AuthCache) Set(cl *Client, topic string, write bool, allow bool) {
+	if c == nil {
+		return
+	}
+
+	key := newAuthCacheKey(cl, topic, write)
+	expires := time.Now().Add(c.ttl).UnixNano()
+
+	c.Lock()
+	defer c.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*authCacheEntry)
+		entry.allow = allow
+		entry.expires = expires
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&authCacheEntry{
+		key:     key,
+		allow:   allow,
+		expires: expires,
+	})
+
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// Len returns the number of cached decisions, including any which have expired.
+func (c *AuthCache) Len() int {
+	if c == nil {
+		return 0
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	return c.order.Len()
+}
+
+// InvalidateClient removes the cached decisions of a client id.
+func (c *AuthCache) InvalidateClient(id string) {
+	c.invalidate(func(key authCacheKey) bool {
+		return key.client == id
+	})
+}
+
+// InvalidateUser removes the cached decisions of a username.
+func (c *AuthCache) InvalidateUser(username string) {
+	c.invalidate(func(key authCacheKey) bool {
+		return key.username == username
+	})
+}
+
+// InvalidateTopic removes the cached decisions of a topic, or topic filter.
+func (c *AuthCache) InvalidateTopic(topic string) {
+	c.invalidate(func(key authCacheKey) bool {
+		return key.topic == topic
+	})
+}
+
+// InvalidateAll removes all cached decisions.
+func (c *AuthCache) InvalidateAll() {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.order.Init()
+	clear(c.entries)
+}
+
+// invalidate removes the cached decisions whose keys match f.
+func (c *AuthCache) invalidate(f func(key authCacheKey) bool) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	for key, el := range c.entries {
+		if f(key) {
+			c.remove(el)
+		}
+	}
+}
+
+// remove removes a cached decision. The cache must be locked.
+func (c *AuthCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*authCacheEntry).key)
+}
+
+// newAuthCacheKey returns the cache key of a client reading or writing a topic.
+func newAuthCacheKey(cl *Client, topic string, write bool) authCacheKey {
+	return authCacheKey{
+		client:   cl.ID,
+		username: string(cl.Properties.Username),
+		topic:    topic,
+		write:    write,
+	}
+}
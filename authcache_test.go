@@ -0,0 +1,215 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// countingACLHook allows access to topics under allow/, and counts its acl checks.
+type countingACLHook struct {
+	HookBase
+	checks int64
+}
+
+func (h *countingACLHook) ID() string {
+	return "counting-acl"
+}
+
+func (h *countingACLHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{OnConnectAuthenticate, OnACLCheck}, []byte{b})
+}
+
+func (h *countingACLHook) OnACLCheck(cl *Client, topic string, write bool) bool {
+	atomic.AddInt64(&h.checks, 1)
+	return len(topic) > 6 && topic[:6] == "allow/"
+}
+
+func newAuthCacheClient(id, username string) *Client {
+	return &Client{ID: id, Properties: ClientProperties{Username: []byte(username)}}
+}
+
+func TestNewAuthCacheDefaults(t *testing.T) {
+	c := NewAuthCache(AuthCacheOptions{TTL: 1000})
+	require.Equal(t, defaultAuthCacheSize, c.size)
+	require.Equal(t, time.Second, c.ttl)
+}
+
+func TestAuthCacheGetSet(t *testing.T) {
+	c := NewAuthCache(AuthCacheOptions{TTL: 60000})
+	cl := newAuthCacheClient("cl1", "user")
+
+	_, ok := c.Get(cl, "a/b", true)
+	require.False(t, ok)
+
+	c.Set(cl, "a/b", true, true)
+	c.Set(cl, "a/b", false, false)
+
+	allow, ok := c.Get(cl, "a/b", true)
+	require.True(t, ok)
+	require.True(t, allow)
+
+	allow, ok = c.Get(cl, "a/b", false)
+	require.True(t, ok)
+	require.False(t, allow)
+
+	_, ok = c.Get(newAuthCacheClient("cl1", "other"), "a/b", true)
+	require.False(t, ok)
+
+	c.Set(cl, "a/b", true, false)
+	allow, ok = c.Get(cl, "a/b", true)
+	require.True(t, ok)
+	require.False(t, allow)
+	require.Equal(t, 2, c.Len())
+}
+
+func TestAuthCacheExpiry(t *testing.T) {
+	c := NewAuthCache(AuthCacheOptions{TTL: 1})
+	cl := newAuthCacheClient("cl1", "")
+
+	c.Set(cl, "a/b", true, true)
+	time.Sleep(time.Millisecond * 5)
+
+	_, ok := c.Get(cl, "a/b", true)
+	require.False(t, ok)
+	require.Equal(t, 0, c.Len())
+}
+
+func TestAuthCacheEviction(t *testing.T) {
+	c := NewAuthCache(AuthCacheOptions{TTL: 60000, Size: 2})
+	cl := newAuthCacheClient("cl1", "")
+
+	c.Set(cl, "a", true, true)
+	c.Set(cl, "b", true, true)
+	_, ok := c.Get(cl, "a", true) // a is now the most recently used
+	require.True(t, ok)
+
+	c.Set(cl, "c", true, true)
+	require.Equal(t, 2, c.Len())
+
+	_, ok = c.Get(cl, "b", true)
+	require.False(t, ok)
+	_, ok = c.Get(cl, "a", true)
+	require.True(t, ok)
+	_, ok = c.Get(cl, "c", true)
+	require.True(t, ok)
+}
+
+func TestAuthCacheInvalidate(t *testing.T) {
+	c := NewAuthCache(AuthCacheOptions{TTL: 60000})
+	cl1 := newAuthCacheClient("cl1", "user1")
+	cl2 := newAuthCacheClient("cl2", "user2")
+
+	fill := func() {
+		c.InvalidateAll()
+		for _, cl := range []*Client{cl1, cl2} {
+			c.Set(cl, "a/b", true, true)
+			c.Set(cl, "c/d", true, true)
+		}
+	}
+
+	fill()
+	c.InvalidateClient("cl1")
+	require.Equal(t, 2, c.Len())
+	_, ok := c.Get(cl1, "a/b", true)
+	require.False(t, ok)
+
+	fill()
+	c.InvalidateUser("user2")
+	require.Equal(t, 2, c.Len())
+	_, ok = c.Get(cl2, "c/d", true)
+	require.False(t, ok)
+
+	fill()
+	c.InvalidateTopic("a/b")
+	require.Equal(t, 2, c.Len())
+	_, ok = c.Get(cl1, "c/d", true)
+	require.True(t, ok)
+
+	c.InvalidateAll()
+	require.Equal(t, 0, c.Len())
+}
+
+func TestAuthCacheNil(t *testing.T) {
+	var c *AuthCache
+	cl := newAuthCacheClient("cl1", "")
+	c.Set(cl, "a/b", true, true)
+	_, ok := c.Get(cl, "a/b", true)
+	require.False(t, ok)
+	require.Equal(t, 0, c.Len())
+	c.InvalidateClient("cl1")
+	c.InvalidateUser("")
+	c.InvalidateTopic("a/b")
+	c.InvalidateAll()
+}
+
+func TestServerAuthCacheDisabled(t *testing.T) {
+	s := New(&Options{Logger: logger, AuthCache: &AuthCacheOptions{}})
+	require.Nil(t, s.AuthCache)
+
+	h := new(countingACLHook)
+	require.NoError(t, s.AddHook(h, nil))
+
+	cl := newAuthCacheClient("cl1", "")
+	require.True(t, s.checkACL(cl, "allow/a", true))
+	require.True(t, s.checkACL(cl, "allow/a", true))
+	require.Equal(t, int64(2), atomic.LoadInt64(&h.checks))
+}
+
+func TestServerCheckACLCached(t *testing.T) {
+	s := New(&Options{Logger: logger, AuthCache: &AuthCacheOptions{TTL: 60000}})
+	require.NotNil(t, s.AuthCache)
+
+	h := new(countingACLHook)
+	require.NoError(t, s.AddHook(h, nil))
+	require.Same(t, s.AuthCache, h.Opts.AuthCache)
+
+	cl := newAuthCacheClient("cl1", "")
+	for i := 0; i < 3; i++ {
+		require.True(t, s.checkACL(cl, "allow/a", true))
+		require.False(t, s.checkACL(cl, "deny/a", true))
+	}
+	require.Equal(t, int64(2), atomic.LoadInt64(&h.checks))
+
+	h.Opts.AuthCache.InvalidateClient("cl1")
+	require.True(t, s.checkACL(cl, "allow/a", true))
+	require.Equal(t, int64(3), atomic.LoadInt64(&h.checks))
+}
+
+func TestServerCheckACLDenied(t *testing.T) {
+	s := New(&Options{Logger: logger, AuthCache: &AuthCacheOptions{TTL: 60000}})
+	require.NoError(t, s.AddHook(new(countingACLHook), nil))
+	h := new(aclDeniedHook)
+	require.NoError(t, s.AddHook(h, nil))
+
+	cl := newAuthCacheClient("cl1", "")
+	require.True(t, s.checkACL(cl, "allow/a", true))
+	require.False(t, s.checkACL(cl, "deny/a", true))
+	require.False(t, s.checkACL(cl, "deny/a", true)) // cached denials are also reported
+	require.False(t, s.checkACL(cl, "deny/b", false))
+
+	require.Equal(t, []ACLDenial{
+		{Topic: "deny/a", Action: ACLActionWrite, Hook: "acl-denied", Rule: "rule-write"},
+		{Topic: "deny/a", Action: ACLActionWrite, Hook: "acl-denied", Rule: "rule-write"},
+		{Topic: "deny/b", Action: ACLActionRead, Hook: "acl-denied", Rule: "rule-read"},
+	}, h.denials)
+}
+
+func TestServerCheckACLSuperuser(t *testing.T) {
+	s := New(&Options{Logger: logger, AuthCache: &AuthCacheOptions{TTL: 60000}})
+	h := new(countingACLHook)
+	require.NoError(t, s.AddHook(h, nil))
+
+	cl := newAuthCacheClient("cl1", "admin")
+	cl.SetSuperuser(true)
+	require.True(t, s.checkACL(cl, "deny/a", true))
+	require.Equal(t, int64(0), atomic.LoadInt64(&h.checks))
+	require.Equal(t, 0, s.AuthCache.Len())
+}
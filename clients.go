@@ -8,10 +8,13 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -31,6 +34,11 @@ var (
 	ErrMinimumKeepalive = errors.New("client keepalive is below minimum recommended value and may exhibit connection instability")
 )
 
+// tlsConnectionStater is satisfied by connections which can report their TLS state, such as *tls.Conn.
+type tlsConnectionStater interface {
+	ConnectionState() tls.ConnectionState
+}
+
 // ReadFn is the function signature for the function used for reading and processing new packets.
 type ReadFn func(*Client, packets.Packet) error
 
@@ -88,6 +96,19 @@ func (cl *Clients) Delete(id string) {
 	delete(cl.internal, id)
 }
 
+// CompareAndDelete removes a client from the internal map if it is still the client
+// registered for its id, returning true if it was removed.
+func (cl *Clients) CompareAndDelete(val *Client) bool {
+	cl.Lock()
+	defer cl.Unlock()
+	if cl.internal[val.ID] != val {
+		return false
+	}
+
+	delete(cl.internal, val.ID)
+	return true
+}
+
 // GetByListener returns clients matching a listener id.
 func (cl *Clients) GetByListener(id string) []*Client {
 	cl.RLock()
@@ -101,6 +122,116 @@ func (cl *Clients) GetByListener(id string) []*Client {
 	return clients
 }
 
+// ClientStatus selects clients by whether they are connected.
+type ClientStatus byte
+
+const (
+	ClientStatusAny          ClientStatus = iota // connected and disconnected clients
+	ClientStatusConnected                        // only connected clients
+	ClientStatusDisconnected                     // only disconnected clients with a retained session
+)
+
+// ClientQuery contains the filters used to select clients with Clients.Query.
+// Empty fields match all clients.
+type ClientQuery struct {
+	Listener     string       // only clients of the listener id
+	Username     string       // only clients with the username
+	Subscription string       // only clients subscribed to the filter
+	Status       ClientStatus // only clients which are connected or disconnected
+}
+
+// ClientView is a snapshot of the details of a client, as returned by Clients.Query.
+type ClientView struct {
+	ID              string   `json:"id"`               // the client id
+	Listener        string   `json:"listener"`         // the listener id of the client
+	Remote          string   `json:"remote"`           // the remote address of the client
+	Username        string   `json:"username"`         // the username of the client
+	Subscriptions   []string `json:"subscriptions"`    // the sorted subscription filters of the client
+	Disconnected    int64    `json:"disconnected"`     // the time the client disconnected in unix time, else zero
+	Inflight        int      `json:"inflight"`         // the number of inflight and queued messages of the client
+	Keepalive       uint16   `json:"keepalive"`        // the keepalive of the client in seconds
+	ProtocolVersion byte     `json:"protocol_version"` // the mqtt protocol version of the client
+	Connected       bool     `json:"connected"`        // the client is connected
+	Clean           bool     `json:"clean"`            // the client requested a clean session
+}
+
+// matches returns true if a client matches the query.
+func (q ClientQuery) matches(cl *Client) bool {
+	if q.Listener != "" && cl.Net.Listener != q.Listener {
+		return false
+	}
+
+	if q.Username != "" && string(cl.Properties.Username) != q.Username {
+		return false
+	}
+
+	switch q.Status {
+	case ClientStatusConnected:
+		if cl.Closed() {
+			return false
+		}
+	case ClientStatusDisconnected:
+		if !cl.Closed() {
+			return false
+		}
+	}
+
+	if q.Subscription != "" {
+		if _, ok := cl.State.Subscriptions.Get(q.Subscription); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// View returns a snapshot of the details of the client.
+func (cl *Client) View() ClientView {
+	subs := make([]string, 0, cl.State.Subscriptions.Len())
+	for filter := range cl.State.Subscriptions.GetAll() {
+		subs = append(subs, filter)
+	}
+	sort.Strings(subs)
+
+	return ClientView{
+		ID:              cl.ID,
+		Listener:        cl.Net.Listener,
+		Remote:          cl.Net.Remote,
+		Username:        string(cl.Properties.Username),
+		Subscriptions:   subs,
+		Disconnected:    cl.StopTime(),
+		Inflight:        cl.State.Inflight.Len(),
+		Keepalive:       cl.State.Keepalive,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Connected:       !cl.Closed(),
+		Clean:           cl.Properties.Clean,
+	}
+}
+
+// Query returns views of the clients which match the query, sorted by client id, so that
+// admin APIs and hooks can inspect clients without holding references to them.
+func (cl *Clients) Query(q ClientQuery) []ClientView {
+	cl.RLock()
+	clients := make([]*Client, 0, len(cl.internal))
+	for _, client := range cl.internal {
+		clients = append(clients, client)
+	}
+	cl.RUnlock()
+
+	views := []ClientView{}
+	for _, client := range clients {
+		if q.matches(client) {
+			views = append(views, client.View())
+		}
+	}
+
+	sort.Slice(views, func(i, j int) bool {
+		return views[i].ID < views[j].ID
+	})
+
+	return views
+}
+
 // Client contains information about a client known by the broker.
 type Client struct {
 	Properties   ClientProperties // client properties
@@ -113,12 +244,24 @@ type Client struct {
 
 // ClientConnection contains the connection transport and metadata for the client.
 type ClientConnection struct {
-	Conn     net.Conn      // the net.Conn used to establish the connection
-	bconn    *bufio.Reader // a buffered net.Conn for reading packets
-	outbuf   *bytes.Buffer // a buffer for writing packets
-	Remote   string        // the remote address of the client
-	Listener string        // listener id of the client
-	Inline   bool          // if true, the client is the built-in 'inline' embedded client
+	Conn       net.Conn             // the net.Conn used to establish the connection
+	bconn      *bufio.Reader        // a buffered net.Conn for reading packets
+	outbuf     *bytes.Buffer        // a buffer for writing packets
+	TLS        *tls.ConnectionState // the tls connection state, if the client connected over tls
+	Revocation error                // the result of the listener certificate revocation check, if configured; the server denies the client if set
+	Remote     string               // the remote address of the client
+	Listener   string               // listener id of the client
+	Inline     bool                 // if true, the client is the built-in 'inline' embedded client
+}
+
+// PeerCertificate returns the leaf certificate presented by the client during the tls
+// handshake, or nil if the client did not connect over tls or did not present a certificate.
+func (c ClientConnection) PeerCertificate() *x509.Certificate {
+	if c.TLS == nil || len(c.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+
+	return c.TLS.PeerCertificates[0]
 }
 
 // ClientProperties contains the properties which define the client behaviour.
@@ -139,30 +282,40 @@ type Will struct {
 	WillDelayInterval uint32                 // -
 	Qos               byte                   // -
 	Retain            bool                   // -
+	Expiry            int64                  // the unix time a delayed will is due to be sent, once armed
 }
 
 // ClientState tracks the state of the client.
 type ClientState struct {
-	TopicAliases    TopicAliases         // a map of topic aliases
-	stopCause       atomic.Value         // reason for stopping
-	Inflight        *Inflight            // a map of in-flight qos messages
-	Subscriptions   *Subscriptions       // a map of the subscription filters a client maintains
-	disconnected    int64                // the time the client disconnected in unix time, for calculating expiry
-	outbound        chan *packets.Packet // queue for pending outbound packets
-	endOnce         sync.Once            // only end once
-	isTakenOver     atomic.Bool          // used to identify orphaned clients
-	packetID        uint32               // the current highest packetID
-	open            context.Context      // indicate that the client is open for packet exchange
-	cancelOpen      context.CancelFunc   // cancel function for open context
-	outboundQty     int32                // number of messages currently in the outbound queue
-	Keepalive       uint16               // the number of seconds the connection can wait
-	ServerKeepalive bool                 // keepalive was set by the server
+	TopicAliases     TopicAliases         // a map of topic aliases
+	stopCause        atomic.Value         // reason for stopping
+	Inflight         *Inflight            // a map of in-flight qos messages
+	Subscriptions    *Subscriptions       // a map of the subscription filters a client maintains
+	disconnected     int64                // the time the client disconnected in unix time, for calculating expiry
+	outbound         chan *packets.Packet // queue for pending outbound packets
+	endOnce          sync.Once            // only end once
+	isTakenOver      atomic.Bool          // used to identify orphaned clients
+	superuser        atomic.Bool          // the client bypasses all acl checks
+	packetID         uint32               // the current highest packetID
+	open             context.Context      // indicate that the client is open for packet exchange
+	cancelOpen       context.CancelFunc   // cancel function for open context
+	ctx              context.Context      // cancelled when the client is stopped or the server is closed
+	cancelCtx        func(error)          // cancel function for ctx, with the cause
+	outboundQty      int32                // number of messages currently in the outbound queue
+	Keepalive        uint16               // the number of seconds the connection can wait
+	ServerKeepalive  bool                 // keepalive was set by the server
+	reauthenticating bool                 // an enhanced re-authentication exchange is in progress
 }
 
 // newClient returns a new instance of Client. This is almost exclusively used by Server
 // for creating new clients, but it lives here because it's not dependent.
 func newClient(c net.Conn, o *ops) *Client {
 	ctx, cancel := context.WithCancel(context.Background())
+	parent := o.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	hctx, hcancel := context.WithCancelCause(parent)
 	cl := &Client{
 		State: ClientState{
 			Inflight:      NewInflights(),
@@ -170,6 +323,8 @@ func newClient(c net.Conn, o *ops) *Client {
 			TopicAliases:  NewTopicAliases(o.options.Capabilities.TopicAliasMaximum),
 			open:          ctx,
 			cancelOpen:    cancel,
+			ctx:           hctx,
+			cancelCtx:     hcancel,
 			Keepalive:     defaultKeepalive,
 			outbound:      make(chan *packets.Packet, o.options.Capabilities.MaximumClientWritesPending),
 		},
@@ -258,6 +413,27 @@ func (cl *Client) ParseConnect(lid string, pk packets.Packet) {
 	}
 }
 
+// tlsHandshakeFailed returns true if the client connection is a tls connection
+// which has not completed the tls handshake.
+func (cl *Client) tlsHandshakeFailed() bool {
+	tc, ok := cl.Net.Conn.(*tls.Conn)
+	return ok && !tc.ConnectionState().HandshakeComplete
+}
+
+// loadTLSState stores the tls connection state of the client connection, if the handshake
+// has been completed. This allows hooks to inspect the verified client certificates (mTLS).
+func (cl *Client) loadTLSState() {
+	cs, ok := cl.Net.Conn.(tlsConnectionStater)
+	if !ok {
+		return
+	}
+
+	state := cs.ConnectionState()
+	if state.HandshakeComplete {
+		cl.Net.TLS = &state
+	}
+}
+
 // refreshDeadline refreshes the read/write deadline for the net.Conn connection.
 func (cl *Client) refreshDeadline(keepalive uint16) {
 	var expiry time.Time // nil time can be used to disable deadline if keepalive = 0
@@ -351,6 +527,7 @@ func (cl *Client) ClearExpiredInflights(now, maximumExpiry int64) []uint16 {
 		if expired || enforced {
 			if ok := cl.State.Inflight.Delete(tk.PacketID); ok {
 				cl.ops.hooks.OnQosDropped(cl, tk)
+				cl.ops.hooks.OnMessageDropped(cl, tk, DropExpired)
 				atomic.AddInt64(&cl.ops.info.Inflight, -1)
 				deleted = append(deleted, tk.PacketID)
 			}
@@ -405,10 +582,36 @@ func (cl *Client) Stop(err error) {
 			cl.State.cancelOpen()
 		}
 
+		if cl.State.cancelCtx != nil {
+			cl.State.cancelCtx(err)
+		}
+
 		atomic.StoreInt64(&cl.State.disconnected, time.Now().Unix())
 	})
 }
 
+// Context returns a context which is cancelled when the client is stopped or the server is
+// closed, with the reason as its cause (see context.Cause). Hooks doing I/O on behalf of the
+// client, such as calling an auth service, should use it so the call is abandoned once the
+// client is gone. It should not be used for writes which must complete after the client
+// disconnects, such as persisting its session.
+//
+// Once the client has stopped, calls are no longer made on behalf of a connected client but
+// for its stored session, such as acl checks for messages queued while it is offline, so a
+// context which is not cancelled is returned. Hooks should bound such calls with their own
+// timeouts.
+func (cl *Client) Context() context.Context {
+	if cl.State.ctx == nil {
+		return context.Background()
+	}
+
+	if cl.Closed() {
+		return context.WithoutCancel(cl.State.ctx)
+	}
+
+	return cl.State.ctx
+}
+
 // StopCause returns the reason the client connection was stopped, if any.
 func (cl *Client) StopCause() error {
 	if cl.State.stopCause.Load() == nil {
@@ -431,6 +634,17 @@ func (cl *Client) IsTakenOver() bool {
 	return cl.State.isTakenOver.Load()
 }
 
+// SetSuperuser sets whether the client is a superuser, which bypasses all acl checks.
+// It is intended to be set by auth hooks when the client authenticates.
+func (cl *Client) SetSuperuser(v bool) {
+	cl.State.superuser.Store(v)
+}
+
+// IsSuperuser returns true if the client is a superuser, which bypasses all acl checks.
+func (cl *Client) IsSuperuser() bool {
+	return cl.State.superuser.Load()
+}
+
 // ReadFixedHeader reads in the values of the next packet's fixed header.
 func (cl *Client) ReadFixedHeader(fh *packets.FixedHeader) error {
 	if cl.Net.bconn == nil {
@@ -555,6 +769,7 @@ func (cl *Client) WritePacket(pk packets.Packet) error {
 
 	pk = cl.ops.hooks.OnPacketEncode(cl, pk)
 
+	start := time.Now()
 	var err error
 	buf := new(bytes.Buffer)
 	switch pk.FixedHeader.Type {
@@ -640,6 +855,11 @@ func (cl *Client) WritePacket(pk packets.Packet) error {
 	}
 
 	cl.ops.hooks.OnPacketSent(cl, pk, buf.Bytes())
+	cl.ops.hooks.OnPacketWritten(cl, PacketWritten{
+		Type:     pk.FixedHeader.Type,
+		Size:     n,
+		Duration: time.Since(start),
+	})
 
 	return err
 }
@@ -8,11 +8,14 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"io"
 	"log/slog"
 	"net"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -118,6 +121,19 @@ func TestClientsDelete(t *testing.T) {
 	require.Nil(t, cl.internal["t1"])
 }
 
+func TestClientsCompareAndDelete(t *testing.T) {
+	cl := NewClients()
+	old := &Client{ID: "t1"}
+	cl.Add(old)
+	cl.Add(&Client{ID: "t1"})
+	require.False(t, cl.CompareAndDelete(old))
+	require.Contains(t, cl.internal, "t1")
+
+	v, _ := cl.Get("t1")
+	require.True(t, cl.CompareAndDelete(v))
+	require.NotContains(t, cl.internal, "t1")
+}
+
 func TestClientsGetByListener(t *testing.T) {
 	cl := NewClients()
 	cl.Add(&Client{ID: "t1", State: ClientState{open: context.Background()}, Net: ClientConnection{Listener: "tcp1"}})
@@ -131,6 +147,79 @@ func TestClientsGetByListener(t *testing.T) {
 	require.Equal(t, "tcp1", clients[0].Net.Listener)
 }
 
+func newQueryTestClients() *Clients {
+	cls := NewClients()
+	for _, c := range []struct {
+		id, listener, username string
+		filters                []string
+		closed                 bool
+	}{
+		{id: "t3", listener: "ws1", username: "bob", filters: []string{"a/b"}},
+		{id: "t1", listener: "tcp1", username: "alice", filters: []string{"a/b", "c/#"}},
+		{id: "t2", listener: "tcp1", username: "bob", closed: true},
+	} {
+		cl, _, _ := newTestClient()
+		cl.ID = c.id
+		cl.Net.Listener = c.listener
+		cl.Properties.Username = []byte(c.username)
+		for _, f := range c.filters {
+			cl.State.Subscriptions.Add(f, packets.Subscription{Filter: f})
+		}
+		if c.closed {
+			cl.Stop(packets.CodeDisconnect)
+		}
+		cls.Add(cl)
+	}
+
+	return cls
+}
+
+func TestClientsQuery(t *testing.T) {
+	cls := newQueryTestClients()
+
+	ids := func(views []ClientView) []string {
+		out := []string{}
+		for _, v := range views {
+			out = append(out, v.ID)
+		}
+		return out
+	}
+
+	require.Equal(t, []string{"t1", "t2", "t3"}, ids(cls.Query(ClientQuery{})))
+	require.Equal(t, []string{"t1", "t2"}, ids(cls.Query(ClientQuery{Listener: "tcp1"})))
+	require.Equal(t, []string{"t2", "t3"}, ids(cls.Query(ClientQuery{Username: "bob"})))
+	require.Equal(t, []string{"t1", "t3"}, ids(cls.Query(ClientQuery{Subscription: "a/b"})))
+	require.Equal(t, []string{"t1", "t3"}, ids(cls.Query(ClientQuery{Status: ClientStatusConnected})))
+	require.Equal(t, []string{"t2"}, ids(cls.Query(ClientQuery{Status: ClientStatusDisconnected})))
+	require.Equal(t, []string{"t3"}, ids(cls.Query(ClientQuery{Username: "bob", Status: ClientStatusConnected})))
+	require.Empty(t, cls.Query(ClientQuery{Subscription: "c/d"}))
+}
+
+func TestClientView(t *testing.T) {
+	cls := newQueryTestClients()
+	cl, ok := cls.Get("t1")
+	require.True(t, ok)
+	cl.Properties.ProtocolVersion = 5
+	cl.State.Inflight.Set(packets.Packet{PacketID: 1})
+
+	v := cl.View()
+	require.Equal(t, "t1", v.ID)
+	require.Equal(t, "tcp1", v.Listener)
+	require.Equal(t, "alice", v.Username)
+	require.Equal(t, []string{"a/b", "c/#"}, v.Subscriptions)
+	require.Equal(t, 1, v.Inflight)
+	require.Equal(t, defaultKeepalive, v.Keepalive)
+	require.Equal(t, byte(5), v.ProtocolVersion)
+	require.True(t, v.Connected)
+	require.Equal(t, int64(0), v.Disconnected)
+
+	cl, _ = cls.Get("t2")
+	v = cl.View()
+	require.False(t, v.Connected)
+	require.NotZero(t, v.Disconnected)
+	require.Empty(t, v.Subscriptions)
+}
+
 func TestNewClient(t *testing.T) {
 	cl, _, _ := newTestClient()
 
@@ -394,6 +483,21 @@ func TestClientClearExpiredInflights(t *testing.T) {
 	require.Equal(t, 4, cl.State.Inflight.Len())
 }
 
+func TestClientClearExpiredInflightsDropped(t *testing.T) {
+	cl, _, _ := newTestClient()
+	cl.ops.hooks.Log = logger
+	hook := new(droppedHook)
+	require.NoError(t, cl.ops.hooks.Add(hook, nil))
+
+	n := time.Now().Unix()
+	cl.State.Inflight.Set(packets.Packet{ProtocolVersion: 5, PacketID: 1, Expiry: n - 1})
+	cl.State.Inflight.Set(packets.Packet{ProtocolVersion: 5, PacketID: 2, Created: n})
+
+	deleted := cl.ClearExpiredInflights(n, 4)
+	require.Equal(t, []uint16{1}, deleted)
+	require.Equal(t, []DropReason{DropExpired}, hook.Reasons())
+}
+
 func TestClientResendInflightMessages(t *testing.T) {
 	pk1 := packets.TPacketData[packets.Puback].Get(packets.TPuback)
 	cl, r, w := newTestClient()
@@ -439,6 +543,52 @@ func TestClientRefreshDeadline(t *testing.T) {
 	require.NotNil(t, cl.Net.Conn) // how do we check net.Conn deadline?
 }
 
+type tlsStateConn struct {
+	net.Conn
+	state tls.ConnectionState
+}
+
+func (c *tlsStateConn) ConnectionState() tls.ConnectionState {
+	return c.state
+}
+
+func TestClientLoadTLSState(t *testing.T) {
+	cl, _, _ := newTestClient()
+	defer cl.Stop(errClientStop)
+
+	cert := &x509.Certificate{Raw: []byte("leaf")}
+	cl.Net.Conn = &tlsStateConn{
+		Conn: cl.Net.Conn,
+		state: tls.ConnectionState{
+			HandshakeComplete: true,
+			PeerCertificates:  []*x509.Certificate{cert},
+		},
+	}
+
+	cl.loadTLSState()
+	require.NotNil(t, cl.Net.TLS)
+	require.Equal(t, cert, cl.Net.PeerCertificate())
+}
+
+func TestClientLoadTLSStateIncompleteHandshake(t *testing.T) {
+	cl, _, _ := newTestClient()
+	defer cl.Stop(errClientStop)
+
+	cl.Net.Conn = &tlsStateConn{Conn: cl.Net.Conn}
+	cl.loadTLSState()
+	require.Nil(t, cl.Net.TLS)
+	require.Nil(t, cl.Net.PeerCertificate())
+}
+
+func TestClientLoadTLSStateNoTLS(t *testing.T) {
+	cl, _, _ := newTestClient()
+	defer cl.Stop(errClientStop)
+
+	cl.loadTLSState()
+	require.Nil(t, cl.Net.TLS)
+	require.Nil(t, cl.Net.PeerCertificate())
+}
+
 func TestClientReadFixedHeader(t *testing.T) {
 	cl, r, _ := newTestClient()
 
@@ -592,6 +742,27 @@ func TestClientStop(t *testing.T) {
 	require.Equal(t, nil, cl.StopCause())
 }
 
+func TestClientContext(t *testing.T) {
+	cl, _, _ := newTestClient()
+	ctx := cl.Context()
+	require.NoError(t, ctx.Err())
+	cl.Stop(packets.ErrSessionTakenOver)
+	require.ErrorIs(t, ctx.Err(), context.Canceled)
+	require.ErrorIs(t, context.Cause(ctx), packets.ErrSessionTakenOver)
+}
+
+func TestClientContextStopped(t *testing.T) {
+	cl, _, _ := newTestClient()
+	cl.Stop(packets.CodeDisconnect)
+	require.NoError(t, cl.Context().Err()) // calls for the stored session are not abandoned
+	require.Nil(t, context.Cause(cl.Context()))
+}
+
+func TestClientContextNil(t *testing.T) {
+	cl := new(Client)
+	require.Equal(t, context.Background(), cl.Context())
+}
+
 func TestClientClosed(t *testing.T) {
 	cl, _, _ := newTestClient()
 	require.False(t, cl.Closed())
@@ -606,6 +777,15 @@ func TestClientIsTakenOver(t *testing.T) {
 	require.True(t, cl.IsTakenOver())
 }
 
+func TestClientSuperuser(t *testing.T) {
+	cl, _, _ := newTestClient()
+	require.False(t, cl.IsSuperuser())
+	cl.SetSuperuser(true)
+	require.True(t, cl.IsSuperuser())
+	cl.SetSuperuser(false)
+	require.False(t, cl.IsSuperuser())
+}
+
 func TestClientReadFixedHeaderError(t *testing.T) {
 	cl, r, _ := newTestClient()
 	defer cl.Stop(errClientStop)
@@ -758,6 +938,53 @@ func TestClientWritePacket(t *testing.T) {
 	}
 }
 
+// writtenHook records the packets written to clients.
+type writtenHook struct {
+	HookBase
+	sync.Mutex
+	written []PacketWritten
+}
+
+func (h *writtenHook) ID() string {
+	return "written"
+}
+
+func (h *writtenHook) Provides(b byte) bool {
+	return b == OnPacketWritten
+}
+
+func (h *writtenHook) OnPacketWritten(cl *Client, w PacketWritten) {
+	h.Lock()
+	defer h.Unlock()
+	h.written = append(h.written, w)
+}
+
+func TestClientWritePacketWritten(t *testing.T) {
+	cl, r, _ := newTestClient()
+	defer cl.Stop(errClientStop)
+	cl.ops.hooks.Log = logger
+	hook := new(writtenHook)
+	err := cl.ops.hooks.Add(hook, nil)
+	require.NoError(t, err)
+
+	go func() {
+		_, _ = io.ReadAll(r)
+	}()
+
+	pk := *pkTable[3].Packet
+	cl.Properties.ProtocolVersion = pk.ProtocolVersion
+	err = cl.WritePacket(pk)
+	require.NoError(t, err)
+
+	hook.Lock()
+	defer hook.Unlock()
+	require.Len(t, hook.written, 1)
+	require.Equal(t, pk.FixedHeader.Type, hook.written[0].Type)
+	require.Equal(t, int64(len(pkTable[3].RawBytes)), hook.written[0].Size)
+	require.Equal(t, atomic.LoadInt64(&cl.ops.info.BytesSent), hook.written[0].Size)
+	require.Greater(t, hook.written[0].Duration, time.Duration(0))
+}
+
 func TestClientWritePacketBuffer(t *testing.T) {
 	r, w := net.Pipe()
 
@@ -10,11 +10,18 @@ import (
 	"os"
 
 	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/auth"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/auth/x509"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/bridge"
 	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/debug"
 	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage/badger"
 	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage/bolt"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage/cassandra"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage/leveldb"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage/memory"
 	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage/pebble"
 	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage/redis"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage/sqlstore"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage/wal"
 	"github.com/AMuzykus/mochi-mqtt-server/v2/listeners"
 	"gopkg.in/yaml.v3"
 
@@ -51,20 +58,77 @@ type HookConfigs struct {
 	Auth    *HookAuthConfig    `yaml:"auth" json:"auth"`
 	Storage *HookStorageConfig `yaml:"storage" json:"storage"`
 	Debug   *debug.Options     `yaml:"debug" json:"debug"`
+
+	// Bridge streams selected events to an external gRPC service, if set.
+	Bridge *bridge.Options `yaml:"bridge" json:"bridge"`
 }
 
 // HookAuthConfig contains configurations for the auth hook.
 type HookAuthConfig struct {
-	Ledger   auth.Ledger `yaml:"ledger" json:"ledger"`
-	AllowAll bool        `yaml:"allow_all" json:"allow_all"`
+	Ledger    auth.Ledger `yaml:"ledger" json:"ledger"`
+	AllowAll  bool        `yaml:"allow_all" json:"allow_all"`
+	Listeners []string    `yaml:"listeners" json:"listeners"` // if set, only clients of these listener ids are authenticated by the hook
+
+	// Timeout abandons the auth checks of the auth hook which do not return in time, if set.
+	Timeout *mqtt.TimeoutOptions `yaml:"timeout" json:"timeout"`
+
+	// LedgerSource is the path of a yaml or json ledger file, or an http or https url, which the
+	// ledger is loaded from and reloaded from when it changes, rather than the ledger above, if set.
+	LedgerSource string `yaml:"ledger_source" json:"ledger_source"`
+
+	// LedgerReloadInterval is the seconds between checks of the ledger source for changes (default 5).
+	LedgerReloadInterval int64 `yaml:"ledger_reload_interval" json:"ledger_reload_interval"`
+
+	// HTTP checks clients against HTTP endpoints rather than the ledger, if set.
+	HTTP *auth.HTTPOptions `yaml:"http" json:"http"`
+
+	// Mosquitto checks clients against mosquitto password and acl files rather than the ledger, if set.
+	Mosquitto *auth.MosquittoOptions `yaml:"mosquitto" json:"mosquitto"`
+
+	// OAuth2 checks clients against OAuth2 access tokens rather than the ledger, if set.
+	OAuth2 *auth.OAuth2Options `yaml:"oauth2" json:"oauth2"`
+
+	// X509 checks clients against their tls client certificates rather than the ledger, if set.
+	X509 *x509.Options `yaml:"x509" json:"x509"`
+
+	// Scram authenticates MQTT v5 clients with SCRAM-SHA-256 enhanced authentication rather than the ledger, if set.
+	Scram *auth.ScramOptions `yaml:"scram" json:"scram"`
+
+	// Vault checks clients against credentials read from HashiCorp Vault rather than the ledger, if set.
+	Vault *auth.VaultOptions `yaml:"vault" json:"vault"`
+
+	// SQL checks clients against credentials and ACLs selected from a SQL database rather than the ledger, if set.
+	SQL *auth.SQLOptions `yaml:"sql" json:"sql"`
+
+	// Redis checks clients against credentials and ACLs read from Redis rather than the ledger, if set.
+	Redis *auth.RedisOptions `yaml:"redis" json:"redis"`
+
+	// GRPC forwards connect and ACL checks to an external gRPC authorization service rather than the ledger, if set.
+	GRPC *auth.GRPCOptions `yaml:"grpc" json:"grpc"`
+
+	// Ban temporarily rejects the connections of ip addresses and usernames which repeatedly
+	// fail to authenticate, alongside any of the above, if set.
+	Ban *auth.BanOptions `yaml:"ban" json:"ban"`
+
+	// Audit logs a structured record of every ACL denial, alongside any of the above, if set.
+	Audit *auth.AuditOptions `yaml:"audit" json:"audit"`
 }
 
 // HookStorageConfig contains configurations for the different storage hooks.
 type HookStorageConfig struct {
-	Badger *badger.Options `yaml:"badger" json:"badger"`
-	Bolt   *bolt.Options   `yaml:"bolt" json:"bolt"`
-	Pebble *pebble.Options `yaml:"pebble" json:"pebble"`
-	Redis  *redis.Options  `yaml:"redis" json:"redis"`
+	Badger    *badger.Options    `yaml:"badger" json:"badger"`
+	Bolt      *bolt.Options      `yaml:"bolt" json:"bolt"`
+	Cassandra *cassandra.Options `yaml:"cassandra" json:"cassandra"`
+	LevelDB   *leveldb.Options   `yaml:"leveldb" json:"leveldb"`
+	Memory    *memory.Options    `yaml:"memory" json:"memory"`
+	Pebble    *pebble.Options    `yaml:"pebble" json:"pebble"`
+	Redis     *redis.Options     `yaml:"redis" json:"redis"`
+	SQL       *sqlstore.Options  `yaml:"sql" json:"sql"`
+	WAL       *wal.Options       `yaml:"wal" json:"wal"`
+
+	// Async dispatches the storage events of the storage hooks asynchronously, if set, so that
+	// slow writes do not stall packet processing.
+	Async *mqtt.AsyncOptions `yaml:"async" json:"async"`
 }
 
 // ToHooks converts Hook file configurations into Hooks to be added to the server.
@@ -86,6 +150,13 @@ func (hc HookConfigs) ToHooks() []mqtt.HookLoadConfig {
 		})
 	}
 
+	if hc.Bridge != nil {
+		hlc = append(hlc, mqtt.HookLoadConfig{
+			Hook:   new(bridge.Hook),
+			Config: hc.Bridge,
+		})
+	}
+
 	return hlc
 }
 
@@ -94,18 +165,95 @@ func (hc HookConfigs) toHooksAuth() []mqtt.HookLoadConfig {
 	var hlc []mqtt.HookLoadConfig
 	if hc.Auth.AllowAll {
 		hlc = append(hlc, mqtt.HookLoadConfig{
-			Hook: new(auth.AllowHook),
+			Hook:      new(auth.AllowHook),
+			Listeners: hc.Auth.Listeners,
+		})
+	} else if hc.Auth.HTTP != nil {
+		hlc = append(hlc, mqtt.HookLoadConfig{
+			Hook:      new(auth.HTTPHook),
+			Config:    hc.Auth.HTTP,
+			Listeners: hc.Auth.Listeners,
+		})
+	} else if hc.Auth.Mosquitto != nil {
+		hlc = append(hlc, mqtt.HookLoadConfig{
+			Hook:      new(auth.MosquittoHook),
+			Config:    hc.Auth.Mosquitto,
+			Listeners: hc.Auth.Listeners,
+		})
+	} else if hc.Auth.OAuth2 != nil {
+		hlc = append(hlc, mqtt.HookLoadConfig{
+			Hook:      new(auth.OAuth2Hook),
+			Config:    hc.Auth.OAuth2,
+			Listeners: hc.Auth.Listeners,
+		})
+	} else if hc.Auth.X509 != nil {
+		hlc = append(hlc, mqtt.HookLoadConfig{
+			Hook:      new(x509.Hook),
+			Config:    hc.Auth.X509,
+			Listeners: hc.Auth.Listeners,
+		})
+	} else if hc.Auth.Scram != nil {
+		hlc = append(hlc, mqtt.HookLoadConfig{
+			Hook:      new(auth.ScramHook),
+			Config:    hc.Auth.Scram,
+			Listeners: hc.Auth.Listeners,
+		})
+	} else if hc.Auth.Vault != nil {
+		hlc = append(hlc, mqtt.HookLoadConfig{
+			Hook:      new(auth.VaultHook),
+			Config:    hc.Auth.Vault,
+			Listeners: hc.Auth.Listeners,
+		})
+	} else if hc.Auth.SQL != nil {
+		hlc = append(hlc, mqtt.HookLoadConfig{
+			Hook:      new(auth.SQLHook),
+			Config:    hc.Auth.SQL,
+			Listeners: hc.Auth.Listeners,
+		})
+	} else if hc.Auth.Redis != nil {
+		hlc = append(hlc, mqtt.HookLoadConfig{
+			Hook:      new(auth.RedisHook),
+			Config:    hc.Auth.Redis,
+			Listeners: hc.Auth.Listeners,
+		})
+	} else if hc.Auth.GRPC != nil {
+		hlc = append(hlc, mqtt.HookLoadConfig{
+			Hook:      new(auth.GRPCHook),
+			Config:    hc.Auth.GRPC,
+			Listeners: hc.Auth.Listeners,
 		})
 	} else {
 		hlc = append(hlc, mqtt.HookLoadConfig{
 			Hook: new(auth.Hook),
 			Config: &auth.Options{
 				Ledger: &auth.Ledger{ // avoid copying sync.Locker
-					Users: hc.Auth.Ledger.Users,
-					Auth:  hc.Auth.Ledger.Auth,
-					ACL:   hc.Auth.Ledger.ACL,
+					Users:     hc.Auth.Ledger.Users,
+					Roles:     hc.Auth.Ledger.Roles,
+					Auth:      hc.Auth.Ledger.Auth,
+					ACL:       hc.Auth.Ledger.ACL,
+					ClientIDs: hc.Auth.Ledger.ClientIDs,
+					Anonymous: hc.Auth.Ledger.Anonymous,
 				},
+				Source:         hc.Auth.LedgerSource,
+				ReloadInterval: hc.Auth.LedgerReloadInterval,
 			},
+			Listeners: hc.Auth.Listeners,
+		})
+	}
+
+	hlc[0].Timeout = hc.Auth.Timeout
+
+	if hc.Auth.Ban != nil {
+		hlc = append(hlc, mqtt.HookLoadConfig{
+			Hook:   new(auth.BanHook),
+			Config: hc.Auth.Ban,
+		})
+	}
+
+	if hc.Auth.Audit != nil {
+		hlc = append(hlc, mqtt.HookLoadConfig{
+			Hook:   new(auth.AuditHook),
+			Config: hc.Auth.Audit,
 		})
 	}
 	return hlc
@@ -141,6 +289,48 @@ func (hc HookConfigs) toHooksStorage() []mqtt.HookLoadConfig {
 			Config: hc.Storage.Pebble,
 		})
 	}
+
+	if hc.Storage.Cassandra != nil {
+		hlc = append(hlc, mqtt.HookLoadConfig{
+			Hook:   new(cassandra.Hook),
+			Config: hc.Storage.Cassandra,
+		})
+	}
+
+	if hc.Storage.SQL != nil {
+		hlc = append(hlc, mqtt.HookLoadConfig{
+			Hook:   new(sqlstore.Hook),
+			Config: hc.Storage.SQL,
+		})
+	}
+
+	if hc.Storage.LevelDB != nil {
+		hlc = append(hlc, mqtt.HookLoadConfig{
+			Hook:   new(leveldb.Hook),
+			Config: hc.Storage.LevelDB,
+		})
+	}
+
+	if hc.Storage.Memory != nil {
+		hlc = append(hlc, mqtt.HookLoadConfig{
+			Hook:   new(memory.Hook),
+			Config: hc.Storage.Memory,
+		})
+	}
+
+	if hc.Storage.WAL != nil {
+		hlc = append(hlc, mqtt.HookLoadConfig{
+			Hook:   new(wal.Hook),
+			Config: hc.Storage.WAL,
+		})
+	}
+
+	if hc.Storage.Async != nil {
+		for i := range hlc {
+			hlc[i].Async = hc.Storage.Async
+		}
+	}
+
 	return hlc
 }
 
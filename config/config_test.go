@@ -12,10 +12,17 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/auth"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/auth/x509"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/bridge"
 	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage/badger"
 	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage/bolt"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage/cassandra"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage/leveldb"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage/memory"
 	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage/pebble"
 	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage/redis"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage/sqlstore"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage/wal"
 	"github.com/AMuzykus/mochi-mqtt-server/v2/listeners"
 
 	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
@@ -104,6 +111,27 @@ func TestFromBytesYAMLError(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestFromBytesListenerOptions(t *testing.T) {
+	o, err := FromBytes([]byte(`
+listeners:
+  - type: "tcp"
+    id: "file-tcp1"
+    address: ":1883"
+    max_connections: 1000
+    accept_rate: 50
+    tcp:
+      keep_alive_idle: 120
+      no_delay: false
+`))
+	require.NoError(t, err)
+	require.Len(t, o.Listeners, 1)
+	require.Equal(t, int64(1000), o.Listeners[0].MaxConnections)
+	require.Equal(t, float64(50), o.Listeners[0].AcceptRate)
+	require.Equal(t, 120, o.Listeners[0].TCP.KeepAliveIdle)
+	require.False(t, *o.Listeners[0].TCP.NoDelay)
+	require.Nil(t, o.Listeners[0].TCP.Linger)
+}
+
 func TestFromBytesJSON(t *testing.T) {
 	o, err := FromBytes(jsonBytes)
 	require.NoError(t, err)
@@ -129,6 +157,227 @@ func TestToHooksAuthAllowAll(t *testing.T) {
 	require.Equal(t, expect, th)
 }
 
+func TestToHooksAuthListeners(t *testing.T) {
+	hc := HookConfigs{
+		Auth: &HookAuthConfig{
+			AllowAll:  true,
+			Listeners: []string{"internal"},
+		},
+	}
+
+	th := hc.toHooksAuth()
+	expect := []mqtt.HookLoadConfig{
+		{Hook: new(auth.AllowHook), Listeners: []string{"internal"}},
+	}
+	require.Equal(t, expect, th)
+}
+
+func TestToHooksAuthTimeout(t *testing.T) {
+	hc := HookConfigs{
+		Auth: &HookAuthConfig{
+			HTTP: &auth.HTTPOptions{
+				ConnectURL: "http://localhost:8080/connect",
+			},
+			Timeout: &mqtt.TimeoutOptions{
+				Timeout: 500,
+				Policy:  mqtt.TimeoutSkip,
+			},
+		},
+	}
+
+	th := hc.toHooksAuth()
+	expect := []mqtt.HookLoadConfig{
+		{Hook: new(auth.HTTPHook), Config: hc.Auth.HTTP, Timeout: hc.Auth.Timeout},
+	}
+	require.Equal(t, expect, th)
+}
+
+func TestToHooksAuthHTTP(t *testing.T) {
+	hc := HookConfigs{
+		Auth: &HookAuthConfig{
+			HTTP: &auth.HTTPOptions{
+				ConnectURL: "http://localhost:8080/connect",
+				ACLURL:     "http://localhost:8080/acl",
+				CacheTTL:   30,
+			},
+		},
+	}
+
+	th := hc.toHooksAuth()
+	expect := []mqtt.HookLoadConfig{
+		{Hook: new(auth.HTTPHook), Config: hc.Auth.HTTP},
+	}
+	require.Equal(t, expect, th)
+}
+
+func TestToHooksAuthMosquitto(t *testing.T) {
+	hc := HookConfigs{
+		Auth: &HookAuthConfig{
+			Mosquitto: &auth.MosquittoOptions{
+				PasswordFile: "/etc/mosquitto/passwd",
+				ACLFile:      "/etc/mosquitto/acl",
+			},
+			Listeners: []string{"public"},
+		},
+	}
+
+	th := hc.toHooksAuth()
+	expect := []mqtt.HookLoadConfig{
+		{Hook: new(auth.MosquittoHook), Config: hc.Auth.Mosquitto, Listeners: []string{"public"}},
+	}
+	require.Equal(t, expect, th)
+}
+
+func TestToHooksAuthOAuth2(t *testing.T) {
+	hc := HookConfigs{
+		Auth: &HookAuthConfig{
+			OAuth2: &auth.OAuth2Options{
+				IntrospectionURL: "http://localhost:8080/introspect",
+				Scopes: map[string]auth.Filters{
+					"sensors:read": {"sensors/#": auth.ReadOnly},
+				},
+			},
+		},
+	}
+
+	th := hc.toHooksAuth()
+	expect := []mqtt.HookLoadConfig{
+		{Hook: new(auth.OAuth2Hook), Config: hc.Auth.OAuth2},
+	}
+	require.Equal(t, expect, th)
+}
+
+func TestToHooksAuthX509(t *testing.T) {
+	hc := HookConfigs{
+		Auth: &HookAuthConfig{
+			X509: &x509.Options{
+				Identity:      x509.IdentityDNS,
+				MatchClientID: true,
+			},
+			Listeners: []string{"tls"},
+		},
+	}
+
+	th := hc.toHooksAuth()
+	expect := []mqtt.HookLoadConfig{
+		{Hook: new(x509.Hook), Config: hc.Auth.X509, Listeners: []string{"tls"}},
+	}
+	require.Equal(t, expect, th)
+}
+
+func TestToHooksAuthScram(t *testing.T) {
+	hc := HookConfigs{
+		Auth: &HookAuthConfig{
+			Scram: &auth.ScramOptions{
+				Users: map[string]string{"mochi": "melon"},
+			},
+		},
+	}
+
+	th := hc.toHooksAuth()
+	expect := []mqtt.HookLoadConfig{
+		{Hook: new(auth.ScramHook), Config: hc.Auth.Scram},
+	}
+	require.Equal(t, expect, th)
+}
+
+func TestToHooksAuthVault(t *testing.T) {
+	hc := HookConfigs{
+		Auth: &HookAuthConfig{
+			Vault: &auth.VaultOptions{
+				Address: "https://vault:8200",
+			},
+		},
+	}
+
+	th := hc.toHooksAuth()
+	expect := []mqtt.HookLoadConfig{
+		{Hook: new(auth.VaultHook), Config: hc.Auth.Vault},
+	}
+	require.Equal(t, expect, th)
+}
+
+func TestToHooksAuthSQL(t *testing.T) {
+	hc := HookConfigs{
+		Auth: &HookAuthConfig{
+			SQL: &auth.SQLOptions{
+				Driver:    "pgx",
+				UserQuery: "SELECT password FROM mqtt_users WHERE username = $1",
+			},
+		},
+	}
+
+	th := hc.toHooksAuth()
+	expect := []mqtt.HookLoadConfig{
+		{Hook: new(auth.SQLHook), Config: hc.Auth.SQL},
+	}
+	require.Equal(t, expect, th)
+}
+
+func TestToHooksAuthRedis(t *testing.T) {
+	hc := HookConfigs{
+		Auth: &HookAuthConfig{
+			Redis: &auth.RedisOptions{
+				Address: "localhost:6379",
+			},
+		},
+	}
+
+	th := hc.toHooksAuth()
+	expect := []mqtt.HookLoadConfig{
+		{Hook: new(auth.RedisHook), Config: hc.Auth.Redis},
+	}
+	require.Equal(t, expect, th)
+}
+
+func TestToHooksAuthGRPC(t *testing.T) {
+	hc := HookConfigs{
+		Auth: &HookAuthConfig{
+			GRPC: &auth.GRPCOptions{
+				Address: "authz:9000",
+			},
+		},
+	}
+
+	th := hc.toHooksAuth()
+	expect := []mqtt.HookLoadConfig{
+		{Hook: new(auth.GRPCHook), Config: hc.Auth.GRPC},
+	}
+	require.Equal(t, expect, th)
+}
+
+func TestToHooksAuthBan(t *testing.T) {
+	hc := HookConfigs{
+		Auth: &HookAuthConfig{
+			AllowAll: true,
+			Ban:      &auth.BanOptions{MaxFailures: 3},
+		},
+	}
+
+	th := hc.toHooksAuth()
+	expect := []mqtt.HookLoadConfig{
+		{Hook: new(auth.AllowHook)},
+		{Hook: new(auth.BanHook), Config: hc.Auth.Ban},
+	}
+	require.Equal(t, expect, th)
+}
+
+func TestToHooksAuthAudit(t *testing.T) {
+	hc := HookConfigs{
+		Auth: &HookAuthConfig{
+			AllowAll: true,
+			Audit:    &auth.AuditOptions{Level: "info"},
+		},
+	}
+
+	th := hc.toHooksAuth()
+	expect := []mqtt.HookLoadConfig{
+		{Hook: new(auth.AllowHook)},
+		{Hook: new(auth.AuditHook), Config: hc.Auth.Audit},
+	}
+	require.Equal(t, expect, th)
+}
+
 func TestToHooksAuthAllowLedger(t *testing.T) {
 	hc := HookConfigs{
 		Auth: &HookAuthConfig{
@@ -156,6 +405,28 @@ func TestToHooksAuthAllowLedger(t *testing.T) {
 	require.Equal(t, expect, th)
 }
 
+func TestToHooksAuthLedgerSource(t *testing.T) {
+	hc := HookConfigs{
+		Auth: &HookAuthConfig{
+			LedgerSource:         "ledger.yaml",
+			LedgerReloadInterval: 30,
+		},
+	}
+
+	th := hc.toHooksAuth()
+	expect := []mqtt.HookLoadConfig{
+		{
+			Hook: new(auth.Hook),
+			Config: &auth.Options{
+				Ledger:         &auth.Ledger{},
+				Source:         "ledger.yaml",
+				ReloadInterval: 30,
+			},
+		},
+	}
+	require.Equal(t, expect, th)
+}
+
 func TestToHooksStorageBadger(t *testing.T) {
 	hc := HookConfigs{
 		Storage: &HookStorageConfig{
@@ -217,6 +488,111 @@ func TestToHooksStorageRedis(t *testing.T) {
 	require.Equal(t, expect, th)
 }
 
+func TestToHooksStorageCassandra(t *testing.T) {
+	hc := HookConfigs{
+		Storage: &HookStorageConfig{
+			Cassandra: &cassandra.Options{
+				Hosts:    []string{"localhost:9042"},
+				Keyspace: "mochi",
+			},
+		},
+	}
+
+	th := hc.toHooksStorage()
+	expect := []mqtt.HookLoadConfig{
+		{
+			Hook:   new(cassandra.Hook),
+			Config: hc.Storage.Cassandra,
+		},
+	}
+
+	require.Equal(t, expect, th)
+}
+
+func TestToHooksStorageSQL(t *testing.T) {
+	hc := HookConfigs{
+		Storage: &HookStorageConfig{
+			SQL: &sqlstore.Options{
+				Driver: "postgres",
+				DSN:    "postgres://localhost/mochi",
+			},
+		},
+	}
+
+	th := hc.toHooksStorage()
+	expect := []mqtt.HookLoadConfig{
+		{
+			Hook:   new(sqlstore.Hook),
+			Config: hc.Storage.SQL,
+		},
+	}
+
+	require.Equal(t, expect, th)
+}
+
+func TestToHooksStorageLevelDB(t *testing.T) {
+	hc := HookConfigs{
+		Storage: &HookStorageConfig{
+			LevelDB: &leveldb.Options{
+				Path: "leveldb",
+				Mode: leveldb.Sync,
+			},
+		},
+	}
+
+	th := hc.toHooksStorage()
+	expect := []mqtt.HookLoadConfig{
+		{
+			Hook:   new(leveldb.Hook),
+			Config: hc.Storage.LevelDB,
+		},
+	}
+
+	require.Equal(t, expect, th)
+}
+
+func TestToHooksStorageMemory(t *testing.T) {
+	hc := HookConfigs{
+		Storage: &HookStorageConfig{
+			Memory: &memory.Options{
+				Path:             "mochi.snapshot",
+				SnapshotInterval: 30,
+			},
+		},
+	}
+
+	th := hc.toHooksStorage()
+	expect := []mqtt.HookLoadConfig{
+		{
+			Hook:   new(memory.Hook),
+			Config: hc.Storage.Memory,
+		},
+	}
+
+	require.Equal(t, expect, th)
+}
+
+func TestToHooksStorageWAL(t *testing.T) {
+	hc := HookConfigs{
+		Storage: &HookStorageConfig{
+			WAL: &wal.Options{
+				Path: "mochi.wal",
+				Sync: true,
+			},
+		},
+	}
+
+	th := hc.toHooksStorage()
+	expect := []mqtt.HookLoadConfig{
+		{
+			Hook:   new(wal.Hook),
+			Config: hc.Storage.WAL,
+		},
+	}
+
+	require.Equal(t, expect, th)
+}
+
 func TestToHooksStoragePebble(t *testing.T) {
 	hc := HookConfigs{
 		Storage: &HookStorageConfig{
@@ -236,3 +612,43 @@ func TestToHooksStoragePebble(t *testing.T) {
 
 	require.Equal(t, expect, th)
 }
+
+func TestToHooksStorageAsync(t *testing.T) {
+	hc := HookConfigs{
+		Storage: &HookStorageConfig{
+			Pebble: &pebble.Options{
+				Path: "pebble",
+			},
+			Async: &mqtt.AsyncOptions{
+				Workers:  4,
+				Overflow: mqtt.OverflowDrop,
+			},
+		},
+	}
+
+	th := hc.toHooksStorage()
+	expect := []mqtt.HookLoadConfig{
+		{
+			Hook:   new(pebble.Hook),
+			Config: hc.Storage.Pebble,
+			Async:  hc.Storage.Async,
+		},
+	}
+
+	require.Equal(t, expect, th)
+}
+
+func TestToHooksBridge(t *testing.T) {
+	hc := HookConfigs{
+		Bridge: &bridge.Options{
+			Address: "extensions:9000",
+			Events:  []string{bridge.EventPublish, bridge.EventDisconnect},
+		},
+	}
+
+	th := hc.ToHooks()
+	expect := []mqtt.HookLoadConfig{
+		{Hook: new(bridge.Hook), Config: hc.Bridge},
+	}
+	require.Equal(t, expect, th)
+}
@@ -0,0 +1,207 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+)
+
+const (
+	// defaultAsyncWorkers is the default number of workers calling an asynchronous hook.
+	defaultAsyncWorkers = 1
+
+	// defaultAsyncQueueSize is the default number of events queued for each worker.
+	defaultAsyncQueueSize = 1024
+)
+
+// OverflowPolicy determines what happens to an event when the queue of an asynchronous hook is full.
+type OverflowPolicy byte
+
+const (
+	OverflowBlock OverflowPolicy = iota // wait until the queue has space, slowing the caller
+	OverflowDrop                        // drop the event without calling the hook
+)
+
+// AsyncOptions contains the options for dispatching the notification events of a hook
+// asynchronously. Notification events are events which do not return a value, such as
+// OnPublished, OnSysInfoTick, OnDisconnect and the OnRetainMessage and OnQosPublish events used
+// by storage hooks. All other events are still called inline.
+type AsyncOptions struct {
+	// Workers is the number of goroutines calling the hook (default 1). Events of the same client
+	// are always called by the same worker, so they are received in order.
+	Workers int `yaml:"workers" json:"workers"`
+
+	// QueueSize is the number of events which may be queued for each worker (default 1024).
+	QueueSize int `yaml:"queue_size" json:"queue_size"`
+
+	// Overflow is the policy applied when a queue is full (default OverflowBlock).
+	Overflow OverflowPolicy `yaml:"overflow" json:"overflow"`
+}
+
+// TimeoutPolicy determines the result of a hook check which does not return within its timeout.
+type TimeoutPolicy byte
+
+const (
+	TimeoutDeny  TimeoutPolicy = iota // deny the client or reject the packet
+	TimeoutAllow                      // allow the client or accept the packet without checking further hooks
+	TimeoutSkip                       // ignore the hook and continue with the next hook
+)
+
+// TimeoutOptions contains the timeout of the blocking checks of a hook: OnConnectAuthenticate,
+// OnACLCheck and OnPublish. A check which does not return within the timeout is abandoned and
+// resolved by the policy, so a hung backend cannot freeze clients. The abandoned call continues
+// in the background until it returns, and its result is discarded. Removing or stopping the hook
+// does not wait for abandoned calls, so hooks with timeouts should tolerate being stopped while
+// a call is in progress.
+type TimeoutOptions struct {
+	// Timeout is the milliseconds to wait for a check to return. Checks are not timed if 0.
+	Timeout int64 `yaml:"timeout" json:"timeout"`
+
+	// Policy is the result of a check which timed out (default TimeoutDeny).
+	Policy TimeoutPolicy `yaml:"policy" json:"policy"`
+}
+
+// publishResult is the result of an OnPublish call.
+type publishResult struct {
+	pk  packets.Packet
+	err error
+}
+
+// timed calls fn, which calls a check method of the hook at index i, within the timeout of the
+// hook, returning false if it did not return in time. The result is def if the hook panics.
+// A call which times out continues in the background, but no longer holds the set, so that a
+// hung call cannot prevent the hook from being removed.
+func timed[T any](h *Hooks, hs *hookSet, i int, event byte, def T, fn func() T) (T, bool) {
+	hook, t := hs.hooks[i], hs.timeouts[i]
+	res := make(chan T, 1)
+	var released atomic.Bool
+	release := func() {
+		if released.CompareAndSwap(false, true) {
+			hs.release()
+		}
+	}
+
+	atomic.AddInt64(&hs.refs, 1) // the caller holds the set, so it cannot be drained yet
+	go func() {
+		defer release()
+		v := def
+		h.guard(hs, i, event, func() { v = fn() })
+		res <- v
+	}()
+
+	timer := time.NewTimer(time.Duration(t.Timeout) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case v := <-res:
+		return v, true
+	case <-timer.C:
+		release() // the abandoned call is not waited for when the set is drained
+		h.Log.Warn("hook call timed out", "hook", hook.ID(), "timeout", t.Timeout, "policy", t.Policy)
+		hs.failed(i, event)
+		return def, false
+	}
+}
+
+// hookDispatcher calls the notification events of a hook from a bounded pool of workers, so
+// that a slow hook does not stall packet processing.
+type hookDispatcher struct {
+	sync.RWMutex
+	hook    string         // the id of the hook
+	log     *slog.Logger   // the logger of the hooks
+	opts    AsyncOptions   // the options of the dispatcher
+	queues  []chan func()  // a queue of event calls for each worker
+	wg      sync.WaitGroup // a waitgroup for the workers
+	dropped atomic.Int64   // the number of events dropped by the overflow policy
+	closed  bool           // true once the dispatcher has been closed
+}
+
+// newHookDispatcher returns a new dispatcher for a hook, with its workers started.
+func newHookDispatcher(hook string, log *slog.Logger, opts AsyncOptions) *hookDispatcher {
+	if opts.Workers < 1 {
+		opts.Workers = defaultAsyncWorkers
+	}
+
+	if opts.QueueSize < 1 {
+		opts.QueueSize = defaultAsyncQueueSize
+	}
+
+	d := &hookDispatcher{
+		hook:   hook,
+		log:    log,
+		opts:   opts,
+		queues: make([]chan func(), opts.Workers),
+	}
+
+	for i := range d.queues {
+		d.queues[i] = make(chan func(), opts.QueueSize)
+		d.wg.Add(1)
+		go d.work(d.queues[i])
+	}
+
+	return d
+}
+
+// work calls the events in a queue until it is closed.
+func (d *hookDispatcher) work(queue chan func()) {
+	defer d.wg.Done()
+	for fn := range queue {
+		fn()
+	}
+}
+
+// dispatch queues an event call on the worker for a key, usually a client id, applying the
+// overflow policy if the queue is full. Events dispatched after the dispatcher has been closed
+// are called inline.
+func (d *hookDispatcher) dispatch(key string, fn func()) {
+	d.RLock()
+	defer d.RUnlock()
+	if d.closed {
+		fn()
+		return
+	}
+
+	queue := d.queues[0]
+	if len(d.queues) > 1 {
+		f := fnv.New32a()
+		_, _ = f.Write([]byte(key))
+		queue = d.queues[f.Sum32()%uint32(len(d.queues))]
+	}
+
+	if d.opts.Overflow == OverflowBlock {
+		queue <- fn
+		return
+	}
+
+	select {
+	case queue <- fn:
+	default:
+		if n := d.dropped.Add(1); d.log != nil && (n == 1 || n%1000 == 0) {
+			d.log.Warn("async hook queue full, dropping events", "hook", d.hook, "dropped", n)
+		}
+	}
+}
+
+// close stops accepting events and waits for the queued events to be called.
+func (d *hookDispatcher) close() {
+	d.Lock()
+	if d.closed {
+		d.Unlock()
+		return
+	}
+
+	d.closed = true
+	for _, queue := range d.queues {
+		close(queue)
+	}
+	d.Unlock()
+
+	d.wg.Wait()
+}
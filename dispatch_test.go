@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHookDispatcherDefaults(t *testing.T) {
+	d := newHookDispatcher("test", logger, AsyncOptions{})
+	defer d.close()
+
+	require.Len(t, d.queues, defaultAsyncWorkers)
+	require.Equal(t, defaultAsyncQueueSize, cap(d.queues[0]))
+	require.Equal(t, OverflowBlock, d.opts.Overflow)
+}
+
+func TestHookDispatcherOrdered(t *testing.T) {
+	d := newHookDispatcher("test", logger, AsyncOptions{Workers: 4, QueueSize: 8})
+
+	var mu sync.Mutex
+	got := map[string][]int{}
+	for i := 0; i < 100; i++ {
+		for _, key := range []string{"a", "b", "c"} {
+			d.dispatch(key, func() {
+				mu.Lock()
+				got[key] = append(got[key], i)
+				mu.Unlock()
+			})
+		}
+	}
+
+	d.close() // waits for the queued events
+	for _, key := range []string{"a", "b", "c"} {
+		require.Len(t, got[key], 100)
+		for i, v := range got[key] {
+			require.Equal(t, i, v) // events with the same key are called in order
+		}
+	}
+}
+
+func TestHookDispatcherOverflowDrop(t *testing.T) {
+	d := newHookDispatcher("test", logger, AsyncOptions{QueueSize: 1, Overflow: OverflowDrop})
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	d.dispatch("a", func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	var called int
+	d.dispatch("a", func() { called++ }) // queued
+	d.dispatch("a", func() { called++ }) // dropped
+	d.dispatch("a", func() { called++ }) // dropped
+	require.Equal(t, int64(2), d.dropped.Load())
+
+	close(release)
+	d.close()
+	require.Equal(t, 1, called)
+}
+
+func TestHookDispatcherOverflowBlock(t *testing.T) {
+	d := newHookDispatcher("test", logger, AsyncOptions{QueueSize: 1})
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	d.dispatch("a", func() {
+		close(started)
+		<-release
+	})
+	<-started
+	d.dispatch("a", func() {}) // fills the queue
+
+	dispatched := make(chan struct{})
+	go func() {
+		d.dispatch("a", func() {})
+		close(dispatched)
+	}()
+
+	select {
+	case <-dispatched:
+		t.Fatal("expected dispatch to block while the queue is full")
+	default:
+	}
+
+	close(release)
+	<-dispatched
+	d.close()
+	require.Equal(t, int64(0), d.dropped.Load())
+}
+
+func TestHookDispatcherClosed(t *testing.T) {
+	d := newHookDispatcher("test", logger, AsyncOptions{})
+	d.close()
+	d.close() // closing again is a no-op
+
+	var called bool
+	d.dispatch("a", func() { called = true })
+	require.True(t, called) // called inline once closed
+}
@@ -0,0 +1,62 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/auth"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage/leveldb"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/listeners"
+)
+
+func main() {
+	leveldbPath := ".leveldb"
+	defer os.RemoveAll(leveldbPath) // remove the example leveldb files at the end
+
+	sigs := make(chan os.Signal, 1)
+	done := make(chan bool, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		done <- true
+	}()
+
+	server := mqtt.New(nil)
+	_ = server.AddHook(new(auth.AllowHook), nil)
+
+	err := server.AddHook(new(leveldb.Hook), &leveldb.Options{
+		Path: leveldbPath,
+		Mode: leveldb.NoSync,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tcp := listeners.NewTCP(listeners.Config{
+		ID:      "t1",
+		Address: ":1883",
+	})
+	err = server.AddListener(tcp)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go func() {
+		err := server.Serve()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	<-done
+	server.Log.Warn("caught signal, stopping...")
+	_ = server.Close()
+	server.Log.Info("main.go finished")
+}
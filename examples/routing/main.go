@@ -0,0 +1,136 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/auth"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/listeners"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+)
+
+func main() {
+	sigs := make(chan os.Signal, 1)
+	done := make(chan bool, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		done <- true
+	}()
+
+	server := mqtt.New(nil)
+	_ = server.AddHook(new(auth.AllowHook), nil)
+
+	// Route messages by region, using the client id prefix of each client as its region.
+	err := server.AddHook(new(RegionHook), &RegionHookOptions{
+		Regions: []string{"eu", "us"},
+		Monitor: "ops-monitor",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tcp := listeners.NewTCP(listeners.Config{
+		ID:      "t1",
+		Address: ":1883",
+	})
+	err = server.AddListener(tcp)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go func() {
+		err := server.Serve()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	<-done
+	server.Log.Warn("caught signal, stopping...")
+	_ = server.Close()
+	server.Log.Info("main.go finished")
+}
+
+// RegionHookOptions contains configuration settings for the region hook.
+type RegionHookOptions struct {
+	Regions []string // the regions, which are also the client id prefixes of the clients in them
+	Monitor string   // the id of a client which receives every alert, regardless of region
+}
+
+// RegionHook is an example of custom routing with OnSelectSubscribers. Messages published to
+// region/<region>/... are only delivered to clients in that region, each shared subscription
+// group is served by a member in the region of the publisher where possible, and messages
+// published to alerts/... are also delivered to the monitor client at qos 1.
+type RegionHook struct {
+	mqtt.HookBase
+	config *RegionHookOptions
+}
+
+func (h *RegionHook) ID() string {
+	return "region-example"
+}
+
+func (h *RegionHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSelectSubscribers,
+	}, []byte{b})
+}
+
+func (h *RegionHook) Init(config any) error {
+	if _, ok := config.(*RegionHookOptions); !ok || config == nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	h.config = config.(*RegionHookOptions)
+	return nil
+}
+
+// region returns the region of a topic or client id, or an empty string if it has none.
+func (h *RegionHook) region(s string) string {
+	for _, r := range h.config.Regions {
+		if strings.HasPrefix(s, r+"-") || strings.HasPrefix(s, "region/"+r+"/") {
+			return r
+		}
+	}
+
+	return ""
+}
+
+func (h *RegionHook) OnSelectSubscribers(subs *mqtt.Subscribers, pk packets.Packet) *mqtt.Subscribers {
+	if region := h.region(pk.TopicName); region != "" {
+		// forbid delivery to clients in other regions
+		subs.Filter(func(id string, sub packets.Subscription) bool {
+			return h.region(id) == region
+		})
+	}
+
+	// serve each shared subscription group from the region of the publisher where possible
+	origin := h.region(pk.Origin)
+	subs.SelectSharedBy(func(group string, members []string) string {
+		for _, id := range members {
+			if h.region(id) == origin {
+				return id
+			}
+		}
+
+		return members[0]
+	})
+
+	if strings.HasPrefix(pk.TopicName, "alerts/") {
+		// force delivery to the monitor, even if it has not subscribed
+		subs.Add(h.config.Monitor, packets.Subscription{Filter: "alerts/#"})
+		subs.SetQos(h.config.Monitor, 1)
+	}
+
+	return subs
+}
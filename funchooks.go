@@ -0,0 +1,169 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+)
+
+// funcHook is a hook which calls a single function for one event, so simple integrations can
+// handle an event without implementing a Hook. It is added by the event registration methods
+// of the server, such as Server.OnPublish.
+type funcHook struct {
+	HookBase
+	id                    string
+	event                 byte
+	onConnectAuthenticate func(cl *Client, pk packets.Packet) bool
+	onACLCheck            func(cl *Client, topic string, write bool) bool
+	onConnect             func(cl *Client, pk packets.Packet) error
+	onSessionEstablished  func(cl *Client, pk packets.Packet)
+	onDisconnect          func(cl *Client, err error, expire bool)
+	onSubscribed          func(cl *Client, pk packets.Packet, reasonCodes []byte)
+	onUnsubscribed        func(cl *Client, pk packets.Packet)
+	onPublish             func(cl *Client, pk packets.Packet) (packets.Packet, error)
+	onPublished           func(cl *Client, pk packets.Packet)
+	onMessageDropped      func(cl *Client, pk packets.Packet, reason DropReason)
+}
+
+// ID returns the ID of the hook.
+func (h *funcHook) ID() string {
+	return h.id
+}
+
+// Provides indicates the hook provides only the event of its function.
+func (h *funcHook) Provides(b byte) bool {
+	return b == h.event
+}
+
+// OnConnectAuthenticate calls the function of the hook.
+func (h *funcHook) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool {
+	return h.onConnectAuthenticate(cl, pk)
+}
+
+// OnACLCheck calls the function of the hook.
+func (h *funcHook) OnACLCheck(cl *Client, topic string, write bool) bool {
+	return h.onACLCheck(cl, topic, write)
+}
+
+// OnConnect calls the function of the hook.
+func (h *funcHook) OnConnect(cl *Client, pk packets.Packet) error {
+	return h.onConnect(cl, pk)
+}
+
+// OnSessionEstablished calls the function of the hook.
+func (h *funcHook) OnSessionEstablished(cl *Client, pk packets.Packet) {
+	h.onSessionEstablished(cl, pk)
+}
+
+// OnDisconnect calls the function of the hook.
+func (h *funcHook) OnDisconnect(cl *Client, err error, expire bool) {
+	h.onDisconnect(cl, err, expire)
+}
+
+// OnSubscribed calls the function of the hook.
+func (h *funcHook) OnSubscribed(cl *Client, pk packets.Packet, reasonCodes []byte) {
+	h.onSubscribed(cl, pk, reasonCodes)
+}
+
+// OnUnsubscribed calls the function of the hook.
+func (h *funcHook) OnUnsubscribed(cl *Client, pk packets.Packet) {
+	h.onUnsubscribed(cl, pk)
+}
+
+// OnPublish calls the function of the hook.
+func (h *funcHook) OnPublish(cl *Client, pk packets.Packet) (packets.Packet, error) {
+	return h.onPublish(cl, pk)
+}
+
+// OnPublished calls the function of the hook.
+func (h *funcHook) OnPublished(cl *Client, pk packets.Packet) {
+	h.onPublished(cl, pk)
+}
+
+// OnMessageDropped calls the function of the hook.
+func (h *funcHook) OnMessageDropped(cl *Client, pk packets.Packet, reason DropReason) {
+	h.onMessageDropped(cl, pk, reason)
+}
+
+// addFuncHook adds a hook which calls a function for an event. The hook is given an id made
+// of the event name and the number of function hooks added to the server, such as
+// func-OnPublish-1, so it can be removed with RemoveHook.
+func (s *Server) addFuncHook(event byte, set func(h *funcHook)) (string, error) {
+	n := atomic.AddInt64(&s.funcHooks, 1)
+	h := &funcHook{
+		id:    "func-" + hookEventNames[event] + "-" + strconv.FormatInt(n, 10),
+		event: event,
+	}
+	set(h)
+
+	if err := s.AddHook(h, nil); err != nil {
+		return "", err
+	}
+
+	return h.id, nil
+}
+
+// OnConnectAuthenticate adds a hook which calls fn to authenticate connecting clients, and
+// returns the id of the hook. Clients are allowed if fn or any other auth hook allows them.
+func (s *Server) OnConnectAuthenticate(fn func(cl *Client, pk packets.Packet) bool) (string, error) {
+	return s.addFuncHook(OnConnectAuthenticate, func(h *funcHook) { h.onConnectAuthenticate = fn })
+}
+
+// OnACLCheck adds a hook which calls fn to check whether clients may publish (write) or
+// subscribe to topics, and returns the id of the hook.
+func (s *Server) OnACLCheck(fn func(cl *Client, topic string, write bool) bool) (string, error) {
+	return s.addFuncHook(OnACLCheck, func(h *funcHook) { h.onACLCheck = fn })
+}
+
+// OnConnect adds a hook which calls fn when a client connects, and returns the id of the hook.
+// If fn returns an error, the client is disconnected.
+func (s *Server) OnConnect(fn func(cl *Client, pk packets.Packet) error) (string, error) {
+	return s.addFuncHook(OnConnect, func(h *funcHook) { h.onConnect = fn })
+}
+
+// OnSessionEstablished adds a hook which calls fn when a client has connected and its session
+// has been established, and returns the id of the hook.
+func (s *Server) OnSessionEstablished(fn func(cl *Client, pk packets.Packet)) (string, error) {
+	return s.addFuncHook(OnSessionEstablished, func(h *funcHook) { h.onSessionEstablished = fn })
+}
+
+// OnDisconnect adds a hook which calls fn when a client disconnects, and returns the id of
+// the hook.
+func (s *Server) OnDisconnect(fn func(cl *Client, err error, expire bool)) (string, error) {
+	return s.addFuncHook(OnDisconnect, func(h *funcHook) { h.onDisconnect = fn })
+}
+
+// OnSubscribed adds a hook which calls fn when a client has subscribed to one or more filters,
+// and returns the id of the hook.
+func (s *Server) OnSubscribed(fn func(cl *Client, pk packets.Packet, reasonCodes []byte)) (string, error) {
+	return s.addFuncHook(OnSubscribed, func(h *funcHook) { h.onSubscribed = fn })
+}
+
+// OnUnsubscribed adds a hook which calls fn when a client has unsubscribed from one or more
+// filters, and returns the id of the hook.
+func (s *Server) OnUnsubscribed(fn func(cl *Client, pk packets.Packet)) (string, error) {
+	return s.addFuncHook(OnUnsubscribed, func(h *funcHook) { h.onUnsubscribed = fn })
+}
+
+// OnPublish adds a hook which calls fn when a client publishes a message, and returns the id
+// of the hook. fn may modify the message, or reject it by returning packets.ErrRejectPacket.
+func (s *Server) OnPublish(fn func(cl *Client, pk packets.Packet) (packets.Packet, error)) (string, error) {
+	return s.addFuncHook(OnPublish, func(h *funcHook) { h.onPublish = fn })
+}
+
+// OnPublished adds a hook which calls fn when a client has published a message to subscribers,
+// and returns the id of the hook.
+func (s *Server) OnPublished(fn func(cl *Client, pk packets.Packet)) (string, error) {
+	return s.addFuncHook(OnPublished, func(h *funcHook) { h.onPublished = fn })
+}
+
+// OnMessageDropped adds a hook which calls fn when a message is dropped instead of being
+// delivered to a client, and returns the id of the hook.
+func (s *Server) OnMessageDropped(fn func(cl *Client, pk packets.Packet, reason DropReason)) (string, error) {
+	return s.addFuncHook(OnMessageDropped, func(h *funcHook) { h.onMessageDropped = fn })
+}
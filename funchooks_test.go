@@ -0,0 +1,76 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerFuncHooks(t *testing.T) {
+	s := New(nil)
+	s.Log = logger
+	cl := &Client{ID: "cl1"}
+	pk := packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}
+
+	var called []string
+	record := func(id string, err error) {
+		require.NoError(t, err)
+		called = append(called, id)
+	}
+
+	record(s.OnConnectAuthenticate(func(cl *Client, pk packets.Packet) bool { return cl.ID == "cl1" }))
+	record(s.OnACLCheck(func(cl *Client, topic string, write bool) bool { return !write }))
+	record(s.OnConnect(func(cl *Client, pk packets.Packet) error { return errTestHook }))
+	record(s.OnPublish(func(cl *Client, pk packets.Packet) (packets.Packet, error) {
+		pk.Payload = []byte("modified")
+		return pk, nil
+	}))
+
+	var events []string
+	record(s.OnSessionEstablished(func(cl *Client, pk packets.Packet) { events = append(events, "established") }))
+	record(s.OnDisconnect(func(cl *Client, err error, expire bool) { events = append(events, "disconnect") }))
+	record(s.OnSubscribed(func(cl *Client, pk packets.Packet, reasonCodes []byte) { events = append(events, "subscribed") }))
+	record(s.OnUnsubscribed(func(cl *Client, pk packets.Packet) { events = append(events, "unsubscribed") }))
+	record(s.OnPublished(func(cl *Client, pk packets.Packet) { events = append(events, "published") }))
+	record(s.OnMessageDropped(func(cl *Client, pk packets.Packet, reason DropReason) { events = append(events, "dropped") }))
+
+	require.Equal(t, []string{
+		"func-OnConnectAuthenticate-1",
+		"func-OnACLCheck-2",
+		"func-OnConnect-3",
+		"func-OnPublish-4",
+		"func-OnSessionEstablished-5",
+		"func-OnDisconnect-6",
+		"func-OnSubscribed-7",
+		"func-OnUnsubscribed-8",
+		"func-OnPublished-9",
+		"func-OnMessageDropped-10",
+	}, called)
+	require.Equal(t, int64(10), s.hooks.Len())
+
+	require.True(t, s.hooks.OnConnectAuthenticate(cl, pk))
+	require.False(t, s.hooks.OnConnectAuthenticate(&Client{ID: "cl2"}, pk))
+	require.True(t, s.hooks.OnACLCheck(cl, "a/b/c", false))
+	require.False(t, s.hooks.OnACLCheck(cl, "a/b/c", true))
+	require.ErrorIs(t, s.hooks.OnConnect(cl, pk), errTestHook)
+
+	out, err := s.hooks.OnPublish(cl, pk)
+	require.NoError(t, err)
+	require.Equal(t, []byte("modified"), out.Payload)
+
+	s.hooks.OnSessionEstablished(cl, pk)
+	s.hooks.OnDisconnect(cl, nil, false)
+	s.hooks.OnSubscribed(cl, pk, []byte{0})
+	s.hooks.OnUnsubscribed(cl, pk)
+	s.hooks.OnPublished(cl, pk)
+	s.hooks.OnMessageDropped(cl, pk, DropNoSubscribers)
+	require.Equal(t, []string{"established", "disconnect", "subscribed", "unsubscribed", "published", "dropped"}, events)
+
+	require.NoError(t, s.RemoveHook("func-OnConnect-3"))
+	require.NoError(t, s.hooks.OnConnect(cl, pk))
+}
@@ -5,11 +5,16 @@
 package mqtt
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"runtime/debug"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage"
 	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
@@ -23,16 +28,26 @@ const (
 	OnStopped
 	OnConnectAuthenticate
 	OnACLCheck
+	OnACLActionCheck
+	OnACLDenied
+	OnPublishQuota
+	OnQuotaExceeded
 	OnConnect
 	OnSessionEstablish
 	OnSessionEstablished
+	OnSessionTakenOver
 	OnDisconnect
+	OnKeepAliveTimeout
 	OnAuthPacket
+	OnEnhancedAuth
+	OnAuthFailed
 	OnPacketRead
 	OnPacketEncode
 	OnPacketSent
+	OnPacketWritten
 	OnPacketProcessed
 	OnSubscribe
+	OnSubscribeFilter
 	OnSubscribed
 	OnSelectSubscribers
 	OnUnsubscribe
@@ -40,32 +55,153 @@ const (
 	OnPublish
 	OnPublished
 	OnPublishDropped
+	OnMessageDropped
 	OnRetainMessage
 	OnRetainPublished
+	OnRetainedDelivered
 	OnQosPublish
 	OnQosComplete
 	OnQosDropped
+	OnQueuedMessage
 	OnPacketIDExhausted
 	OnWill
 	OnWillSent
 	OnClientExpired
 	OnRetainedExpired
+	OnListenerConnection
 	StoredClients
 	StoredSubscriptions
 	StoredInflightMessages
+	StoredQueuedMessages
 	StoredRetainedMessages
 	StoredSysInfo
+	StoredSession
 )
 
+// ListenerEvent is a type of connection event which occurred on a listener.
+type ListenerEvent byte
+
+const (
+	ListenerConnectionAccepted ListenerEvent = iota // a connection was accepted by the listener
+	ListenerConnectionRejected                      // a connection was closed before completing the connect handshake
+	ListenerTLSHandshakeFailed                      // a connection failed the tls handshake
+	ListenerConnectionClosed                        // a connection was closed after completing the connect handshake
+)
+
+// ACLAction is an action which a client may be allowed or denied on a topic. The retain and
+// will actions are restricted separately to the write access of a topic.
+type ACLAction byte
+
+const (
+	ACLActionRetain ACLAction = iota // the client publishes a retained message to the topic
+	ACLActionWill                    // the client registers a will message on the topic
+	ACLActionRead                    // the client subscribes to or receives messages from the topic
+	ACLActionWrite                   // the client publishes to the topic
+)
+
+// String returns the name of the action.
+func (a ACLAction) String() string {
+	switch a {
+	case ACLActionRetain:
+		return "retain"
+	case ACLActionWill:
+		return "will"
+	case ACLActionRead:
+		return "read"
+	case ACLActionWrite:
+		return "write"
+	default:
+		return "unknown"
+	}
+}
+
+// DropReason is the reason a message was dropped instead of being delivered to a client.
+type DropReason byte
+
+const (
+	DropQueueFull          DropReason = iota // the outbound queue of the client was full
+	DropInflightFull                         // the client had the maximum number of inflight messages
+	DropPacketIDsExhausted                   // the client had no free packet ids
+	DropExpired                              // the message expired before it was acknowledged
+	DropOffline                              // the client was offline and the message was qos 0
+	DropNotAuthorized                        // the client was not allowed to read the topic
+	DropNoSubscribers                        // no clients were subscribed to the topic
+	DropQueueLimit                           // the message exceeded the queue limits of the client
+)
+
+// String returns the name of the reason.
+func (r DropReason) String() string {
+	switch r {
+	case DropQueueFull:
+		return "queue_full"
+	case DropInflightFull:
+		return "inflight_full"
+	case DropPacketIDsExhausted:
+		return "packet_ids_exhausted"
+	case DropExpired:
+		return "expired"
+	case DropOffline:
+		return "offline"
+	case DropNotAuthorized:
+		return "not_authorized"
+	case DropNoSubscribers:
+		return "no_subscribers"
+	case DropQueueLimit:
+		return "queue_limit"
+	default:
+		return "unknown"
+	}
+}
+
+// ACLDenial describes an ACL check which denied a client access to a topic.
+type ACLDenial struct {
+	Topic  string    // the topic or filter the client attempted to access
+	Action ACLAction // the action which was denied
+	Hook   string    // the id of the hook which described the rule, if any
+	Rule   string    // a description of the rule which denied access, if known
+}
+
+// QuotaExceeded describes a publish which exceeded a rate limit quota.
+type QuotaExceeded struct {
+	Topic     string // the topic the client published to
+	Hook      string // the id of the hook which enforced the quota
+	Rule      string // a description of the quota rule, if known
+	Limit     string // the limit which was exceeded, such as messages or bytes
+	Throttled bool   // the publish was delayed until it was within the quota rather than rejected
+}
+
+// PacketWritten describes a packet which has been written to a client.
+type PacketWritten struct {
+	Type     byte          // the type of the packet
+	Size     int64         // the number of bytes written, including the fixed header
+	Duration time.Duration // the time taken to encode and write the packet
+}
+
 var (
 	// ErrInvalidConfigType indicates a different Type of config value was expected to what was received.
 	ErrInvalidConfigType = errors.New("invalid config type provided")
+
+	// ErrHookNotFound indicates no hook with the given id has been added.
+	ErrHookNotFound = errors.New("hook not found")
+
+	// ErrHookReloadUnsupported indicates the hook does not implement Reloader.
+	ErrHookReloadUnsupported = errors.New("hook does not support reloading")
+
+	// ErrStopHookChain may be returned by the OnPacketRead, OnSubscribeFilter and OnPublish methods
+	// of a hook to indicate it has handled the packet, so the packet it returns is used without
+	// being passed to the hooks after it.
+	ErrStopHookChain = errors.New("hook chain stopped")
 )
 
 // HookLoadConfig contains the hook and configuration as loaded from a configuration (usually file).
 type HookLoadConfig struct {
-	Hook   Hook
-	Config any
+	Hook      Hook
+	Config    any
+	Listeners []string        // if set, the hook only authenticates and authorizes clients of these listeners
+	Priority  int             // hooks with a higher priority are called first
+	Async     *AsyncOptions   // if set, the notification events of the hook are called asynchronously
+	Timeout   *TimeoutOptions // if set, the auth and publish checks of the hook are abandoned after a timeout
+	Scope     *HookScope      // if set, the events of the hook are only called for clients and topics within the scope
 }
 
 // Hook provides an interface of handlers for different events which occur
@@ -81,17 +217,27 @@ type Hook interface {
 	OnStopped()
 	OnConnectAuthenticate(cl *Client, pk packets.Packet) bool
 	OnACLCheck(cl *Client, topic string, write bool) bool
+	OnACLActionCheck(cl *Client, topic string, action ACLAction) bool   // restricts the retain and will actions of clients with write access
+	OnACLDenied(cl *Client, denial ACLDenial)                           // triggers when an ACL check denies a client access to a topic
+	OnPublishQuota(cl *Client, pk packets.Packet) (QuotaExceeded, bool) // enforces the publish rate limit quotas of clients
+	OnQuotaExceeded(cl *Client, exceeded QuotaExceeded)                 // triggers when a publish exceeds a quota
 	OnSysInfoTick(*system.Info)
 	OnConnect(cl *Client, pk packets.Packet) error
 	OnSessionEstablish(cl *Client, pk packets.Packet)
 	OnSessionEstablished(cl *Client, pk packets.Packet)
+	OnSessionTakenOver(evicted, cl *Client) // triggers when a connected client is evicted by a new client with the same id
 	OnDisconnect(cl *Client, err error, expire bool)
+	OnKeepAliveTimeout(cl *Client) // triggers when a client is disconnected for not sending a packet within its keepalive
 	OnAuthPacket(cl *Client, pk packets.Packet) (packets.Packet, error)
+	OnEnhancedAuth(cl *Client, ea EnhancedAuth) (packets.Code, []byte)  // performs a step of an mqtt v5 enhanced authentication exchange
+	OnAuthFailed(cl *Client, code packets.Code)                         // triggers when a client fails to authenticate
 	OnPacketRead(cl *Client, pk packets.Packet) (packets.Packet, error) // triggers when a new packet is received by a client, but before packet validation
 	OnPacketEncode(cl *Client, pk packets.Packet) packets.Packet        // modify a packet before it is byte-encoded and written to the client
 	OnPacketSent(cl *Client, pk packets.Packet, b []byte)               // triggers when packet bytes have been written to the client
+	OnPacketWritten(cl *Client, w PacketWritten)                        // reports the type, size and write duration of a packet sent to the client
 	OnPacketProcessed(cl *Client, pk packets.Packet, err error)         // triggers after a packet from the client been processed (handled)
 	OnSubscribe(cl *Client, pk packets.Packet) packets.Packet
+	OnSubscribeFilter(cl *Client, sub packets.Subscription) (packets.Subscription, error) // rewrite or reject a requested filter before it is subscribed
 	OnSubscribed(cl *Client, pk packets.Packet, reasonCodes []byte)
 	OnSelectSubscribers(subs *Subscribers, pk packets.Packet) *Subscribers
 	OnUnsubscribe(cl *Client, pk packets.Packet) packets.Packet
@@ -99,35 +245,153 @@ type Hook interface {
 	OnPublish(cl *Client, pk packets.Packet) (packets.Packet, error)
 	OnPublished(cl *Client, pk packets.Packet)
 	OnPublishDropped(cl *Client, pk packets.Packet)
+	OnMessageDropped(cl *Client, pk packets.Packet, reason DropReason) // triggers when a message is dropped instead of delivered, with the reason
 	OnRetainMessage(cl *Client, pk packets.Packet, r int64)
 	OnRetainPublished(cl *Client, pk packets.Packet)
+	OnRetainedDelivered(cl *Client, filter string, count int) // triggers when the retained messages of a filter have been delivered to a new subscriber
 	OnQosPublish(cl *Client, pk packets.Packet, sent int64, resends int)
 	OnQosComplete(cl *Client, pk packets.Packet)
 	OnQosDropped(cl *Client, pk packets.Packet)
+	OnQueuedMessage(cl *Client, pk packets.Packet)
 	OnPacketIDExhausted(cl *Client, pk packets.Packet)
 	OnWill(cl *Client, will Will) (Will, error)
 	OnWillSent(cl *Client, pk packets.Packet)
 	OnClientExpired(cl *Client)
 	OnRetainedExpired(filter string)
+	OnListenerConnection(listener string, event ListenerEvent, err error)
 	StoredClients() ([]storage.Client, error)
 	StoredSubscriptions() ([]storage.Subscription, error)
 	StoredInflightMessages() ([]storage.Message, error)
+	StoredQueuedMessages() ([]storage.Message, error)
 	StoredRetainedMessages() ([]storage.Message, error)
 	StoredSysInfo() (storage.SystemInfo, error)
+	StoredSession(id string) (storage.Session, error)
+}
+
+// EnhancedAuth is a step of an MQTT v5 enhanced authentication exchange, as started by a
+// connect or re-authenticate packet with an authentication method.
+type EnhancedAuth struct {
+	Method string // the authentication method of the exchange
+	Data   []byte // the authentication data sent by the client
+	Start  bool   // true if the step starts a new exchange
+	Reauth bool   // true if the exchange re-authenticates a connected client
+}
+
+// HealthChecker is an optional interface which may be implemented by hooks to report their
+// health, such as storage connectivity or auth backend reachability. Hooks implementing it are
+// considered critical, and any error returned marks the server as not ready.
+type HealthChecker interface {
+	Health() error
+}
+
+// BackupRestorer is an optional interface which may be implemented by storage hooks to
+// write and restore backups of their persisted data.
+type BackupRestorer interface {
+	Backup(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+// StoredIterator is an optional interface which may be implemented by storage hooks to
+// stream stored values to a callback one at a time, rather than returning them all at once,
+// so that large stores can be restored without holding every value in memory. Iteration
+// stops at the first error returned by the callback.
+type StoredIterator interface {
+	IterClients(fn func(v storage.Client) error) error
+	IterSubscriptions(fn func(v storage.Subscription) error) error
+	IterInflightMessages(fn func(v storage.Message) error) error
+	IterQueuedMessages(fn func(v storage.Message) error) error
+	IterRetainedMessages(fn func(v storage.Message) error) error
+}
+
+// StorageStatsReporter is an optional interface which may be implemented by storage hooks to
+// report the counters and latencies of their reads, writes and deletes. The stats are published
+// on the sysinfo tick.
+type StorageStatsReporter interface {
+	StorageStats() storage.Stats
+}
+
+// Reloader is an optional interface which may be implemented by hooks to apply a new config
+// while the server is running, without removing and adding the hook again. The config is of
+// the same type as the config passed to Init, and events may be called during the reload.
+type Reloader interface {
+	Reload(config any) error
+}
+
+// ACLDenialDescriber is an optional interface which may be implemented by auth hooks to
+// describe the rule which denied a client access to a topic, for the OnACLDenied event.
+type ACLDenialDescriber interface {
+	DescribeACLDenial(cl *Client, topic string, action ACLAction) string
+}
+
+// AuthDecision is the decision of an auth hook which implements ConnectDecider or ACLDecider.
+type AuthDecision byte
+
+const (
+	AuthPass  AuthDecision = iota // the hook does not decide, and the hooks after it are asked
+	AuthAllow                     // the client is allowed, and the hooks after it are not asked
+	AuthDeny                      // the client is denied, and the hooks after it are not asked
+)
+
+// ConnectDecider is an optional interface which may be implemented by auth hooks which are
+// stacked with other auth hooks, so that a hook which recognises a client can deny it without
+// the hooks after it being asked. DecideConnect is called instead of OnConnectAuthenticate,
+// and the hook must still provide OnConnectAuthenticate.
+type ConnectDecider interface {
+	DecideConnect(cl *Client, pk packets.Packet) AuthDecision
+}
+
+// ACLDecider is an optional interface which may be implemented by auth hooks which are stacked
+// with other auth hooks, so that a hook can deny access to a topic without the hooks after it
+// being asked. DecideACL is called instead of OnACLCheck, and the hook must still provide
+// OnACLCheck.
+type ACLDecider interface {
+	DecideACL(cl *Client, topic string, write bool) AuthDecision
+}
+
+// connectDecision returns the decision of a hook on whether a client may connect.
+func connectDecision(hook Hook, cl *Client, pk packets.Packet) AuthDecision {
+	if d, ok := hook.(ConnectDecider); ok {
+		return d.DecideConnect(cl, pk)
+	}
+
+	if hook.OnConnectAuthenticate(cl, pk) {
+		return AuthAllow
+	}
+
+	return AuthPass
+}
+
+// aclDecision returns the decision of a hook on whether a client may access a topic.
+func aclDecision(hook Hook, cl *Client, topic string, write bool) AuthDecision {
+	if d, ok := hook.(ACLDecider); ok {
+		return d.DecideACL(cl, topic, write)
+	}
+
+	if hook.OnACLCheck(cl, topic, write) {
+		return AuthAllow
+	}
+
+	return AuthPass
 }
 
 // HookOptions contains values which are inherited from the server on initialisation.
 type HookOptions struct {
 	Capabilities *Capabilities
+	AuthCache    *AuthCache      // the server acl decision cache, nil if disabled
+	Context      context.Context // the server context, cancelled when the server is closed
 }
 
 // Hooks is a slice of Hook interfaces to be called in sequence.
 type Hooks struct {
-	Log        *slog.Logger   // a logger for the hook (from the server)
-	internal   atomic.Value   // a slice of []Hook
-	wg         sync.WaitGroup // a waitgroup for syncing hook shutdown
-	qty        int64          // the number of hooks in use
-	sync.Mutex                // a mutex for locking when adding hooks
+	Log           *slog.Logger   // a logger for the hook (from the server)
+	internal      atomic.Value   // a *hookSet of the hooks in use
+	wg            sync.WaitGroup // a waitgroup for syncing hook shutdown
+	qty           int64          // the number of hooks in use
+	queueLimiters int64          // the number of hooks in use which implement QueueLimiter
+	PanicLimit    int64          // hooks which panic this many times are removed, never if 0
+	RecordMetrics bool           // record the call counts and latencies of each hook event
+	panics        sync.Map       // the number of panics recovered from each hook, keyed by hook id
+	sync.Mutex                   // a mutex for locking when adding hooks
 }
 
 // Len returns the number of hooks added.
@@ -137,7 +401,9 @@ func (h *Hooks) Len() int64 {
 
 // Provides returns true if any one hook provides any of the requested hook methods.
 func (h *Hooks) Provides(b ...byte) bool {
-	for _, hook := range h.GetAll() {
+	hs := h.acquire()
+	defer hs.release()
+	for _, hook := range hs.hooks {
 		for _, hb := range b {
 			if hook.Provides(hb) {
 				return true
@@ -150,42 +416,441 @@ func (h *Hooks) Provides(b ...byte) bool {
 
 // Add adds and initializes a new hook.
 func (h *Hooks) Add(hook Hook, config any) error {
+	return h.AddForListeners(hook, config, nil)
+}
+
+// AddForListeners adds and initializes a new hook whose OnConnectAuthenticate, OnEnhancedAuth
+// and OnACLCheck methods are only called for clients connected to the given listener ids. If no listeners
+// are given, the hook applies to all clients, as with Add. All other events are unaffected.
+func (h *Hooks) AddForListeners(hook Hook, config any, listeners []string) error {
+	return h.AddWithPriority(hook, config, 0, listeners)
+}
+
+// AddWithPriority adds and initializes a new hook which is called in order of priority. Hooks
+// with a higher priority are called before hooks with a lower priority, and hooks with the same
+// priority are called in the order they were added. Hooks added with Add have a priority of 0.
+// If listeners are given, the hook is scoped to them as with AddForListeners.
+func (h *Hooks) AddWithPriority(hook Hook, config any, priority int, listeners []string) error {
+	return h.add(HookLoadConfig{Hook: hook, Config: config, Priority: priority, Listeners: listeners})
+}
+
+// AddAsync adds and initializes a new hook whose notification events, such as OnPublished and
+// OnSysInfoTick, are queued and called by a pool of workers rather than inline, so that a slow
+// hook cannot stall packet processing. Events which return a value are still called inline.
+func (h *Hooks) AddAsync(hook Hook, config any, opts AsyncOptions) error {
+	return h.add(HookLoadConfig{Hook: hook, Config: config, Async: &opts})
+}
+
+// AddWithTimeout adds and initializes a new hook whose OnConnectAuthenticate, OnACLCheck and
+// OnPublish checks are abandoned if they do not return within the timeout, and resolved by the
+// timeout policy instead.
+func (h *Hooks) AddWithTimeout(hook Hook, config any, opts TimeoutOptions) error {
+	return h.add(HookLoadConfig{Hook: hook, Config: config, Timeout: &opts})
+}
+
+// AddScoped adds and initializes a new hook whose events are only called for clients and
+// topics within the scope, such as the clients of one tenant. Events which do not concern a
+// client or topic are called as normal.
+func (h *Hooks) AddScoped(hook Hook, config any, scope HookScope) error {
+	return h.add(HookLoadConfig{Hook: hook, Config: config, Scope: &scope})
+}
+
+// add adds and initializes the hook of a hook load config, with its priority, listeners,
+// async, timeout and scope options.
+func (h *Hooks) add(hlc HookLoadConfig) error {
 	h.Lock()
 	defer h.Unlock()
 
-	err := hook.Init(config)
+	hook := hlc.Hook
+	err := hook.Init(hlc.Config)
 	if err != nil {
 		return fmt.Errorf("failed initialising %s hook: %w", hook.ID(), err)
 	}
 
-	i, ok := h.internal.Load().([]Hook)
-	if !ok {
-		i = []Hook{}
+	old := h.load()
+	n := len(old.hooks)
+	for n > 0 && old.priorities[n-1] < hlc.Priority {
+		n--
+	}
+
+	hs := old.replace(insertAt(old.hooks, n, len(old.hooks), hook, true))
+	hs.priorities = insertAt(old.priorities, n, len(old.hooks), hlc.Priority, true)
+
+	var scope map[string]bool
+	if len(hlc.Listeners) > 0 {
+		scope = make(map[string]bool, len(hlc.Listeners))
+		for _, l := range hlc.Listeners {
+			scope[l] = true
+		}
 	}
+	hs.scopes = insertAt(old.scopes, n, len(old.hooks), scope, scope != nil)
 
-	i = append(i, hook)
-	h.internal.Store(i)
+	var d *hookDispatcher
+	if hlc.Async != nil {
+		d = newHookDispatcher(hook.ID(), h.Log, *hlc.Async)
+	}
+	hs.async = insertAt(old.async, n, len(old.hooks), d, d != nil)
+	hs.timeouts = insertAt(old.timeouts, n, len(old.hooks), hlc.Timeout, hlc.Timeout != nil)
+
+	var m *hookMetrics
+	if h.RecordMetrics {
+		m = new(hookMetrics)
+	}
+	hs.metrics = insertAt(old.metrics, n, len(old.hooks), m, m != nil)
+
+	f := newHookScope(hlc.Scope)
+	hs.filters = insertAt(old.filters, n, len(old.hooks), f, f != nil)
+
+	h.internal.Store(hs)
 	atomic.AddInt64(&h.qty, 1)
+	if _, ok := hook.(QueueLimiter); ok {
+		atomic.AddInt64(&h.queueLimiters, 1)
+	}
 	h.wg.Add(1)
 
 	return nil
 }
 
+// Remove detaches the hook with the given id, waits for any calls to the hook which are in
+// progress to return, and then stops it. Events which occur after Remove is called are not
+// sent to the hook. Remove must not be called from within a hook method, as it would wait
+// for itself.
+func (h *Hooks) Remove(id string) error {
+	h.Lock()
+	old := h.load()
+	n := -1
+	for i, hook := range old.hooks {
+		if hook.ID() == id {
+			n = i
+			break
+		}
+	}
+
+	if n == -1 {
+		h.Unlock()
+		return ErrHookNotFound
+	}
+
+	hs := old.replace(removeAt(old.hooks, n))
+	hs.priorities = removeAt(old.priorities, n)
+	hs.scopes = removeAt(old.scopes, n)
+	hs.async = removeAt(old.async, n)
+	hs.timeouts = removeAt(old.timeouts, n)
+	hs.metrics = removeAt(old.metrics, n)
+	hs.filters = removeAt(old.filters, n)
+
+	h.internal.Store(hs)
+	atomic.AddInt64(&h.qty, -1)
+	if _, ok := old.hooks[n].(QueueLimiter); ok {
+		atomic.AddInt64(&h.queueLimiters, -1)
+	}
+	h.Unlock()
+
+	hs.drain()
+	if d := old.dispatcher(n); d != nil {
+		d.close()
+	}
+
+	err := old.hooks[n].Stop()
+	h.wg.Done()
+
+	return err
+}
+
+// Reload applies a new config to the hook with the given id, if it implements Reloader.
+func (h *Hooks) Reload(id string, config any) error {
+	hs := h.acquire()
+	defer hs.release()
+	for _, hook := range hs.hooks {
+		if hook.ID() != id {
+			continue
+		}
+
+		r, ok := hook.(Reloader)
+		if !ok {
+			return ErrHookReloadUnsupported
+		}
+
+		return r.Reload(config)
+	}
+
+	return ErrHookNotFound
+}
+
+// insertAt returns a copy of the per-hook values s with v inserted at index n, where size is the
+// number of hooks before the insert. Values are only kept for every hook once one is set, so nil
+// is returned if s is empty and v is not set.
+func insertAt[T any](s []T, n, size int, v T, set bool) []T {
+	if len(s) == 0 && !set {
+		return nil
+	}
+
+	out := make([]T, size+1)
+	copy(out, s[:min(n, len(s))])
+	if n < len(s) {
+		copy(out[n+1:], s[n:])
+	}
+	out[n] = v
+
+	return out
+}
+
+// removeAt returns a copy of the per-hook values s without the value at index n.
+func removeAt[T any](s []T, n int) []T {
+	if n >= len(s) {
+		return s
+	}
+
+	return append(append(make([]T, 0, len(s)-1), s[:n]...), s[n+1:]...)
+}
+
+// hookSet is an immutable set of the hooks in use. Hooks are added and removed by replacing
+// the set, and the calls in progress on each set are counted, so that removed hooks can be
+// drained before they are stopped.
+type hookSet struct {
+	hooks      []Hook
+	priorities []int                   // the priority of each hook, keyed on hook index
+	scopes     []map[string]bool       // the listeners each hook applies to, keyed on hook index, or nil if it applies to all
+	async      []*hookDispatcher       // the dispatcher of each hook, keyed on hook index, or nil if it is called inline
+	timeouts   []*TimeoutOptions       // the call timeout of each hook, keyed on hook index, or nil if it has none
+	metrics    []*hookMetrics          // the call metrics of each hook, keyed on hook index, or nil if not recorded
+	filters    []*hookScope            // the scope of each hook, keyed on hook index, or nil if it applies to all
+	refs       int64                   // the number of calls in progress on the set
+	prev       atomic.Pointer[hookSet] // the set this set replaced, until it has been drained
+}
+
+// replace returns a new set of hooks which replaces the set.
+func (hs *hookSet) replace(hooks []Hook) *hookSet {
+	n := &hookSet{hooks: hooks}
+	if hs != emptyHookSet {
+		n.prev.Store(hs)
+	}
+
+	return n
+}
+
+// inScope returns true if the hook at index i applies to the listener of a client.
+func (hs *hookSet) inScope(i int, cl *Client) bool {
+	if i >= len(hs.scopes) || hs.scopes[i] == nil {
+		return true
+	}
+
+	return hs.scopes[i][cl.Net.Listener]
+}
+
+// dispatcher returns the dispatcher of the hook at index i, or nil if its events are called inline.
+func (hs *hookSet) dispatcher(i int) *hookDispatcher {
+	if i >= len(hs.async) {
+		return nil
+	}
+
+	return hs.async[i]
+}
+
+// timeout returns the timeout options of the hook at index i, or nil if its calls are not timed.
+func (hs *hookSet) timeout(i int) *TimeoutOptions {
+	if i >= len(hs.timeouts) || hs.timeouts[i] == nil || hs.timeouts[i].Timeout <= 0 {
+		return nil
+	}
+
+	return hs.timeouts[i]
+}
+
+// metric returns the metrics of the hook at index i, or nil if its calls are not recorded.
+func (hs *hookSet) metric(i int) *hookMetrics {
+	if i >= len(hs.metrics) {
+		return nil
+	}
+
+	return hs.metrics[i]
+}
+
+// failed records a call to the hook at index i which returned an error.
+func (hs *hookSet) failed(i int, event byte) {
+	if m := hs.metric(i); m != nil {
+		m.failed(event)
+	}
+}
+
+// release indicates a call on the set has returned.
+func (hs *hookSet) release() {
+	atomic.AddInt64(&hs.refs, -1)
+}
+
+// drain waits for the calls in progress on the sets replaced by the set to return. Replaced
+// sets cannot be acquired again, so once drained they are released.
+func (hs *hookSet) drain() {
+	for prev := hs.prev.Load(); prev != nil; prev = prev.prev.Load() {
+		for atomic.LoadInt64(&prev.refs) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	hs.prev.Store(nil)
+}
+
+// emptyHookSet is the set of hooks before any hooks are added.
+var emptyHookSet = new(hookSet)
+
+// load returns the current set of hooks.
+func (h *Hooks) load() *hookSet {
+	hs, ok := h.internal.Load().(*hookSet)
+	if !ok {
+		return emptyHookSet
+	}
+
+	return hs
+}
+
+// acquire returns the current set of hooks, which is held until it is released, so that
+// hooks removed while the set is in use are not stopped until the call has returned.
+func (h *Hooks) acquire() *hookSet {
+	for {
+		hs := h.load()
+		atomic.AddInt64(&hs.refs, 1)
+		if hs == h.load() {
+			return hs
+		}
+
+		hs.release() // the set was replaced before it was held
+	}
+}
+
 // GetAll returns a slice of all the hooks.
 func (h *Hooks) GetAll() []Hook {
-	i, ok := h.internal.Load().([]Hook)
-	if !ok {
-		return []Hook{}
+	return h.load().hooks
+}
+
+// Health checks the health of each hook which implements HealthChecker, returning
+// the joined errors of any which are unhealthy.
+func (h *Hooks) Health() error {
+	var errs []error
+	hs := h.acquire()
+	defer hs.release()
+	for _, hook := range hs.hooks {
+		if hc, ok := hook.(HealthChecker); ok {
+			if err := hc.Health(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", hook.ID(), err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// guard calls fn, which calls the event method of the hook at index i, recovering from any panic
+// in the hook so that it cannot take down the client or the server. The panic is logged with its
+// stack and counted, and the hook is removed once it reaches the panic limit. The call is
+// recorded in the metrics of the hook, if metrics are being recorded.
+func (h *Hooks) guard(hs *hookSet, i int, event byte, fn func()) {
+	var start time.Time
+	m := hs.metric(i)
+	if m != nil {
+		start = time.Now()
 	}
 
-	return i
+	defer func() {
+		r := recover()
+		if r != nil {
+			h.recovered(hs.hooks[i], r)
+		}
+
+		if m != nil {
+			m.record(event, time.Since(start), r != nil)
+		}
+	}()
+
+	fn()
+}
+
+// recovered records a panic recovered from a hook.
+func (h *Hooks) recovered(hook Hook, r any) {
+	v, _ := h.panics.LoadOrStore(hook.ID(), new(atomic.Int64))
+	n := v.(*atomic.Int64).Add(1)
+	h.Log.Error("recovered from hook panic",
+		"hook", hook.ID(),
+		"panic", r,
+		"panics", n,
+		"stack", string(debug.Stack()))
+
+	if h.PanicLimit > 0 && n == h.PanicLimit {
+		h.Log.Error("removing hook after repeated panics", "hook", hook.ID(), "panics", n)
+		go func() { // the hook may still be in use by the caller
+			if err := h.Remove(hook.ID()); err != nil {
+				h.Log.Warn("failed to remove panicking hook", "error", err, "hook", hook.ID())
+			}
+		}()
+	}
+}
+
+// Metrics returns the call metrics of each event of each hook, keyed by hook id and event
+// name, if metrics are being recorded.
+func (h *Hooks) Metrics() map[string]map[string]HookMetrics {
+	hs := h.acquire()
+	defer hs.release()
+
+	metrics := make(map[string]map[string]HookMetrics)
+	for i, hook := range hs.hooks {
+		if m := hs.metric(i); m != nil {
+			metrics[hook.ID()] = m.snapshot()
+		}
+	}
+
+	return metrics
+}
+
+// Panics returns the number of panics recovered from each hook which has panicked, keyed by hook id.
+func (h *Hooks) Panics() map[string]int64 {
+	panics := make(map[string]int64)
+	h.panics.Range(func(k, v any) bool {
+		panics[k.(string)] = v.(*atomic.Int64).Load()
+		return true
+	})
+
+	return panics
+}
+
+// AsyncDropped returns the number of events dropped by the overflow policy of each asynchronous
+// hook, keyed by hook id.
+func (h *Hooks) AsyncDropped() map[string]int64 {
+	hs := h.acquire()
+	defer hs.release()
+
+	dropped := make(map[string]int64)
+	for i, hook := range hs.hooks {
+		if d := hs.dispatcher(i); d != nil {
+			dropped[hook.ID()] = d.dropped.Load()
+		}
+	}
+
+	return dropped
+}
+
+// StorageStats returns the storage stats of each hook which implements StorageStatsReporter,
+// keyed by hook id.
+func (h *Hooks) StorageStats() map[string]storage.Stats {
+	stats := map[string]storage.Stats{}
+	hs := h.acquire()
+	defer hs.release()
+	for _, hook := range hs.hooks {
+		if r, ok := hook.(StorageStatsReporter); ok {
+			stats[hook.ID()] = r.StorageStats()
+		}
+	}
+
+	return stats
 }
 
 // Stop indicates all attached hooks to gracefully end.
 func (h *Hooks) Stop() {
 	go func() {
-		for _, hook := range h.GetAll() {
+		hs := h.load()
+		for i, hook := range hs.hooks {
 			h.Log.Info("stopping hook", "hook", hook.ID())
+			if d := hs.dispatcher(i); d != nil {
+				d.close() // call the queued events before the hook is stopped
+			}
+
 			if err := hook.Stop(); err != nil {
 				h.Log.Debug("problem stopping hook", "error", err, "hook", hook.ID())
 			}
@@ -199,36 +864,51 @@ func (h *Hooks) Stop() {
 
 // OnSysInfoTick is called when the $SYS topic values are published out.
 func (h *Hooks) OnSysInfoTick(sys *system.Info) {
-	for _, hook := range h.GetAll() {
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
 		if hook.Provides(OnSysInfoTick) {
-			hook.OnSysInfoTick(sys)
+			if d := hs.dispatcher(i); d != nil {
+				d.dispatch("", func() { h.guard(hs, i, OnSysInfoTick, func() { hook.OnSysInfoTick(sys) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnSysInfoTick, func() { hook.OnSysInfoTick(sys) })
 		}
 	}
 }
 
 // OnStarted is called when the server has successfully started.
 func (h *Hooks) OnStarted() {
-	for _, hook := range h.GetAll() {
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
 		if hook.Provides(OnStarted) {
-			hook.OnStarted()
+			h.guard(hs, i, OnStarted, func() { hook.OnStarted() })
 		}
 	}
 }
 
 // OnStopped is called when the server has successfully stopped.
 func (h *Hooks) OnStopped() {
-	for _, hook := range h.GetAll() {
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
 		if hook.Provides(OnStopped) {
-			hook.OnStopped()
+			h.guard(hs, i, OnStopped, func() { hook.OnStopped() })
 		}
 	}
 }
 
 // OnConnect is called when a new client connects, and may return a packets.Code as an error to halt the connection.
+// A packets.Code error reason code is sent to the client in the CONNACK.
 func (h *Hooks) OnConnect(cl *Client, pk packets.Packet) error {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnConnect) {
-			err := hook.OnConnect(cl, pk)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnConnect) && hs.scoped(i, cl, "") {
+			var err error
+			h.guard(hs, i, OnConnect, func() { err = hook.OnConnect(cl, pk) })
 			if err != nil {
 				return err
 			}
@@ -240,27 +920,79 @@ func (h *Hooks) OnConnect(cl *Client, pk packets.Packet) error {
 // OnSessionEstablish is called right after a new client connects and authenticates and right before
 // the session is established and CONNACK is sent.
 func (h *Hooks) OnSessionEstablish(cl *Client, pk packets.Packet) {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnSessionEstablish) {
-			hook.OnSessionEstablish(cl, pk)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnSessionEstablish) && hs.scoped(i, cl, "") {
+			h.guard(hs, i, OnSessionEstablish, func() { hook.OnSessionEstablish(cl, pk) })
 		}
 	}
 }
 
 // OnSessionEstablished is called when a new client establishes a session (after OnConnect).
 func (h *Hooks) OnSessionEstablished(cl *Client, pk packets.Packet) {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnSessionEstablished) {
-			hook.OnSessionEstablished(cl, pk)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnSessionEstablished) && hs.scoped(i, cl, "") {
+			if d := hs.dispatcher(i); d != nil {
+				pk := pk // copied so that only async calls move it to the heap
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnSessionEstablished, func() { hook.OnSessionEstablished(cl, pk) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnSessionEstablished, func() { hook.OnSessionEstablished(cl, pk) })
+		}
+	}
+}
+
+// OnSessionTakenOver is called when a connected client is disconnected because a new client
+// connected with the same client id, once the new client has inherited the session. Both
+// clients are passed, so the connection details of each can be compared.
+func (h *Hooks) OnSessionTakenOver(evicted, cl *Client) {
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnSessionTakenOver) && hs.scoped(i, cl, "") {
+			if d := hs.dispatcher(i); d != nil {
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnSessionTakenOver, func() { hook.OnSessionTakenOver(evicted, cl) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnSessionTakenOver, func() { hook.OnSessionTakenOver(evicted, cl) })
 		}
 	}
 }
 
 // OnDisconnect is called when a client is disconnected for any reason.
 func (h *Hooks) OnDisconnect(cl *Client, err error, expire bool) {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnDisconnect) {
-			hook.OnDisconnect(cl, err, expire)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnDisconnect) && hs.scoped(i, cl, "") {
+			if d := hs.dispatcher(i); d != nil {
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnDisconnect, func() { hook.OnDisconnect(cl, err, expire) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnDisconnect, func() { hook.OnDisconnect(cl, err, expire) })
+		}
+	}
+}
+
+// OnKeepAliveTimeout is called when a client is disconnected because no packet was received
+// within its keepalive period, before the will message is sent and OnDisconnect is called.
+func (h *Hooks) OnKeepAliveTimeout(cl *Client) {
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnKeepAliveTimeout) && hs.scoped(i, cl, "") {
+			if d := hs.dispatcher(i); d != nil {
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnKeepAliveTimeout, func() { hook.OnKeepAliveTimeout(cl) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnKeepAliveTimeout, func() { hook.OnKeepAliveTimeout(cl) })
 		}
 	}
 }
@@ -268,13 +1000,19 @@ func (h *Hooks) OnDisconnect(cl *Client, err error, expire bool) {
 // OnPacketRead is called when a packet is received from a client.
 func (h *Hooks) OnPacketRead(cl *Client, pk packets.Packet) (pkx packets.Packet, err error) {
 	pkx = pk
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnPacketRead) {
-			npk, err := hook.OnPacketRead(cl, pkx)
-			if err != nil && errors.Is(err, packets.ErrRejectPacket) {
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnPacketRead) && hs.scopedPacket(i, cl, pkx) {
+			npk, err := pkx, error(nil)
+			h.guard(hs, i, OnPacketRead, func() { npk, err = hook.OnPacketRead(cl, pkx) })
+			if errors.Is(err, ErrStopHookChain) {
+				return npk, nil
+			} else if err != nil && errors.Is(err, packets.ErrRejectPacket) {
 				h.Log.Debug("packet rejected", "hook", hook.ID(), "packet", pkx)
 				return pk, err
 			} else if err != nil {
+				hs.failed(i, OnPacketRead)
 				continue
 			}
 
@@ -289,9 +1027,12 @@ func (h *Hooks) OnPacketRead(cl *Client, pk packets.Packet) (pkx packets.Packet,
 // to create their own auth packet handling mechanisms.
 func (h *Hooks) OnAuthPacket(cl *Client, pk packets.Packet) (pkx packets.Packet, err error) {
 	pkx = pk
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnAuthPacket) {
-			npk, err := hook.OnAuthPacket(cl, pkx)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnAuthPacket) && hs.scopedPacket(i, cl, pkx) {
+			npk, err := pkx, error(nil)
+			h.guard(hs, i, OnAuthPacket, func() { npk, err = hook.OnAuthPacket(cl, pkx) })
 			if err != nil {
 				return pk, err
 			}
@@ -303,11 +1044,51 @@ func (h *Hooks) OnAuthPacket(cl *Client, pk packets.Packet) (pkx packets.Packet,
 	return
 }
 
+// OnEnhancedAuth is called for each step of an MQTT v5 enhanced authentication exchange. The
+// step is passed to each hook until one supports the authentication method, which returns
+// CodeContinueAuthentication and the data to send to the client if the exchange continues,
+// CodeSuccess if the client is authenticated, or an error code if it is not. If no hook
+// supports the method, ErrBadAuthenticationMethod is returned.
+func (h *Hooks) OnEnhancedAuth(cl *Client, ea EnhancedAuth) (code packets.Code, data []byte) {
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnEnhancedAuth) && hs.inScope(i, cl) && hs.scoped(i, cl, "") {
+			code, data = packets.ErrBadAuthenticationMethod, nil
+			h.guard(hs, i, OnEnhancedAuth, func() { code, data = hook.OnEnhancedAuth(cl, ea) })
+			if code != packets.ErrBadAuthenticationMethod {
+				return code, data
+			}
+		}
+	}
+
+	return packets.ErrBadAuthenticationMethod, nil
+}
+
+// OnAuthFailed is called when a client fails to authenticate, whether on connect, on
+// reauthentication, or by http listener auth. The code is the reason the client was rejected.
+func (h *Hooks) OnAuthFailed(cl *Client, code packets.Code) {
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnAuthFailed) && hs.scoped(i, cl, "") {
+			if d := hs.dispatcher(i); d != nil {
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnAuthFailed, func() { hook.OnAuthFailed(cl, code) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnAuthFailed, func() { hook.OnAuthFailed(cl, code) })
+		}
+	}
+}
+
 // OnPacketEncode is called immediately before a packet is encoded to be sent to a client.
 func (h *Hooks) OnPacketEncode(cl *Client, pk packets.Packet) packets.Packet {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnPacketEncode) {
-			pk = hook.OnPacketEncode(cl, pk)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnPacketEncode) && hs.scopedPacket(i, cl, pk) {
+			h.guard(hs, i, OnPacketEncode, func() { pk = hook.OnPacketEncode(cl, pk) })
 		}
 	}
 
@@ -316,9 +1097,17 @@ func (h *Hooks) OnPacketEncode(cl *Client, pk packets.Packet) packets.Packet {
 
 // OnPacketProcessed is called when a packet has been received and successfully handled by the broker.
 func (h *Hooks) OnPacketProcessed(cl *Client, pk packets.Packet, err error) {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnPacketProcessed) {
-			hook.OnPacketProcessed(cl, pk, err)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnPacketProcessed) && hs.scopedPacket(i, cl, pk) {
+			if d := hs.dispatcher(i); d != nil {
+				pk := pk // copied so that only async calls move it to the heap
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnPacketProcessed, func() { hook.OnPacketProcessed(cl, pk, err) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnPacketProcessed, func() { hook.OnPacketProcessed(cl, pk, err) })
 		}
 	}
 }
@@ -326,9 +1115,35 @@ func (h *Hooks) OnPacketProcessed(cl *Client, pk packets.Packet, err error) {
 // OnPacketSent is called when a packet has been sent to a client. It takes a bytes parameter
 // containing the bytes sent.
 func (h *Hooks) OnPacketSent(cl *Client, pk packets.Packet, b []byte) {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnPacketSent) {
-			hook.OnPacketSent(cl, pk, b)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnPacketSent) && hs.scopedPacket(i, cl, pk) {
+			if d := hs.dispatcher(i); d != nil {
+				pk := pk            // copied so that only async calls move it to the heap
+				b := bytes.Clone(b) // the buffer is reused once the call returns
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnPacketSent, func() { hook.OnPacketSent(cl, pk, b) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnPacketSent, func() { hook.OnPacketSent(cl, pk, b) })
+		}
+	}
+}
+
+// OnPacketWritten is called when a packet has been written to a client, with the number of
+// bytes written and the time taken, so that hooks can account for the egress of each client.
+func (h *Hooks) OnPacketWritten(cl *Client, w PacketWritten) {
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnPacketWritten) && hs.scoped(i, cl, "") {
+			if d := hs.dispatcher(i); d != nil {
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnPacketWritten, func() { hook.OnPacketWritten(cl, w) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnPacketWritten, func() { hook.OnPacketWritten(cl, w) })
 		}
 	}
 }
@@ -338,19 +1153,58 @@ func (h *Hooks) OnPacketSent(cl *Client, pk packets.Packet, b []byte) {
 // before the packet is processed. The return values of the hook methods are passed-through
 // in the order the hooks were attached.
 func (h *Hooks) OnSubscribe(cl *Client, pk packets.Packet) packets.Packet {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnSubscribe) {
-			pk = hook.OnSubscribe(cl, pk)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnSubscribe) && hs.scopedPacket(i, cl, pk) {
+			h.guard(hs, i, OnSubscribe, func() { pk = hook.OnSubscribe(cl, pk) })
 		}
 	}
 	return pk
 }
 
+// OnSubscribeFilter is called for each filter a client subscribes to, before the filter is
+// validated, checked against the ACLs and added to the topics index. Each hook may rewrite the
+// filter and its subscription options, such as prefixing it or downgrading its qos, and the
+// result is passed to the next hook. If a hook returns an error the filter is rejected, and
+// the error is returned with the subscription as received by that hook.
+func (h *Hooks) OnSubscribeFilter(cl *Client, sub packets.Subscription) (packets.Subscription, error) {
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnSubscribeFilter) && hs.scoped(i, cl, sub.Filter) {
+			nsub, err := sub, error(nil)
+			h.guard(hs, i, OnSubscribeFilter, func() { nsub, err = hook.OnSubscribeFilter(cl, sub) })
+			if errors.Is(err, ErrStopHookChain) {
+				return nsub, nil
+			} else if err != nil {
+				h.Log.Debug("subscription filter rejected",
+					"error", err,
+					"hook", hook.ID(),
+					"client", cl.ID,
+					"filter", sub.Filter)
+				return sub, err
+			}
+			sub = nsub
+		}
+	}
+
+	return sub, nil
+}
+
 // OnSubscribed is called when a client subscribes to one or more filters.
 func (h *Hooks) OnSubscribed(cl *Client, pk packets.Packet, reasonCodes []byte) {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnSubscribed) {
-			hook.OnSubscribed(cl, pk, reasonCodes)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnSubscribed) && hs.scopedPacket(i, cl, pk) {
+			if d := hs.dispatcher(i); d != nil {
+				pk := pk // copied so that only async calls move it to the heap
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnSubscribed, func() { hook.OnSubscribed(cl, pk, reasonCodes) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnSubscribed, func() { hook.OnSubscribed(cl, pk, reasonCodes) })
 		}
 	}
 }
@@ -358,11 +1212,14 @@ func (h *Hooks) OnSubscribed(cl *Client, pk packets.Packet, reasonCodes []byte)
 // OnSelectSubscribers is called when subscribers have been collected for a topic, but before
 // shared subscription subscribers have been selected. This hook can be used to programmatically
 // remove or add clients to a publish to subscribers process, or to select the subscriber for a shared
-// group in a custom manner (such as based on client id, ip, etc).
+// group in a custom manner (such as based on client id, ip, etc), using the methods of Subscribers.
+// If no subscriber is selected for any shared group, one is selected for each group as normal.
 func (h *Hooks) OnSelectSubscribers(subs *Subscribers, pk packets.Packet) *Subscribers {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnSelectSubscribers) {
-			subs = hook.OnSelectSubscribers(subs, pk)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnSelectSubscribers) && hs.scopedPacket(i, nil, pk) {
+			h.guard(hs, i, OnSelectSubscribers, func() { subs = hook.OnSelectSubscribers(subs, pk) })
 		}
 	}
 	return subs
@@ -373,9 +1230,11 @@ func (h *Hooks) OnSelectSubscribers(subs *Subscribers, pk packets.Packet) *Subsc
 // before the packet is processed. The return values of the hook methods are passed-through
 // in the order the hooks were attached.
 func (h *Hooks) OnUnsubscribe(cl *Client, pk packets.Packet) packets.Packet {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnUnsubscribe) {
-			pk = hook.OnUnsubscribe(cl, pk)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnUnsubscribe) && hs.scopedPacket(i, cl, pk) {
+			h.guard(hs, i, OnUnsubscribe, func() { pk = hook.OnUnsubscribe(cl, pk) })
 		}
 	}
 	return pk
@@ -383,9 +1242,17 @@ func (h *Hooks) OnUnsubscribe(cl *Client, pk packets.Packet) packets.Packet {
 
 // OnUnsubscribed is called when a client unsubscribes from one or more filters.
 func (h *Hooks) OnUnsubscribed(cl *Client, pk packets.Packet) {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnUnsubscribed) {
-			hook.OnUnsubscribed(cl, pk)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnUnsubscribed) && hs.scopedPacket(i, cl, pk) {
+			if d := hs.dispatcher(i); d != nil {
+				pk := pk // copied so that only async calls move it to the heap
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnUnsubscribed, func() { hook.OnUnsubscribed(cl, pk) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnUnsubscribed, func() { hook.OnUnsubscribed(cl, pk) })
 		}
 	}
 }
@@ -395,10 +1262,35 @@ func (h *Hooks) OnUnsubscribed(cl *Client, pk packets.Packet) {
 // The return values of the hook methods are passed-through in the order the hooks were attached.
 func (h *Hooks) OnPublish(cl *Client, pk packets.Packet) (pkx packets.Packet, err error) {
 	pkx = pk
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnPublish) {
-			npk, err := hook.OnPublish(cl, pkx)
-			if err != nil {
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnPublish) && hs.scopedPacket(i, cl, pkx) {
+			npk, err := pkx, error(nil)
+			if t := hs.timeout(i); t != nil {
+				in := pkx
+				r, done := timed(h, hs, i, OnPublish, publishResult{pk: in}, func() publishResult {
+					npk, err := hook.OnPublish(cl, in)
+					return publishResult{pk: npk, err: err}
+				})
+
+				if !done {
+					switch t.Policy {
+					case TimeoutDeny:
+						return pk, packets.ErrRejectPacket
+					case TimeoutAllow:
+						return pkx, nil
+					}
+					continue
+				}
+
+				npk, err = r.pk, r.err
+			} else {
+				h.guard(hs, i, OnPublish, func() { npk, err = hook.OnPublish(cl, pkx) })
+			}
+			if errors.Is(err, ErrStopHookChain) {
+				return npk, nil
+			} else if err != nil {
 				if errors.Is(err, packets.ErrRejectPacket) {
 					h.Log.Debug("publish packet rejected",
 						"error", err,
@@ -408,6 +1300,7 @@ func (h *Hooks) OnPublish(cl *Client, pk packets.Packet) (pkx packets.Packet, er
 				} else if errors.Is(err, packets.CodeSuccessIgnore) {
 					return pk, err
 				}
+				hs.failed(i, OnPublish)
 				h.Log.Error("publish packet error",
 					"error", err,
 					"hook", hook.ID(),
@@ -423,9 +1316,17 @@ func (h *Hooks) OnPublish(cl *Client, pk packets.Packet) (pkx packets.Packet, er
 
 // OnPublished is called when a client has published a message to subscribers.
 func (h *Hooks) OnPublished(cl *Client, pk packets.Packet) {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnPublished) {
-			hook.OnPublished(cl, pk)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnPublished) && hs.scopedPacket(i, cl, pk) {
+			if d := hs.dispatcher(i); d != nil {
+				pk := pk // copied so that only async calls move it to the heap
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnPublished, func() { hook.OnPublished(cl, pk) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnPublished, func() { hook.OnPublished(cl, pk) })
 		}
 	}
 }
@@ -433,27 +1334,87 @@ func (h *Hooks) OnPublished(cl *Client, pk packets.Packet) {
 // OnPublishDropped is called when a message to a client was dropped instead of delivered
 // such as when a client is too slow to respond.
 func (h *Hooks) OnPublishDropped(cl *Client, pk packets.Packet) {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnPublishDropped) {
-			hook.OnPublishDropped(cl, pk)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnPublishDropped) && hs.scopedPacket(i, cl, pk) {
+			if d := hs.dispatcher(i); d != nil {
+				pk := pk // copied so that only async calls move it to the heap
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnPublishDropped, func() { hook.OnPublishDropped(cl, pk) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnPublishDropped, func() { hook.OnPublishDropped(cl, pk) })
+		}
+	}
+}
+
+// OnMessageDropped is called when a message was dropped instead of being delivered to a
+// client, with the reason it was dropped. For messages without subscribers, the client is
+// the publishing client, and the message is only reported if the client is still known.
+func (h *Hooks) OnMessageDropped(cl *Client, pk packets.Packet, reason DropReason) {
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnMessageDropped) && hs.scopedPacket(i, cl, pk) {
+			if d := hs.dispatcher(i); d != nil {
+				pk := pk // copied so that only async calls move it to the heap
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnMessageDropped, func() { hook.OnMessageDropped(cl, pk, reason) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnMessageDropped, func() { hook.OnMessageDropped(cl, pk, reason) })
 		}
 	}
 }
 
 // OnRetainMessage is called then a published message is retained.
 func (h *Hooks) OnRetainMessage(cl *Client, pk packets.Packet, r int64) {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnRetainMessage) {
-			hook.OnRetainMessage(cl, pk, r)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnRetainMessage) && hs.scopedPacket(i, cl, pk) {
+			if d := hs.dispatcher(i); d != nil {
+				pk := pk // copied so that only async calls move it to the heap
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnRetainMessage, func() { hook.OnRetainMessage(cl, pk, r) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnRetainMessage, func() { hook.OnRetainMessage(cl, pk, r) })
 		}
 	}
 }
 
 // OnRetainPublished is called when a retained message is published.
 func (h *Hooks) OnRetainPublished(cl *Client, pk packets.Packet) {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnRetainPublished) {
-			hook.OnRetainPublished(cl, pk)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnRetainPublished) && hs.scopedPacket(i, cl, pk) {
+			if d := hs.dispatcher(i); d != nil {
+				pk := pk // copied so that only async calls move it to the heap
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnRetainPublished, func() { hook.OnRetainPublished(cl, pk) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnRetainPublished, func() { hook.OnRetainPublished(cl, pk) })
+		}
+	}
+}
+
+// OnRetainedDelivered is called when the retained messages matching a filter have been
+// delivered to a client which subscribed to it, with the number of messages delivered.
+func (h *Hooks) OnRetainedDelivered(cl *Client, filter string, count int) {
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnRetainedDelivered) && hs.scoped(i, cl, filter) {
+			if d := hs.dispatcher(i); d != nil {
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnRetainedDelivered, func() { hook.OnRetainedDelivered(cl, filter, count) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnRetainedDelivered, func() { hook.OnRetainedDelivered(cl, filter, count) })
 		}
 	}
 }
@@ -462,9 +1423,17 @@ func (h *Hooks) OnRetainPublished(cl *Client, pk packets.Packet) {
 // In other words, this method is called when a new inflight message is created or resent.
 // It is typically used to store a new inflight message.
 func (h *Hooks) OnQosPublish(cl *Client, pk packets.Packet, sent int64, resends int) {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnQosPublish) {
-			hook.OnQosPublish(cl, pk, sent, resends)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnQosPublish) && hs.scopedPacket(i, cl, pk) {
+			if d := hs.dispatcher(i); d != nil {
+				pk := pk // copied so that only async calls move it to the heap
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnQosPublish, func() { hook.OnQosPublish(cl, pk, sent, resends) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnQosPublish, func() { hook.OnQosPublish(cl, pk, sent, resends) })
 		}
 	}
 }
@@ -473,9 +1442,17 @@ func (h *Hooks) OnQosPublish(cl *Client, pk packets.Packet, sent int64, resends
 // In other words, when an inflight message is resolved.
 // It is typically used to delete an inflight message from a store.
 func (h *Hooks) OnQosComplete(cl *Client, pk packets.Packet) {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnQosComplete) {
-			hook.OnQosComplete(cl, pk)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnQosComplete) && hs.scopedPacket(i, cl, pk) {
+			if d := hs.dispatcher(i); d != nil {
+				pk := pk // copied so that only async calls move it to the heap
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnQosComplete, func() { hook.OnQosComplete(cl, pk) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnQosComplete, func() { hook.OnQosComplete(cl, pk) })
 		}
 	}
 }
@@ -484,9 +1461,37 @@ func (h *Hooks) OnQosComplete(cl *Client, pk packets.Packet) {
 // an inflight message expires or is abandoned. It is typically used to delete an
 // inflight message from a store.
 func (h *Hooks) OnQosDropped(cl *Client, pk packets.Packet) {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnQosDropped) {
-			hook.OnQosDropped(cl, pk)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnQosDropped) && hs.scopedPacket(i, cl, pk) {
+			if d := hs.dispatcher(i); d != nil {
+				pk := pk // copied so that only async calls move it to the heap
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnQosDropped, func() { hook.OnQosDropped(cl, pk) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnQosDropped, func() { hook.OnQosDropped(cl, pk) })
+		}
+	}
+}
+
+// OnQueuedMessage is called when a publish packet with Qos >= 1 is queued for a client
+// which is not connected, such as a disconnected client with a durable session. The
+// message is delivered when the client reconnects, at which point OnQosPublish is called.
+// It is typically used to store a queued message.
+func (h *Hooks) OnQueuedMessage(cl *Client, pk packets.Packet) {
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnQueuedMessage) && hs.scopedPacket(i, cl, pk) {
+			if d := hs.dispatcher(i); d != nil {
+				pk := pk // copied so that only async calls move it to the heap
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnQueuedMessage, func() { hook.OnQueuedMessage(cl, pk) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnQueuedMessage, func() { hook.OnQueuedMessage(cl, pk) })
 		}
 	}
 }
@@ -494,9 +1499,17 @@ func (h *Hooks) OnQosDropped(cl *Client, pk packets.Packet) {
 // OnPacketIDExhausted is called when the client runs out of unused packet ids to
 // assign to a packet.
 func (h *Hooks) OnPacketIDExhausted(cl *Client, pk packets.Packet) {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnPacketIDExhausted) {
-			hook.OnPacketIDExhausted(cl, pk)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnPacketIDExhausted) && hs.scopedPacket(i, cl, pk) {
+			if d := hs.dispatcher(i); d != nil {
+				pk := pk // copied so that only async calls move it to the heap
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnPacketIDExhausted, func() { hook.OnPacketIDExhausted(cl, pk) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnPacketIDExhausted, func() { hook.OnPacketIDExhausted(cl, pk) })
 		}
 	}
 }
@@ -506,10 +1519,14 @@ func (h *Hooks) OnPacketIDExhausted(cl *Client, pk packets.Packet) {
 // published. The return values of the hook methods are passed-through in the order
 // the hooks were attached.
 func (h *Hooks) OnWill(cl *Client, will Will) Will {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnWill) {
-			mlwt, err := hook.OnWill(cl, will)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnWill) && hs.scoped(i, cl, will.TopicName) {
+			mlwt, err := will, error(nil)
+			h.guard(hs, i, OnWill, func() { mlwt, err = hook.OnWill(cl, will) })
 			if err != nil {
+				hs.failed(i, OnWill)
 				h.Log.Error("parse will error",
 					"error", err,
 					"hook", hook.ID(),
@@ -524,28 +1541,71 @@ func (h *Hooks) OnWill(cl *Client, will Will) Will {
 }
 
 // OnWillSent is called when an LWT message has been issued from a disconnecting client.
+// A will with a will delay interval is issued when the interval or the session ends,
+// whichever is first, and is never issued if the client reconnects before then.
 func (h *Hooks) OnWillSent(cl *Client, pk packets.Packet) {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnWillSent) {
-			hook.OnWillSent(cl, pk)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnWillSent) && hs.scopedPacket(i, cl, pk) {
+			if d := hs.dispatcher(i); d != nil {
+				pk := pk // copied so that only async calls move it to the heap
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnWillSent, func() { hook.OnWillSent(cl, pk) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnWillSent, func() { hook.OnWillSent(cl, pk) })
 		}
 	}
 }
 
 // OnClientExpired is called when a client session has expired and should be deleted.
 func (h *Hooks) OnClientExpired(cl *Client) {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnClientExpired) {
-			hook.OnClientExpired(cl)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnClientExpired) && hs.scoped(i, cl, "") {
+			if d := hs.dispatcher(i); d != nil {
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnClientExpired, func() { hook.OnClientExpired(cl) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnClientExpired, func() { hook.OnClientExpired(cl) })
 		}
 	}
 }
 
 // OnRetainedExpired is called when a retained message has expired and should be deleted.
 func (h *Hooks) OnRetainedExpired(filter string) {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnRetainedExpired) {
-			hook.OnRetainedExpired(filter)
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnRetainedExpired) && hs.scoped(i, nil, filter) {
+			if d := hs.dispatcher(i); d != nil {
+				d.dispatch(filter, func() { h.guard(hs, i, OnRetainedExpired, func() { hook.OnRetainedExpired(filter) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnRetainedExpired, func() { hook.OnRetainedExpired(filter) })
+		}
+	}
+}
+
+// OnListenerConnection is called when a connection is accepted by a listener, or closed
+// by it. For rejected and tls handshake failed connections, err contains the cause.
+func (h *Hooks) OnListenerConnection(listener string, event ListenerEvent, err error) {
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnListenerConnection) && hs.scopedListener(i, listener) {
+			if d := hs.dispatcher(i); d != nil {
+				d.dispatch(listener, func() {
+					h.guard(hs, i, OnListenerConnection, func() { hook.OnListenerConnection(listener, event, err) })
+				})
+				continue
+			}
+
+			h.guard(hs, i, OnListenerConnection, func() { hook.OnListenerConnection(listener, event, err) })
 		}
 	}
 }
@@ -553,7 +1613,9 @@ func (h *Hooks) OnRetainedExpired(filter string) {
 // StoredClients returns all clients, e.g. from a persistent store, is used to
 // populate the server clients list before start.
 func (h *Hooks) StoredClients() (v []storage.Client, err error) {
-	for _, hook := range h.GetAll() {
+	hs := h.acquire()
+	defer hs.release()
+	for _, hook := range hs.hooks {
 		if hook.Provides(StoredClients) {
 			v, err := hook.StoredClients()
 			if err != nil {
@@ -573,7 +1635,9 @@ func (h *Hooks) StoredClients() (v []storage.Client, err error) {
 // StoredSubscriptions returns all subcriptions, e.g. from a persistent store, and is
 // used to populate the server subscriptions list before start.
 func (h *Hooks) StoredSubscriptions() (v []storage.Subscription, err error) {
-	for _, hook := range h.GetAll() {
+	hs := h.acquire()
+	defer hs.release()
+	for _, hook := range hs.hooks {
 		if hook.Provides(StoredSubscriptions) {
 			v, err := hook.StoredSubscriptions()
 			if err != nil {
@@ -593,7 +1657,9 @@ func (h *Hooks) StoredSubscriptions() (v []storage.Subscription, err error) {
 // StoredInflightMessages returns all inflight messages, e.g. from a persistent store,
 // and is used to populate the restored clients with inflight messages before start.
 func (h *Hooks) StoredInflightMessages() (v []storage.Message, err error) {
-	for _, hook := range h.GetAll() {
+	hs := h.acquire()
+	defer hs.release()
+	for _, hook := range hs.hooks {
 		if hook.Provides(StoredInflightMessages) {
 			v, err := hook.StoredInflightMessages()
 			if err != nil {
@@ -610,10 +1676,34 @@ func (h *Hooks) StoredInflightMessages() (v []storage.Message, err error) {
 	return
 }
 
+// StoredQueuedMessages returns all messages queued for disconnected clients, e.g. from a
+// persistent store, and is used to populate the restored clients with queued messages before start.
+func (h *Hooks) StoredQueuedMessages() (v []storage.Message, err error) {
+	hs := h.acquire()
+	defer hs.release()
+	for _, hook := range hs.hooks {
+		if hook.Provides(StoredQueuedMessages) {
+			v, err := hook.StoredQueuedMessages()
+			if err != nil {
+				h.Log.Error("failed to load queued messages", "error", err, "hook", hook.ID())
+				return v, err
+			}
+
+			if len(v) > 0 {
+				return v, nil
+			}
+		}
+	}
+
+	return
+}
+
 // StoredRetainedMessages returns all retained messages, e.g. from a persistent store,
 // and is used to populate the server topics with retained messages before start.
 func (h *Hooks) StoredRetainedMessages() (v []storage.Message, err error) {
-	for _, hook := range h.GetAll() {
+	hs := h.acquire()
+	defer hs.release()
+	for _, hook := range hs.hooks {
 		if hook.Provides(StoredRetainedMessages) {
 			v, err := hook.StoredRetainedMessages()
 			if err != nil {
@@ -630,9 +1720,211 @@ func (h *Hooks) StoredRetainedMessages() (v []storage.Message, err error) {
 	return
 }
 
+// IterClients calls fn with each stored client, e.g. from a persistent store, streaming the
+// values from hooks which implement StoredIterator, and otherwise from StoredClients.
+func (h *Hooks) IterClients(fn func(v storage.Client) error) error {
+	hs := h.acquire()
+	defer hs.release()
+	for _, hook := range hs.hooks {
+		if !hook.Provides(StoredClients) {
+			continue
+		}
+
+		var n int
+		visit := func(v storage.Client) error {
+			n++
+			return fn(v)
+		}
+
+		var err error
+		if it, ok := hook.(StoredIterator); ok {
+			err = it.IterClients(visit)
+		} else {
+			var v []storage.Client
+			v, err = hook.StoredClients()
+			for i := 0; err == nil && i < len(v); i++ {
+				err = visit(v[i])
+			}
+		}
+
+		if err != nil {
+			h.Log.Error("failed to load clients", "error", err, "hook", hook.ID())
+			return err
+		}
+
+		if n > 0 {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// IterSubscriptions calls fn with each stored subscription, e.g. from a persistent store, streaming the
+// values from hooks which implement StoredIterator, and otherwise from StoredSubscriptions.
+func (h *Hooks) IterSubscriptions(fn func(v storage.Subscription) error) error {
+	hs := h.acquire()
+	defer hs.release()
+	for _, hook := range hs.hooks {
+		if !hook.Provides(StoredSubscriptions) {
+			continue
+		}
+
+		var n int
+		visit := func(v storage.Subscription) error {
+			n++
+			return fn(v)
+		}
+
+		var err error
+		if it, ok := hook.(StoredIterator); ok {
+			err = it.IterSubscriptions(visit)
+		} else {
+			var v []storage.Subscription
+			v, err = hook.StoredSubscriptions()
+			for i := 0; err == nil && i < len(v); i++ {
+				err = visit(v[i])
+			}
+		}
+
+		if err != nil {
+			h.Log.Error("failed to load subscriptions", "error", err, "hook", hook.ID())
+			return err
+		}
+
+		if n > 0 {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// IterInflightMessages calls fn with each stored inflight message, e.g. from a persistent store, streaming the
+// values from hooks which implement StoredIterator, and otherwise from StoredInflightMessages.
+func (h *Hooks) IterInflightMessages(fn func(v storage.Message) error) error {
+	hs := h.acquire()
+	defer hs.release()
+	for _, hook := range hs.hooks {
+		if !hook.Provides(StoredInflightMessages) {
+			continue
+		}
+
+		var n int
+		visit := func(v storage.Message) error {
+			n++
+			return fn(v)
+		}
+
+		var err error
+		if it, ok := hook.(StoredIterator); ok {
+			err = it.IterInflightMessages(visit)
+		} else {
+			var v []storage.Message
+			v, err = hook.StoredInflightMessages()
+			for i := 0; err == nil && i < len(v); i++ {
+				err = visit(v[i])
+			}
+		}
+
+		if err != nil {
+			h.Log.Error("failed to load inflight messages", "error", err, "hook", hook.ID())
+			return err
+		}
+
+		if n > 0 {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// IterQueuedMessages calls fn with each stored message queued for a disconnected client, e.g. from a persistent store, streaming the
+// values from hooks which implement StoredIterator, and otherwise from StoredQueuedMessages.
+func (h *Hooks) IterQueuedMessages(fn func(v storage.Message) error) error {
+	hs := h.acquire()
+	defer hs.release()
+	for _, hook := range hs.hooks {
+		if !hook.Provides(StoredQueuedMessages) {
+			continue
+		}
+
+		var n int
+		visit := func(v storage.Message) error {
+			n++
+			return fn(v)
+		}
+
+		var err error
+		if it, ok := hook.(StoredIterator); ok {
+			err = it.IterQueuedMessages(visit)
+		} else {
+			var v []storage.Message
+			v, err = hook.StoredQueuedMessages()
+			for i := 0; err == nil && i < len(v); i++ {
+				err = visit(v[i])
+			}
+		}
+
+		if err != nil {
+			h.Log.Error("failed to load queued messages", "error", err, "hook", hook.ID())
+			return err
+		}
+
+		if n > 0 {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// IterRetainedMessages calls fn with each stored retained message, e.g. from a persistent store, streaming the
+// values from hooks which implement StoredIterator, and otherwise from StoredRetainedMessages.
+func (h *Hooks) IterRetainedMessages(fn func(v storage.Message) error) error {
+	hs := h.acquire()
+	defer hs.release()
+	for _, hook := range hs.hooks {
+		if !hook.Provides(StoredRetainedMessages) {
+			continue
+		}
+
+		var n int
+		visit := func(v storage.Message) error {
+			n++
+			return fn(v)
+		}
+
+		var err error
+		if it, ok := hook.(StoredIterator); ok {
+			err = it.IterRetainedMessages(visit)
+		} else {
+			var v []storage.Message
+			v, err = hook.StoredRetainedMessages()
+			for i := 0; err == nil && i < len(v); i++ {
+				err = visit(v[i])
+			}
+		}
+
+		if err != nil {
+			h.Log.Error("failed to load retained messages", "error", err, "hook", hook.ID())
+			return err
+		}
+
+		if n > 0 {
+			return nil
+		}
+	}
+
+	return nil
+}
+
 // StoredSysInfo returns a set of system info values.
 func (h *Hooks) StoredSysInfo() (v storage.SystemInfo, err error) {
-	for _, hook := range h.GetAll() {
+	hs := h.acquire()
+	defer hs.release()
+	for _, hook := range hs.hooks {
 		if hook.Provides(StoredSysInfo) {
 			v, err := hook.StoredSysInfo()
 			if err != nil {
@@ -649,15 +1941,55 @@ func (h *Hooks) StoredSysInfo() (v storage.SystemInfo, err error) {
 	return
 }
 
+// StoredSession returns the stored session of a single client, e.g. from a persistent store,
+// and is used to restore the session of a client when it connects if sessions are loaded lazily.
+func (h *Hooks) StoredSession(id string) (v storage.Session, err error) {
+	hs := h.acquire()
+	defer hs.release()
+	for _, hook := range hs.hooks {
+		if hook.Provides(StoredSession) {
+			v, err := hook.StoredSession(id)
+			if err != nil {
+				h.Log.Error("failed to load session", "error", err, "hook", hook.ID(), "client", id)
+				return v, err
+			}
+
+			if v.Client.ID != "" {
+				return v, nil
+			}
+		}
+	}
+
+	return
+}
+
 // OnConnectAuthenticate is called when a user attempts to authenticate with the server.
 // An implementation of this method MUST be used to allow or deny access to the
 // server (see hooks/auth/allow_all or basic). It can be used in custom hooks to
-// check connecting users against an existing user database.
+// check connecting users against an existing user database. Hooks are asked in order
+// until one allows the client, or one which implements ConnectDecider denies it.
 func (h *Hooks) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnConnectAuthenticate) {
-			if ok := hook.OnConnectAuthenticate(cl, pk); ok {
-				return true
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnConnectAuthenticate) && hs.inScope(i, cl) && hs.scoped(i, cl, "") {
+			var d AuthDecision // a hook which panics does not authenticate the client
+			if t := hs.timeout(i); t != nil {
+				in := pk
+				var done bool
+				if d, done = timed(h, hs, i, OnConnectAuthenticate, AuthPass, func() AuthDecision { return connectDecision(hook, cl, in) }); !done {
+					if t.Policy == TimeoutSkip {
+						continue
+					}
+
+					return t.Policy == TimeoutAllow
+				}
+			} else {
+				h.guard(hs, i, OnConnectAuthenticate, func() { d = connectDecision(hook, cl, pk) })
+			}
+
+			if d != AuthPass {
+				return d == AuthAllow
 			}
 		}
 	}
@@ -669,11 +2001,28 @@ func (h *Hooks) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool {
 // An implementation of this method MUST be used to allow or deny access to the
 // (see hooks/auth/allow_all or basic). It can be used in custom hooks to
 // check publishing and subscribing users against an existing permissions or roles database.
+// Hooks are asked in order until one allows access, or one which implements ACLDecider denies it.
 func (h *Hooks) OnACLCheck(cl *Client, topic string, write bool) bool {
-	for _, hook := range h.GetAll() {
-		if hook.Provides(OnACLCheck) {
-			if ok := hook.OnACLCheck(cl, topic, write); ok {
-				return true
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnACLCheck) && hs.inScope(i, cl) && hs.scoped(i, cl, topic) {
+			var d AuthDecision
+			if t := hs.timeout(i); t != nil {
+				var done bool
+				if d, done = timed(h, hs, i, OnACLCheck, AuthPass, func() AuthDecision { return aclDecision(hook, cl, topic, write) }); !done {
+					if t.Policy == TimeoutSkip {
+						continue
+					}
+
+					return t.Policy == TimeoutAllow
+				}
+			} else {
+				h.guard(hs, i, OnACLCheck, func() { d = aclDecision(hook, cl, topic, write) })
+			}
+
+			if d != AuthPass {
+				return d == AuthAllow
 			}
 		}
 	}
@@ -681,6 +2030,108 @@ func (h *Hooks) OnACLCheck(cl *Client, topic string, write bool) bool {
 	return false
 }
 
+// OnACLActionCheck is called when a client with write access to a topic attempts to publish a
+// retained message or register a will message on it. The action is allowed unless a hook denies it,
+// so hooks should return true for actions they do not restrict.
+func (h *Hooks) OnACLActionCheck(cl *Client, topic string, action ACLAction) bool {
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnACLActionCheck) && hs.inScope(i, cl) && hs.scoped(i, cl, topic) {
+			var ok bool // a hook which panics denies the action
+			h.guard(hs, i, OnACLActionCheck, func() { ok = hook.OnACLActionCheck(cl, topic, action) })
+			if !ok {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// OnACLDenied is called when an ACL check denies a client access to a topic, such as when
+// publishing, subscribing, receiving a message, retaining a message or registering a will.
+// The rule which denied access is described by the first hook in scope which implements
+// ACLDenialDescriber and returns a description.
+func (h *Hooks) OnACLDenied(cl *Client, topic string, action ACLAction) {
+	if !h.Provides(OnACLDenied) {
+		return
+	}
+
+	denial := ACLDenial{
+		Topic:  topic,
+		Action: action,
+	}
+
+	hs := h.acquire()
+	defer hs.release()
+	hooks := hs.hooks
+	for i, hook := range hooks {
+		if d, ok := hook.(ACLDenialDescriber); ok && hs.inScope(i, cl) && hs.scoped(i, cl, topic) {
+			if rule := d.DescribeACLDenial(cl, topic, action); rule != "" {
+				denial.Hook = hook.ID()
+				denial.Rule = rule
+				break
+			}
+		}
+	}
+
+	for i, hook := range hooks {
+		if hook.Provides(OnACLDenied) && hs.scoped(i, cl, topic) {
+			if d := hs.dispatcher(i); d != nil {
+				denial := denial // copied so that only async calls move it to the heap
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnACLDenied, func() { hook.OnACLDenied(cl, denial) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnACLDenied, func() { hook.OnACLDenied(cl, denial) })
+		}
+	}
+}
+
+// OnPublishQuota is called when a client with write access to a topic publishes to it, returning
+// false if the publish exceeded a quota and should be rejected. Hooks which throttle rather than
+// reject a publish delay it before returning. Each exceeded quota is passed to OnQuotaExceeded.
+func (h *Hooks) OnPublishQuota(cl *Client, pk packets.Packet) bool {
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnPublishQuota) && hs.inScope(i, cl) && hs.scopedPacket(i, cl, pk) {
+			var exceeded QuotaExceeded
+			var over bool
+			h.guard(hs, i, OnPublishQuota, func() { exceeded, over = hook.OnPublishQuota(cl, pk) })
+			if !over {
+				continue
+			}
+
+			exceeded.Topic = pk.TopicName
+			exceeded.Hook = hook.ID()
+			h.OnQuotaExceeded(cl, exceeded)
+			if !exceeded.Throttled {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// OnQuotaExceeded is called when a publish exceeds a quota, whether it was rejected or throttled.
+func (h *Hooks) OnQuotaExceeded(cl *Client, exceeded QuotaExceeded) {
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if hook.Provides(OnQuotaExceeded) && hs.scoped(i, cl, exceeded.Topic) {
+			if d := hs.dispatcher(i); d != nil {
+				d.dispatch(cl.ID, func() { h.guard(hs, i, OnQuotaExceeded, func() { hook.OnQuotaExceeded(cl, exceeded) }) })
+				continue
+			}
+
+			h.guard(hs, i, OnQuotaExceeded, func() { hook.OnQuotaExceeded(cl, exceeded) })
+		}
+	}
+}
+
 // HookBase provides a set of default methods for each hook. It should be embedded in
 // all hooks.
 type HookBase struct {
@@ -737,6 +2188,22 @@ func (h *HookBase) OnACLCheck(cl *Client, topic string, write bool) bool {
 	return false
 }
 
+// OnACLActionCheck is called when a user attempts to retain a message or register a will on a topic.
+func (h *HookBase) OnACLActionCheck(cl *Client, topic string, action ACLAction) bool {
+	return true
+}
+
+// OnACLDenied is called when an ACL check denies a client access to a topic.
+func (h *HookBase) OnACLDenied(cl *Client, denial ACLDenial) {}
+
+// OnPublishQuota is called when a client publishes to a topic it has write access to.
+func (h *HookBase) OnPublishQuota(cl *Client, pk packets.Packet) (QuotaExceeded, bool) {
+	return QuotaExceeded{}, false
+}
+
+// OnQuotaExceeded is called when a publish exceeds a quota.
+func (h *HookBase) OnQuotaExceeded(cl *Client, exceeded QuotaExceeded) {}
+
 // OnConnect is called when a new client connects.
 func (h *HookBase) OnConnect(cl *Client, pk packets.Packet) error {
 	return nil
@@ -749,14 +2216,28 @@ func (h *HookBase) OnSessionEstablish(cl *Client, pk packets.Packet) {}
 // OnSessionEstablished is called when a new client establishes a session (after OnConnect).
 func (h *HookBase) OnSessionEstablished(cl *Client, pk packets.Packet) {}
 
+// OnSessionTakenOver is called when a connected client is evicted by a new client with the same id.
+func (h *HookBase) OnSessionTakenOver(evicted, cl *Client) {}
+
 // OnDisconnect is called when a client is disconnected for any reason.
 func (h *HookBase) OnDisconnect(cl *Client, err error, expire bool) {}
 
+// OnKeepAliveTimeout is called when a client is disconnected due to keepalive expiry.
+func (h *HookBase) OnKeepAliveTimeout(cl *Client) {}
+
 // OnAuthPacket is called when an auth packet is received from the client.
 func (h *HookBase) OnAuthPacket(cl *Client, pk packets.Packet) (packets.Packet, error) {
 	return pk, nil
 }
 
+// OnEnhancedAuth is called for each step of an enhanced authentication exchange.
+func (h *HookBase) OnEnhancedAuth(cl *Client, ea EnhancedAuth) (packets.Code, []byte) {
+	return packets.ErrBadAuthenticationMethod, nil
+}
+
+// OnAuthFailed is called when a client fails to authenticate.
+func (h *HookBase) OnAuthFailed(cl *Client, code packets.Code) {}
+
 // OnPacketRead is called when a packet is received.
 func (h *HookBase) OnPacketRead(cl *Client, pk packets.Packet) (packets.Packet, error) {
 	return pk, nil
@@ -770,6 +2251,9 @@ func (h *HookBase) OnPacketEncode(cl *Client, pk packets.Packet) packets.Packet
 // OnPacketSent is called immediately after a packet is written to a client.
 func (h *HookBase) OnPacketSent(cl *Client, pk packets.Packet, b []byte) {}
 
+// OnPacketWritten is called immediately after a packet is written to a client.
+func (h *HookBase) OnPacketWritten(cl *Client, w PacketWritten) {}
+
 // OnPacketProcessed is called immediately after a packet from a client is processed.
 func (h *HookBase) OnPacketProcessed(cl *Client, pk packets.Packet, err error) {}
 
@@ -778,6 +2262,11 @@ func (h *HookBase) OnSubscribe(cl *Client, pk packets.Packet) packets.Packet {
 	return pk
 }
 
+// OnSubscribeFilter is called for each filter a client subscribes to.
+func (h *HookBase) OnSubscribeFilter(cl *Client, sub packets.Subscription) (packets.Subscription, error) {
+	return sub, nil
+}
+
 // OnSubscribed is called when a client subscribes to one or more filters.
 func (h *HookBase) OnSubscribed(cl *Client, pk packets.Packet, reasonCodes []byte) {}
 
@@ -805,12 +2294,18 @@ func (h *HookBase) OnPublished(cl *Client, pk packets.Packet) {}
 // OnPublishDropped is called when a message to a client is dropped instead of being delivered.
 func (h *HookBase) OnPublishDropped(cl *Client, pk packets.Packet) {}
 
+// OnMessageDropped is called when a message is dropped instead of being delivered to a client.
+func (h *HookBase) OnMessageDropped(cl *Client, pk packets.Packet, reason DropReason) {}
+
 // OnRetainMessage is called then a published message is retained.
 func (h *HookBase) OnRetainMessage(cl *Client, pk packets.Packet, r int64) {}
 
 // OnRetainPublished is called when a retained message is published.
 func (h *HookBase) OnRetainPublished(cl *Client, pk packets.Packet) {}
 
+// OnRetainedDelivered is called when the retained messages of a filter are delivered to a client.
+func (h *HookBase) OnRetainedDelivered(cl *Client, filter string, count int) {}
+
 // OnQosPublish is called when a publish packet with Qos > 1 is issued to a subscriber.
 func (h *HookBase) OnQosPublish(cl *Client, pk packets.Packet, sent int64, resends int) {}
 
@@ -820,6 +2315,9 @@ func (h *HookBase) OnQosComplete(cl *Client, pk packets.Packet) {}
 // OnQosDropped is called the Qos flow for a message expires.
 func (h *HookBase) OnQosDropped(cl *Client, pk packets.Packet) {}
 
+// OnQueuedMessage is called when a publish packet with Qos > 0 is queued for a disconnected client.
+func (h *HookBase) OnQueuedMessage(cl *Client, pk packets.Packet) {}
+
 // OnPacketIDExhausted is called when the client runs out of unused packet ids to assign to a packet.
 func (h *HookBase) OnPacketIDExhausted(cl *Client, pk packets.Packet) {}
 
@@ -837,6 +2335,9 @@ func (h *HookBase) OnClientExpired(cl *Client) {}
 // OnRetainedExpired is called when a retained message for a topic has expired.
 func (h *HookBase) OnRetainedExpired(topic string) {}
 
+// OnListenerConnection is called when a connection is accepted or closed by a listener.
+func (h *HookBase) OnListenerConnection(listener string, event ListenerEvent, err error) {}
+
 // StoredClients returns all clients from a store.
 func (h *HookBase) StoredClients() (v []storage.Client, err error) {
 	return
@@ -852,6 +2353,11 @@ func (h *HookBase) StoredInflightMessages() (v []storage.Message, err error) {
 	return
 }
 
+// StoredQueuedMessages returns all messages queued for disconnected clients from a store.
+func (h *HookBase) StoredQueuedMessages() (v []storage.Message, err error) {
+	return
+}
+
 // StoredRetainedMessages returns all retained messages from a store.
 func (h *HookBase) StoredRetainedMessages() (v []storage.Message, err error) {
 	return
@@ -861,3 +2367,8 @@ func (h *HookBase) StoredRetainedMessages() (v []storage.Message, err error) {
 func (h *HookBase) StoredSysInfo() (v storage.SystemInfo, err error) {
 	return
 }
+
+// StoredSession returns the stored session of a client from a store.
+func (h *HookBase) StoredSession(id string) (v storage.Session, err error) {
+	return
+}
@@ -0,0 +1,86 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"context"
+	"log/slog"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+)
+
+// AuditOptions contains the configuration of the ACL denial audit hook.
+type AuditOptions struct {
+	// Level is the level audit records are logged at, such as info or warn (default warn).
+	Level string `yaml:"level" json:"level"`
+
+	// Logger receives the audit records, such as a logger with a json handler writing to a
+	// file shipped to a SIEM (default the server logger).
+	Logger *slog.Logger `yaml:"-" json:"-"`
+
+	// OnDenied is called with each ACL denial, so it may be forwarded elsewhere.
+	OnDenied func(cl *mqtt.Client, denial mqtt.ACLDenial) `yaml:"-" json:"-"`
+}
+
+// AuditHook is a hook which logs a structured audit record of every ACL check which denies
+// a client access to a topic, including the client, topic, action and the rule which denied it.
+type AuditHook struct {
+	mqtt.HookBase
+	config *AuditOptions
+	level  slog.Level
+}
+
+// ID returns the ID of the hook.
+func (h *AuditHook) ID() string {
+	return "auth-audit"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *AuditHook) Provides(b byte) bool {
+	return b == mqtt.OnACLDenied
+}
+
+// Init configures the hook.
+func (h *AuditHook) Init(config any) error {
+	if _, ok := config.(*AuditOptions); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(AuditOptions)
+	}
+
+	h.config = config.(*AuditOptions)
+	if h.config.Level == "" {
+		h.config.Level = slog.LevelWarn.String()
+	}
+
+	if err := h.level.UnmarshalText([]byte(h.config.Level)); err != nil {
+		return err
+	}
+
+	if h.config.Logger == nil {
+		h.config.Logger = h.Log
+	}
+
+	return nil
+}
+
+// OnACLDenied logs an audit record of an ACL check which denied a client access to a topic.
+func (h *AuditHook) OnACLDenied(cl *mqtt.Client, denial mqtt.ACLDenial) {
+	h.config.Logger.LogAttrs(context.Background(), h.level, "acl denied",
+		slog.String("client", cl.ID),
+		slog.String("username", string(cl.Properties.Username)),
+		slog.String("remote", cl.Net.Remote),
+		slog.String("listener", cl.Net.Listener),
+		slog.String("topic", denial.Topic),
+		slog.String("action", denial.Action.String()),
+		slog.String("hook", denial.Hook),
+		slog.String("rule", denial.Rule))
+
+	if h.config.OnDenied != nil {
+		h.config.OnDenied(cl, denial)
+	}
+}
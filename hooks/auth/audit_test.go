@@ -0,0 +1,70 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditHookID(t *testing.T) {
+	h := new(AuditHook)
+	require.Equal(t, "auth-audit", h.ID())
+}
+
+func TestAuditHookProvides(t *testing.T) {
+	h := new(AuditHook)
+	require.True(t, h.Provides(mqtt.OnACLDenied))
+	require.False(t, h.Provides(mqtt.OnACLCheck))
+}
+
+func TestAuditHookInit(t *testing.T) {
+	h := new(AuditHook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+	require.Error(t, h.Init(&AuditOptions{Level: "loud"}))
+
+	require.NoError(t, h.Init(nil))
+	require.Equal(t, slog.LevelWarn, h.level)
+	require.Same(t, logger, h.config.Logger)
+}
+
+func TestAuditHookOnACLDenied(t *testing.T) {
+	buf := new(bytes.Buffer)
+	var denials []mqtt.ACLDenial
+
+	h := new(AuditHook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&AuditOptions{
+		Level:    "info",
+		Logger:   slog.New(slog.NewJSONHandler(buf, nil)),
+		OnDenied: func(cl *mqtt.Client, denial mqtt.ACLDenial) { denials = append(denials, denial) },
+	}))
+
+	cl := &mqtt.Client{ID: "cl1", Properties: mqtt.ClientProperties{Username: []byte("mochi")}}
+	cl.Net.Remote = "10.0.0.1:1000"
+	cl.Net.Listener = "t1"
+	denial := mqtt.ACLDenial{Topic: "a/b", Action: mqtt.ACLActionWrite, Hook: "auth-ledger", Rule: "acl[0].filters[a/#]"}
+	h.OnACLDenied(cl, denial)
+
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	require.Equal(t, "INFO", record["level"])
+	require.Equal(t, "acl denied", record["msg"])
+	require.Equal(t, "cl1", record["client"])
+	require.Equal(t, "mochi", record["username"])
+	require.Equal(t, "10.0.0.1:1000", record["remote"])
+	require.Equal(t, "t1", record["listener"])
+	require.Equal(t, "a/b", record["topic"])
+	require.Equal(t, "write", record["action"])
+	require.Equal(t, "auth-ledger", record["hook"])
+	require.Equal(t, "acl[0].filters[a/#]", record["rule"])
+	require.Equal(t, []mqtt.ACLDenial{denial}, denials)
+}
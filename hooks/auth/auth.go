@@ -6,22 +6,99 @@ package auth
 
 import (
 	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
 	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
 )
 
+const (
+	// DefaultControlTopic is the default topic dynamic security commands are published to.
+	DefaultControlTopic = "$CONTROL/dynamic-security/v1"
+
+	controlSubscriptionID = 1 // the identifier of the inline subscription to the control topic
+
+	// defaultBackendTimeout is the default number of milliseconds to wait for a response from
+	// the service behind an auth hook, such as an http endpoint, database or vault.
+	defaultBackendTimeout = 5000
+)
+
 // Options contains the configuration/rules data for the auth ledger.
 type Options struct {
 	Data   []byte
 	Ledger *Ledger
+
+	// Server enables dynamic security, if set. Users can then be managed by publishing commands
+	// to the control topic, and persisted by the storage hooks. The server must have the inline
+	// client enabled.
+	Server *mqtt.Server
+
+	// ControlTopic is the topic dynamic security commands are published to (default
+	// $CONTROL/dynamic-security/v1). Responses are published to ControlTopic/response.
+	ControlTopic string
+
+	// Admins are the usernames of the clients allowed to publish commands to the control topic
+	// and to subscribe to its responses. No other clients can access the control topics.
+	Admins []string
+
+	// Persist stores the users as a retained message on ControlTopic/users whenever they change,
+	// so they are saved by any storage hook and restored when the server is started.
+	Persist bool
+
+	// Source is the path of a yaml or json ledger file, or an http or https url to fetch the
+	// ledger from. The ledger is loaded from the source when the hook is initialised, and
+	// replaced whenever the source changes, including its users.
+	Source string
+
+	// SourceHeaders are added to the requests for a url source, such as an authorization header.
+	SourceHeaders map[string]string
+
+	// ReloadInterval is the seconds between checks of the source for changes (default 5). The
+	// source is not reloaded if negative.
+	ReloadInterval int64
 }
 
 // Hook is an authentication hook which implements an auth ledger.
 type Hook struct {
 	mqtt.HookBase
-	config *Options
-	ledger *Ledger
+	config   *Options
+	ledger   *Ledger
+	client   *http.Client                       // the http client used to fetch a url source
+	sourceMu sync.Mutex                         // guards source
+	source   ledgerSource                       // the state of the source the ledger was last loaded from
+	done     chan struct{}                      // closed to stop the reload loop
+	stopped  chan struct{}                      // closed when the reload loop has stopped
+	quotaMu  sync.Mutex                         // guards quotas
+	quotas   map[string]map[string]*quotaBucket // the publish quotas of clients, keyed on client id and rule
+}
+
+// controlCommand is a dynamic security command published to the control topic.
+type controlCommand struct {
+	Command  string  `json:"command"`            // addUser, removeUser, setACL or listUsers
+	Username string  `json:"username,omitempty"` // the username of the user to change
+	Password string  `json:"password,omitempty"` // the password of a user to add
+	ACL      Filters `json:"acl,omitempty"`      // the ACL filters of a user to add or change
+}
+
+// controlRequest is a message of commands published to the control topic.
+type controlRequest struct {
+	Commands []controlCommand `json:"commands"`
+}
+
+// controlResult is the result of a dynamic security command.
+type controlResult struct {
+	Command string   `json:"command"`
+	Error   string   `json:"error,omitempty"`
+	Users   []string `json:"users,omitempty"` // the usernames returned by listUsers
+}
+
+// controlResponse is a message of results published to the control response topic.
+type controlResponse struct {
+	Responses []controlResult `json:"responses"`
 }
 
 // ID returns the ID of the hook.
@@ -32,8 +109,13 @@ func (h *Hook) ID() string {
 // Provides indicates which hook methods this hook provides.
 func (h *Hook) Provides(b byte) bool {
 	return bytes.Contains([]byte{
+		mqtt.OnConnect,
 		mqtt.OnConnectAuthenticate,
 		mqtt.OnACLCheck,
+		mqtt.OnACLActionCheck,
+		mqtt.OnPublishQuota,
+		mqtt.OnDisconnect,
+		mqtt.OnStarted,
 	}, []byte{b})
 }
 
@@ -67,10 +149,101 @@ func (h *Hook) Init(config any) error {
 		}
 	}
 
+	if h.config.Source != "" {
+		h.client = new(http.Client)
+		if err := h.ReloadLedger(); err != nil {
+			return err
+		}
+	}
+
+	if err := h.ledger.Validate(); err != nil {
+		return err
+	}
+
+	if h.config.Server != nil {
+		if !h.config.Server.Options.InlineClient {
+			return mqtt.ErrInlineClientNotEnabled
+		}
+
+		if h.config.ControlTopic == "" {
+			h.config.ControlTopic = DefaultControlTopic
+		}
+	}
+
 	h.Log.Info("loaded auth rules",
 		"authentication", len(h.ledger.Auth),
 		"acl", len(h.ledger.ACL))
 
+	if h.config.ReloadInterval == 0 {
+		h.config.ReloadInterval = defaultReloadInterval
+	}
+
+	if h.config.Source != "" && h.config.ReloadInterval > 0 {
+		h.done = make(chan struct{})
+		h.stopped = make(chan struct{})
+		go h.reloadLoop(time.Duration(h.config.ReloadInterval) * time.Second)
+	}
+
+	return nil
+}
+
+// Stop stops checking the ledger source for changes.
+func (h *Hook) Stop() error {
+	if h.done != nil {
+		close(h.done)
+		<-h.stopped
+		h.done = nil
+	}
+
+	return nil
+}
+
+// Reload replaces the rules of the auth ledger with the Ledger or Data of a new config while the
+// server is running, including its users. The ACL decisions cached by the server are
+// invalidated. The other options are only applied when the hook is initialised.
+func (h *Hook) Reload(config any) error {
+	o, ok := config.(*Options)
+	if !ok || o == nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	ln := o.Ledger
+	if ln == nil {
+		ln = new(Ledger)
+		if err := ln.Unmarshal(o.Data); err != nil {
+			return err
+		}
+	}
+
+	if err := ln.Validate(); err != nil {
+		return err
+	}
+
+	h.ledger.Replace(ln)
+	if h.Opts != nil {
+		h.Opts.AuthCache.InvalidateAll()
+	}
+
+	h.Log.Info("reloaded auth rules",
+		"users", len(ln.Users),
+		"authentication", len(ln.Auth),
+		"acl", len(ln.ACL))
+
+	return nil
+}
+
+// OnConnect rejects a connecting client with an invalid client identifier reason code if its
+// client id does not match the client id rules of the auth ledger.
+func (h *Hook) OnConnect(cl *mqtt.Client, pk packets.Packet) error {
+	if n, ok := h.ledger.ClientIDOk(cl); !ok {
+		h.Log.Info("client id rejected by auth ledger",
+			"client", cl.ID,
+			"username", string(pk.Connect.Username),
+			"remote", cl.Net.Remote,
+			"rule", n)
+		return packets.ErrClientIdentifierNotValid
+	}
+
 	return nil
 }
 
@@ -78,6 +251,9 @@ func (h *Hook) Init(config any) error {
 // in the auth ledger.
 func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
 	if _, ok := h.ledger.AuthOk(cl, pk); ok {
+		if h.ledger.SuperuserOk(cl, pk) {
+			cl.SetSuperuser(true)
+		}
 		return true
 	}
 
@@ -88,8 +264,12 @@ func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
 }
 
 // OnACLCheck returns true if the connecting client has matching read or write access to subscribe
-// or publish to a given topic.
+// or publish to a given topic. Only admins can access the dynamic security control topics.
 func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	if h.isControlTopic(topic) {
+		return h.isAdmin(cl)
+	}
+
 	if _, ok := h.ledger.ACLOk(cl, topic, write); ok {
 		return true
 	}
@@ -101,3 +281,193 @@ func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
 
 	return false
 }
+
+// OnACLActionCheck returns true unless the retain or will filters of the auth ledger disallow
+// the client from retaining a message or registering a will on a topic.
+func (h *Hook) OnACLActionCheck(cl *mqtt.Client, topic string, action mqtt.ACLAction) bool {
+	if _, ok := h.ledger.ActionOk(cl, topic, action); ok {
+		return true
+	}
+
+	h.Log.Debug("client failed ACL action check",
+		"client", cl.ID,
+		"username", string(cl.Properties.Username),
+		"action", action.String(),
+		"topic", topic)
+	return false
+}
+
+// DescribeACLDenial describes the rule of the auth ledger which denied a client access to a topic.
+func (h *Hook) DescribeACLDenial(cl *mqtt.Client, topic string, action mqtt.ACLAction) string {
+	switch action {
+	case mqtt.ACLActionRead, mqtt.ACLActionWrite:
+		if h.isControlTopic(topic) {
+			return "control topic"
+		}
+
+		return h.ledger.ACLRule(cl, topic, action == mqtt.ACLActionWrite)
+	default:
+		return h.ledger.ActionRule(cl, topic, action)
+	}
+}
+
+// OnStarted restores the persisted users and subscribes to the control topic, if dynamic
+// security is enabled.
+func (h *Hook) OnStarted() {
+	if h.config.Server == nil {
+		return
+	}
+
+	if h.config.Persist {
+		h.restoreUsers()
+	}
+
+	err := h.config.Server.Subscribe(h.config.ControlTopic, controlSubscriptionID, h.onControl)
+	if err != nil {
+		h.Log.Error("failed to subscribe to dynamic security control topic", "error", err)
+	}
+}
+
+// AddUser adds a user to the ledger, replacing any existing user with the same username.
+func (h *Hook) AddUser(username, password string, acl Filters) error {
+	err := h.ledger.AddUser(UserRule{
+		Username: RString(username),
+		Password: RString(password),
+		ACL:      acl,
+	})
+	if err != nil {
+		return err
+	}
+
+	h.persistUsers()
+	return nil
+}
+
+// RemoveUser removes a user from the ledger.
+func (h *Hook) RemoveUser(username string) error {
+	if err := h.ledger.RemoveUser(username); err != nil {
+		return err
+	}
+
+	h.persistUsers()
+	return nil
+}
+
+// SetACL replaces the ACL filters of a user in the ledger.
+func (h *Hook) SetACL(username string, acl Filters) error {
+	if err := h.ledger.SetACL(username, acl); err != nil {
+		return err
+	}
+
+	h.persistUsers()
+	return nil
+}
+
+// usersTopic returns the topic the users are persisted to.
+func (h *Hook) usersTopic() string {
+	return h.config.ControlTopic + "/users"
+}
+
+// persistUsers publishes the users as a retained message, so they are saved by the storage
+// hooks, if persistence is enabled.
+func (h *Hook) persistUsers() {
+	if h.config == nil || h.config.Server == nil || !h.config.Persist {
+		return
+	}
+
+	data, err := h.ledger.UsersJSON()
+	if err == nil {
+		err = h.config.Server.Publish(h.usersTopic(), data, true, 0)
+	}
+
+	if err != nil {
+		h.Log.Error("failed to persist dynamic security users", "error", err)
+	}
+}
+
+// restoreUsers replaces the users of the ledger with the users persisted as a retained message.
+func (h *Hook) restoreUsers() {
+	pks := h.config.Server.Topics.Messages(h.usersTopic())
+	if len(pks) == 0 {
+		return
+	}
+
+	var users Users
+	if err := json.Unmarshal(pks[0].Payload, &users); err != nil {
+		h.Log.Error("failed to restore dynamic security users", "error", err)
+		return
+	}
+
+	h.ledger.SetUsers(users)
+	h.Log.Info("restored dynamic security users", "users", len(users))
+}
+
+// isControlTopic returns true if a topic or filter matches any of the control topics. Filters
+// beginning with a wildcard do not match the control topics, which begin with $.
+func (h *Hook) isControlTopic(topic string) bool {
+	if h.config == nil || h.config.Server == nil || strings.HasPrefix(topic, "+") || strings.HasPrefix(topic, "#") {
+		return false
+	}
+
+	for _, t := range []string{h.config.ControlTopic, h.config.ControlTopic + "/response", h.usersTopic()} {
+		if _, ok := MatchTopic(topic, t); ok || topic == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isAdmin returns true if a client is allowed to access the control topics.
+func (h *Hook) isAdmin(cl *mqtt.Client) bool {
+	for _, admin := range h.config.Admins {
+		if admin != "" && admin == string(cl.Properties.Username) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// onControl runs the dynamic security commands of a message published to the control topic,
+// and publishes their results to the control response topic.
+func (h *Hook) onControl(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+	var req controlRequest
+	var resp controlResponse
+	if err := json.Unmarshal(pk.Payload, &req); err != nil {
+		resp.Responses = append(resp.Responses, controlResult{Error: err.Error()})
+	}
+
+	for _, c := range req.Commands {
+		r := controlResult{Command: c.Command}
+		var err error
+		switch c.Command {
+		case "addUser":
+			err = h.AddUser(c.Username, c.Password, c.ACL)
+		case "removeUser":
+			err = h.RemoveUser(c.Username)
+		case "setACL":
+			err = h.SetACL(c.Username, c.ACL)
+		case "listUsers":
+			r.Users = h.ledger.Usernames()
+		default:
+			r.Error = "unknown command"
+		}
+
+		if err != nil {
+			r.Error = err.Error()
+		}
+
+		h.Log.Info("dynamic security command", "command", c.Command, "username", c.Username, "client", cl.ID, "error", r.Error)
+		resp.Responses = append(resp.Responses, r)
+	}
+
+	data, err := json.Marshal(resp)
+	if err == nil {
+		err = h.config.Server.Publish(h.config.ControlTopic+"/response", data, false, 0)
+	}
+
+	if err != nil {
+		h.Log.Error("failed to publish dynamic security response", "error", err)
+	}
+}
@@ -5,6 +5,7 @@
 package auth
 
 import (
+	"encoding/json"
 	"log/slog"
 	"os"
 	"testing"
@@ -16,6 +17,13 @@ import (
 
 var logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
 
+// newClient returns a client with the given id and username, connected to listener t1.
+func newClient(id, username string) *mqtt.Client {
+	cl := &mqtt.Client{ID: id, Properties: mqtt.ClientProperties{Username: []byte(username)}}
+	cl.Net.Listener = "t1"
+	return cl
+}
+
 // func teardown(t *testing.T, path string, h *Hook) {
 // 	h.Stop()
 // }
@@ -28,7 +36,12 @@ func TestBasicID(t *testing.T) {
 func TestBasicProvides(t *testing.T) {
 	h := new(Hook)
 	require.True(t, h.Provides(mqtt.OnACLCheck))
+	require.True(t, h.Provides(mqtt.OnConnect))
+	require.True(t, h.Provides(mqtt.OnACLActionCheck))
 	require.True(t, h.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, h.Provides(mqtt.OnPublishQuota))
+	require.True(t, h.Provides(mqtt.OnDisconnect))
+	require.True(t, h.Provides(mqtt.OnStarted))
 	require.False(t, h.Provides(mqtt.OnPublish))
 }
 
@@ -156,6 +169,139 @@ func TestOnConnectAuthenticate(t *testing.T) {
 	))
 }
 
+func TestOnConnectClientIDRules(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Ledger: &Ledger{
+			ClientIDs: ClientIDRules{{Pattern: "%u"}},
+		},
+	})
+	require.NoError(t, err)
+
+	cl := &mqtt.Client{ID: "mochi", Properties: mqtt.ClientProperties{Username: []byte("mochi")}}
+	require.NoError(t, h.OnConnect(cl, packets.Packet{}))
+
+	cl.ID = "other"
+	require.ErrorIs(t, h.OnConnect(cl, packets.Packet{}), packets.ErrClientIdentifierNotValid)
+}
+
+func TestOnACLActionCheck(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Ledger: &Ledger{
+			ACL: ACLRules{{Retain: ActionFilters{"sensors/#": false}}},
+		},
+	})
+	require.NoError(t, err)
+
+	cl := &mqtt.Client{ID: "s1"}
+	require.False(t, h.OnACLActionCheck(cl, "sensors/s1", mqtt.ACLActionRetain))
+	require.True(t, h.OnACLActionCheck(cl, "sensors/s1", mqtt.ACLActionWill))
+	require.True(t, h.OnACLActionCheck(cl, "other", mqtt.ACLActionRetain))
+}
+
+func TestDescribeACLDenial(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Ledger: &Ledger{
+			ACL: ACLRules{{Filters: Filters{"a/#": Deny}, Retain: ActionFilters{"b/#": false}}},
+		},
+	})
+	require.NoError(t, err)
+
+	cl := &mqtt.Client{ID: "cl1"}
+	require.Equal(t, "acl[0].filters[a/#]", h.DescribeACLDenial(cl, "a/b", mqtt.ACLActionRead))
+	require.Equal(t, "acl[0].retain[b/#]", h.DescribeACLDenial(cl, "b/c", mqtt.ACLActionRetain))
+	require.Equal(t, "", h.DescribeACLDenial(cl, "c/d", mqtt.ACLActionWrite))
+}
+
+func TestInitInvalidClientIDPattern(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Ledger: &Ledger{
+			ClientIDs: ClientIDRules{{Pattern: "dev-("}},
+		},
+	})
+	require.ErrorIs(t, err, ErrInvalidClientIDPattern)
+}
+
+func TestReload(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Data: ledgerYAML})
+	require.NoError(t, err)
+	ledger := h.ledger
+
+	err = h.Reload(&Options{
+		Ledger: &Ledger{
+			Auth: AuthRules{{Username: "other", Password: "pass", Allow: true}},
+		},
+	})
+	require.NoError(t, err)
+	require.Same(t, ledger, h.ledger)
+	require.Len(t, h.ledger.Auth, 1)
+	require.Equal(t, RString("other"), h.ledger.Auth[0].Username)
+	require.Empty(t, h.ledger.ACL)
+
+	err = h.Reload(&Options{Data: ledgerYAML})
+	require.NoError(t, err)
+	require.Equal(t, ledgerStruct.Auth[0].Username, h.ledger.Auth[0].Username)
+}
+
+func TestReloadBadConfig(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Data: ledgerYAML})
+	require.NoError(t, err)
+
+	err = h.Reload(map[string]any{})
+	require.ErrorIs(t, err, mqtt.ErrInvalidConfigType)
+
+	err = h.Reload(&Options{Data: []byte("fdsfdsafasd")})
+	require.Error(t, err)
+
+	err = h.Reload(&Options{
+		Ledger: &Ledger{
+			ClientIDs: ClientIDRules{{Pattern: "dev-("}},
+		},
+	})
+	require.ErrorIs(t, err, ErrInvalidClientIDPattern)
+	require.Equal(t, ledgerStruct.Auth[0].Username, h.ledger.Auth[0].Username)
+}
+
+func TestOnConnectAuthenticateSuperuser(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Ledger: &Ledger{
+			Users: Users{
+				"admin": {Password: "secret", Superuser: true},
+				"mochi": {Password: "melon"},
+			},
+			Auth: AuthRules{{Remote: "127.0.0.1", Allow: true}},
+		},
+	})
+	require.NoError(t, err)
+
+	admin := &mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte("admin")}}
+	require.True(t, h.OnConnectAuthenticate(admin, packets.Packet{Connect: packets.ConnectParams{Password: []byte("secret")}}))
+	require.True(t, admin.IsSuperuser())
+
+	mochi := &mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte("mochi")}}
+	require.True(t, h.OnConnectAuthenticate(mochi, packets.Packet{Connect: packets.ConnectParams{Password: []byte("melon")}}))
+	require.False(t, mochi.IsSuperuser())
+
+	// a superuser allowed by an auth rule without its password is not a superuser
+	local := &mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte("admin")}}
+	local.Net.Remote = "127.0.0.1"
+	require.True(t, h.OnConnectAuthenticate(local, packets.Packet{}))
+	require.False(t, local.IsSuperuser())
+}
+
 func TestOnACL(t *testing.T) {
 	h := new(Hook)
 	h.SetOpts(logger, nil)
@@ -211,3 +357,162 @@ func TestOnACL(t *testing.T) {
 		true,
 	))
 }
+
+func newDynamicSecurityHook(t *testing.T, server *mqtt.Server, persist bool) *Hook {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Ledger: &Ledger{
+			Users: Users{
+				"admin": {Username: "admin", Password: "admin"},
+			},
+		},
+		Server:  server,
+		Admins:  []string{"admin"},
+		Persist: persist,
+	})
+	require.NoError(t, err)
+	h.OnStarted()
+	return h
+}
+
+func TestDynamicSecurityInitNoInlineClient(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(&Options{Server: mqtt.New(nil)})
+	require.ErrorIs(t, err, mqtt.ErrInlineClientNotEnabled)
+}
+
+func TestDynamicSecurityInitDefaults(t *testing.T) {
+	h := newDynamicSecurityHook(t, mqtt.New(&mqtt.Options{InlineClient: true}), false)
+	require.Equal(t, DefaultControlTopic, h.config.ControlTopic)
+}
+
+func TestDynamicSecurityAddUser(t *testing.T) {
+	h := newDynamicSecurityHook(t, mqtt.New(&mqtt.Options{InlineClient: true}), false)
+	cl := &mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte("mochi")}}
+	pk := packets.Packet{Connect: packets.ConnectParams{Password: []byte("melon")}}
+	require.False(t, h.OnConnectAuthenticate(cl, pk))
+
+	require.NoError(t, h.AddUser("mochi", "melon", Filters{"a/#": ReadOnly}))
+	require.True(t, h.OnConnectAuthenticate(cl, pk))
+	require.True(t, h.OnACLCheck(cl, "a/b", false))
+	require.False(t, h.OnACLCheck(cl, "a/b", true))
+
+	require.NoError(t, h.SetACL("mochi", Filters{"a/#": ReadWrite}))
+	require.True(t, h.OnACLCheck(cl, "a/b", true))
+
+	require.NoError(t, h.RemoveUser("mochi"))
+	require.False(t, h.OnConnectAuthenticate(cl, pk))
+
+	require.ErrorIs(t, h.RemoveUser("mochi"), ErrUserNotFound)
+	require.ErrorIs(t, h.SetACL("mochi", Filters{}), ErrUserNotFound)
+	require.ErrorIs(t, h.AddUser("", "melon", nil), ErrUsernameEmpty)
+}
+
+func TestDynamicSecurityControlTopicACL(t *testing.T) {
+	h := newDynamicSecurityHook(t, mqtt.New(&mqtt.Options{InlineClient: true}), false)
+	admin := &mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte("admin")}}
+	other := &mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte("mochi")}}
+
+	for _, topic := range []string{
+		DefaultControlTopic,
+		DefaultControlTopic + "/response",
+		DefaultControlTopic + "/users",
+		"$CONTROL/#",
+		"$CONTROL/+/v1",
+	} {
+		require.True(t, h.OnACLCheck(admin, topic, true), topic)
+		require.False(t, h.OnACLCheck(other, topic, true), topic)
+		require.False(t, h.OnACLCheck(other, topic, false), topic)
+	}
+
+	require.True(t, h.OnACLCheck(other, "#", false))
+	require.True(t, h.OnACLCheck(other, "+/dynamic-security/v1", false))
+	require.True(t, h.OnACLCheck(other, "$CONTROL/other", true))
+}
+
+func TestDynamicSecurityControlTopicDisabled(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(nil))
+	h.OnStarted()
+
+	require.True(t, h.OnACLCheck(new(mqtt.Client), DefaultControlTopic, true))
+	require.NoError(t, h.AddUser("mochi", "melon", nil))
+}
+
+func TestDynamicSecurityCommands(t *testing.T) {
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	h := newDynamicSecurityHook(t, server, false)
+
+	responses := make(chan []byte, 1)
+	err := server.Subscribe(DefaultControlTopic+"/response", 2, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		responses <- pk.Payload
+	})
+	require.NoError(t, err)
+
+	commands := `{"commands":[
+		{"command":"addUser","username":"mochi","password":"melon","acl":{"a/#":3}},
+		{"command":"addUser","username":"melon","password":"peach"},
+		{"command":"setACL","username":"melon","acl":{"b/#":1}},
+		{"command":"removeUser","username":"peach"},
+		{"command":"listUsers"},
+		{"command":"reboot"}
+	]}`
+	require.NoError(t, server.Publish(DefaultControlTopic, []byte(commands), false, 0))
+
+	var resp controlResponse
+	require.NoError(t, json.Unmarshal(<-responses, &resp))
+	require.Equal(t, []controlResult{
+		{Command: "addUser"},
+		{Command: "addUser"},
+		{Command: "setACL"},
+		{Command: "removeUser", Error: ErrUserNotFound.Error()},
+		{Command: "listUsers", Users: []string{"admin", "melon", "mochi"}},
+		{Command: "reboot", Error: "unknown command"},
+	}, resp.Responses)
+
+	require.Equal(t, Filters{"a/#": ReadWrite}, h.ledger.Users["mochi"].ACL)
+	require.Equal(t, Filters{"b/#": ReadOnly}, h.ledger.Users["melon"].ACL)
+
+	require.NoError(t, server.Publish(DefaultControlTopic, []byte("{"), false, 0))
+	require.NoError(t, json.Unmarshal(<-responses, &resp))
+	require.Len(t, resp.Responses, 1)
+	require.NotEmpty(t, resp.Responses[0].Error)
+}
+
+func TestDynamicSecurityPersist(t *testing.T) {
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	h := newDynamicSecurityHook(t, server, true)
+	require.NoError(t, h.AddUser("mochi", "melon", Filters{"a/#": ReadWrite}))
+
+	pks := server.Topics.Messages(DefaultControlTopic + "/users")
+	require.Len(t, pks, 1)
+	require.True(t, pks[0].FixedHeader.Retain)
+
+	// a new hook restores the persisted users when the server is started
+	r := newDynamicSecurityHook(t, server, true)
+	require.Equal(t, []string{"admin", "mochi"}, r.ledger.Usernames())
+	require.Equal(t, RString("melon"), r.ledger.Users["mochi"].Password)
+
+	require.NoError(t, r.RemoveUser("mochi"))
+	r = newDynamicSecurityHook(t, server, true)
+	require.Equal(t, []string{"admin"}, r.ledger.Usernames())
+}
+
+func TestDynamicSecurityPersistDisabled(t *testing.T) {
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	h := newDynamicSecurityHook(t, server, false)
+	require.NoError(t, h.AddUser("mochi", "melon", nil))
+	require.Empty(t, server.Topics.Messages(DefaultControlTopic+"/users"))
+}
+
+func TestDynamicSecurityRestoreInvalid(t *testing.T) {
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	require.NoError(t, server.Publish(DefaultControlTopic+"/users", []byte("{"), true, 0))
+
+	h := newDynamicSecurityHook(t, server, true)
+	require.Equal(t, []string{"admin"}, h.ledger.Usernames())
+}
@@ -0,0 +1,281 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+)
+
+const (
+	BanByIP       = "ip"       // failed attempts are counted per remote ip address
+	BanByUsername = "username" // failed attempts are counted per username
+
+	defaultBanMaxFailures = 5   // the default number of failed attempts before a ban
+	defaultBanWindow      = 60  // the default seconds failed attempts are counted over
+	defaultBanDuration    = 300 // the default seconds a ban lasts
+)
+
+// ErrUnknownBanTrack indicates failed attempts cannot be counted by a track.
+var ErrUnknownBanTrack = errors.New("unknown ban track")
+
+// BanOptions contains the configuration of the failed authentication ban hook.
+type BanOptions struct {
+	// MaxFailures is the number of failed authentication attempts within Window after
+	// which further attempts are rejected (default 5).
+	MaxFailures int `yaml:"max_failures" json:"max_failures"`
+
+	// Window is the seconds over which failed attempts are counted (default 60).
+	Window int64 `yaml:"window" json:"window"`
+
+	// BanDuration is the seconds further attempts are rejected for (default 300).
+	BanDuration int64 `yaml:"ban_duration" json:"ban_duration"`
+
+	// Tarpit is the milliseconds to hold a banned connection open before it is closed,
+	// slowing down clients which retry immediately. Disabled if 0.
+	Tarpit int64 `yaml:"tarpit" json:"tarpit"`
+
+	// Track lists what failed attempts are counted by: ip, username, or both (default both).
+	Track []string `yaml:"track" json:"track"`
+
+	// OnBan is called when an ip address or username is banned, so operators may be alerted.
+	OnBan func(event BanEvent) `yaml:"-" json:"-"`
+}
+
+// BanEvent describes an ip address or username which was banned after repeated failed
+// authentication attempts.
+type BanEvent struct {
+	Track    string    // ip or username
+	Value    string    // the banned ip address or username
+	Failures int       // the number of failed attempts which caused the ban
+	Until    time.Time // the time the ban ends
+}
+
+// banKey identifies the failed attempts of an ip address or username.
+type banKey struct {
+	track string
+	value string
+}
+
+// banRecord contains the recent failed attempts of an ip address or username.
+type banRecord struct {
+	failures int       // the number of failed attempts since first
+	first    time.Time // the time of the first failed attempt in the window
+	until    time.Time // the time a ban ends, if banned
+}
+
+// BanHook is a hook which counts failed authentication attempts by remote ip address
+// and username, and temporarily rejects the connections of any which fail too often.
+// Bans are applied to mqtt connections; failed http listener requests are counted
+// towards bans but are not rejected by them.
+type BanHook struct {
+	mqtt.HookBase
+	config    *BanOptions
+	mu        sync.Mutex
+	records   map[banKey]*banRecord
+	lastSweep time.Time
+}
+
+// ID returns the ID of the hook.
+func (h *BanHook) ID() string {
+	return "auth-ban"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *BanHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnect,
+		mqtt.OnAuthFailed,
+		mqtt.OnSessionEstablish,
+	}, []byte{b})
+}
+
+// Init configures the hook with the ban thresholds.
+func (h *BanHook) Init(config any) error {
+	if _, ok := config.(*BanOptions); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(BanOptions)
+	}
+
+	h.config = config.(*BanOptions)
+	if h.config.MaxFailures <= 0 {
+		h.config.MaxFailures = defaultBanMaxFailures
+	}
+
+	if h.config.Window <= 0 {
+		h.config.Window = defaultBanWindow
+	}
+
+	if h.config.BanDuration <= 0 {
+		h.config.BanDuration = defaultBanDuration
+	}
+
+	if len(h.config.Track) == 0 {
+		h.config.Track = []string{BanByIP, BanByUsername}
+	}
+
+	for _, track := range h.config.Track {
+		if track != BanByIP && track != BanByUsername {
+			return fmt.Errorf("%w: %s", ErrUnknownBanTrack, track)
+		}
+	}
+
+	h.records = map[banKey]*banRecord{}
+	h.Log.Info("loaded auth ban",
+		"max_failures", h.config.MaxFailures,
+		"window", h.config.Window,
+		"ban_duration", h.config.BanDuration,
+		"track", h.config.Track)
+
+	return nil
+}
+
+// OnConnect rejects a connecting client with ErrBanned if its ip address or username is
+// banned, after holding the connection for the tarpit duration.
+func (h *BanHook) OnConnect(cl *mqtt.Client, pk packets.Packet) error {
+	if !h.Banned(cl.Net.Remote, string(pk.Connect.Username)) {
+		return nil
+	}
+
+	h.Log.Debug("rejected banned client",
+		"client", cl.ID,
+		"username", string(pk.Connect.Username),
+		"remote", cl.Net.Remote)
+
+	if h.config.Tarpit > 0 {
+		time.Sleep(time.Millisecond * time.Duration(h.config.Tarpit))
+	}
+
+	return packets.ErrBanned
+}
+
+// OnAuthFailed counts a failed authentication attempt, banning the ip address or
+// username of the client if it has failed too often.
+func (h *BanHook) OnAuthFailed(cl *mqtt.Client, code packets.Code) {
+	now := time.Now()
+	window := time.Second * time.Duration(h.config.Window)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if now.Sub(h.lastSweep) > window {
+		h.sweep(now, window)
+	}
+
+	for _, key := range h.keys(cl.Net.Remote, string(cl.Properties.Username)) {
+		r, ok := h.records[key]
+		if !ok || now.Sub(r.first) > window {
+			r = &banRecord{first: now, until: r.ban()}
+			h.records[key] = r
+		}
+
+		if now.Before(r.until) {
+			continue
+		}
+
+		r.failures++
+		if r.failures < h.config.MaxFailures {
+			continue
+		}
+
+		event := BanEvent{
+			Track:    key.track,
+			Value:    key.value,
+			Failures: r.failures,
+			Until:    now.Add(time.Second * time.Duration(h.config.BanDuration)),
+		}
+
+		r.failures = 0
+		r.until = event.Until
+		h.Log.Warn("banned after failed authentication attempts",
+			"track", event.Track,
+			"value", event.Value,
+			"failures", event.Failures,
+			"until", event.Until,
+			"code", code)
+
+		if h.config.OnBan != nil {
+			h.config.OnBan(event)
+		}
+	}
+}
+
+// OnSessionEstablish clears the failed attempts of the ip address and username of a
+// client which authenticated successfully.
+func (h *BanHook) OnSessionEstablish(cl *mqtt.Client, pk packets.Packet) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for _, key := range h.keys(cl.Net.Remote, string(pk.Connect.Username)) {
+		if r, ok := h.records[key]; ok && !now.Before(r.until) {
+			delete(h.records, key)
+		}
+	}
+}
+
+// Banned returns true if a remote address or username is currently banned.
+func (h *BanHook) Banned(remote, username string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for _, key := range h.keys(remote, username) {
+		if r, ok := h.records[key]; ok && now.Before(r.until) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// keys returns the tracked keys of a remote address and username.
+func (h *BanHook) keys(remote, username string) []banKey {
+	keys := make([]banKey, 0, 2)
+	if slices.Contains(h.config.Track, BanByIP) && remote != "" {
+		if host, _, err := net.SplitHostPort(remote); err == nil {
+			remote = host
+		}
+		keys = append(keys, banKey{track: BanByIP, value: remote})
+	}
+
+	if slices.Contains(h.config.Track, BanByUsername) && username != "" {
+		keys = append(keys, banKey{track: BanByUsername, value: username})
+	}
+
+	return keys
+}
+
+// sweep removes the records which are neither banned nor within the window. The hook
+// must be locked.
+func (h *BanHook) sweep(now time.Time, window time.Duration) {
+	for key, r := range h.records {
+		if now.Sub(r.first) > window && !now.Before(r.until) {
+			delete(h.records, key)
+		}
+	}
+
+	h.lastSweep = now
+}
+
+// ban returns the end of the ban of a record, if any.
+func (r *banRecord) ban() time.Time {
+	if r == nil {
+		return time.Time{}
+	}
+
+	return r.until
+}
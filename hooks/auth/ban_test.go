@@ -0,0 +1,173 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func newBanHook(t *testing.T, opts *BanOptions) *BanHook {
+	h := new(BanHook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(opts))
+	return h
+}
+
+func TestBanHookID(t *testing.T) {
+	h := new(BanHook)
+	require.Equal(t, "auth-ban", h.ID())
+}
+
+func TestBanHookProvides(t *testing.T) {
+	h := new(BanHook)
+	require.True(t, h.Provides(mqtt.OnConnect))
+	require.True(t, h.Provides(mqtt.OnAuthFailed))
+	require.True(t, h.Provides(mqtt.OnSessionEstablish))
+	require.False(t, h.Provides(mqtt.OnConnectAuthenticate))
+}
+
+func TestBanHookInitBadConfig(t *testing.T) {
+	h := new(BanHook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, h.Init(&BanOptions{Track: []string{"client"}}), ErrUnknownBanTrack)
+}
+
+func TestBanHookInitDefaults(t *testing.T) {
+	h := new(BanHook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(nil))
+	require.Equal(t, defaultBanMaxFailures, h.config.MaxFailures)
+	require.Equal(t, int64(defaultBanWindow), h.config.Window)
+	require.Equal(t, int64(defaultBanDuration), h.config.BanDuration)
+	require.Equal(t, []string{BanByIP, BanByUsername}, h.config.Track)
+}
+
+func TestBanHookBansIP(t *testing.T) {
+	var events []BanEvent
+	h := newBanHook(t, &BanOptions{
+		MaxFailures: 3,
+		Track:       []string{BanByIP},
+		OnBan:       func(event BanEvent) { events = append(events, event) },
+	})
+
+	cl := newClient("cl1", "user")
+	cl.Net.Remote = "10.0.0.1:1000"
+	for i := 0; i < 2; i++ {
+		h.OnAuthFailed(cl, packets.ErrBadUsernameOrPassword)
+	}
+	require.False(t, h.Banned("10.0.0.1:1000", "user"))
+	require.Empty(t, events)
+
+	other := newClient("cl1", "other")
+	other.Net.Remote = "10.0.0.1:1001"
+	h.OnAuthFailed(other, packets.ErrBadUsernameOrPassword)
+	require.True(t, h.Banned("10.0.0.1:2000", "anyone"))
+	require.False(t, h.Banned("10.0.0.2:1000", "user"))
+
+	require.Len(t, events, 1)
+	require.Equal(t, BanByIP, events[0].Track)
+	require.Equal(t, "10.0.0.1", events[0].Value)
+	require.Equal(t, 3, events[0].Failures)
+	require.True(t, events[0].Until.After(time.Now()))
+
+	banned := newClient("cl1", "")
+	banned.Net.Remote = "10.0.0.1:3000"
+	require.ErrorIs(t, h.OnConnect(banned, connectPacket("", "")), packets.ErrBanned)
+
+	allowed := newClient("cl1", "")
+	allowed.Net.Remote = "10.0.0.2:3000"
+	require.NoError(t, h.OnConnect(allowed, connectPacket("", "")))
+
+	// failures while banned do not raise further events
+	h.OnAuthFailed(banned, packets.ErrBadUsernameOrPassword)
+	require.Len(t, events, 1)
+}
+
+func TestBanHookBansUsername(t *testing.T) {
+	h := newBanHook(t, &BanOptions{MaxFailures: 2, Track: []string{BanByUsername}})
+
+	cl := newClient("cl1", "admin")
+	cl.Net.Remote = "10.0.0.1:1000"
+	h.OnAuthFailed(cl, packets.ErrBadUsernameOrPassword)
+
+	other := newClient("cl1", "admin")
+	other.Net.Remote = "10.0.0.2:1000"
+	h.OnAuthFailed(other, packets.ErrNotAuthorized)
+
+	anon := newClient("cl1", "")
+	anon.Net.Remote = "10.0.0.3:1000"
+	h.OnAuthFailed(anon, packets.ErrNotAuthorized)
+
+	require.True(t, h.Banned("10.0.0.9:1000", "admin"))
+	require.False(t, h.Banned("10.0.0.1:1000", "user"))
+
+	banned := newClient("cl1", "")
+	banned.Net.Remote = "10.0.0.9:1000"
+	require.ErrorIs(t, h.OnConnect(banned, connectPacket("admin", "")), packets.ErrBanned)
+}
+
+func TestBanHookExpiry(t *testing.T) {
+	h := newBanHook(t, &BanOptions{MaxFailures: 1})
+	cl := newClient("cl1", "user")
+	cl.Net.Remote = "10.0.0.1:1000"
+	h.OnAuthFailed(cl, packets.ErrBadUsernameOrPassword)
+	require.True(t, h.Banned("10.0.0.1:1000", ""))
+
+	for _, r := range h.records {
+		r.until = time.Now().Add(-time.Second)
+		r.first = time.Now().Add(-time.Hour)
+	}
+
+	require.False(t, h.Banned("10.0.0.1:1000", "user"))
+
+	h.lastSweep = time.Time{}
+	other := newClient("cl1", "")
+	other.Net.Remote = "10.0.0.2:1000"
+	h.OnAuthFailed(other, packets.ErrBadUsernameOrPassword)
+	require.Len(t, h.records, 1)
+}
+
+func TestBanHookWindow(t *testing.T) {
+	h := newBanHook(t, &BanOptions{MaxFailures: 2, Track: []string{BanByIP}})
+	cl := newClient("cl1", "")
+	cl.Net.Remote = "10.0.0.1:1000"
+	h.OnAuthFailed(cl, packets.ErrBadUsernameOrPassword)
+
+	for _, r := range h.records {
+		r.first = time.Now().Add(-time.Hour)
+	}
+
+	h.OnAuthFailed(cl, packets.ErrBadUsernameOrPassword)
+	require.False(t, h.Banned("10.0.0.1:1000", ""))
+}
+
+func TestBanHookSuccessClearsFailures(t *testing.T) {
+	h := newBanHook(t, &BanOptions{MaxFailures: 2})
+	cl := newClient("cl1", "user")
+	cl.Net.Remote = "10.0.0.1:1000"
+	h.OnAuthFailed(cl, packets.ErrBadUsernameOrPassword)
+	h.OnSessionEstablish(cl, connectPacket("user", ""))
+	require.Empty(t, h.records)
+
+	h.OnAuthFailed(cl, packets.ErrBadUsernameOrPassword)
+	require.False(t, h.Banned("10.0.0.1:1000", "user"))
+}
+
+func TestBanHookTarpit(t *testing.T) {
+	h := newBanHook(t, &BanOptions{MaxFailures: 1, Tarpit: 20})
+	cl := newClient("cl1", "")
+	cl.Net.Remote = "10.0.0.1:1000"
+	h.OnAuthFailed(cl, packets.ErrBadUsernameOrPassword)
+
+	start := time.Now()
+	require.ErrorIs(t, h.OnConnect(cl, connectPacket("", "")), packets.ErrBanned)
+	require.GreaterOrEqual(t, time.Since(start), time.Millisecond*20)
+}
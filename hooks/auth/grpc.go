@@ -0,0 +1,440 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/internal/protowire"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// grpcAuthenticateMethod is the full name of the Authenticate method of the mqtt.Authorizer service.
+	grpcAuthenticateMethod = "/mqtt.Authorizer/Authenticate"
+
+	// grpcCheckACLMethod is the full name of the CheckACL method of the mqtt.Authorizer service.
+	grpcCheckACLMethod = "/mqtt.Authorizer/CheckACL"
+
+	// defaultGRPCRetryBackoff is the default milliseconds to wait before the first retry.
+	defaultGRPCRetryBackoff = 100
+
+	// defaultGRPCBreakerThreshold is the default number of consecutive failures which open the circuit breaker.
+	defaultGRPCBreakerThreshold = 5
+
+	// defaultGRPCBreakerCooldown is the default seconds the circuit breaker stays open.
+	defaultGRPCBreakerCooldown = 30
+)
+
+var (
+	// ErrNoGRPCAddress indicates the address of the authorization service was not configured.
+	ErrNoGRPCAddress = errors.New("no grpc auth address")
+
+	// ErrGRPCCircuitOpen indicates a check was not sent because the circuit breaker is open.
+	ErrGRPCCircuitOpen = errors.New("grpc auth circuit breaker open")
+)
+
+// GRPCOptions contains the configuration of the gRPC auth hook.
+type GRPCOptions struct {
+	// Address is the address of the authorization service, such as authz:9000.
+	Address string `yaml:"address" json:"address"`
+
+	// TLS connects to the service with TLS, verified with the system roots. Plaintext is
+	// used if neither TLS nor TLSConfig is set.
+	TLS bool `yaml:"tls" json:"tls"`
+
+	// Metadata is added to each call, such as an authorization token for the service.
+	Metadata map[string]string `yaml:"metadata" json:"metadata"`
+
+	// Timeout is the deadline in milliseconds of each attempt of a call (default 5000).
+	Timeout int64 `yaml:"timeout" json:"timeout"`
+
+	// Retries is the number of times a call is retried if the service is unavailable or the
+	// deadline is exceeded. Each retry waits twice as long as the last, starting from
+	// RetryBackoff milliseconds (default 100).
+	Retries      int   `yaml:"retries" json:"retries"`
+	RetryBackoff int64 `yaml:"retry_backoff" json:"retry_backoff"`
+
+	// BreakerThreshold is the number of consecutive failed calls which open the circuit
+	// breaker (default 5). While it is open, checks fail without calling the service for
+	// BreakerCooldown seconds (default 30), after which a single call is let through to
+	// test whether the service has recovered.
+	BreakerThreshold int   `yaml:"breaker_threshold" json:"breaker_threshold"`
+	BreakerCooldown  int64 `yaml:"breaker_cooldown" json:"breaker_cooldown"`
+
+	// FailOpen allows access when a call fails or the circuit breaker is open. By default
+	// access is denied (fail-closed).
+	FailOpen bool `yaml:"fail_open" json:"fail_open"`
+
+	// TLSConfig is the tls configuration used to connect to the service, if set.
+	TLSConfig *tls.Config `yaml:"-" json:"-"`
+
+	// DialOptions are added to the options used to create the client connection.
+	DialOptions []grpc.DialOption `yaml:"-" json:"-"`
+}
+
+// grpcAuthenticateRequest is an AuthenticateRequest sent to the Authenticate method.
+type grpcAuthenticateRequest struct {
+	clientID string
+	username string
+	password []byte
+	remote   string
+	listener string
+}
+
+// grpcACLRequest is an ACLRequest sent to the CheckACL method.
+type grpcACLRequest struct {
+	clientID string
+	username string
+	topic    string
+	write    bool
+	remote   string
+	listener string
+}
+
+// grpcDecision is a Decision returned by the authorization service.
+type grpcDecision struct {
+	allow     bool
+	superuser bool
+}
+
+// GRPCHook is an authentication hook which forwards connect and ACL checks to an external
+// authorization service implementing the mqtt.Authorizer service described in grpc.proto.
+type GRPCHook struct {
+	mqtt.HookBase
+	config    *GRPCOptions
+	conn      *grpc.ClientConn
+	mu        sync.Mutex // guards the circuit breaker
+	failures  int        // the number of consecutive failed calls
+	openUntil time.Time  // the time the circuit breaker stops rejecting calls
+	probing   bool       // a call is testing whether the service has recovered
+}
+
+// ID returns the ID of the hook.
+func (h *GRPCHook) ID() string {
+	return "auth-grpc"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *GRPCHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnACLCheck,
+	}, []byte{b})
+}
+
+// Init creates the client connection to the authorization service.
+func (h *GRPCHook) Init(config any) error {
+	if _, ok := config.(*GRPCOptions); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(GRPCOptions)
+	}
+
+	h.config = config.(*GRPCOptions)
+	if h.config.Address == "" {
+		return ErrNoGRPCAddress
+	}
+
+	if h.config.Timeout <= 0 {
+		h.config.Timeout = defaultBackendTimeout
+	}
+
+	if h.config.RetryBackoff <= 0 {
+		h.config.RetryBackoff = defaultGRPCRetryBackoff
+	}
+
+	if h.config.BreakerThreshold <= 0 {
+		h.config.BreakerThreshold = defaultGRPCBreakerThreshold
+	}
+
+	if h.config.BreakerCooldown <= 0 {
+		h.config.BreakerCooldown = defaultGRPCBreakerCooldown
+	}
+
+	creds := insecure.NewCredentials()
+	if h.config.TLSConfig != nil {
+		creds = credentials.NewTLS(h.config.TLSConfig)
+	} else if h.config.TLS {
+		creds = credentials.NewTLS(new(tls.Config))
+	}
+
+	opts := append([]grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(grpcAuthCodec{})),
+	}, h.config.DialOptions...)
+
+	conn, err := grpc.NewClient(h.config.Address, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create grpc auth client: %w", err)
+	}
+	h.conn = conn
+
+	h.Log.Info("loaded grpc auth service",
+		"address", h.config.Address,
+		"retries", h.config.Retries,
+		"fail_open", h.config.FailOpen)
+
+	return nil
+}
+
+// Stop closes the client connection.
+func (h *GRPCHook) Stop() error {
+	if h.conn == nil {
+		return nil
+	}
+
+	conn := h.conn
+	h.conn = nil
+	return conn.Close()
+}
+
+// OnConnectAuthenticate returns true if the authorization service allows the client to
+// connect, marking the client as a superuser if the service decides so.
+func (h *GRPCHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	var d grpcDecision
+	err := h.call(cl.Context(), grpcAuthenticateMethod, &grpcAuthenticateRequest{
+		clientID: cl.ID,
+		username: string(pk.Connect.Username),
+		password: pk.Connect.Password,
+		remote:   cl.Net.Remote,
+		listener: cl.Net.Listener,
+	}, &d)
+	if err != nil {
+		h.Log.Warn("grpc auth request failed", "error", err, "method", grpcAuthenticateMethod, "fail_open", h.config.FailOpen)
+		return h.config.FailOpen
+	}
+
+	if !d.allow {
+		h.Log.Info("client failed authentication check",
+			"username", string(pk.Connect.Username),
+			"remote", cl.Net.Remote)
+		return false
+	}
+
+	if d.superuser {
+		cl.SetSuperuser(true)
+	}
+
+	return true
+}
+
+// OnACLCheck returns true if the authorization service allows the client to publish or
+// subscribe to a topic.
+func (h *GRPCHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	var d grpcDecision
+	err := h.call(cl.Context(), grpcCheckACLMethod, &grpcACLRequest{
+		clientID: cl.ID,
+		username: string(cl.Properties.Username),
+		topic:    topic,
+		write:    write,
+		remote:   cl.Net.Remote,
+		listener: cl.Net.Listener,
+	}, &d)
+	if err != nil {
+		h.Log.Warn("grpc auth request failed", "error", err, "method", grpcCheckACLMethod, "fail_open", h.config.FailOpen)
+		return h.config.FailOpen
+	}
+
+	if !d.allow {
+		h.Log.Debug("client failed allowed ACL check",
+			"client", cl.ID,
+			"username", string(cl.Properties.Username),
+			"topic", topic)
+	}
+
+	return d.allow
+}
+
+// call invokes a method of the authorization service, retrying if the service is unavailable
+// or the deadline is exceeded. Calls fail immediately while the circuit breaker is open, and
+// are not retried once ctx is cancelled.
+func (h *GRPCHook) call(ctx context.Context, method string, req, resp any) error {
+	if !h.breakerAllow() {
+		return ErrGRPCCircuitOpen
+	}
+
+	backoff := time.Duration(h.config.RetryBackoff) * time.Millisecond
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = h.invoke(ctx, method, req, resp); err == nil {
+			break
+		}
+
+		code := status.Code(err)
+		if attempt >= h.config.Retries || (code != codes.Unavailable && code != codes.DeadlineExceeded) {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			h.breakerDone(err)
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	h.breakerDone(err)
+	return err
+}
+
+// invoke makes a single call to a method of the authorization service.
+func (h *GRPCHook) invoke(ctx context.Context, method string, req, resp any) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(h.config.Timeout)*time.Millisecond)
+	defer cancel()
+
+	for k, v := range h.config.Metadata {
+		ctx = metadata.AppendToOutgoingContext(ctx, k, v)
+	}
+
+	return h.conn.Invoke(ctx, method, req, resp)
+}
+
+// breakerAllow returns true if a call may be sent to the service. Once the circuit breaker
+// has been open for the cooldown, a single call is allowed to test the service.
+func (h *GRPCHook) breakerAllow() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.failures < h.config.BreakerThreshold {
+		return true
+	}
+
+	if time.Now().Before(h.openUntil) || h.probing {
+		return false
+	}
+
+	h.probing = true
+	return true
+}
+
+// breakerDone records the result of a call, opening the circuit breaker once the threshold
+// of consecutive failures is reached.
+func (h *GRPCHook) breakerDone(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.probing = false
+	if err == nil {
+		if h.failures >= h.config.BreakerThreshold {
+			h.Log.Info("grpc auth circuit breaker closed", "address", h.config.Address)
+		}
+		h.failures = 0
+		return
+	}
+
+	h.failures++
+	if h.failures >= h.config.BreakerThreshold {
+		h.openUntil = time.Now().Add(time.Duration(h.config.BreakerCooldown) * time.Second)
+		if h.failures == h.config.BreakerThreshold {
+			h.Log.Warn("grpc auth circuit breaker opened",
+				"address", h.config.Address,
+				"failures", h.failures,
+				"cooldown", h.config.BreakerCooldown)
+		}
+	}
+}
+
+// grpcAuthCodec encodes and decodes the messages of the mqtt.Authorizer service in the
+// protobuf wire format, as described by grpc.proto.
+type grpcAuthCodec struct{}
+
+// Name returns the name of the codec.
+func (grpcAuthCodec) Name() string {
+	return "proto"
+}
+
+// Marshal encodes a message of the authorization service.
+func (grpcAuthCodec) Marshal(v any) ([]byte, error) {
+	var b []byte
+	switch m := v.(type) {
+	case *grpcAuthenticateRequest:
+		b = protowire.AppendString(b, 1, m.clientID)
+		b = protowire.AppendString(b, 2, m.username)
+		b = protowire.AppendString(b, 3, string(m.password))
+		b = protowire.AppendString(b, 4, m.remote)
+		b = protowire.AppendString(b, 5, m.listener)
+	case *grpcACLRequest:
+		b = protowire.AppendString(b, 1, m.clientID)
+		b = protowire.AppendString(b, 2, m.username)
+		b = protowire.AppendString(b, 3, m.topic)
+		b = protowire.AppendBool(b, 4, m.write)
+		b = protowire.AppendString(b, 5, m.remote)
+		b = protowire.AppendString(b, 6, m.listener)
+	case *grpcDecision:
+		b = protowire.AppendBool(b, 1, m.allow)
+		b = protowire.AppendBool(b, 2, m.superuser)
+	default:
+		return nil, fmt.Errorf("grpc auth codec: unsupported type %T", v)
+	}
+
+	return b, nil
+}
+
+// Unmarshal decodes a message of the authorization service.
+func (grpcAuthCodec) Unmarshal(data []byte, v any) error {
+	switch m := v.(type) {
+	case *grpcAuthenticateRequest:
+		return protowire.Consume(data, func(num protowire.Number, u uint64, b []byte) {
+			switch num {
+			case 1:
+				m.clientID = string(b)
+			case 2:
+				m.username = string(b)
+			case 3:
+				m.password = append([]byte{}, b...)
+			case 4:
+				m.remote = string(b)
+			case 5:
+				m.listener = string(b)
+			}
+		})
+	case *grpcACLRequest:
+		return protowire.Consume(data, func(num protowire.Number, u uint64, b []byte) {
+			switch num {
+			case 1:
+				m.clientID = string(b)
+			case 2:
+				m.username = string(b)
+			case 3:
+				m.topic = string(b)
+			case 4:
+				m.write = u != 0
+			case 5:
+				m.remote = string(b)
+			case 6:
+				m.listener = string(b)
+			}
+		})
+	case *grpcDecision:
+		return protowire.Consume(data, func(num protowire.Number, u uint64, b []byte) {
+			switch num {
+			case 1:
+				m.allow = u != 0
+			case 2:
+				m.superuser = u != 0
+			}
+		})
+	default:
+		return fmt.Errorf("grpc auth codec: unsupported type %T", v)
+	}
+}
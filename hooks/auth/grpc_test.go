@@ -0,0 +1,267 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// testAuthorizer is a test implementation of the mqtt.Authorizer service.
+type testAuthorizer struct {
+	calls int64        // the number of calls received
+	fail  atomic.Value // a grpc status code to fail calls with, if set
+}
+
+func (a *testAuthorizer) authenticate(ctx context.Context, req *grpcAuthenticateRequest) (*grpcDecision, error) {
+	if err := a.failed(); err != nil {
+		return nil, err
+	}
+
+	if md, _ := metadata.FromIncomingContext(ctx); len(md.Get("token")) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "no token")
+	}
+
+	return &grpcDecision{
+		allow:     string(req.password) == "password-"+req.username && req.listener == "t1",
+		superuser: req.username == "admin",
+	}, nil
+}
+
+func (a *testAuthorizer) checkACL(ctx context.Context, req *grpcACLRequest) (*grpcDecision, error) {
+	if err := a.failed(); err != nil {
+		return nil, err
+	}
+
+	return &grpcDecision{
+		allow: strings.HasPrefix(req.topic, req.username+"/") || (!req.write && req.topic == "news"),
+	}, nil
+}
+
+func (a *testAuthorizer) failed() error {
+	atomic.AddInt64(&a.calls, 1)
+	if code, ok := a.fail.Load().(codes.Code); ok && code != codes.OK {
+		return status.Error(code, "failed")
+	}
+	return nil
+}
+
+func newTestAuthorizer(t *testing.T) (*testAuthorizer, string) {
+	a := new(testAuthorizer)
+	desc := grpc.ServiceDesc{
+		ServiceName: "mqtt.Authorizer",
+		HandlerType: (*any)(nil),
+		Methods: []grpc.MethodDesc{
+			{
+				MethodName: "Authenticate",
+				Handler: func(srv any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+					req := new(grpcAuthenticateRequest)
+					if err := dec(req); err != nil {
+						return nil, err
+					}
+					return srv.(*testAuthorizer).authenticate(ctx, req)
+				},
+			},
+			{
+				MethodName: "CheckACL",
+				Handler: func(srv any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+					req := new(grpcACLRequest)
+					if err := dec(req); err != nil {
+						return nil, err
+					}
+					return srv.(*testAuthorizer).checkACL(ctx, req)
+				},
+			},
+		},
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := grpc.NewServer(grpc.ForceServerCodec(grpcAuthCodec{}))
+	s.RegisterService(&desc, a)
+	go func() { _ = s.Serve(lis) }()
+	t.Cleanup(s.Stop)
+
+	return a, lis.Addr().String()
+}
+
+func newGRPCHook(t *testing.T, opts *GRPCOptions) *GRPCHook {
+	h := new(GRPCHook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(opts))
+	t.Cleanup(func() { _ = h.Stop() })
+	return h
+}
+
+func TestGRPCHookID(t *testing.T) {
+	h := new(GRPCHook)
+	require.Equal(t, "auth-grpc", h.ID())
+}
+
+func TestGRPCHookProvides(t *testing.T) {
+	h := new(GRPCHook)
+	require.True(t, h.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, h.Provides(mqtt.OnACLCheck))
+	require.False(t, h.Provides(mqtt.OnPublish))
+}
+
+func TestGRPCHookInitBadConfig(t *testing.T) {
+	h := new(GRPCHook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, h.Init(nil), ErrNoGRPCAddress)
+}
+
+func TestGRPCHookInitDefaults(t *testing.T) {
+	h := newGRPCHook(t, &GRPCOptions{Address: "localhost:9000", TLS: true})
+	require.Equal(t, int64(defaultBackendTimeout), h.config.Timeout)
+	require.Equal(t, int64(defaultGRPCRetryBackoff), h.config.RetryBackoff)
+	require.Equal(t, defaultGRPCBreakerThreshold, h.config.BreakerThreshold)
+	require.Equal(t, int64(defaultGRPCBreakerCooldown), h.config.BreakerCooldown)
+	require.NotNil(t, h.conn)
+	require.NoError(t, h.Stop())
+	require.NoError(t, h.Stop())
+}
+
+func TestGRPCHookOnConnectAuthenticate(t *testing.T) {
+	_, addr := newTestAuthorizer(t)
+	h := newGRPCHook(t, &GRPCOptions{Address: addr, Metadata: map[string]string{"token": "secret"}})
+
+	peach := newClient("cl1", "peach")
+	require.True(t, h.OnConnectAuthenticate(peach, connectPacket("peach", "password-peach")))
+	require.False(t, peach.IsSuperuser())
+	require.False(t, h.OnConnectAuthenticate(peach, connectPacket("peach", "wrong")))
+
+	admin := newClient("cl2", "admin")
+	require.True(t, h.OnConnectAuthenticate(admin, connectPacket("admin", "password-admin")))
+	require.True(t, admin.IsSuperuser())
+
+	other := newClient("cl3", "peach")
+	other.Net.Listener = "t2"
+	require.False(t, h.OnConnectAuthenticate(other, connectPacket("peach", "password-peach")))
+}
+
+func TestGRPCHookNoMetadata(t *testing.T) {
+	_, addr := newTestAuthorizer(t)
+	h := newGRPCHook(t, &GRPCOptions{Address: addr})
+	require.False(t, h.OnConnectAuthenticate(newClient("cl1", "peach"), connectPacket("peach", "password-peach")))
+}
+
+func TestGRPCHookOnACLCheck(t *testing.T) {
+	_, addr := newTestAuthorizer(t)
+	h := newGRPCHook(t, &GRPCOptions{Address: addr})
+
+	cl := newClient("cl1", "peach")
+	require.True(t, h.OnACLCheck(cl, "peach/a", true))
+	require.True(t, h.OnACLCheck(cl, "news", false))
+	require.False(t, h.OnACLCheck(cl, "news", true))
+	require.False(t, h.OnACLCheck(cl, "melon/a", false))
+}
+
+func TestGRPCHookRetry(t *testing.T) {
+	a, addr := newTestAuthorizer(t)
+	h := newGRPCHook(t, &GRPCOptions{Address: addr, Retries: 2, RetryBackoff: 1})
+
+	a.fail.Store(codes.Unavailable)
+	require.False(t, h.OnACLCheck(newClient("cl1", "peach"), "peach/a", true))
+	require.Equal(t, int64(3), atomic.LoadInt64(&a.calls))
+
+	a.fail.Store(codes.Internal) // other errors are not retried
+	require.False(t, h.OnACLCheck(newClient("cl1", "peach"), "peach/a", true))
+	require.Equal(t, int64(4), atomic.LoadInt64(&a.calls))
+}
+
+func TestGRPCHookFailOpen(t *testing.T) {
+	a, addr := newTestAuthorizer(t)
+	h := newGRPCHook(t, &GRPCOptions{Address: addr, FailOpen: true})
+
+	a.fail.Store(codes.Internal)
+	require.True(t, h.OnACLCheck(newClient("cl1", "peach"), "melon/a", true))
+}
+
+func TestGRPCHookCircuitBreaker(t *testing.T) {
+	a, addr := newTestAuthorizer(t)
+	h := newGRPCHook(t, &GRPCOptions{Address: addr, BreakerThreshold: 2, BreakerCooldown: 60})
+	cl := newClient("cl1", "peach")
+
+	a.fail.Store(codes.Internal)
+	require.False(t, h.OnACLCheck(cl, "peach/a", true))
+	require.False(t, h.OnACLCheck(cl, "peach/a", true))
+	require.Equal(t, int64(2), atomic.LoadInt64(&a.calls))
+
+	// the breaker is open, so the service is not called
+	a.fail.Store(codes.OK)
+	require.False(t, h.OnACLCheck(cl, "peach/a", true))
+	require.Equal(t, int64(2), atomic.LoadInt64(&a.calls))
+
+	// after the cooldown, a successful call closes the breaker
+	h.mu.Lock()
+	h.openUntil = time.Now().Add(-time.Second)
+	h.mu.Unlock()
+	require.True(t, h.OnACLCheck(cl, "peach/a", true))
+	require.True(t, h.OnACLCheck(cl, "peach/a", true))
+	require.Equal(t, int64(4), atomic.LoadInt64(&a.calls))
+	require.Equal(t, 0, h.failures)
+}
+
+func TestGRPCHookCircuitBreakerProbeFails(t *testing.T) {
+	h := new(GRPCHook)
+	h.SetOpts(logger, nil)
+	h.config = &GRPCOptions{BreakerThreshold: 1, BreakerCooldown: 60}
+
+	require.True(t, h.breakerAllow())
+	h.breakerDone(ErrGRPCCircuitOpen)
+	require.False(t, h.breakerAllow())
+
+	h.openUntil = time.Now().Add(-time.Second)
+	require.True(t, h.breakerAllow())
+	require.False(t, h.breakerAllow()) // only one probe at a time
+	h.breakerDone(ErrGRPCCircuitOpen)
+	require.False(t, h.breakerAllow())
+	require.True(t, h.openUntil.After(time.Now()))
+}
+
+func TestGRPCAuthCodec(t *testing.T) {
+	c := grpcAuthCodec{}
+	require.Equal(t, "proto", c.Name())
+
+	for _, v := range []any{
+		&grpcAuthenticateRequest{clientID: "cl1", username: "peach", password: []byte("p"), remote: "1.2.3.4:1", listener: "t1"},
+		&grpcACLRequest{clientID: "cl1", username: "peach", topic: "a/b", write: true, remote: "1.2.3.4:1", listener: "t1"},
+		&grpcDecision{allow: true, superuser: true},
+	} {
+		b, err := c.Marshal(v)
+		require.NoError(t, err)
+
+		var out any
+		switch v.(type) {
+		case *grpcAuthenticateRequest:
+			out = new(grpcAuthenticateRequest)
+		case *grpcACLRequest:
+			out = new(grpcACLRequest)
+		case *grpcDecision:
+			out = new(grpcDecision)
+		}
+		require.NoError(t, c.Unmarshal(b, out))
+		require.Equal(t, v, out)
+	}
+
+	_, err := c.Marshal("x")
+	require.Error(t, err)
+	require.Error(t, c.Unmarshal(nil, new(string)))
+	require.Error(t, c.Unmarshal([]byte{0x0a, 0x05}, new(grpcDecision)))
+}
@@ -0,0 +1,351 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+)
+
+const (
+	// defaultHTTPCacheSize is the default maximum number of cached responses.
+	defaultHTTPCacheSize = 10000
+)
+
+var (
+	// ErrNoHTTPEndpoint indicates neither a connect nor an ACL endpoint was configured.
+	ErrNoHTTPEndpoint = errors.New("no http auth endpoint")
+
+	// ErrHTTPStatus indicates an endpoint responded with a status which neither allows nor denies access.
+	ErrHTTPStatus = errors.New("unexpected http auth status")
+)
+
+// HTTPOptions contains the configuration of the HTTP auth hook.
+type HTTPOptions struct {
+	// ConnectURL is the endpoint which connect requests are posted to. If empty, every
+	// client is allowed to connect.
+	ConnectURL string `yaml:"connect_url" json:"connect_url"`
+
+	// ACLURL is the endpoint which ACL checks are posted to. If empty, every client is
+	// allowed to publish and subscribe to any topic.
+	ACLURL string `yaml:"acl_url" json:"acl_url"`
+
+	// Headers are added to each request, such as an authorization header for the endpoint.
+	Headers map[string]string `yaml:"headers" json:"headers"`
+
+	// Timeout is the milliseconds to wait for a response before the check fails (default 5000).
+	Timeout int64 `yaml:"timeout" json:"timeout"`
+
+	// CacheTTL is the seconds a response is cached for, so repeated checks do not call the
+	// endpoint. Responses are not cached if 0. Failed checks are never cached.
+	CacheTTL int64 `yaml:"cache_ttl" json:"cache_ttl"`
+
+	// CacheSize is the maximum number of cached responses (default 10000).
+	CacheSize int `yaml:"cache_size" json:"cache_size"`
+
+	// FailOpen allows access when the endpoint cannot be reached, times out or responds with
+	// an unexpected status. By default access is denied (fail-closed).
+	FailOpen bool `yaml:"fail_open" json:"fail_open"`
+
+	// Client is the http client used to make requests, if set.
+	Client *http.Client `yaml:"-" json:"-"`
+}
+
+// HTTPConnectRequest is the body posted to the connect endpoint.
+type HTTPConnectRequest struct {
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Remote   string `json:"remote"`
+	Listener string `json:"listener"`
+}
+
+// HTTPACLRequest is the body posted to the ACL endpoint.
+type HTTPACLRequest struct {
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Topic    string `json:"topic"`
+	Write    bool   `json:"write"` // true if the client is publishing, false if it is subscribing
+	Remote   string `json:"remote"`
+	Listener string `json:"listener"`
+}
+
+// cacheEntry is a cached response from an endpoint.
+type cacheEntry struct {
+	allow   bool      // the endpoint allowed access
+	expires time.Time // the time the response expires
+}
+
+// HTTPHook is an authentication hook which posts connect and ACL checks to HTTP endpoints.
+// A 2xx response allows access, and a 4xx response denies it.
+type HTTPHook struct {
+	mqtt.HookBase
+	config atomic.Pointer[HTTPOptions]      // the options in use, replaced by Reload
+	client *http.Client                     // the http client used if the options do not set one
+	mu     sync.Mutex                       // guards cache
+	cache  map[[sha256.Size]byte]cacheEntry // cached responses, keyed by a hash of the request
+}
+
+// ID returns the ID of the hook.
+func (h *HTTPHook) ID() string {
+	return "auth-http"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *HTTPHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnACLCheck,
+	}, []byte{b})
+}
+
+// Init configures the hook with the endpoints to be used for checking.
+func (h *HTTPHook) Init(config any) error {
+	if _, ok := config.(*HTTPOptions); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(HTTPOptions)
+	}
+
+	o := config.(*HTTPOptions)
+	if err := o.prepare(); err != nil {
+		return err
+	}
+
+	h.config.Store(o)
+	h.client = new(http.Client)
+	h.cache = make(map[[sha256.Size]byte]cacheEntry)
+
+	h.Log.Info("loaded http auth endpoints",
+		"connect", o.ConnectURL,
+		"acl", o.ACLURL,
+		"fail_open", o.FailOpen)
+
+	return nil
+}
+
+// Reload replaces the endpoints and options of the hook while the server is running. Cached
+// responses are discarded, and checks in progress complete with the previous options.
+func (h *HTTPHook) Reload(config any) error {
+	o, ok := config.(*HTTPOptions)
+	if !ok || o == nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if err := o.prepare(); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.config.Store(o)
+	clear(h.cache)
+	h.mu.Unlock()
+
+	h.Log.Info("reloaded http auth endpoints",
+		"connect", o.ConnectURL,
+		"acl", o.ACLURL,
+		"fail_open", o.FailOpen)
+
+	return nil
+}
+
+// prepare returns an error if the options have no endpoints, and sets the default values of
+// any options which are not set.
+func (o *HTTPOptions) prepare() error {
+	if o.ConnectURL == "" && o.ACLURL == "" {
+		return ErrNoHTTPEndpoint
+	}
+
+	if o.Timeout <= 0 {
+		o.Timeout = defaultBackendTimeout
+	}
+
+	if o.CacheSize <= 0 {
+		o.CacheSize = defaultHTTPCacheSize
+	}
+
+	return nil
+}
+
+// OnConnectAuthenticate returns true if the connect endpoint allows the client to connect.
+func (h *HTTPHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	cfg := h.config.Load()
+	if cfg.ConnectURL == "" {
+		return true
+	}
+
+	ok := h.check(cl.Context(), cfg, cfg.ConnectURL, HTTPConnectRequest{
+		ClientID: cl.ID,
+		Username: string(pk.Connect.Username),
+		Password: string(pk.Connect.Password),
+		Remote:   cl.Net.Remote,
+		Listener: cl.Net.Listener,
+	})
+
+	if !ok {
+		h.Log.Info("client failed authentication check",
+			"username", string(pk.Connect.Username),
+			"remote", cl.Net.Remote)
+	}
+
+	return ok
+}
+
+// OnACLCheck returns true if the ACL endpoint allows the client to publish or subscribe to
+// a topic.
+func (h *HTTPHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	cfg := h.config.Load()
+	if cfg.ACLURL == "" {
+		return true
+	}
+
+	ok := h.check(cl.Context(), cfg, cfg.ACLURL, HTTPACLRequest{
+		ClientID: cl.ID,
+		Username: string(cl.Properties.Username),
+		Topic:    topic,
+		Write:    write,
+		Remote:   cl.Net.Remote,
+		Listener: cl.Net.Listener,
+	})
+
+	if !ok {
+		h.Log.Debug("client failed allowed ACL check",
+			"client", cl.ID,
+			"username", string(cl.Properties.Username),
+			"topic", topic)
+	}
+
+	return ok
+}
+
+// check returns true if the endpoint allows the request, using a cached response if one
+// has not expired. If the request fails, access is allowed only if the hook fails open.
+func (h *HTTPHook) check(ctx context.Context, cfg *HTTPOptions, url string, req any) bool {
+	body, err := json.Marshal(req)
+	if err != nil {
+		h.Log.Error("failed to encode http auth request", "error", err)
+		return cfg.FailOpen
+	}
+
+	key := sha256.Sum256(append([]byte(url+"\n"), body...))
+	if allow, ok := h.cached(cfg, key); ok {
+		return allow
+	}
+
+	allow, err := h.post(ctx, cfg, url, body)
+	if err != nil {
+		h.Log.Warn("http auth request failed", "error", err, "url", url, "fail_open", cfg.FailOpen)
+		return cfg.FailOpen
+	}
+
+	h.store(cfg, key, allow)
+	return allow
+}
+
+// post sends a request body to an endpoint, returning true if it allows access or false
+// if it denies access. The request is cancelled if ctx is cancelled.
+func (h *HTTPHook) post(ctx context.Context, cfg *HTTPOptions, url string, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.Timeout)*time.Millisecond)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	client := cfg.Client
+	if client == nil {
+		client = h.client
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return false, nil
+	default:
+		return false, fmt.Errorf("%w: %d", ErrHTTPStatus, resp.StatusCode)
+	}
+}
+
+// cached returns a cached response for a request, if one has not expired.
+func (h *HTTPHook) cached(cfg *HTTPOptions, key [sha256.Size]byte) (allow, ok bool) {
+	if cfg.CacheTTL <= 0 {
+		return false, false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e, ok := h.cache[key]
+	if !ok {
+		return false, false
+	}
+
+	if time.Now().After(e.expires) {
+		delete(h.cache, key)
+		return false, false
+	}
+
+	return e.allow, true
+}
+
+// store caches a response for a request. Expired responses are removed when the cache is
+// full, and the response is not cached if it is still full.
+func (h *HTTPHook) store(cfg *HTTPOptions, key [sha256.Size]byte, allow bool) {
+	if cfg.CacheTTL <= 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if cfg != h.config.Load() {
+		return // the options were reloaded during the request
+	}
+
+	now := time.Now()
+	if len(h.cache) >= cfg.CacheSize {
+		for k, e := range h.cache {
+			if now.After(e.expires) {
+				delete(h.cache, k)
+			}
+		}
+
+		if len(h.cache) >= cfg.CacheSize {
+			return
+		}
+	}
+
+	h.cache[key] = cacheEntry{
+		allow:   allow,
+		expires: now.Add(time.Duration(cfg.CacheTTL) * time.Second),
+	}
+}
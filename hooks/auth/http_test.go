@@ -0,0 +1,341 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// httpAuthServer is a test endpoint which allows the user mochi to connect, and to publish
+// and subscribe to topics beneath a/.
+type httpAuthServer struct {
+	*httptest.Server
+	calls   atomic.Int64
+	connect atomic.Value // the last connect request
+	acl     atomic.Value // the last acl request
+}
+
+func newHTTPAuthServer(t *testing.T) *httpAuthServer {
+	s := new(httpAuthServer)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connect", func(w http.ResponseWriter, r *http.Request) {
+		s.calls.Add(1)
+		var req HTTPConnectRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		s.connect.Store(req)
+
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if req.Username != "mochi" || req.Password != "melon" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})
+
+	mux.HandleFunc("/acl", func(w http.ResponseWriter, r *http.Request) {
+		s.calls.Add(1)
+		var req HTTPACLRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		s.acl.Store(req)
+
+		if len(req.Topic) < 2 || req.Topic[:2] != "a/" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})
+
+	mux.HandleFunc("/error", func(w http.ResponseWriter, r *http.Request) {
+		s.calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		s.calls.Add(1)
+		time.Sleep(100 * time.Millisecond)
+	})
+
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newHTTPHook(t *testing.T, opts *HTTPOptions) *HTTPHook {
+	h := new(HTTPHook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(opts))
+	return h
+}
+
+func connectPacket(username, password string) packets.Packet {
+	return packets.Packet{
+		Connect: packets.ConnectParams{
+			Username: []byte(username),
+			Password: []byte(password),
+		},
+	}
+}
+
+func TestHTTPID(t *testing.T) {
+	h := new(HTTPHook)
+	require.Equal(t, "auth-http", h.ID())
+}
+
+func TestHTTPProvides(t *testing.T) {
+	h := new(HTTPHook)
+	require.True(t, h.Provides(mqtt.OnACLCheck))
+	require.True(t, h.Provides(mqtt.OnConnectAuthenticate))
+	require.False(t, h.Provides(mqtt.OnPublish))
+}
+
+func TestHTTPInitBadConfig(t *testing.T) {
+	h := new(HTTPHook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(map[string]any{})
+	require.ErrorIs(t, err, mqtt.ErrInvalidConfigType)
+}
+
+func TestHTTPInitNoEndpoint(t *testing.T) {
+	h := new(HTTPHook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(nil)
+	require.ErrorIs(t, err, ErrNoHTTPEndpoint)
+}
+
+func TestHTTPInitDefaults(t *testing.T) {
+	h := newHTTPHook(t, &HTTPOptions{ConnectURL: "http://localhost/connect"})
+	require.Equal(t, int64(defaultBackendTimeout), h.config.Load().Timeout)
+	require.Equal(t, defaultHTTPCacheSize, h.config.Load().CacheSize)
+	require.NotNil(t, h.client)
+}
+
+func TestHTTPOnConnectAuthenticate(t *testing.T) {
+	s := newHTTPAuthServer(t)
+	h := newHTTPHook(t, &HTTPOptions{
+		ConnectURL: s.URL + "/connect",
+		Headers:    map[string]string{"Authorization": "Bearer token"},
+	})
+
+	cl := &mqtt.Client{ID: "cl1", Net: mqtt.ClientConnection{Remote: "127.0.0.1", Listener: "t1"}}
+	require.True(t, h.OnConnectAuthenticate(cl, connectPacket("mochi", "melon")))
+	require.Equal(t, HTTPConnectRequest{
+		ClientID: "cl1",
+		Username: "mochi",
+		Password: "melon",
+		Remote:   "127.0.0.1",
+		Listener: "t1",
+	}, s.connect.Load())
+
+	require.False(t, h.OnConnectAuthenticate(cl, connectPacket("mochi", "badpass")))
+	require.False(t, h.OnConnectAuthenticate(cl, connectPacket("other", "melon")))
+}
+
+func TestHTTPOnConnectAuthenticateHeaders(t *testing.T) {
+	s := newHTTPAuthServer(t)
+	h := newHTTPHook(t, &HTTPOptions{ConnectURL: s.URL + "/connect"})
+	require.False(t, h.OnConnectAuthenticate(new(mqtt.Client), connectPacket("mochi", "melon")))
+}
+
+func TestHTTPOnConnectAuthenticateNoEndpoint(t *testing.T) {
+	s := newHTTPAuthServer(t)
+	h := newHTTPHook(t, &HTTPOptions{ACLURL: s.URL + "/acl"})
+	require.True(t, h.OnConnectAuthenticate(new(mqtt.Client), connectPacket("other", "")))
+	require.Equal(t, int64(0), s.calls.Load())
+}
+
+func TestHTTPOnACLCheck(t *testing.T) {
+	s := newHTTPAuthServer(t)
+	h := newHTTPHook(t, &HTTPOptions{ACLURL: s.URL + "/acl"})
+
+	cl := &mqtt.Client{
+		ID:         "cl1",
+		Properties: mqtt.ClientProperties{Username: []byte("mochi")},
+		Net:        mqtt.ClientConnection{Remote: "127.0.0.1", Listener: "t1"},
+	}
+
+	require.True(t, h.OnACLCheck(cl, "a/b/c", true))
+	require.Equal(t, HTTPACLRequest{
+		ClientID: "cl1",
+		Username: "mochi",
+		Topic:    "a/b/c",
+		Write:    true,
+		Remote:   "127.0.0.1",
+		Listener: "t1",
+	}, s.acl.Load())
+
+	require.False(t, h.OnACLCheck(cl, "d/e/f", false))
+	require.False(t, s.acl.Load().(HTTPACLRequest).Write)
+}
+
+func TestHTTPOnACLCheckNoEndpoint(t *testing.T) {
+	s := newHTTPAuthServer(t)
+	h := newHTTPHook(t, &HTTPOptions{ConnectURL: s.URL + "/connect"})
+	require.True(t, h.OnACLCheck(new(mqtt.Client), "d/e/f", true))
+	require.Equal(t, int64(0), s.calls.Load())
+}
+
+func TestHTTPFailClosed(t *testing.T) {
+	s := newHTTPAuthServer(t)
+	h := newHTTPHook(t, &HTTPOptions{
+		ConnectURL: s.URL + "/error",
+		ACLURL:     s.URL + "/slow",
+		Timeout:    10,
+	})
+
+	require.False(t, h.OnConnectAuthenticate(new(mqtt.Client), connectPacket("mochi", "melon")))
+	require.False(t, h.OnACLCheck(new(mqtt.Client), "a/b/c", true))
+}
+
+func TestHTTPFailOpen(t *testing.T) {
+	s := newHTTPAuthServer(t)
+	h := newHTTPHook(t, &HTTPOptions{
+		ConnectURL: s.URL + "/error",
+		ACLURL:     s.URL + "/slow",
+		Timeout:    10,
+		FailOpen:   true,
+	})
+
+	require.True(t, h.OnConnectAuthenticate(new(mqtt.Client), connectPacket("mochi", "melon")))
+	require.True(t, h.OnACLCheck(new(mqtt.Client), "d/e/f", true))
+}
+
+func TestHTTPFailOpenUnreachable(t *testing.T) {
+	s := newHTTPAuthServer(t)
+	url := s.URL
+	s.Close()
+
+	h := newHTTPHook(t, &HTTPOptions{ConnectURL: url + "/connect", FailOpen: true})
+	require.True(t, h.OnConnectAuthenticate(new(mqtt.Client), connectPacket("other", "")))
+}
+
+func TestHTTPFailOpenDenied(t *testing.T) {
+	s := newHTTPAuthServer(t)
+	h := newHTTPHook(t, &HTTPOptions{ACLURL: s.URL + "/acl", FailOpen: true})
+	require.False(t, h.OnACLCheck(new(mqtt.Client), "d/e/f", true))
+}
+
+func TestHTTPCache(t *testing.T) {
+	s := newHTTPAuthServer(t)
+	h := newHTTPHook(t, &HTTPOptions{ACLURL: s.URL + "/acl", CacheTTL: 60})
+
+	cl := &mqtt.Client{ID: "cl1"}
+	require.True(t, h.OnACLCheck(cl, "a/b/c", true))
+	require.True(t, h.OnACLCheck(cl, "a/b/c", true))
+	require.False(t, h.OnACLCheck(cl, "d/e/f", true))
+	require.False(t, h.OnACLCheck(cl, "d/e/f", true))
+	require.Equal(t, int64(2), s.calls.Load())
+
+	require.True(t, h.OnACLCheck(cl, "a/b/c", false))
+	require.Equal(t, int64(3), s.calls.Load())
+}
+
+func TestHTTPCacheExpired(t *testing.T) {
+	s := newHTTPAuthServer(t)
+	h := newHTTPHook(t, &HTTPOptions{ACLURL: s.URL + "/acl", CacheTTL: 60})
+
+	cl := &mqtt.Client{ID: "cl1"}
+	require.True(t, h.OnACLCheck(cl, "a/b/c", true))
+	for k, e := range h.cache {
+		e.expires = time.Now().Add(-time.Second)
+		h.cache[k] = e
+	}
+
+	require.True(t, h.OnACLCheck(cl, "a/b/c", true))
+	require.Equal(t, int64(2), s.calls.Load())
+}
+
+func TestHTTPCacheDisabled(t *testing.T) {
+	s := newHTTPAuthServer(t)
+	h := newHTTPHook(t, &HTTPOptions{ACLURL: s.URL + "/acl"})
+
+	cl := &mqtt.Client{ID: "cl1"}
+	require.True(t, h.OnACLCheck(cl, "a/b/c", true))
+	require.True(t, h.OnACLCheck(cl, "a/b/c", true))
+	require.Equal(t, int64(2), s.calls.Load())
+	require.Empty(t, h.cache)
+}
+
+func TestHTTPCacheFailuresNotCached(t *testing.T) {
+	s := newHTTPAuthServer(t)
+	h := newHTTPHook(t, &HTTPOptions{ConnectURL: s.URL + "/error", CacheTTL: 60})
+
+	require.False(t, h.OnConnectAuthenticate(new(mqtt.Client), connectPacket("mochi", "melon")))
+	require.False(t, h.OnConnectAuthenticate(new(mqtt.Client), connectPacket("mochi", "melon")))
+	require.Equal(t, int64(2), s.calls.Load())
+	require.Empty(t, h.cache)
+}
+
+func TestHTTPCacheFull(t *testing.T) {
+	s := newHTTPAuthServer(t)
+	h := newHTTPHook(t, &HTTPOptions{ACLURL: s.URL + "/acl", CacheTTL: 60, CacheSize: 2})
+
+	cl := &mqtt.Client{ID: "cl1"}
+	require.True(t, h.OnACLCheck(cl, "a/1", true))
+	require.True(t, h.OnACLCheck(cl, "a/2", true))
+	require.True(t, h.OnACLCheck(cl, "a/3", true))
+	require.Len(t, h.cache, 2)
+
+	for k, e := range h.cache {
+		e.expires = time.Now().Add(-time.Second)
+		h.cache[k] = e
+		break
+	}
+
+	require.True(t, h.OnACLCheck(cl, "a/3", true))
+	require.Len(t, h.cache, 2)
+	require.Equal(t, int64(4), s.calls.Load())
+}
+
+func TestHTTPReload(t *testing.T) {
+	s := newHTTPAuthServer(t)
+	h := newHTTPHook(t, &HTTPOptions{ACLURL: s.URL + "/error", CacheTTL: 60})
+
+	cl := &mqtt.Client{ID: "cl1"}
+	require.False(t, h.OnACLCheck(cl, "a/1", true))
+	h.store(h.config.Load(), [sha256.Size]byte{1}, true)
+	require.Len(t, h.cache, 1)
+
+	err := h.Reload(&HTTPOptions{ACLURL: s.URL + "/acl", CacheTTL: 60})
+	require.NoError(t, err)
+	require.Empty(t, h.cache)
+	require.Equal(t, int64(defaultBackendTimeout), h.config.Load().Timeout)
+	require.True(t, h.OnACLCheck(cl, "a/1", true))
+	require.False(t, h.OnACLCheck(cl, "b/1", true))
+}
+
+func TestHTTPReloadBadConfig(t *testing.T) {
+	h := newHTTPHook(t, &HTTPOptions{ACLURL: "http://localhost/acl"})
+
+	err := h.Reload(map[string]any{})
+	require.ErrorIs(t, err, mqtt.ErrInvalidConfigType)
+
+	err = h.Reload(nil)
+	require.ErrorIs(t, err, mqtt.ErrInvalidConfigType)
+
+	err = h.Reload(&HTTPOptions{})
+	require.ErrorIs(t, err, ErrNoHTTPEndpoint)
+	require.Equal(t, "http://localhost/acl", h.config.Load().ACLURL)
+}
+
+func TestHTTPStoreReloaded(t *testing.T) {
+	h := newHTTPHook(t, &HTTPOptions{ACLURL: "http://localhost/acl", CacheTTL: 60})
+	cfg := h.config.Load()
+	require.NoError(t, h.Reload(&HTTPOptions{ACLURL: "http://localhost/acl2", CacheTTL: 60}))
+
+	h.store(cfg, [sha256.Size]byte{1}, true) // a response to a request made before the reload
+	require.Empty(t, h.cache)
+}
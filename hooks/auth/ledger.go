@@ -6,6 +6,10 @@ package auth
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
 
@@ -22,6 +26,17 @@ const (
 	ReadWrite               // user can both publish and subscribe to the topic
 )
 
+var (
+	// ErrUserNotFound indicates a user does not exist in the users map of the ledger.
+	ErrUserNotFound = errors.New("user not found")
+
+	// ErrUsernameEmpty indicates a user was added to the ledger without a username.
+	ErrUsernameEmpty = errors.New("username is empty")
+
+	// ErrInvalidClientIDPattern indicates a client id rule has a pattern which is not a valid regular expression.
+	ErrInvalidClientIDPattern = errors.New("invalid client id pattern")
+)
+
 // Access determines the read/write privileges for an ACL rule.
 type Access byte
 
@@ -30,12 +45,20 @@ type Users map[string]UserRule
 
 // UserRule defines a set of access rules for a specific user.
 type UserRule struct {
-	Username RString `json:"username,omitempty" yaml:"username,omitempty"` // the username of a user
-	Password RString `json:"password,omitempty" yaml:"password,omitempty"` // the password of a user
-	ACL      Filters `json:"acl,omitempty" yaml:"acl,omitempty"`           // filters to match, if desired
-	Disallow bool    `json:"disallow,omitempty" yaml:"disallow,omitempty"` // allow or disallow the user
+	Username  RString       `json:"username,omitempty" yaml:"username,omitempty"`   // the username of a user
+	Password  RString       `json:"password,omitempty" yaml:"password,omitempty"`   // the password of a user
+	ACL       Filters       `json:"acl,omitempty" yaml:"acl,omitempty"`             // filters to match, if desired
+	Disallow  bool          `json:"disallow,omitempty" yaml:"disallow,omitempty"`   // allow or disallow the user
+	Superuser bool          `json:"superuser,omitempty" yaml:"superuser,omitempty"` // the user bypasses all ACL checks
+	Roles     []string      `json:"roles,omitempty" yaml:"roles,omitempty"`         // the roles whose filters also apply to the user
+	Retain    ActionFilters `json:"retain,omitempty" yaml:"retain,omitempty"`       // filters the user may or may not retain messages on
+	Will      ActionFilters `json:"will,omitempty" yaml:"will,omitempty"`           // filters the user may or may not register wills on
+	Quotas    QuotaFilters  `json:"quotas,omitempty" yaml:"quotas,omitempty"`       // the publish quotas of filters
 }
 
+// Roles contains named sets of ACL filters which can be shared by many users, keyed on role name.
+type Roles map[string]Filters
+
 // AuthRules defines generic access rules applicable to all users.
 type AuthRules []AuthRule
 
@@ -43,24 +66,106 @@ type AuthRule struct {
 	Client   RString `json:"client,omitempty" yaml:"client,omitempty"`     // the id of a connecting client
 	Username RString `json:"username,omitempty" yaml:"username,omitempty"` // the username of a user
 	Remote   RString `json:"remote,omitempty" yaml:"remote,omitempty"`     // remote address or
+	Listener RString `json:"listener,omitempty" yaml:"listener,omitempty"` // the id of the listener the client connected to
 	Password RString `json:"password,omitempty" yaml:"password,omitempty"` // the password of a user
 	Allow    bool    `json:"allow,omitempty" yaml:"allow,omitempty"`       // allow or disallow the users
 }
 
+// ClientIDRules defines the client ids which clients may connect with.
+type ClientIDRules []ClientIDRule
+
+// ClientIDRule restricts the client ids of matching clients to a pattern. The pattern is a
+// regular expression which must match the whole client id, and any %u in the pattern is
+// replaced with the username of the client.
+type ClientIDRule struct {
+	Username RString `json:"username,omitempty" yaml:"username,omitempty"` // the username of a user
+	Remote   RString `json:"remote,omitempty" yaml:"remote,omitempty"`     // the remote address of the client
+	Listener RString `json:"listener,omitempty" yaml:"listener,omitempty"` // the id of the listener the client connected to
+	Pattern  string  `json:"pattern" yaml:"pattern"`                       // the pattern the client id must match
+}
+
+// compile returns the pattern of the rule as a regular expression for a username.
+func (r ClientIDRule) compile(username string) (*regexp.Regexp, error) {
+	p := strings.ReplaceAll(r.Pattern, "%u", regexp.QuoteMeta(username))
+	re, err := regexp.Compile("^(?:" + p + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidClientIDPattern, err)
+	}
+
+	return re, nil
+}
+
+// AnonymousRule allows clients without a username to connect, and confines them to a namespace
+// of topics. The auth and ACL rules are not checked for clients which match the rule.
+type AnonymousRule struct {
+	Listener RString `json:"listener,omitempty" yaml:"listener,omitempty"` // the id of the listener anonymous clients may connect to
+	Filters  Filters `json:"filters" yaml:"filters"`                       // the filters anonymous clients are confined to, such as public/#
+}
+
+// matches returns true if the rule applies to a client.
+func (r *AnonymousRule) matches(cl *mqtt.Client) bool {
+	return r != nil && len(cl.Properties.Username) == 0 && r.Listener.Matches(cl.Net.Listener)
+}
+
+// ok returns true if the filters of the rule allow the client to read or write to a topic, and
+// the filter which decided it. Deny filters take precedence, and topics which match none of the
+// filters are denied.
+func (r *AnonymousRule) ok(cl *mqtt.Client, topic string, write bool) (allow bool, filter RString) {
+	for fl, access := range r.Filters {
+		if !fl.ClientFilterMatches(cl, topic) {
+			continue
+		}
+
+		if access == Deny {
+			return false, fl
+		}
+
+		if filter == "" || !allow {
+			filter = fl
+		}
+
+		if access == ReadWrite || (access == ReadOnly && !write) || (access == WriteOnly && write) {
+			allow = true
+		}
+	}
+
+	return allow, filter
+}
+
 // ACLRules defines generic topic or filter access rules applicable to all users.
 type ACLRules []ACLRule
 
 // ACLRule defines access rules for a specific topic or filter.
 type ACLRule struct {
-	Client   RString `json:"client,omitempty" yaml:"client,omitempty"`     // the id of a connecting client
-	Username RString `json:"username,omitempty" yaml:"username,omitempty"` // the username of a user
-	Remote   RString `json:"remote,omitempty" yaml:"remote,omitempty"`     // remote address or
-	Filters  Filters `json:"filters,omitempty" yaml:"filters,omitempty"`   // filters to match
+	Client   RString       `json:"client,omitempty" yaml:"client,omitempty"`     // the id of a connecting client
+	Username RString       `json:"username,omitempty" yaml:"username,omitempty"` // the username of a user
+	Remote   RString       `json:"remote,omitempty" yaml:"remote,omitempty"`     // remote address or
+	Listener RString       `json:"listener,omitempty" yaml:"listener,omitempty"` // the id of the listener the client connected to
+	Filters  Filters       `json:"filters,omitempty" yaml:"filters,omitempty"`   // filters to match
+	Retain   ActionFilters `json:"retain,omitempty" yaml:"retain,omitempty"`     // filters matching clients may or may not retain messages on
+	Will     ActionFilters `json:"will,omitempty" yaml:"will,omitempty"`         // filters matching clients may or may not register wills on
+	Quotas   QuotaFilters  `json:"quotas,omitempty" yaml:"quotas,omitempty"`     // the publish quotas of filters for matching clients
 }
 
 // Filters is a map of Access rules keyed on filter.
 type Filters map[RString]Access
 
+// ActionFilters is a map of whether an action such as retaining a message or registering a
+// will is allowed, keyed on filter. Actions on topics matching none of the filters are allowed.
+type ActionFilters map[RString]bool
+
+// Quota limits the rate a client may publish to topics matching a filter. Limits which are 0
+// are not enforced.
+type Quota struct {
+	Messages float64 `json:"messages,omitempty" yaml:"messages,omitempty"` // the messages which may be published per second
+	Bytes    int64   `json:"bytes,omitempty" yaml:"bytes,omitempty"`       // the payload bytes which may be published per minute
+	Throttle bool    `json:"throttle,omitempty" yaml:"throttle,omitempty"` // delay publishes which exceed the quota rather than rejecting them
+}
+
+// QuotaFilters is a map of publish quotas keyed on filter. Each client has a separate quota
+// for each filter.
+type QuotaFilters map[RString]Quota
+
 // RString is a rule value string.
 type RString string
 
@@ -79,12 +184,66 @@ func (r RString) Matches(a string) bool {
 	return false
 }
 
+// PasswordMatches returns true if a password matches the rule. If the rule is a password hash,
+// such as one created by HashPassword, the password is verified against the hash.
+func (r RString) PasswordMatches(password []byte) bool {
+	if IsPasswordHash(string(r)) {
+		return verifyPassword(string(r), password)
+	}
+
+	return r.Matches(string(password))
+}
+
+// passwordEquals returns true if a password is equal to the rule, or if the rule is a password
+// hash, if the password is verified against the hash.
+func (r RString) passwordEquals(password []byte) bool {
+	if IsPasswordHash(string(r)) {
+		return verifyPassword(string(r), password)
+	}
+
+	return r == RString(password)
+}
+
 // FilterMatches returns true if a filter matches a topic rule.
 func (r RString) FilterMatches(a string) bool {
 	_, ok := MatchTopic(string(r), a)
 	return ok
 }
 
+// ClientFilterMatches returns true if a filter matches a topic rule, after replacing %c in the
+// filter with the client id and %u with the username of a client.
+func (r RString) ClientFilterMatches(cl *mqtt.Client, a string) bool {
+	filter, ok := expandPattern(string(r), cl.ID, string(cl.Properties.Username))
+	if !ok {
+		return false
+	}
+
+	return RString(filter).FilterMatches(a)
+}
+
+// expandPattern replaces %c in a pattern with the client id and %u with the username. A
+// pattern is not expanded if the value it uses is empty or contains wildcards or separators.
+func expandPattern(pattern, clientID, username string) (string, bool) {
+	for _, v := range []struct {
+		token, value string
+	}{
+		{"%c", clientID},
+		{"%u", username},
+	} {
+		if !strings.Contains(pattern, v.token) {
+			continue
+		}
+
+		if v.value == "" || strings.ContainsAny(v.value, "+#/") {
+			return "", false
+		}
+
+		pattern = strings.ReplaceAll(pattern, v.token, v.value)
+	}
+
+	return pattern, true
+}
+
 // MatchTopic checks if a given topic matches a filter, accounting for filter
 // wildcards. Eg. filter /a/b/+/c == topic a/b/d/c.
 func MatchTopic(filter string, topic string) (elements []string, matched bool) {
@@ -118,30 +277,161 @@ func MatchTopic(filter string, topic string) (elements []string, matched bool) {
 	return elements, true
 }
 
-// Ledger is an auth ledger containing access rules for users and topics.
+// Ledger is an auth ledger containing access rules for users and topics. The ledger may be
+// safely updated while it is in use.
 type Ledger struct {
-	sync.Mutex `json:"-" yaml:"-"`
-	Users      Users     `json:"users" yaml:"users"`
-	Auth       AuthRules `json:"auth" yaml:"auth"`
-	ACL        ACLRules  `json:"acl" yaml:"acl"`
+	sync.RWMutex `json:"-" yaml:"-"`
+	Users        Users          `json:"users" yaml:"users"`
+	Roles        Roles          `json:"roles,omitempty" yaml:"roles,omitempty"`
+	Auth         AuthRules      `json:"auth" yaml:"auth"`
+	ACL          ACLRules       `json:"acl" yaml:"acl"`
+	ClientIDs    ClientIDRules  `json:"client_ids,omitempty" yaml:"client_ids,omitempty"`
+	Anonymous    *AnonymousRule `json:"anonymous,omitempty" yaml:"anonymous,omitempty"`
+
+	patterns map[string]*regexp.Regexp // the compiled client id patterns which do not contain %u, keyed on pattern
 }
 
-// Update updates the internal values of the ledger.
+// Update updates the internal values of the ledger. The new ledger should be validated first,
+// so its client id patterns are checked and compiled.
 func (l *Ledger) Update(ln *Ledger) {
 	l.Lock()
 	defer l.Unlock()
+	l.Roles = ln.Roles
 	l.Auth = ln.Auth
 	l.ACL = ln.ACL
+	l.ClientIDs = ln.ClientIDs
+	l.Anonymous = ln.Anonymous
+	l.patterns = ln.patterns
+}
+
+// Replace atomically replaces all of the values of the ledger, including the users map. The
+// new ledger should be validated first, so its client id patterns are checked and compiled.
+func (l *Ledger) Replace(ln *Ledger) {
+	l.Lock()
+	defer l.Unlock()
+	l.Users = ln.Users
+	l.Roles = ln.Roles
+	l.Auth = ln.Auth
+	l.ACL = ln.ACL
+	l.ClientIDs = ln.ClientIDs
+	l.Anonymous = ln.Anonymous
+	l.patterns = ln.patterns
+}
+
+// Validate returns an error if any of the client id rules have an invalid pattern, and
+// compiles the patterns which do not depend on the username of the client.
+func (l *Ledger) Validate() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.compilePatterns()
+}
+
+// compilePatterns compiles the client id patterns which do not contain %u, returning an
+// error if any pattern is invalid. The lock must be held by the caller.
+func (l *Ledger) compilePatterns() error {
+	var patterns map[string]*regexp.Regexp
+	for _, rule := range l.ClientIDs {
+		re, err := rule.compile("")
+		if err != nil {
+			return err
+		}
+
+		if !strings.Contains(rule.Pattern, "%u") {
+			if patterns == nil {
+				patterns = make(map[string]*regexp.Regexp)
+			}
+			patterns[rule.Pattern] = re
+		}
+	}
+
+	l.patterns = patterns
+	return nil
+}
+
+// AddUser adds a user to the users map, replacing any existing user with the same username.
+func (l *Ledger) AddUser(u UserRule) error {
+	if u.Username == "" {
+		return ErrUsernameEmpty
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if l.Users == nil {
+		l.Users = make(Users)
+	}
+
+	l.Users[string(u.Username)] = u
+	return nil
+}
+
+// RemoveUser removes a user from the users map.
+func (l *Ledger) RemoveUser(username string) error {
+	l.Lock()
+	defer l.Unlock()
+	if _, ok := l.Users[username]; !ok {
+		return ErrUserNotFound
+	}
+
+	delete(l.Users, username)
+	return nil
+}
+
+// SetACL replaces the ACL filters of a user in the users map.
+func (l *Ledger) SetACL(username string, acl Filters) error {
+	l.Lock()
+	defer l.Unlock()
+	u, ok := l.Users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	u.ACL = acl
+	l.Users[username] = u
+	return nil
+}
+
+// Usernames returns the sorted usernames of the users map.
+func (l *Ledger) Usernames() []string {
+	l.RLock()
+	defer l.RUnlock()
+	usernames := make([]string, 0, len(l.Users))
+	for username := range l.Users {
+		usernames = append(usernames, username)
+	}
+
+	sort.Strings(usernames)
+	return usernames
+}
+
+// SetUsers replaces the users map.
+func (l *Ledger) SetUsers(users Users) {
+	l.Lock()
+	defer l.Unlock()
+	l.Users = users
+}
+
+// UsersJSON encodes the users map into a JSON string.
+func (l *Ledger) UsersJSON() (data []byte, err error) {
+	l.RLock()
+	defer l.RUnlock()
+	return json.Marshal(l.Users)
 }
 
 // AuthOk returns true if the rules indicate the user is allowed to authenticate.
 func (l *Ledger) AuthOk(cl *mqtt.Client, pk packets.Packet) (n int, ok bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	if l.Anonymous.matches(cl) {
+		return 0, true
+	}
+
 	// If the users map is set, always check for a predefined user first instead
 	// of iterating through global rules.
 	if l.Users != nil {
 		if u, ok := l.Users[string(cl.Properties.Username)]; ok &&
 			u.Password != "" &&
-			u.Password == RString(pk.Connect.Password) {
+			u.Password.passwordEquals(pk.Connect.Password) {
 			return 0, !u.Disallow
 		}
 	}
@@ -151,8 +441,9 @@ func (l *Ledger) AuthOk(cl *mqtt.Client, pk packets.Packet) (n int, ok bool) {
 	for n, rule := range l.Auth {
 		if rule.Client.Matches(cl.ID) &&
 			rule.Username.Matches(string(cl.Properties.Username)) &&
-			rule.Password.Matches(string(pk.Connect.Password)) &&
-			rule.Remote.Matches(cl.Net.Remote) {
+			rule.Password.PasswordMatches(pk.Connect.Password) &&
+			rule.Remote.Matches(cl.Net.Remote) &&
+			rule.Listener.Matches(cl.Net.Listener) {
 			return n, rule.Allow
 		}
 	}
@@ -160,40 +451,118 @@ func (l *Ledger) AuthOk(cl *mqtt.Client, pk packets.Packet) (n int, ok bool) {
 	return 0, false
 }
 
+// ClientIDOk returns true if the client id of the client matches the pattern of the first
+// client id rule which applies to the client. Clients matching no rule may use any client id.
+func (l *Ledger) ClientIDOk(cl *mqtt.Client) (n int, ok bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	username := string(cl.Properties.Username)
+	for n, rule := range l.ClientIDs {
+		if rule.Username.Matches(username) &&
+			rule.Remote.Matches(cl.Net.Remote) &&
+			rule.Listener.Matches(cl.Net.Listener) {
+			if strings.Contains(rule.Pattern, "%u") && username == "" {
+				return n, false // a client without a username cannot match its username
+			}
+
+			re, ok := l.patterns[rule.Pattern]
+			if !ok { // the pattern contains %u, or the rules were changed without validating them
+				var err error
+				if re, err = rule.compile(username); err != nil {
+					return n, false
+				}
+			}
+
+			return n, re.MatchString(cl.ID)
+		}
+	}
+
+	return 0, true
+}
+
+// SuperuserOk returns true if the client authenticates as a superuser in the users map.
+// Superusers matched by the auth rules rather than the users map are not superusers.
+func (l *Ledger) SuperuserOk(cl *mqtt.Client, pk packets.Packet) bool {
+	l.RLock()
+	defer l.RUnlock()
+
+	u, ok := l.Users[string(cl.Properties.Username)]
+	return ok && u.Superuser && !u.Disallow &&
+		u.Password != "" &&
+		u.Password.passwordEquals(pk.Connect.Password)
+}
+
 // ACLOk returns true if the rules indicate the user is allowed to read or write to
 // a specific filter or topic respectively, based on the `write` bool.
 func (l *Ledger) ACLOk(cl *mqtt.Client, topic string, write bool) (n int, ok bool) {
+	l.RLock()
+	defer l.RUnlock()
+	n, ok, _ = l.aclOk(cl, topic, write)
+	return n, ok
+}
+
+// ACLRule returns a description of the rule which determines whether the user may read or
+// write to a topic, such as `users[mochi].acl[a/#]` or `acl[2]`. An empty string is returned
+// if no rule matched the topic.
+func (l *Ledger) ACLRule(cl *mqtt.Client, topic string, write bool) string {
+	l.RLock()
+	defer l.RUnlock()
+	_, _, rule := l.aclOk(cl, topic, write)
+	return rule
+}
+
+// aclOk returns whether the user may read or write to a topic, and the index and a
+// description of the rule which matched. The ledger must be locked.
+func (l *Ledger) aclOk(cl *mqtt.Client, topic string, write bool) (n int, ok bool, rule string) {
+	if l.Anonymous.matches(cl) {
+		allow, filter := l.Anonymous.ok(cl, topic, write)
+		if filter == "" {
+			return 0, false, "anonymous"
+		}
+
+		return 0, allow, fmt.Sprintf("anonymous.filters[%s]", filter)
+	}
+
 	// If the users map is set, always check for a predefined user first instead
 	// of iterating through global rules.
 	if l.Users != nil {
-		if u, ok := l.Users[string(cl.Properties.Username)]; ok && len(u.ACL) > 0 {
+		username := string(cl.Properties.Username)
+		if u, ok := l.Users[username]; ok {
 			for filter, access := range u.ACL {
-				if filter.FilterMatches(topic) {
+				if filter.ClientFilterMatches(cl, topic) {
+					rule := fmt.Sprintf("users[%s].acl[%s]", username, filter)
 					if !write && (access == ReadOnly || access == ReadWrite) {
-						return n, true
+						return n, true, rule
 					} else if write && (access == WriteOnly || access == ReadWrite) {
-						return n, true
+						return n, true, rule
 					} else {
-						return n, false
+						return n, false, rule
 					}
 				}
 			}
+
+			// The filters of the user take precedence over the filters of its roles.
+			if allow, rule := l.roleACLOk(u.Roles, cl, topic, write); rule != "" {
+				return n, allow, rule
+			}
 		}
 	}
 
 	for n, rule := range l.ACL {
 		if rule.Client.Matches(cl.ID) &&
 			rule.Username.Matches(string(cl.Properties.Username)) &&
-			rule.Remote.Matches(cl.Net.Remote) {
+			rule.Remote.Matches(cl.Net.Remote) &&
+			rule.Listener.Matches(cl.Net.Listener) {
 			if len(rule.Filters) == 0 {
-				return n, true
+				return n, true, fmt.Sprintf("acl[%d]", n)
 			}
 
 			if write {
 				for filter, access := range rule.Filters {
 					if access == WriteOnly || access == ReadWrite {
-						if filter.FilterMatches(topic) {
-							return n, true
+						if filter.ClientFilterMatches(cl, topic) {
+							return n, true, fmt.Sprintf("acl[%d].filters[%s]", n, filter)
 						}
 					}
 				}
@@ -202,35 +571,193 @@ func (l *Ledger) ACLOk(cl *mqtt.Client, topic string, write bool) (n int, ok boo
 			if !write {
 				for filter, access := range rule.Filters {
 					if access == ReadOnly || access == ReadWrite {
-						if filter.FilterMatches(topic) {
-							return n, true
+						if filter.ClientFilterMatches(cl, topic) {
+							return n, true, fmt.Sprintf("acl[%d].filters[%s]", n, filter)
 						}
 					}
 				}
 			}
 
 			for filter := range rule.Filters {
-				if filter.FilterMatches(topic) {
-					return n, false
+				if filter.ClientFilterMatches(cl, topic) {
+					return n, false, fmt.Sprintf("acl[%d].filters[%s]", n, filter)
 				}
 			}
 		}
 	}
 
-	return 0, true
+	return 0, true, ""
+}
+
+// ActionOk returns true if the rules allow the user to retain a message or register a will
+// on a topic. The action filters of the user are checked before those of the ACL rules, and
+// actions on topics which match none of the filters are allowed.
+func (l *Ledger) ActionOk(cl *mqtt.Client, topic string, action mqtt.ACLAction) (n int, ok bool) {
+	l.RLock()
+	defer l.RUnlock()
+	n, ok, _ = l.actionOk(cl, topic, action)
+	return n, ok
+}
+
+// ActionRule returns a description of the rule which determines whether the user may retain
+// a message or register a will on a topic, such as `acl[1].retain[a/#]`. An empty string is
+// returned if no filter matched the topic.
+func (l *Ledger) ActionRule(cl *mqtt.Client, topic string, action mqtt.ACLAction) string {
+	l.RLock()
+	defer l.RUnlock()
+	_, _, rule := l.actionOk(cl, topic, action)
+	return rule
+}
+
+// actionOk returns whether the user may retain a message or register a will on a topic, and
+// the index and a description of the rule which matched. The ledger must be locked.
+func (l *Ledger) actionOk(cl *mqtt.Client, topic string, action mqtt.ACLAction) (n int, ok bool, rule string) {
+	username := string(cl.Properties.Username)
+	if u, ok := l.Users[username]; ok {
+		if allow, filter := u.actionFilters(action).ok(cl, topic); filter != "" {
+			return 0, allow, fmt.Sprintf("users[%s].%s[%s]", username, action, filter)
+		}
+	}
+
+	for n, rule := range l.ACL {
+		if rule.Client.Matches(cl.ID) &&
+			rule.Username.Matches(username) &&
+			rule.Remote.Matches(cl.Net.Remote) &&
+			rule.Listener.Matches(cl.Net.Listener) {
+			if allow, filter := rule.actionFilters(action).ok(cl, topic); filter != "" {
+				return n, allow, fmt.Sprintf("acl[%d].%s[%s]", n, action, filter)
+			}
+		}
+	}
+
+	return 0, true, ""
+}
+
+// actionFilters returns the action filters of the user for an action.
+func (u UserRule) actionFilters(action mqtt.ACLAction) ActionFilters {
+	if action == mqtt.ACLActionWill {
+		return u.Will
+	}
+
+	return u.Retain
+}
+
+// actionFilters returns the action filters of the rule for an action.
+func (r ACLRule) actionFilters(action mqtt.ACLAction) ActionFilters {
+	if action == mqtt.ACLActionWill {
+		return r.Will
+	}
+
+	return r.Retain
+}
+
+// ok returns whether the filters allow an action on a topic, and the filter which decided
+// it, or an empty filter if none matched the topic. Filters which disallow the action take
+// precedence.
+func (f ActionFilters) ok(cl *mqtt.Client, topic string) (allow bool, filter RString) {
+	for fl, allowed := range f {
+		if fl.ClientFilterMatches(cl, topic) {
+			if !allowed {
+				return false, fl
+			}
+			filter = fl
+		}
+	}
+
+	return filter != "", filter
+}
+
+// QuotaRule returns the publish quota of the user for a topic and a description of the rule
+// it belongs to, such as `acl[1].quotas[a/#]`. The quotas of the user are checked before those
+// of the ACL rules. An empty description is returned if no quota filter matched the topic.
+func (l *Ledger) QuotaRule(cl *mqtt.Client, topic string) (quota Quota, rule string) {
+	l.RLock()
+	defer l.RUnlock()
+
+	username := string(cl.Properties.Username)
+	if u, ok := l.Users[username]; ok {
+		if q, filter := u.Quotas.match(cl, topic); filter != "" {
+			return q, fmt.Sprintf("users[%s].quotas[%s]", username, filter)
+		}
+	}
+
+	for n, rule := range l.ACL {
+		if rule.Client.Matches(cl.ID) &&
+			rule.Username.Matches(username) &&
+			rule.Remote.Matches(cl.Net.Remote) &&
+			rule.Listener.Matches(cl.Net.Listener) {
+			if q, filter := rule.Quotas.match(cl, topic); filter != "" {
+				return q, fmt.Sprintf("acl[%d].quotas[%s]", n, filter)
+			}
+		}
+	}
+
+	return Quota{}, ""
+}
+
+// match returns the quota of the most specific filter matching a topic, and the filter, or
+// an empty filter if none matched the topic. The longest matching filter is the most specific.
+func (f QuotaFilters) match(cl *mqtt.Client, topic string) (quota Quota, filter RString) {
+	for fl, q := range f {
+		if !fl.ClientFilterMatches(cl, topic) {
+			continue
+		}
+
+		if filter == "" || len(fl) > len(filter) || (len(fl) == len(filter) && fl < filter) {
+			quota, filter = q, fl
+		}
+	}
+
+	return quota, filter
+}
+
+// roleACLOk returns true if the filters of the roles allow the client to read or write to
+// a topic, and a description of the role filter which decided it, or an empty string if
+// none of the filters matched the topic. Deny filters take precedence. The ledger must be
+// locked.
+func (l *Ledger) roleACLOk(roles []string, cl *mqtt.Client, topic string, write bool) (allow bool, rule string) {
+	for _, role := range roles {
+		for filter, access := range l.Roles[role] {
+			if !filter.ClientFilterMatches(cl, topic) {
+				continue
+			}
+
+			if rule == "" {
+				rule = fmt.Sprintf("roles[%s][%s]", role, filter)
+			}
+
+			switch access {
+			case Deny:
+				return false, fmt.Sprintf("roles[%s][%s]", role, filter)
+			case ReadOnly:
+				allow = allow || !write
+			case WriteOnly:
+				allow = allow || write
+			case ReadWrite:
+				allow = true
+			}
+		}
+	}
+
+	return allow, rule
 }
 
 // ToJSON encodes the values into a JSON string.
 func (l *Ledger) ToJSON() (data []byte, err error) {
+	l.RLock()
+	defer l.RUnlock()
 	return json.Marshal(l)
 }
 
 // ToYAML encodes the values into a YAML string.
 func (l *Ledger) ToYAML() (data []byte, err error) {
+	l.RLock()
+	defer l.RUnlock()
 	return yaml.Marshal(l)
 }
 
-// Unmarshal decodes a JSON or YAML string (such as a rule config from a file) into a struct.
+// Unmarshal decodes a JSON or YAML string (such as a rule config from a file) into a struct,
+// returning an error if any of the client id rules have an invalid pattern.
 func (l *Ledger) Unmarshal(data []byte) error {
 	l.Lock()
 	defer l.Unlock()
@@ -238,9 +765,16 @@ func (l *Ledger) Unmarshal(data []byte) error {
 		return nil
 	}
 
+	var err error
 	if data[0] == '{' {
-		return json.Unmarshal(data, l)
+		err = json.Unmarshal(data, l)
+	} else {
+		err = yaml.Unmarshal(data, &l)
+	}
+
+	if err != nil {
+		return err
 	}
 
-	return yaml.Unmarshal(data, &l)
+	return l.compilePatterns()
 }
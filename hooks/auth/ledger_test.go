@@ -5,6 +5,7 @@
 package auth
 
 import (
+	"sync"
 	"testing"
 
 	"github.com/AMuzykus/mochi-mqtt-server/v2"
@@ -460,6 +461,331 @@ func TestCanACL(t *testing.T) {
 	}
 }
 
+func TestClientFilterMatches(t *testing.T) {
+	cl := &mqtt.Client{ID: "dev1", Properties: mqtt.ClientProperties{Username: []byte("mochi")}}
+	require.True(t, RString("devices/%c/#").ClientFilterMatches(cl, "devices/dev1/status"))
+	require.False(t, RString("devices/%c/#").ClientFilterMatches(cl, "devices/dev2/status"))
+	require.True(t, RString("users/%u/%c").ClientFilterMatches(cl, "users/mochi/dev1"))
+	require.True(t, RString("a/#").ClientFilterMatches(cl, "a/b"))
+
+	anon := &mqtt.Client{ID: "dev1"}
+	require.False(t, RString("users/%u/#").ClientFilterMatches(anon, "users//x"))
+
+	wild := &mqtt.Client{ID: "+"}
+	require.False(t, RString("devices/%c/#").ClientFilterMatches(wild, "devices/+/status"))
+	require.False(t, RString("devices/%c/#").ClientFilterMatches(&mqtt.Client{ID: "a/b"}, "devices/a/b/status"))
+}
+
+func TestACLOkClientPlaceholders(t *testing.T) {
+	l := &Ledger{
+		Users: Users{
+			"mochi": {ACL: Filters{"users/%u/#": ReadWrite}},
+		},
+		ACL: ACLRules{
+			{
+				Filters: Filters{
+					"devices/%c/#": ReadWrite,
+					"devices/#":    Deny,
+				},
+			},
+		},
+	}
+
+	dev := &mqtt.Client{ID: "dev1"}
+	_, ok := l.ACLOk(dev, "devices/dev1/status", true)
+	require.True(t, ok)
+	_, ok = l.ACLOk(dev, "devices/dev2/status", true)
+	require.False(t, ok)
+
+	user := &mqtt.Client{ID: "cl1", Properties: mqtt.ClientProperties{Username: []byte("mochi")}}
+	_, ok = l.ACLOk(user, "users/mochi/inbox", false)
+	require.True(t, ok)
+	_, ok = l.ACLOk(user, "users/melon/inbox", false)
+	require.True(t, ok) // no user filter matches, so the general rules apply
+	_, ok = l.ACLOk(user, "devices/dev1/status", false)
+	require.False(t, ok)
+}
+
+func TestLedgerListenerRules(t *testing.T) {
+	l := &Ledger{
+		Auth: AuthRules{
+			{Listener: "internal", Allow: true},
+			{Listener: "public", Username: "mochi", Password: "melon", Allow: true},
+		},
+		ACL: ACLRules{
+			{Listener: "internal"},
+			{Listener: "public", Username: "mochi", Filters: Filters{"mochi/#": ReadWrite}},
+			{Filters: Filters{"#": Deny}},
+		},
+	}
+
+	internal := &mqtt.Client{ID: "cl1"}
+	internal.Net.Listener = "internal"
+	public := &mqtt.Client{ID: "cl2", Properties: mqtt.ClientProperties{Username: []byte("mochi")}}
+	public.Net.Listener = "public"
+	anon := &mqtt.Client{ID: "cl3"}
+	anon.Net.Listener = "public"
+
+	pk := packets.Packet{Connect: packets.ConnectParams{Password: []byte("melon")}}
+	_, ok := l.AuthOk(internal, packets.Packet{})
+	require.True(t, ok)
+	_, ok = l.AuthOk(public, pk)
+	require.True(t, ok)
+	_, ok = l.AuthOk(public, packets.Packet{})
+	require.False(t, ok)
+	_, ok = l.AuthOk(anon, pk)
+	require.False(t, ok)
+
+	_, ok = l.ACLOk(internal, "any/topic", true)
+	require.True(t, ok)
+	_, ok = l.ACLOk(public, "mochi/a", true)
+	require.True(t, ok)
+	_, ok = l.ACLOk(public, "any/topic", true)
+	require.False(t, ok)
+	_, ok = l.ACLOk(anon, "any/topic", false)
+	require.False(t, ok)
+}
+
+func TestLedgerClientIDOk(t *testing.T) {
+	l := &Ledger{
+		ClientIDs: ClientIDRules{
+			{Listener: "internal", Pattern: ".*"},
+			{Username: "device", Pattern: "dev-[0-9a-f]{12}"},
+			{Pattern: "%u"},
+		},
+	}
+
+	client := func(id, username, listener string) *mqtt.Client {
+		cl := &mqtt.Client{ID: id, Properties: mqtt.ClientProperties{Username: []byte(username)}}
+		cl.Net.Listener = listener
+		return cl
+	}
+
+	tt := []struct {
+		cl *mqtt.Client
+		n  int
+		ok bool
+	}{
+		{cl: client("anything", "", "internal"), n: 0, ok: true},
+		{cl: client("dev-0123456789ab", "device", "t1"), n: 1, ok: true},
+		{cl: client("dev-0123456789abc", "device", "t1"), n: 1, ok: false},
+		{cl: client("xdev-0123456789ab", "device", "t1"), n: 1, ok: false},
+		{cl: client("mochi", "mochi", "t1"), n: 2, ok: true},
+		{cl: client("mochi2", "mochi", "t1"), n: 2, ok: false},
+		{cl: client("a.b", "a.b", "t1"), n: 2, ok: true},
+		{cl: client("axb", "a.b", "t1"), n: 2, ok: false},
+		{cl: client("", "", "t1"), n: 2, ok: false},
+	}
+
+	for _, tx := range tt {
+		n, ok := l.ClientIDOk(tx.cl)
+		require.Equal(t, tx.n, n, tx.cl.ID)
+		require.Equal(t, tx.ok, ok, tx.cl.ID)
+	}
+
+	n, ok := new(Ledger).ClientIDOk(client("any", "", "t1"))
+	require.Equal(t, 0, n)
+	require.True(t, ok)
+}
+
+func TestLedgerQuotaRule(t *testing.T) {
+	l := &Ledger{
+		Users: Users{
+			"sensor": {
+				Password: "melon",
+				Quotas:   QuotaFilters{"sensors/%c/#": {Messages: 10}},
+			},
+		},
+		ACL: ACLRules{
+			{Listener: "internal"},
+			{Quotas: QuotaFilters{"#": {Messages: 100}, "sensors/#": {Bytes: 1000}}},
+		},
+	}
+
+	sensor := &mqtt.Client{ID: "s1", Properties: mqtt.ClientProperties{Username: []byte("sensor")}}
+	q, rule := l.QuotaRule(sensor, "sensors/s1/state")
+	require.Equal(t, Quota{Messages: 10}, q)
+	require.Equal(t, "users[sensor].quotas[sensors/%c/#]", rule)
+
+	q, rule = l.QuotaRule(sensor, "sensors/s2/state") // the most specific filter applies
+	require.Equal(t, Quota{Bytes: 1000}, q)
+	require.Equal(t, "acl[1].quotas[sensors/#]", rule)
+
+	q, rule = l.QuotaRule(sensor, "other")
+	require.Equal(t, Quota{Messages: 100}, q)
+	require.Equal(t, "acl[1].quotas[#]", rule)
+
+	sensor.Net.Listener = "internal"
+	_, rule = l.QuotaRule(sensor, "other") // rules without quotas do not stop the search
+	require.Equal(t, "acl[1].quotas[#]", rule)
+
+	_, rule = (&Ledger{}).QuotaRule(sensor, "other")
+	require.Empty(t, rule)
+}
+
+func TestLedgerActionOk(t *testing.T) {
+	l := &Ledger{
+		Users: Users{
+			"sensor": {
+				Password: "melon",
+				ACL:      Filters{"sensors/#": WriteOnly},
+				Retain:   ActionFilters{"sensors/#": false, "sensors/%c/config": true},
+				Will:     ActionFilters{"sensors/%c/status": true},
+			},
+		},
+		ACL: ACLRules{
+			{Listener: "public", Will: ActionFilters{"#": false}},
+			{Retain: ActionFilters{"sensors/#": false}},
+		},
+	}
+
+	sensor := &mqtt.Client{ID: "s1", Properties: mqtt.ClientProperties{Username: []byte("sensor")}}
+	_, ok := l.ActionOk(sensor, "sensors/s1/state", mqtt.ACLActionRetain)
+	require.False(t, ok)
+	_, ok = l.ActionOk(sensor, "sensors/s1/config", mqtt.ACLActionRetain) // deny takes precedence
+	require.False(t, ok)
+	_, ok = l.ActionOk(sensor, "other", mqtt.ACLActionRetain)
+	require.True(t, ok)
+	_, ok = l.ActionOk(sensor, "sensors/s1/status", mqtt.ACLActionWill)
+	require.True(t, ok)
+
+	sensor.Net.Listener = "public"
+	_, ok = l.ActionOk(sensor, "sensors/s1/status", mqtt.ACLActionWill) // the user filters are checked first
+	require.True(t, ok)
+	n, ok := l.ActionOk(sensor, "sensors/s2/status", mqtt.ACLActionWill)
+	require.Equal(t, 0, n)
+	require.False(t, ok)
+
+	anon := &mqtt.Client{ID: "a1"}
+	n, ok = l.ActionOk(anon, "sensors/a1/state", mqtt.ACLActionRetain)
+	require.Equal(t, 1, n)
+	require.False(t, ok)
+	_, ok = l.ActionOk(anon, "sensors/a1/state", mqtt.ACLActionWill)
+	require.True(t, ok)
+}
+
+func TestLedgerACLRule(t *testing.T) {
+	l := &Ledger{
+		Users: Users{
+			"mochi": {ACL: Filters{"mochi/#": ReadOnly}, Roles: []string{"device"}},
+		},
+		Roles: Roles{"device": {"devices/#": Deny}},
+		ACL: ACLRules{
+			{Username: "admin"},
+			{Filters: Filters{"a/#": ReadOnly}},
+		},
+	}
+
+	mochi := &mqtt.Client{ID: "cl1", Properties: mqtt.ClientProperties{Username: []byte("mochi")}}
+	require.Equal(t, "users[mochi].acl[mochi/#]", l.ACLRule(mochi, "mochi/a", true))
+	require.Equal(t, "roles[device][devices/#]", l.ACLRule(mochi, "devices/a", false))
+	require.Equal(t, "acl[1].filters[a/#]", l.ACLRule(mochi, "a/b", true))
+	require.Equal(t, "", l.ACLRule(mochi, "other", true))
+	require.Equal(t, "acl[0]", l.ACLRule(&mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte("admin")}}, "a/b", true))
+}
+
+func TestLedgerActionRule(t *testing.T) {
+	l := &Ledger{
+		Users: Users{
+			"mochi": {Retain: ActionFilters{"mochi/#": false}},
+		},
+		ACL: ACLRules{
+			{Will: ActionFilters{"#": false}},
+		},
+	}
+
+	mochi := &mqtt.Client{ID: "cl1", Properties: mqtt.ClientProperties{Username: []byte("mochi")}}
+	require.Equal(t, "users[mochi].retain[mochi/#]", l.ActionRule(mochi, "mochi/a", mqtt.ACLActionRetain))
+	require.Equal(t, "acl[0].will[#]", l.ActionRule(mochi, "mochi/a", mqtt.ACLActionWill))
+	require.Equal(t, "", l.ActionRule(mochi, "other", mqtt.ACLActionRetain))
+}
+
+func TestLedgerAnonymous(t *testing.T) {
+	l := &Ledger{
+		Auth: AuthRules{{Remote: "127.0.0.1", Allow: true}},
+		ACL:  ACLRules{{Remote: "127.0.0.1"}},
+		Anonymous: &AnonymousRule{
+			Listener: "public",
+			Filters: Filters{
+				"public/#":        ReadWrite,
+				"public/secret/#": Deny,
+				"news/#":          ReadOnly,
+				"public/%c/#":     ReadWrite,
+			},
+		},
+	}
+
+	anon := &mqtt.Client{ID: "cl1"}
+	anon.Net.Listener = "public"
+	anon.Net.Remote = "127.0.0.1"
+	_, ok := l.AuthOk(anon, packets.Packet{})
+	require.True(t, ok)
+
+	_, ok = l.ACLOk(anon, "public/a", true)
+	require.True(t, ok)
+	_, ok = l.ACLOk(anon, "news/a", false)
+	require.True(t, ok)
+	_, ok = l.ACLOk(anon, "news/a", true)
+	require.False(t, ok)
+	_, ok = l.ACLOk(anon, "public/secret/a", false) // deny takes precedence
+	require.False(t, ok)
+	_, ok = l.ACLOk(anon, "private/a", false) // the acl rules are not checked
+	require.False(t, ok)
+	require.Equal(t, "anonymous", l.ACLRule(anon, "private/a", false))
+	require.Equal(t, "anonymous.filters[news/#]", l.ACLRule(anon, "news/a", true))
+
+	// clients of other listeners and clients with usernames use the auth and acl rules
+	other := &mqtt.Client{ID: "cl2"}
+	other.Net.Listener = "internal"
+	_, ok = l.AuthOk(other, packets.Packet{})
+	require.False(t, ok)
+	other.Net.Remote = "127.0.0.1"
+	_, ok = l.ACLOk(other, "private/a", false)
+	require.True(t, ok)
+
+	named := &mqtt.Client{ID: "cl3", Properties: mqtt.ClientProperties{Username: []byte("mochi")}}
+	named.Net.Listener = "public"
+	_, ok = l.AuthOk(named, packets.Packet{})
+	require.False(t, ok)
+}
+
+func TestLedgerValidate(t *testing.T) {
+	l := &Ledger{ClientIDs: ClientIDRules{{Pattern: "dev-%u"}}}
+	require.NoError(t, l.Validate())
+
+	l.ClientIDs = append(l.ClientIDs, ClientIDRule{Pattern: "dev-[0-9"})
+	require.ErrorIs(t, l.Validate(), ErrInvalidClientIDPattern)
+
+	_, ok := l.ClientIDOk(&mqtt.Client{ID: "dev-1"})
+	require.False(t, ok)
+}
+
+func TestLedgerValidateCompilesPatterns(t *testing.T) {
+	ln := &Ledger{ClientIDs: ClientIDRules{{Pattern: "dev-[0-9]+"}, {Pattern: "%u-[0-9]+"}}}
+	require.NoError(t, ln.Validate())
+	require.Len(t, ln.patterns, 1)
+	require.Contains(t, ln.patterns, "dev-[0-9]+")
+
+	l := new(Ledger)
+	l.Replace(ln)
+	require.Equal(t, ln.patterns, l.patterns)
+
+	_, ok := l.ClientIDOk(&mqtt.Client{ID: "dev-1"})
+	require.True(t, ok)
+	_, ok = l.ClientIDOk(&mqtt.Client{ID: "dev-a"})
+	require.False(t, ok)
+}
+
+func TestLedgerUnmarshalInvalidPattern(t *testing.T) {
+	l := new(Ledger)
+	err := l.Unmarshal([]byte(`{"client_ids":[{"pattern":"dev-[0-9"}]}`))
+	require.ErrorIs(t, err, ErrInvalidClientIDPattern)
+
+	err = l.Unmarshal([]byte("client_ids:\n  - pattern: dev-[0-9]+\n"))
+	require.NoError(t, err)
+	require.Contains(t, l.patterns, "dev-[0-9]+")
+}
+
 func TestMatchTopic(t *testing.T) {
 	el, matched := MatchTopic("a/+/c/+", "a/b/c/d")
 	require.True(t, matched)
@@ -568,12 +894,124 @@ func TestLedgerUpdate(t *testing.T) {
 		},
 	}
 
+	n.Roles = Roles{"device": {"devices/#": ReadWrite}}
+	n.ClientIDs = ClientIDRules{{Pattern: "%u"}}
+	n.Anonymous = &AnonymousRule{Filters: Filters{"public/#": ReadWrite}}
+
 	old.Update(n)
 	require.Len(t, old.Auth, 2)
+	require.Equal(t, n.Roles, old.Roles)
+	require.Equal(t, n.ClientIDs, old.ClientIDs)
+	require.Equal(t, n.Anonymous, old.Anonymous)
 	require.Equal(t, RString("192.168.*"), old.Auth[1].Remote)
 	require.NotSame(t, n, old)
 }
 
+func TestLedgerReplace(t *testing.T) {
+	l := &Ledger{
+		Users: Users{"peach": {Password: "password1"}},
+		Auth:  AuthRules{{Remote: "127.0.0.1", Allow: true}},
+	}
+
+	n := &Ledger{
+		Users:     Users{"melon": {Password: "password2"}},
+		Roles:     Roles{"device": {"devices/#": ReadWrite}},
+		ACL:       ACLRules{{Filters: Filters{"#": Deny}}},
+		ClientIDs: ClientIDRules{{Pattern: "%u"}},
+		Anonymous: &AnonymousRule{Filters: Filters{"public/#": ReadWrite}},
+	}
+
+	l.Replace(n)
+	require.Equal(t, n.Users, l.Users)
+	require.Equal(t, n.Roles, l.Roles)
+	require.Empty(t, l.Auth)
+	require.Equal(t, n.ACL, l.ACL)
+	require.Equal(t, n.ClientIDs, l.ClientIDs)
+	require.Equal(t, n.Anonymous, l.Anonymous)
+}
+
+func TestLedgerAddUser(t *testing.T) {
+	l := new(Ledger)
+	err := l.AddUser(UserRule{Username: "mochi", Password: "melon"})
+	require.NoError(t, err)
+	require.Equal(t, RString("melon"), l.Users["mochi"].Password)
+
+	err = l.AddUser(UserRule{Username: "mochi", Password: "peach"})
+	require.NoError(t, err)
+	require.Len(t, l.Users, 1)
+	require.Equal(t, RString("peach"), l.Users["mochi"].Password)
+
+	_, ok := l.AuthOk(&mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte("mochi")}},
+		packets.Packet{Connect: packets.ConnectParams{Password: []byte("peach")}})
+	require.True(t, ok)
+}
+
+func TestLedgerAddUserEmpty(t *testing.T) {
+	l := new(Ledger)
+	err := l.AddUser(UserRule{Password: "melon"})
+	require.ErrorIs(t, err, ErrUsernameEmpty)
+	require.Empty(t, l.Users)
+}
+
+func TestLedgerRemoveUser(t *testing.T) {
+	l := &Ledger{Users: Users{"mochi": {Username: "mochi"}}}
+	require.NoError(t, l.RemoveUser("mochi"))
+	require.Empty(t, l.Users)
+	require.ErrorIs(t, l.RemoveUser("mochi"), ErrUserNotFound)
+}
+
+func TestLedgerSetACL(t *testing.T) {
+	l := &Ledger{Users: Users{"mochi": {Username: "mochi", Password: "melon"}}}
+	err := l.SetACL("mochi", Filters{"a/#": ReadOnly})
+	require.NoError(t, err)
+	require.Equal(t, Filters{"a/#": ReadOnly}, l.Users["mochi"].ACL)
+	require.Equal(t, RString("melon"), l.Users["mochi"].Password)
+
+	require.ErrorIs(t, l.SetACL("melon", Filters{}), ErrUserNotFound)
+}
+
+func TestLedgerUsernames(t *testing.T) {
+	l := new(Ledger)
+	require.Empty(t, l.Usernames())
+
+	l.SetUsers(Users{"zen": {}, "mochi": {}, "melon": {}})
+	require.Equal(t, []string{"melon", "mochi", "zen"}, l.Usernames())
+}
+
+func TestLedgerUsersJSON(t *testing.T) {
+	l := &Ledger{Users: Users{"mochi": {Username: "mochi", Password: "melon"}}}
+	data, err := l.UsersJSON()
+	require.NoError(t, err)
+	require.JSONEq(t, `{"mochi":{"username":"mochi","password":"melon"}}`, string(data))
+}
+
+func TestLedgerConcurrentUpdates(t *testing.T) {
+	l := new(Ledger)
+	cl := &mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte("mochi")}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_ = l.AddUser(UserRule{Username: "mochi", ACL: Filters{"a/#": ReadWrite}})
+				_ = l.SetACL("mochi", Filters{"b/#": ReadWrite})
+				_ = l.RemoveUser("mochi")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				l.ACLOk(cl, "a/b", true)
+				l.AuthOk(cl, packets.Packet{})
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
 func TestLedgerToJSON(t *testing.T) {
 	data, err := ledgerStruct.ToJSON()
 	require.NoError(t, err)
@@ -608,3 +1046,203 @@ func TestLedgerUnmarshalNil(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, new(Ledger), l)
 }
+
+func TestACLOkRoles(t *testing.T) {
+	l := &Ledger{
+		Roles: Roles{
+			"device": {
+				"devices/%c/#":   ReadWrite,
+				"firmware/#":     ReadOnly,
+				"firmware/beta":  Deny,
+				"telemetry/%c/#": WriteOnly,
+			},
+			"monitor": {
+				"devices/#": ReadOnly,
+			},
+		},
+		Users: Users{
+			"dev1":  {Roles: []string{"device"}},
+			"dev2":  {Roles: []string{"device", "monitor", "missing"}},
+			"dev3":  {Roles: []string{"device"}, ACL: Filters{"firmware/beta": ReadOnly}},
+			"other": {},
+		},
+		ACL: ACLRules{
+			{Filters: Filters{"#": Deny}},
+		},
+	}
+
+	client := func(id, username string) *mqtt.Client {
+		return &mqtt.Client{ID: id, Properties: mqtt.ClientProperties{Username: []byte(username)}}
+	}
+
+	tt := []struct {
+		desc   string
+		client *mqtt.Client
+		topic  string
+		write  bool
+		ok     bool
+	}{
+		{desc: "own device topic", client: client("d1", "dev1"), topic: "devices/d1/state", write: true, ok: true},
+		{desc: "other device topic", client: client("d1", "dev1"), topic: "devices/d2/state", write: false, ok: false},
+		{desc: "read only filter", client: client("d1", "dev1"), topic: "firmware/v1", write: false, ok: true},
+		{desc: "read only filter write", client: client("d1", "dev1"), topic: "firmware/v1", write: true, ok: false},
+		{desc: "deny filter", client: client("d1", "dev1"), topic: "firmware/beta", write: false, ok: false},
+		{desc: "write only filter", client: client("d1", "dev1"), topic: "telemetry/d1/temp", write: true, ok: true},
+		{desc: "no role filter matches", client: client("d1", "dev1"), topic: "other", write: false, ok: false},
+		{desc: "second role", client: client("d2", "dev2"), topic: "devices/d1/state", write: false, ok: true},
+		{desc: "second role write", client: client("d2", "dev2"), topic: "devices/d1/state", write: true, ok: false},
+		{desc: "user filter precedence", client: client("d3", "dev3"), topic: "firmware/beta", write: false, ok: true},
+		{desc: "no roles", client: client("o1", "other"), topic: "devices/o1/state", write: true, ok: false},
+	}
+
+	for _, d := range tt {
+		t.Run(d.desc, func(t *testing.T) {
+			_, ok := l.ACLOk(d.client, d.topic, d.write)
+			require.Equal(t, d.ok, ok)
+		})
+	}
+}
+
+func TestLedgerUnmarshalRoles(t *testing.T) {
+	l := new(Ledger)
+	err := l.Unmarshal([]byte(`
+roles:
+  device:
+    devices/%c/#: 3
+users:
+  dev1:
+    password: melon
+    roles: [device]
+`))
+	require.NoError(t, err)
+	require.Equal(t, Filters{"devices/%c/#": ReadWrite}, l.Roles["device"])
+	require.Equal(t, []string{"device"}, l.Users["dev1"].Roles)
+}
+
+func TestLedgerUnmarshalClientIDs(t *testing.T) {
+	l := new(Ledger)
+	err := l.Unmarshal([]byte(`
+client_ids:
+  - username: device
+    pattern: dev-[0-9a-f]{12}
+  - listener: public
+    pattern: "%u"
+`))
+	require.NoError(t, err)
+	require.Equal(t, ClientIDRules{
+		{Username: "device", Pattern: "dev-[0-9a-f]{12}"},
+		{Listener: "public", Pattern: "%u"},
+	}, l.ClientIDs)
+}
+
+func TestLedgerUnmarshalActions(t *testing.T) {
+	l := new(Ledger)
+	err := l.Unmarshal([]byte(`
+users:
+  sensor:
+    password: melon
+    retain:
+      sensors/#: false
+acl:
+  - will:
+      devices/+/status: true
+`))
+	require.NoError(t, err)
+	require.Equal(t, ActionFilters{"sensors/#": false}, l.Users["sensor"].Retain)
+	require.Equal(t, ActionFilters{"devices/+/status": true}, l.ACL[0].Will)
+}
+
+func TestLedgerUnmarshalQuotas(t *testing.T) {
+	l := new(Ledger)
+	err := l.Unmarshal([]byte(`
+users:
+  sensor:
+    password: melon
+    quotas:
+      sensors/#:
+        messages: 0.5
+acl:
+  - listener: public
+    quotas:
+      "#":
+        bytes: 60000
+        throttle: true
+`))
+	require.NoError(t, err)
+	require.Equal(t, QuotaFilters{"sensors/#": {Messages: 0.5}}, l.Users["sensor"].Quotas)
+	require.Equal(t, QuotaFilters{"#": {Bytes: 60000, Throttle: true}}, l.ACL[0].Quotas)
+}
+
+func TestLedgerUnmarshalAnonymous(t *testing.T) {
+	l := new(Ledger)
+	err := l.Unmarshal([]byte(`
+anonymous:
+  listener: public
+  filters:
+    public/#: 3
+`))
+	require.NoError(t, err)
+	require.Equal(t, &AnonymousRule{Listener: "public", Filters: Filters{"public/#": ReadWrite}}, l.Anonymous)
+}
+
+func TestLedgerSuperuserOk(t *testing.T) {
+	l := &Ledger{
+		Users: Users{
+			"admin":    {Password: "secret", Superuser: true},
+			"disabled": {Password: "secret", Superuser: true, Disallow: true},
+			"mochi":    {Password: "melon"},
+		},
+	}
+
+	client := func(username string) *mqtt.Client {
+		return &mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte(username)}}
+	}
+	pk := func(password string) packets.Packet {
+		return packets.Packet{Connect: packets.ConnectParams{Password: []byte(password)}}
+	}
+
+	require.True(t, l.SuperuserOk(client("admin"), pk("secret")))
+	require.False(t, l.SuperuserOk(client("admin"), pk("wrong")))
+	require.False(t, l.SuperuserOk(client("disabled"), pk("secret")))
+	require.False(t, l.SuperuserOk(client("mochi"), pk("melon")))
+	require.False(t, l.SuperuserOk(client("unknown"), pk("secret")))
+}
+
+func TestAuthOkHashedPasswords(t *testing.T) {
+	bhash, err := HashPassword(HashBcrypt, "melon")
+	require.NoError(t, err)
+	ahash, err := HashPassword(HashArgon2id, "lemon")
+	require.NoError(t, err)
+
+	l := &Ledger{
+		Users: Users{
+			"mochi-co": {Password: RString(bhash)},
+		},
+		Auth: AuthRules{
+			{Username: "mochi", Password: RString(ahash), Allow: true},
+		},
+	}
+
+	tt := []struct {
+		desc     string
+		username string
+		password string
+		ok       bool
+	}{
+		{desc: "users map hash", username: "mochi-co", password: "melon", ok: true},
+		{desc: "users map wrong password", username: "mochi-co", password: "lemon", ok: false},
+		{desc: "users map hash as password", username: "mochi-co", password: bhash, ok: false},
+		{desc: "auth rule hash", username: "mochi", password: "lemon", ok: true},
+		{desc: "auth rule wrong password", username: "mochi", password: "melon", ok: false},
+		{desc: "auth rule hash as password", username: "mochi", password: ahash, ok: false},
+	}
+
+	for _, d := range tt {
+		t.Run(d.desc, func(t *testing.T) {
+			cl := &mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte(d.username)}}
+			pk := packets.Packet{Connect: packets.ConnectParams{Password: []byte(d.password)}}
+			_, ok := l.AuthOk(cl, pk)
+			require.Equal(t, d.ok, ok)
+		})
+	}
+}
@@ -0,0 +1,491 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/pbkdf2"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+)
+
+const (
+	// defaultReloadInterval is the default number of seconds between checks for changed files.
+	defaultReloadInterval = 5
+)
+
+var (
+	// ErrInvalidPasswordFile indicates a line of a mosquitto password file could not be parsed.
+	ErrInvalidPasswordFile = errors.New("invalid mosquitto password file")
+
+	// ErrInvalidACLFile indicates a line of a mosquitto acl file could not be parsed.
+	ErrInvalidACLFile = errors.New("invalid mosquitto acl file")
+)
+
+// MosquittoOptions contains the configuration of the mosquitto auth hook.
+type MosquittoOptions struct {
+	// PasswordFile is the path of a mosquitto password file, as created by mosquitto_passwd.
+	// If empty, every client with a username is allowed to connect.
+	PasswordFile string `yaml:"password_file" json:"password_file"`
+
+	// ACLFile is the path of a mosquitto acl file. If empty, every client is allowed to
+	// publish and subscribe to any topic.
+	ACLFile string `yaml:"acl_file" json:"acl_file"`
+
+	// AllowAnonymous allows clients without a username to connect.
+	AllowAnonymous bool `yaml:"allow_anonymous" json:"allow_anonymous"`
+
+	// ReloadInterval is the seconds between checks for changes to the files, which are
+	// reloaded when they change (default 5). Files are not reloaded if negative.
+	ReloadInterval int64 `yaml:"reload_interval" json:"reload_interval"`
+}
+
+// mosquittoPassword is a hashed password from a mosquitto password file.
+type mosquittoPassword struct {
+	iterations int    // the pbkdf2 iterations, or 0 if the password is hashed with salted sha512
+	salt       []byte // the salt of the hash
+	hash       []byte // the hashed password
+}
+
+// matches returns true if the password hashes to the stored hash.
+func (p mosquittoPassword) matches(password []byte) bool {
+	var hash []byte
+	if p.iterations > 0 {
+		var err error
+		hash, err = pbkdf2.Key(sha512.New, string(password), p.salt, p.iterations, len(p.hash))
+		if err != nil {
+			return false
+		}
+	} else {
+		sum := sha512.Sum512(append(append([]byte{}, password...), p.salt...))
+		hash = sum[:]
+	}
+
+	return subtle.ConstantTimeCompare(hash, p.hash) == 1
+}
+
+// mosquittoACL is a topic or pattern rule from a mosquitto acl file.
+type mosquittoACL struct {
+	filter  string // the topic filter, which may contain %c and %u if it is a pattern
+	access  Access // the access granted or denied by the rule
+	pattern bool   // the filter is a pattern, which is expanded for each client
+}
+
+// mosquittoACLs are the rules read from a mosquitto acl file.
+type mosquittoACLs struct {
+	anonymous []mosquittoACL            // topic rules for clients without a username
+	users     map[string][]mosquittoACL // topic rules keyed on username
+	patterns  []mosquittoACL            // pattern rules which apply to every client
+}
+
+// fileState is the modification time and size of a file, used to detect changes.
+type fileState struct {
+	mod  time.Time
+	size int64
+}
+
+// MosquittoHook is an authentication hook which checks clients against mosquitto password
+// and acl files, reloading them when they change.
+type MosquittoHook struct {
+	mqtt.HookBase
+	config    *MosquittoOptions
+	mu        sync.RWMutex                 // guards passwords, acls and states
+	passwords map[string]mosquittoPassword // hashed passwords keyed on username
+	acls      *mosquittoACLs               // the acl rules, or nil if there is no acl file
+	states    [2]fileState                 // the states of the password and acl files when loaded
+	done      chan struct{}                // closed to stop the reload loop
+	stopped   chan struct{}                // closed when the reload loop has stopped
+}
+
+// ID returns the ID of the hook.
+func (h *MosquittoHook) ID() string {
+	return "auth-mosquitto"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *MosquittoHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnACLCheck,
+	}, []byte{b})
+}
+
+// Init loads the password and acl files, and starts checking them for changes.
+func (h *MosquittoHook) Init(config any) error {
+	if _, ok := config.(*MosquittoOptions); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(MosquittoOptions)
+	}
+
+	h.config = config.(*MosquittoOptions)
+	if h.config.ReloadInterval == 0 {
+		h.config.ReloadInterval = defaultReloadInterval
+	}
+
+	if err := h.Reload(); err != nil {
+		return err
+	}
+
+	if h.config.ReloadInterval > 0 && (h.config.PasswordFile != "" || h.config.ACLFile != "") {
+		h.done = make(chan struct{})
+		h.stopped = make(chan struct{})
+		go h.reloadLoop(time.Duration(h.config.ReloadInterval) * time.Second)
+	}
+
+	return nil
+}
+
+// Stop stops checking the files for changes.
+func (h *MosquittoHook) Stop() error {
+	if h.done != nil {
+		close(h.done)
+		<-h.stopped
+		h.done = nil
+	}
+
+	return nil
+}
+
+// reloadLoop reloads the files every interval if they have changed, until the hook is stopped.
+func (h *MosquittoHook) reloadLoop(interval time.Duration) {
+	defer close(h.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !h.changed() {
+				continue
+			}
+
+			if err := h.Reload(); err != nil {
+				h.Log.Error("failed to reload mosquitto auth files", "error", err)
+			}
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// changed returns true if the password or acl file has changed since it was loaded.
+func (h *MosquittoHook) changed() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for i, path := range []string{h.config.PasswordFile, h.config.ACLFile} {
+		if path != "" && statFile(path) != h.states[i] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// statFile returns the state of a file, or the zero state if it cannot be read.
+func statFile(path string) fileState {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileState{}
+	}
+
+	return fileState{mod: info.ModTime(), size: info.Size()}
+}
+
+// Reload reads the password and acl files. If either file cannot be read, the previously
+// loaded files are kept and an error is returned, and the files are not reloaded again
+// until they change.
+func (h *MosquittoHook) Reload() error {
+	states := [2]fileState{statFile(h.config.PasswordFile), statFile(h.config.ACLFile)}
+	passwords, acls, err := h.load()
+
+	h.mu.Lock()
+	h.states = states
+	if err == nil {
+		h.passwords = passwords
+		h.acls = acls
+	}
+	h.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	users := 0
+	if acls != nil {
+		users = len(acls.users)
+	}
+
+	h.Log.Info("loaded mosquitto auth files",
+		"passwords", len(passwords),
+		"acl_users", users)
+
+	return nil
+}
+
+// load reads and parses the password and acl files, if they are set.
+func (h *MosquittoHook) load() (passwords map[string]mosquittoPassword, acls *mosquittoACLs, err error) {
+	if h.config.PasswordFile != "" {
+		f, err := os.Open(h.config.PasswordFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+
+		passwords, err = parsePasswordFile(f)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if h.config.ACLFile != "" {
+		f, err := os.Open(h.config.ACLFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+
+		acls, err = parseACLFile(f)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return passwords, acls, nil
+}
+
+// parsePasswordFile reads the username and hashed password on each line of a mosquitto
+// password file. Passwords hashed with salted sha512 ($6$) and pbkdf2-sha512 ($7$) are supported.
+func parsePasswordFile(r io.Reader) (map[string]mosquittoPassword, error) {
+	passwords := make(map[string]mosquittoPassword)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("%w: line %d", ErrInvalidPasswordFile, n)
+		}
+
+		p, err := parsePasswordHash(hash)
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %w", ErrInvalidPasswordFile, n, err)
+		}
+
+		passwords[username] = p
+	}
+
+	return passwords, scanner.Err()
+}
+
+// parsePasswordHash parses a hashed password in the $6$salt$hash or $7$iterations$salt$hash
+// formats written by mosquitto_passwd.
+func parsePasswordHash(s string) (p mosquittoPassword, err error) {
+	parts := strings.Split(s, "$")
+	switch {
+	case len(parts) == 4 && parts[0] == "" && parts[1] == "6":
+		parts = parts[2:]
+	case len(parts) == 5 && parts[0] == "" && parts[1] == "7":
+		p.iterations, err = strconv.Atoi(parts[2])
+		if err != nil || p.iterations <= 0 {
+			return p, fmt.Errorf("bad iterations %q", parts[2])
+		}
+		parts = parts[3:]
+	default:
+		return p, errors.New("unsupported password hash")
+	}
+
+	if p.salt, err = base64.StdEncoding.DecodeString(parts[0]); err != nil {
+		return p, err
+	}
+
+	if p.hash, err = base64.StdEncoding.DecodeString(parts[1]); err != nil {
+		return p, err
+	}
+
+	if len(p.hash) == 0 {
+		return p, errors.New("empty password hash")
+	}
+
+	return p, nil
+}
+
+// parseACLFile reads the rules of a mosquitto acl file. Topic rules before the first user
+// line apply to clients without a username, and pattern rules apply to every client.
+func parseACLFile(r io.Reader) (*mosquittoACLs, error) {
+	acls := &mosquittoACLs{users: make(map[string][]mosquittoACL)}
+	user := "" // the username of the current user line, or empty before the first
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		keyword, rest, _ := strings.Cut(line, " ")
+		rest = strings.TrimSpace(rest)
+		switch keyword {
+		case "user":
+			if rest == "" {
+				return nil, fmt.Errorf("%w: line %d: missing username", ErrInvalidACLFile, n)
+			}
+			user = rest
+			if _, ok := acls.users[user]; !ok {
+				acls.users[user] = nil
+			}
+		case "topic", "pattern":
+			rule, err := parseACLRule(rest)
+			if err != nil {
+				return nil, fmt.Errorf("%w: line %d: %w", ErrInvalidACLFile, n, err)
+			}
+
+			switch {
+			case keyword == "pattern":
+				rule.pattern = true
+				acls.patterns = append(acls.patterns, rule)
+			case user == "":
+				acls.anonymous = append(acls.anonymous, rule)
+			default:
+				acls.users[user] = append(acls.users[user], rule)
+			}
+		default:
+			return nil, fmt.Errorf("%w: line %d: unknown keyword %q", ErrInvalidACLFile, n, keyword)
+		}
+	}
+
+	return acls, scanner.Err()
+}
+
+// parseACLRule parses the optional access and the topic filter of a topic or pattern line.
+// Rules without an access grant read and write access.
+func parseACLRule(s string) (mosquittoACL, error) {
+	rule := mosquittoACL{access: ReadWrite, filter: s}
+	access, filter, ok := strings.Cut(s, " ")
+	if ok {
+		switch access {
+		case "read":
+			rule.access = ReadOnly
+		case "write":
+			rule.access = WriteOnly
+		case "readwrite":
+			rule.access = ReadWrite
+		case "deny":
+			rule.access = Deny
+		default:
+			ok = false
+		}
+	}
+
+	if ok {
+		rule.filter = strings.TrimSpace(filter)
+	}
+
+	if rule.filter == "" {
+		return rule, errors.New("missing topic")
+	}
+
+	return rule, nil
+}
+
+// OnConnectAuthenticate returns true if the client's password matches the password file.
+// Clients without a username are only allowed if anonymous clients are allowed.
+func (h *MosquittoHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	if len(pk.Connect.Username) == 0 {
+		return h.config.AllowAnonymous
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.passwords == nil {
+		return true
+	}
+
+	if p, ok := h.passwords[string(pk.Connect.Username)]; ok && p.matches(pk.Connect.Password) {
+		return true
+	}
+
+	h.Log.Info("client failed authentication check",
+		"username", string(pk.Connect.Username),
+		"remote", cl.Net.Remote)
+	return false
+}
+
+// OnACLCheck returns true if the acl file grants the client read or write access to a topic,
+// based on the write bool. Any matching deny rule takes precedence over rules granting access.
+func (h *MosquittoHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.acls == nil {
+		return true
+	}
+
+	username := string(cl.Properties.Username)
+	rules := h.acls.anonymous
+	if username != "" {
+		rules = h.acls.users[username]
+	}
+
+	allowed := false
+	for _, group := range [][]mosquittoACL{rules, h.acls.patterns} {
+		for _, rule := range group {
+			filter := rule.filter
+			if rule.pattern {
+				var ok bool
+				if filter, ok = expandPattern(filter, cl.ID, username); !ok {
+					continue
+				}
+			}
+
+			if _, ok := MatchTopic(filter, topic); !ok {
+				continue
+			}
+
+			switch {
+			case rule.access == Deny:
+				h.Log.Debug("client denied by acl rule",
+					"client", cl.ID,
+					"username", username,
+					"topic", topic)
+				return false
+			case rule.access == ReadWrite,
+				write && rule.access == WriteOnly,
+				!write && rule.access == ReadOnly:
+				allowed = true
+			}
+		}
+	}
+
+	if !allowed {
+		h.Log.Debug("client failed allowed ACL check",
+			"client", cl.ID,
+			"username", username,
+			"topic", topic)
+	}
+
+	return allowed
+}
@@ -0,0 +1,283 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha512"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/stretchr/testify/require"
+)
+
+const testACLFile = `# anonymous clients
+topic read public/#
+
+user mochi
+topic readwrite mochi/#
+topic deny mochi/secret
+topic read updates/+
+
+user melon
+topic melon/#
+
+pattern write clients/%c/status
+pattern read users/%u/#
+`
+
+// hashSHA512 returns a password hashed in the mosquitto $6$ format.
+func hashSHA512(password string) string {
+	salt := []byte("saltsaltsalt")
+	sum := sha512.Sum512(append([]byte(password), salt...))
+	return "$6$" + base64.StdEncoding.EncodeToString(salt) + "$" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// hashPBKDF2 returns a password hashed in the mosquitto $7$ format.
+func hashPBKDF2(password string) string {
+	salt := []byte("pepperpepper")
+	hash, _ := pbkdf2.Key(sha512.New, password, salt, 101, 64)
+	return "$7$101$" + base64.StdEncoding.EncodeToString(salt) + "$" + base64.StdEncoding.EncodeToString(hash)
+}
+
+func writeMosquittoFiles(t *testing.T) (passwd, acl string) {
+	dir := t.TempDir()
+	passwd = filepath.Join(dir, "passwd")
+	acl = filepath.Join(dir, "acl")
+
+	data := "# users\nmochi:" + hashPBKDF2("melon") + "\nmelon:" + hashSHA512("peach") + "\n"
+	require.NoError(t, os.WriteFile(passwd, []byte(data), 0600))
+	require.NoError(t, os.WriteFile(acl, []byte(testACLFile), 0600))
+	return passwd, acl
+}
+
+func newMosquittoHook(t *testing.T, opts *MosquittoOptions) *MosquittoHook {
+	h := new(MosquittoHook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(opts))
+	t.Cleanup(func() { _ = h.Stop() })
+	return h
+}
+
+func TestMosquittoID(t *testing.T) {
+	h := new(MosquittoHook)
+	require.Equal(t, "auth-mosquitto", h.ID())
+}
+
+func TestMosquittoProvides(t *testing.T) {
+	h := new(MosquittoHook)
+	require.True(t, h.Provides(mqtt.OnACLCheck))
+	require.True(t, h.Provides(mqtt.OnConnectAuthenticate))
+	require.False(t, h.Provides(mqtt.OnPublish))
+}
+
+func TestMosquittoInitBadConfig(t *testing.T) {
+	h := new(MosquittoHook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(map[string]any{})
+	require.ErrorIs(t, err, mqtt.ErrInvalidConfigType)
+}
+
+func TestMosquittoInitDefaults(t *testing.T) {
+	h := newMosquittoHook(t, new(MosquittoOptions))
+	require.Equal(t, int64(defaultReloadInterval), h.config.ReloadInterval)
+	require.Nil(t, h.done)
+
+	require.True(t, h.OnConnectAuthenticate(newClient("cl1", "mochi"), connectPacket("mochi", "any")))
+	require.False(t, h.OnConnectAuthenticate(newClient("cl1", ""), connectPacket("", "")))
+	require.True(t, h.OnACLCheck(newClient("cl1", "mochi"), "a/b/c", true))
+}
+
+func TestMosquittoInitMissingFile(t *testing.T) {
+	h := new(MosquittoHook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(&MosquittoOptions{PasswordFile: filepath.Join(t.TempDir(), "passwd")})
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestMosquittoOnConnectAuthenticate(t *testing.T) {
+	passwd, _ := writeMosquittoFiles(t)
+	h := newMosquittoHook(t, &MosquittoOptions{PasswordFile: passwd})
+
+	require.True(t, h.OnConnectAuthenticate(new(mqtt.Client), connectPacket("mochi", "melon")))
+	require.True(t, h.OnConnectAuthenticate(new(mqtt.Client), connectPacket("melon", "peach")))
+	require.False(t, h.OnConnectAuthenticate(new(mqtt.Client), connectPacket("mochi", "peach")))
+	require.False(t, h.OnConnectAuthenticate(new(mqtt.Client), connectPacket("melon", "")))
+	require.False(t, h.OnConnectAuthenticate(new(mqtt.Client), connectPacket("peach", "melon")))
+	require.False(t, h.OnConnectAuthenticate(new(mqtt.Client), connectPacket("", "")))
+}
+
+func TestMosquittoOnConnectAuthenticateAnonymous(t *testing.T) {
+	passwd, _ := writeMosquittoFiles(t)
+	h := newMosquittoHook(t, &MosquittoOptions{PasswordFile: passwd, AllowAnonymous: true})
+
+	require.True(t, h.OnConnectAuthenticate(new(mqtt.Client), connectPacket("", "")))
+	require.False(t, h.OnConnectAuthenticate(new(mqtt.Client), connectPacket("mochi", "peach")))
+}
+
+func TestMosquittoOnACLCheck(t *testing.T) {
+	_, acl := writeMosquittoFiles(t)
+	h := newMosquittoHook(t, &MosquittoOptions{ACLFile: acl})
+
+	tt := []struct {
+		desc     string
+		client   *mqtt.Client
+		topic    string
+		write    bool
+		expected bool
+	}{
+		{"anonymous read", newClient("cl1", ""), "public/news", false, true},
+		{"anonymous write", newClient("cl1", ""), "public/news", true, false},
+		{"anonymous other", newClient("cl1", ""), "mochi/a", false, false},
+		{"user readwrite", newClient("cl1", "mochi"), "mochi/a/b", true, true},
+		{"user read", newClient("cl1", "mochi"), "updates/a", false, true},
+		{"user read only", newClient("cl1", "mochi"), "updates/a", true, false},
+		{"user deny", newClient("cl1", "mochi"), "mochi/secret", false, false},
+		{"user not anonymous", newClient("cl1", "mochi"), "public/news", false, false},
+		{"user default access", newClient("cl1", "melon"), "melon/a", true, true},
+		{"other user", newClient("cl1", "melon"), "mochi/a", false, false},
+		{"unknown user", newClient("cl1", "peach"), "mochi/a", false, false},
+		{"client pattern", newClient("cl1", "peach"), "clients/cl1/status", true, true},
+		{"client pattern other", newClient("cl1", "peach"), "clients/cl2/status", true, false},
+		{"client pattern read", newClient("cl1", "peach"), "clients/cl1/status", false, false},
+		{"user pattern", newClient("cl1", "peach"), "users/peach/inbox", false, true},
+		{"user pattern anonymous", newClient("cl1", ""), "users//inbox", false, false},
+		{"user pattern wildcard", newClient("cl1", "+"), "users/+/inbox", false, false},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			require.Equal(t, tx.expected, h.OnACLCheck(tx.client, tx.topic, tx.write))
+		})
+	}
+}
+
+func TestMosquittoReload(t *testing.T) {
+	passwd, acl := writeMosquittoFiles(t)
+	h := newMosquittoHook(t, &MosquittoOptions{PasswordFile: passwd, ACLFile: acl, ReloadInterval: -1})
+	require.Nil(t, h.done)
+	require.False(t, h.changed())
+
+	data := "peach:" + hashPBKDF2("plum") + "\n"
+	require.NoError(t, os.WriteFile(passwd, []byte(data), 0600))
+	require.True(t, h.changed())
+	require.NoError(t, h.Reload())
+	require.False(t, h.changed())
+
+	require.True(t, h.OnConnectAuthenticate(new(mqtt.Client), connectPacket("peach", "plum")))
+	require.False(t, h.OnConnectAuthenticate(new(mqtt.Client), connectPacket("mochi", "melon")))
+}
+
+func TestMosquittoReloadInvalidKeepsRules(t *testing.T) {
+	passwd, acl := writeMosquittoFiles(t)
+	h := newMosquittoHook(t, &MosquittoOptions{PasswordFile: passwd, ACLFile: acl, ReloadInterval: -1})
+
+	require.NoError(t, os.WriteFile(acl, []byte("topic\n"), 0600))
+	require.ErrorIs(t, h.Reload(), ErrInvalidACLFile)
+	require.False(t, h.changed())
+
+	require.True(t, h.OnConnectAuthenticate(new(mqtt.Client), connectPacket("mochi", "melon")))
+	require.True(t, h.OnACLCheck(newClient("cl1", "mochi"), "mochi/a", true))
+}
+
+func TestMosquittoReloadLoop(t *testing.T) {
+	passwd, _ := writeMosquittoFiles(t)
+	h := new(MosquittoHook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&MosquittoOptions{PasswordFile: passwd}))
+	require.NotNil(t, h.done)
+	require.NoError(t, h.Stop())
+	require.NoError(t, h.Stop())
+}
+
+func TestMosquittoReloadLoopChanges(t *testing.T) {
+	passwd, _ := writeMosquittoFiles(t)
+	h := newMosquittoHook(t, &MosquittoOptions{PasswordFile: passwd, ReloadInterval: -1})
+
+	h.done = make(chan struct{})
+	h.stopped = make(chan struct{})
+	go h.reloadLoop(5 * time.Millisecond)
+
+	data := "peach:" + hashSHA512("plum") + "\n# changed\n"
+	require.NoError(t, os.WriteFile(passwd, []byte(data), 0600))
+	require.Eventually(t, func() bool {
+		return h.OnConnectAuthenticate(new(mqtt.Client), connectPacket("peach", "plum"))
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestParsePasswordFile(t *testing.T) {
+	tt := []struct {
+		desc string
+		data string
+		ok   bool
+	}{
+		{"empty", "", true},
+		{"comments", "# comment\n\n", true},
+		{"sha512", "mochi:" + hashSHA512("melon"), true},
+		{"pbkdf2", "mochi:" + hashPBKDF2("melon"), true},
+		{"no separator", "mochi", false},
+		{"no username", ":" + hashSHA512("melon"), false},
+		{"plain text", "mochi:melon", false},
+		{"unknown hash", "mochi:$5$c2FsdA==$aGFzaA==", false},
+		{"bad iterations", "mochi:$7$x$c2FsdA==$aGFzaA==", false},
+		{"bad salt", "mochi:$6$!!$aGFzaA==", false},
+		{"bad hash", "mochi:$6$c2FsdA==$!!", false},
+		{"empty hash", "mochi:$6$c2FsdA==$", false},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			_, err := parsePasswordFile(strings.NewReader(tx.data))
+			if tx.ok {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, ErrInvalidPasswordFile)
+			}
+		})
+	}
+}
+
+func TestParseACLFile(t *testing.T) {
+	acls, err := parseACLFile(strings.NewReader(testACLFile))
+	require.NoError(t, err)
+	require.Equal(t, []mosquittoACL{{filter: "public/#", access: ReadOnly}}, acls.anonymous)
+	require.Equal(t, []mosquittoACL{
+		{filter: "mochi/#", access: ReadWrite},
+		{filter: "mochi/secret", access: Deny},
+		{filter: "updates/+", access: ReadOnly},
+	}, acls.users["mochi"])
+	require.Equal(t, []mosquittoACL{{filter: "melon/#", access: ReadWrite}}, acls.users["melon"])
+	require.Equal(t, []mosquittoACL{
+		{filter: "clients/%c/status", access: WriteOnly, pattern: true},
+		{filter: "users/%u/#", access: ReadOnly, pattern: true},
+	}, acls.patterns)
+}
+
+func TestParseACLFileInvalid(t *testing.T) {
+	for _, data := range []string{
+		"user\n",
+		"topic\n",
+		"owner mochi\n",
+	} {
+		_, err := parseACLFile(strings.NewReader(data))
+		require.ErrorIs(t, err, ErrInvalidACLFile, data)
+	}
+}
+
+func TestParseACLFileTopicOnly(t *testing.T) {
+	acls, err := parseACLFile(strings.NewReader("topic read\ntopic a topic/with space\n"))
+	require.NoError(t, err)
+	require.Equal(t, []mosquittoACL{
+		{filter: "read", access: ReadWrite},
+		{filter: "a topic/with space", access: ReadWrite},
+	}, acls.anonymous)
+}
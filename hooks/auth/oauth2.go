@@ -0,0 +1,504 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // register the hashes used by jwt signatures
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+)
+
+var (
+	// ErrNoTokenValidator indicates neither an introspection endpoint nor a jwt key was configured.
+	ErrNoTokenValidator = errors.New("no oauth2 introspection url or jwt key")
+
+	// ErrInvalidJWTKey indicates the jwt key file does not contain an rsa or ecdsa public key.
+	ErrInvalidJWTKey = errors.New("invalid jwt key file")
+
+	// ErrInvalidToken indicates an access token could not be parsed or its claims are not valid.
+	ErrInvalidToken = errors.New("invalid access token")
+
+	// ErrInvalidSignature indicates the signature of a jwt access token could not be verified.
+	ErrInvalidSignature = errors.New("invalid access token signature")
+
+	// ErrUnsupportedAlg indicates a jwt access token is signed with an algorithm which is not
+	// supported, or which does not match the configured key.
+	ErrUnsupportedAlg = errors.New("unsupported access token algorithm")
+
+	// ErrTokenInactive indicates an access token is not active, such as if it was revoked.
+	ErrTokenInactive = errors.New("access token is not active")
+
+	// ErrTokenExpired indicates an access token has expired.
+	ErrTokenExpired = errors.New("access token has expired")
+)
+
+// OAuth2Options contains the configuration of the OAuth2 auth hook.
+type OAuth2Options struct {
+	// IntrospectionURL is the RFC 7662 endpoint which opaque access tokens are validated by.
+	IntrospectionURL string `yaml:"introspection_url" json:"introspection_url"`
+
+	// ClientID and ClientSecret are the credentials the broker authenticates to the
+	// introspection endpoint with, if set.
+	ClientID     string `yaml:"client_id" json:"client_id"`
+	ClientSecret string `yaml:"client_secret" json:"client_secret"`
+
+	// JWTSecret is the shared secret used to validate HS256, HS384 and HS512 jwt access
+	// tokens locally, without calling the introspection endpoint.
+	JWTSecret string `yaml:"jwt_secret" json:"jwt_secret"`
+
+	// JWTKeyFile is the path of a PEM encoded rsa or ecdsa public key or certificate used to
+	// validate RS256, RS384, RS512, ES256, ES384 and ES512 jwt access tokens locally.
+	JWTKeyFile string `yaml:"jwt_key_file" json:"jwt_key_file"`
+
+	// Issuer and Audience are checked against the iss and aud claims of the token, if set.
+	Issuer   string `yaml:"issuer" json:"issuer"`
+	Audience string `yaml:"audience" json:"audience"`
+
+	// MatchUsername requires the connect username to equal the username or sub claim of the token.
+	MatchUsername bool `yaml:"match_username" json:"match_username"`
+
+	// Scopes maps the scopes of a token to the topic filters the client may access. Filters
+	// may contain %c and %u placeholders. A client with any scope may access any topic if
+	// no scopes are configured.
+	Scopes map[string]Filters `yaml:"scopes" json:"scopes"`
+
+	// Timeout is the milliseconds to wait for the introspection endpoint (default 5000).
+	Timeout int64 `yaml:"timeout" json:"timeout"`
+
+	// Client is the http client used to call the introspection endpoint, if set.
+	Client *http.Client `yaml:"-" json:"-"`
+}
+
+// audience is a claim which may be either a string or an array of strings.
+type audience []string
+
+// UnmarshalJSON decodes a string or an array of strings.
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = strings.Fields(s)
+		return nil
+	}
+
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// tokenClaims are the claims of a jwt access token or an introspection response.
+type tokenClaims struct {
+	Active   bool     `json:"active"`
+	Scope    string   `json:"scope"` // space separated scopes
+	Scp      audience `json:"scp"`   // scopes as issued by some providers
+	Exp      float64  `json:"exp"`
+	Nbf      float64  `json:"nbf"`
+	Iss      string   `json:"iss"`
+	Aud      audience `json:"aud"`
+	Sub      string   `json:"sub"`
+	Username string   `json:"username"`
+}
+
+// scopes returns the scopes granted by the token.
+func (c *tokenClaims) scopes() []string {
+	return append(strings.Fields(c.Scope), c.Scp...)
+}
+
+// oauth2Session is the validated token of a connected client.
+type oauth2Session struct {
+	client  *mqtt.Client // the client the token belongs to
+	scopes  []string     // the scopes granted by the token
+	expires time.Time    // the expiry of the token, or zero if it does not expire
+}
+
+// OAuth2Hook is an authentication hook which treats the connect password as an OAuth2 access
+// token, validating it by token introspection or as a jwt, and maps the scopes of the token to
+// the topics the client may access.
+type OAuth2Hook struct {
+	mqtt.HookBase
+	config   *OAuth2Options
+	client   *http.Client
+	key      crypto.PublicKey          // the public key used to verify jwt signatures
+	mu       sync.RWMutex              // guards sessions
+	sessions map[string]*oauth2Session // validated tokens, keyed by client id
+}
+
+// ID returns the ID of the hook.
+func (h *OAuth2Hook) ID() string {
+	return "auth-oauth2"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *OAuth2Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnACLCheck,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init configures the hook with the introspection endpoint and jwt keys.
+func (h *OAuth2Hook) Init(config any) error {
+	if _, ok := config.(*OAuth2Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(OAuth2Options)
+	}
+
+	h.config = config.(*OAuth2Options)
+	if h.config.IntrospectionURL == "" && h.config.JWTSecret == "" && h.config.JWTKeyFile == "" {
+		return ErrNoTokenValidator
+	}
+
+	if h.config.JWTKeyFile != "" {
+		key, err := loadPublicKey(h.config.JWTKeyFile)
+		if err != nil {
+			return err
+		}
+		h.key = key
+	}
+
+	if h.config.Timeout <= 0 {
+		h.config.Timeout = defaultBackendTimeout
+	}
+
+	h.client = h.config.Client
+	if h.client == nil {
+		h.client = new(http.Client)
+	}
+
+	h.sessions = make(map[string]*oauth2Session)
+
+	h.Log.Info("loaded oauth2 auth",
+		"introspection", h.config.IntrospectionURL,
+		"jwt", h.config.JWTSecret != "" || h.key != nil,
+		"scopes", len(h.config.Scopes))
+
+	return nil
+}
+
+// OnConnectAuthenticate returns true if the connect password is a valid access token.
+func (h *OAuth2Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	claims, err := h.validate(string(pk.Connect.Password), time.Now())
+	if err == nil && h.config.MatchUsername &&
+		!slices.Contains([]string{claims.Username, claims.Sub}, string(pk.Connect.Username)) {
+		err = fmt.Errorf("%w: username does not match token", ErrInvalidToken)
+	}
+
+	if err != nil {
+		h.Log.Info("client failed authentication check",
+			"error", err,
+			"username", string(pk.Connect.Username),
+			"remote", cl.Net.Remote)
+		return false
+	}
+
+	s := &oauth2Session{
+		client: cl,
+		scopes: claims.scopes(),
+	}
+
+	if claims.Exp > 0 {
+		s.expires = time.Unix(int64(claims.Exp), 0)
+	}
+
+	h.mu.Lock()
+	h.sessions[cl.ID] = s
+	h.mu.Unlock()
+
+	return true
+}
+
+// OnACLCheck returns true if the scopes of the client token allow it to publish or subscribe
+// to a topic. Deny filters take precedence, and clients with expired tokens are denied.
+func (h *OAuth2Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	h.mu.RLock()
+	s, ok := h.sessions[cl.ID]
+	h.mu.RUnlock()
+	if !ok || s.client != cl {
+		return false
+	}
+
+	if !s.expires.IsZero() && time.Now().After(s.expires) {
+		h.Log.Debug("client access token has expired", "client", cl.ID, "topic", topic)
+		return false
+	}
+
+	if len(h.config.Scopes) == 0 {
+		return true
+	}
+
+	var allow bool
+	for _, scope := range s.scopes {
+		for filter, access := range h.config.Scopes[scope] {
+			if !filter.ClientFilterMatches(cl, topic) {
+				continue
+			}
+
+			switch access {
+			case Deny:
+				return false
+			case ReadOnly:
+				allow = allow || !write
+			case WriteOnly:
+				allow = allow || write
+			case ReadWrite:
+				allow = true
+			}
+		}
+	}
+
+	if !allow {
+		h.Log.Debug("client failed allowed ACL check",
+			"client", cl.ID,
+			"username", string(cl.Properties.Username),
+			"topic", topic)
+	}
+
+	return allow
+}
+
+// OnDisconnect removes the validated token of a disconnected client.
+func (h *OAuth2Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.sessions[cl.ID]; ok && s.client == cl {
+		delete(h.sessions, cl.ID)
+	}
+}
+
+// validate returns the claims of an access token if it is valid. Tokens which look like a
+// jwt are validated locally if a jwt key is configured, and any others are introspected.
+func (h *OAuth2Hook) validate(token string, now time.Time) (*tokenClaims, error) {
+	if token == "" {
+		return nil, fmt.Errorf("%w: empty token", ErrInvalidToken)
+	}
+
+	var claims *tokenClaims
+	var err error
+	switch {
+	case strings.Count(token, ".") == 2 && (h.config.JWTSecret != "" || h.key != nil):
+		claims, err = h.parseJWT(token)
+	case h.config.IntrospectionURL != "":
+		claims, err = h.introspect(token)
+	default:
+		err = fmt.Errorf("%w: not a jwt", ErrInvalidToken)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !claims.Active {
+		return nil, ErrTokenInactive
+	}
+
+	if claims.Exp > 0 && now.After(time.Unix(int64(claims.Exp), 0)) {
+		return nil, ErrTokenExpired
+	}
+
+	if claims.Nbf > 0 && now.Before(time.Unix(int64(claims.Nbf), 0)) {
+		return nil, fmt.Errorf("%w: token is not yet valid", ErrInvalidToken)
+	}
+
+	if h.config.Issuer != "" && claims.Iss != h.config.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, claims.Iss)
+	}
+
+	if h.config.Audience != "" && !slices.Contains(claims.Aud, h.config.Audience) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	}
+
+	return claims, nil
+}
+
+// introspect validates an opaque access token using the introspection endpoint.
+func (h *OAuth2Hook) introspect(token string) (*tokenClaims, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(h.config.Timeout)*time.Millisecond)
+	defer cancel()
+
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.config.IntrospectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if h.config.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(h.config.ClientID), url.QueryEscape(h.config.ClientSecret))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("%w: %d", ErrHTTPStatus, resp.StatusCode)
+	}
+
+	claims := new(tokenClaims)
+	if err := json.NewDecoder(resp.Body).Decode(claims); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	return claims, nil
+}
+
+// parseJWT verifies the signature of a jwt access token and returns its claims.
+func (h *OAuth2Hook) parseJWT(token string) (*tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	b64 := base64.RawURLEncoding
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+
+	data, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	if err := h.verifySignature(header.Alg, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	data, err = b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	claims := new(tokenClaims)
+	if err := json.Unmarshal(data, claims); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	claims.Active = true // a jwt with a valid signature is active until it expires
+
+	return claims, nil
+}
+
+// verifySignature verifies the signature of a jwt using the configured secret or public key.
+func (h *OAuth2Hook) verifySignature(alg string, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("%w: %q", ErrUnsupportedAlg, alg)
+	}
+
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("%w: %q", ErrUnsupportedAlg, alg)
+	}
+
+	digest := hash.New()
+	digest.Write(signed)
+
+	rsaKey, isRSA := h.key.(*rsa.PublicKey)
+	ecKey, isEC := h.key.(*ecdsa.PublicKey)
+	switch {
+	case alg[:2] == "HS" && h.config.JWTSecret != "":
+		mac := hmac.New(hash.New, []byte(h.config.JWTSecret))
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return ErrInvalidSignature
+		}
+	case alg[:2] == "RS" && isRSA:
+		if err := rsa.VerifyPKCS1v15(rsaKey, hash, digest.Sum(nil), sig); err != nil {
+			return ErrInvalidSignature
+		}
+	case alg[:2] == "ES" && isEC:
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return ErrInvalidSignature
+		}
+
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(ecKey, digest.Sum(nil), r, s) {
+			return ErrInvalidSignature
+		}
+	default:
+		return fmt.Errorf("%w: %q", ErrUnsupportedAlg, alg)
+	}
+
+	return nil
+}
+
+// loadPublicKey reads an rsa or ecdsa public key from a PEM encoded public key or certificate.
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no pem block", ErrInvalidJWTKey)
+	}
+
+	var key any
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidJWTKey, err)
+		}
+		key = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidJWTKey, err)
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported key type %T", ErrInvalidJWTKey, key)
+	}
+}
@@ -0,0 +1,377 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/stretchr/testify/require"
+)
+
+const testJWTSecret = "melon"
+
+// signJWT returns a jwt with the claims, signed with a secret or private key.
+func signJWT(t *testing.T, alg string, key any, claims map[string]any) string {
+	b64 := base64.RawURLEncoding
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case string:
+		mac := hmac.New(crypto.SHA256.New, []byte(k))
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest.Sum(nil))
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest.Sum(nil))
+		require.NoError(t, err)
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+// writePublicKey writes the PEM encoded public key of a private key to a temporary file.
+func writePublicKey(t *testing.T, key crypto.Signer) string {
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "key.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+	return path
+}
+
+// newIntrospectionServer returns a test introspection endpoint which responds to the token
+// "opaque" as active, and any other token as inactive.
+func newIntrospectionServer(t *testing.T) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != "broker" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		require.NoError(t, r.ParseForm())
+		require.Equal(t, "access_token", r.PostForm.Get("token_type_hint"))
+		if r.PostForm.Get("token") != "opaque" {
+			_, _ = w.Write([]byte(`{"active":false}`))
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"active":   true,
+			"scope":    "sensors:read devices",
+			"username": "mochi",
+			"aud":      "mqtt",
+			"exp":      time.Now().Add(time.Hour).Unix(),
+		})
+	}))
+
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newOAuth2Hook(t *testing.T, opts *OAuth2Options) *OAuth2Hook {
+	h := new(OAuth2Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(opts))
+	return h
+}
+
+func TestOAuth2ID(t *testing.T) {
+	h := new(OAuth2Hook)
+	require.Equal(t, "auth-oauth2", h.ID())
+}
+
+func TestOAuth2Provides(t *testing.T) {
+	h := new(OAuth2Hook)
+	require.True(t, h.Provides(mqtt.OnACLCheck))
+	require.True(t, h.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, h.Provides(mqtt.OnDisconnect))
+	require.False(t, h.Provides(mqtt.OnPublish))
+}
+
+func TestOAuth2InitBadConfig(t *testing.T) {
+	h := new(OAuth2Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(map[string]any{})
+	require.ErrorIs(t, err, mqtt.ErrInvalidConfigType)
+}
+
+func TestOAuth2InitNoValidator(t *testing.T) {
+	h := new(OAuth2Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(nil)
+	require.ErrorIs(t, err, ErrNoTokenValidator)
+}
+
+func TestOAuth2InitBadKeyFile(t *testing.T) {
+	h := new(OAuth2Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(&OAuth2Options{JWTKeyFile: filepath.Join(t.TempDir(), "missing.pem")})
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	path := filepath.Join(t.TempDir(), "key.pem")
+	require.NoError(t, os.WriteFile(path, []byte("not a key"), 0600))
+	err = h.Init(&OAuth2Options{JWTKeyFile: path})
+	require.ErrorIs(t, err, ErrInvalidJWTKey)
+}
+
+func TestOAuth2InitDefaults(t *testing.T) {
+	h := newOAuth2Hook(t, &OAuth2Options{JWTSecret: testJWTSecret})
+	require.Equal(t, int64(defaultBackendTimeout), h.config.Timeout)
+	require.NotNil(t, h.client)
+	require.NotNil(t, h.sessions)
+}
+
+func TestOAuth2JWTHS256(t *testing.T) {
+	h := newOAuth2Hook(t, &OAuth2Options{JWTSecret: testJWTSecret})
+	cl := &mqtt.Client{ID: "cl1"}
+
+	token := signJWT(t, "HS256", testJWTSecret, map[string]any{"sub": "mochi"})
+	require.True(t, h.OnConnectAuthenticate(cl, connectPacket("mochi", token)))
+
+	token = signJWT(t, "HS256", "lemon", map[string]any{"sub": "mochi"})
+	require.False(t, h.OnConnectAuthenticate(cl, connectPacket("mochi", token)))
+}
+
+func TestOAuth2JWTRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	h := newOAuth2Hook(t, &OAuth2Options{JWTKeyFile: writePublicKey(t, key)})
+	cl := &mqtt.Client{ID: "cl1"}
+
+	require.True(t, h.OnConnectAuthenticate(cl, connectPacket("", signJWT(t, "RS256", key, nil))))
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	require.False(t, h.OnConnectAuthenticate(cl, connectPacket("", signJWT(t, "RS256", other, nil))))
+}
+
+func TestOAuth2JWTES256(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	h := newOAuth2Hook(t, &OAuth2Options{JWTKeyFile: writePublicKey(t, key)})
+	cl := &mqtt.Client{ID: "cl1"}
+
+	require.True(t, h.OnConnectAuthenticate(cl, connectPacket("", signJWT(t, "ES256", key, nil))))
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	require.False(t, h.OnConnectAuthenticate(cl, connectPacket("", signJWT(t, "ES256", other, nil))))
+}
+
+func TestOAuth2JWTUnsupportedAlg(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	h := newOAuth2Hook(t, &OAuth2Options{JWTKeyFile: writePublicKey(t, key)})
+
+	// an hmac signed with the public key must not be accepted
+	_, err = h.validate(signJWT(t, "HS256", testJWTSecret, nil), time.Now())
+	require.ErrorIs(t, err, ErrUnsupportedAlg)
+
+	_, err = h.validate(signJWT(t, "none", testJWTSecret, nil), time.Now())
+	require.ErrorIs(t, err, ErrUnsupportedAlg)
+
+	_, err = h.validate(signJWT(t, "RS999", key, nil), time.Now())
+	require.ErrorIs(t, err, ErrUnsupportedAlg)
+}
+
+func TestOAuth2JWTMalformed(t *testing.T) {
+	h := newOAuth2Hook(t, &OAuth2Options{JWTSecret: testJWTSecret})
+	for _, token := range []string{"", "a.b", "!.b.c", "e30.b.!", "bm90anNvbg.e30.c"} {
+		_, err := h.validate(token, time.Now())
+		require.Error(t, err, token)
+	}
+}
+
+func TestOAuth2Claims(t *testing.T) {
+	h := newOAuth2Hook(t, &OAuth2Options{
+		JWTSecret: testJWTSecret,
+		Issuer:    "https://auth.example.com",
+		Audience:  "mqtt",
+	})
+
+	now := time.Now()
+	valid := map[string]any{
+		"iss": "https://auth.example.com",
+		"aud": []string{"other", "mqtt"},
+		"exp": now.Add(time.Hour).Unix(),
+		"nbf": now.Add(-time.Hour).Unix(),
+	}
+
+	_, err := h.validate(signJWT(t, "HS256", testJWTSecret, valid), now)
+	require.NoError(t, err)
+
+	tt := []struct {
+		desc  string
+		claim string
+		value any
+		err   error
+	}{
+		{desc: "expired", claim: "exp", value: now.Add(-time.Minute).Unix(), err: ErrTokenExpired},
+		{desc: "not yet valid", claim: "nbf", value: now.Add(time.Minute).Unix(), err: ErrInvalidToken},
+		{desc: "issuer", claim: "iss", value: "https://other.example.com", err: ErrInvalidToken},
+		{desc: "audience", claim: "aud", value: "other", err: ErrInvalidToken},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			claims := map[string]any{}
+			for k, v := range valid {
+				claims[k] = v
+			}
+			claims[tx.claim] = tx.value
+
+			_, err := h.validate(signJWT(t, "HS256", testJWTSecret, claims), now)
+			require.ErrorIs(t, err, tx.err)
+		})
+	}
+}
+
+func TestOAuth2MatchUsername(t *testing.T) {
+	h := newOAuth2Hook(t, &OAuth2Options{JWTSecret: testJWTSecret, MatchUsername: true})
+	cl := &mqtt.Client{ID: "cl1"}
+
+	token := signJWT(t, "HS256", testJWTSecret, map[string]any{"sub": "mochi"})
+	require.True(t, h.OnConnectAuthenticate(cl, connectPacket("mochi", token)))
+	require.False(t, h.OnConnectAuthenticate(cl, connectPacket("other", token)))
+}
+
+func TestOAuth2Introspection(t *testing.T) {
+	s := newIntrospectionServer(t)
+	h := newOAuth2Hook(t, &OAuth2Options{
+		IntrospectionURL: s.URL,
+		ClientID:         "broker",
+		ClientSecret:     "secret",
+		Audience:         "mqtt",
+	})
+
+	claims, err := h.validate("opaque", time.Now())
+	require.NoError(t, err)
+	require.Equal(t, "mochi", claims.Username)
+	require.Equal(t, []string{"sensors:read", "devices"}, claims.scopes())
+
+	_, err = h.validate("revoked", time.Now())
+	require.ErrorIs(t, err, ErrTokenInactive)
+}
+
+func TestOAuth2IntrospectionUnauthorized(t *testing.T) {
+	s := newIntrospectionServer(t)
+	h := newOAuth2Hook(t, &OAuth2Options{IntrospectionURL: s.URL})
+
+	_, err := h.validate("opaque", time.Now())
+	require.ErrorIs(t, err, ErrHTTPStatus)
+}
+
+func TestOAuth2IntrospectionUnreachable(t *testing.T) {
+	s := newIntrospectionServer(t)
+	s.Close()
+	h := newOAuth2Hook(t, &OAuth2Options{IntrospectionURL: s.URL})
+
+	cl := &mqtt.Client{ID: "cl1"}
+	require.False(t, h.OnConnectAuthenticate(cl, connectPacket("mochi", "opaque")))
+}
+
+func TestOAuth2OpaqueTokenWithoutIntrospection(t *testing.T) {
+	h := newOAuth2Hook(t, &OAuth2Options{JWTSecret: testJWTSecret})
+	_, err := h.validate("opaque", time.Now())
+	require.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestOAuth2OnACLCheck(t *testing.T) {
+	s := newIntrospectionServer(t)
+	h := newOAuth2Hook(t, &OAuth2Options{
+		IntrospectionURL: s.URL,
+		ClientID:         "broker",
+		ClientSecret:     "secret",
+		Scopes: map[string]Filters{
+			"sensors:read": {"sensors/#": ReadOnly, "sensors/secret": Deny},
+			"devices":      {"devices/%c/#": ReadWrite, "devices/+/firmware": WriteOnly},
+			"admin":        {"#": ReadWrite},
+		},
+	})
+
+	cl := &mqtt.Client{ID: "cl1", Properties: mqtt.ClientProperties{Username: []byte("mochi")}}
+	require.False(t, h.OnACLCheck(cl, "sensors/a", false)) // not authenticated
+	require.True(t, h.OnConnectAuthenticate(cl, connectPacket("mochi", "opaque")))
+
+	require.True(t, h.OnACLCheck(cl, "sensors/a", false))
+	require.False(t, h.OnACLCheck(cl, "sensors/a", true))
+	require.False(t, h.OnACLCheck(cl, "sensors/secret", false))
+	require.True(t, h.OnACLCheck(cl, "devices/cl1/state", true))
+	require.True(t, h.OnACLCheck(cl, "devices/cl1/firmware", false))
+	require.True(t, h.OnACLCheck(cl, "devices/cl2/firmware", true))
+	require.False(t, h.OnACLCheck(cl, "devices/cl2/firmware", false))
+	require.False(t, h.OnACLCheck(cl, "devices/cl2/state", true))
+	require.False(t, h.OnACLCheck(cl, "admin/a", true))
+
+	other := &mqtt.Client{ID: "cl1"}
+	require.False(t, h.OnACLCheck(other, "sensors/a", false)) // same id, different client
+}
+
+func TestOAuth2OnACLCheckNoScopes(t *testing.T) {
+	h := newOAuth2Hook(t, &OAuth2Options{JWTSecret: testJWTSecret})
+	cl := &mqtt.Client{ID: "cl1"}
+	require.True(t, h.OnConnectAuthenticate(cl, connectPacket("", signJWT(t, "HS256", testJWTSecret, nil))))
+	require.True(t, h.OnACLCheck(cl, "any/topic", true))
+}
+
+func TestOAuth2OnACLCheckExpired(t *testing.T) {
+	h := newOAuth2Hook(t, &OAuth2Options{JWTSecret: testJWTSecret})
+	cl := &mqtt.Client{ID: "cl1"}
+	token := signJWT(t, "HS256", testJWTSecret, map[string]any{"exp": time.Now().Add(time.Hour).Unix()})
+	require.True(t, h.OnConnectAuthenticate(cl, connectPacket("", token)))
+	require.True(t, h.OnACLCheck(cl, "a/b", true))
+
+	h.sessions[cl.ID].expires = time.Now().Add(-time.Second)
+	require.False(t, h.OnACLCheck(cl, "a/b", true))
+}
+
+func TestOAuth2OnDisconnect(t *testing.T) {
+	h := newOAuth2Hook(t, &OAuth2Options{JWTSecret: testJWTSecret})
+	token := signJWT(t, "HS256", testJWTSecret, nil)
+
+	old := &mqtt.Client{ID: "cl1"}
+	require.True(t, h.OnConnectAuthenticate(old, connectPacket("", token)))
+
+	cl := &mqtt.Client{ID: "cl1"} // takes over the session of old
+	require.True(t, h.OnConnectAuthenticate(cl, connectPacket("", token)))
+
+	h.OnDisconnect(old, nil, false)
+	require.True(t, h.OnACLCheck(cl, "a/b", true))
+
+	h.OnDisconnect(cl, nil, false)
+	require.False(t, h.OnACLCheck(cl, "a/b", true))
+	require.Empty(t, h.sessions)
+}
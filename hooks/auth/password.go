@@ -0,0 +1,131 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	HashBcrypt   = "bcrypt"        // hash passwords with bcrypt
+	HashArgon2id = "argon2id"      // hash passwords with argon2id
+	HashPBKDF2   = "pbkdf2-sha256" // hash passwords with pbkdf2 and sha256
+
+	argon2Time    = 1         // the number of passes over the memory by argon2id
+	argon2Memory  = 64 * 1024 // the KiB of memory used by argon2id
+	argon2Threads = 4         // the number of threads used by argon2id
+	pbkdf2Iter    = 600000    // the number of pbkdf2 iterations
+	saltSize      = 16        // the size of generated salts in bytes
+	keySize       = 32        // the size of argon2id and pbkdf2 keys in bytes
+)
+
+// ErrUnknownHash indicates a password hashing algorithm is not supported.
+var ErrUnknownHash = errors.New("unknown password hash algorithm")
+
+// HashPassword returns a password hashed with the bcrypt, argon2id or pbkdf2-sha256 algorithm,
+// encoded with an algorithm prefix so it can be used in place of a plaintext password in the ledger.
+func HashPassword(algorithm, password string) (string, error) {
+	if algorithm == HashBcrypt {
+		b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(b), err
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	b64 := base64.RawStdEncoding
+	switch algorithm {
+	case HashArgon2id:
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, keySize)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time,
+			argon2Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+	case HashPBKDF2:
+		key, err := pbkdf2.Key(sha256.New, password, salt, pbkdf2Iter, keySize)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("$pbkdf2-sha256$i=%d$%s$%s", pbkdf2Iter, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnknownHash, algorithm)
+	}
+}
+
+// IsPasswordHash returns true if a value is a password hash which can be verified by the ledger.
+func IsPasswordHash(s string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$argon2id$", "$pbkdf2-sha256$"} {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// verifyPassword returns true if a password matches a password hash. A malformed hash
+// never matches.
+func verifyPassword(hash string, password []byte) bool {
+	parts := strings.Split(hash, "$")
+	b64 := base64.RawStdEncoding
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$") && len(parts) == 6:
+		var version int
+		var memory, time uint32
+		var threads uint8
+		if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+			return false
+		}
+
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil || time < 1 || threads < 1 {
+			return false
+		}
+
+		salt, err := b64.DecodeString(parts[4])
+		if err != nil {
+			return false
+		}
+
+		key, err := b64.DecodeString(parts[5])
+		if err != nil || len(key) == 0 {
+			return false
+		}
+
+		other := argon2.IDKey(password, salt, time, memory, threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1
+	case strings.HasPrefix(hash, "$pbkdf2-sha256$") && len(parts) == 5:
+		var iter int
+		if _, err := fmt.Sscanf(parts[2], "i=%d", &iter); err != nil || iter <= 0 {
+			return false
+		}
+
+		salt, err := b64.DecodeString(parts[3])
+		if err != nil {
+			return false
+		}
+
+		key, err := b64.DecodeString(parts[4])
+		if err != nil || len(key) == 0 {
+			return false
+		}
+
+		other, err := pbkdf2.Key(sha256.New, string(password), salt, iter, len(key))
+		return err == nil && subtle.ConstantTimeCompare(key, other) == 1
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), password) == nil
+	default:
+		return false
+	}
+}
@@ -0,0 +1,81 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashPassword(t *testing.T) {
+	for _, algorithm := range []string{HashBcrypt, HashArgon2id, HashPBKDF2} {
+		t.Run(algorithm, func(t *testing.T) {
+			hash, err := HashPassword(algorithm, "melon")
+			require.NoError(t, err)
+			require.True(t, IsPasswordHash(hash))
+			require.True(t, verifyPassword(hash, []byte("melon")))
+			require.False(t, verifyPassword(hash, []byte("lemon")))
+			require.False(t, verifyPassword(hash, []byte("")))
+
+			other, err := HashPassword(algorithm, "melon")
+			require.NoError(t, err)
+			require.NotEqual(t, hash, other) // salted
+		})
+	}
+}
+
+func TestHashPasswordUnknown(t *testing.T) {
+	_, err := HashPassword("md5", "melon")
+	require.ErrorIs(t, err, ErrUnknownHash)
+}
+
+func TestIsPasswordHash(t *testing.T) {
+	require.True(t, IsPasswordHash("$2a$10$abc"))
+	require.True(t, IsPasswordHash("$2b$10$abc"))
+	require.True(t, IsPasswordHash("$2y$10$abc"))
+	require.True(t, IsPasswordHash("$argon2id$v=19$m=65536,t=1,p=4$abc$abc"))
+	require.True(t, IsPasswordHash("$pbkdf2-sha256$i=1000$abc$abc"))
+	require.False(t, IsPasswordHash("melon"))
+	require.False(t, IsPasswordHash("$6$salt$hash"))
+	require.False(t, IsPasswordHash(""))
+}
+
+func TestVerifyPasswordMalformed(t *testing.T) {
+	tt := []string{
+		"$2a$10$invalid",
+		"$argon2id$v=19$m=65536,t=1,p=4$c2FsdA",
+		"$argon2id$v=18$m=65536,t=1,p=4$c2FsdA$a2V5",
+		"$argon2id$v=19$m=65536,t=0,p=4$c2FsdA$a2V5",
+		"$argon2id$v=19$m=65536,t=1,p=0$c2FsdA$a2V5",
+		"$argon2id$v=19$bad$c2FsdA$a2V5",
+		"$argon2id$v=19$m=65536,t=1,p=4$!!$a2V5",
+		"$argon2id$v=19$m=65536,t=1,p=4$c2FsdA$",
+		"$pbkdf2-sha256$i=1000$c2FsdA",
+		"$pbkdf2-sha256$i=0$c2FsdA$a2V5",
+		"$pbkdf2-sha256$bad$c2FsdA$a2V5",
+		"$pbkdf2-sha256$i=1000$!!$a2V5",
+		"$pbkdf2-sha256$i=1000$c2FsdA$",
+		"melon",
+	}
+
+	for _, hash := range tt {
+		t.Run(hash, func(t *testing.T) {
+			require.False(t, verifyPassword(hash, []byte("melon")))
+		})
+	}
+}
+
+func TestRStringPasswordMatches(t *testing.T) {
+	hash, err := HashPassword(HashPBKDF2, "melon")
+	require.NoError(t, err)
+
+	require.True(t, RString(hash).PasswordMatches([]byte("melon")))
+	require.False(t, RString(hash).PasswordMatches([]byte("lemon")))
+	require.False(t, RString(hash).PasswordMatches([]byte(hash)))
+	require.True(t, RString("melon").PasswordMatches([]byte("melon")))
+	require.True(t, RString("*").PasswordMatches([]byte("any")))
+	require.False(t, RString("melon").PasswordMatches([]byte("lemon")))
+}
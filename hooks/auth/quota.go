@@ -0,0 +1,133 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+)
+
+const (
+	quotaLimitMessages = "messages" // the messages per second limit of a quota
+	quotaLimitBytes    = "bytes"    // the bytes per minute limit of a quota
+)
+
+// quotaBucket is a token bucket tracking the publishes of a client against a quota.
+type quotaBucket struct {
+	messages float64   // the messages which may be published before the quota is exceeded
+	bytes    float64   // the payload bytes which may be published before the quota is exceeded
+	updated  time.Time // the time the bucket was last refilled
+}
+
+// newQuotaBucket returns a full bucket for a quota.
+func newQuotaBucket(q Quota, now time.Time) *quotaBucket {
+	return &quotaBucket{
+		messages: max(q.Messages, 1),
+		bytes:    float64(q.Bytes),
+		updated:  now,
+	}
+}
+
+// take refills the bucket for the time elapsed since it was last refilled, and takes a publish
+// of size bytes from it. The limit which was exceeded is returned with how long the publish must
+// wait to be within the quota, or an empty limit if it is within the quota. A publish which
+// exceeds the quota is only taken if the quota throttles.
+func (b *quotaBucket) take(q Quota, size int, now time.Time) (limit string, wait time.Duration) {
+	elapsed := now.Sub(b.updated).Seconds()
+	b.updated = now
+
+	if q.Messages > 0 {
+		b.messages = min(b.messages+elapsed*q.Messages, max(q.Messages, 1))
+		if b.messages < 1 {
+			limit = quotaLimitMessages
+			wait = time.Duration((1 - b.messages) / q.Messages * float64(time.Second))
+		}
+	}
+
+	if q.Bytes > 0 {
+		rate := float64(q.Bytes) / 60
+		b.bytes = min(b.bytes+elapsed*rate, float64(q.Bytes))
+		if b.bytes < float64(size) {
+			if w := time.Duration((float64(size) - b.bytes) / rate * float64(time.Second)); w > wait {
+				limit, wait = quotaLimitBytes, w
+			}
+		}
+	}
+
+	if limit == "" || q.Throttle {
+		if q.Messages > 0 {
+			b.messages--
+		}
+
+		if q.Bytes > 0 {
+			b.bytes -= float64(size)
+		}
+	}
+
+	return limit, wait
+}
+
+// OnPublishQuota enforces the publish quotas of the auth ledger, keeping a separate quota for
+// each client and quota rule. Publishes which exceed a throttled quota are delayed until they
+// are within it, and other publishes which exceed a quota are rejected. Publishes with payloads
+// larger than the bytes limit of a quota are always rejected.
+func (h *Hook) OnPublishQuota(cl *mqtt.Client, pk packets.Packet) (mqtt.QuotaExceeded, bool) {
+	q, rule := h.ledger.QuotaRule(cl, pk.TopicName)
+	if rule == "" || (q.Messages <= 0 && q.Bytes <= 0) {
+		return mqtt.QuotaExceeded{}, false
+	}
+
+	if q.Bytes > 0 && int64(len(pk.Payload)) > q.Bytes {
+		return mqtt.QuotaExceeded{Rule: rule, Limit: quotaLimitBytes}, true
+	}
+
+	now := time.Now()
+	h.quotaMu.Lock()
+	if h.quotas == nil {
+		h.quotas = make(map[string]map[string]*quotaBucket)
+	}
+
+	buckets, ok := h.quotas[cl.ID]
+	if !ok {
+		buckets = make(map[string]*quotaBucket)
+		h.quotas[cl.ID] = buckets
+	}
+
+	b, ok := buckets[rule]
+	if !ok {
+		b = newQuotaBucket(q, now)
+		buckets[rule] = b
+	}
+
+	limit, wait := b.take(q, len(pk.Payload), now)
+	h.quotaMu.Unlock()
+
+	if limit == "" {
+		return mqtt.QuotaExceeded{}, false
+	}
+
+	h.Log.Debug("client exceeded publish quota",
+		"client", cl.ID,
+		"username", string(cl.Properties.Username),
+		"topic", pk.TopicName,
+		"rule", rule,
+		"limit", limit,
+		"throttle", q.Throttle)
+
+	if q.Throttle {
+		time.Sleep(wait)
+	}
+
+	return mqtt.QuotaExceeded{Rule: rule, Limit: limit, Throttled: q.Throttle}, true
+}
+
+// OnDisconnect removes the publish quotas of a disconnected client.
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.quotaMu.Lock()
+	defer h.quotaMu.Unlock()
+	delete(h.quotas, cl.ID)
+}
@@ -0,0 +1,129 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func newQuotaHook(t *testing.T, ledger *Ledger) *Hook {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{Ledger: ledger}))
+	return h
+}
+
+func quotaPublish(topic string, size int) packets.Packet {
+	return packets.Packet{TopicName: topic, Payload: make([]byte, size)}
+}
+
+func TestQuotaBucketMessages(t *testing.T) {
+	now := time.Now()
+	q := Quota{Messages: 2}
+	b := newQuotaBucket(q, now)
+
+	for i := 0; i < 2; i++ {
+		limit, _ := b.take(q, 0, now)
+		require.Empty(t, limit)
+	}
+
+	limit, wait := b.take(q, 0, now)
+	require.Equal(t, quotaLimitMessages, limit)
+	require.Equal(t, 500*time.Millisecond, wait)
+
+	limit, _ = b.take(q, 0, now.Add(500*time.Millisecond))
+	require.Empty(t, limit)
+}
+
+func TestQuotaBucketBytes(t *testing.T) {
+	now := time.Now()
+	q := Quota{Bytes: 600}
+	b := newQuotaBucket(q, now)
+
+	limit, _ := b.take(q, 500, now)
+	require.Empty(t, limit)
+
+	limit, wait := b.take(q, 200, now) // 100 bytes remain, refilled at 10 bytes per second
+	require.Equal(t, quotaLimitBytes, limit)
+	require.Equal(t, 10*time.Second, wait)
+	require.Equal(t, float64(100), b.bytes) // rejected publishes are not taken
+
+	limit, _ = b.take(q, 200, now.Add(10*time.Second))
+	require.Empty(t, limit)
+}
+
+func TestQuotaBucketThrottle(t *testing.T) {
+	now := time.Now()
+	q := Quota{Messages: 1, Throttle: true}
+	b := newQuotaBucket(q, now)
+
+	limit, _ := b.take(q, 0, now)
+	require.Empty(t, limit)
+
+	limit, wait := b.take(q, 0, now)
+	require.Equal(t, quotaLimitMessages, limit)
+	require.Equal(t, time.Second, wait)
+
+	limit, wait = b.take(q, 0, now) // throttled publishes are taken, so later publishes wait longer
+	require.Equal(t, quotaLimitMessages, limit)
+	require.Equal(t, 2*time.Second, wait)
+}
+
+func TestOnPublishQuota(t *testing.T) {
+	h := newQuotaHook(t, &Ledger{
+		ACL: ACLRules{
+			{Quotas: QuotaFilters{"limited/#": {Messages: 1}, "small/#": {Bytes: 10}}},
+		},
+	})
+
+	cl := &mqtt.Client{ID: "cl1"}
+	_, over := h.OnPublishQuota(cl, quotaPublish("other", 0))
+	require.False(t, over)
+
+	_, over = h.OnPublishQuota(cl, quotaPublish("limited/a", 0))
+	require.False(t, over)
+
+	exceeded, over := h.OnPublishQuota(cl, quotaPublish("limited/a", 0))
+	require.True(t, over)
+	require.Equal(t, mqtt.QuotaExceeded{Rule: "acl[0].quotas[limited/#]", Limit: quotaLimitMessages}, exceeded)
+
+	// each client has its own quota
+	_, over = h.OnPublishQuota(&mqtt.Client{ID: "cl2"}, quotaPublish("limited/a", 0))
+	require.False(t, over)
+
+	// payloads larger than the bytes limit are always rejected
+	exceeded, over = h.OnPublishQuota(cl, quotaPublish("small/a", 11))
+	require.True(t, over)
+	require.Equal(t, mqtt.QuotaExceeded{Rule: "acl[0].quotas[small/#]", Limit: quotaLimitBytes}, exceeded)
+
+	h.OnDisconnect(cl, nil, false)
+	require.NotContains(t, h.quotas, "cl1")
+	_, over = h.OnPublishQuota(cl, quotaPublish("limited/a", 0))
+	require.False(t, over)
+}
+
+func TestOnPublishQuotaThrottle(t *testing.T) {
+	h := newQuotaHook(t, &Ledger{
+		ACL: ACLRules{
+			{Quotas: QuotaFilters{"#": {Messages: 50, Throttle: true}}},
+		},
+	})
+
+	cl := &mqtt.Client{ID: "cl1"}
+	h.quotas = map[string]map[string]*quotaBucket{
+		"cl1": {"acl[0].quotas[#]": {updated: time.Now()}}, // an empty bucket
+	}
+
+	start := time.Now()
+	exceeded, over := h.OnPublishQuota(cl, quotaPublish("a/b", 0))
+	require.True(t, over)
+	require.True(t, exceeded.Throttled)
+	require.GreaterOrEqual(t, time.Since(start), 15*time.Millisecond)
+}
@@ -0,0 +1,253 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// defaultRedisAddr is the default address of the redis service.
+	defaultRedisAddr = "localhost:6379"
+
+	// defaultRedisPrefix is the default prefix of the user and acl keys.
+	defaultRedisPrefix = "mqtt:"
+)
+
+// RedisOptions contains the configuration of the Redis auth hook. The credentials of each user
+// are read from the hash at <Prefix>users:<username>, with a password field containing the
+// password or a password hash (such as one created by HashPassword), and an optional superuser
+// field. The acl filters of a user are read from the hash at <Prefix>acl:<username>, mapping
+// each filter to its access (0 deny, 1 read, 2 write, 3 read and write).
+type RedisOptions struct {
+	// Address is the address of the redis service (default localhost:6379).
+	Address string `yaml:"address" json:"address"`
+
+	// Username is the username used to connect to the redis service, if set.
+	Username string `yaml:"username" json:"username"`
+
+	// Password is the password used to connect to the redis service, if set.
+	Password string `yaml:"password" json:"password"`
+
+	// Database is the number of the redis database.
+	Database int `yaml:"database" json:"database"`
+
+	// Prefix is the prefix of the user and acl keys (default mqtt:).
+	Prefix string `yaml:"prefix" json:"prefix"`
+
+	// DefaultACL contains the topic filters of users without an acl hash.
+	// If not set, such users may publish and subscribe to any topic.
+	DefaultACL Filters `yaml:"default_acl" json:"default_acl"`
+
+	// Timeout is the milliseconds to wait for a response from redis (default 5000).
+	Timeout int64 `yaml:"timeout" json:"timeout"`
+
+	// Options are the options of the redis client, which take precedence over Address,
+	// Username, Password and Database if set.
+	Options *redis.Options `yaml:"-" json:"-"`
+}
+
+// RedisHook is an authentication hook which checks clients against credentials and ACL
+// filters read from Redis. Keys are read on every check, so credentials provisioned by
+// another system apply immediately.
+type RedisHook struct {
+	mqtt.HookBase
+	config *RedisOptions
+	db     *redis.Client
+}
+
+// ID returns the ID of the hook.
+func (h *RedisHook) ID() string {
+	return "auth-redis"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *RedisHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnACLCheck,
+	}, []byte{b})
+}
+
+// Init connects to the redis service.
+func (h *RedisHook) Init(config any) error {
+	if _, ok := config.(*RedisOptions); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(RedisOptions)
+	}
+
+	h.config = config.(*RedisOptions)
+	if h.config.Options == nil {
+		h.config.Options = &redis.Options{
+			Addr:     h.config.Address,
+			Username: h.config.Username,
+			Password: h.config.Password,
+			DB:       h.config.Database,
+		}
+
+		if h.config.Options.Addr == "" {
+			h.config.Options.Addr = defaultRedisAddr
+		}
+	}
+
+	if h.config.Prefix == "" {
+		h.config.Prefix = defaultRedisPrefix
+	}
+
+	if h.config.Timeout == 0 {
+		h.config.Timeout = defaultBackendTimeout
+	}
+
+	h.Log.Info("connecting to redis auth service",
+		"address", h.config.Options.Addr,
+		"prefix", h.config.Prefix,
+		"db", h.config.Options.DB)
+
+	h.db = redis.NewClient(h.config.Options)
+
+	ctx, cancel := h.context(context.Background())
+	defer cancel()
+	if err := h.db.Ping(ctx).Err(); err != nil {
+		_ = h.db.Close()
+		h.db = nil
+		return fmt.Errorf("failed to ping redis auth service: %w", err)
+	}
+
+	return nil
+}
+
+// Stop closes the connection to the redis service.
+func (h *RedisHook) Stop() error {
+	if h.db == nil {
+		return nil
+	}
+
+	db := h.db
+	h.db = nil
+	return db.Close()
+}
+
+// context returns a context derived from parent which is cancelled after the request timeout.
+func (h *RedisHook) context(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, time.Duration(h.config.Timeout)*time.Millisecond)
+}
+
+// userKey returns the key of the credentials of a user.
+func (h *RedisHook) userKey(username string) string {
+	return h.config.Prefix + "users:" + username
+}
+
+// aclKey returns the key of the acl filters of a user.
+func (h *RedisHook) aclKey(username string) string {
+	return h.config.Prefix + "acl:" + username
+}
+
+// OnConnectAuthenticate returns true if the password of the client matches the password of
+// the user in redis. Users with a true superuser field are marked as superusers.
+func (h *RedisHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	ctx, cancel := h.context(cl.Context())
+	defer cancel()
+
+	username := string(pk.Connect.Username)
+	user, err := h.db.HGetAll(ctx, h.userKey(username)).Result()
+	if err != nil {
+		h.Log.Warn("redis auth request failed", "error", err, "username", username)
+		return false
+	}
+
+	password, ok := user["password"]
+	if !ok || !RString(password).passwordEquals(pk.Connect.Password) {
+		h.Log.Info("client failed authentication check",
+			"username", username,
+			"remote", cl.Net.Remote)
+		return false
+	}
+
+	if su, _ := strconv.ParseBool(user["superuser"]); su {
+		cl.SetSuperuser(true)
+	}
+
+	return true
+}
+
+// OnACLCheck returns true if the acl filters of the user in redis allow the client to publish
+// or subscribe to a topic. Deny filters take precedence, and filters with an invalid access
+// deny the client.
+func (h *RedisHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	ctx, cancel := h.context(cl.Context())
+	defer cancel()
+
+	username := string(cl.Properties.Username)
+	var exists *redis.IntCmd
+	var acl *redis.StringStringMapCmd
+	_, err := h.db.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		exists = pipe.Exists(ctx, h.userKey(username))
+		acl = pipe.HGetAll(ctx, h.aclKey(username))
+		return nil
+	})
+	if err != nil {
+		h.Log.Warn("redis auth request failed", "error", err, "username", username)
+		return false
+	}
+
+	if exists.Val() == 0 {
+		return false
+	}
+
+	filters := h.config.DefaultACL
+	if len(acl.Val()) > 0 {
+		filters = make(Filters, len(acl.Val()))
+		for filter, v := range acl.Val() {
+			access, err := strconv.ParseUint(v, 10, 8)
+			if err != nil || access > uint64(ReadWrite) {
+				access = uint64(Deny)
+			}
+			filters[RString(filter)] = Access(access)
+		}
+	}
+
+	if filters == nil {
+		return true
+	}
+
+	var allow bool
+	for filter, access := range filters {
+		if !filter.ClientFilterMatches(cl, topic) {
+			continue
+		}
+
+		switch access {
+		case Deny:
+			return false
+		case ReadOnly:
+			allow = allow || !write
+		case WriteOnly:
+			allow = allow || write
+		case ReadWrite:
+			allow = true
+		}
+	}
+
+	if !allow {
+		h.Log.Debug("client failed allowed ACL check",
+			"client", cl.ID,
+			"username", username,
+			"topic", topic)
+	}
+
+	return allow
+}
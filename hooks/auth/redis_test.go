@@ -0,0 +1,143 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"testing"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	miniredis "github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+)
+
+func newRedisHook(t *testing.T, s *miniredis.Miniredis, opts *RedisOptions) *RedisHook {
+	if opts == nil {
+		opts = new(RedisOptions)
+	}
+	opts.Address = s.Addr()
+
+	h := new(RedisHook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(opts))
+	t.Cleanup(func() { _ = h.Stop() })
+	return h
+}
+
+func TestRedisHookID(t *testing.T) {
+	h := new(RedisHook)
+	require.Equal(t, "auth-redis", h.ID())
+}
+
+func TestRedisHookProvides(t *testing.T) {
+	h := new(RedisHook)
+	require.True(t, h.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, h.Provides(mqtt.OnACLCheck))
+	require.False(t, h.Provides(mqtt.OnPublish))
+}
+
+func TestRedisHookInitBadConfig(t *testing.T) {
+	h := new(RedisHook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+}
+
+func TestRedisHookInitDefaults(t *testing.T) {
+	s := miniredis.RunT(t)
+	h := newRedisHook(t, s, nil)
+	require.Equal(t, defaultRedisPrefix, h.config.Prefix)
+	require.Equal(t, int64(defaultBackendTimeout), h.config.Timeout)
+	require.Equal(t, s.Addr(), h.config.Options.Addr)
+}
+
+func TestRedisHookInitOptions(t *testing.T) {
+	s := miniredis.RunT(t)
+	h := new(RedisHook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&RedisOptions{Address: "unused:1", Options: &redis.Options{Addr: s.Addr()}}))
+	require.NoError(t, h.Stop())
+	require.NoError(t, h.Stop())
+}
+
+func TestRedisHookInitUnreachable(t *testing.T) {
+	s := miniredis.RunT(t)
+	addr := s.Addr()
+	s.Close()
+
+	h := new(RedisHook)
+	h.SetOpts(logger, nil)
+	require.Error(t, h.Init(&RedisOptions{Address: addr, Timeout: 100}))
+	require.Nil(t, h.db)
+}
+
+func TestRedisHookOnConnectAuthenticate(t *testing.T) {
+	s := miniredis.RunT(t)
+	h := newRedisHook(t, s, &RedisOptions{Prefix: "test:"})
+
+	hash, err := HashPassword(HashBcrypt, "password2")
+	require.NoError(t, err)
+	s.HSet("test:users:peach", "password", "password1")
+	s.HSet("test:users:melon", "password", hash)
+	s.HSet("test:users:admin", "password", "password3", "superuser", "true")
+	s.HSet("test:users:nopass", "superuser", "true")
+
+	peach := newClient("cl1", "peach")
+	require.True(t, h.OnConnectAuthenticate(peach, connectPacket("peach", "password1")))
+	require.False(t, peach.IsSuperuser())
+	require.False(t, h.OnConnectAuthenticate(peach, connectPacket("peach", "wrong")))
+	require.True(t, h.OnConnectAuthenticate(newClient("cl2", "melon"), connectPacket("melon", "password2")))
+	require.False(t, h.OnConnectAuthenticate(newClient("cl3", "apple"), connectPacket("apple", "")))
+	require.False(t, h.OnConnectAuthenticate(newClient("cl3", "nopass"), connectPacket("nopass", "")))
+
+	admin := newClient("cl4", "admin")
+	require.True(t, h.OnConnectAuthenticate(admin, connectPacket("admin", "password3")))
+	require.True(t, admin.IsSuperuser())
+
+	// credentials provisioned after the hook started apply immediately
+	s.HSet("test:users:apple", "password", "password4")
+	require.True(t, h.OnConnectAuthenticate(newClient("cl3", "apple"), connectPacket("apple", "password4")))
+}
+
+func TestRedisHookOnACLCheck(t *testing.T) {
+	s := miniredis.RunT(t)
+	h := newRedisHook(t, s, nil)
+
+	s.HSet("mqtt:users:peach", "password", "password1")
+	s.HSet("mqtt:acl:peach", "peach/#", "3", "news/#", "1", "news/secret", "0", "bad/#", "x")
+	s.HSet("mqtt:users:melon", "password", "password2")
+	s.HSet("mqtt:acl:melon", "devices/%c/#", "2")
+	s.HSet("mqtt:users:apple", "password", "password3")
+
+	peach := newClient("cl1", "peach")
+	require.True(t, h.OnACLCheck(peach, "peach/a", true))
+	require.True(t, h.OnACLCheck(peach, "peach/a", false))
+	require.True(t, h.OnACLCheck(peach, "news/a", false))
+	require.False(t, h.OnACLCheck(peach, "news/a", true))
+	require.False(t, h.OnACLCheck(peach, "news/secret", false))
+	require.False(t, h.OnACLCheck(peach, "bad/a", false))
+	require.False(t, h.OnACLCheck(peach, "other", false))
+
+	melon := newClient("dev1", "melon")
+	require.True(t, h.OnACLCheck(melon, "devices/dev1/state", true))
+	require.False(t, h.OnACLCheck(melon, "devices/dev2/state", true))
+	require.False(t, h.OnACLCheck(melon, "devices/dev1/state", false))
+
+	require.True(t, h.OnACLCheck(newClient("cl3", "apple"), "any/topic", true))
+	require.False(t, h.OnACLCheck(newClient("cl4", "unknown"), "any/topic", true))
+
+	h.config.DefaultACL = Filters{"public/#": ReadOnly}
+	require.True(t, h.OnACLCheck(newClient("cl3", "apple"), "public/a", false))
+	require.False(t, h.OnACLCheck(newClient("cl3", "apple"), "any/topic", true))
+}
+
+func TestRedisHookUnreachable(t *testing.T) {
+	s := miniredis.RunT(t)
+	h := newRedisHook(t, s, &RedisOptions{Timeout: 100})
+	s.HSet("mqtt:users:peach", "password", "password1")
+	s.Close()
+
+	require.False(t, h.OnConnectAuthenticate(newClient("cl1", "peach"), connectPacket("peach", "password1")))
+	require.False(t, h.OnACLCheck(newClient("cl1", "peach"), "peach/a", true))
+}
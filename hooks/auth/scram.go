@@ -0,0 +1,453 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+)
+
+const (
+	// ScramSHA256 is the MQTT v5 authentication method of the SCRAM-SHA-256 auth hook.
+	ScramSHA256 = "SCRAM-SHA-256"
+
+	// defaultScramIterations is the default number of pbkdf2 iterations used to derive credentials.
+	defaultScramIterations = 4096
+
+	// scramNonceSize is the number of random bytes in a server nonce.
+	scramNonceSize = 18
+
+	// scramExchangeTimeout is the time after which an unfinished exchange is discarded.
+	scramExchangeTimeout = time.Minute
+)
+
+var (
+	// ErrInvalidScramCredential indicates a stored scram credential could not be parsed.
+	ErrInvalidScramCredential = errors.New("invalid scram credential")
+
+	// ErrInvalidScramMessage indicates a scram message from a client could not be parsed.
+	ErrInvalidScramMessage = errors.New("invalid scram message")
+
+	// ErrScramProofMismatch indicates a client did not prove it knows the password.
+	ErrScramProofMismatch = errors.New("scram client proof does not match")
+)
+
+// ScramOptions contains the configuration of the SCRAM-SHA-256 auth hook.
+type ScramOptions struct {
+	// Users maps usernames to credentials created by ScramCredential, or to plaintext passwords
+	// from which credentials are derived when the hook is initialised.
+	Users map[string]string `yaml:"users" json:"users"`
+
+	// Iterations is the number of pbkdf2 iterations used to derive credentials from plaintext
+	// passwords (default 4096).
+	Iterations int `yaml:"iterations" json:"iterations"`
+
+	// Ledger contains the ACL rules of authenticated clients. If nil, every authenticated client
+	// may publish and subscribe to any topic.
+	Ledger *Ledger `yaml:"ledger" json:"ledger"`
+}
+
+// scramCredential is the salted credential of a user, from which the password cannot be recovered.
+type scramCredential struct {
+	iterations int    // the pbkdf2 iterations
+	salt       []byte // the pbkdf2 salt
+	storedKey  []byte // the hash of the client key
+	serverKey  []byte // the key used to sign the server final message
+}
+
+// String encodes the credential as SCRAM-SHA-256$<iterations>:<salt>$<stored key>:<server key>.
+func (c scramCredential) String() string {
+	b64 := base64.StdEncoding
+	return fmt.Sprintf("%s$%d:%s$%s:%s", ScramSHA256, c.iterations, b64.EncodeToString(c.salt),
+		b64.EncodeToString(c.storedKey), b64.EncodeToString(c.serverKey))
+}
+
+// newScramCredential derives a credential from a password.
+func newScramCredential(password string, salt []byte, iterations int) (scramCredential, error) {
+	salted, err := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	if err != nil {
+		return scramCredential{}, err
+	}
+
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return scramCredential{
+		iterations: iterations,
+		salt:       salt,
+		storedKey:  storedKey[:],
+		serverKey:  scramHMAC(salted, "Server Key"),
+	}, nil
+}
+
+// parseScramCredential decodes a credential encoded by String.
+func parseScramCredential(s string) (c scramCredential, err error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 3 || parts[0] != ScramSHA256 {
+		return c, ErrInvalidScramCredential
+	}
+
+	iter, salt, ok := strings.Cut(parts[1], ":")
+	if !ok {
+		return c, ErrInvalidScramCredential
+	}
+
+	storedKey, serverKey, ok := strings.Cut(parts[2], ":")
+	if !ok {
+		return c, ErrInvalidScramCredential
+	}
+
+	b64 := base64.StdEncoding
+	c.iterations, err = strconv.Atoi(iter)
+	if err != nil || c.iterations <= 0 {
+		return c, ErrInvalidScramCredential
+	}
+
+	if c.salt, err = b64.DecodeString(salt); err != nil {
+		return c, ErrInvalidScramCredential
+	}
+
+	if c.storedKey, err = b64.DecodeString(storedKey); err != nil || len(c.storedKey) != sha256.Size {
+		return c, ErrInvalidScramCredential
+	}
+
+	if c.serverKey, err = b64.DecodeString(serverKey); err != nil || len(c.serverKey) != sha256.Size {
+		return c, ErrInvalidScramCredential
+	}
+
+	return c, nil
+}
+
+// ScramCredential returns a SCRAM-SHA-256 credential for a password with a random salt, which
+// can be stored in place of the password in ScramOptions.Users. If iterations is 0, the default
+// of 4096 is used.
+func ScramCredential(password string, iterations int) (string, error) {
+	if iterations <= 0 {
+		iterations = defaultScramIterations
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	c, err := newScramCredential(password, salt, iterations)
+	if err != nil {
+		return "", err
+	}
+
+	return c.String(), nil
+}
+
+// scramHMAC returns the hmac-sha256 of a message.
+func scramHMAC(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// scramExchange is the state of an unfinished exchange with a client.
+type scramExchange struct {
+	username        string          // the username of the client-first message
+	credential      scramCredential // the credential of the user
+	known           bool            // false if the user does not exist, and the credential is a decoy
+	gs2Header       string          // the gs2 header of the client-first message
+	clientFirstBare string          // the client-first message without the gs2 header
+	serverFirst     string          // the server-first message
+	nonce           string          // the combined client and server nonce
+	started         time.Time       // the time the exchange started
+}
+
+// ScramHook is an authentication hook which authenticates MQTT v5 clients with a
+// SCRAM-SHA-256 (RFC 7677) enhanced authentication exchange, so passwords are never sent
+// to the server.
+type ScramHook struct {
+	mqtt.HookBase
+	config    *ScramOptions
+	users     map[string]scramCredential
+	secret    []byte                          // the key used to derive decoy salts for unknown users
+	mu        sync.Mutex                      // guards exchanges
+	exchanges map[*mqtt.Client]*scramExchange // unfinished exchanges, keyed by client
+}
+
+// ID returns the ID of the hook.
+func (h *ScramHook) ID() string {
+	return "auth-scram"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *ScramHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnEnhancedAuth,
+		mqtt.OnACLCheck,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init configures the hook with the credentials of the users.
+func (h *ScramHook) Init(config any) error {
+	if _, ok := config.(*ScramOptions); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(ScramOptions)
+	}
+
+	h.config = config.(*ScramOptions)
+	if h.config.Iterations <= 0 {
+		h.config.Iterations = defaultScramIterations
+	}
+
+	h.secret = make([]byte, sha256.Size)
+	if _, err := rand.Read(h.secret); err != nil {
+		return err
+	}
+
+	h.users = make(map[string]scramCredential, len(h.config.Users))
+	for username, password := range h.config.Users {
+		var c scramCredential
+		var err error
+		if strings.HasPrefix(password, ScramSHA256+"$") {
+			c, err = parseScramCredential(password)
+		} else {
+			salt := make([]byte, saltSize)
+			if _, err = rand.Read(salt); err == nil {
+				c, err = newScramCredential(password, salt, h.config.Iterations)
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("user %s: %w", username, err)
+		}
+
+		h.users[username] = c
+	}
+
+	h.exchanges = make(map[*mqtt.Client]*scramExchange)
+
+	h.Log.Info("loaded scram auth users", "users", len(h.users))
+
+	return nil
+}
+
+// OnEnhancedAuth performs a step of a SCRAM-SHA-256 exchange with a client, responding to the
+// client-first message with the server-first message, and to the client-final message with the
+// server-final message if the client proves it knows the password.
+func (h *ScramHook) OnEnhancedAuth(cl *mqtt.Client, ea mqtt.EnhancedAuth) (packets.Code, []byte) {
+	if ea.Method != ScramSHA256 {
+		return packets.ErrBadAuthenticationMethod, nil
+	}
+
+	if ea.Start {
+		x, err := h.start(ea.Data)
+		if err == nil && (ea.Reauth || len(cl.Properties.Username) > 0) && x.username != string(cl.Properties.Username) {
+			err = fmt.Errorf("%w: username does not match client", ErrInvalidScramMessage)
+		}
+
+		if err != nil {
+			h.Log.Info("client failed authentication check", "error", err, "remote", cl.Net.Remote)
+			return packets.ErrNotAuthorized, nil
+		}
+
+		h.mu.Lock()
+		h.exchanges[cl] = x
+		h.mu.Unlock()
+
+		return packets.CodeContinueAuthentication, []byte(x.serverFirst)
+	}
+
+	h.mu.Lock()
+	x, ok := h.exchanges[cl]
+	delete(h.exchanges, cl)
+	h.mu.Unlock()
+	if !ok {
+		h.Log.Info("client failed authentication check", "error", "no scram exchange", "remote", cl.Net.Remote)
+		return packets.ErrNotAuthorized, nil
+	}
+
+	serverFinal, err := x.finish(ea.Data)
+	if err != nil {
+		h.Log.Info("client failed authentication check",
+			"error", err,
+			"username", x.username,
+			"remote", cl.Net.Remote)
+		return packets.ErrNotAuthorized, nil
+	}
+
+	if !ea.Reauth {
+		cl.Properties.Username = []byte(x.username)
+	}
+
+	return packets.CodeSuccess, []byte(serverFinal)
+}
+
+// OnACLCheck returns true if a client authenticated by the hook may publish or subscribe to
+// a topic, according to the ledger ACL rules if set.
+func (h *ScramHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	if cl.Properties.Props.AuthenticationMethod != ScramSHA256 {
+		return false
+	}
+
+	if h.config.Ledger == nil {
+		return true
+	}
+
+	_, ok := h.config.Ledger.ACLOk(cl, topic, write)
+	return ok
+}
+
+// OnDisconnect discards any unfinished exchange of a disconnected client.
+func (h *ScramHook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.exchanges, cl)
+}
+
+// start parses a client-first message and returns a new exchange. Unknown users are given a
+// decoy credential, so they cannot be distinguished from known users until the exchange fails.
+func (h *ScramHook) start(msg []byte) (*scramExchange, error) {
+	gs2Header, bare, ok := cutGS2Header(string(msg))
+	if !ok {
+		return nil, fmt.Errorf("%w: gs2 header", ErrInvalidScramMessage)
+	}
+
+	attrs := strings.Split(bare, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") || len(attrs[1]) == 2 {
+		return nil, fmt.Errorf("%w: client-first", ErrInvalidScramMessage)
+	}
+
+	username, ok := decodeScramName(attrs[0][2:])
+	if !ok {
+		return nil, fmt.Errorf("%w: username", ErrInvalidScramMessage)
+	}
+
+	nonce := make([]byte, scramNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	x := &scramExchange{
+		username:        username,
+		gs2Header:       gs2Header,
+		clientFirstBare: bare,
+		nonce:           attrs[1][2:] + base64.RawStdEncoding.EncodeToString(nonce),
+		started:         time.Now(),
+	}
+
+	x.credential, x.known = h.users[username]
+	if !x.known {
+		x.credential = scramCredential{
+			iterations: h.config.Iterations,
+			salt:       scramHMAC(h.secret, username)[:saltSize],
+		}
+	}
+
+	x.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", x.nonce,
+		base64.StdEncoding.EncodeToString(x.credential.salt), x.credential.iterations)
+
+	h.mu.Lock()
+	for cl, e := range h.exchanges {
+		if time.Since(e.started) > scramExchangeTimeout {
+			delete(h.exchanges, cl)
+		}
+	}
+	h.mu.Unlock()
+
+	return x, nil
+}
+
+// finish verifies the proof of a client-final message and returns the server-final message.
+func (x *scramExchange) finish(msg []byte) (string, error) {
+	withoutProof, proof, ok := strings.Cut(string(msg), ",p=")
+	if !ok {
+		return "", fmt.Errorf("%w: client-final", ErrInvalidScramMessage)
+	}
+
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 || attrs[0] != "c="+base64.StdEncoding.EncodeToString([]byte(x.gs2Header)) {
+		return "", fmt.Errorf("%w: channel binding", ErrInvalidScramMessage)
+	}
+
+	if attrs[1] != "r="+x.nonce {
+		return "", fmt.Errorf("%w: nonce", ErrInvalidScramMessage)
+	}
+
+	clientProof, err := base64.StdEncoding.DecodeString(proof)
+	if err != nil || len(clientProof) != sha256.Size {
+		return "", fmt.Errorf("%w: proof", ErrInvalidScramMessage)
+	}
+
+	if !x.known {
+		return "", ErrScramProofMismatch
+	}
+
+	authMessage := x.clientFirstBare + "," + x.serverFirst + "," + withoutProof
+	clientSignature := scramHMAC(x.credential.storedKey, authMessage)
+	clientKey := make([]byte, sha256.Size)
+	for i := range clientKey {
+		clientKey[i] = clientProof[i] ^ clientSignature[i]
+	}
+
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], x.credential.storedKey) != 1 {
+		return "", ErrScramProofMismatch
+	}
+
+	serverSignature := scramHMAC(x.credential.serverKey, authMessage)
+	return "v=" + base64.StdEncoding.EncodeToString(serverSignature), nil
+}
+
+// cutGS2Header splits a client-first message into its gs2 header and the bare message.
+// Channel binding is not supported, and an authorization identity is not permitted.
+func cutGS2Header(msg string) (header, bare string, ok bool) {
+	for _, prefix := range []string{"n,,", "y,,"} {
+		if strings.HasPrefix(msg, prefix) {
+			return prefix, msg[len(prefix):], true
+		}
+	}
+
+	return "", "", false
+}
+
+// decodeScramName decodes the =2C and =3D escapes of a scram username.
+func decodeScramName(s string) (string, bool) {
+	if s == "" || strings.Contains(s, ",") {
+		return "", false
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '=' {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(s[i:], "=2C"):
+			b.WriteByte(',')
+		case strings.HasPrefix(s[i:], "=3D"):
+			b.WriteByte('=')
+		default:
+			return "", false
+		}
+		i += 2
+	}
+
+	return b.String(), true
+}
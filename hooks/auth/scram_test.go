@@ -0,0 +1,323 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// scramClientFinal returns the client-final message for a server-first message, as sent by a
+// client which knows the password.
+func scramClientFinal(t *testing.T, clientFirstBare, serverFirst, password string) string {
+	attrs := strings.Split(serverFirst, ",")
+	require.Len(t, attrs, 3)
+	salt, err := base64.StdEncoding.DecodeString(attrs[1][2:])
+	require.NoError(t, err)
+	iter, err := strconv.Atoi(attrs[2][2:])
+	require.NoError(t, err)
+
+	salted, err := pbkdf2.Key(sha256.New, password, salt, iter, sha256.Size)
+	require.NoError(t, err)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	withoutProof := "c=biws," + attrs[0]
+	signature := scramHMAC(storedKey[:], clientFirstBare+","+serverFirst+","+withoutProof)
+	for i := range clientKey {
+		clientKey[i] ^= signature[i]
+	}
+
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(clientKey)
+}
+
+func newScramHook(t *testing.T, opts *ScramOptions) *ScramHook {
+	h := new(ScramHook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(opts))
+	return h
+}
+
+// scramConnect performs a scram exchange for a connecting client, returning the final result.
+func scramConnect(t *testing.T, h *ScramHook, cl *mqtt.Client, username, password string) (packets.Code, []byte) {
+	clientFirstBare := "n=" + username + ",r=fyko+d2lbbFgONRv9qkxdawL"
+	code, serverFirst := h.OnEnhancedAuth(cl, mqtt.EnhancedAuth{
+		Method: ScramSHA256,
+		Data:   []byte("n,," + clientFirstBare),
+		Start:  true,
+	})
+
+	if code != packets.CodeContinueAuthentication {
+		return code, serverFirst
+	}
+
+	return h.OnEnhancedAuth(cl, mqtt.EnhancedAuth{
+		Method: ScramSHA256,
+		Data:   []byte(scramClientFinal(t, clientFirstBare, string(serverFirst), password)),
+	})
+}
+
+func TestScramID(t *testing.T) {
+	h := new(ScramHook)
+	require.Equal(t, "auth-scram", h.ID())
+}
+
+func TestScramProvides(t *testing.T) {
+	h := new(ScramHook)
+	require.True(t, h.Provides(mqtt.OnEnhancedAuth))
+	require.True(t, h.Provides(mqtt.OnACLCheck))
+	require.True(t, h.Provides(mqtt.OnDisconnect))
+	require.False(t, h.Provides(mqtt.OnConnectAuthenticate))
+}
+
+func TestScramInitBadConfig(t *testing.T) {
+	h := new(ScramHook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+}
+
+func TestScramInitBadCredential(t *testing.T) {
+	h := new(ScramHook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&ScramOptions{Users: map[string]string{"mochi": "SCRAM-SHA-256$bad"}})
+	require.ErrorIs(t, err, ErrInvalidScramCredential)
+}
+
+func TestScramInitDefaults(t *testing.T) {
+	h := new(ScramHook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(nil))
+	require.Equal(t, defaultScramIterations, h.config.Iterations)
+	require.NotNil(t, h.exchanges)
+}
+
+func TestScramCredential(t *testing.T) {
+	s, err := ScramCredential("melon", 0)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(s, "SCRAM-SHA-256$4096:"))
+
+	c, err := parseScramCredential(s)
+	require.NoError(t, err)
+	require.Equal(t, s, c.String())
+
+	other, err := ScramCredential("melon", 100)
+	require.NoError(t, err)
+	require.NotEqual(t, s, other)
+	require.True(t, strings.HasPrefix(other, "SCRAM-SHA-256$100:"))
+}
+
+func TestParseScramCredentialInvalid(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	tt := []string{
+		"",
+		"SCRAM-SHA-1$4096:c2FsdA==$" + key + ":" + key,
+		"SCRAM-SHA-256$4096$" + key + ":" + key,
+		"SCRAM-SHA-256$4096:c2FsdA==$" + key,
+		"SCRAM-SHA-256$0:c2FsdA==$" + key + ":" + key,
+		"SCRAM-SHA-256$4096:!!$" + key + ":" + key,
+		"SCRAM-SHA-256$4096:c2FsdA==$c2FsdA==:" + key,
+		"SCRAM-SHA-256$4096:c2FsdA==$" + key + ":c2FsdA==",
+	}
+
+	for _, s := range tt {
+		_, err := parseScramCredential(s)
+		require.ErrorIs(t, err, ErrInvalidScramCredential, s)
+	}
+}
+
+func TestScramRFC7677(t *testing.T) {
+	salt, err := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	require.NoError(t, err)
+	c, err := newScramCredential("pencil", salt, 4096)
+	require.NoError(t, err)
+
+	x := &scramExchange{
+		username:        "user",
+		credential:      c,
+		known:           true,
+		gs2Header:       "n,,",
+		clientFirstBare: "n=user,r=rOprNGfwEbeRWgbNEkqO",
+		serverFirst:     "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		nonce:           "rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0",
+	}
+
+	serverFinal, err := x.finish([]byte("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="))
+	require.NoError(t, err)
+	require.Equal(t, "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=", serverFinal)
+}
+
+func TestScramOnEnhancedAuth(t *testing.T) {
+	cred, err := ScramCredential("lemon", 0)
+	require.NoError(t, err)
+	h := newScramHook(t, &ScramOptions{
+		Users: map[string]string{
+			"mochi": "melon",
+			"melon": cred,
+		},
+	})
+
+	cl := new(mqtt.Client)
+	code, data := scramConnect(t, h, cl, "mochi", "melon")
+	require.Equal(t, packets.CodeSuccess, code)
+	require.True(t, strings.HasPrefix(string(data), "v="))
+	require.Equal(t, []byte("mochi"), cl.Properties.Username)
+	require.Empty(t, h.exchanges)
+
+	code, _ = scramConnect(t, h, new(mqtt.Client), "melon", "lemon")
+	require.Equal(t, packets.CodeSuccess, code)
+
+	code, _ = scramConnect(t, h, new(mqtt.Client), "mochi", "lemon")
+	require.Equal(t, packets.ErrNotAuthorized, code)
+	require.Empty(t, h.exchanges)
+}
+
+func TestScramOnEnhancedAuthUnknownUser(t *testing.T) {
+	h := newScramHook(t, &ScramOptions{Users: map[string]string{"mochi": "melon"}})
+
+	data := []byte("n,,n=unknown,r=abc")
+	code, serverFirst := h.OnEnhancedAuth(new(mqtt.Client), mqtt.EnhancedAuth{Method: ScramSHA256, Data: data, Start: true})
+	require.Equal(t, packets.CodeContinueAuthentication, code) // indistinguishable from a known user
+
+	_, again := h.OnEnhancedAuth(new(mqtt.Client), mqtt.EnhancedAuth{Method: ScramSHA256, Data: data, Start: true})
+	require.Equal(t, strings.Split(string(serverFirst), ",")[1], strings.Split(string(again), ",")[1]) // stable salt
+
+	code, _ = scramConnect(t, h, new(mqtt.Client), "unknown", "melon")
+	require.Equal(t, packets.ErrNotAuthorized, code)
+}
+
+func TestScramOnEnhancedAuthOtherMethod(t *testing.T) {
+	h := newScramHook(t, new(ScramOptions))
+	code, _ := h.OnEnhancedAuth(new(mqtt.Client), mqtt.EnhancedAuth{Method: "SCRAM-SHA-1", Start: true})
+	require.Equal(t, packets.ErrBadAuthenticationMethod, code)
+}
+
+func TestScramOnEnhancedAuthUsernameMismatch(t *testing.T) {
+	h := newScramHook(t, &ScramOptions{Users: map[string]string{"mochi": "melon"}})
+	cl := &mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte("other")}}
+	code, _ := scramConnect(t, h, cl, "mochi", "melon")
+	require.Equal(t, packets.ErrNotAuthorized, code)
+}
+
+func TestScramOnEnhancedAuthReauth(t *testing.T) {
+	h := newScramHook(t, &ScramOptions{Users: map[string]string{"mochi": "melon", "melon": "lemon"}})
+	cl := &mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte("mochi")}}
+
+	code, _ := h.OnEnhancedAuth(cl, mqtt.EnhancedAuth{
+		Method: ScramSHA256,
+		Data:   []byte("n,,n=melon,r=abc"),
+		Start:  true,
+		Reauth: true,
+	})
+	require.Equal(t, packets.ErrNotAuthorized, code) // cannot change user when re-authenticating
+
+	code, _ = scramConnect(t, h, cl, "mochi", "melon")
+	require.Equal(t, packets.CodeSuccess, code)
+}
+
+func TestScramOnEnhancedAuthNoExchange(t *testing.T) {
+	h := newScramHook(t, &ScramOptions{Users: map[string]string{"mochi": "melon"}})
+	code, _ := h.OnEnhancedAuth(new(mqtt.Client), mqtt.EnhancedAuth{Method: ScramSHA256, Data: []byte("c=biws,r=abc,p=abc")})
+	require.Equal(t, packets.ErrNotAuthorized, code)
+}
+
+func TestScramClientFirstInvalid(t *testing.T) {
+	h := newScramHook(t, &ScramOptions{Users: map[string]string{"mochi": "melon"}})
+	tt := []string{
+		"",
+		"p=tls-unique,,n=mochi,r=abc",
+		"n,a=admin,n=mochi,r=abc",
+		"n,,r=abc",
+		"n,,n=mochi",
+		"n,,n=mochi,r=",
+		"n,,n=,r=abc",
+		"n,,n=mo=chi,r=abc",
+	}
+
+	for _, msg := range tt {
+		_, err := h.start([]byte(msg))
+		require.ErrorIs(t, err, ErrInvalidScramMessage, msg)
+	}
+}
+
+func TestScramClientFinalInvalid(t *testing.T) {
+	h := newScramHook(t, &ScramOptions{Users: map[string]string{"mochi": "melon"}})
+	x, err := h.start([]byte("n,,n=mochi,r=abc"))
+	require.NoError(t, err)
+
+	proof := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	tt := []struct {
+		msg string
+		err error
+	}{
+		{msg: "c=biws,r=" + x.nonce, err: ErrInvalidScramMessage},
+		{msg: "c=eSws,r=" + x.nonce + ",p=" + proof, err: ErrInvalidScramMessage},
+		{msg: "c=biws,r=abc,p=" + proof, err: ErrInvalidScramMessage},
+		{msg: "c=biws,r=" + x.nonce + ",p=!!", err: ErrInvalidScramMessage},
+		{msg: "c=biws,r=" + x.nonce + ",p=c2FsdA==", err: ErrInvalidScramMessage},
+		{msg: "c=biws,r=" + x.nonce + ",p=" + proof, err: ErrScramProofMismatch},
+	}
+
+	for _, tx := range tt {
+		_, err := x.finish([]byte(tx.msg))
+		require.ErrorIs(t, err, tx.err, tx.msg)
+	}
+}
+
+func TestDecodeScramName(t *testing.T) {
+	name, ok := decodeScramName("a=2Cb=3Dc")
+	require.True(t, ok)
+	require.Equal(t, "a,b=c", name)
+
+	_, ok = decodeScramName("a=2")
+	require.False(t, ok)
+}
+
+func TestScramExchangeExpiry(t *testing.T) {
+	h := newScramHook(t, &ScramOptions{Users: map[string]string{"mochi": "melon"}})
+	old := new(mqtt.Client)
+	code, _ := h.OnEnhancedAuth(old, mqtt.EnhancedAuth{Method: ScramSHA256, Data: []byte("n,,n=mochi,r=abc"), Start: true})
+	require.Equal(t, packets.CodeContinueAuthentication, code)
+	h.exchanges[old].started = time.Now().Add(-scramExchangeTimeout * 2)
+
+	code, _ = h.OnEnhancedAuth(new(mqtt.Client), mqtt.EnhancedAuth{Method: ScramSHA256, Data: []byte("n,,n=mochi,r=abc"), Start: true})
+	require.Equal(t, packets.CodeContinueAuthentication, code)
+	_, ok := h.exchanges[old]
+	require.False(t, ok)
+	require.Len(t, h.exchanges, 1)
+}
+
+func TestScramOnDisconnect(t *testing.T) {
+	h := newScramHook(t, &ScramOptions{Users: map[string]string{"mochi": "melon"}})
+	cl := new(mqtt.Client)
+	code, _ := h.OnEnhancedAuth(cl, mqtt.EnhancedAuth{Method: ScramSHA256, Data: []byte("n,,n=mochi,r=abc"), Start: true})
+	require.Equal(t, packets.CodeContinueAuthentication, code)
+
+	h.OnDisconnect(cl, nil, true)
+	require.Empty(t, h.exchanges)
+}
+
+func TestScramOnACLCheck(t *testing.T) {
+	h := newScramHook(t, new(ScramOptions))
+	cl := &mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte("mochi")}}
+	require.False(t, h.OnACLCheck(cl, "a/b", true))
+
+	cl.Properties.Props.AuthenticationMethod = ScramSHA256
+	require.True(t, h.OnACLCheck(cl, "a/b", true))
+
+	h.config.Ledger = &Ledger{
+		Users: Users{"mochi": {ACL: Filters{"mochi/#": ReadWrite, "a/#": Deny}}},
+	}
+	require.True(t, h.OnACLCheck(cl, "mochi/a", true))
+	require.False(t, h.OnACLCheck(cl, "a/b", true))
+}
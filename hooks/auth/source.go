@@ -0,0 +1,162 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxLedgerSourceSize is the maximum number of bytes read from a ledger url.
+const maxLedgerSourceSize = 16 << 20
+
+// ledgerSource is the state of the source the ledger was last loaded from.
+type ledgerSource struct {
+	file fileState         // the state of a file source
+	etag string            // the etag of a url source
+	sum  [sha256.Size]byte // a hash of the source data
+}
+
+// isURLSource returns true if a ledger source is an http or https url.
+func isURLSource(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// ReloadLedger reads the ledger from the source and replaces the rules of the ledger with it.
+// If the source cannot be read or is invalid, the current ledger is kept and an error is returned.
+func (h *Hook) ReloadLedger() error {
+	return h.reloadLedger(true)
+}
+
+// reloadLoop reloads the ledger every interval if the source has changed, until the hook is stopped.
+func (h *Hook) reloadLoop(interval time.Duration) {
+	defer close(h.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := h.reloadLedger(false); err != nil {
+				h.Log.Error("failed to reload auth ledger", "error", err, "source", h.config.Source)
+			}
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// reloadLedger reads the ledger from the source and atomically replaces the ledger if the
+// source has changed, or always if force is true. The ACL decisions cached by the server are
+// invalidated when the ledger is replaced.
+func (h *Hook) reloadLedger(force bool) error {
+	h.sourceMu.Lock()
+	defer h.sourceMu.Unlock()
+
+	data, changed, err := h.readSource(force)
+	if err != nil || !changed {
+		return err
+	}
+
+	ln := new(Ledger)
+	if err := ln.Unmarshal(data); err != nil {
+		return err
+	}
+
+	if err := ln.Validate(); err != nil {
+		return err
+	}
+
+	h.ledger.Replace(ln)
+	if h.Opts != nil {
+		h.Opts.AuthCache.InvalidateAll()
+	}
+
+	h.Log.Info("loaded auth ledger",
+		"source", h.config.Source,
+		"users", len(ln.Users),
+		"authentication", len(ln.Auth),
+		"acl", len(ln.ACL))
+
+	return nil
+}
+
+// readSource reads the data of the ledger source, returning false if it has not changed since
+// it was last read. Unchanged sources are only read again if force is true.
+func (h *Hook) readSource(force bool) (data []byte, changed bool, err error) {
+	if isURLSource(h.config.Source) {
+		data, changed, err = h.fetchSource(force)
+	} else {
+		state := statFile(h.config.Source)
+		if !force && state == h.source.file {
+			return nil, false, nil
+		}
+
+		h.source.file = state
+		data, err = os.ReadFile(h.config.Source)
+		changed = true
+	}
+
+	if err != nil || !changed {
+		return nil, false, err
+	}
+
+	sum := sha256.Sum256(data)
+	if !force && sum == h.source.sum {
+		return nil, false, nil
+	}
+
+	h.source.sum = sum
+	return data, true, nil
+}
+
+// fetchSource requests the ledger from a url source. The etag of the previous response is
+// sent unless force is true, so an unchanged ledger does not need to be transferred.
+func (h *Hook) fetchSource(force bool) (data []byte, changed bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*defaultBackendTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.config.Source, nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for k, v := range h.config.SourceHeaders {
+		req.Header.Set(k, v)
+	}
+
+	if !force && h.source.etag != "" {
+		req.Header.Set("If-None-Match", h.source.etag)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, false, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, false, fmt.Errorf("%w: %d", ErrHTTPStatus, resp.StatusCode)
+	}
+
+	data, err = io.ReadAll(io.LimitReader(resp.Body, maxLedgerSourceSize))
+	if err != nil {
+		return nil, false, err
+	}
+
+	h.source.etag = resp.Header.Get("ETag")
+	return data, true, nil
+}
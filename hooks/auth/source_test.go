@@ -0,0 +1,141 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	sourceLedgerPeach = `
+users:
+  peach:
+    password: password1
+`
+	sourceLedgerMelon = `{"users": {"melon": {"password": "password2"}}}`
+)
+
+func newSourceHook(t *testing.T, opts *Options) *Hook {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(opts))
+	t.Cleanup(func() { _ = h.Stop() })
+	return h
+}
+
+func sourceAuthOk(h *Hook, username, password string) bool {
+	cl := &mqtt.Client{Properties: mqtt.ClientProperties{Username: []byte(username)}}
+	return h.OnConnectAuthenticate(cl, packets.Packet{Connect: packets.ConnectParams{Password: []byte(password)}})
+}
+
+func TestLedgerSourceFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(sourceLedgerPeach), 0600))
+
+	h := newSourceHook(t, &Options{Source: path, ReloadInterval: -1})
+	require.Nil(t, h.done)
+	require.True(t, sourceAuthOk(h, "peach", "password1"))
+
+	require.NoError(t, os.WriteFile(path, []byte(sourceLedgerMelon), 0600))
+	require.NoError(t, h.reloadLedger(false))
+	require.False(t, sourceAuthOk(h, "peach", "password1"))
+	require.True(t, sourceAuthOk(h, "melon", "password2"))
+
+	// an invalid source keeps the current ledger
+	require.NoError(t, os.WriteFile(path, []byte(`client_ids: [{pattern: "dev-("}]`), 0600))
+	require.ErrorIs(t, h.reloadLedger(false), ErrInvalidClientIDPattern)
+	require.True(t, sourceAuthOk(h, "melon", "password2"))
+
+	require.NoError(t, os.Remove(path))
+	require.Error(t, h.ReloadLedger())
+	require.True(t, sourceAuthOk(h, "melon", "password2"))
+}
+
+func TestLedgerSourceFileMissing(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.Error(t, h.Init(&Options{Source: filepath.Join(t.TempDir(), "missing.yaml")}))
+}
+
+func TestLedgerSourceURL(t *testing.T) {
+	var mu sync.Mutex
+	var requests, transfers int64
+	body, etag := sourceLedgerPeach, `"v1"`
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		atomic.AddInt64(&requests, 1)
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		atomic.AddInt64(&transfers, 1)
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Init(&Options{Source: srv.URL, ReloadInterval: -1}), ErrHTTPStatus)
+
+	h = newSourceHook(t, &Options{
+		Source:         srv.URL,
+		SourceHeaders:  map[string]string{"Authorization": "Bearer token"},
+		ReloadInterval: -1,
+	})
+	require.True(t, sourceAuthOk(h, "peach", "password1"))
+
+	require.NoError(t, h.reloadLedger(false))
+	require.Equal(t, int64(1), atomic.LoadInt64(&transfers))
+
+	mu.Lock()
+	body, etag = sourceLedgerMelon, `"v2"`
+	mu.Unlock()
+
+	require.NoError(t, h.reloadLedger(false))
+	require.Equal(t, int64(2), atomic.LoadInt64(&transfers))
+	require.True(t, sourceAuthOk(h, "melon", "password2"))
+}
+
+func TestLedgerSourceReloadLoop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(sourceLedgerPeach), 0600))
+
+	s := mqtt.New(&mqtt.Options{Logger: logger, AuthCache: &mqtt.AuthCacheOptions{TTL: 60000}})
+	h := new(Hook)
+	require.NoError(t, s.AddHook(h, &Options{Source: path, ReloadInterval: 1}))
+	require.Equal(t, int64(1), h.config.ReloadInterval)
+
+	cl := &mqtt.Client{ID: "cl1"}
+	s.AuthCache.Set(cl, "a/b", true, true)
+
+	require.NoError(t, os.WriteFile(path, []byte(sourceLedgerMelon), 0600))
+	require.Eventually(t, func() bool {
+		return sourceAuthOk(h, "melon", "password2")
+	}, time.Second*3, time.Millisecond*50)
+	require.Equal(t, 0, s.AuthCache.Len())
+
+	require.NoError(t, h.Stop())
+	require.NoError(t, h.Stop())
+}
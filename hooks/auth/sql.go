@@ -0,0 +1,281 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+)
+
+const (
+	// defaultSQLMaxOpenConns is the default maximum number of open database connections.
+	defaultSQLMaxOpenConns = 10
+
+	// defaultSQLMaxIdleConns is the default maximum number of idle database connections.
+	defaultSQLMaxIdleConns = 2
+)
+
+var (
+	// ErrNoSQLDatabase indicates neither a database nor a driver was configured.
+	ErrNoSQLDatabase = errors.New("no sql auth database or driver")
+
+	// ErrNoSQLUserQuery indicates no query was configured to select the passwords of users.
+	ErrNoSQLUserQuery = errors.New("no sql auth user query")
+)
+
+// SQLOptions contains the configuration of the SQL auth hook. The queries are written for the
+// database being used, such as with $1 placeholders for PostgreSQL, and are prepared when the
+// hook is initialised.
+type SQLOptions struct {
+	// Driver is the database/sql driver name, such as pgx or postgres, used with DSN if DB is not set.
+	// The driver must be imported by the application.
+	Driver string `yaml:"driver" json:"driver"`
+
+	// DSN is the data source name passed to the driver.
+	DSN string `yaml:"dsn" json:"dsn"`
+
+	// UserQuery selects the password or password hash of a user, taking the username as its
+	// only argument, such as `SELECT password_hash FROM mqtt_users WHERE username = $1 LIMIT 1`.
+	UserQuery string `yaml:"user_query" json:"user_query"`
+
+	// SuperuserQuery selects a count which is greater than 0 if a user is a superuser, taking
+	// the username as its only argument. Superusers skip ACL checks. No users are superusers if empty.
+	SuperuserQuery string `yaml:"superuser_query" json:"superuser_query"`
+
+	// ACLQuery selects the filters a user may access, taking the username and the access being
+	// checked (1 for read, 2 for write) as arguments, such as
+	// `SELECT topic FROM mqtt_acls WHERE username = $1 AND rw & $2 != 0`. Filters may contain
+	// %c and %u placeholders. Authenticated clients may access any topic if empty.
+	ACLQuery string `yaml:"acl_query" json:"acl_query"`
+
+	// MaxOpenConns is the maximum number of open connections in the pool (default 10).
+	MaxOpenConns int `yaml:"max_open_conns" json:"max_open_conns"`
+
+	// MaxIdleConns is the maximum number of idle connections in the pool (default 2).
+	MaxIdleConns int `yaml:"max_idle_conns" json:"max_idle_conns"`
+
+	// ConnMaxLifetime is the maximum seconds a connection is reused for. Connections are reused
+	// forever if 0.
+	ConnMaxLifetime int64 `yaml:"conn_max_lifetime" json:"conn_max_lifetime"`
+
+	// Timeout is the milliseconds to wait for a query before the check fails (default 5000).
+	Timeout int64 `yaml:"timeout" json:"timeout"`
+
+	// DB is an optional database handle, which takes precedence over Driver and DSN.
+	// A handle passed in DB is not closed when the hook stops.
+	DB *sql.DB `yaml:"-" json:"-"`
+}
+
+// SQLHook is an authentication hook which checks the credentials and ACLs of clients with
+// queries against a SQL database, such as PostgreSQL.
+type SQLHook struct {
+	mqtt.HookBase
+	config    *SQLOptions
+	db        *sql.DB   // the database handle
+	owned     bool      // the database was opened by the hook, and is closed when it stops
+	user      *sql.Stmt // the prepared user query
+	superuser *sql.Stmt // the prepared superuser query, if set
+	acl       *sql.Stmt // the prepared acl query, if set
+}
+
+// ID returns the ID of the hook.
+func (h *SQLHook) ID() string {
+	return "auth-sql"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *SQLHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnACLCheck,
+	}, []byte{b})
+}
+
+// Init connects to the database and prepares the queries.
+func (h *SQLHook) Init(config any) error {
+	if _, ok := config.(*SQLOptions); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(SQLOptions)
+	}
+
+	h.config = config.(*SQLOptions)
+	if h.config.DB == nil && h.config.Driver == "" {
+		return ErrNoSQLDatabase
+	}
+
+	if h.config.UserQuery == "" {
+		return ErrNoSQLUserQuery
+	}
+
+	if h.config.MaxOpenConns == 0 {
+		h.config.MaxOpenConns = defaultSQLMaxOpenConns
+	}
+
+	if h.config.MaxIdleConns == 0 {
+		h.config.MaxIdleConns = defaultSQLMaxIdleConns
+	}
+
+	if h.config.Timeout == 0 {
+		h.config.Timeout = defaultBackendTimeout
+	}
+
+	h.db = h.config.DB
+	if h.db == nil {
+		db, err := sql.Open(h.config.Driver, h.config.DSN)
+		if err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+
+		db.SetMaxOpenConns(h.config.MaxOpenConns)
+		db.SetMaxIdleConns(h.config.MaxIdleConns)
+		db.SetConnMaxLifetime(time.Duration(h.config.ConnMaxLifetime) * time.Second)
+		h.db = db
+		h.owned = true
+	}
+
+	if err := h.prepare(); err != nil {
+		_ = h.Stop()
+		return err
+	}
+
+	h.Log.Info("loaded sql auth",
+		"driver", h.config.Driver,
+		"superusers", h.superuser != nil,
+		"acl", h.acl != nil)
+
+	return nil
+}
+
+// prepare prepares the configured queries.
+func (h *SQLHook) prepare() error {
+	ctx, cancel := h.context(context.Background())
+	defer cancel()
+
+	var err error
+	for _, q := range []struct {
+		query string
+		stmt  **sql.Stmt
+	}{
+		{h.config.UserQuery, &h.user},
+		{h.config.SuperuserQuery, &h.superuser},
+		{h.config.ACLQuery, &h.acl},
+	} {
+		if q.query == "" {
+			continue
+		}
+
+		if *q.stmt, err = h.db.PrepareContext(ctx, q.query); err != nil {
+			return fmt.Errorf("failed to prepare query %q: %w", q.query, err)
+		}
+	}
+
+	return nil
+}
+
+// Stop closes the prepared queries, and the database if it was opened by the hook.
+func (h *SQLHook) Stop() error {
+	for _, stmt := range []*sql.Stmt{h.user, h.superuser, h.acl} {
+		if stmt != nil {
+			_ = stmt.Close()
+		}
+	}
+	h.user, h.superuser, h.acl = nil, nil, nil
+
+	db := h.db
+	h.db = nil
+	if db != nil && h.owned {
+		return db.Close()
+	}
+
+	return nil
+}
+
+// context returns a context derived from parent which is cancelled after the query timeout.
+func (h *SQLHook) context(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, time.Duration(h.config.Timeout)*time.Millisecond)
+}
+
+// OnConnectAuthenticate returns true if the password of the client matches the password or
+// password hash selected by the user query.
+func (h *SQLHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	ctx, cancel := h.context(cl.Context())
+	defer cancel()
+
+	username := string(pk.Connect.Username)
+	var password string
+	err := h.user.QueryRowContext(ctx, username).Scan(&password)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !RString(password).passwordEquals(pk.Connect.Password)) {
+		h.Log.Info("client failed authentication check",
+			"username", username,
+			"remote", cl.Net.Remote)
+		return false
+	} else if err != nil {
+		h.Log.Warn("sql auth query failed", "error", err, "username", username)
+		return false
+	}
+
+	if h.superuser != nil {
+		var n int64
+		if err := h.superuser.QueryRowContext(ctx, username).Scan(&n); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			h.Log.Warn("sql superuser query failed", "error", err, "username", username)
+		} else if n > 0 {
+			cl.SetSuperuser(true)
+		}
+	}
+
+	return true
+}
+
+// OnACLCheck returns true if any of the filters selected by the acl query for the user match
+// the topic, or if there is no acl query.
+func (h *SQLHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	if h.acl == nil {
+		return true
+	}
+
+	access := ReadOnly
+	if write {
+		access = WriteOnly
+	}
+
+	ctx, cancel := h.context(cl.Context())
+	defer cancel()
+
+	username := string(cl.Properties.Username)
+	rows, err := h.acl.QueryContext(ctx, username, int(access))
+	if err != nil {
+		h.Log.Warn("sql acl query failed", "error", err, "username", username)
+		return false
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var filter string
+		if err := rows.Scan(&filter); err != nil {
+			h.Log.Warn("sql acl query failed", "error", err, "username", username)
+			return false
+		}
+
+		if RString(filter).ClientFilterMatches(cl, topic) {
+			return true
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		h.Log.Warn("sql acl query failed", "error", err, "username", username)
+	}
+
+	return false
+}
@@ -0,0 +1,152 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/stretchr/testify/require"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	sqlUserQuery      = "SELECT password FROM mqtt_users WHERE username = ? LIMIT 1"
+	sqlSuperuserQuery = "SELECT COUNT(*) FROM mqtt_users WHERE username = ? AND admin = 1"
+	sqlACLQuery       = "SELECT topic FROM mqtt_acls WHERE username = ? AND rw & ? != 0"
+)
+
+// newSQLAuthDB returns a sqlite database with users and acls.
+func newSQLAuthDB(t *testing.T) string {
+	dsn := filepath.Join(t.TempDir(), "auth.db")
+	db, err := sql.Open("sqlite", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	hash, err := HashPassword(HashBcrypt, "password2")
+	require.NoError(t, err)
+
+	for _, stmt := range []string{
+		"CREATE TABLE mqtt_users (username TEXT PRIMARY KEY, password TEXT NOT NULL, admin INTEGER NOT NULL DEFAULT 0)",
+		"CREATE TABLE mqtt_acls (username TEXT NOT NULL, topic TEXT NOT NULL, rw INTEGER NOT NULL)",
+		"INSERT INTO mqtt_users (username, password) VALUES ('peach', 'password1')",
+		"INSERT INTO mqtt_users (username, password) VALUES ('melon', '" + hash + "')",
+		"INSERT INTO mqtt_users (username, password, admin) VALUES ('admin', 'password3', 1)",
+		"INSERT INTO mqtt_acls (username, topic, rw) VALUES ('peach', 'peach/#', 3)",
+		"INSERT INTO mqtt_acls (username, topic, rw) VALUES ('peach', 'news/#', 1)",
+		"INSERT INTO mqtt_acls (username, topic, rw) VALUES ('melon', 'devices/%c/#', 2)",
+	} {
+		_, err := db.Exec(stmt)
+		require.NoError(t, err)
+	}
+
+	return dsn
+}
+
+func newSQLHook(t *testing.T, opts *SQLOptions) *SQLHook {
+	h := new(SQLHook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(opts))
+	t.Cleanup(func() { _ = h.Stop() })
+	return h
+}
+
+func TestSQLHookID(t *testing.T) {
+	h := new(SQLHook)
+	require.Equal(t, "auth-sql", h.ID())
+}
+
+func TestSQLHookProvides(t *testing.T) {
+	h := new(SQLHook)
+	require.True(t, h.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, h.Provides(mqtt.OnACLCheck))
+	require.False(t, h.Provides(mqtt.OnPublish))
+}
+
+func TestSQLHookInitBadConfig(t *testing.T) {
+	h := new(SQLHook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, h.Init(nil), ErrNoSQLDatabase)
+	require.ErrorIs(t, h.Init(&SQLOptions{Driver: "sqlite"}), ErrNoSQLUserQuery)
+	require.Error(t, h.Init(&SQLOptions{Driver: "missing", UserQuery: sqlUserQuery}))
+	require.Nil(t, h.db)
+
+	// queries which cannot be prepared fail, and the hook is stopped
+	db, err := sql.Open("sqlite", newSQLAuthDB(t))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	require.Error(t, h.Init(&SQLOptions{DB: db, UserQuery: sqlUserQuery}))
+	require.Nil(t, h.db)
+}
+
+func TestSQLHookInitDefaults(t *testing.T) {
+	h := newSQLHook(t, &SQLOptions{Driver: "sqlite", DSN: newSQLAuthDB(t), UserQuery: sqlUserQuery})
+	require.Equal(t, defaultSQLMaxOpenConns, h.config.MaxOpenConns)
+	require.Equal(t, defaultSQLMaxIdleConns, h.config.MaxIdleConns)
+	require.Equal(t, int64(defaultBackendTimeout), h.config.Timeout)
+	require.Equal(t, defaultSQLMaxOpenConns, h.db.Stats().MaxOpenConnections)
+	require.True(t, h.owned)
+}
+
+func TestSQLHookOnConnectAuthenticate(t *testing.T) {
+	h := newSQLHook(t, &SQLOptions{
+		Driver:         "sqlite",
+		DSN:            newSQLAuthDB(t),
+		UserQuery:      sqlUserQuery,
+		SuperuserQuery: sqlSuperuserQuery,
+	})
+
+	peach := newClient("cl1", "peach")
+	require.True(t, h.OnConnectAuthenticate(peach, connectPacket("peach", "password1")))
+	require.False(t, peach.IsSuperuser())
+	require.False(t, h.OnConnectAuthenticate(peach, connectPacket("peach", "wrong")))
+	require.True(t, h.OnConnectAuthenticate(newClient("cl2", "melon"), connectPacket("melon", "password2")))
+	require.False(t, h.OnConnectAuthenticate(newClient("cl3", "apple"), connectPacket("apple", "")))
+
+	admin := newClient("cl4", "admin")
+	require.True(t, h.OnConnectAuthenticate(admin, connectPacket("admin", "password3")))
+	require.True(t, admin.IsSuperuser())
+}
+
+func TestSQLHookOnACLCheck(t *testing.T) {
+	db, err := sql.Open("sqlite", newSQLAuthDB(t))
+	require.NoError(t, err)
+	defer db.Close()
+
+	h := newSQLHook(t, &SQLOptions{DB: db, UserQuery: sqlUserQuery, ACLQuery: sqlACLQuery})
+	require.False(t, h.owned)
+
+	peach := newClient("cl1", "peach")
+	require.True(t, h.OnACLCheck(peach, "peach/a", true))
+	require.True(t, h.OnACLCheck(peach, "peach/a", false))
+	require.True(t, h.OnACLCheck(peach, "news/a", false))
+	require.False(t, h.OnACLCheck(peach, "news/a", true))
+	require.False(t, h.OnACLCheck(peach, "other", false))
+
+	melon := newClient("dev1", "melon")
+	require.True(t, h.OnACLCheck(melon, "devices/dev1/state", true))
+	require.False(t, h.OnACLCheck(melon, "devices/dev2/state", true))
+	require.False(t, h.OnACLCheck(melon, "devices/dev1/state", false))
+
+	require.NoError(t, h.Stop())
+	require.NoError(t, db.Ping()) // a database passed in DB is not closed
+}
+
+func TestSQLHookNoACLQuery(t *testing.T) {
+	h := newSQLHook(t, &SQLOptions{Driver: "sqlite", DSN: newSQLAuthDB(t), UserQuery: sqlUserQuery})
+	require.True(t, h.OnACLCheck(newClient("cl1", "peach"), "any/topic", true))
+}
+
+func TestSQLHookQueryFailure(t *testing.T) {
+	h := newSQLHook(t, &SQLOptions{Driver: "sqlite", DSN: newSQLAuthDB(t), UserQuery: sqlUserQuery, ACLQuery: sqlACLQuery})
+	require.NoError(t, h.db.Close())
+
+	require.False(t, h.OnConnectAuthenticate(newClient("cl1", "peach"), connectPacket("peach", "password1")))
+	require.False(t, h.OnACLCheck(newClient("cl1", "peach"), "peach/a", true))
+}
@@ -0,0 +1,481 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+)
+
+const (
+	VaultEngineKV       = "kv"       // credentials are read from a kv secrets engine
+	VaultEngineDatabase = "database" // credentials are read from database secrets engine static roles
+
+	// defaultVaultKVPath is the default path of the user secrets in the kv engine.
+	defaultVaultKVPath = "mqtt/users"
+
+	// defaultVaultRenewRetry is the seconds to wait before retrying a failed token renewal.
+	defaultVaultRenewRetry = 10
+)
+
+var (
+	// ErrNoVaultAddress indicates the address of the vault server was not configured.
+	ErrNoVaultAddress = errors.New("no vault address")
+
+	// ErrUnknownVaultEngine indicates the secrets engine credentials are read from is not supported.
+	ErrUnknownVaultEngine = errors.New("unknown vault secrets engine")
+)
+
+// VaultOptions contains the configuration of the HashiCorp Vault auth hook.
+type VaultOptions struct {
+	// Address is the address of the vault server, such as https://vault:8200.
+	Address string `yaml:"address" json:"address"`
+
+	// Token is the vault token used to read credentials.
+	Token string `yaml:"token" json:"token"`
+
+	// Namespace is the vault enterprise namespace of the secrets engine, if set.
+	Namespace string `yaml:"namespace" json:"namespace"`
+
+	// Engine is the secrets engine credentials are read from: kv or database (default kv).
+	// A kv secret is read for each username, containing its password (or a password hash,
+	// such as one created by HashPassword) and optionally its acl filters. The database
+	// engine reads the current password of the static role named after the username.
+	Engine string `yaml:"engine" json:"engine"`
+
+	// Mount is the path the secrets engine is mounted at (default secret for kv, and
+	// database for the database engine).
+	Mount string `yaml:"mount" json:"mount"`
+
+	// Path is the path of the user secrets within the kv engine (default mqtt/users).
+	Path string `yaml:"path" json:"path"`
+
+	// KVVersion is the version of the kv engine, 1 or 2 (default 2).
+	KVVersion int `yaml:"kv_version" json:"kv_version"`
+
+	// DefaultACL contains the topic filters of users whose secrets contain no acl filters.
+	// If not set, such users may publish and subscribe to any topic.
+	DefaultACL Filters `yaml:"default_acl" json:"default_acl"`
+
+	// CacheTTL is the seconds credentials are cached for, so repeated checks do not read
+	// them from vault. Credentials are not cached if 0, and database credentials are not
+	// cached beyond their next rotation.
+	CacheTTL int64 `yaml:"cache_ttl" json:"cache_ttl"`
+
+	// CacheSize is the maximum number of cached credentials (default 10000).
+	CacheSize int `yaml:"cache_size" json:"cache_size"`
+
+	// RenewToken renews the lease of the vault token before it expires, if it is renewable.
+	RenewToken bool `yaml:"renew_token" json:"renew_token"`
+
+	// Timeout is the milliseconds to wait for a response from vault (default 5000).
+	Timeout int64 `yaml:"timeout" json:"timeout"`
+
+	// Client is the http client used to make requests, if set.
+	Client *http.Client `yaml:"-" json:"-"`
+}
+
+// vaultResponse is a response from the vault api.
+type vaultResponse struct {
+	Data json.RawMessage `json:"data"`
+	Auth *struct {
+		LeaseDuration int64 `json:"lease_duration"`
+		Renewable     bool  `json:"renewable"`
+	} `json:"auth"`
+}
+
+// vaultSecret is the data of a user secret in the kv engine or a database static role.
+type vaultSecret struct {
+	Data     json.RawMessage `json:"data"` // the secret of a kv version 2 engine
+	Password string          `json:"password"`
+	ACL      Filters         `json:"acl"`
+	TTL      int64           `json:"ttl"` // the seconds until a database static role is rotated
+}
+
+// vaultUser contains the credentials of a user read from vault.
+type vaultUser struct {
+	found    bool      // a secret exists for the user
+	password RString   // the password or password hash of the user
+	acl      Filters   // the acl filters of the user, if set
+	expires  time.Time // the time the cached credentials expire
+}
+
+// VaultHook is an authentication hook which checks clients against credentials and ACL
+// filters read from HashiCorp Vault.
+type VaultHook struct {
+	mqtt.HookBase
+	config *VaultOptions
+	client *http.Client
+	mu     sync.Mutex           // guards cache
+	cache  map[string]vaultUser // cached credentials, keyed on username
+	done   chan struct{}        // closed when the hook is stopped
+	wg     sync.WaitGroup       // waits for the token renewal to stop
+}
+
+// ID returns the ID of the hook.
+func (h *VaultHook) ID() string {
+	return "auth-vault"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *VaultHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnACLCheck,
+	}, []byte{b})
+}
+
+// Init configures the hook with the vault server and secrets engine, and starts renewing
+// the vault token if required.
+func (h *VaultHook) Init(config any) error {
+	if _, ok := config.(*VaultOptions); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(VaultOptions)
+	}
+
+	h.config = config.(*VaultOptions)
+	if h.config.Address == "" {
+		return ErrNoVaultAddress
+	}
+
+	if h.config.Engine == "" {
+		h.config.Engine = VaultEngineKV
+	}
+
+	switch h.config.Engine {
+	case VaultEngineKV:
+		if h.config.Mount == "" {
+			h.config.Mount = "secret"
+		}
+
+		if h.config.Path == "" {
+			h.config.Path = defaultVaultKVPath
+		}
+
+		if h.config.KVVersion == 0 {
+			h.config.KVVersion = 2
+		}
+	case VaultEngineDatabase:
+		if h.config.Mount == "" {
+			h.config.Mount = "database"
+		}
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownVaultEngine, h.config.Engine)
+	}
+
+	if h.config.Timeout <= 0 {
+		h.config.Timeout = defaultBackendTimeout
+	}
+
+	if h.config.CacheSize <= 0 {
+		h.config.CacheSize = defaultHTTPCacheSize
+	}
+
+	h.client = h.config.Client
+	if h.client == nil {
+		h.client = new(http.Client)
+	}
+
+	h.cache = make(map[string]vaultUser)
+	h.done = make(chan struct{})
+
+	if h.config.RenewToken {
+		resp, err := h.request(http.MethodGet, "auth/token/lookup-self")
+		if err == nil && resp == nil {
+			err = fmt.Errorf("%w: %d", ErrHTTPStatus, http.StatusNotFound)
+		}
+
+		if err != nil {
+			return fmt.Errorf("lookup vault token: %w", err)
+		}
+
+		var token struct {
+			TTL       int64 `json:"ttl"`
+			Renewable bool  `json:"renewable"`
+		}
+
+		if err := json.Unmarshal(resp.Data, &token); err != nil {
+			return fmt.Errorf("lookup vault token: %w", err)
+		}
+
+		if token.Renewable && token.TTL > 0 {
+			h.wg.Add(1)
+			go h.renewToken(token.TTL)
+		}
+	}
+
+	h.Log.Info("loaded vault auth",
+		"address", h.config.Address,
+		"engine", h.config.Engine,
+		"mount", h.config.Mount)
+
+	return nil
+}
+
+// Stop stops renewing the vault token.
+func (h *VaultHook) Stop() error {
+	if h.done != nil {
+		close(h.done)
+		h.wg.Wait()
+		h.done = nil
+	}
+
+	return nil
+}
+
+// OnConnectAuthenticate returns true if the connect password matches the credentials of the
+// user in vault. If cached credentials do not match, they are read again in case the password
+// has been changed or rotated.
+func (h *VaultHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	username := string(pk.Connect.Username)
+	u, cached, err := h.user(username, false)
+	if err == nil && cached && !(u.found && u.password.passwordEquals(pk.Connect.Password)) {
+		u, _, err = h.user(username, true)
+	}
+
+	if err != nil {
+		h.Log.Warn("vault auth request failed", "error", err, "username", username)
+		return false
+	}
+
+	if !u.found || !u.password.passwordEquals(pk.Connect.Password) {
+		h.Log.Info("client failed authentication check",
+			"username", username,
+			"remote", cl.Net.Remote)
+		return false
+	}
+
+	return true
+}
+
+// OnACLCheck returns true if the acl filters of the user in vault allow the client to publish
+// or subscribe to a topic. Deny filters take precedence.
+func (h *VaultHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	u, _, err := h.user(string(cl.Properties.Username), false)
+	if err != nil {
+		h.Log.Warn("vault auth request failed", "error", err, "username", string(cl.Properties.Username))
+		return false
+	}
+
+	if !u.found {
+		return false
+	}
+
+	filters := u.acl
+	if filters == nil {
+		filters = h.config.DefaultACL
+	}
+
+	if filters == nil {
+		return true
+	}
+
+	var allow bool
+	for filter, access := range filters {
+		if !filter.ClientFilterMatches(cl, topic) {
+			continue
+		}
+
+		switch access {
+		case Deny:
+			return false
+		case ReadOnly:
+			allow = allow || !write
+		case WriteOnly:
+			allow = allow || write
+		case ReadWrite:
+			allow = true
+		}
+	}
+
+	if !allow {
+		h.Log.Debug("client failed allowed ACL check",
+			"client", cl.ID,
+			"username", string(cl.Properties.Username),
+			"topic", topic)
+	}
+
+	return allow
+}
+
+// user returns the credentials of a user, and whether they were cached. Cached credentials
+// are ignored if fresh is true.
+func (h *VaultHook) user(username string, fresh bool) (vaultUser, bool, error) {
+	now := time.Now()
+	if !fresh && h.config.CacheTTL > 0 {
+		h.mu.Lock()
+		u, ok := h.cache[username]
+		h.mu.Unlock()
+		if ok && now.Before(u.expires) {
+			return u, true, nil
+		}
+	}
+
+	u, err := h.read(username)
+	if err != nil {
+		return u, false, err
+	}
+
+	if h.config.CacheTTL > 0 {
+		expires := now.Add(time.Duration(h.config.CacheTTL) * time.Second)
+		if u.expires.IsZero() || expires.Before(u.expires) {
+			u.expires = expires
+		}
+		h.store(username, u)
+	}
+
+	return u, false, nil
+}
+
+// read reads the credentials of a user from vault.
+func (h *VaultHook) read(username string) (vaultUser, error) {
+	var u vaultUser
+	if username == "" || username == "." || username == ".." || strings.ContainsAny(username, "/?#%") {
+		return u, nil // not a valid secret name
+	}
+
+	var path string
+	switch {
+	case h.config.Engine == VaultEngineDatabase:
+		path = h.config.Mount + "/static-creds/" + username
+	case h.config.KVVersion == 1:
+		path = h.config.Mount + "/" + h.config.Path + "/" + username
+	default:
+		path = h.config.Mount + "/data/" + h.config.Path + "/" + username
+	}
+
+	resp, err := h.request(http.MethodGet, path)
+	if err != nil || resp == nil {
+		return u, err
+	}
+
+	var secret vaultSecret
+	if err := json.Unmarshal(resp.Data, &secret); err != nil {
+		return u, fmt.Errorf("decode vault secret: %w", err)
+	}
+
+	if h.config.Engine == VaultEngineKV && h.config.KVVersion != 1 {
+		data := secret.Data
+		secret = vaultSecret{}
+		if err := json.Unmarshal(data, &secret); err != nil {
+			return u, fmt.Errorf("decode vault secret: %w", err)
+		}
+	}
+
+	u = vaultUser{
+		found:    secret.Password != "",
+		password: RString(secret.Password),
+	}
+
+	if h.config.Engine == VaultEngineDatabase {
+		if secret.TTL > 0 {
+			u.expires = time.Now().Add(time.Duration(secret.TTL) * time.Second) // the next rotation
+		}
+	} else {
+		u.acl = secret.ACL
+	}
+
+	return u, nil
+}
+
+// store caches the credentials of a user. Expired credentials are removed when the cache is
+// full, and the credentials are not cached if it is still full.
+func (h *VaultHook) store(username string, u vaultUser) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	if len(h.cache) >= h.config.CacheSize {
+		for k, e := range h.cache {
+			if now.After(e.expires) {
+				delete(h.cache, k)
+			}
+		}
+
+		if len(h.cache) >= h.config.CacheSize {
+			return
+		}
+	}
+
+	h.cache[username] = u
+}
+
+// request makes a request to the vault api, returning nil if the path was not found.
+func (h *VaultHook) request(method, path string) (*vaultResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(h.config.Timeout)*time.Millisecond)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(h.config.Address, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("X-Vault-Token", h.config.Token)
+	if h.config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", h.config.Namespace)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("%w: %d", ErrHTTPStatus, resp.StatusCode)
+	}
+
+	vr := new(vaultResponse)
+	if err := json.NewDecoder(resp.Body).Decode(vr); err != nil {
+		return nil, fmt.Errorf("decode vault response: %w", err)
+	}
+
+	return vr, nil
+}
+
+// renewToken renews the lease of the vault token when half of it has elapsed, until the
+// hook is stopped.
+func (h *VaultHook) renewToken(ttl int64) {
+	defer h.wg.Done()
+
+	wait := time.Duration(ttl) * time.Second / 2
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-time.After(wait):
+		}
+
+		resp, err := h.request(http.MethodPost, "auth/token/renew-self")
+		switch {
+		case err == nil && resp != nil && resp.Auth != nil && resp.Auth.LeaseDuration > 0:
+			wait = time.Duration(resp.Auth.LeaseDuration) * time.Second / 2
+			h.Log.Debug("renewed vault token", "lease_duration", resp.Auth.LeaseDuration)
+		default:
+			wait = defaultVaultRenewRetry * time.Second
+			h.Log.Warn("failed to renew vault token", "error", err)
+		}
+	}
+}
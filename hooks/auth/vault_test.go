@@ -0,0 +1,244 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// testVault is a minimal vault server which serves secrets from a map of paths.
+type testVault struct {
+	sync.Mutex
+	secrets map[string]any // response data keyed on path
+	reads   int64
+	renews  int64
+	headers http.Header
+}
+
+func newTestVault(t *testing.T, secrets map[string]any) (*testVault, *httptest.Server) {
+	v := &testVault{secrets: secrets}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v.Lock()
+		defer v.Unlock()
+		v.headers = r.Header.Clone()
+
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, "/v1/")
+		switch path {
+		case "auth/token/lookup-self":
+			_ = json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"ttl": 2, "renewable": true}})
+			return
+		case "auth/token/renew-self":
+			atomic.AddInt64(&v.renews, 1)
+			_ = json.NewEncoder(w).Encode(map[string]any{"auth": map[string]any{"lease_duration": 2, "renewable": true}})
+			return
+		}
+
+		atomic.AddInt64(&v.reads, 1)
+		data, ok := v.secrets[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": data})
+	}))
+	t.Cleanup(srv.Close)
+
+	return v, srv
+}
+
+func (v *testVault) set(path string, data any) {
+	v.Lock()
+	defer v.Unlock()
+	v.secrets[path] = data
+}
+
+func newVaultHook(t *testing.T, opts *VaultOptions) *VaultHook {
+	h := new(VaultHook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(opts))
+	t.Cleanup(func() { _ = h.Stop() })
+	return h
+}
+
+func TestVaultHookID(t *testing.T) {
+	h := new(VaultHook)
+	require.Equal(t, "auth-vault", h.ID())
+}
+
+func TestVaultHookProvides(t *testing.T) {
+	h := new(VaultHook)
+	require.True(t, h.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, h.Provides(mqtt.OnACLCheck))
+	require.False(t, h.Provides(mqtt.OnPublish))
+}
+
+func TestVaultHookInitBadConfig(t *testing.T) {
+	h := new(VaultHook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, h.Init(nil), ErrNoVaultAddress)
+	require.ErrorIs(t, h.Init(&VaultOptions{Address: "http://vault", Engine: "ldap"}), ErrUnknownVaultEngine)
+}
+
+func TestVaultHookInitDefaults(t *testing.T) {
+	h := newVaultHook(t, &VaultOptions{Address: "http://vault"})
+	require.Equal(t, VaultEngineKV, h.config.Engine)
+	require.Equal(t, "secret", h.config.Mount)
+	require.Equal(t, defaultVaultKVPath, h.config.Path)
+	require.Equal(t, 2, h.config.KVVersion)
+	require.Equal(t, int64(defaultBackendTimeout), h.config.Timeout)
+
+	h = newVaultHook(t, &VaultOptions{Address: "http://vault", Engine: VaultEngineDatabase})
+	require.Equal(t, "database", h.config.Mount)
+}
+
+func TestVaultHookKV(t *testing.T) {
+	hash, err := HashPassword(HashBcrypt, "hashed")
+	require.NoError(t, err)
+
+	v, srv := newTestVault(t, map[string]any{
+		"secret/data/mqtt/users/peach": map[string]any{
+			"data": map[string]any{
+				"password": "password1",
+				"acl":      map[string]any{"peach/#": ReadWrite, "public/#": ReadOnly, "peach/secret": Deny},
+			},
+		},
+		"secret/data/mqtt/users/melon": map[string]any{
+			"data": map[string]any{"password": hash},
+		},
+	})
+
+	h := newVaultHook(t, &VaultOptions{Address: srv.URL, Token: "s.token", Namespace: "ns1"})
+
+	require.True(t, h.OnConnectAuthenticate(newClient("cl1", "peach"), connectPacket("peach", "password1")))
+	require.Equal(t, "ns1", v.headers.Get("X-Vault-Namespace"))
+	require.False(t, h.OnConnectAuthenticate(newClient("cl1", "peach"), connectPacket("peach", "wrong")))
+	require.True(t, h.OnConnectAuthenticate(newClient("cl1", "melon"), connectPacket("melon", "hashed")))
+	require.False(t, h.OnConnectAuthenticate(newClient("cl1", "melon"), connectPacket("melon", hash)))
+	require.False(t, h.OnConnectAuthenticate(newClient("cl1", "apple"), connectPacket("apple", "")))
+	require.False(t, h.OnConnectAuthenticate(newClient("cl1", ""), connectPacket("../peach", "password1")))
+
+	cl := newClient("cl1", "peach")
+	require.True(t, h.OnACLCheck(cl, "peach/a", true))
+	require.True(t, h.OnACLCheck(cl, "public/a", false))
+	require.False(t, h.OnACLCheck(cl, "public/a", true))
+	require.False(t, h.OnACLCheck(cl, "peach/secret", false))
+	require.False(t, h.OnACLCheck(cl, "other", false))
+
+	require.True(t, h.OnACLCheck(newClient("cl1", "melon"), "any/topic", true))
+	require.False(t, h.OnACLCheck(newClient("cl1", "apple"), "any/topic", true))
+}
+
+func TestVaultHookKVVersion1DefaultACL(t *testing.T) {
+	_, srv := newTestVault(t, map[string]any{
+		"kv/devices/peach": map[string]any{"password": "password1"},
+	})
+
+	h := newVaultHook(t, &VaultOptions{
+		Address:    srv.URL,
+		Token:      "s.token",
+		Mount:      "kv",
+		Path:       "devices",
+		KVVersion:  1,
+		DefaultACL: Filters{"devices/%u/#": ReadWrite},
+	})
+
+	require.True(t, h.OnConnectAuthenticate(newClient("cl1", "peach"), connectPacket("peach", "password1")))
+	require.True(t, h.OnACLCheck(newClient("cl1", "peach"), "devices/peach/state", true))
+	require.False(t, h.OnACLCheck(newClient("cl1", "peach"), "devices/melon/state", true))
+}
+
+func TestVaultHookDatabase(t *testing.T) {
+	v, srv := newTestVault(t, map[string]any{
+		"database/static-creds/peach": map[string]any{"username": "peach", "password": "rotated1", "ttl": 3600},
+	})
+
+	h := newVaultHook(t, &VaultOptions{Address: srv.URL, Token: "s.token", Engine: VaultEngineDatabase, CacheTTL: 60})
+	require.True(t, h.OnConnectAuthenticate(newClient("cl1", "peach"), connectPacket("peach", "rotated1")))
+	require.True(t, h.OnACLCheck(newClient("cl1", "peach"), "any/topic", true))
+
+	// a rotated password is read again when the cached password does not match
+	v.set("database/static-creds/peach", map[string]any{"username": "peach", "password": "rotated2", "ttl": 3600})
+	require.True(t, h.OnConnectAuthenticate(newClient("cl1", "peach"), connectPacket("peach", "rotated2")))
+	require.False(t, h.OnConnectAuthenticate(newClient("cl1", "peach"), connectPacket("peach", "rotated1")))
+}
+
+func TestVaultHookDatabaseRotationExpiry(t *testing.T) {
+	_, srv := newTestVault(t, map[string]any{
+		"database/static-creds/peach": map[string]any{"password": "rotated1", "ttl": 5},
+	})
+
+	h := newVaultHook(t, &VaultOptions{Address: srv.URL, Token: "s.token", Engine: VaultEngineDatabase, CacheTTL: 60})
+	u, _, err := h.user("peach", false)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(time.Second*5), u.expires, time.Second)
+}
+
+func TestVaultHookCache(t *testing.T) {
+	v, srv := newTestVault(t, map[string]any{
+		"secret/data/mqtt/users/peach": map[string]any{"data": map[string]any{"password": "password1"}},
+	})
+
+	h := newVaultHook(t, &VaultOptions{Address: srv.URL, Token: "s.token", CacheTTL: 60})
+	for i := 0; i < 3; i++ {
+		require.True(t, h.OnConnectAuthenticate(newClient("cl1", "peach"), connectPacket("peach", "password1")))
+		require.True(t, h.OnACLCheck(newClient("cl1", "peach"), "a/b", true))
+	}
+	require.Equal(t, int64(1), atomic.LoadInt64(&v.reads))
+
+	h = newVaultHook(t, &VaultOptions{Address: srv.URL, Token: "s.token"})
+	for i := 0; i < 3; i++ {
+		require.True(t, h.OnACLCheck(newClient("cl1", "peach"), "a/b", true))
+	}
+	require.Equal(t, int64(4), atomic.LoadInt64(&v.reads))
+}
+
+func TestVaultHookCacheFull(t *testing.T) {
+	_, srv := newTestVault(t, map[string]any{})
+	h := newVaultHook(t, &VaultOptions{Address: srv.URL, Token: "s.token", CacheTTL: 60, CacheSize: 1})
+
+	require.False(t, h.OnACLCheck(newClient("cl1", "peach"), "a/b", true))
+	require.False(t, h.OnACLCheck(newClient("cl1", "melon"), "a/b", true))
+	require.Len(t, h.cache, 1)
+}
+
+func TestVaultHookFailure(t *testing.T) {
+	_, srv := newTestVault(t, map[string]any{})
+	h := newVaultHook(t, &VaultOptions{Address: srv.URL, Token: "s.wrong"})
+	require.False(t, h.OnConnectAuthenticate(newClient("cl1", "peach"), connectPacket("peach", "password1")))
+	require.False(t, h.OnACLCheck(newClient("cl1", "peach"), "a/b", true))
+}
+
+func TestVaultHookRenewToken(t *testing.T) {
+	v, srv := newTestVault(t, map[string]any{})
+
+	h := new(VaultHook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Init(&VaultOptions{Address: srv.URL, Token: "s.wrong", RenewToken: true}), ErrHTTPStatus)
+
+	h = newVaultHook(t, &VaultOptions{Address: srv.URL, Token: "s.token", RenewToken: true})
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&v.renews) > 0
+	}, time.Second*3, time.Millisecond*50)
+
+	require.NoError(t, h.Stop())
+	require.NoError(t, h.Stop())
+}
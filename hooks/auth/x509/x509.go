@@ -0,0 +1,221 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package x509
+
+import (
+	"bytes"
+	stdx509 "crypto/x509"
+	"errors"
+	"fmt"
+	"slices"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/auth"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+)
+
+const (
+	IdentityCN    = "cn"    // the identity is the subject common name
+	IdentityDNS   = "dns"   // the identity is a dns name subject alternative name
+	IdentityEmail = "email" // the identity is an email address subject alternative name
+	IdentityURI   = "uri"   // the identity is a uri subject alternative name
+	IdentityIP    = "ip"    // the identity is an ip address subject alternative name
+)
+
+var (
+	// ErrUnknownIdentity indicates the certificate field an identity is derived from is not supported.
+	ErrUnknownIdentity = errors.New("unknown certificate identity field")
+
+	// ErrNoCertificate indicates the client did not present a verified certificate.
+	ErrNoCertificate = errors.New("no verified client certificate")
+
+	// ErrNoIdentity indicates the client certificate does not contain an identity.
+	ErrNoIdentity = errors.New("client certificate has no identity")
+
+	// ErrIdentityMismatch indicates the client id or username does not match the certificate identity.
+	ErrIdentityMismatch = errors.New("client does not match certificate identity")
+)
+
+// Options contains the configuration of the client certificate auth hook.
+type Options struct {
+	// Identity is the certificate field the client identity is derived from: cn, dns, email,
+	// uri or ip (default cn). If a certificate has several alternative names of the type,
+	// the first is used unless the client id or username must match one of them.
+	Identity string `yaml:"identity" json:"identity"`
+
+	// MatchClientID requires the client id to equal the certificate identity.
+	MatchClientID bool `yaml:"match_client_id" json:"match_client_id"`
+
+	// MatchUsername requires the connect username to equal the certificate identity.
+	MatchUsername bool `yaml:"match_username" json:"match_username"`
+
+	// ACL contains the topic filters each identity may access. Filters may contain %c and %u
+	// placeholders. If empty, every client may publish and subscribe to any topic.
+	ACL map[string]auth.Filters `yaml:"acl" json:"acl"`
+
+	// DefaultACL contains the topic filters of identities which are not in ACL.
+	DefaultACL auth.Filters `yaml:"default_acl" json:"default_acl"`
+}
+
+// Hook is an authentication hook which derives the identity of a client from its verified
+// tls client certificate, and applies the ACL rules of the identity.
+type Hook struct {
+	mqtt.HookBase
+	config *Options
+}
+
+// ID returns the ID of the hook.
+func (h *Hook) ID() string {
+	return "auth-x509"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnACLCheck,
+	}, []byte{b})
+}
+
+// Init configures the hook with the identity field and ACL rules.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.config = config.(*Options)
+	if h.config.Identity == "" {
+		h.config.Identity = IdentityCN
+	}
+
+	if !slices.Contains([]string{IdentityCN, IdentityDNS, IdentityEmail, IdentityURI, IdentityIP}, h.config.Identity) {
+		return fmt.Errorf("%w: %s", ErrUnknownIdentity, h.config.Identity)
+	}
+
+	h.Log.Info("loaded x509 auth",
+		"identity", h.config.Identity,
+		"match_client_id", h.config.MatchClientID,
+		"match_username", h.config.MatchUsername,
+		"identities", len(h.config.ACL))
+
+	return nil
+}
+
+// OnConnectAuthenticate returns true if the client presented a verified certificate with an
+// identity matching the client.
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	if _, err := h.identity(cl, string(pk.Connect.Username)); err != nil {
+		h.Log.Info("client failed authentication check",
+			"error", err,
+			"username", string(pk.Connect.Username),
+			"remote", cl.Net.Remote)
+		return false
+	}
+
+	return true
+}
+
+// OnACLCheck returns true if the ACL rules of the client identity allow it to publish or
+// subscribe to a topic. Deny filters take precedence.
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	id, err := h.identity(cl, string(cl.Properties.Username))
+	if err != nil {
+		return false
+	}
+
+	if len(h.config.ACL) == 0 && h.config.DefaultACL == nil {
+		return true
+	}
+
+	filters, ok := h.config.ACL[id]
+	if !ok {
+		filters = h.config.DefaultACL
+	}
+
+	var allow bool
+	for filter, access := range filters {
+		if !filter.ClientFilterMatches(cl, topic) {
+			continue
+		}
+
+		switch access {
+		case auth.Deny:
+			return false
+		case auth.ReadOnly:
+			allow = allow || !write
+		case auth.WriteOnly:
+			allow = allow || write
+		case auth.ReadWrite:
+			allow = true
+		}
+	}
+
+	if !allow {
+		h.Log.Debug("client failed allowed ACL check",
+			"client", cl.ID,
+			"identity", id,
+			"topic", topic)
+	}
+
+	return allow
+}
+
+// identity returns the identity of a client from its verified certificate, ensuring it
+// matches the client id and username if required.
+func (h *Hook) identity(cl *mqtt.Client, username string) (string, error) {
+	cert := cl.Net.PeerCertificate()
+	if cert == nil || len(cl.Net.TLS.VerifiedChains) == 0 {
+		return "", ErrNoCertificate
+	}
+
+	ids := Identities(cert, h.config.Identity)
+	if len(ids) == 0 {
+		return "", fmt.Errorf("%w: %s", ErrNoIdentity, h.config.Identity)
+	}
+
+	id := ids[0]
+	if h.config.MatchClientID {
+		if !slices.Contains(ids, cl.ID) {
+			return "", fmt.Errorf("%w: client id %s", ErrIdentityMismatch, cl.ID)
+		}
+		id = cl.ID
+	}
+
+	if h.config.MatchUsername {
+		if !slices.Contains(ids, username) || h.config.MatchClientID && username != id {
+			return "", fmt.Errorf("%w: username %s", ErrIdentityMismatch, username)
+		}
+		id = username
+	}
+
+	return id, nil
+}
+
+// Identities returns the non-empty values of a certificate field which may identify a client.
+func Identities(cert *stdx509.Certificate, field string) []string {
+	var ids []string
+	switch field {
+	case IdentityCN:
+		ids = []string{cert.Subject.CommonName}
+	case IdentityDNS:
+		ids = cert.DNSNames
+	case IdentityEmail:
+		ids = cert.EmailAddresses
+	case IdentityURI:
+		for _, u := range cert.URIs {
+			ids = append(ids, u.String())
+		}
+	case IdentityIP:
+		for _, ip := range cert.IPAddresses {
+			ids = append(ids, ip.String())
+		}
+	}
+
+	return slices.DeleteFunc(slices.Clone(ids), func(id string) bool { return id == "" })
+}
@@ -0,0 +1,171 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package x509
+
+import (
+	"crypto/tls"
+	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/auth"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+var logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+var testCert = &stdx509.Certificate{
+	Subject:        pkix.Name{CommonName: "device-1"},
+	DNSNames:       []string{"device-1.example.com", "alias.example.com"},
+	EmailAddresses: []string{"device-1@example.com"},
+	URIs:           []*url.URL{{Scheme: "spiffe", Host: "example.com", Path: "/device-1"}},
+	IPAddresses:    []net.IP{net.ParseIP("10.0.0.1")},
+}
+
+func newHook(t *testing.T, opts *Options) *Hook {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(opts))
+	return h
+}
+
+// newClient returns a client which presented a certificate, which is verified if set.
+func newClient(id, username string, cert *stdx509.Certificate, verified bool) *mqtt.Client {
+	cl := &mqtt.Client{
+		ID:         id,
+		Properties: mqtt.ClientProperties{Username: []byte(username)},
+	}
+
+	if cert != nil {
+		cl.Net.TLS = &tls.ConnectionState{PeerCertificates: []*stdx509.Certificate{cert}}
+		if verified {
+			cl.Net.TLS.VerifiedChains = [][]*stdx509.Certificate{{cert}}
+		}
+	}
+
+	return cl
+}
+
+func connectPacket(username string) packets.Packet {
+	return packets.Packet{Connect: packets.ConnectParams{Username: []byte(username)}}
+}
+
+func TestID(t *testing.T) {
+	h := new(Hook)
+	require.Equal(t, "auth-x509", h.ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := new(Hook)
+	require.True(t, h.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, h.Provides(mqtt.OnACLCheck))
+	require.False(t, h.Provides(mqtt.OnPublish))
+}
+
+func TestInitBadConfig(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+}
+
+func TestInitUnknownIdentity(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Init(&Options{Identity: "serial"}), ErrUnknownIdentity)
+}
+
+func TestInitDefaults(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(nil))
+	require.Equal(t, IdentityCN, h.config.Identity)
+}
+
+func TestIdentities(t *testing.T) {
+	require.Equal(t, []string{"device-1"}, Identities(testCert, IdentityCN))
+	require.Equal(t, []string{"device-1.example.com", "alias.example.com"}, Identities(testCert, IdentityDNS))
+	require.Equal(t, []string{"device-1@example.com"}, Identities(testCert, IdentityEmail))
+	require.Equal(t, []string{"spiffe://example.com/device-1"}, Identities(testCert, IdentityURI))
+	require.Equal(t, []string{"10.0.0.1"}, Identities(testCert, IdentityIP))
+	require.Empty(t, Identities(new(stdx509.Certificate), IdentityCN))
+	require.Empty(t, Identities(testCert, "serial"))
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	h := newHook(t, new(Options))
+	require.True(t, h.OnConnectAuthenticate(newClient("any", "", testCert, true), connectPacket("")))
+	require.False(t, h.OnConnectAuthenticate(newClient("any", "", testCert, false), connectPacket("")))
+	require.False(t, h.OnConnectAuthenticate(newClient("any", "", nil, false), connectPacket("")))
+	require.False(t, h.OnConnectAuthenticate(newClient("any", "", new(stdx509.Certificate), true), connectPacket("")))
+}
+
+func TestOnConnectAuthenticateMatchClientID(t *testing.T) {
+	h := newHook(t, &Options{Identity: IdentityDNS, MatchClientID: true})
+	require.True(t, h.OnConnectAuthenticate(newClient("device-1.example.com", "", testCert, true), connectPacket("")))
+	require.True(t, h.OnConnectAuthenticate(newClient("alias.example.com", "", testCert, true), connectPacket("")))
+	require.False(t, h.OnConnectAuthenticate(newClient("device-2.example.com", "", testCert, true), connectPacket("")))
+}
+
+func TestOnConnectAuthenticateMatchUsername(t *testing.T) {
+	h := newHook(t, &Options{MatchUsername: true})
+	require.True(t, h.OnConnectAuthenticate(newClient("any", "", testCert, true), connectPacket("device-1")))
+	require.False(t, h.OnConnectAuthenticate(newClient("any", "", testCert, true), connectPacket("device-2")))
+}
+
+func TestOnConnectAuthenticateMatchBoth(t *testing.T) {
+	h := newHook(t, &Options{Identity: IdentityDNS, MatchClientID: true, MatchUsername: true})
+	require.True(t, h.OnConnectAuthenticate(newClient("alias.example.com", "", testCert, true), connectPacket("alias.example.com")))
+	require.False(t, h.OnConnectAuthenticate(newClient("alias.example.com", "", testCert, true), connectPacket("device-1.example.com")))
+}
+
+func TestOnACLCheckNoRules(t *testing.T) {
+	h := newHook(t, new(Options))
+	require.True(t, h.OnACLCheck(newClient("any", "", testCert, true), "a/b", true))
+	require.False(t, h.OnACLCheck(newClient("any", "", nil, false), "a/b", true))
+}
+
+func TestOnACLCheck(t *testing.T) {
+	h := newHook(t, &Options{
+		ACL: map[string]auth.Filters{
+			"device-1": {
+				"devices/%c/#":     auth.ReadWrite,
+				"devices/+/config": auth.ReadOnly,
+				"devices/secret":   auth.Deny,
+				"telemetry":        auth.WriteOnly,
+			},
+		},
+		DefaultACL: auth.Filters{"public/#": auth.ReadOnly},
+	})
+
+	cl := newClient("cl1", "", testCert, true)
+	require.True(t, h.OnACLCheck(cl, "devices/cl1/state", true))
+	require.True(t, h.OnACLCheck(cl, "devices/cl2/config", false))
+	require.False(t, h.OnACLCheck(cl, "devices/cl2/config", true))
+	require.False(t, h.OnACLCheck(cl, "devices/secret", false))
+	require.True(t, h.OnACLCheck(cl, "telemetry", true))
+	require.False(t, h.OnACLCheck(cl, "telemetry", false))
+	require.False(t, h.OnACLCheck(cl, "public/news", false))
+
+	other := newClient("cl2", "", &stdx509.Certificate{Subject: pkix.Name{CommonName: "device-2"}}, true)
+	require.True(t, h.OnACLCheck(other, "public/news", false))
+	require.False(t, h.OnACLCheck(other, "public/news", true))
+	require.False(t, h.OnACLCheck(other, "devices/cl2/state", true))
+}
+
+func TestOnACLCheckNoDefault(t *testing.T) {
+	h := newHook(t, &Options{
+		ACL: map[string]auth.Filters{"device-1": {"#": auth.ReadWrite}},
+	})
+
+	other := newClient("cl2", "", &stdx509.Certificate{Subject: pkix.Name{CommonName: "device-2"}}, true)
+	require.False(t, h.OnACLCheck(other, "a/b", false))
+	require.True(t, h.OnACLCheck(newClient("cl1", "", testCert, true), "a/b", false))
+}
@@ -0,0 +1,679 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+// Package bridge provides a hook which streams selected broker events to an external gRPC
+// service implementing the mqtt.Bridge service described in bridge.proto, so the broker can be
+// extended out of process in any language. The service decides the result of blocking events.
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/internal/protowire"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// bridgeEventsMethod is the full name of the Events method of the mqtt.Bridge service.
+	bridgeEventsMethod = "/mqtt.Bridge/Events"
+
+	// defaultTimeout is the default milliseconds to wait for the response to a blocking event.
+	defaultTimeout = 1000
+
+	// defaultQueueSize is the default number of events queued for the stream.
+	defaultQueueSize = 1024
+
+	// defaultReconnectBackoff is the default milliseconds to wait before reopening the stream.
+	defaultReconnectBackoff = 500
+
+	// maxReconnectBackoff is the maximum milliseconds to wait before reopening the stream.
+	maxReconnectBackoff = 30000
+)
+
+// The names of the events which can be streamed to the service.
+const (
+	EventConnectAuthenticate = "connect_authenticate" // blocking: allow or deny a connecting client
+	EventACLCheck            = "acl_check"            // blocking: allow or deny access to a topic
+	EventPublish             = "publish"              // blocking: allow, deny or mutate a published message
+	EventConnect             = "connect"              // a client session was established
+	EventDisconnect          = "disconnect"           // a client disconnected
+	EventSubscribed          = "subscribed"           // a client subscribed to a filter
+	EventUnsubscribed        = "unsubscribed"         // a client unsubscribed from a filter
+	EventPublished           = "published"            // a message was published
+)
+
+// eventType is the Type of an Event sent to the service.
+type eventType byte
+
+const (
+	typeConnectAuthenticate eventType = iota
+	typeACLCheck
+	typePublish
+	typeConnect
+	typeDisconnect
+	typeSubscribed
+	typeUnsubscribed
+	typePublished
+)
+
+// events maps the name of each event to its type and the hook method which sends it.
+var events = map[string]struct {
+	typ  eventType
+	hook byte
+}{
+	EventConnectAuthenticate: {typeConnectAuthenticate, mqtt.OnConnectAuthenticate},
+	EventACLCheck:            {typeACLCheck, mqtt.OnACLCheck},
+	EventPublish:             {typePublish, mqtt.OnPublish},
+	EventConnect:             {typeConnect, mqtt.OnSessionEstablished},
+	EventDisconnect:          {typeDisconnect, mqtt.OnDisconnect},
+	EventSubscribed:          {typeSubscribed, mqtt.OnSubscribed},
+	EventUnsubscribed:        {typeUnsubscribed, mqtt.OnUnsubscribed},
+	EventPublished:           {typePublished, mqtt.OnPublished},
+}
+
+var (
+	// ErrNoAddress indicates the address of the service was not configured.
+	ErrNoAddress = errors.New("no grpc bridge address")
+
+	// ErrNoEvents indicates no events were selected to be streamed to the service.
+	ErrNoEvents = errors.New("no grpc bridge events")
+
+	// ErrUnknownEvent indicates an event which cannot be streamed was selected.
+	ErrUnknownEvent = errors.New("unknown grpc bridge event")
+
+	// ErrNotConnected indicates a blocking event could not be sent because the stream is not open.
+	ErrNotConnected = errors.New("grpc bridge not connected")
+
+	// ErrTimeout indicates the service did not respond to a blocking event in time.
+	ErrTimeout = errors.New("grpc bridge response timed out")
+)
+
+// Options contains the configuration of the grpc bridge hook.
+type Options struct {
+	// Address is the address of the service, such as extensions:9000.
+	Address string `yaml:"address" json:"address"`
+
+	// TLS connects to the service with TLS, verified with the system roots. Plaintext is
+	// used if neither TLS nor TLSConfig is set.
+	TLS bool `yaml:"tls" json:"tls"`
+
+	// Metadata is added to the stream, such as an authorization token for the service.
+	Metadata map[string]string `yaml:"metadata" json:"metadata"`
+
+	// Events are the names of the events streamed to the service, such as publish or
+	// disconnect. The connect_authenticate, acl_check and publish events are blocking, and
+	// wait for the response of the service.
+	Events []string `yaml:"events" json:"events"`
+
+	// Timeout is the milliseconds to wait for the response to a blocking event before it
+	// fails (default 1000).
+	Timeout int64 `yaml:"timeout" json:"timeout"`
+
+	// QueueSize is the number of events which may be queued for the stream (default 1024).
+	// Non-blocking events are dropped while the queue is full or the stream is not open.
+	QueueSize int `yaml:"queue_size" json:"queue_size"`
+
+	// ReconnectBackoff is the milliseconds to wait before reopening a stream which ended,
+	// doubling with each failed attempt up to 30 seconds (default 500).
+	ReconnectBackoff int64 `yaml:"reconnect_backoff" json:"reconnect_backoff"`
+
+	// FailOpen allows blocking events when the service cannot be reached or does not respond
+	// in time. By default they are denied (fail-closed).
+	FailOpen bool `yaml:"fail_open" json:"fail_open"`
+
+	// TLSConfig is the tls configuration used to connect to the service, if set.
+	TLSConfig *tls.Config `yaml:"-" json:"-"`
+
+	// DialOptions are added to the options used to create the client connection.
+	DialOptions []grpc.DialOption `yaml:"-" json:"-"`
+}
+
+// bridgeEvent is an Event sent to the service.
+type bridgeEvent struct {
+	id       uint64
+	typ      eventType
+	clientID string
+	username string
+	password []byte
+	remote   string
+	listener string
+	topic    string
+	payload  []byte
+	qos      byte
+	retain   bool
+	write    bool
+	err      string
+}
+
+// bridgeResponse is a Response received from the service.
+type bridgeResponse struct {
+	id        uint64
+	allow     bool
+	superuser bool
+	mutate    bool
+	topic     string
+	payload   []byte
+}
+
+// bridgeStreamDesc describes the Events method of the mqtt.Bridge service.
+var bridgeStreamDesc = grpc.StreamDesc{
+	StreamName:    "Events",
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+// Hook is a hook which streams selected events to an external gRPC service, and waits for
+// the service to decide the result of blocking events.
+type Hook struct {
+	mqtt.HookBase
+	config    *Options
+	conn      *grpc.ClientConn
+	provides  []byte                          // the hook methods of the selected events
+	out       chan *bridgeEvent               // the events queued for the stream
+	mu        sync.Mutex                      // guards pending
+	pending   map[uint64]chan *bridgeResponse // the blocking events awaiting a response, keyed on id
+	nextID    atomic.Uint64                   // the id of the last blocking event
+	connected atomic.Bool                     // true while the stream is open
+	dropped   atomic.Int64                    // the number of non-blocking events dropped
+	cancel    context.CancelFunc              // stops the stream
+	done      chan struct{}                   // closed when the stream has stopped
+}
+
+// ID returns the ID of the hook.
+func (h *Hook) ID() string {
+	return "grpc-bridge"
+}
+
+// Provides indicates which hook methods this hook provides, which are those of the
+// selected events.
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains(h.provides, []byte{b})
+}
+
+// Init creates the client connection to the service and starts streaming events.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.config = config.(*Options)
+	if h.config.Address == "" {
+		return ErrNoAddress
+	}
+
+	if len(h.config.Events) == 0 {
+		return ErrNoEvents
+	}
+
+	h.provides = nil
+	for _, name := range h.config.Events {
+		e, ok := events[name]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownEvent, name)
+		}
+		h.provides = append(h.provides, e.hook)
+	}
+
+	if h.config.Timeout <= 0 {
+		h.config.Timeout = defaultTimeout
+	}
+
+	if h.config.QueueSize <= 0 {
+		h.config.QueueSize = defaultQueueSize
+	}
+
+	if h.config.ReconnectBackoff <= 0 {
+		h.config.ReconnectBackoff = defaultReconnectBackoff
+	}
+
+	creds := insecure.NewCredentials()
+	if h.config.TLSConfig != nil {
+		creds = credentials.NewTLS(h.config.TLSConfig)
+	} else if h.config.TLS {
+		creds = credentials.NewTLS(new(tls.Config))
+	}
+
+	opts := append([]grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(bridgeCodec{})),
+	}, h.config.DialOptions...)
+
+	conn, err := grpc.NewClient(h.config.Address, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create grpc bridge client: %w", err)
+	}
+	h.conn = conn
+
+	h.out = make(chan *bridgeEvent, h.config.QueueSize)
+	h.pending = make(map[uint64]chan *bridgeResponse)
+	h.done = make(chan struct{})
+
+	parent := context.Background()
+	if h.Opts != nil && h.Opts.Context != nil {
+		parent = h.Opts.Context
+	}
+
+	var ctx context.Context
+	ctx, h.cancel = context.WithCancel(parent)
+	go h.run(ctx)
+
+	h.Log.Info("started grpc bridge",
+		"address", h.config.Address,
+		"events", h.config.Events,
+		"fail_open", h.config.FailOpen)
+
+	return nil
+}
+
+// Stop stops streaming events and closes the client connection.
+func (h *Hook) Stop() error {
+	if h.conn == nil {
+		return nil
+	}
+
+	h.cancel()
+	<-h.done
+
+	conn := h.conn
+	h.conn = nil
+	return conn.Close()
+}
+
+// Connected returns true if the stream to the service is open.
+func (h *Hook) Connected() bool {
+	return h.connected.Load()
+}
+
+// Dropped returns the number of non-blocking events which were dropped because the queue
+// was full or the stream was not open.
+func (h *Hook) Dropped() int64 {
+	return h.dropped.Load()
+}
+
+// run opens the stream and reopens it with a backoff whenever it ends, until ctx is cancelled.
+func (h *Hook) run(ctx context.Context) {
+	defer close(h.done)
+
+	backoff := time.Duration(h.config.ReconnectBackoff) * time.Millisecond
+	for {
+		opened, err := h.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if opened {
+			backoff = time.Duration(h.config.ReconnectBackoff) * time.Millisecond
+		}
+
+		h.Log.Warn("grpc bridge stream ended", "error", err, "address", h.config.Address, "retry", backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, maxReconnectBackoff*time.Millisecond)
+	}
+}
+
+// stream opens a stream to the service, sending queued events and resolving the responses
+// to blocking events until the stream ends, returning true if the stream was opened.
+func (h *Hook) stream(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for k, v := range h.config.Metadata {
+		ctx = metadata.AppendToOutgoingContext(ctx, k, v)
+	}
+
+	s, err := h.conn.NewStream(ctx, &bridgeStreamDesc, bridgeEventsMethod)
+	if err != nil {
+		return false, err
+	}
+
+	h.connected.Store(true)
+	defer h.disconnected()
+
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			r := new(bridgeResponse)
+			if err := s.RecvMsg(r); err != nil {
+				errs <- err
+				return
+			}
+			h.resolve(r)
+		}
+	}()
+
+	for {
+		select {
+		case ev := <-h.out:
+			if err := s.SendMsg(ev); err != nil {
+				return true, err
+			}
+		case err := <-errs:
+			return true, err
+		case <-ctx.Done():
+			_ = s.CloseSend()
+			return true, ctx.Err()
+		}
+	}
+}
+
+// disconnected marks the stream as closed and fails the blocking events awaiting a response.
+func (h *Hook) disconnected() {
+	h.connected.Store(false)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, ch := range h.pending {
+		close(ch)
+		delete(h.pending, id)
+	}
+}
+
+// resolve passes a response to the blocking event awaiting it, if any.
+func (h *Hook) resolve(r *bridgeResponse) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ch, ok := h.pending[r.id]; ok {
+		ch <- r
+		delete(h.pending, r.id)
+	}
+}
+
+// request sends a blocking event to the service and waits for the response.
+func (h *Hook) request(ctx context.Context, ev *bridgeEvent) (*bridgeResponse, error) {
+	if !h.connected.Load() {
+		return nil, ErrNotConnected
+	}
+
+	ev.id = h.nextID.Add(1)
+	ch := make(chan *bridgeResponse, 1)
+	h.mu.Lock()
+	h.pending[ev.id] = ch
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		delete(h.pending, ev.id)
+		h.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(time.Duration(h.config.Timeout) * time.Millisecond)
+	defer timer.Stop()
+
+	select {
+	case h.out <- ev:
+	case <-timer.C:
+		return nil, ErrTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case r, ok := <-ch:
+		if !ok {
+			return nil, ErrNotConnected
+		}
+		return r, nil
+	case <-timer.C:
+		return nil, ErrTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// notify queues a non-blocking event for the stream, dropping it if the stream is not open
+// or the queue is full.
+func (h *Hook) notify(ev *bridgeEvent) {
+	if h.connected.Load() {
+		select {
+		case h.out <- ev:
+			return
+		default:
+		}
+	}
+
+	if n := h.dropped.Add(1); n == 1 || n%1000 == 0 {
+		h.Log.Warn("grpc bridge dropping events", "address", h.config.Address, "dropped", n)
+	}
+}
+
+// clientEvent returns an event of a type with the values of a client.
+func clientEvent(typ eventType, cl *mqtt.Client) *bridgeEvent {
+	return &bridgeEvent{
+		typ:      typ,
+		clientID: cl.ID,
+		username: string(cl.Properties.Username),
+		remote:   cl.Net.Remote,
+		listener: cl.Net.Listener,
+	}
+}
+
+// OnConnectAuthenticate returns true if the service allows the client to connect, marking
+// the client as a superuser if the service decides so.
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	ev := clientEvent(typeConnectAuthenticate, cl)
+	ev.username = string(pk.Connect.Username)
+	ev.password = pk.Connect.Password
+
+	r, err := h.request(cl.Context(), ev)
+	if err != nil {
+		h.Log.Warn("grpc bridge request failed", "error", err, "event", EventConnectAuthenticate, "fail_open", h.config.FailOpen)
+		return h.config.FailOpen
+	}
+
+	if r.allow && r.superuser {
+		cl.SetSuperuser(true)
+	}
+
+	return r.allow
+}
+
+// OnACLCheck returns true if the service allows the client to publish or subscribe to a topic.
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	ev := clientEvent(typeACLCheck, cl)
+	ev.topic = topic
+	ev.write = write
+
+	r, err := h.request(cl.Context(), ev)
+	if err != nil {
+		h.Log.Warn("grpc bridge request failed", "error", err, "event", EventACLCheck, "fail_open", h.config.FailOpen)
+		return h.config.FailOpen
+	}
+
+	return r.allow
+}
+
+// OnPublish rejects the packet if the service denies it, or replaces its topic and payload
+// if the service mutates it.
+func (h *Hook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	ev := clientEvent(typePublish, cl)
+	ev.topic = pk.TopicName
+	ev.payload = pk.Payload
+	ev.qos = pk.FixedHeader.Qos
+	ev.retain = pk.FixedHeader.Retain
+
+	r, err := h.request(cl.Context(), ev)
+	if err != nil {
+		h.Log.Warn("grpc bridge request failed", "error", err, "event", EventPublish, "fail_open", h.config.FailOpen)
+		if h.config.FailOpen {
+			return pk, nil
+		}
+		return pk, packets.ErrRejectPacket
+	}
+
+	if !r.allow {
+		return pk, packets.ErrRejectPacket
+	}
+
+	if r.mutate {
+		if r.topic != "" {
+			pk.TopicName = r.topic
+		}
+		pk.Payload = r.payload
+	}
+
+	return pk, nil
+}
+
+// OnSessionEstablished sends a connect event.
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.notify(clientEvent(typeConnect, cl))
+}
+
+// OnDisconnect sends a disconnect event.
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	ev := clientEvent(typeDisconnect, cl)
+	if err != nil {
+		ev.err = err.Error()
+	}
+	h.notify(ev)
+}
+
+// OnSubscribed sends a subscribed event for each filter of the packet.
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	for _, sub := range pk.Filters {
+		ev := clientEvent(typeSubscribed, cl)
+		ev.topic = sub.Filter
+		ev.qos = sub.Qos
+		h.notify(ev)
+	}
+}
+
+// OnUnsubscribed sends an unsubscribed event for each filter of the packet.
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	for _, sub := range pk.Filters {
+		ev := clientEvent(typeUnsubscribed, cl)
+		ev.topic = sub.Filter
+		h.notify(ev)
+	}
+}
+
+// OnPublished sends a published event.
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	ev := clientEvent(typePublished, cl)
+	ev.topic = pk.TopicName
+	ev.payload = pk.Payload
+	ev.qos = pk.FixedHeader.Qos
+	ev.retain = pk.FixedHeader.Retain
+	h.notify(ev)
+}
+
+// bridgeCodec encodes and decodes the messages of the mqtt.Bridge service in the protobuf
+// wire format, as described by bridge.proto.
+type bridgeCodec struct{}
+
+// Name returns the name of the codec.
+func (bridgeCodec) Name() string {
+	return "proto"
+}
+
+// Marshal encodes a message of the bridge service.
+func (bridgeCodec) Marshal(v any) ([]byte, error) {
+	var b []byte
+	switch m := v.(type) {
+	case *bridgeEvent:
+		b = protowire.AppendVarint(b, 1, m.id)
+		b = protowire.AppendVarint(b, 2, uint64(m.typ))
+		b = protowire.AppendString(b, 3, m.clientID)
+		b = protowire.AppendString(b, 4, m.username)
+		b = protowire.AppendBytes(b, 5, m.password)
+		b = protowire.AppendString(b, 6, m.remote)
+		b = protowire.AppendString(b, 7, m.listener)
+		b = protowire.AppendString(b, 8, m.topic)
+		b = protowire.AppendBytes(b, 9, m.payload)
+		b = protowire.AppendVarint(b, 10, uint64(m.qos))
+		b = protowire.AppendBool(b, 11, m.retain)
+		b = protowire.AppendBool(b, 12, m.write)
+		b = protowire.AppendString(b, 13, m.err)
+	case *bridgeResponse:
+		b = protowire.AppendVarint(b, 1, m.id)
+		b = protowire.AppendBool(b, 2, m.allow)
+		b = protowire.AppendBool(b, 3, m.superuser)
+		b = protowire.AppendBool(b, 4, m.mutate)
+		b = protowire.AppendString(b, 5, m.topic)
+		b = protowire.AppendBytes(b, 6, m.payload)
+	default:
+		return nil, fmt.Errorf("grpc bridge codec: unsupported type %T", v)
+	}
+
+	return b, nil
+}
+
+// Unmarshal decodes a message of the bridge service.
+func (bridgeCodec) Unmarshal(data []byte, v any) error {
+	switch m := v.(type) {
+	case *bridgeEvent:
+		return protowire.Consume(data, func(num protowire.Number, u uint64, b []byte) {
+			switch num {
+			case 1:
+				m.id = u
+			case 2:
+				m.typ = eventType(u)
+			case 3:
+				m.clientID = string(b)
+			case 4:
+				m.username = string(b)
+			case 5:
+				m.password = append([]byte{}, b...)
+			case 6:
+				m.remote = string(b)
+			case 7:
+				m.listener = string(b)
+			case 8:
+				m.topic = string(b)
+			case 9:
+				m.payload = append([]byte{}, b...)
+			case 10:
+				m.qos = byte(u)
+			case 11:
+				m.retain = u != 0
+			case 12:
+				m.write = u != 0
+			case 13:
+				m.err = string(b)
+			}
+		})
+	case *bridgeResponse:
+		return protowire.Consume(data, func(num protowire.Number, u uint64, b []byte) {
+			switch num {
+			case 1:
+				m.id = u
+			case 2:
+				m.allow = u != 0
+			case 3:
+				m.superuser = u != 0
+			case 4:
+				m.mutate = u != 0
+			case 5:
+				m.topic = string(b)
+			case 6:
+				m.payload = append([]byte{}, b...)
+			}
+		})
+	default:
+		return fmt.Errorf("grpc bridge codec: unsupported type %T", v)
+	}
+}
@@ -0,0 +1,369 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+var logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+// testService is a test implementation of the mqtt.Bridge service.
+type testService struct {
+	events  chan *bridgeEvent // the non-blocking events received
+	streams int64             // the number of streams opened
+	end     int64             // the number of streams to end as soon as they are opened
+}
+
+func (s *testService) stream(stream grpc.ServerStream) error {
+	atomic.AddInt64(&s.streams, 1)
+	if atomic.AddInt64(&s.end, -1) >= 0 {
+		return errors.New("ended")
+	}
+
+	if md, _ := metadata.FromIncomingContext(stream.Context()); len(md.Get("token")) == 0 {
+		return errors.New("no token")
+	}
+
+	for {
+		ev := new(bridgeEvent)
+		if err := stream.RecvMsg(ev); err != nil {
+			return nil
+		}
+
+		if ev.id == 0 {
+			s.events <- ev
+			continue
+		}
+
+		r := &bridgeResponse{id: ev.id}
+		switch ev.typ {
+		case typeConnectAuthenticate:
+			r.allow = string(ev.password) == "password-"+ev.username
+			r.superuser = ev.username == "admin"
+		case typeACLCheck:
+			r.allow = !ev.write || ev.topic == ev.clientID+"/out"
+		case typePublish:
+			switch ev.topic {
+			case "slow":
+				continue
+			case "deny":
+			case "mutate":
+				r.allow, r.mutate, r.topic, r.payload = true, true, "mutated", []byte("changed")
+			default:
+				r.allow = true
+			}
+		}
+
+		if err := stream.SendMsg(r); err != nil {
+			return err
+		}
+	}
+}
+
+func newTestService(t *testing.T) (*testService, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &testService{events: make(chan *bridgeEvent, 16)}
+	srv := grpc.NewServer(grpc.ForceServerCodec(bridgeCodec{}))
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "mqtt.Bridge",
+		HandlerType: (*any)(nil),
+		Streams: []grpc.StreamDesc{
+			{
+				StreamName: "Events",
+				Handler: func(_ any, stream grpc.ServerStream) error {
+					return s.stream(stream)
+				},
+				ServerStreams: true,
+				ClientStreams: true,
+			},
+		},
+	}, s)
+
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(srv.Stop)
+
+	return s, ln.Addr().String()
+}
+
+func newTestHook(t *testing.T, opts *Options) *Hook {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	if opts.Metadata == nil {
+		opts.Metadata = map[string]string{"token": "abc"}
+	}
+	if opts.Events == nil {
+		opts.Events = []string{EventConnectAuthenticate, EventACLCheck, EventPublish}
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 500
+	}
+
+	require.NoError(t, h.Init(opts))
+	t.Cleanup(func() { _ = h.Stop() })
+	return h
+}
+
+func newConnectedHook(t *testing.T, opts *Options) (*Hook, *testService) {
+	s, address := newTestService(t)
+	opts.Address = address
+	h := newTestHook(t, opts)
+	require.Eventually(t, h.Connected, time.Second, time.Millisecond)
+	return h, s
+}
+
+func TestID(t *testing.T) {
+	h := new(Hook)
+	require.Equal(t, "grpc-bridge", h.ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := newTestHook(t, &Options{
+		Address: "127.0.0.1:1",
+		Events:  []string{EventACLCheck, EventDisconnect},
+	})
+	require.True(t, h.Provides(mqtt.OnACLCheck))
+	require.True(t, h.Provides(mqtt.OnDisconnect))
+	require.False(t, h.Provides(mqtt.OnConnectAuthenticate))
+	require.False(t, h.Provides(mqtt.OnPublished))
+}
+
+func TestInitBadConfig(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(map[string]any{})
+	require.ErrorIs(t, err, mqtt.ErrInvalidConfigType)
+}
+
+func TestInitNoAddress(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.ErrorIs(t, err, ErrNoAddress)
+}
+
+func TestInitNoEvents(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Address: "127.0.0.1:1"})
+	require.ErrorIs(t, err, ErrNoEvents)
+}
+
+func TestInitUnknownEvent(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Address: "127.0.0.1:1", Events: []string{EventPublish, "nope"}})
+	require.ErrorIs(t, err, ErrUnknownEvent)
+}
+
+func TestInitDefaults(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{Address: "127.0.0.1:1", Events: []string{EventPublished}}))
+	defer h.Stop()
+	require.Equal(t, int64(defaultTimeout), h.config.Timeout)
+	require.Equal(t, defaultQueueSize, cap(h.out))
+	require.Equal(t, int64(defaultReconnectBackoff), h.config.ReconnectBackoff)
+}
+
+func TestStop(t *testing.T) {
+	h, _ := newConnectedHook(t, new(Options))
+	require.NoError(t, h.Stop())
+	require.False(t, h.Connected())
+	require.NoError(t, h.Stop())
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	h, _ := newConnectedHook(t, new(Options))
+
+	cl := &mqtt.Client{ID: "cl1"}
+	require.True(t, h.OnConnectAuthenticate(cl, packets.Packet{
+		Connect: packets.ConnectParams{Username: []byte("mochi"), Password: []byte("password-mochi")},
+	}))
+	require.False(t, cl.IsSuperuser())
+
+	require.False(t, h.OnConnectAuthenticate(cl, packets.Packet{
+		Connect: packets.ConnectParams{Username: []byte("mochi"), Password: []byte("wrong")},
+	}))
+
+	admin := &mqtt.Client{ID: "cl2"}
+	require.True(t, h.OnConnectAuthenticate(admin, packets.Packet{
+		Connect: packets.ConnectParams{Username: []byte("admin"), Password: []byte("password-admin")},
+	}))
+	require.True(t, admin.IsSuperuser())
+}
+
+func TestOnACLCheck(t *testing.T) {
+	h, _ := newConnectedHook(t, new(Options))
+	cl := &mqtt.Client{ID: "cl1"}
+	require.True(t, h.OnACLCheck(cl, "a/b", false))
+	require.True(t, h.OnACLCheck(cl, "cl1/out", true))
+	require.False(t, h.OnACLCheck(cl, "a/b", true))
+}
+
+func TestOnPublish(t *testing.T) {
+	h, _ := newConnectedHook(t, new(Options))
+	cl := &mqtt.Client{ID: "cl1"}
+
+	pk, err := h.OnPublish(cl, packets.Packet{TopicName: "a/b", Payload: []byte("hello")})
+	require.NoError(t, err)
+	require.Equal(t, "a/b", pk.TopicName)
+	require.Equal(t, []byte("hello"), pk.Payload)
+
+	_, err = h.OnPublish(cl, packets.Packet{TopicName: "deny", Payload: []byte("hello")})
+	require.ErrorIs(t, err, packets.ErrRejectPacket)
+
+	pk, err = h.OnPublish(cl, packets.Packet{TopicName: "mutate", Payload: []byte("hello")})
+	require.NoError(t, err)
+	require.Equal(t, "mutated", pk.TopicName)
+	require.Equal(t, []byte("changed"), pk.Payload)
+}
+
+func TestOnPublishTimeout(t *testing.T) {
+	h, _ := newConnectedHook(t, &Options{Timeout: 20})
+	_, err := h.OnPublish(&mqtt.Client{ID: "cl1"}, packets.Packet{TopicName: "slow"})
+	require.ErrorIs(t, err, packets.ErrRejectPacket)
+	require.Empty(t, h.pending)
+}
+
+func TestOnPublishTimeoutFailOpen(t *testing.T) {
+	h, _ := newConnectedHook(t, &Options{Timeout: 20, FailOpen: true})
+	pk, err := h.OnPublish(&mqtt.Client{ID: "cl1"}, packets.Packet{TopicName: "slow"})
+	require.NoError(t, err)
+	require.Equal(t, "slow", pk.TopicName)
+}
+
+func TestNotConnected(t *testing.T) {
+	h := newTestHook(t, &Options{Address: "127.0.0.1:1"})
+	require.False(t, h.Connected())
+	require.False(t, h.OnACLCheck(&mqtt.Client{ID: "cl1"}, "a/b", false))
+
+	_, err := h.request(context.Background(), &bridgeEvent{})
+	require.ErrorIs(t, err, ErrNotConnected)
+}
+
+func TestNotConnectedFailOpen(t *testing.T) {
+	h := newTestHook(t, &Options{Address: "127.0.0.1:1", FailOpen: true})
+	require.True(t, h.OnACLCheck(&mqtt.Client{ID: "cl1"}, "a/b", false))
+}
+
+func TestNotify(t *testing.T) {
+	h, s := newConnectedHook(t, &Options{
+		Events: []string{EventConnect, EventDisconnect, EventSubscribed, EventUnsubscribed, EventPublished},
+	})
+
+	cl := &mqtt.Client{ID: "cl1", Net: mqtt.ClientConnection{Remote: "127.0.0.1", Listener: "t1"}}
+	cl.Properties.Username = []byte("mochi")
+
+	h.OnSessionEstablished(cl, packets.Packet{})
+	ev := <-s.events
+	require.Equal(t, typeConnect, ev.typ)
+	require.Equal(t, "cl1", ev.clientID)
+	require.Equal(t, "mochi", ev.username)
+	require.Equal(t, "127.0.0.1", ev.remote)
+	require.Equal(t, "t1", ev.listener)
+
+	h.OnSubscribed(cl, packets.Packet{Filters: packets.Subscriptions{
+		{Filter: "a/#", Qos: 1},
+		{Filter: "b/#"},
+	}}, []byte{1, 0})
+	ev = <-s.events
+	require.Equal(t, typeSubscribed, ev.typ)
+	require.Equal(t, "a/#", ev.topic)
+	require.Equal(t, byte(1), ev.qos)
+	ev = <-s.events
+	require.Equal(t, "b/#", ev.topic)
+
+	h.OnUnsubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a/#"}}})
+	ev = <-s.events
+	require.Equal(t, typeUnsubscribed, ev.typ)
+	require.Equal(t, "a/#", ev.topic)
+
+	pk := packets.Packet{TopicName: "a/b", Payload: []byte("hello")}
+	pk.FixedHeader.Qos = 2
+	pk.FixedHeader.Retain = true
+	h.OnPublished(cl, pk)
+	ev = <-s.events
+	require.Equal(t, typePublished, ev.typ)
+	require.Equal(t, "a/b", ev.topic)
+	require.Equal(t, []byte("hello"), ev.payload)
+	require.Equal(t, byte(2), ev.qos)
+	require.True(t, ev.retain)
+
+	h.OnDisconnect(cl, packets.ErrKeepAliveTimeout, false)
+	ev = <-s.events
+	require.Equal(t, typeDisconnect, ev.typ)
+	require.Equal(t, packets.ErrKeepAliveTimeout.Error(), ev.err)
+}
+
+func TestNotifyNotConnected(t *testing.T) {
+	h := newTestHook(t, &Options{Address: "127.0.0.1:1", Events: []string{EventPublished}})
+	h.OnPublished(&mqtt.Client{ID: "cl1"}, packets.Packet{TopicName: "a/b"})
+	require.Equal(t, int64(1), h.Dropped())
+	require.Empty(t, h.out)
+}
+
+func TestReconnect(t *testing.T) {
+	s, address := newTestService(t)
+	s.end = 2
+
+	h := newTestHook(t, &Options{Address: address, ReconnectBackoff: 5})
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&s.streams) == 3 && h.Connected()
+	}, time.Second, time.Millisecond)
+	require.True(t, h.OnACLCheck(&mqtt.Client{ID: "cl1"}, "a/b", false))
+}
+
+func TestCodec(t *testing.T) {
+	c := bridgeCodec{}
+
+	ev := &bridgeEvent{
+		id:       7,
+		typ:      typePublish,
+		clientID: "cl1",
+		username: "mochi",
+		password: []byte("pass"),
+		remote:   "127.0.0.1",
+		listener: "t1",
+		topic:    "a/b",
+		payload:  []byte("hello"),
+		qos:      1,
+		retain:   true,
+		write:    true,
+		err:      "closed",
+	}
+	b, err := c.Marshal(ev)
+	require.NoError(t, err)
+	out := new(bridgeEvent)
+	require.NoError(t, c.Unmarshal(b, out))
+	require.Equal(t, ev, out)
+
+	r := &bridgeResponse{id: 7, allow: true, superuser: true, mutate: true, topic: "a/c", payload: []byte("x")}
+	b, err = c.Marshal(r)
+	require.NoError(t, err)
+	rout := new(bridgeResponse)
+	require.NoError(t, c.Unmarshal(b, rout))
+	require.Equal(t, r, rout)
+
+	_, err = c.Marshal("nope")
+	require.Error(t, err)
+	require.Error(t, c.Unmarshal(b, new(string)))
+	require.Error(t, c.Unmarshal([]byte{0xff}, new(bridgeResponse)))
+}
@@ -115,6 +115,11 @@ func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
 	h.Log.Debug("inflight dropped", "m", h.packetMeta(pk))
 }
 
+// OnQueuedMessage is called when a publish packet with Qos is queued for a disconnected client.
+func (h *Hook) OnQueuedMessage(cl *mqtt.Client, pk packets.Packet) {
+	h.Log.Debug("inflight queued", "m", h.packetMeta(pk))
+}
+
 // OnLWTSent is called when a Will Message has been issued from a disconnecting client.
 func (h *Hook) OnLWTSent(cl *mqtt.Client, pk packets.Packet) {
 	h.Log.Debug("sent lwt for client", "method", "OnLWTSent", "client", cl.ID)
@@ -125,6 +130,11 @@ func (h *Hook) OnRetainedExpired(filter string) {
 	h.Log.Debug("retained message expired", "method", "OnRetainedExpired", "topic", filter)
 }
 
+// OnListenerConnection is called when a connection is accepted or closed by a listener.
+func (h *Hook) OnListenerConnection(listener string, event mqtt.ListenerEvent, err error) {
+	h.Log.Debug("listener connection", "method", "OnListenerConnection", "listener", listener, "event", event, "error", err)
+}
+
 // OnClientExpired is called when the server clears an expired client.
 func (h *Hook) OnClientExpired(cl *mqtt.Client) {
 	h.Log.Debug("client session expired", "method", "OnClientExpired", "client", cl.ID)
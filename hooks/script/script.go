@@ -0,0 +1,320 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+// Package script provides a hook which passes published messages to a JavaScript script run
+// by goja, so payload transformation and routing rules can be written without recompiling
+// the broker.
+//
+// The script defines a global onPublish function, which is called with a message object
+// containing the clientId, username, topic, payload (as a string), qos and retain of each
+// message published by a client. It returns false to reject the message, an object to replace
+// the topic, payload or retain of the message with its topic, payload and retain properties,
+// or nothing to leave the message unchanged. The script may call:
+//
+//	mochi.publish(topic, payload, retain, qos) // publish a message once onPublish returns
+//	mochi.log(message)                         // write a message to the server logger
+//	mochi.kv.get(key)                          // get a value stored by the script
+//	mochi.kv.set(key, value)                   // store a value, kept until the server stops
+//	mochi.kv.delete(key)                       // delete a stored value
+//
+// Messages published by the inline client, including those published by the script, are not
+// passed to onPublish, so routing rules cannot loop.
+package script
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+
+	"github.com/dop251/goja"
+)
+
+const (
+	// defaultTimeout is the default milliseconds the script may run for on each event.
+	defaultTimeout = 100
+
+	// publishFunction is the name of the function called for each published message.
+	publishFunction = "onPublish"
+)
+
+var (
+	// ErrNoScript indicates neither a script path nor the script source were configured.
+	ErrNoScript = errors.New("no script")
+
+	// ErrTimeout indicates the script did not return within the time limit.
+	ErrTimeout = errors.New("script timed out")
+
+	// ErrNoServer indicates the script published a message but the server was not configured.
+	ErrNoServer = errors.New("script cannot publish without a server")
+)
+
+// Options contains the configuration of the script hook.
+type Options struct {
+	// Path is the path of the JavaScript file to load.
+	Path string `yaml:"path" json:"path"`
+
+	// Script is the JavaScript source, used instead of reading Path if set.
+	Script string `yaml:"script" json:"script"`
+
+	// Timeout is the milliseconds the script may run for when it is loaded and on each
+	// event, after which it is interrupted and fails (default 100).
+	Timeout int64 `yaml:"timeout" json:"timeout"`
+
+	// RejectOnError rejects messages for which onPublish fails or times out. By default
+	// they are published unchanged.
+	RejectOnError bool `yaml:"reject_on_error" json:"reject_on_error"`
+
+	// Server is the server which messages published by the script are published to. The
+	// server must have the inline client enabled.
+	Server *mqtt.Server `yaml:"-" json:"-"`
+}
+
+// message is a message published by the script.
+type message struct {
+	topic   string
+	payload []byte
+	retain  bool
+	qos     byte
+}
+
+// Hook is a hook which passes published messages to a JavaScript script.
+type Hook struct {
+	mqtt.HookBase
+	mu        sync.Mutex // guards the runtime, which is not safe for concurrent use
+	config    *Options
+	vm        *goja.Runtime
+	onPublish goja.Callable  // the onPublish function of the script, if defined
+	kv        map[string]any // the values stored by the script
+	queued    []message      // the messages published by the script during the current call
+}
+
+// ID returns the ID of the hook.
+func (h *Hook) ID() string {
+	return "script"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublish,
+	}, []byte{b})
+}
+
+// Init loads and runs the script.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.kv = make(map[string]any)
+	if err := h.load(config.(*Options)); err != nil {
+		return err
+	}
+
+	h.Log.Info("loaded script", "path", h.config.Path, "timeout", h.config.Timeout)
+
+	return nil
+}
+
+// Reload replaces the script while the server is running. Values stored by the previous
+// script are kept, and events in progress complete with the previous script.
+func (h *Hook) Reload(config any) error {
+	o, ok := config.(*Options)
+	if !ok || o == nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.load(o); err != nil {
+		return err
+	}
+
+	h.Log.Info("reloaded script", "path", h.config.Path, "timeout", h.config.Timeout)
+
+	return nil
+}
+
+// load creates a runtime with the mochi api and runs the script in it, replacing the
+// runtime in use if the script runs successfully. The caller must hold mu.
+func (h *Hook) load(o *Options) error {
+	if o.Path == "" && o.Script == "" {
+		return ErrNoScript
+	}
+
+	if o.Timeout <= 0 {
+		o.Timeout = defaultTimeout
+	}
+
+	src, name := o.Script, "script.js"
+	if src == "" {
+		b, err := os.ReadFile(o.Path)
+		if err != nil {
+			return fmt.Errorf("failed to read script: %w", err)
+		}
+		src, name = string(b), o.Path
+	}
+
+	vm := goja.New()
+	if err := vm.Set("mochi", h.api(vm, o)); err != nil {
+		return err
+	}
+
+	_, err := run(vm, o.Timeout, func() (goja.Value, error) {
+		return vm.RunScript(name, src)
+	})
+	h.queued = nil // messages cannot be published before the server has started
+	if err != nil {
+		return fmt.Errorf("failed to run script: %w", err)
+	}
+
+	fn, _ := goja.AssertFunction(vm.Get(publishFunction))
+
+	h.config = o
+	h.vm = vm
+	h.onPublish = fn
+
+	return nil
+}
+
+// api returns the mochi object which is available to the script.
+func (h *Hook) api(vm *goja.Runtime, o *Options) *goja.Object {
+	kv := vm.NewObject()
+	_ = kv.Set("get", func(key string) any {
+		return h.kv[key]
+	})
+	_ = kv.Set("set", func(key string, value goja.Value) {
+		h.kv[key] = value.Export()
+	})
+	_ = kv.Set("delete", func(key string) {
+		delete(h.kv, key)
+	})
+
+	api := vm.NewObject()
+	_ = api.Set("kv", kv)
+	_ = api.Set("log", func(msg string) {
+		h.Log.Info(msg, "hook", h.ID())
+	})
+	_ = api.Set("publish", func(topic, payload string, retain bool, qos int) {
+		if o.Server == nil {
+			panic(vm.NewGoError(ErrNoServer))
+		}
+
+		h.queued = append(h.queued, message{
+			topic:   topic,
+			payload: []byte(payload),
+			retain:  retain,
+			qos:     byte(qos),
+		})
+	})
+
+	return api
+}
+
+// run calls fn, interrupting the runtime if it does not return within the timeout.
+func run(vm *goja.Runtime, timeout int64, fn func() (goja.Value, error)) (goja.Value, error) {
+	timer := time.AfterFunc(time.Duration(timeout)*time.Millisecond, func() {
+		vm.Interrupt(ErrTimeout)
+	})
+	defer vm.ClearInterrupt()
+	defer timer.Stop()
+
+	v, err := fn()
+	var ie *goja.InterruptedError
+	if errors.As(err, &ie) && ie.Value() == ErrTimeout {
+		return nil, ErrTimeout
+	}
+
+	return v, err
+}
+
+// OnPublish passes a message published by a client to the onPublish function of the script,
+// rejecting or replacing the message according to the result, and then publishes any
+// messages published by the script.
+func (h *Hook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if cl.Net.Inline {
+		return pk, nil
+	}
+
+	h.mu.Lock()
+	if h.onPublish == nil {
+		h.mu.Unlock()
+		return pk, nil
+	}
+
+	o := h.config
+	v, err := run(h.vm, o.Timeout, func() (goja.Value, error) {
+		return h.onPublish(goja.Undefined(), h.vm.ToValue(map[string]any{
+			"clientId": cl.ID,
+			"username": string(cl.Properties.Username),
+			"topic":    pk.TopicName,
+			"payload":  string(pk.Payload),
+			"qos":      pk.FixedHeader.Qos,
+			"retain":   pk.FixedHeader.Retain,
+		}))
+	})
+
+	var result any
+	if err == nil && v != nil {
+		result = v.Export()
+	}
+
+	queued := h.queued
+	h.queued = nil
+	h.mu.Unlock()
+
+	h.publish(o, queued)
+
+	if err != nil {
+		h.Log.Warn("script failed", "error", err, "function", publishFunction, "client", cl.ID, "topic", pk.TopicName)
+		if o.RejectOnError {
+			return pk, packets.ErrRejectPacket
+		}
+		return pk, nil
+	}
+
+	switch r := result.(type) {
+	case bool:
+		if !r {
+			return pk, packets.ErrRejectPacket
+		}
+	case map[string]any:
+		if topic, ok := r["topic"].(string); ok && topic != "" {
+			pk.TopicName = topic
+		}
+
+		if payload, ok := r["payload"].(string); ok {
+			pk.Payload = []byte(payload)
+		}
+
+		if retain, ok := r["retain"].(bool); ok {
+			pk.FixedHeader.Retain = retain
+		}
+	}
+
+	return pk, nil
+}
+
+// publish publishes the messages published by the script.
+func (h *Hook) publish(o *Options, queued []message) {
+	for _, m := range queued {
+		if err := o.Server.Publish(m.topic, m.payload, m.retain, m.qos); err != nil {
+			h.Log.Warn("failed to publish script message", "error", err, "topic", m.topic)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package script
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+var logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+const testScript = `
+function onPublish(msg) {
+	if (msg.topic === "deny") {
+		return false;
+	}
+
+	if (msg.topic === "upper") {
+		return { payload: msg.payload.toUpperCase() };
+	}
+
+	if (msg.topic === "move") {
+		return { topic: "moved/" + msg.clientId, retain: true };
+	}
+
+	if (msg.topic === "route") {
+		mochi.publish("routed/" + msg.username, msg.payload, false, 0);
+	}
+
+	if (msg.topic === "count") {
+		var n = (mochi.kv.get("count") || 0) + 1;
+		mochi.kv.set("count", n);
+		return { payload: String(n) };
+	}
+
+	if (msg.topic === "loop") {
+		while (true) {}
+	}
+
+	if (msg.topic === "throw") {
+		throw new Error("failed");
+	}
+}
+`
+
+func newTestHook(t *testing.T, opts *Options) *Hook {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	if opts.Path == "" && opts.Script == "" {
+		opts.Script = testScript
+	}
+
+	require.NoError(t, h.Init(opts))
+	return h
+}
+
+func newTestClient() *mqtt.Client {
+	cl := &mqtt.Client{ID: "cl1"}
+	cl.Properties.Username = []byte("mochi")
+	return cl
+}
+
+func TestID(t *testing.T) {
+	h := new(Hook)
+	require.Equal(t, "script", h.ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := new(Hook)
+	require.True(t, h.Provides(mqtt.OnPublish))
+	require.False(t, h.Provides(mqtt.OnACLCheck))
+}
+
+func TestInitBadConfig(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(map[string]any{})
+	require.ErrorIs(t, err, mqtt.ErrInvalidConfigType)
+}
+
+func TestInitNoScript(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.ErrorIs(t, err, ErrNoScript)
+}
+
+func TestInitSyntaxError(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Script: "function ("})
+	require.Error(t, err)
+}
+
+func TestInitTimeout(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Script: "while (true) {}", Timeout: 20})
+	require.ErrorIs(t, err, ErrTimeout)
+}
+
+func TestInitPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.js")
+	require.NoError(t, os.WriteFile(path, []byte(testScript), 0600))
+
+	h := newTestHook(t, &Options{Path: path})
+	require.Equal(t, int64(defaultTimeout), h.config.Timeout)
+	require.NotNil(t, h.onPublish)
+}
+
+func TestInitPathMissing(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Path: filepath.Join(t.TempDir(), "missing.js")})
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestOnPublishUnchanged(t *testing.T) {
+	h := newTestHook(t, new(Options))
+	pk := packets.Packet{TopicName: "a/b", Payload: []byte("hello")}
+	out, err := h.OnPublish(newTestClient(), pk)
+	require.NoError(t, err)
+	require.Equal(t, pk, out)
+}
+
+func TestOnPublishNoFunction(t *testing.T) {
+	h := newTestHook(t, &Options{Script: "var a = 1;"})
+	pk := packets.Packet{TopicName: "deny"}
+	out, err := h.OnPublish(newTestClient(), pk)
+	require.NoError(t, err)
+	require.Equal(t, pk, out)
+}
+
+func TestOnPublishReject(t *testing.T) {
+	h := newTestHook(t, new(Options))
+	_, err := h.OnPublish(newTestClient(), packets.Packet{TopicName: "deny"})
+	require.ErrorIs(t, err, packets.ErrRejectPacket)
+}
+
+func TestOnPublishTransform(t *testing.T) {
+	h := newTestHook(t, new(Options))
+	out, err := h.OnPublish(newTestClient(), packets.Packet{TopicName: "upper", Payload: []byte("hello")})
+	require.NoError(t, err)
+	require.Equal(t, "upper", out.TopicName)
+	require.Equal(t, []byte("HELLO"), out.Payload)
+
+	out, err = h.OnPublish(newTestClient(), packets.Packet{TopicName: "move", Payload: []byte("hello")})
+	require.NoError(t, err)
+	require.Equal(t, "moved/cl1", out.TopicName)
+	require.Equal(t, []byte("hello"), out.Payload)
+	require.True(t, out.FixedHeader.Retain)
+}
+
+func TestOnPublishInline(t *testing.T) {
+	h := newTestHook(t, new(Options))
+	cl := newTestClient()
+	cl.Net.Inline = true
+	_, err := h.OnPublish(cl, packets.Packet{TopicName: "deny"})
+	require.NoError(t, err)
+}
+
+func TestOnPublishKV(t *testing.T) {
+	h := newTestHook(t, new(Options))
+	for _, want := range []string{"1", "2", "3"} {
+		out, err := h.OnPublish(newTestClient(), packets.Packet{TopicName: "count"})
+		require.NoError(t, err)
+		require.Equal(t, []byte(want), out.Payload)
+	}
+}
+
+func TestOnPublishTimeout(t *testing.T) {
+	h := newTestHook(t, &Options{Timeout: 20})
+	pk := packets.Packet{TopicName: "loop"}
+	out, err := h.OnPublish(newTestClient(), pk)
+	require.NoError(t, err)
+	require.Equal(t, pk, out)
+
+	// the runtime can be used once the interrupt is cleared
+	_, err = h.OnPublish(newTestClient(), packets.Packet{TopicName: "deny"})
+	require.ErrorIs(t, err, packets.ErrRejectPacket)
+}
+
+func TestOnPublishErrorReject(t *testing.T) {
+	h := newTestHook(t, &Options{RejectOnError: true})
+	_, err := h.OnPublish(newTestClient(), packets.Packet{TopicName: "throw"})
+	require.ErrorIs(t, err, packets.ErrRejectPacket)
+}
+
+func TestOnPublishRoute(t *testing.T) {
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	h := newTestHook(t, &Options{Server: server})
+
+	routed := make(chan packets.Packet, 1)
+	err := server.Subscribe("routed/#", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		routed <- pk
+	})
+	require.NoError(t, err)
+
+	out, err := h.OnPublish(newTestClient(), packets.Packet{TopicName: "route", Payload: []byte("hello")})
+	require.NoError(t, err)
+	require.Equal(t, "route", out.TopicName)
+
+	pk := <-routed
+	require.Equal(t, "routed/mochi", pk.TopicName)
+	require.Equal(t, []byte("hello"), pk.Payload)
+}
+
+func TestOnPublishRouteNoServer(t *testing.T) {
+	h := newTestHook(t, &Options{RejectOnError: true})
+	_, err := h.OnPublish(newTestClient(), packets.Packet{TopicName: "route"})
+	require.ErrorIs(t, err, packets.ErrRejectPacket)
+	require.Empty(t, h.queued)
+}
+
+func TestReload(t *testing.T) {
+	h := newTestHook(t, new(Options))
+	_, err := h.OnPublish(newTestClient(), packets.Packet{TopicName: "count"})
+	require.NoError(t, err)
+
+	err = h.Reload(&Options{Script: `function onPublish(msg) { return { payload: "v2:" + mochi.kv.get("count") }; }`})
+	require.NoError(t, err)
+
+	out, err := h.OnPublish(newTestClient(), packets.Packet{TopicName: "deny"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2:1"), out.Payload)
+}
+
+func TestReloadBadConfig(t *testing.T) {
+	h := newTestHook(t, new(Options))
+	require.ErrorIs(t, h.Reload(nil), mqtt.ErrInvalidConfigType)
+	require.Error(t, h.Reload(&Options{Script: "function ("}))
+
+	// the previous script is still in use
+	_, err := h.OnPublish(newTestClient(), packets.Packet{TopicName: "deny"})
+	require.ErrorIs(t, err, packets.ErrRejectPacket)
+}
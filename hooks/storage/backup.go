@@ -0,0 +1,132 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// maxBackupFieldSize is the maximum size of a key or value read from a backup.
+	maxBackupFieldSize = 256 << 20
+)
+
+var (
+	// ErrInvalidBackup indicates a backup is malformed or truncated.
+	ErrInvalidBackup = errors.New("invalid backup")
+
+	// backupMagic prefixes backups written by Backup.
+	backupMagic = []byte("MQBK")
+)
+
+// Backup writes the schema version and records of a store to w. Each record is written as
+// a length-prefixed key and value, and the backup ends with an empty key. Values are written
+// as returned by the store, so backups of encrypted stores are not encrypted.
+func Backup(w io.Writer, r Records) error {
+	version, _, err := r.SchemaVersion()
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	bw := bufio.NewWriter(w)
+	buf := make([]byte, 0, binary.MaxVarintLen64)
+	_, _ = bw.Write(backupMagic)
+	_, _ = bw.Write(binary.AppendUvarint(buf, uint64(version)))
+
+	err = r.Each(func(key string, value []byte) error {
+		_, _ = bw.Write(binary.AppendUvarint(buf, uint64(len(key))))
+		_, _ = bw.WriteString(key)
+		_, _ = bw.Write(binary.AppendUvarint(buf, uint64(len(value))))
+		_, err := bw.Write(value)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	_, _ = bw.Write(binary.AppendUvarint(buf, 0))
+	return bw.Flush()
+}
+
+// Restore replaces the records of a store with the records of a backup written by Backup,
+// and migrates them to the current schema version. Backups written by a newer schema
+// version are refused. Restore is not atomic, and a failed restore should be retried.
+func Restore(rd io.Reader, r Records) error {
+	br := bufio.NewReader(rd)
+	magic := make([]byte, len(backupMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != string(backupMagic) {
+		return ErrInvalidBackup
+	}
+
+	version, err := binary.ReadUvarint(br)
+	if err != nil {
+		return ErrInvalidBackup
+	}
+
+	if version > SchemaVersion {
+		return fmt.Errorf("%w: backup version %d, supported version %d", ErrNewerSchemaVersion, version, SchemaVersion)
+	}
+
+	var keys []string
+	err = r.Each(func(key string, _ []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := r.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	for {
+		key, err := readBackupField(br)
+		if err != nil {
+			return err
+		}
+
+		if len(key) == 0 {
+			break
+		}
+
+		value, err := readBackupField(br)
+		if err != nil {
+			return err
+		}
+
+		if err := r.Set(string(key), value); err != nil {
+			return err
+		}
+	}
+
+	if err := r.SetSchemaVersion(int(version)); err != nil {
+		return err
+	}
+
+	_, err = Migrate(r, Migrations, SchemaVersion)
+	return err
+}
+
+// readBackupField reads a length-prefixed field from a backup.
+func readBackupField(br *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil || n > maxBackupFieldSize {
+		return nil, ErrInvalidBackup
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return nil, ErrInvalidBackup
+	}
+
+	return b, nil
+}
@@ -0,0 +1,97 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupRestore(t *testing.T) {
+	src := &memRecords{version: SchemaVersion, hasVer: true, data: map[string][]byte{
+		"CL_a":  []byte(`{"id":"a"}`),
+		"RET_b": []byte(`{"topic_name":"b"}`),
+		"SYS":   {},
+	}}
+
+	buf := new(bytes.Buffer)
+	err := Backup(buf, src)
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(buf.Bytes(), backupMagic))
+
+	dst := &memRecords{data: map[string][]byte{
+		"CL_old": []byte(`{"id":"old"}`),
+	}}
+	err = Restore(buf, dst)
+	require.NoError(t, err)
+	require.Equal(t, src.data, dst.data)
+	require.Equal(t, SchemaVersion, dst.version)
+}
+
+func TestBackupVersionError(t *testing.T) {
+	err := Backup(new(bytes.Buffer), &memRecords{fail: errors.New("test")})
+	require.ErrorContains(t, err, "failed to read schema version")
+}
+
+func TestRestoreMigratesOlderBackup(t *testing.T) {
+	migrations := Migrations
+	defer func() {
+		Migrations = migrations
+	}()
+
+	Migrations = []Migration{
+		{
+			Version: SchemaVersion,
+			Upgrade: func(key string, value []byte) ([]byte, error) {
+				return append(value, '!'), nil
+			},
+		},
+	}
+
+	buf := new(bytes.Buffer)
+	err := Backup(buf, &memRecords{data: map[string][]byte{"CL_a": []byte("a")}})
+	require.NoError(t, err)
+
+	dst := &memRecords{data: map[string][]byte{}}
+	err = Restore(buf, dst)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a!"), dst.data["CL_a"])
+	require.Equal(t, SchemaVersion, dst.version)
+}
+
+func TestRestoreNewerBackup(t *testing.T) {
+	buf := new(bytes.Buffer)
+	err := Backup(buf, &memRecords{version: SchemaVersion + 1, hasVer: true, data: map[string][]byte{}})
+	require.NoError(t, err)
+
+	dst := &memRecords{data: map[string][]byte{"CL_a": []byte("a")}}
+	err = Restore(buf, dst)
+	require.ErrorIs(t, err, ErrNewerSchemaVersion)
+	require.Len(t, dst.data, 1)
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	buf := new(bytes.Buffer)
+	err := Backup(buf, &memRecords{version: 1, hasVer: true, data: map[string][]byte{"CL_a": []byte("a")}})
+	require.NoError(t, err)
+	b := buf.Bytes()
+
+	tt := [][]byte{
+		{},
+		[]byte("NOPE"),
+		backupMagic,
+		b[:len(b)-1],
+		b[:len(b)-3],
+		append(append([]byte{}, backupMagic...), 1, 0xff, 0xff, 0xff, 0xff, 0x0f),
+	}
+
+	for _, tx := range tt {
+		err = Restore(bytes.NewReader(tx), &memRecords{data: map[string][]byte{}})
+		require.ErrorIs(t, err, ErrInvalidBackup)
+	}
+}
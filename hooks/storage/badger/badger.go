@@ -8,7 +8,10 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	badgerdb "github.com/dgraph-io/badger/v4"
@@ -23,6 +26,8 @@ const (
 	defaultDbFile         = ".badger"
 	defaultGcInterval     = 5 * 60 // gc interval in seconds
 	defaultGcDiscardRatio = 0.5
+	defaultBatchSize      = 1000 // the maximum number of queued writes committed in one batch
+	defaultBatchInterval  = 100  // the maximum time in milliseconds a write is queued before it is committed
 )
 
 // clientKey returns a primary key for a client.
@@ -45,6 +50,11 @@ func inflightKey(cl *mqtt.Client, pk packets.Packet) string {
 	return storage.InflightKey + "_" + cl.ID + ":" + pk.FormatID()
 }
 
+// queuedKey returns a primary key for a message queued for a disconnected client.
+func queuedKey(cl *mqtt.Client, pk packets.Packet) string {
+	return storage.QueuedKey + "_" + cl.ID + ":" + pk.FormatID()
+}
+
 // sysInfoKey returns a primary key for system info.
 func sysInfoKey() string {
 	return storage.SysInfoKey
@@ -66,14 +76,63 @@ type Options struct {
 	// discardRatio must be in the range (0.0, 1.0), both endpoints excluded, otherwise, it will be set to the default value of 0.5.
 	GcDiscardRatio float64 `yaml:"gc_discard_ratio" json:"gc_discard_ratio"`
 	GcInterval     int64   `yaml:"gc_interval" json:"gc_interval"`
+	// AsyncWrites queues writes and commits them in batched transactions, when BatchSize writes are
+	// queued or BatchInterval milliseconds have passed, rather than committing a transaction per event.
+	// Queued writes are committed when the hook is stopped, but are lost if the process exits unexpectedly.
+	AsyncWrites   bool  `yaml:"async_writes" json:"async_writes"`
+	BatchSize     int   `yaml:"batch_size" json:"batch_size"`
+	BatchInterval int64 `yaml:"batch_interval" json:"batch_interval"`
+
+	// Compression compresses retained and inflight message payloads above a size threshold.
+	Compression storage.Compression `yaml:"compression" json:"compression"`
+
+	// Encryption encrypts stored values with AES-GCM, if set.
+	Encryption *storage.Encryption `yaml:"encryption" json:"encryption"`
+
+	// Durability sets when writes are synchronized to disk. By default writes are synchronized
+	// according to Options.SyncWrites.
+	Durability storage.Durability `yaml:"durability" json:"durability"`
+
+	// Namespace prefixes the keys of stored values, so several brokers can share a database.
+	Namespace storage.Namespace `yaml:"namespace" json:"namespace"`
+
+	// ReadOnly opens the database read-only, so a standby broker can restore from it without
+	// writing to it. A read-only hook only provides the methods which read from the store, and
+	// does not collect garbage or queue writes.
+	ReadOnly bool `yaml:"read_only" json:"read_only"`
+}
+
+// write is a queued write of a key.
+type write struct {
+	key   []byte        // the key to write
+	value []byte        // the value to set
+	ttl   time.Duration // the time until the value expires, or 0 if it does not expire
+	del   bool          // delete the key rather than setting a value
+}
+
+// entry returns the badger entry which sets the value of the write.
+func (w write) entry() *badgerdb.Entry {
+	e := badgerdb.NewEntry(w.key, w.value)
+	if w.ttl > 0 {
+		e = e.WithTTL(w.ttl)
+	}
+	return e
 }
 
 // Hook is a persistent storage hook based using BadgerDB file store as a backend.
 type Hook struct {
 	mqtt.HookBase
-	config   *Options     // options for configuring the BadgerDB instance.
-	gcTicker *time.Ticker // Ticker for BadgerDB garbage collection.
-	db       *badgerdb.DB // the BadgerDB instance.
+	config   *Options           // options for configuring the BadgerDB instance.
+	gcTicker *time.Ticker       // Ticker for BadgerDB garbage collection.
+	db       *badgerdb.DB       // the BadgerDB instance.
+	crypt    *storage.Encryptor // encrypts stored values, if encryption is enabled
+	syncer   *storage.Syncer    // synchronizes the database periodically, under the interval durability policy
+	writes   chan write         // queued writes, if async writes are enabled
+	flushes  chan chan error    // requests to commit the queued writes
+	done     chan struct{}      // closed to stop the batch loop
+	stopped  chan struct{}      // closed when the batch loop has committed all writes and stopped
+	stopOnce sync.Once          // ensures the batch loop is only stopped once
+	stats    storage.Recorder   // records the reads, writes and deletes of the hook
 }
 
 // ID returns the id of the hook.
@@ -81,9 +140,22 @@ func (h *Hook) ID() string {
 	return "badger-db"
 }
 
-// Provides indicates which hook methods this hook provides.
+// Provides indicates which hook methods this hook provides. A read-only hook only provides
+// the methods which read from the store.
 func (h *Hook) Provides(b byte) bool {
-	return bytes.Contains([]byte{
+	if bytes.Contains([]byte{
+		mqtt.StoredClients,
+		mqtt.StoredInflightMessages,
+		mqtt.StoredQueuedMessages,
+		mqtt.StoredRetainedMessages,
+		mqtt.StoredSubscriptions,
+		mqtt.StoredSysInfo,
+		mqtt.StoredSession,
+	}, []byte{b}) {
+		return true
+	}
+
+	return (h.config == nil || !h.config.ReadOnly) && bytes.Contains([]byte{
 		mqtt.OnSessionEstablished,
 		mqtt.OnDisconnect,
 		mqtt.OnSubscribed,
@@ -93,14 +165,10 @@ func (h *Hook) Provides(b byte) bool {
 		mqtt.OnQosPublish,
 		mqtt.OnQosComplete,
 		mqtt.OnQosDropped,
+		mqtt.OnQueuedMessage,
 		mqtt.OnSysInfoTick,
 		mqtt.OnClientExpired,
 		mqtt.OnRetainedExpired,
-		mqtt.StoredClients,
-		mqtt.StoredInflightMessages,
-		mqtt.StoredRetainedMessages,
-		mqtt.StoredSubscriptions,
-		mqtt.StoredSysInfo,
 	}, []byte{b})
 }
 
@@ -131,6 +199,24 @@ func (h *Hook) Init(config any) error {
 		h.config = config.(*Options)
 	}
 
+	if err := h.config.Compression.Validate(); err != nil {
+		return err
+	}
+
+	if err := h.config.Durability.Validate(); err != nil {
+		return err
+	}
+
+	if err := h.config.Namespace.Validate(); err != nil {
+		return err
+	}
+
+	var err error
+	h.crypt, err = storage.NewEncryptor(h.config.Encryption)
+	if err != nil {
+		return err
+	}
+
 	if len(h.config.Path) == 0 {
 		h.config.Path = defaultDbFile
 	}
@@ -148,25 +234,188 @@ func (h *Hook) Init(config any) error {
 		h.config.Options = &defaultOpts
 	}
 	h.config.Options.Logger = h
+	if h.config.ReadOnly {
+		h.config.Options.ReadOnly = true
+	}
+	h.config.Options.SyncWrites = h.config.Durability.SyncEach(h.config.Options.SyncWrites)
 
-	var err error
 	h.db, err = badgerdb.Open(*h.config.Options)
 	if err != nil {
 		return err
 	}
 
+	if err := h.migrateSchema(); err != nil {
+		_ = h.db.Close()
+		h.db = nil
+		return err
+	}
+
+	if h.config.ReadOnly {
+		return nil
+	}
+
 	h.gcTicker = time.NewTicker(time.Duration(h.config.GcInterval) * time.Second)
 	go h.gcLoop()
 
+	h.syncer = storage.NewSyncer(h.config.Durability.SyncInterval(), h.db.Sync)
+
+	if h.config.AsyncWrites {
+		if h.config.BatchSize <= 0 {
+			h.config.BatchSize = defaultBatchSize
+		}
+
+		if h.config.BatchInterval <= 0 {
+			h.config.BatchInterval = defaultBatchInterval
+		}
+
+		h.writes = make(chan write, h.config.BatchSize)
+		h.flushes = make(chan chan error)
+		h.done = make(chan struct{})
+		h.stopped = make(chan struct{})
+		go h.batchLoop(h.config.BatchSize, time.Duration(h.config.BatchInterval)*time.Millisecond)
+	}
+
 	return nil
 }
 
-// Stop closes the badger instance.
+// Stop commits any queued writes, synchronizes them and closes the badger instance.
 func (h *Hook) Stop() error {
 	if h.gcTicker != nil {
 		h.gcTicker.Stop()
 	}
-	return h.db.Close()
+
+	if h.done != nil {
+		h.stopOnce.Do(func() {
+			close(h.done)
+		})
+		<-h.stopped
+	}
+
+	serr := h.syncer.Stop()
+	if err := h.db.Close(); err != nil {
+		return err
+	}
+
+	return serr
+}
+
+// batchLoop commits queued writes in batches, when size writes have been queued, when the
+// oldest write has been queued for interval, or when a flush is requested.
+func (h *Hook) batchLoop(size int, interval time.Duration) {
+	defer close(h.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	pending := make([]write, 0, size)
+	for {
+		select {
+		case w := <-h.writes:
+			pending = append(pending, w)
+			if len(pending) >= size {
+				_ = h.commit(pending)
+				pending = pending[:0]
+			}
+		case <-ticker.C:
+			_ = h.commit(pending)
+			pending = pending[:0]
+		case reply := <-h.flushes:
+			pending = h.drain(pending)
+			reply <- h.commit(pending)
+			pending = pending[:0]
+		case <-h.done:
+			_ = h.commit(h.drain(pending))
+			return
+		}
+	}
+}
+
+// drain appends any writes waiting in the queue to pending.
+func (h *Hook) drain(pending []write) []write {
+	for {
+		select {
+		case w := <-h.writes:
+			pending = append(pending, w)
+		default:
+			return pending
+		}
+	}
+}
+
+// commit writes a batch of queued writes to the database.
+func (h *Hook) commit(writes []write) error {
+	if len(writes) == 0 {
+		return nil
+	}
+
+	wb := h.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	for _, w := range writes {
+		var err error
+		if w.del {
+			err = wb.Delete(w.key)
+		} else {
+			err = wb.SetEntry(w.entry())
+		}
+
+		if err != nil {
+			h.Log.Error("failed to batch data", "error", err, "key", string(w.key))
+			return err
+		}
+	}
+
+	err := wb.Flush()
+	if err != nil {
+		h.Log.Error("failed to commit batched data", "error", err, "writes", len(writes))
+	}
+	return err
+}
+
+// queue adds a write to the queue of writes to be committed in the next batch.
+func (h *Hook) queue(w write) error {
+	select {
+	case <-h.done:
+		return badgerdb.ErrDBClosed
+	default:
+	}
+
+	select {
+	case h.writes <- w:
+		return nil
+	case <-h.done:
+		return badgerdb.ErrDBClosed
+	}
+}
+
+// Flush commits any queued writes to the database, if async writes are enabled.
+func (h *Hook) Flush() error {
+	if h.flushes == nil {
+		return nil
+	}
+
+	reply := make(chan error, 1)
+	select {
+	case h.flushes <- reply:
+		return <-reply
+	case <-h.stopped:
+		return nil
+	}
+}
+
+// Health returns an error if the database is not open, or if it failed to be synchronized
+// to disk under the interval durability policy.
+func (h *Hook) Health() error {
+	if h.db == nil || h.db.IsClosed() {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return h.syncer.Err()
+}
+
+// StorageStats returns the counters and latencies of the reads, writes and deletes of the hook.
+func (h *Hook) StorageStats() storage.Stats {
+	return h.stats.Stats()
 }
 
 // OnSessionEstablished adds a client to the store when their session is established.
@@ -286,16 +535,19 @@ func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
 
 	props := pk.Properties.Copy(false)
 	in := &storage.Message{
-		ID:          retainedKey(pk.TopicName),
-		T:           storage.RetainedKey,
-		FixedHeader: pk.FixedHeader,
-		TopicName:   pk.TopicName,
-		Payload:     pk.Payload,
-		Created:     pk.Created,
-		Client:      cl.ID,
-		Origin:      pk.Origin,
+		ID:              retainedKey(pk.TopicName),
+		T:               storage.RetainedKey,
+		FixedHeader:     pk.FixedHeader,
+		TopicName:       pk.TopicName,
+		Payload:         pk.Payload,
+		Created:         pk.Created,
+		Expiry:          pk.Expiry,
+		ProtocolVersion: pk.ProtocolVersion,
+		Client:          cl.ID,
+		Origin:          pk.Origin,
 		Properties: storage.MessageProperties{
 			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
 			MessageExpiryInterval:  props.MessageExpiryInterval,
 			ContentType:            props.ContentType,
 			ResponseTopic:          props.ResponseTopic,
@@ -306,7 +558,11 @@ func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
 		},
 	}
 
-	_ = h.setKv(in.ID, in)
+	if err := h.config.Compression.CompressMessage(in); err != nil {
+		h.Log.Error("failed to compress payload", "error", err, "key", in.ID)
+	}
+
+	_ = h.setExpiringKv(in.ID, in, messageTTL(pk))
 }
 
 // OnQosPublish adds or updates an inflight message in the store.
@@ -316,20 +572,45 @@ func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, rese
 		return
 	}
 
+	in := h.message(storage.InflightKey, inflightKey(cl, pk), cl, pk, sent)
+	_ = h.setKv(in.ID, in)
+
+	// queued messages are resent as duplicates once the client reconnects, and are inflight from then on.
+	if pk.FixedHeader.Dup {
+		_ = h.delKv(queuedKey(cl, pk))
+	}
+}
+
+// OnQueuedMessage adds a message queued for a disconnected client to the store.
+func (h *Hook) OnQueuedMessage(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in := h.message(storage.QueuedKey, queuedKey(cl, pk), cl, pk, 0)
+	_ = h.setKv(in.ID, in)
+}
+
+// message returns a storable inflight or queued message, compressing the payload if enabled.
+func (h *Hook) message(t, id string, cl *mqtt.Client, pk packets.Packet, sent int64) *storage.Message {
 	props := pk.Properties.Copy(false)
 	in := &storage.Message{
-		ID:          inflightKey(cl, pk),
-		T:           storage.InflightKey,
-		Client:      cl.ID,
-		Origin:      pk.Origin,
-		PacketID:    pk.PacketID,
-		FixedHeader: pk.FixedHeader,
-		TopicName:   pk.TopicName,
-		Payload:     pk.Payload,
-		Sent:        sent,
-		Created:     pk.Created,
+		ID:              id,
+		T:               t,
+		Client:          cl.ID,
+		Origin:          pk.Origin,
+		PacketID:        pk.PacketID,
+		FixedHeader:     pk.FixedHeader,
+		TopicName:       pk.TopicName,
+		Payload:         pk.Payload,
+		Sent:            sent,
+		Created:         pk.Created,
+		Expiry:          pk.Expiry,
+		ProtocolVersion: pk.ProtocolVersion,
 		Properties: storage.MessageProperties{
 			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
 			MessageExpiryInterval:  props.MessageExpiryInterval,
 			ContentType:            props.ContentType,
 			ResponseTopic:          props.ResponseTopic,
@@ -340,7 +621,11 @@ func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, rese
 		},
 	}
 
-	_ = h.setKv(in.ID, in)
+	if err := h.config.Compression.CompressMessage(in); err != nil {
+		h.Log.Error("failed to compress payload", "error", err, "key", in.ID)
+	}
+
+	return in
 }
 
 // OnQosComplete removes a resolved inflight message from the store.
@@ -353,13 +638,15 @@ func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
 	_ = h.delKv(inflightKey(cl, pk))
 }
 
-// OnQosDropped removes a dropped inflight message from the store.
+// OnQosDropped removes a dropped inflight or queued message from the store.
 func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
 	if h.db == nil {
 		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
 	}
 
 	h.OnQosComplete(cl, pk)
+	_ = h.delKv(queuedKey(cl, pk))
 }
 
 // OnSysInfoTick stores the latest system info in the store.
@@ -477,6 +764,105 @@ func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
 	return
 }
 
+// StoredQueuedMessages returns all messages queued for disconnected clients from the store.
+func (h *Hook) StoredQueuedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	v = make([]storage.Message, 0)
+	err = h.iterKv(storage.QueuedKey, func(value []byte) error {
+		obj := storage.Message{}
+		err = obj.UnmarshalBinary(value)
+		if err == nil {
+			v = append(v, obj)
+		}
+		return err
+	})
+	return
+}
+
+// IterClients calls fn with each stored client in the store.
+func (h *Hook) IterClients(fn func(v storage.Client) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	return h.iterKv(storage.ClientKey, func(value []byte) error {
+		obj := storage.Client{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		return fn(obj)
+	})
+}
+
+// IterSubscriptions calls fn with each stored subscription in the store.
+func (h *Hook) IterSubscriptions(fn func(v storage.Subscription) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	return h.iterKv(storage.SubscriptionKey, func(value []byte) error {
+		obj := storage.Subscription{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		return fn(obj)
+	})
+}
+
+// IterRetainedMessages calls fn with each stored retained message in the store.
+func (h *Hook) IterRetainedMessages(fn func(v storage.Message) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	return h.iterKv(storage.RetainedKey, func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		return fn(obj)
+	})
+}
+
+// IterInflightMessages calls fn with each stored inflight message in the store.
+func (h *Hook) IterInflightMessages(fn func(v storage.Message) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	return h.iterKv(storage.InflightKey, func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		return fn(obj)
+	})
+}
+
+// IterQueuedMessages calls fn with each message queued for a disconnected client in the store.
+func (h *Hook) IterQueuedMessages(fn func(v storage.Message) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	return h.iterKv(storage.QueuedKey, func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		return fn(obj)
+	})
+}
+
 // StoredSysInfo returns the system info from the store.
 func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
 	if h.db == nil {
@@ -491,6 +877,62 @@ func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
 	return v, nil
 }
 
+// StoredSession returns the stored client, subscriptions, and inflight and queued messages
+// of a single client from the store.
+func (h *Hook) StoredSession(id string) (v storage.Session, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err = h.getKv(storage.ClientKey+"_"+id, &v.Client)
+	if errors.Is(err, badgerdb.ErrKeyNotFound) {
+		return v, nil
+	} else if err != nil {
+		return
+	}
+
+	err = h.iterKv(storage.SubscriptionKey+"_"+id+":", func(value []byte) error {
+		obj := storage.Subscription{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		if obj.Client == id {
+			v.Subscriptions = append(v.Subscriptions, obj)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	err = h.iterKv(storage.InflightKey+"_"+id+":", func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		if obj.Client == id {
+			v.Inflight = append(v.Inflight, obj)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	err = h.iterKv(storage.QueuedKey+"_"+id+":", func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		if obj.Client == id {
+			v.Queued = append(v.Queued, obj)
+		}
+		return nil
+	})
+	return
+}
+
 // Errorf satisfies the badger interface for an error logger.
 func (h *Hook) Errorf(m string, v ...any) {
 	h.Log.Error(fmt.Sprintf(strings.ToLower(strings.Trim(m, "\n")), v...), "v", v)
@@ -507,6 +949,17 @@ func (h *Hook) Infof(m string, v ...any) {
 	h.Log.Info(fmt.Sprintf(strings.ToLower(strings.Trim(m, "\n")), v...), "v", v)
 }
 
+// messageTTL returns the time remaining until a message expires, or 0 if the message does
+// not expire. Expired messages are removed by badger, so they are not restored even if the
+// broker stopped before it could expire them.
+func messageTTL(pk packets.Packet) time.Duration {
+	if pk.Expiry <= 0 {
+		return 0
+	}
+
+	return max(time.Until(time.Unix(pk.Expiry, 0)), time.Second)
+}
+
 // Debugf satisfies the badger interface for a debug logger.
 func (h *Hook) Debugf(m string, v ...any) {
 	h.Log.Debug(fmt.Sprintf(strings.ToLower(strings.Trim(m, "\n")), v...), "v", v)
@@ -514,10 +967,27 @@ func (h *Hook) Debugf(m string, v ...any) {
 
 // setKv stores a key-value pair in the database.
 func (h *Hook) setKv(k string, v storage.Serializable) error {
-	err := h.db.Update(func(txn *badgerdb.Txn) error {
-		data, _ := v.MarshalBinary()
-		return txn.Set([]byte(k), data)
-	})
+	return h.setExpiringKv(k, v, 0)
+}
+
+// setExpiringKv stores a key-value pair in the database, which badger removes once ttl
+// has passed. The pair does not expire if ttl is 0.
+func (h *Hook) setExpiringKv(k string, v storage.Serializable, ttl time.Duration) error {
+	k = h.config.Namespace.Key(k)
+	data, _ := v.MarshalBinary()
+	data, err := h.crypt.Encrypt([]byte(k), data)
+	if err == nil {
+		start := time.Now()
+		w := write{key: []byte(k), value: data, ttl: ttl}
+		if h.writes != nil {
+			err = h.queue(w)
+		} else {
+			err = h.db.Update(func(txn *badgerdb.Txn) error {
+				return txn.SetEntry(w.entry())
+			})
+		}
+		h.stats.Write(start, err)
+	}
 	if err != nil {
 		h.Log.Error("failed to upsert data", "error", err, "key", k)
 	}
@@ -526,9 +996,17 @@ func (h *Hook) setKv(k string, v storage.Serializable) error {
 
 // delKv deletes a key-value pair from the database.
 func (h *Hook) delKv(k string) error {
-	err := h.db.Update(func(txn *badgerdb.Txn) error {
-		return txn.Delete([]byte(k))
-	})
+	k = h.config.Namespace.Key(k)
+	var err error
+	start := time.Now()
+	if h.writes != nil {
+		err = h.queue(write{key: []byte(k), del: true})
+	} else {
+		err = h.db.Update(func(txn *badgerdb.Txn) error {
+			return txn.Delete([]byte(k))
+		})
+	}
+	h.stats.Delete(start, err)
 
 	if err != nil {
 		h.Log.Error("failed to delete data", "error", err, "key", k)
@@ -538,7 +1016,10 @@ func (h *Hook) delKv(k string) error {
 
 // getKv retrieves the value associated with a key from the database.
 func (h *Hook) getKv(k string, v storage.Serializable) error {
-	return h.db.View(func(txn *badgerdb.Txn) error {
+	_ = h.Flush() // read any queued writes
+	k = h.config.Namespace.Key(k)
+	start := time.Now()
+	err := h.db.View(func(txn *badgerdb.Txn) error {
 		item, err := txn.Get([]byte(k))
 		if err != nil {
 			return err
@@ -547,12 +1028,21 @@ func (h *Hook) getKv(k string, v storage.Serializable) error {
 		if err != nil {
 			return err
 		}
-		return v.UnmarshalBinary(value)
+		return h.unmarshal([]byte(k), value, v)
 	})
+	if errors.Is(err, badgerdb.ErrKeyNotFound) {
+		h.stats.Read(start, nil) // a missing key is not a failed read
+	} else {
+		h.stats.Read(start, err)
+	}
+	return err
 }
 
 // iterKv iterates over key-value pairs with keys having the specified prefix in the database.
 func (h *Hook) iterKv(prefix string, visit func([]byte) error) error {
+	_ = h.Flush() // read any queued writes
+	prefix = h.config.Namespace.Key(prefix)
+	start := time.Now()
 	err := h.db.View(func(txn *badgerdb.Txn) error {
 		iterator := txn.NewIterator(badgerdb.DefaultIteratorOptions)
 		defer iterator.Close()
@@ -560,6 +1050,9 @@ func (h *Hook) iterKv(prefix string, visit func([]byte) error) error {
 		for iterator.Seek([]byte(prefix)); iterator.ValidForPrefix([]byte(prefix)); iterator.Next() {
 			item := iterator.Item()
 			value, err := item.ValueCopy(nil)
+			if err == nil {
+				value, err = h.crypt.Decrypt(item.Key(), value)
+			}
 
 			if err != nil {
 				return err
@@ -571,8 +1064,203 @@ func (h *Hook) iterKv(prefix string, visit func([]byte) error) error {
 		}
 		return nil
 	})
+	h.stats.Read(start, err)
 	if err != nil {
 		h.Log.Error("failed to find data", "error", err, "prefix", prefix)
 	}
 	return err
 }
+
+// unmarshal decrypts a value stored under key and decodes it into v.
+func (h *Hook) unmarshal(key, data []byte, v storage.Serializable) error {
+	data, err := h.crypt.Decrypt(key, data)
+	if err != nil {
+		return err
+	}
+
+	return v.UnmarshalBinary(data)
+}
+
+// Backup writes a consistent backup of the records in the store to w.
+func (h *Hook) Backup(w io.Writer) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	_ = h.Flush() // include any queued writes
+	return storage.Backup(w, records{h: h})
+}
+
+// Restore replaces the records in the store with a backup read from r. It should be
+// called before the server is started, as restored records are only loaded on startup.
+func (h *Hook) Restore(r io.Reader) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	if h.config.ReadOnly {
+		return storage.ErrReadOnly
+	}
+
+	_ = h.Flush() // include any queued writes
+	return storage.Restore(r, records{h: h})
+}
+
+// Export writes the clients, subscriptions, retained messages, inflight messages and
+// system info in the store to w as JSON Lines, which can be imported into any storage hook.
+func (h *Hook) Export(w io.Writer) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	_ = h.Flush() // include any queued writes
+	return storage.Export(w, h)
+}
+
+// Import adds the records of an export read from r to the store, replacing any existing
+// records with the same keys. It should be called before the server is started, as imported
+// records are only loaded on startup.
+func (h *Hook) Import(r io.Reader) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	if h.config.ReadOnly {
+		return storage.ErrReadOnly
+	}
+
+	return storage.Import(r, h.importRecord)
+}
+
+// importRecord stores an imported record under the key used by the hook.
+func (h *Hook) importRecord(v storage.Serializable) error {
+	switch v := v.(type) {
+	case *storage.Client:
+		return h.setKv(clientKey(&mqtt.Client{ID: v.ID}), v)
+	case *storage.Subscription:
+		v.ID = subscriptionKey(&mqtt.Client{ID: v.Client}, v.Filter)
+		return h.setKv(v.ID, v)
+	case *storage.Message:
+		switch v.T {
+		case storage.RetainedKey:
+			v.ID = retainedKey(v.TopicName)
+		case storage.QueuedKey:
+			v.ID = queuedKey(&mqtt.Client{ID: v.Client}, packets.Packet{PacketID: v.PacketID})
+		default:
+			v.ID = inflightKey(&mqtt.Client{ID: v.Client}, packets.Packet{PacketID: v.PacketID})
+		}
+
+		if err := h.config.Compression.CompressMessage(v); err != nil {
+			h.Log.Error("failed to compress payload", "error", err, "key", v.ID)
+		}
+		return h.setKv(v.ID, v)
+	case *storage.SystemInfo:
+		v.ID = sysInfoKey()
+		return h.setKv(v.ID, v)
+	}
+
+	return nil
+}
+
+// migrateSchema upgrades the records of the store to the current schema version. The records
+// of a read-only store are only checked, as they cannot be migrated.
+func (h *Hook) migrateSchema() error {
+	if h.config.ReadOnly {
+		_, err := storage.CheckSchema(records{h: h}, storage.Migrations, storage.SchemaVersion)
+		return err
+	}
+
+	from, err := storage.Migrate(records{h: h}, storage.Migrations, storage.SchemaVersion)
+	if err != nil {
+		return err
+	}
+
+	if from != storage.SchemaVersion {
+		h.Log.Info("migrated storage schema", "from", from, "to", storage.SchemaVersion)
+	}
+
+	return nil
+}
+
+// records provides the raw records of the store to schema migrations.
+type records struct {
+	h *Hook
+}
+
+// SchemaVersion returns the schema version of the store.
+func (r records) SchemaVersion() (v int, ok bool, err error) {
+	err = r.h.db.View(func(txn *badgerdb.Txn) error {
+		item, err := txn.Get([]byte(r.h.config.Namespace.Key(storage.SchemaVersionKey)))
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(val []byte) error {
+			v, err = strconv.Atoi(string(val))
+			return err
+		})
+	})
+	if errors.Is(err, badgerdb.ErrKeyNotFound) {
+		return 0, false, nil
+	}
+
+	return v, err == nil, err
+}
+
+// SetSchemaVersion stores the schema version of the store.
+func (r records) SetSchemaVersion(v int) error {
+	return r.h.db.Update(func(txn *badgerdb.Txn) error {
+		return txn.Set([]byte(r.h.config.Namespace.Key(storage.SchemaVersionKey)), []byte(strconv.Itoa(v)))
+	})
+}
+
+// Each calls visit with the key, without the namespace, and decrypted value of each record
+// in the namespace.
+func (r records) Each(visit func(key string, value []byte) error) error {
+	prefix := []byte(r.h.config.Namespace.Key(""))
+	return r.h.db.View(func(txn *badgerdb.Txn) error {
+		iterator := txn.NewIterator(badgerdb.DefaultIteratorOptions)
+		defer iterator.Close()
+
+		for iterator.Seek(prefix); iterator.ValidForPrefix(prefix); iterator.Next() {
+			item := iterator.Item()
+			if string(item.Key()) == r.h.config.Namespace.Key(storage.SchemaVersionKey) {
+				continue
+			}
+
+			value, err := item.ValueCopy(nil)
+			if err == nil {
+				value, err = r.h.crypt.Decrypt(item.Key(), value)
+			}
+
+			if err != nil {
+				return err
+			}
+
+			if err := visit(string(item.Key()[len(prefix):]), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Set encrypts and sets the value of a record.
+func (r records) Set(key string, value []byte) error {
+	k := []byte(r.h.config.Namespace.Key(key))
+	value, err := r.h.crypt.Encrypt(k, value)
+	if err != nil {
+		return err
+	}
+
+	return r.h.db.Update(func(txn *badgerdb.Txn) error {
+		return txn.Set(k, value)
+	})
+}
+
+// Delete deletes a record.
+func (r records) Delete(key string) error {
+	return r.h.db.Update(func(txn *badgerdb.Txn) error {
+		return txn.Delete([]byte(r.h.config.Namespace.Key(key)))
+	})
+}
@@ -5,9 +5,13 @@
 package badger
 
 import (
+	"bytes"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"log/slog"
 	"os"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -148,6 +152,19 @@ func TestInitUseDefaults(t *testing.T) {
 	require.Equal(t, defaultDbFile, h.config.Path)
 }
 
+func TestHealth(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Health(), storage.ErrDBFileNotOpen)
+
+	err := h.Init(nil)
+	require.NoError(t, err)
+	require.NoError(t, h.Health())
+
+	teardown(t, h.config.Path, h)
+	require.ErrorIs(t, h.Health(), storage.ErrDBFileNotOpen)
+}
+
 func TestOnSessionEstablishedThenOnDisconnect(t *testing.T) {
 	h := new(Hook)
 	h.SetOpts(logger, nil)
@@ -380,6 +397,57 @@ func TestOnRetainMessageThenUnset(t *testing.T) {
 	require.ErrorIs(t, err, badgerdb.ErrKeyNotFound)
 }
 
+// expiresAt returns the unix time at which badger expires a key, or 0 if it does not expire.
+func expiresAt(t *testing.T, h *Hook, k string) uint64 {
+	var v uint64
+	err := h.db.View(func(txn *badgerdb.Txn) error {
+		item, err := txn.Get([]byte(k))
+		if err != nil {
+			return err
+		}
+		v = item.ExpiresAt()
+		return nil
+	})
+	require.NoError(t, err)
+	return v
+}
+
+func TestOnRetainMessageExpiry(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		t.Run(fmt.Sprintf("async=%t", async), func(t *testing.T) {
+			h := new(Hook)
+			h.SetOpts(logger, nil)
+			err := h.Init(&Options{AsyncWrites: async})
+			require.NoError(t, err)
+			defer teardown(t, h.config.Path, h)
+
+			expiry := time.Now().Unix() + 60
+			h.OnRetainMessage(client, packets.Packet{
+				FixedHeader: packets.FixedHeader{Retain: true},
+				TopicName:   "a/b/c",
+				Expiry:      expiry,
+			}, 1)
+			h.OnRetainMessage(client, packets.Packet{
+				FixedHeader: packets.FixedHeader{Retain: true},
+				TopicName:   "d/e/f",
+			}, 1)
+			require.NoError(t, h.Flush())
+
+			require.InDelta(t, expiry, expiresAt(t, h, retainedKey("a/b/c")), 1)
+			require.Equal(t, uint64(0), expiresAt(t, h, retainedKey("d/e/f")))
+		})
+	}
+}
+
+func TestMessageTTL(t *testing.T) {
+	require.Equal(t, time.Duration(0), messageTTL(packets.Packet{}))
+	require.Equal(t, time.Second, messageTTL(packets.Packet{Expiry: time.Now().Unix() - 10}))
+
+	ttl := messageTTL(packets.Packet{Expiry: time.Now().Unix() + 60})
+	require.Greater(t, ttl, 58*time.Second)
+	require.LessOrEqual(t, ttl, 60*time.Second)
+}
+
 func TestOnRetainedExpired(t *testing.T) {
 	h := new(Hook)
 	h.SetOpts(logger, nil)
@@ -508,6 +576,68 @@ func TestOnQosDroppedNoDB(t *testing.T) {
 	h.OnQosDropped(client, packets.Packet{})
 }
 
+func TestOnQueuedMessageThenResend(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b/c",
+		Payload:     []byte("hello"),
+		PacketID:    7,
+	}
+	h.OnQueuedMessage(client, pk)
+
+	queued, err := h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Len(t, queued, 1)
+	require.Equal(t, storage.QueuedKey, queued[0].T)
+	require.Equal(t, uint16(7), queued[0].PacketID)
+	require.Equal(t, pk.Payload, queued[0].Payload)
+
+	inflight, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Empty(t, inflight)
+
+	// the queued message is resent as a duplicate when the client reconnects
+	pk.FixedHeader.Dup = true
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	queued, err = h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Empty(t, queued)
+
+	inflight, err = h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+	require.Equal(t, uint16(7), inflight[0].PacketID)
+}
+
+func TestOnQueuedMessageThenDropped(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+	pk := packets.Packet{TopicName: "a/b/c", PacketID: 7}
+	h.OnQueuedMessage(client, pk)
+	h.OnQosDropped(client, pk)
+
+	queued, err := h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Empty(t, queued)
+}
+
+func TestOnQueuedMessageNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnQueuedMessage(client, packets.Packet{})
+	v, _ := h.StoredQueuedMessages()
+	require.Empty(t, v)
+}
+
 func TestOnSysInfoTick(t *testing.T) {
 	h := new(Hook)
 	h.SetOpts(logger, nil)
@@ -675,6 +805,44 @@ func TestStoredInflightMessages(t *testing.T) {
 	require.Equal(t, "i3", r[2].ID)
 }
 
+func TestStoredInflightMessagesV5Properties(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	pk := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:       "a/b/c",
+		Payload:         []byte("hello"),
+		PacketID:        1,
+		ProtocolVersion: 5,
+		Created:         time.Now().Unix(),
+		Expiry:          time.Now().Unix() + 30,
+		Properties: packets.Properties{
+			PayloadFormat:          1,
+			PayloadFormatFlag:      true,
+			MessageExpiryInterval:  30,
+			SubscriptionIdentifier: []int{2},
+			User:                   []packets.UserProperty{{Key: "k", Val: "v"}},
+		},
+	}
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	r, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+
+	out := r[0].ToPacket()
+	require.Equal(t, pk.Expiry, out.Expiry)
+	require.Equal(t, pk.ProtocolVersion, out.ProtocolVersion)
+	require.Equal(t, pk.Properties.PayloadFormatFlag, out.Properties.PayloadFormatFlag)
+	require.Equal(t, pk.Properties.MessageExpiryInterval, out.Properties.MessageExpiryInterval)
+	require.Equal(t, pk.Properties.SubscriptionIdentifier, out.Properties.SubscriptionIdentifier)
+	require.Equal(t, pk.Properties.User, out.Properties.User)
+}
+
 func TestStoredInflightMessagesNoDB(t *testing.T) {
 	h := new(Hook)
 	h.SetOpts(logger, nil)
@@ -713,6 +881,115 @@ func TestStoredSysInfoNoDB(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestStoredSession(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	// a client with an id prefixed by the id of the client
+	other := &mqtt.Client{ID: client.ID + ":2"}
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b/c",
+		PacketID:    7,
+	}
+	for _, cl := range []*mqtt.Client{client, other} {
+		h.OnSessionEstablished(cl, packets.Packet{})
+		h.OnSubscribed(cl, pkf, []byte{0})
+		h.OnQosPublish(cl, pk, time.Now().Unix(), 0)
+	}
+	pk.PacketID = 8
+	h.OnQueuedMessage(client, pk)
+
+	v, err := h.StoredSession(client.ID)
+	require.NoError(t, err)
+	require.Equal(t, client.ID, v.Client.ID)
+	require.Len(t, v.Subscriptions, 1)
+	require.Equal(t, "a/b/c", v.Subscriptions[0].Filter)
+	require.Len(t, v.Inflight, 1)
+	require.Equal(t, uint16(7), v.Inflight[0].PacketID)
+	require.Len(t, v.Queued, 1)
+	require.Equal(t, uint16(8), v.Queued[0].PacketID)
+
+	v, err = h.StoredSession("absent")
+	require.NoError(t, err)
+	require.Empty(t, v)
+}
+
+func TestStoredSessionNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	v, err := h.StoredSession(client.ID)
+	require.Empty(t, v)
+	require.NoError(t, err)
+}
+
+func TestStorageStats(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	_, err = h.StoredSession("absent")
+	require.NoError(t, err)
+	h.OnClientExpired(client)
+
+	stats := h.StorageStats()
+	require.Positive(t, stats.Writes.Count)
+	require.Equal(t, int64(0), stats.Writes.Errors)
+	require.Equal(t, int64(1), stats.Reads.Count)
+	require.Equal(t, int64(0), stats.Reads.Errors) // a missing key is not a failed read
+	require.Equal(t, int64(1), stats.Deletes.Count)
+}
+
+func TestIterStored(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{0})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b/c",
+		PacketID:    7,
+	}
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+	pk.PacketID = 8
+	h.OnQueuedMessage(client, pk)
+
+	var got []string
+	require.NoError(t, h.IterClients(func(v storage.Client) error {
+		got = append(got, v.ID)
+		return nil
+	}))
+	require.NoError(t, h.IterSubscriptions(func(v storage.Subscription) error {
+		got = append(got, v.Filter)
+		return nil
+	}))
+	visit := func(v storage.Message) error {
+		got = append(got, v.T)
+		return nil
+	}
+	require.NoError(t, h.IterRetainedMessages(visit))
+	require.NoError(t, h.IterInflightMessages(visit))
+	require.NoError(t, h.IterQueuedMessages(visit))
+	require.Equal(t, []string{client.ID, "a/b/c", storage.RetainedKey, storage.InflightKey, storage.QueuedKey}, got)
+
+	errVisit := errors.New("visit")
+	err = h.IterClients(func(v storage.Client) error {
+		return errVisit
+	})
+	require.ErrorIs(t, err, errVisit)
+}
+
 func TestErrorf(t *testing.T) {
 	// coverage: one day check log hook
 	h := new(Hook)
@@ -806,3 +1083,526 @@ func TestIterKv(t *testing.T) {
 	})
 	require.ErrorIs(t, visitErr, err)
 }
+
+// dbHas reports whether a key has been committed to the database, without flushing queued writes.
+func dbHas(t *testing.T, h *Hook, k string) bool {
+	err := h.db.View(func(txn *badgerdb.Txn) error {
+		_, err := txn.Get([]byte(k))
+		return err
+	})
+	if errors.Is(err, badgerdb.ErrKeyNotFound) {
+		return false
+	}
+	require.NoError(t, err)
+	return true
+}
+
+func TestInitAsyncWritesDefaults(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{AsyncWrites: true})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	require.Equal(t, defaultBatchSize, h.config.BatchSize)
+	require.Equal(t, int64(defaultBatchInterval), h.config.BatchInterval)
+	require.NotNil(t, h.writes)
+}
+
+func TestAsyncWritesCommitOnBatchSize(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{AsyncWrites: true, BatchSize: 2, BatchInterval: 60000})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	require.NoError(t, h.setKv("a", &storage.Client{ID: "a"}))
+	require.False(t, dbHas(t, h, "a"))
+
+	require.NoError(t, h.setKv("b", &storage.Client{ID: "b"}))
+	require.Eventually(t, func() bool {
+		return dbHas(t, h, "a") && dbHas(t, h, "b")
+	}, time.Second, time.Millisecond*5)
+}
+
+func TestAsyncWritesCommitOnBatchInterval(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{AsyncWrites: true, BatchSize: 100, BatchInterval: 10})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	require.NoError(t, h.setKv("a", &storage.Client{ID: "a"}))
+	require.Eventually(t, func() bool {
+		return dbHas(t, h, "a")
+	}, time.Second, time.Millisecond*5)
+}
+
+func TestAsyncWritesFlush(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{AsyncWrites: true, BatchSize: 100, BatchInterval: 60000})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	require.NoError(t, h.setKv("a", &storage.Client{ID: "a"}))
+	require.NoError(t, h.setKv("b", &storage.Client{ID: "b"}))
+	require.NoError(t, h.delKv("b"))
+	require.False(t, dbHas(t, h, "a"))
+
+	require.NoError(t, h.Flush())
+	require.True(t, dbHas(t, h, "a"))
+	require.False(t, dbHas(t, h, "b"))
+}
+
+func TestAsyncWritesReadQueued(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{AsyncWrites: true, BatchSize: 100, BatchInterval: 60000})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, client.ID, r[0].ID)
+
+	var cl storage.Client
+	require.NoError(t, h.getKv(clientKey(client), &cl))
+	require.Equal(t, client.ID, cl.ID)
+}
+
+func TestAsyncWritesCommitOnStop(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{AsyncWrites: true, BatchSize: 100, BatchInterval: 60000})
+	require.NoError(t, err)
+	path := h.config.Path
+	defer func() {
+		require.NoError(t, os.RemoveAll("./"+strings.Replace(path, "..", "", -1)))
+	}()
+
+	require.NoError(t, h.setKv("a", &storage.Client{ID: "a"}))
+	require.NoError(t, h.Stop())
+
+	require.ErrorIs(t, h.setKv("b", &storage.Client{ID: "b"}), badgerdb.ErrDBClosed)
+	require.NoError(t, h.Flush())
+
+	h2 := new(Hook)
+	h2.SetOpts(logger, nil)
+	err = h2.Init(&Options{Path: path})
+	require.NoError(t, err)
+	defer h2.Stop()
+
+	require.True(t, dbHas(t, h2, "a"))
+}
+
+func TestInitBadCompression(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Compression: storage.Compression{Algorithm: "lz4"},
+	})
+	require.ErrorIs(t, err, storage.ErrUnknownCompression)
+}
+
+func TestInitBadNamespace(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Namespace: "a:b"})
+	require.ErrorIs(t, err, storage.ErrInvalidNamespace)
+}
+
+func TestInitBadDurability(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Durability: storage.Durability{Policy: "sometimes"},
+	})
+	require.ErrorIs(t, err, storage.ErrUnknownDurability)
+}
+
+func TestDurability(t *testing.T) {
+	tt := []struct {
+		policy     string
+		syncWrites bool
+		interval   bool
+	}{
+		{policy: "", syncWrites: false},
+		{policy: storage.DurabilityAlways, syncWrites: true},
+		{policy: storage.DurabilityInterval, syncWrites: false, interval: true},
+		{policy: storage.DurabilityNone, syncWrites: false},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.policy, func(t *testing.T) {
+			h := new(Hook)
+			h.SetOpts(logger, nil)
+			err := h.Init(&Options{
+				Durability: storage.Durability{Policy: tx.policy, Interval: 10},
+			})
+			require.NoError(t, err)
+			defer teardown(t, h.config.Path, h)
+
+			require.Equal(t, tx.syncWrites, h.config.Options.SyncWrites)
+			require.Equal(t, tx.interval, h.syncer != nil)
+
+			h.OnSessionEstablished(client, packets.Packet{})
+			time.Sleep(30 * time.Millisecond)
+			require.NoError(t, h.Health())
+		})
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Namespace: "t1"})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+
+	err = h.db.View(func(txn *badgerdb.Txn) error {
+		_, err := txn.Get([]byte("t1:" + clientKey(client)))
+		return err
+	})
+	require.NoError(t, err)
+
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+
+	_, ok, err := records{h: h}.SchemaVersion()
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	h.config.Namespace = "t2" // another broker sharing the database
+	r, err = h.StoredClients()
+	require.NoError(t, err)
+	require.Empty(t, r)
+
+	_, ok, err = records{h: h}.SchemaVersion()
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestReadOnly(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	h.OnSessionEstablished(client, packets.Packet{})
+	require.NoError(t, h.Stop())
+
+	s := new(Hook)
+	s.SetOpts(logger, nil)
+	err = s.Init(&Options{ReadOnly: true, AsyncWrites: true})
+	require.NoError(t, err)
+	defer teardown(t, s.config.Path, s)
+	require.Nil(t, s.gcTicker)
+	require.Nil(t, s.writes)
+
+	require.True(t, s.Provides(mqtt.StoredClients))
+	require.False(t, s.Provides(mqtt.OnSessionEstablished))
+	require.False(t, s.Provides(mqtt.OnSysInfoTick))
+
+	r, err := s.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, client.ID, r[0].ID)
+
+	require.ErrorIs(t, s.Restore(new(bytes.Buffer)), storage.ErrReadOnly)
+	require.ErrorIs(t, s.Import(new(bytes.Buffer)), storage.ErrReadOnly)
+}
+
+func TestOnRetainMessageCompressed(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Compression: storage.Compression{Algorithm: storage.CompressionZstd},
+	})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Retain: true, Qos: 1},
+		Payload:     bytes.Repeat([]byte("hello"), 1000),
+		TopicName:   "a/b/c",
+		PacketID:    1,
+	}
+
+	h.OnRetainMessage(client, pk, 1)
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	var raw []byte
+	err = h.db.View(func(txn *badgerdb.Txn) error {
+		item, err := txn.Get([]byte(retainedKey(pk.TopicName)))
+		if err != nil {
+			return err
+		}
+		raw, err = item.ValueCopy(nil)
+		return err
+	})
+	require.NoError(t, err)
+	require.Contains(t, string(raw), `"compression":"zstd"`)
+
+	r, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, pk.Payload, r[0].Payload)
+
+	r, err = h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, pk.Payload, r[0].Payload)
+}
+
+func TestInitBadEncryption(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Encryption: &storage.Encryption{Key: "bad"},
+	})
+	require.ErrorIs(t, err, storage.ErrInvalidEncryptionKey)
+}
+
+func TestEncryption(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Encryption: &storage.Encryption{Key: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)), Migrate: true},
+	})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	// values stored before encryption was enabled can still be read while migrating
+	plain, err := storage.Message{ID: retainedKey("d/e/f"), T: storage.RetainedKey, TopicName: "d/e/f"}.MarshalBinary()
+	require.NoError(t, err)
+	err = h.db.Update(func(txn *badgerdb.Txn) error {
+		return txn.Set([]byte(retainedKey("d/e/f")), plain)
+	})
+	require.NoError(t, err)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Retain: true},
+		Payload:     []byte("hello"),
+		TopicName:   "a/b/c",
+	}
+	h.OnRetainMessage(client, pk, 1)
+
+	var raw []byte
+	err = h.db.View(func(txn *badgerdb.Txn) error {
+		item, err := txn.Get([]byte(retainedKey(pk.TopicName)))
+		if err != nil {
+			return err
+		}
+		raw, err = item.ValueCopy(nil)
+		return err
+	})
+	require.NoError(t, err)
+	require.NotContains(t, string(raw), "topic_name")
+
+	r, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+	require.ElementsMatch(t, []string{"a/b/c", "d/e/f"}, []string{r[0].TopicName, r[1].TopicName})
+
+	// encrypted values cannot be moved to another key
+	err = h.db.Update(func(txn *badgerdb.Txn) error {
+		return txn.Set([]byte(retainedKey("x/y/z")), raw)
+	})
+	require.NoError(t, err)
+	require.ErrorIs(t, h.getKv(retainedKey("x/y/z"), new(storage.Message)), storage.ErrInvalidEncryptedData)
+
+	// unencrypted values are refused once the store has been migrated
+	h.crypt, err = storage.NewEncryptor(&storage.Encryption{Key: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))})
+	require.NoError(t, err)
+	require.ErrorIs(t, h.getKv(retainedKey("d/e/f"), new(storage.Message)), storage.ErrUnencryptedData)
+}
+
+func TestInitSchemaVersion(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	v, ok, err := records{h: h}.SchemaVersion()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, storage.SchemaVersion, v)
+}
+
+func TestInitNewerSchemaVersion(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	require.NoError(t, records{h: h}.SetSchemaVersion(storage.SchemaVersion+1))
+	require.NoError(t, h.Stop())
+
+	h = new(Hook)
+	h.SetOpts(logger, nil)
+	err = h.Init(nil)
+	require.ErrorIs(t, err, storage.ErrNewerSchemaVersion)
+	require.NoError(t, os.RemoveAll("./"+defaultDbFile))
+}
+
+func TestInitMigratesSchema(t *testing.T) {
+	migrations := storage.Migrations
+	defer func() {
+		storage.Migrations = migrations
+	}()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	h.OnSessionEstablished(&mqtt.Client{ID: "cl1", Net: mqtt.ClientConnection{Remote: "old"}}, packets.Packet{})
+	require.NoError(t, records{h: h}.Delete(storage.SchemaVersionKey)) // an unversioned store
+	require.NoError(t, h.Stop())
+
+	storage.Migrations = []storage.Migration{
+		{
+			Version: storage.SchemaVersion,
+			Upgrade: func(key string, value []byte) ([]byte, error) {
+				return bytes.Replace(value, []byte(`"old"`), []byte(`"new"`), 1), nil
+			},
+		},
+	}
+
+	h = new(Hook)
+	h.SetOpts(logger, nil)
+	err = h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, "new", r[0].Remote)
+
+	v, ok, err := records{h: h}.SchemaVersion()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, storage.SchemaVersion, v)
+}
+
+func TestBackupRestore(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{0})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, h.Backup(buf))
+
+	// changes made after the backup are discarded by the restore
+	h.OnSessionEstablished(&mqtt.Client{ID: "cl2"}, packets.Packet{})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c"}, -1)
+
+	require.NoError(t, h.Restore(buf))
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	require.Equal(t, client.ID, clients[0].ID)
+
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+
+	retained, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+	require.Equal(t, []byte("hello"), retained[0].Payload)
+
+	v, ok, err := records{h: h}.SchemaVersion()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, storage.SchemaVersion, v)
+}
+
+func TestBackupRestoreNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Backup(new(bytes.Buffer)), storage.ErrDBFileNotOpen)
+	require.ErrorIs(t, h.Restore(new(bytes.Buffer)), storage.ErrDBFileNotOpen)
+}
+
+func TestExportImport(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+	pk := packets.Packet{TopicName: "a/b/c", Payload: []byte("hi"), PacketID: 7}
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{1})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+	h.OnQueuedMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("later"), PacketID: 8})
+	h.OnSysInfoTick(&system.Info{Version: "2.0.0"})
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, h.Export(buf))
+
+	// records exported by other storage hooks have keys in a different format
+	buf.WriteString(`{"t":"SUB","id":"SUB_cl2:d/e","client":"cl2","filter":"d/e","qos":2}` + "\n")
+
+	h2 := new(Hook)
+	h2.SetOpts(logger, nil)
+	err = h2.Init(&Options{Path: t.TempDir()})
+	require.NoError(t, err)
+	defer h2.Stop()
+	require.NoError(t, h2.Import(buf))
+
+	clients, err := h2.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	require.Equal(t, client.ID, clients[0].ID)
+	require.Equal(t, client.Properties.Username, clients[0].Username)
+
+	subs, err := h2.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Filter < subs[j].Filter })
+	require.Equal(t, "a/b/c", subs[0].Filter)
+	require.Equal(t, subscriptionKey(&mqtt.Client{ID: "cl2"}, "d/e"), subs[1].ID)
+	require.Equal(t, byte(2), subs[1].Qos)
+
+	retained, err := h2.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+	require.Equal(t, []byte("hello"), retained[0].Payload)
+
+	inflight, err := h2.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+	require.Equal(t, []byte("hi"), inflight[0].Payload)
+	require.Equal(t, inflightKey(client, pk), inflight[0].ID)
+
+	queued, err := h2.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Len(t, queued, 1)
+	require.Equal(t, []byte("later"), queued[0].Payload)
+	require.Equal(t, uint16(8), queued[0].PacketID)
+
+	sys, err := h2.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, "2.0.0", sys.Version)
+}
+
+func TestExportImportNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Export(new(bytes.Buffer)), storage.ErrDBFileNotOpen)
+	require.ErrorIs(t, h.Import(new(bytes.Buffer)), storage.ErrDBFileNotOpen)
+}
@@ -8,6 +8,8 @@ package bolt
 import (
 	"bytes"
 	"errors"
+	"io"
+	"strconv"
 	"time"
 
 	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
@@ -30,6 +32,9 @@ const (
 	defaultTimeout = 250 * time.Millisecond
 
 	defaultBucket = "mochi"
+
+	// pageSize is the number of values read in each transaction when iterating over stored values.
+	pageSize = 1000
 )
 
 // clientKey returns a primary key for a client.
@@ -52,6 +57,11 @@ func inflightKey(cl *mqtt.Client, pk packets.Packet) string {
 	return storage.InflightKey + "_" + cl.ID + ":" + pk.FormatID()
 }
 
+// queuedKey returns a primary key for a message queued for a disconnected client.
+func queuedKey(cl *mqtt.Client, pk packets.Packet) string {
+	return storage.QueuedKey + "_" + cl.ID + ":" + pk.FormatID()
+}
+
 // sysInfoKey returns a primary key for system info.
 func sysInfoKey() string {
 	return storage.SysInfoKey
@@ -62,13 +72,39 @@ type Options struct {
 	Options *bbolt.Options
 	Bucket  string `yaml:"bucket" json:"bucket"`
 	Path    string `yaml:"path" json:"path"`
+	// BatchWrites coalesces writes from concurrent clients into shared transactions, rather than
+	// committing a transaction per event. A write waits at most MaxBatchDelay milliseconds, or until
+	// MaxBatchSize writes are pending, before it is committed.
+	BatchWrites   bool  `yaml:"batch_writes" json:"batch_writes"`
+	MaxBatchSize  int   `yaml:"max_batch_size" json:"max_batch_size"`
+	MaxBatchDelay int64 `yaml:"max_batch_delay" json:"max_batch_delay"`
+
+	// Compression compresses retained and inflight message payloads above a size threshold.
+	Compression storage.Compression `yaml:"compression" json:"compression"`
+
+	// Encryption encrypts stored values with AES-GCM, if set.
+	Encryption *storage.Encryption `yaml:"encryption" json:"encryption"`
+
+	// Durability sets when writes are synchronized to disk. By default each transaction is
+	// synchronized when it is committed, unless Options.NoSync is set.
+	Durability storage.Durability `yaml:"durability" json:"durability"`
+
+	// Namespace prefixes the keys of stored values, so several brokers can share a bucket.
+	Namespace storage.Namespace `yaml:"namespace" json:"namespace"`
+
+	// ReadOnly opens the database read-only, so a standby broker can restore from it without
+	// writing to it. A read-only hook only provides the methods which read from the store.
+	ReadOnly bool `yaml:"read_only" json:"read_only"`
 }
 
 // Hook is a persistent storage hook based using boltdb file store as a backend.
 type Hook struct {
 	mqtt.HookBase
-	config *Options  // options for configuring the boltdb instance.
-	db     *bbolt.DB // the boltdb instance.
+	config *Options           // options for configuring the boltdb instance.
+	db     *bbolt.DB          // the boltdb instance.
+	crypt  *storage.Encryptor // encrypts stored values, if encryption is enabled
+	syncer *storage.Syncer    // synchronizes the database periodically, under the interval durability policy
+	stats  storage.Recorder   // records the reads, writes and deletes of the hook
 }
 
 // ID returns the id of the hook.
@@ -76,9 +112,22 @@ func (h *Hook) ID() string {
 	return "bolt-db"
 }
 
-// Provides indicates which hook methods this hook provides.
+// Provides indicates which hook methods this hook provides. A read-only hook only provides
+// the methods which read from the store.
 func (h *Hook) Provides(b byte) bool {
-	return bytes.Contains([]byte{
+	if bytes.Contains([]byte{
+		mqtt.StoredClients,
+		mqtt.StoredInflightMessages,
+		mqtt.StoredQueuedMessages,
+		mqtt.StoredRetainedMessages,
+		mqtt.StoredSubscriptions,
+		mqtt.StoredSysInfo,
+		mqtt.StoredSession,
+	}, []byte{b}) {
+		return true
+	}
+
+	return (h.config == nil || !h.config.ReadOnly) && bytes.Contains([]byte{
 		mqtt.OnSessionEstablished,
 		mqtt.OnDisconnect,
 		mqtt.OnSubscribed,
@@ -88,14 +137,10 @@ func (h *Hook) Provides(b byte) bool {
 		mqtt.OnQosPublish,
 		mqtt.OnQosComplete,
 		mqtt.OnQosDropped,
+		mqtt.OnQueuedMessage,
 		mqtt.OnSysInfoTick,
 		mqtt.OnClientExpired,
 		mqtt.OnRetainedExpired,
-		mqtt.StoredClients,
-		mqtt.StoredInflightMessages,
-		mqtt.StoredRetainedMessages,
-		mqtt.StoredSubscriptions,
-		mqtt.StoredSysInfo,
 	}, []byte{b})
 }
 
@@ -110,6 +155,24 @@ func (h *Hook) Init(config any) error {
 	}
 
 	h.config = config.(*Options)
+	if err := h.config.Compression.Validate(); err != nil {
+		return err
+	}
+
+	if err := h.config.Durability.Validate(); err != nil {
+		return err
+	}
+
+	if err := h.config.Namespace.Validate(); err != nil {
+		return err
+	}
+
+	var err error
+	h.crypt, err = storage.NewEncryptor(h.config.Encryption)
+	if err != nil {
+		return err
+	}
+
 	if h.config.Options == nil {
 		h.config.Options = &bbolt.Options{
 			Timeout: defaultTimeout,
@@ -123,26 +186,83 @@ func (h *Hook) Init(config any) error {
 		h.config.Bucket = defaultBucket
 	}
 
-	var err error
+	if h.config.ReadOnly {
+		h.config.Options.ReadOnly = true
+	}
+
 	h.db, err = bbolt.Open(h.config.Path, 0600, h.config.Options)
 	if err != nil {
 		return err
 	}
 
-	err = h.db.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(h.config.Bucket))
+	if h.config.MaxBatchSize > 0 {
+		h.db.MaxBatchSize = h.config.MaxBatchSize
+	}
+
+	if h.config.MaxBatchDelay > 0 {
+		h.db.MaxBatchDelay = time.Duration(h.config.MaxBatchDelay) * time.Millisecond
+	}
+
+	if h.config.ReadOnly {
+		err = h.db.View(func(tx *bbolt.Tx) error {
+			if tx.Bucket([]byte(h.config.Bucket)) == nil {
+				return ErrBucketNotFound
+			}
+			return nil
+		})
+	} else {
+		err = h.db.Update(func(tx *bbolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists([]byte(h.config.Bucket))
+			return err
+		})
+	}
+	if err != nil {
+		_ = h.db.Close()
+		h.db = nil
 		return err
-	})
-	return err
+	}
+
+	if err := h.migrateSchema(); err != nil {
+		_ = h.db.Close()
+		h.db = nil
+		return err
+	}
+
+	if !h.config.ReadOnly {
+		h.db.NoSync = !h.config.Durability.SyncEach(!h.config.Options.NoSync)
+		h.syncer = storage.NewSyncer(h.config.Durability.SyncInterval(), h.db.Sync)
+	}
+
+	return nil
 }
 
-// Stop closes the boltdb instance.
+// Stop synchronizes and closes the boltdb instance.
 func (h *Hook) Stop() error {
+	serr := h.syncer.Stop()
+	h.syncer = nil
 	err := h.db.Close()
 	h.db = nil
+	if err == nil {
+		err = serr
+	}
 	return err
 }
 
+// Health returns an error if the database is not open, or if it failed to be synchronized
+// to disk under the interval durability policy.
+func (h *Hook) Health() error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return h.syncer.Err()
+}
+
+// StorageStats returns the counters and latencies of the reads, writes and deletes of the hook.
+func (h *Hook) StorageStats() storage.Stats {
+	return h.stats.Stats()
+}
+
 // OnSessionEstablished adds a client to the store when their session is established.
 func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
 	h.updateClient(cl)
@@ -254,16 +374,19 @@ func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
 
 	props := pk.Properties.Copy(false)
 	in := &storage.Message{
-		ID:          retainedKey(pk.TopicName),
-		T:           storage.RetainedKey,
-		FixedHeader: pk.FixedHeader,
-		TopicName:   pk.TopicName,
-		Payload:     pk.Payload,
-		Created:     pk.Created,
-		Client:      cl.ID,
-		Origin:      pk.Origin,
+		ID:              retainedKey(pk.TopicName),
+		T:               storage.RetainedKey,
+		FixedHeader:     pk.FixedHeader,
+		TopicName:       pk.TopicName,
+		Payload:         pk.Payload,
+		Created:         pk.Created,
+		Expiry:          pk.Expiry,
+		ProtocolVersion: pk.ProtocolVersion,
+		Client:          cl.ID,
+		Origin:          pk.Origin,
 		Properties: storage.MessageProperties{
 			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
 			MessageExpiryInterval:  props.MessageExpiryInterval,
 			ContentType:            props.ContentType,
 			ResponseTopic:          props.ResponseTopic,
@@ -274,6 +397,10 @@ func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
 		},
 	}
 
+	if err := h.config.Compression.CompressMessage(in); err != nil {
+		h.Log.Error("failed to compress payload", "error", err, "key", in.ID)
+	}
+
 	_ = h.setKv(in.ID, in)
 }
 
@@ -284,19 +411,45 @@ func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, rese
 		return
 	}
 
+	in := h.message(storage.InflightKey, inflightKey(cl, pk), cl, pk, sent)
+	_ = h.setKv(in.ID, in)
+
+	// queued messages are resent as duplicates once the client reconnects, and are inflight from then on.
+	if pk.FixedHeader.Dup {
+		_ = h.delKv(queuedKey(cl, pk))
+	}
+}
+
+// OnQueuedMessage adds a message queued for a disconnected client to the store.
+func (h *Hook) OnQueuedMessage(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in := h.message(storage.QueuedKey, queuedKey(cl, pk), cl, pk, 0)
+	_ = h.setKv(in.ID, in)
+}
+
+// message returns a storable inflight or queued message, compressing the payload if enabled.
+func (h *Hook) message(t, id string, cl *mqtt.Client, pk packets.Packet, sent int64) *storage.Message {
 	props := pk.Properties.Copy(false)
 	in := &storage.Message{
-		ID:          inflightKey(cl, pk),
-		T:           storage.InflightKey,
-		Client:      cl.ID,
-		Origin:      pk.Origin,
-		FixedHeader: pk.FixedHeader,
-		TopicName:   pk.TopicName,
-		Payload:     pk.Payload,
-		Sent:        sent,
-		Created:     pk.Created,
+		ID:              id,
+		T:               t,
+		Client:          cl.ID,
+		Origin:          pk.Origin,
+		PacketID:        pk.PacketID,
+		FixedHeader:     pk.FixedHeader,
+		TopicName:       pk.TopicName,
+		Payload:         pk.Payload,
+		Sent:            sent,
+		Created:         pk.Created,
+		Expiry:          pk.Expiry,
+		ProtocolVersion: pk.ProtocolVersion,
 		Properties: storage.MessageProperties{
 			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
 			MessageExpiryInterval:  props.MessageExpiryInterval,
 			ContentType:            props.ContentType,
 			ResponseTopic:          props.ResponseTopic,
@@ -307,7 +460,11 @@ func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, rese
 		},
 	}
 
-	_ = h.setKv(in.ID, in)
+	if err := h.config.Compression.CompressMessage(in); err != nil {
+		h.Log.Error("failed to compress payload", "error", err, "key", in.ID)
+	}
+
+	return in
 }
 
 // OnQosComplete removes a resolved inflight message from the store.
@@ -320,13 +477,15 @@ func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
 	_ = h.delKv(inflightKey(cl, pk))
 }
 
-// OnQosDropped removes a dropped inflight message from the store.
+// OnQosDropped removes a dropped inflight or queued message from the store.
 func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
 	if h.db == nil {
 		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
 	}
 
 	h.OnQosComplete(cl, pk)
+	_ = h.delKv(queuedKey(cl, pk))
 }
 
 // OnSysInfoTick stores the latest system info in the store.
@@ -438,6 +597,105 @@ func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
 	return
 }
 
+// StoredQueuedMessages returns all messages queued for disconnected clients from the store.
+func (h *Hook) StoredQueuedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	v = make([]storage.Message, 0)
+	err = h.iterKv(storage.QueuedKey, func(value []byte) error {
+		obj := storage.Message{}
+		err = obj.UnmarshalBinary(value)
+		if err == nil {
+			v = append(v, obj)
+		}
+		return err
+	})
+	return
+}
+
+// IterClients calls fn with each stored client in the store.
+func (h *Hook) IterClients(fn func(v storage.Client) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return storage.ErrDBFileNotOpen
+	}
+
+	return h.pageKv(storage.ClientKey, func(value []byte) error {
+		obj := storage.Client{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		return fn(obj)
+	})
+}
+
+// IterSubscriptions calls fn with each stored subscription in the store.
+func (h *Hook) IterSubscriptions(fn func(v storage.Subscription) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return storage.ErrDBFileNotOpen
+	}
+
+	return h.pageKv(storage.SubscriptionKey, func(value []byte) error {
+		obj := storage.Subscription{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		return fn(obj)
+	})
+}
+
+// IterRetainedMessages calls fn with each stored retained message in the store.
+func (h *Hook) IterRetainedMessages(fn func(v storage.Message) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return storage.ErrDBFileNotOpen
+	}
+
+	return h.pageKv(storage.RetainedKey, func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		return fn(obj)
+	})
+}
+
+// IterInflightMessages calls fn with each stored inflight message in the store.
+func (h *Hook) IterInflightMessages(fn func(v storage.Message) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return storage.ErrDBFileNotOpen
+	}
+
+	return h.pageKv(storage.InflightKey, func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		return fn(obj)
+	})
+}
+
+// IterQueuedMessages calls fn with each message queued for a disconnected client in the store.
+func (h *Hook) IterQueuedMessages(fn func(v storage.Message) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return storage.ErrDBFileNotOpen
+	}
+
+	return h.pageKv(storage.QueuedKey, func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		return fn(obj)
+	})
+}
+
 // StoredSysInfo returns the system info from the store.
 func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
 	if h.db == nil {
@@ -453,18 +711,92 @@ func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
 	return v, nil
 }
 
+// StoredSession returns the stored client, subscriptions, and inflight and queued messages
+// of a single client from the store.
+func (h *Hook) StoredSession(id string) (v storage.Session, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	err = h.getKv(storage.ClientKey+"_"+id, &v.Client)
+	if errors.Is(err, ErrKeyNotFound) {
+		return v, nil
+	} else if err != nil {
+		return
+	}
+
+	err = h.iterKv(storage.SubscriptionKey+"_"+id+":", func(value []byte) error {
+		obj := storage.Subscription{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		if obj.Client == id {
+			v.Subscriptions = append(v.Subscriptions, obj)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	err = h.iterKv(storage.InflightKey+"_"+id+":", func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		if obj.Client == id {
+			v.Inflight = append(v.Inflight, obj)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	err = h.iterKv(storage.QueuedKey+"_"+id+":", func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		if obj.Client == id {
+			v.Queued = append(v.Queued, obj)
+		}
+		return nil
+	})
+	return
+}
+
+// update runs fn in a read-write transaction, coalescing it with concurrent writes if batch writes
+// are enabled. A batched fn may be run more than once, so must be idempotent.
+func (h *Hook) update(fn func(tx *bbolt.Tx) error) error {
+	if h.config.BatchWrites {
+		return h.db.Batch(fn)
+	}
+
+	return h.db.Update(fn)
+}
+
 // setKv stores a key-value pair in the database.
 func (h *Hook) setKv(k string, v storage.Serializable) error {
-	err := h.db.Update(func(tx *bbolt.Tx) error {
+	k = h.config.Namespace.Key(k)
+	data, _ := v.MarshalBinary()
+	data, err := h.crypt.Encrypt([]byte(k), data)
+	if err != nil {
+		h.Log.Error("failed to encrypt data", "error", err, "key", k)
+		return err
+	}
 
+	start := time.Now()
+	err = h.update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(h.config.Bucket))
-		data, _ := v.MarshalBinary()
 		err := bucket.Put([]byte(k), data)
 		if err != nil {
 			return err
 		}
 		return nil
 	})
+	h.stats.Write(start, err)
 	if err != nil {
 		h.Log.Error("failed to upsert data", "error", err, "key", k)
 	}
@@ -473,7 +805,9 @@ func (h *Hook) setKv(k string, v storage.Serializable) error {
 
 // delKv deletes a key-value pair from the database.
 func (h *Hook) delKv(k string) error {
-	err := h.db.Update(func(tx *bbolt.Tx) error {
+	k = h.config.Namespace.Key(k)
+	start := time.Now()
+	err := h.update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(h.config.Bucket))
 		err := bucket.Delete([]byte(k))
 		if err != nil {
@@ -481,6 +815,7 @@ func (h *Hook) delKv(k string) error {
 		}
 		return nil
 	})
+	h.stats.Delete(start, err)
 	if err != nil {
 		h.Log.Error("failed to delete data", "error", err, "key", k)
 	}
@@ -489,6 +824,8 @@ func (h *Hook) delKv(k string) error {
 
 // getKv retrieves the value associated with a key from the database.
 func (h *Hook) getKv(k string, v storage.Serializable) error {
+	k = h.config.Namespace.Key(k)
+	start := time.Now()
 	err := h.db.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(h.config.Bucket))
 
@@ -497,30 +834,268 @@ func (h *Hook) getKv(k string, v storage.Serializable) error {
 			return ErrKeyNotFound
 		}
 
-		return v.UnmarshalBinary(value)
+		return h.unmarshal([]byte(k), value, v)
 	})
-	if err != nil {
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
 		h.Log.Error("failed to get data", "error", err, "key", k)
+		h.stats.Read(start, err)
+		return err
 	}
+
+	h.stats.Read(start, nil) // a missing key is not a failed read
 	return err
 }
 
 // iterKv iterates over key-value pairs with keys having the specified prefix in the database.
 func (h *Hook) iterKv(prefix string, visit func([]byte) error) error {
+	prefix = h.config.Namespace.Key(prefix)
+	start := time.Now()
 	err := h.db.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(h.config.Bucket))
 
 		c := bucket.Cursor()
-		for k, v := c.Seek([]byte(prefix)); k != nil && string(k[:len(prefix)]) == prefix; k, v = c.Next() {
-			if err := visit(v); err != nil {
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			value, err := h.crypt.Decrypt(k, v)
+			if err != nil {
+				return err
+			}
+
+			if err := visit(value); err != nil {
 				return err
 			}
 		}
 		return nil
 	})
+	h.stats.Read(start, err)
 
 	if err != nil {
 		h.Log.Error("failed to iter data", "error", err, "prefix", prefix)
 	}
 	return err
 }
+
+// pageKv iterates over the values of keys having the specified prefix in the database, reading
+// pageSize values in each transaction. Values are visited outside of a transaction, so visit
+// may write to the database.
+func (h *Hook) pageKv(prefix string, visit func([]byte) error) error {
+	prefix = h.config.Namespace.Key(prefix)
+	seek, resume := []byte(prefix), false
+	for {
+		var last []byte
+		page := make([][]byte, 0, pageSize)
+		start := time.Now()
+		err := h.db.View(func(tx *bbolt.Tx) error {
+			c := tx.Bucket([]byte(h.config.Bucket)).Cursor()
+			k, v := c.Seek(seek)
+			if resume && bytes.Equal(k, seek) {
+				k, v = c.Next() // the last key of the previous page
+			}
+
+			for ; k != nil && bytes.HasPrefix(k, []byte(prefix)) && len(page) < pageSize; k, v = c.Next() {
+				value, err := h.crypt.Decrypt(k, v)
+				if err != nil {
+					return err
+				}
+
+				page = append(page, bytes.Clone(value)) // values are only valid during the transaction
+				last = k
+			}
+
+			last = bytes.Clone(last)
+			return nil
+		})
+		h.stats.Read(start, err)
+		if err != nil {
+			h.Log.Error("failed to iter data", "error", err, "prefix", prefix)
+			return err
+		}
+
+		for _, value := range page {
+			if err := visit(value); err != nil {
+				return err
+			}
+		}
+
+		if len(page) < pageSize {
+			return nil
+		}
+
+		seek, resume = last, true
+	}
+}
+
+// unmarshal decrypts a value stored under key and decodes it into v.
+func (h *Hook) unmarshal(key, data []byte, v storage.Serializable) error {
+	data, err := h.crypt.Decrypt(key, data)
+	if err != nil {
+		return err
+	}
+
+	return v.UnmarshalBinary(data)
+}
+
+// Backup writes a consistent backup of the records in the store to w.
+func (h *Hook) Backup(w io.Writer) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return storage.Backup(w, records{h: h})
+}
+
+// Restore replaces the records in the store with a backup read from r. It should be
+// called before the server is started, as restored records are only loaded on startup.
+func (h *Hook) Restore(r io.Reader) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	if h.config.ReadOnly {
+		return storage.ErrReadOnly
+	}
+
+	return storage.Restore(r, records{h: h})
+}
+
+// Export writes the clients, subscriptions, retained messages, inflight messages and
+// system info in the store to w as JSON Lines, which can be imported into any storage hook.
+func (h *Hook) Export(w io.Writer) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return storage.Export(w, h)
+}
+
+// Import adds the records of an export read from r to the store, replacing any existing
+// records with the same keys. It should be called before the server is started, as imported
+// records are only loaded on startup.
+func (h *Hook) Import(r io.Reader) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	if h.config.ReadOnly {
+		return storage.ErrReadOnly
+	}
+
+	return storage.Import(r, h.importRecord)
+}
+
+// importRecord stores an imported record under the key used by the hook.
+func (h *Hook) importRecord(v storage.Serializable) error {
+	switch v := v.(type) {
+	case *storage.Client:
+		return h.setKv(clientKey(&mqtt.Client{ID: v.ID}), v)
+	case *storage.Subscription:
+		v.ID = subscriptionKey(&mqtt.Client{ID: v.Client}, v.Filter)
+		return h.setKv(v.ID, v)
+	case *storage.Message:
+		switch v.T {
+		case storage.RetainedKey:
+			v.ID = retainedKey(v.TopicName)
+		case storage.QueuedKey:
+			v.ID = queuedKey(&mqtt.Client{ID: v.Client}, packets.Packet{PacketID: v.PacketID})
+		default:
+			v.ID = inflightKey(&mqtt.Client{ID: v.Client}, packets.Packet{PacketID: v.PacketID})
+		}
+
+		if err := h.config.Compression.CompressMessage(v); err != nil {
+			h.Log.Error("failed to compress payload", "error", err, "key", v.ID)
+		}
+		return h.setKv(v.ID, v)
+	case *storage.SystemInfo:
+		v.ID = sysInfoKey()
+		return h.setKv(v.ID, v)
+	}
+
+	return nil
+}
+
+// migrateSchema upgrades the records of the store to the current schema version. The records
+// of a read-only store are only checked, as they cannot be migrated.
+func (h *Hook) migrateSchema() error {
+	if h.config.ReadOnly {
+		_, err := storage.CheckSchema(records{h: h}, storage.Migrations, storage.SchemaVersion)
+		return err
+	}
+
+	from, err := storage.Migrate(records{h: h}, storage.Migrations, storage.SchemaVersion)
+	if err != nil {
+		return err
+	}
+
+	if from != storage.SchemaVersion {
+		h.Log.Info("migrated storage schema", "from", from, "to", storage.SchemaVersion)
+	}
+
+	return nil
+}
+
+// records provides the raw records of the store to schema migrations.
+type records struct {
+	h *Hook
+}
+
+// SchemaVersion returns the schema version of the store.
+func (r records) SchemaVersion() (v int, ok bool, err error) {
+	err = r.h.db.View(func(tx *bbolt.Tx) error {
+		value := tx.Bucket([]byte(r.h.config.Bucket)).Get([]byte(r.h.config.Namespace.Key(storage.SchemaVersionKey)))
+		if value == nil {
+			return nil
+		}
+
+		ok = true
+		v, err = strconv.Atoi(string(value))
+		return err
+	})
+
+	return v, ok, err
+}
+
+// SetSchemaVersion stores the schema version of the store.
+func (r records) SetSchemaVersion(v int) error {
+	return r.h.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(r.h.config.Bucket)).Put([]byte(r.h.config.Namespace.Key(storage.SchemaVersionKey)), []byte(strconv.Itoa(v)))
+	})
+}
+
+// Each calls visit with the key, without the namespace, and decrypted value of each record
+// in the namespace.
+func (r records) Each(visit func(key string, value []byte) error) error {
+	prefix := []byte(r.h.config.Namespace.Key(""))
+	return r.h.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(r.h.config.Bucket)).ForEach(func(k, v []byte) error {
+			if !bytes.HasPrefix(k, prefix) || string(k) == r.h.config.Namespace.Key(storage.SchemaVersionKey) {
+				return nil
+			}
+
+			value, err := r.h.crypt.Decrypt(k, v)
+			if err != nil {
+				return err
+			}
+
+			return visit(string(k[len(prefix):]), append([]byte{}, value...))
+		})
+	})
+}
+
+// Set encrypts and sets the value of a record.
+func (r records) Set(key string, value []byte) error {
+	k := []byte(r.h.config.Namespace.Key(key))
+	value, err := r.h.crypt.Encrypt(k, value)
+	if err != nil {
+		return err
+	}
+
+	return r.h.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(r.h.config.Bucket)).Put(k, value)
+	})
+}
+
+// Delete deletes a record.
+func (r records) Delete(key string) error {
+	return r.h.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(r.h.config.Bucket)).Delete([]byte(r.h.config.Namespace.Key(key)))
+	})
+}
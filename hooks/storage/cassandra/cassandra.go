@@ -0,0 +1,1100 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package cassandra
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/system"
+
+	"github.com/gocql/gocql"
+)
+
+const (
+	defaultHost              = "localhost"
+	defaultKeyspace          = "mochi"
+	defaultConsistency       = "LOCAL_QUORUM"
+	defaultReplicationFactor = 1
+	defaultTimeout           = 5 * time.Second
+	defaultPageSize          = 1000
+)
+
+// Tables are the names of the tables used to store each type of data. Each table has the
+// same schema: rows are partitioned by p and clustered by k, with the encoded data in data.
+const (
+	clientsTable       = "clients"
+	subscriptionsTable = "subscriptions"
+	retainedTable      = "retained"
+	inflightTable      = "inflight"
+	queuedTable        = "queued"
+	sysInfoTable       = "sysinfo"
+)
+
+var (
+	// ErrInvalidKeyspace indicates the keyspace name is not a valid cql identifier.
+	ErrInvalidKeyspace = errors.New("invalid keyspace name")
+
+	validKeyspace = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]{0,47}$`)
+	tables        = []string{clientsTable, subscriptionsTable, retainedTable, inflightTable, queuedTable, sysInfoTable}
+)
+
+// clientKey returns the partition and clustering keys for a client.
+func clientKey(cl *mqtt.Client) (string, string) {
+	return cl.ID, ""
+}
+
+// subscriptionKey returns the partition and clustering keys for a subscription. Subscriptions
+// are partitioned by client, so the subscriptions of a client are stored together.
+func subscriptionKey(cl *mqtt.Client, filter string) (string, string) {
+	return cl.ID, filter
+}
+
+// retainedKey returns the partition and clustering keys for a retained message.
+func retainedKey(topic string) (string, string) {
+	return topic, ""
+}
+
+// inflightKey returns the partition and clustering keys for an inflight or queued message. These
+// messages are partitioned by client, so the messages of a client are stored together.
+func inflightKey(cl *mqtt.Client, pk packets.Packet) (string, string) {
+	return cl.ID, pk.FormatID()
+}
+
+// sysInfoKey returns the partition and clustering keys for system info.
+func sysInfoKey() (string, string) {
+	return storage.SysInfoKey, ""
+}
+
+// Options contains configuration settings for the cassandra or scylla cluster.
+type Options struct {
+	Hosts             []string `yaml:"hosts" json:"hosts"`                           // the addresses of the cluster nodes
+	Keyspace          string   `yaml:"keyspace" json:"keyspace"`                     // the keyspace to store data in
+	Username          string   `yaml:"username" json:"username"`                     // the username for password authentication
+	Password          string   `yaml:"password" json:"password"`                     // the password for password authentication
+	Consistency       string   `yaml:"consistency" json:"consistency"`               // the consistency level of queries, e.g. LOCAL_QUORUM
+	LocalDC           string   `yaml:"local_dc" json:"local_dc"`                     // prefer nodes in the named datacenter
+	ReplicationFactor int      `yaml:"replication_factor" json:"replication_factor"` // the replication factor used if the keyspace is created
+	CreateSchema      bool     `yaml:"create_schema" json:"create_schema"`           // create the keyspace and tables if they do not exist
+	Timeout           int64    `yaml:"timeout" json:"timeout"`                       // the query and connection timeout in milliseconds
+	PageSize          int      `yaml:"page_size" json:"page_size"`                   // the number of rows fetched per page when loading stored data
+
+	// Namespace prefixes the names of the tables, so several brokers can share a keyspace.
+	Namespace storage.Namespace `yaml:"namespace" json:"namespace"`
+
+	// ReadOnly stops the hook writing to the keyspace, so a standby broker can restore from it.
+	// A read-only hook only provides the methods which read from the store, and never creates
+	// the schema.
+	ReadOnly bool `yaml:"read_only" json:"read_only"`
+
+	// Cluster is an optional gocql cluster configuration, which takes precedence over the
+	// connection values above. Keyspace, CreateSchema, and ReplicationFactor still apply.
+	Cluster *gocql.ClusterConfig `yaml:"-" json:"-"`
+}
+
+// db is the table operations used by the hook.
+type db interface {
+	put(table, p, k string, data []byte) error
+	delete(table, p, k string) error
+	get(table, p, k string) ([]byte, error)
+	scan(table string, fn func(data []byte)) error
+	partition(table, p string, fn func(data []byte)) error
+	ping() error
+	close()
+}
+
+// Hook is a persistent storage hook using a Cassandra or ScyllaDB cluster as a backend,
+// for fleets with more sessions and retained messages than a single node store can hold.
+type Hook struct {
+	mqtt.HookBase
+	config *Options         // options for connecting to the cluster
+	db     db               // the cluster session
+	stats  storage.Recorder // records the reads, writes and deletes of the hook
+}
+
+// ID returns the id of the hook.
+func (h *Hook) ID() string {
+	return "cassandra-db"
+}
+
+// Provides indicates which hook methods this hook provides. A read-only hook only provides
+// the methods which read from the store.
+func (h *Hook) Provides(b byte) bool {
+	if bytes.Contains([]byte{
+		mqtt.StoredClients,
+		mqtt.StoredInflightMessages,
+		mqtt.StoredQueuedMessages,
+		mqtt.StoredRetainedMessages,
+		mqtt.StoredSubscriptions,
+		mqtt.StoredSysInfo,
+		mqtt.StoredSession,
+	}, []byte{b}) {
+		return true
+	}
+
+	return (h.config == nil || !h.config.ReadOnly) && bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+		mqtt.OnRetainMessage,
+		mqtt.OnQosPublish,
+		mqtt.OnQosComplete,
+		mqtt.OnQosDropped,
+		mqtt.OnQueuedMessage,
+		mqtt.OnWillSent,
+		mqtt.OnSysInfoTick,
+		mqtt.OnClientExpired,
+		mqtt.OnRetainedExpired,
+	}, []byte{b})
+}
+
+// Init initializes and connects to the cluster, creating the schema if configured.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.config = config.(*Options)
+	if h.config.Keyspace == "" {
+		h.config.Keyspace = defaultKeyspace
+	}
+
+	if !validKeyspace.MatchString(h.config.Keyspace) {
+		return fmt.Errorf("%w: %s", ErrInvalidKeyspace, h.config.Keyspace)
+	}
+
+	if err := h.config.Namespace.Validate(); err != nil {
+		return err
+	}
+
+	if h.config.ReplicationFactor <= 0 {
+		h.config.ReplicationFactor = defaultReplicationFactor
+	}
+
+	if h.config.PageSize <= 0 {
+		h.config.PageSize = defaultPageSize
+	}
+
+	cluster, err := h.clusterConfig()
+	if err != nil {
+		return err
+	}
+
+	h.Log.Info(
+		"connecting to cassandra service",
+		"hosts", cluster.Hosts,
+		"keyspace", h.config.Keyspace,
+		"namespace", h.config.Namespace,
+		"consistency", cluster.Consistency.String(),
+	)
+
+	if h.config.CreateSchema && !h.config.ReadOnly {
+		if err := createSchema(cluster, h.config.Keyspace, h.config.Namespace, h.config.ReplicationFactor); err != nil {
+			return fmt.Errorf("failed to create schema: %w", err)
+		}
+	}
+
+	cluster.Keyspace = h.config.Keyspace
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return fmt.Errorf("failed to connect to service: %w", err)
+	}
+
+	h.db = &recordedDB{
+		db: &cqlDB{
+			session:   session,
+			keyspace:  h.config.Keyspace,
+			namespace: h.config.Namespace,
+			pageSize:  h.config.PageSize,
+		},
+		stats: &h.stats,
+	}
+
+	h.Log.Info("connected to cassandra service")
+
+	return nil
+}
+
+// clusterConfig returns the gocql cluster configuration from the hook options.
+func (h *Hook) clusterConfig() (*gocql.ClusterConfig, error) {
+	if h.config.Cluster != nil {
+		return h.config.Cluster, nil
+	}
+
+	hosts := h.config.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{defaultHost}
+	}
+
+	cluster := gocql.NewCluster(hosts...)
+	consistency := h.config.Consistency
+	if consistency == "" {
+		consistency = defaultConsistency
+	}
+
+	if err := cluster.Consistency.UnmarshalText([]byte(strings.ToUpper(consistency))); err != nil {
+		return nil, err
+	}
+
+	timeout := defaultTimeout
+	if h.config.Timeout > 0 {
+		timeout = time.Duration(h.config.Timeout) * time.Millisecond
+	}
+	cluster.Timeout = timeout
+	cluster.ConnectTimeout = timeout
+
+	if h.config.Username != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{
+			Username: h.config.Username,
+			Password: h.config.Password,
+		}
+	}
+
+	if h.config.LocalDC != "" {
+		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(gocql.DCAwareRoundRobinPolicy(h.config.LocalDC))
+	}
+
+	return cluster, nil
+}
+
+// createSchema creates the keyspace and tables used by the hook if they do not exist.
+func createSchema(cluster *gocql.ClusterConfig, keyspace string, ns storage.Namespace, rf int) error {
+	c := *cluster
+	c.Keyspace = ""
+	session, err := c.CreateSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	for _, stmt := range schema(keyspace, ns, rf) {
+		if err := session.Query(stmt).Exec(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// schema returns the statements which create the keyspace and tables used by the hook, with
+// the names of the tables prefixed by the namespace.
+func schema(keyspace string, ns storage.Namespace, rf int) []string {
+	stmts := []string{
+		fmt.Sprintf("CREATE KEYSPACE IF NOT EXISTS %s WITH replication = {'class': 'SimpleStrategy', 'replication_factor': %d}", keyspace, rf),
+	}
+
+	for _, table := range tables {
+		stmts = append(stmts, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.%s (p text, k text, data blob, PRIMARY KEY (p, k))", keyspace, ns.Table(table)))
+	}
+
+	return stmts
+}
+
+// Stop closes the cluster session.
+func (h *Hook) Stop() error {
+	h.Log.Info("disconnecting from cassandra service")
+	if h.db != nil {
+		h.db.close()
+	}
+
+	return nil
+}
+
+// Health returns an error if the cluster cannot be reached.
+func (h *Hook) Health() error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return h.db.ping()
+}
+
+// StorageStats returns the counters and latencies of the reads, writes and deletes of the hook.
+func (h *Hook) StorageStats() storage.Stats {
+	return h.stats.Stats()
+}
+
+// setKv stores an encoded value in a table.
+func (h *Hook) setKv(table, p, k string, v encoding.BinaryMarshaler) {
+	data, err := v.MarshalBinary()
+	if err != nil {
+		h.Log.Error("failed to marshal data", "error", err, "table", table, "key", p+":"+k)
+		return
+	}
+
+	err = h.db.put(table, p, k, data)
+	if err != nil {
+		h.Log.Error("failed to upsert data", "error", err, "table", table, "key", p+":"+k)
+	}
+}
+
+// delKv deletes a value from a table.
+func (h *Hook) delKv(table, p, k string) {
+	err := h.db.delete(table, p, k)
+	if err != nil {
+		h.Log.Error("failed to delete data", "error", err, "table", table, "key", p+":"+k)
+	}
+}
+
+// OnSessionEstablished adds a client to the store when their session is established.
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// OnWillSent is called when a client sends a Will Message and the Will Message is removed from the client record.
+func (h *Hook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// updateClient writes the client data to the store.
+func (h *Hook) updateClient(cl *mqtt.Client) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := cl.Properties.Props.Copy(false)
+	in := &storage.Client{
+		ID:              cl.ID,
+		T:               storage.ClientKey,
+		Remote:          cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		Username:        cl.Properties.Username,
+		Clean:           cl.Properties.Clean,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Properties: storage.ClientProperties{
+			SessionExpiryInterval: props.SessionExpiryInterval,
+			AuthenticationMethod:  props.AuthenticationMethod,
+			AuthenticationData:    props.AuthenticationData,
+			RequestProblemInfo:    props.RequestProblemInfo,
+			RequestResponseInfo:   props.RequestResponseInfo,
+			ReceiveMaximum:        props.ReceiveMaximum,
+			TopicAliasMaximum:     props.TopicAliasMaximum,
+			User:                  props.User,
+			MaximumPacketSize:     props.MaximumPacketSize,
+		},
+		Will: storage.ClientWill(cl.Properties.Will),
+	}
+
+	p, k := clientKey(cl)
+	h.setKv(clientsTable, p, k, in)
+}
+
+// OnDisconnect removes a client from the store if they were using a clean session.
+func (h *Hook) OnDisconnect(cl *mqtt.Client, _ error, expire bool) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if !expire {
+		return
+	}
+
+	if cl.StopCause() == packets.ErrSessionTakenOver {
+		return
+	}
+
+	p, k := clientKey(cl)
+	h.delKv(clientsTable, p, k)
+}
+
+// OnSubscribed adds one or more client subscriptions to the store.
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	var in *storage.Subscription
+	for i := 0; i < len(pk.Filters); i++ {
+		p, k := subscriptionKey(cl, pk.Filters[i].Filter)
+		in = &storage.Subscription{
+			ID:                p + ":" + k,
+			T:                 storage.SubscriptionKey,
+			Client:            cl.ID,
+			Qos:               reasonCodes[i],
+			Filter:            pk.Filters[i].Filter,
+			Identifier:        pk.Filters[i].Identifier,
+			NoLocal:           pk.Filters[i].NoLocal,
+			RetainHandling:    pk.Filters[i].RetainHandling,
+			RetainAsPublished: pk.Filters[i].RetainAsPublished,
+		}
+
+		h.setKv(subscriptionsTable, p, k, in)
+	}
+}
+
+// OnUnsubscribed removes one or more client subscriptions from the store.
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	for i := 0; i < len(pk.Filters); i++ {
+		p, k := subscriptionKey(cl, pk.Filters[i].Filter)
+		h.delKv(subscriptionsTable, p, k)
+	}
+}
+
+// OnRetainMessage adds a retained message for a topic to the store.
+func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	p, k := retainedKey(pk.TopicName)
+	if r == -1 {
+		h.delKv(retainedTable, p, k)
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:              p,
+		T:               storage.RetainedKey,
+		FixedHeader:     pk.FixedHeader,
+		TopicName:       pk.TopicName,
+		Payload:         pk.Payload,
+		Created:         pk.Created,
+		Expiry:          pk.Expiry,
+		ProtocolVersion: pk.ProtocolVersion,
+		Client:          cl.ID,
+		Origin:          pk.Origin,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	h.setKv(retainedTable, p, k, in)
+}
+
+// OnQosPublish adds or updates an inflight message in the store.
+func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, resends int) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	p, k := inflightKey(cl, pk)
+	h.setKv(inflightTable, p, k, h.message(storage.InflightKey, p+":"+k, cl, pk, sent))
+
+	// queued messages are resent as duplicates once the client reconnects, and are inflight from then on.
+	if pk.FixedHeader.Dup {
+		h.delKv(queuedTable, p, k)
+	}
+}
+
+// OnQueuedMessage adds a message queued for a disconnected client to the store.
+func (h *Hook) OnQueuedMessage(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	p, k := inflightKey(cl, pk)
+	h.setKv(queuedTable, p, k, h.message(storage.QueuedKey, p+":"+k, cl, pk, 0))
+}
+
+// message returns a storable inflight or queued message.
+func (h *Hook) message(t, id string, cl *mqtt.Client, pk packets.Packet, sent int64) *storage.Message {
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:              id,
+		T:               t,
+		Client:          cl.ID,
+		Origin:          pk.Origin,
+		PacketID:        pk.PacketID,
+		FixedHeader:     pk.FixedHeader,
+		TopicName:       pk.TopicName,
+		Payload:         pk.Payload,
+		Sent:            sent,
+		Created:         pk.Created,
+		Expiry:          pk.Expiry,
+		ProtocolVersion: pk.ProtocolVersion,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	return in
+}
+
+// OnQosComplete removes a resolved inflight message from the store.
+func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	p, k := inflightKey(cl, pk)
+	h.delKv(inflightTable, p, k)
+}
+
+// OnQosDropped removes a dropped inflight or queued message from the store.
+func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.OnQosComplete(cl, pk)
+	p, k := inflightKey(cl, pk)
+	h.delKv(queuedTable, p, k)
+}
+
+// OnSysInfoTick stores the latest system info in the store.
+func (h *Hook) OnSysInfoTick(sys *system.Info) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	p, k := sysInfoKey()
+	in := &storage.SystemInfo{
+		ID:   p,
+		T:    storage.SysInfoKey,
+		Info: *sys.Clone(),
+	}
+
+	h.setKv(sysInfoTable, p, k, in)
+}
+
+// OnRetainedExpired deletes expired retained messages from the store.
+func (h *Hook) OnRetainedExpired(filter string) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	p, k := retainedKey(filter)
+	h.delKv(retainedTable, p, k)
+}
+
+// OnClientExpired deleted expired clients from the store.
+func (h *Hook) OnClientExpired(cl *mqtt.Client) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	p, k := clientKey(cl)
+	h.delKv(clientsTable, p, k)
+}
+
+// StoredClients returns all stored clients from the store.
+func (h *Hook) StoredClients() (v []storage.Client, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err = h.db.scan(clientsTable, func(data []byte) {
+		var d storage.Client
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal client data", "error", err, "data", data)
+			return
+		}
+		v = append(v, d)
+	})
+
+	return v, err
+}
+
+// StoredSubscriptions returns all stored subscriptions from the store.
+func (h *Hook) StoredSubscriptions() (v []storage.Subscription, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err = h.db.scan(subscriptionsTable, func(data []byte) {
+		var d storage.Subscription
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal subscription data", "error", err, "data", data)
+			return
+		}
+		v = append(v, d)
+	})
+
+	return v, err
+}
+
+// StoredRetainedMessages returns all stored retained messages from the store.
+func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err = h.db.scan(retainedTable, func(data []byte) {
+		var d storage.Message
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal retained message data", "error", err, "data", data)
+			return
+		}
+		v = append(v, d)
+	})
+
+	return v, err
+}
+
+// StoredInflightMessages returns all stored inflight messages from the store.
+func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err = h.db.scan(inflightTable, func(data []byte) {
+		var d storage.Message
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal inflight message data", "error", err, "data", data)
+			return
+		}
+		v = append(v, d)
+	})
+
+	return v, err
+}
+
+// StoredQueuedMessages returns all messages queued for disconnected clients from the store.
+func (h *Hook) StoredQueuedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err = h.db.scan(queuedTable, func(data []byte) {
+		var d storage.Message
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal queued message data", "error", err, "data", data)
+			return
+		}
+		v = append(v, d)
+	})
+
+	return v, err
+}
+
+// IterClients calls fn with each stored client in the store, as the rows
+// of the table are fetched a page at a time.
+func (h *Hook) IterClients(fn func(v storage.Client) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	var ferr error
+	err := h.db.scan(clientsTable, func(data []byte) {
+		if ferr != nil {
+			return
+		}
+
+		var d storage.Client
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal client data", "error", err, "data", data)
+			return
+		}
+		ferr = fn(d)
+	})
+	if ferr != nil {
+		return ferr
+	}
+
+	return err
+}
+
+// IterSubscriptions calls fn with each stored subscription in the store, as the rows
+// of the table are fetched a page at a time.
+func (h *Hook) IterSubscriptions(fn func(v storage.Subscription) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	var ferr error
+	err := h.db.scan(subscriptionsTable, func(data []byte) {
+		if ferr != nil {
+			return
+		}
+
+		var d storage.Subscription
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal subscription data", "error", err, "data", data)
+			return
+		}
+		ferr = fn(d)
+	})
+	if ferr != nil {
+		return ferr
+	}
+
+	return err
+}
+
+// IterRetainedMessages calls fn with each stored retained message in the store, as the rows
+// of the table are fetched a page at a time.
+func (h *Hook) IterRetainedMessages(fn func(v storage.Message) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	var ferr error
+	err := h.db.scan(retainedTable, func(data []byte) {
+		if ferr != nil {
+			return
+		}
+
+		var d storage.Message
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal retained message data", "error", err, "data", data)
+			return
+		}
+		ferr = fn(d)
+	})
+	if ferr != nil {
+		return ferr
+	}
+
+	return err
+}
+
+// IterInflightMessages calls fn with each stored inflight message in the store, as the rows
+// of the table are fetched a page at a time.
+func (h *Hook) IterInflightMessages(fn func(v storage.Message) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	var ferr error
+	err := h.db.scan(inflightTable, func(data []byte) {
+		if ferr != nil {
+			return
+		}
+
+		var d storage.Message
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal inflight message data", "error", err, "data", data)
+			return
+		}
+		ferr = fn(d)
+	})
+	if ferr != nil {
+		return ferr
+	}
+
+	return err
+}
+
+// IterQueuedMessages calls fn with each message queued for a disconnected client in the store, as the rows
+// of the table are fetched a page at a time.
+func (h *Hook) IterQueuedMessages(fn func(v storage.Message) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	var ferr error
+	err := h.db.scan(queuedTable, func(data []byte) {
+		if ferr != nil {
+			return
+		}
+
+		var d storage.Message
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal queued message data", "error", err, "data", data)
+			return
+		}
+		ferr = fn(d)
+	})
+	if ferr != nil {
+		return ferr
+	}
+
+	return err
+}
+
+// StoredSysInfo returns the system info from the store.
+func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	p, k := sysInfoKey()
+	data, err := h.db.get(sysInfoTable, p, k)
+	if err != nil || data == nil {
+		return v, err
+	}
+
+	if err = v.UnmarshalBinary(data); err != nil {
+		h.Log.Error("failed to unmarshal sys info data", "error", err, "data", data)
+	}
+
+	return v, nil
+}
+
+// StoredSession returns the stored client, subscriptions, and inflight and queued messages
+// of a single client from the store. The rows of a client are read from its own partitions.
+func (h *Hook) StoredSession(id string) (v storage.Session, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	p, k := clientKey(&mqtt.Client{ID: id})
+	data, err := h.db.get(clientsTable, p, k)
+	if err != nil || data == nil {
+		return v, err
+	}
+
+	if err = v.Client.UnmarshalBinary(data); err != nil {
+		return
+	}
+
+	err = h.db.partition(subscriptionsTable, id, func(data []byte) {
+		var d storage.Subscription
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal subscription data", "error", err, "data", data)
+			return
+		}
+		v.Subscriptions = append(v.Subscriptions, d)
+	})
+	if err != nil {
+		return
+	}
+
+	err = h.db.partition(inflightTable, id, func(data []byte) {
+		var d storage.Message
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal inflight message data", "error", err, "data", data)
+			return
+		}
+		v.Inflight = append(v.Inflight, d)
+	})
+	if err != nil {
+		return
+	}
+
+	err = h.db.partition(queuedTable, id, func(data []byte) {
+		var d storage.Message
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal queued message data", "error", err, "data", data)
+			return
+		}
+		v.Queued = append(v.Queued, d)
+	})
+
+	return v, err
+}
+
+// Export writes the clients, subscriptions, retained messages, inflight messages and
+// system info in the store to w as JSON Lines, which can be imported into any storage hook.
+func (h *Hook) Export(w io.Writer) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return storage.Export(w, h)
+}
+
+// Import adds the records of an export read from r to the store, replacing any existing
+// records with the same keys. It should be called before the server is started, as imported
+// records are only loaded on startup.
+func (h *Hook) Import(r io.Reader) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	if h.config != nil && h.config.ReadOnly {
+		return storage.ErrReadOnly
+	}
+
+	return storage.Import(r, h.importRecord)
+}
+
+// importRecord stores an imported record in the table and under the keys used by the hook.
+func (h *Hook) importRecord(v storage.Serializable) error {
+	var table, p, k string
+	switch v := v.(type) {
+	case *storage.Client:
+		table = clientsTable
+		p, k = clientKey(&mqtt.Client{ID: v.ID})
+	case *storage.Subscription:
+		table = subscriptionsTable
+		p, k = subscriptionKey(&mqtt.Client{ID: v.Client}, v.Filter)
+		v.ID = p + ":" + k
+	case *storage.Message:
+		switch v.T {
+		case storage.RetainedKey:
+			table = retainedTable
+			p, k = retainedKey(v.TopicName)
+			v.ID = p
+		case storage.QueuedKey:
+			table = queuedTable
+			p, k = inflightKey(&mqtt.Client{ID: v.Client}, packets.Packet{PacketID: v.PacketID})
+			v.ID = p + ":" + k
+		default:
+			table = inflightTable
+			p, k = inflightKey(&mqtt.Client{ID: v.Client}, packets.Packet{PacketID: v.PacketID})
+			v.ID = p + ":" + k
+		}
+	case *storage.SystemInfo:
+		table = sysInfoTable
+		p, k = sysInfoKey()
+		v.ID = p
+	}
+
+	data, err := v.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	return h.db.put(table, p, k, data)
+}
+
+// cqlDB is a db backed by a gocql session.
+type cqlDB struct {
+	session   *gocql.Session    // the cluster session
+	keyspace  string            // the keyspace containing the tables
+	namespace storage.Namespace // prefixes the names of the tables
+	pageSize  int               // the number of rows fetched per page when scanning
+}
+
+// put upserts a row in a table.
+func (d *cqlDB) put(table, p, k string, data []byte) error {
+	return d.session.Query(fmt.Sprintf("INSERT INTO %s.%s (p, k, data) VALUES (?, ?, ?)", d.keyspace, d.namespace.Table(table)), p, k, data).Exec()
+}
+
+// delete deletes a row from a table.
+func (d *cqlDB) delete(table, p, k string) error {
+	return d.session.Query(fmt.Sprintf("DELETE FROM %s.%s WHERE p = ? AND k = ?", d.keyspace, d.namespace.Table(table)), p, k).Exec()
+}
+
+// get returns the data of a row in a table, or nil if the row does not exist.
+func (d *cqlDB) get(table, p, k string) ([]byte, error) {
+	var data []byte
+	err := d.session.Query(fmt.Sprintf("SELECT data FROM %s.%s WHERE p = ? AND k = ?", d.keyspace, d.namespace.Table(table)), p, k).Scan(&data)
+	if errors.Is(err, gocql.ErrNotFound) {
+		return nil, nil
+	}
+
+	return data, err
+}
+
+// scan calls fn with the data of every row in a table, fetching the rows a page at a time.
+func (d *cqlDB) scan(table string, fn func(data []byte)) error {
+	iter := d.session.Query(fmt.Sprintf("SELECT data FROM %s.%s", d.keyspace, d.namespace.Table(table))).PageSize(d.pageSize).Iter()
+	var data []byte
+	for iter.Scan(&data) {
+		fn(data)
+		data = nil
+	}
+
+	return iter.Close()
+}
+
+// partition calls fn with the data of every row in a partition of a table.
+func (d *cqlDB) partition(table, p string, fn func(data []byte)) error {
+	iter := d.session.Query(fmt.Sprintf("SELECT data FROM %s.%s WHERE p = ?", d.keyspace, d.namespace.Table(table)), p).PageSize(d.pageSize).Iter()
+	var data []byte
+	for iter.Scan(&data) {
+		fn(data)
+		data = nil
+	}
+
+	return iter.Close()
+}
+
+// ping checks the cluster can be queried.
+func (d *cqlDB) ping() error {
+	return d.session.Query("SELECT release_version FROM system.local").Exec()
+}
+
+// close closes the session.
+func (d *cqlDB) close() {
+	d.session.Close()
+}
+
+// recordedDB is a db which records the operations of the db it wraps.
+type recordedDB struct {
+	db                      // the wrapped db
+	stats *storage.Recorder // records the reads, writes and deletes of the db
+}
+
+// put upserts a row in a table.
+func (d *recordedDB) put(table, p, k string, data []byte) error {
+	start := time.Now()
+	err := d.db.put(table, p, k, data)
+	d.stats.Write(start, err)
+	return err
+}
+
+// delete deletes a row from a table.
+func (d *recordedDB) delete(table, p, k string) error {
+	start := time.Now()
+	err := d.db.delete(table, p, k)
+	d.stats.Delete(start, err)
+	return err
+}
+
+// get returns the data of a row in a table, or nil if the row does not exist.
+func (d *recordedDB) get(table, p, k string) ([]byte, error) {
+	start := time.Now()
+	data, err := d.db.get(table, p, k)
+	d.stats.Read(start, err)
+	return data, err
+}
+
+// scan calls fn with the data of every row in a table.
+func (d *recordedDB) scan(table string, fn func(data []byte)) error {
+	start := time.Now()
+	err := d.db.scan(table, fn)
+	d.stats.Read(start, err)
+	return err
+}
+
+// partition calls fn with the data of every row in a partition of a table.
+func (d *recordedDB) partition(table, p string, fn func(data []byte)) error {
+	start := time.Now()
+	err := d.db.partition(table, p, fn)
+	d.stats.Read(start, err)
+	return err
+}
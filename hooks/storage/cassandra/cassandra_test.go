@@ -0,0 +1,924 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package cassandra
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/system"
+
+	"github.com/gocql/gocql"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	client = &mqtt.Client{
+		ID: "test",
+		Net: mqtt.ClientConnection{
+			Remote:   "test.addr",
+			Listener: "listener",
+		},
+		Properties: mqtt.ClientProperties{
+			Username: []byte("username"),
+			Clean:    false,
+		},
+	}
+
+	pkf = packets.Packet{Filters: packets.Subscriptions{{Filter: "a/b/c"}}}
+
+	errTest = errors.New("test")
+)
+
+// memDB is an in-memory db for testing the hook without a cluster.
+type memDB struct {
+	sync.Mutex
+	tables map[string]map[string][]byte
+	err    error
+	closed bool
+}
+
+func newMemDB() *memDB {
+	return &memDB{tables: map[string]map[string][]byte{}}
+}
+
+func (d *memDB) put(table, p, k string, data []byte) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+
+	if d.tables[table] == nil {
+		d.tables[table] = map[string][]byte{}
+	}
+	d.tables[table][p+"\x00"+k] = data
+	return nil
+}
+
+func (d *memDB) delete(table, p, k string) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+
+	delete(d.tables[table], p+"\x00"+k)
+	return nil
+}
+
+func (d *memDB) get(table, p, k string) ([]byte, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	return d.tables[table][p+"\x00"+k], nil
+}
+
+func (d *memDB) scan(table string, fn func(data []byte)) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+
+	keys := make([]string, 0, len(d.tables[table]))
+	for k := range d.tables[table] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fn(d.tables[table][k])
+	}
+	return nil
+}
+
+func (d *memDB) partition(table, p string, fn func(data []byte)) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+
+	keys := make([]string, 0, len(d.tables[table]))
+	for k := range d.tables[table] {
+		if strings.HasPrefix(k, p+"\x00") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fn(d.tables[table][k])
+	}
+	return nil
+}
+
+func (d *memDB) ping() error {
+	return d.err
+}
+
+func (d *memDB) close() {
+	d.closed = true
+}
+
+func newHook(t *testing.T) (*Hook, *memDB) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	d := newMemDB()
+	h.db = d
+	return h, d
+}
+
+func TestClientKey(t *testing.T) {
+	p, k := clientKey(&mqtt.Client{ID: "cl1"})
+	require.Equal(t, "cl1", p)
+	require.Equal(t, "", k)
+}
+
+func TestSubscriptionKey(t *testing.T) {
+	p, k := subscriptionKey(&mqtt.Client{ID: "cl1"}, "a/b/c")
+	require.Equal(t, "cl1", p)
+	require.Equal(t, "a/b/c", k)
+}
+
+func TestRetainedKey(t *testing.T) {
+	p, k := retainedKey("a/b/c")
+	require.Equal(t, "a/b/c", p)
+	require.Equal(t, "", k)
+}
+
+func TestInflightKey(t *testing.T) {
+	p, k := inflightKey(&mqtt.Client{ID: "cl1"}, packets.Packet{PacketID: 1})
+	require.Equal(t, "cl1", p)
+	require.Equal(t, "1", k)
+}
+
+func TestSysInfoKey(t *testing.T) {
+	p, _ := sysInfoKey()
+	require.Equal(t, storage.SysInfoKey, p)
+}
+
+func TestID(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.Equal(t, "cassandra-db", h.ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.True(t, h.Provides(mqtt.OnSessionEstablished))
+	require.True(t, h.Provides(mqtt.OnDisconnect))
+	require.True(t, h.Provides(mqtt.OnSubscribed))
+	require.True(t, h.Provides(mqtt.OnUnsubscribed))
+	require.True(t, h.Provides(mqtt.OnRetainMessage))
+	require.True(t, h.Provides(mqtt.OnQosPublish))
+	require.True(t, h.Provides(mqtt.OnQosComplete))
+	require.True(t, h.Provides(mqtt.OnQosDropped))
+	require.True(t, h.Provides(mqtt.OnSysInfoTick))
+	require.True(t, h.Provides(mqtt.StoredClients))
+	require.True(t, h.Provides(mqtt.StoredInflightMessages))
+	require.True(t, h.Provides(mqtt.StoredRetainedMessages))
+	require.True(t, h.Provides(mqtt.StoredSubscriptions))
+	require.True(t, h.Provides(mqtt.StoredSysInfo))
+	require.False(t, h.Provides(mqtt.OnACLCheck))
+	require.False(t, h.Provides(mqtt.OnConnectAuthenticate))
+}
+
+func TestInitBadConfig(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(map[string]any{})
+	require.ErrorIs(t, err, mqtt.ErrInvalidConfigType)
+}
+
+func TestInitBadKeyspace(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(&Options{Keyspace: "mochi; DROP KEYSPACE system"})
+	require.ErrorIs(t, err, ErrInvalidKeyspace)
+}
+
+func TestInitBadNamespace(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Namespace: "a:b"})
+	require.ErrorIs(t, err, storage.ErrInvalidNamespace)
+}
+
+func TestInitBadConsistency(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(&Options{Consistency: "most"})
+	require.Error(t, err)
+}
+
+func TestInitUnreachable(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(&Options{Hosts: []string{"127.0.0.1:1"}, Timeout: 100})
+	require.Error(t, err)
+	require.Nil(t, h.db)
+	require.Equal(t, defaultKeyspace, h.config.Keyspace)
+	require.Equal(t, defaultReplicationFactor, h.config.ReplicationFactor)
+	require.Equal(t, defaultPageSize, h.config.PageSize)
+}
+
+func TestInitUnreachableCreateSchema(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(&Options{Hosts: []string{"127.0.0.1:1"}, Timeout: 100, CreateSchema: true})
+	require.Error(t, err)
+	require.Nil(t, h.db)
+}
+
+func TestClusterConfigDefaults(t *testing.T) {
+	h := new(Hook)
+	h.config = new(Options)
+
+	c, err := h.clusterConfig()
+	require.NoError(t, err)
+	require.Equal(t, []string{defaultHost}, c.Hosts)
+	require.Equal(t, gocql.LocalQuorum, c.Consistency)
+	require.Equal(t, defaultTimeout, c.Timeout)
+	require.Nil(t, c.Authenticator)
+}
+
+func TestClusterConfigOptions(t *testing.T) {
+	h := new(Hook)
+	h.config = &Options{
+		Hosts:       []string{"n1:9042", "n2:9042"},
+		Username:    "username",
+		Password:    "password",
+		Consistency: "one",
+		LocalDC:     "dc1",
+		Timeout:     250,
+	}
+
+	c, err := h.clusterConfig()
+	require.NoError(t, err)
+	require.Equal(t, []string{"n1:9042", "n2:9042"}, c.Hosts)
+	require.Equal(t, gocql.One, c.Consistency)
+	require.Equal(t, 250*time.Millisecond, c.Timeout)
+	require.Equal(t, 250*time.Millisecond, c.ConnectTimeout)
+	require.Equal(t, gocql.PasswordAuthenticator{Username: "username", Password: "password"}, c.Authenticator)
+	require.NotNil(t, c.PoolConfig.HostSelectionPolicy)
+}
+
+func TestClusterConfigCustom(t *testing.T) {
+	cluster := gocql.NewCluster("n1")
+	h := new(Hook)
+	h.config = &Options{Cluster: cluster, Hosts: []string{"n2"}}
+
+	c, err := h.clusterConfig()
+	require.NoError(t, err)
+	require.Same(t, cluster, c)
+}
+
+func TestSchema(t *testing.T) {
+	stmts := schema("mochi", "", 3)
+	require.Len(t, stmts, len(tables)+1)
+	require.Contains(t, stmts[0], "CREATE KEYSPACE IF NOT EXISTS mochi")
+	require.Contains(t, stmts[0], "'replication_factor': 3")
+	require.Equal(t, "CREATE TABLE IF NOT EXISTS mochi.clients (p text, k text, data blob, PRIMARY KEY (p, k))", stmts[1])
+}
+
+func TestSchemaNamespace(t *testing.T) {
+	stmts := schema("mochi", "t1", 3)
+	require.Len(t, stmts, len(tables)+1)
+	require.Equal(t, "CREATE TABLE IF NOT EXISTS mochi.t1_clients (p text, k text, data blob, PRIMARY KEY (p, k))", stmts[1])
+}
+
+func TestReadOnly(t *testing.T) {
+	h, _ := newHook(t)
+	h.config = &Options{ReadOnly: true}
+
+	require.True(t, h.Provides(mqtt.StoredClients))
+	require.False(t, h.Provides(mqtt.OnSessionEstablished))
+	require.False(t, h.Provides(mqtt.OnSysInfoTick))
+	require.ErrorIs(t, h.Import(new(bytes.Buffer)), storage.ErrReadOnly)
+}
+
+func TestStop(t *testing.T) {
+	h, d := newHook(t)
+	require.NoError(t, h.Stop())
+	require.True(t, d.closed)
+
+	h.db = nil
+	require.NoError(t, h.Stop())
+}
+
+func TestHealth(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Health(), storage.ErrDBFileNotOpen)
+
+	h, d := newHook(t)
+	require.NoError(t, h.Health())
+
+	d.err = errTest
+	require.ErrorIs(t, h.Health(), errTest)
+}
+
+func TestOnSessionEstablishedThenOnDisconnect(t *testing.T) {
+	h, d := newHook(t)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+
+	r := new(storage.Client)
+	row, err := d.get(clientsTable, client.ID, "")
+	require.NoError(t, err)
+	err = r.UnmarshalBinary(row)
+	require.NoError(t, err)
+
+	require.Equal(t, client.ID, r.ID)
+	require.Equal(t, client.Net.Remote, r.Remote)
+	require.Equal(t, client.Net.Listener, r.Listener)
+	require.Equal(t, client.Properties.Username, r.Username)
+	require.Equal(t, client.Properties.Clean, r.Clean)
+
+	h.OnDisconnect(client, nil, false)
+	row, err = d.get(clientsTable, client.ID, "")
+	require.NoError(t, err)
+	require.NotNil(t, row)
+
+	h.OnDisconnect(client, nil, true)
+	row, err = d.get(clientsTable, client.ID, "")
+	require.NoError(t, err)
+	require.Nil(t, row)
+}
+
+func TestOnDisconnectSessionTakenOver(t *testing.T) {
+	h, d := newHook(t)
+
+	cl := &mqtt.Client{ID: "test"}
+	h.OnSessionEstablished(cl, packets.Packet{})
+	cl.Stop(packets.ErrSessionTakenOver)
+
+	h.OnDisconnect(cl, nil, true)
+	row, err := d.get(clientsTable, cl.ID, "")
+	require.NoError(t, err)
+	require.NotNil(t, row)
+}
+
+func TestOnSessionEstablishedNoDB(t *testing.T) {
+	h, _ := newHook(t)
+	h.db = nil
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnDisconnect(client, nil, true)
+}
+
+func TestOnSessionEstablishedDBError(t *testing.T) {
+	h, d := newHook(t)
+	d.err = errTest
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnDisconnect(client, nil, true)
+}
+
+func TestOnWillSent(t *testing.T) {
+	h, d := newHook(t)
+
+	c1 := &mqtt.Client{ID: client.ID}
+	c1.Properties.Will.Flag = 1
+	h.OnWillSent(c1, packets.Packet{})
+
+	r := new(storage.Client)
+	row, err := d.get(clientsTable, client.ID, "")
+	require.NoError(t, err)
+	require.NoError(t, r.UnmarshalBinary(row))
+	require.Equal(t, uint32(1), r.Will.Flag)
+}
+
+func TestOnSubscribedThenOnUnsubscribed(t *testing.T) {
+	h, d := newHook(t)
+
+	h.OnSubscribed(client, pkf, []byte{0})
+
+	r := new(storage.Subscription)
+	row, err := d.get(subscriptionsTable, client.ID, "a/b/c")
+	require.NoError(t, err)
+	require.NoError(t, r.UnmarshalBinary(row))
+	require.Equal(t, client.ID, r.Client)
+	require.Equal(t, pkf.Filters[0].Filter, r.Filter)
+	require.Equal(t, byte(0), r.Qos)
+
+	h.OnUnsubscribed(client, pkf)
+	row, err = d.get(subscriptionsTable, client.ID, "a/b/c")
+	require.NoError(t, err)
+	require.Nil(t, row)
+}
+
+func TestOnSubscribedNoDB(t *testing.T) {
+	h, _ := newHook(t)
+	h.db = nil
+	h.OnSubscribed(client, pkf, []byte{0})
+	h.OnUnsubscribed(client, pkf)
+}
+
+func TestOnRetainMessageThenUnset(t *testing.T) {
+	h, d := newHook(t)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Retain: true,
+		},
+		Payload:   []byte("hello"),
+		TopicName: "a/b/c",
+	}
+
+	h.OnRetainMessage(client, pk, 1)
+
+	r := new(storage.Message)
+	row, err := d.get(retainedTable, pk.TopicName, "")
+	require.NoError(t, err)
+	require.NoError(t, r.UnmarshalBinary(row))
+	require.Equal(t, pk.TopicName, r.TopicName)
+	require.Equal(t, pk.Payload, r.Payload)
+
+	h.OnRetainMessage(client, pk, -1)
+	row, err = d.get(retainedTable, pk.TopicName, "")
+	require.NoError(t, err)
+	require.Nil(t, row)
+
+	h.OnRetainMessage(client, pk, 1)
+	h.OnRetainedExpired(pk.TopicName)
+	row, err = d.get(retainedTable, pk.TopicName, "")
+	require.NoError(t, err)
+	require.Nil(t, row)
+}
+
+func TestOnRetainMessageNoDB(t *testing.T) {
+	h, _ := newHook(t)
+	h.db = nil
+	h.OnRetainMessage(client, packets.Packet{}, 0)
+	h.OnRetainedExpired("a/b/c")
+}
+
+func TestOnQosPublishThenQOSComplete(t *testing.T) {
+	h, d := newHook(t)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Retain: true,
+			Qos:    2,
+		},
+		Payload:   []byte("hello"),
+		TopicName: "a/b/c",
+		PacketID:  7,
+	}
+
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	r := new(storage.Message)
+	row, err := d.get(inflightTable, client.ID, "7")
+	require.NoError(t, err)
+	require.NoError(t, r.UnmarshalBinary(row))
+	require.Equal(t, pk.TopicName, r.TopicName)
+	require.Equal(t, pk.Payload, r.Payload)
+	require.NotZero(t, r.Sent)
+
+	h.OnQosComplete(client, pk)
+	row, err = d.get(inflightTable, client.ID, "7")
+	require.NoError(t, err)
+	require.Nil(t, row)
+
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+	h.OnQosDropped(client, pk)
+	row, err = d.get(inflightTable, client.ID, "7")
+	require.NoError(t, err)
+	require.Nil(t, row)
+}
+
+func TestOnQosPublishNoDB(t *testing.T) {
+	h, _ := newHook(t)
+	h.db = nil
+	h.OnQosPublish(client, packets.Packet{}, time.Now().Unix(), 0)
+	h.OnQosComplete(client, packets.Packet{})
+	h.OnQosDropped(client, packets.Packet{})
+}
+
+func TestOnQueuedMessageThenResend(t *testing.T) {
+	h, _ := newHook(t)
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b/c",
+		Payload:     []byte("hello"),
+		PacketID:    7,
+	}
+	h.OnQueuedMessage(client, pk)
+
+	queued, err := h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Len(t, queued, 1)
+	require.Equal(t, storage.QueuedKey, queued[0].T)
+	require.Equal(t, uint16(7), queued[0].PacketID)
+	require.Equal(t, pk.Payload, queued[0].Payload)
+
+	inflight, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Empty(t, inflight)
+
+	// the queued message is resent as a duplicate when the client reconnects
+	pk.FixedHeader.Dup = true
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	queued, err = h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Empty(t, queued)
+
+	inflight, err = h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+	require.Equal(t, uint16(7), inflight[0].PacketID)
+}
+
+func TestOnQueuedMessageThenDropped(t *testing.T) {
+	h, _ := newHook(t)
+	pk := packets.Packet{TopicName: "a/b/c", PacketID: 7}
+	h.OnQueuedMessage(client, pk)
+	h.OnQosDropped(client, pk)
+
+	queued, err := h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Empty(t, queued)
+}
+
+func TestOnQueuedMessageNoDB(t *testing.T) {
+	h, _ := newHook(t)
+	h.db = nil
+	h.OnQueuedMessage(client, packets.Packet{})
+	v, _ := h.StoredQueuedMessages()
+	require.Empty(t, v)
+}
+
+func TestOnSysInfoTick(t *testing.T) {
+	h, _ := newHook(t)
+
+	info := &system.Info{
+		Version:       "2.0.0",
+		BytesReceived: 100,
+	}
+
+	h.OnSysInfoTick(info)
+
+	r, err := h.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, info.Version, r.Version)
+	require.Equal(t, info.BytesReceived, r.BytesReceived)
+}
+
+func TestOnSysInfoTickNoDB(t *testing.T) {
+	h, _ := newHook(t)
+	h.db = nil
+	h.OnSysInfoTick(new(system.Info))
+}
+
+func TestOnClientExpired(t *testing.T) {
+	h, d := newHook(t)
+
+	cl := &mqtt.Client{ID: "cl1"}
+	h.OnSessionEstablished(cl, packets.Packet{})
+	h.OnClientExpired(cl)
+
+	row, err := d.get(clientsTable, cl.ID, "")
+	require.NoError(t, err)
+	require.Nil(t, row)
+}
+
+func TestOnClientExpiredNoDB(t *testing.T) {
+	h, _ := newHook(t)
+	h.db = nil
+	h.OnClientExpired(client)
+}
+
+func TestStoredClients(t *testing.T) {
+	h, d := newHook(t)
+
+	h.OnSessionEstablished(&mqtt.Client{ID: "cl1"}, packets.Packet{})
+	h.OnSessionEstablished(&mqtt.Client{ID: "cl2"}, packets.Packet{})
+	require.NoError(t, d.put(clientsTable, "bad", "", []byte("{")))
+
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+	require.Equal(t, "cl1", r[0].ID)
+	require.Equal(t, "cl2", r[1].ID)
+
+	d.err = errTest
+	_, err = h.StoredClients()
+	require.ErrorIs(t, err, errTest)
+}
+
+func TestStoredSubscriptions(t *testing.T) {
+	h, d := newHook(t)
+
+	h.OnSubscribed(&mqtt.Client{ID: "cl1"}, pkf, []byte{1})
+	h.OnSubscribed(&mqtt.Client{ID: "cl2"}, pkf, []byte{2})
+	require.NoError(t, d.put(subscriptionsTable, "bad", "", []byte("{")))
+
+	r, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+	require.Equal(t, "cl1", r[0].Client)
+	require.Equal(t, byte(2), r[1].Qos)
+
+	d.err = errTest
+	_, err = h.StoredSubscriptions()
+	require.ErrorIs(t, err, errTest)
+}
+
+func TestStoredRetainedMessages(t *testing.T) {
+	h, d := newHook(t)
+
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c"}, 1)
+	h.OnRetainMessage(client, packets.Packet{TopicName: "d/e/f"}, 1)
+	require.NoError(t, d.put(retainedTable, "bad", "", []byte("{")))
+
+	r, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+	require.Equal(t, "a/b/c", r[0].TopicName)
+	require.Equal(t, "d/e/f", r[1].TopicName)
+
+	d.err = errTest
+	_, err = h.StoredRetainedMessages()
+	require.ErrorIs(t, err, errTest)
+}
+
+func TestStoredInflightMessages(t *testing.T) {
+	h, d := newHook(t)
+
+	h.OnQosPublish(client, packets.Packet{TopicName: "a/b/c", PacketID: 1}, 0, 0)
+	h.OnQosPublish(client, packets.Packet{TopicName: "d/e/f", PacketID: 2}, 0, 0)
+	require.NoError(t, d.put(inflightTable, "bad", "", []byte("{")))
+
+	r, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+	require.Equal(t, "test:1", r[0].ID)
+	require.Equal(t, "test:2", r[1].ID)
+
+	d.err = errTest
+	_, err = h.StoredInflightMessages()
+	require.ErrorIs(t, err, errTest)
+}
+
+func TestStoredInflightMessagesV5Properties(t *testing.T) {
+	h, _ := newHook(t)
+
+	pk := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:       "a/b/c",
+		Payload:         []byte("hello"),
+		PacketID:        1,
+		ProtocolVersion: 5,
+		Created:         time.Now().Unix(),
+		Expiry:          time.Now().Unix() + 30,
+		Properties: packets.Properties{
+			PayloadFormat:          1,
+			PayloadFormatFlag:      true,
+			MessageExpiryInterval:  30,
+			SubscriptionIdentifier: []int{2},
+			User:                   []packets.UserProperty{{Key: "k", Val: "v"}},
+		},
+	}
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	r, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+
+	out := r[0].ToPacket()
+	require.Equal(t, pk.Expiry, out.Expiry)
+	require.Equal(t, pk.ProtocolVersion, out.ProtocolVersion)
+	require.Equal(t, pk.Properties.PayloadFormatFlag, out.Properties.PayloadFormatFlag)
+	require.Equal(t, pk.Properties.MessageExpiryInterval, out.Properties.MessageExpiryInterval)
+	require.Equal(t, pk.Properties.SubscriptionIdentifier, out.Properties.SubscriptionIdentifier)
+	require.Equal(t, pk.Properties.User, out.Properties.User)
+}
+
+func TestStoredSysInfo(t *testing.T) {
+	h, d := newHook(t)
+
+	r, err := h.StoredSysInfo()
+	require.NoError(t, err)
+	require.Empty(t, r.Version)
+
+	p, k := sysInfoKey()
+	require.NoError(t, d.put(sysInfoTable, p, k, []byte("{")))
+	r, err = h.StoredSysInfo()
+	require.NoError(t, err)
+	require.Empty(t, r.Version)
+
+	d.err = errTest
+	_, err = h.StoredSysInfo()
+	require.ErrorIs(t, err, errTest)
+}
+
+func TestStoredSession(t *testing.T) {
+	h, _ := newHook(t)
+
+	// a client with an id prefixed by the id of the client
+	other := &mqtt.Client{ID: client.ID + ":2"}
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b/c",
+		PacketID:    7,
+	}
+	for _, cl := range []*mqtt.Client{client, other} {
+		h.OnSessionEstablished(cl, packets.Packet{})
+		h.OnSubscribed(cl, pkf, []byte{0})
+		h.OnQosPublish(cl, pk, time.Now().Unix(), 0)
+	}
+	pk.PacketID = 8
+	h.OnQueuedMessage(client, pk)
+
+	v, err := h.StoredSession(client.ID)
+	require.NoError(t, err)
+	require.Equal(t, client.ID, v.Client.ID)
+	require.Len(t, v.Subscriptions, 1)
+	require.Equal(t, "a/b/c", v.Subscriptions[0].Filter)
+	require.Len(t, v.Inflight, 1)
+	require.Equal(t, uint16(7), v.Inflight[0].PacketID)
+	require.Len(t, v.Queued, 1)
+	require.Equal(t, uint16(8), v.Queued[0].PacketID)
+
+	v, err = h.StoredSession("absent")
+	require.NoError(t, err)
+	require.Empty(t, v)
+}
+
+func TestStoredSessionNoDB(t *testing.T) {
+	h, _ := newHook(t)
+	h.db = nil
+	v, err := h.StoredSession(client.ID)
+	require.Empty(t, v)
+	require.NoError(t, err)
+}
+
+func TestStorageStats(t *testing.T) {
+	h, d := newHook(t)
+	h.db = &recordedDB{db: d, stats: &h.stats}
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	_, err := h.StoredSession("absent")
+	require.NoError(t, err)
+	h.OnClientExpired(client)
+
+	stats := h.StorageStats()
+	require.Positive(t, stats.Writes.Count)
+	require.Equal(t, int64(0), stats.Writes.Errors)
+	require.Equal(t, int64(1), stats.Reads.Count)
+	require.Equal(t, int64(0), stats.Reads.Errors) // a missing key is not a failed read
+	require.Equal(t, int64(1), stats.Deletes.Count)
+}
+
+func TestIterStored(t *testing.T) {
+	h, _ := newHook(t)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{0})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b/c",
+		PacketID:    7,
+	}
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+	pk.PacketID = 8
+	h.OnQueuedMessage(client, pk)
+
+	var got []string
+	require.NoError(t, h.IterClients(func(v storage.Client) error {
+		got = append(got, v.ID)
+		return nil
+	}))
+	require.NoError(t, h.IterSubscriptions(func(v storage.Subscription) error {
+		got = append(got, v.Filter)
+		return nil
+	}))
+	visit := func(v storage.Message) error {
+		got = append(got, v.T)
+		return nil
+	}
+	require.NoError(t, h.IterRetainedMessages(visit))
+	require.NoError(t, h.IterInflightMessages(visit))
+	require.NoError(t, h.IterQueuedMessages(visit))
+	require.Equal(t, []string{client.ID, "a/b/c", storage.RetainedKey, storage.InflightKey, storage.QueuedKey}, got)
+
+	errVisit := errors.New("visit")
+	err := h.IterClients(func(v storage.Client) error {
+		return errVisit
+	})
+	require.ErrorIs(t, err, errVisit)
+}
+
+func TestStoredNoDB(t *testing.T) {
+	h, _ := newHook(t)
+	h.db = nil
+
+	v, err := h.StoredClients()
+	require.Empty(t, v)
+	require.NoError(t, err)
+
+	v2, err := h.StoredSubscriptions()
+	require.Empty(t, v2)
+	require.NoError(t, err)
+
+	v3, err := h.StoredRetainedMessages()
+	require.Empty(t, v3)
+	require.NoError(t, err)
+
+	v4, err := h.StoredInflightMessages()
+	require.Empty(t, v4)
+	require.NoError(t, err)
+
+	v5, err := h.StoredSysInfo()
+	require.Empty(t, v5)
+	require.NoError(t, err)
+}
+
+func TestExportImport(t *testing.T) {
+	h, _ := newHook(t)
+	pk := packets.Packet{TopicName: "a/b/c", Payload: []byte("hi"), PacketID: 7}
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{1})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+	h.OnQueuedMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("later"), PacketID: 8})
+	h.OnSysInfoTick(&system.Info{Version: "2.0.0"})
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, h.Export(buf))
+
+	// records exported by other storage hooks have keys in a different format
+	buf.WriteString(`{"t":"SUB","id":"SUB_cl2:d/e","client":"cl2","filter":"d/e","qos":2}` + "\n")
+
+	h2, _ := newHook(t)
+	require.NoError(t, h2.Import(buf))
+
+	clients, err := h2.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	require.Equal(t, client.ID, clients[0].ID)
+	require.Equal(t, client.Properties.Username, clients[0].Username)
+
+	subs, err := h2.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Filter < subs[j].Filter })
+	require.Equal(t, "a/b/c", subs[0].Filter)
+	require.Equal(t, "cl2:d/e", subs[1].ID)
+	require.Equal(t, byte(2), subs[1].Qos)
+
+	retained, err := h2.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+	require.Equal(t, []byte("hello"), retained[0].Payload)
+
+	inflight, err := h2.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+	require.Equal(t, []byte("hi"), inflight[0].Payload)
+	require.Equal(t, "test:7", inflight[0].ID)
+
+	queued, err := h2.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Len(t, queued, 1)
+	require.Equal(t, []byte("later"), queued[0].Payload)
+	require.Equal(t, uint16(8), queued[0].PacketID)
+
+	sys, err := h2.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, "2.0.0", sys.Version)
+}
+
+func TestExportImportNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Export(new(bytes.Buffer)), storage.ErrDBFileNotOpen)
+	require.ErrorIs(t, h.Import(new(bytes.Buffer)), storage.ErrDBFileNotOpen)
+}
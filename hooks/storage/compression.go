@@ -0,0 +1,123 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionSnappy = "snappy" // compress payloads with snappy, which is fast but compresses less
+	CompressionZstd   = "zstd"   // compress payloads with zstd, which compresses more but is slower
+
+	// DefaultCompressionThreshold is the default minimum size of a payload in bytes before it is compressed.
+	DefaultCompressionThreshold = 1024
+)
+
+var (
+	// ErrUnknownCompression indicates a compression algorithm is not supported.
+	ErrUnknownCompression = errors.New("unknown compression algorithm")
+
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// Compression configures the compression of message payloads by a storage hook. Payloads
+// are only compressed if an algorithm is set. Compressed payloads are decompressed when
+// a message is unmarshalled, regardless of the current configuration.
+type Compression struct {
+	Algorithm string `yaml:"algorithm" json:"algorithm"` // the compression algorithm, snappy or zstd
+	Threshold int    `yaml:"threshold" json:"threshold"` // payloads smaller than this many bytes are not compressed
+}
+
+// Validate returns an error if the compression algorithm is not supported.
+func (c Compression) Validate() error {
+	switch c.Algorithm {
+	case "", CompressionSnappy, CompressionZstd:
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownCompression, c.Algorithm)
+	}
+}
+
+// CompressMessage compresses the payload of a message if it meets the size threshold, and
+// if compressing it saves space. The message is unchanged if an error is returned.
+func (c Compression) CompressMessage(m *Message) error {
+	threshold := c.Threshold
+	if threshold <= 0 {
+		threshold = DefaultCompressionThreshold
+	}
+
+	if c.Algorithm == "" || m.Compression != "" || len(m.Payload) < threshold {
+		return nil
+	}
+
+	b, err := compress(c.Algorithm, m.Payload)
+	if err != nil {
+		return err
+	}
+
+	if len(b) >= len(m.Payload) {
+		return nil
+	}
+
+	m.Payload = b
+	m.Compression = c.Algorithm
+	return nil
+}
+
+// decompressMessage decompresses the payload of a message which was compressed when stored.
+func decompressMessage(m *Message) error {
+	if m.Compression == "" {
+		return nil
+	}
+
+	b, err := decompress(m.Compression, m.Payload)
+	if err != nil {
+		return err
+	}
+
+	m.Payload = b
+	m.Compression = ""
+	return nil
+}
+
+// initZstd creates the shared zstd encoder and decoder, which are safe for concurrent use.
+func initZstd() {
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+}
+
+// compress compresses b using the given algorithm.
+func compress(algorithm string, b []byte) ([]byte, error) {
+	switch algorithm {
+	case CompressionSnappy:
+		return snappy.Encode(nil, b), nil
+	case CompressionZstd:
+		zstdOnce.Do(initZstd)
+		return zstdEncoder.EncodeAll(b, nil), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCompression, algorithm)
+	}
+}
+
+// decompress decompresses b using the given algorithm.
+func decompress(algorithm string, b []byte) ([]byte, error) {
+	switch algorithm {
+	case CompressionSnappy:
+		return snappy.Decode(nil, b)
+	case CompressionZstd:
+		zstdOnce.Do(initZstd)
+		return zstdDecoder.DecodeAll(b, nil)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCompression, algorithm)
+	}
+}
@@ -0,0 +1,86 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var compressiblePayload = bytes.Repeat([]byte("mochi"), 1000)
+
+func TestCompressionValidate(t *testing.T) {
+	require.NoError(t, Compression{}.Validate())
+	require.NoError(t, Compression{Algorithm: CompressionSnappy}.Validate())
+	require.NoError(t, Compression{Algorithm: CompressionZstd}.Validate())
+	require.ErrorIs(t, Compression{Algorithm: "lz4"}.Validate(), ErrUnknownCompression)
+}
+
+func TestCompressMessageRoundTrip(t *testing.T) {
+	for _, alg := range []string{CompressionSnappy, CompressionZstd} {
+		t.Run(alg, func(t *testing.T) {
+			m := &Message{ID: "test", Payload: compressiblePayload}
+			err := Compression{Algorithm: alg}.CompressMessage(m)
+			require.NoError(t, err)
+			require.Equal(t, alg, m.Compression)
+			require.Less(t, len(m.Payload), len(compressiblePayload))
+
+			data, err := m.MarshalBinary()
+			require.NoError(t, err)
+
+			var d Message
+			err = d.UnmarshalBinary(data)
+			require.NoError(t, err)
+			require.Equal(t, compressiblePayload, d.Payload)
+			require.Equal(t, "", d.Compression)
+		})
+	}
+}
+
+func TestCompressMessageDisabled(t *testing.T) {
+	m := &Message{Payload: compressiblePayload}
+	err := Compression{}.CompressMessage(m)
+	require.NoError(t, err)
+	require.Equal(t, compressiblePayload, m.Payload)
+	require.Equal(t, "", m.Compression)
+}
+
+func TestCompressMessageBelowThreshold(t *testing.T) {
+	m := &Message{Payload: compressiblePayload[:DefaultCompressionThreshold-1]}
+	err := Compression{Algorithm: CompressionZstd}.CompressMessage(m)
+	require.NoError(t, err)
+	require.Equal(t, "", m.Compression)
+
+	err = Compression{Algorithm: CompressionZstd, Threshold: 10}.CompressMessage(m)
+	require.NoError(t, err)
+	require.Equal(t, CompressionZstd, m.Compression)
+}
+
+func TestCompressMessageIncompressible(t *testing.T) {
+	payload := []byte("abcdefghij")
+	m := &Message{Payload: payload}
+	err := Compression{Algorithm: CompressionSnappy, Threshold: 1}.CompressMessage(m)
+	require.NoError(t, err)
+	require.Equal(t, payload, m.Payload)
+	require.Equal(t, "", m.Compression)
+}
+
+func TestCompressMessageUnknown(t *testing.T) {
+	m := &Message{Payload: compressiblePayload}
+	err := Compression{Algorithm: "lz4"}.CompressMessage(m)
+	require.ErrorIs(t, err, ErrUnknownCompression)
+	require.Equal(t, compressiblePayload, m.Payload)
+}
+
+func TestMessageUnmarshalBinaryBadCompression(t *testing.T) {
+	var d Message
+	err := d.UnmarshalBinary([]byte(`{"payload":"YWJj","compression":"lz4"}`))
+	require.ErrorIs(t, err, ErrUnknownCompression)
+
+	err = d.UnmarshalBinary([]byte(`{"payload":"YWJj","compression":"zstd"}`))
+	require.Error(t, err)
+}
@@ -0,0 +1,146 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DurabilityAlways   = "always"   // synchronize each write to disk before it returns
+	DurabilityInterval = "interval" // synchronize writes to disk periodically
+	DurabilityNone     = "none"     // leave the operating system to write to disk when it chooses
+
+	// DefaultSyncInterval is the default number of milliseconds between synchronizations under
+	// the interval policy.
+	DefaultSyncInterval = 1000
+)
+
+// ErrUnknownDurability indicates a durability policy is not supported.
+var ErrUnknownDurability = errors.New("unknown durability policy")
+
+// Durability configures when a file-based storage hook synchronizes its writes to disk. Writes
+// which have not been synchronized survive the broker crashing, but may be lost if the operating
+// system crashes or the machine loses power. If no policy is set, the default of the database
+// engine is used.
+type Durability struct {
+	Policy   string `yaml:"policy" json:"policy"`     // the durability policy, always, interval or none
+	Interval int64  `yaml:"interval" json:"interval"` // the milliseconds between synchronizations under the interval policy
+}
+
+// Validate returns an error if the durability policy is not supported.
+func (d Durability) Validate() error {
+	switch d.Policy {
+	case "", DurabilityAlways, DurabilityInterval, DurabilityNone:
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownDurability, d.Policy)
+	}
+}
+
+// SyncEach returns true if each write should be synchronized to disk before it returns.
+// If no policy is set, def is returned.
+func (d Durability) SyncEach(def bool) bool {
+	if d.Policy == "" {
+		return def
+	}
+
+	return d.Policy == DurabilityAlways
+}
+
+// SyncInterval returns the time between synchronizations under the interval policy, or 0 if
+// writes should not be synchronized periodically.
+func (d Durability) SyncInterval() time.Duration {
+	if d.Policy != DurabilityInterval {
+		return 0
+	}
+
+	if d.Interval <= 0 {
+		return DefaultSyncInterval * time.Millisecond
+	}
+
+	return time.Duration(d.Interval) * time.Millisecond
+}
+
+// Syncer periodically synchronizes a store to disk under the interval durability policy.
+type Syncer struct {
+	sync    func() error  // synchronizes the store to disk
+	done    chan struct{} // closed to stop the loop
+	stopped chan struct{} // closed when the loop has stopped
+	once    sync.Once     // ensures the loop is only stopped once
+	mu      sync.Mutex    // guards err
+	err     error         // the error of the last synchronization
+}
+
+// NewSyncer starts calling fn every interval to synchronize a store to disk. A nil Syncer is
+// returned if interval is 0, which is safe to stop.
+func NewSyncer(interval time.Duration, fn func() error) *Syncer {
+	if interval <= 0 {
+		return nil
+	}
+
+	s := &Syncer{
+		sync:    fn,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	go s.loop(interval)
+	return s
+}
+
+// loop synchronizes the store every interval until the syncer is stopped.
+func (s *Syncer) loop(interval time.Duration) {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.run()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// run synchronizes the store and records the result.
+func (s *Syncer) run() {
+	err := s.sync()
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+// Err returns the error of the last synchronization, if it failed.
+func (s *Syncer) Err() error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Stop stops the syncer and synchronizes the store a final time, returning any error.
+func (s *Syncer) Stop() error {
+	if s == nil {
+		return nil
+	}
+
+	s.once.Do(func() {
+		close(s.done)
+		<-s.stopped
+		s.run()
+	})
+
+	return s.Err()
+}
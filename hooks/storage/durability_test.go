@@ -0,0 +1,87 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDurabilityValidate(t *testing.T) {
+	require.NoError(t, Durability{}.Validate())
+	require.NoError(t, Durability{Policy: DurabilityAlways}.Validate())
+	require.NoError(t, Durability{Policy: DurabilityInterval}.Validate())
+	require.NoError(t, Durability{Policy: DurabilityNone}.Validate())
+	require.ErrorIs(t, Durability{Policy: "sometimes"}.Validate(), ErrUnknownDurability)
+}
+
+func TestDurabilitySyncEach(t *testing.T) {
+	require.True(t, Durability{}.SyncEach(true))
+	require.False(t, Durability{}.SyncEach(false))
+	require.True(t, Durability{Policy: DurabilityAlways}.SyncEach(false))
+	require.False(t, Durability{Policy: DurabilityInterval}.SyncEach(true))
+	require.False(t, Durability{Policy: DurabilityNone}.SyncEach(true))
+}
+
+func TestDurabilitySyncInterval(t *testing.T) {
+	require.Equal(t, time.Duration(0), Durability{}.SyncInterval())
+	require.Equal(t, time.Duration(0), Durability{Policy: DurabilityAlways, Interval: 10}.SyncInterval())
+	require.Equal(t, time.Duration(0), Durability{Policy: DurabilityNone}.SyncInterval())
+	require.Equal(t, DefaultSyncInterval*time.Millisecond, Durability{Policy: DurabilityInterval}.SyncInterval())
+	require.Equal(t, 10*time.Millisecond, Durability{Policy: DurabilityInterval, Interval: 10}.SyncInterval())
+}
+
+func TestSyncer(t *testing.T) {
+	var n atomic.Int64
+	s := NewSyncer(time.Millisecond, func() error {
+		n.Add(1)
+		return nil
+	})
+
+	require.Eventually(t, func() bool { return n.Load() >= 2 }, time.Second, time.Millisecond)
+	require.NoError(t, s.Err())
+	require.NoError(t, s.Stop())
+
+	stopped := n.Load()
+	require.NoError(t, s.Stop())
+	time.Sleep(5 * time.Millisecond)
+	require.Equal(t, stopped, n.Load())
+}
+
+func TestSyncerStopSyncs(t *testing.T) {
+	var n atomic.Int64
+	s := NewSyncer(time.Hour, func() error {
+		n.Add(1)
+		return nil
+	})
+
+	require.NoError(t, s.Stop())
+	require.Equal(t, int64(1), n.Load())
+}
+
+func TestSyncerError(t *testing.T) {
+	errTest := errors.New("test")
+	s := NewSyncer(time.Millisecond, func() error {
+		return errTest
+	})
+
+	require.Eventually(t, func() bool { return s.Err() != nil }, time.Second, time.Millisecond)
+	require.ErrorIs(t, s.Err(), errTest)
+	require.ErrorIs(t, s.Stop(), errTest)
+}
+
+func TestSyncerDisabled(t *testing.T) {
+	s := NewSyncer(0, func() error {
+		return errors.New("unexpected sync")
+	})
+
+	require.Nil(t, s)
+	require.NoError(t, s.Err())
+	require.NoError(t, s.Stop())
+}
@@ -0,0 +1,236 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+)
+
+const (
+	// dataKeySize is the size of the randomly generated data keys in bytes (AES-256).
+	dataKeySize = 32
+)
+
+var (
+	// ErrInvalidEncryptionKey indicates the encryption key or key callbacks are not valid.
+	ErrInvalidEncryptionKey = errors.New("invalid encryption key")
+
+	// ErrInvalidEncryptedData indicates an encrypted value is malformed.
+	ErrInvalidEncryptedData = errors.New("invalid encrypted data")
+
+	// ErrUnencryptedData indicates a stored value is not encrypted, and unencrypted values
+	// are not accepted outside of a migration.
+	ErrUnencryptedData = errors.New("unencrypted data")
+
+	// encryptedMagic prefixes encrypted values, distinguishing them from unencrypted json values.
+	encryptedMagic = []byte("MQE\x01")
+)
+
+// Encryption configures the encryption of stored values by a storage hook. Each value is
+// encrypted with AES-GCM using a randomly generated data key, and the data key is itself
+// encrypted (wrapped) with the master key, or by the WrapKey callback if an external key
+// management service is used. The wrapped data key is stored with each value, and the key
+// the value is stored under is authenticated, so values cannot be moved between keys.
+type Encryption struct {
+	// Key is the base64 encoded 16, 24 or 32 byte AES master key.
+	Key string `yaml:"key" json:"key"`
+
+	// Migrate accepts values which are not encrypted, so that encryption can be enabled on an
+	// existing store. Unencrypted values are encrypted when they are next written. Otherwise,
+	// unencrypted values are refused, so they cannot be substituted for encrypted values.
+	Migrate bool `yaml:"migrate" json:"migrate"`
+
+	// WrapKey and UnwrapKey encrypt and decrypt data keys using an external key management
+	// service, in place of Key. Both must be set.
+	WrapKey   func(key []byte) ([]byte, error)     `yaml:"-" json:"-"`
+	UnwrapKey func(wrapped []byte) ([]byte, error) `yaml:"-" json:"-"`
+}
+
+// Encryptor encrypts and decrypts stored values. A nil Encryptor returns values unchanged.
+type Encryptor struct {
+	wrap    func(key []byte) ([]byte, error)     // wraps a data key
+	unwrap  func(wrapped []byte) ([]byte, error) // unwraps a data key
+	aead    cipher.AEAD                          // the cipher for the current data key
+	wrapped []byte                               // the current data key, wrapped
+	migrate bool                                 // accept unencrypted values
+	mu      sync.RWMutex                         // protects keys
+	keys    map[string]cipher.AEAD               // ciphers for data keys unwrapped while decrypting, by wrapped key
+}
+
+// NewEncryptor returns a new Encryptor for an encryption config, generating a new data key.
+// A nil Encryptor is returned if the config is nil.
+func NewEncryptor(c *Encryption) (*Encryptor, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	e := &Encryptor{
+		wrap:    c.WrapKey,
+		unwrap:  c.UnwrapKey,
+		migrate: c.Migrate,
+		keys:    map[string]cipher.AEAD{},
+	}
+
+	if c.WrapKey != nil || c.UnwrapKey != nil {
+		if c.WrapKey == nil || c.UnwrapKey == nil {
+			return nil, fmt.Errorf("%w: both WrapKey and UnwrapKey must be set", ErrInvalidEncryptionKey)
+		}
+	} else {
+		key, err := base64.StdEncoding.DecodeString(c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidEncryptionKey, err)
+		}
+
+		master, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+
+		e.wrap = func(key []byte) ([]byte, error) {
+			return seal(master, key, nil), nil
+		}
+		e.unwrap = func(wrapped []byte) ([]byte, error) {
+			return open(master, wrapped, nil)
+		}
+	}
+
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	var err error
+	e.aead, err = newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	e.wrapped, err = e.wrap(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	if len(e.wrapped) > math.MaxUint16 {
+		return nil, fmt.Errorf("%w: wrapped data key is too long", ErrInvalidEncryptionKey)
+	}
+
+	e.keys[string(e.wrapped)] = e.aead
+	return e, nil
+}
+
+// Encrypt encrypts a value stored under key with the current data key.
+func (e *Encryptor) Encrypt(key, data []byte) ([]byte, error) {
+	if e == nil {
+		return data, nil
+	}
+
+	b := make([]byte, 0, len(encryptedMagic)+2+len(e.wrapped)+e.aead.NonceSize()+len(data)+e.aead.Overhead())
+	b = append(b, encryptedMagic...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(e.wrapped)))
+	b = append(b, e.wrapped...)
+	return append(b, seal(e.aead, data, key)...), nil
+}
+
+// Decrypt decrypts a value stored under key, encrypted with any data key which can be
+// unwrapped. Values which are not encrypted are returned unchanged if migrating, and are
+// otherwise refused.
+func (e *Encryptor) Decrypt(key, data []byte) ([]byte, error) {
+	if e == nil {
+		return data, nil
+	}
+
+	if !bytes.HasPrefix(data, encryptedMagic) {
+		if e.migrate {
+			return data, nil
+		}
+
+		return nil, ErrUnencryptedData
+	}
+
+	b := data[len(encryptedMagic):]
+	if len(b) < 2 {
+		return nil, ErrInvalidEncryptedData
+	}
+
+	n := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) < n {
+		return nil, ErrInvalidEncryptedData
+	}
+
+	aead, err := e.cipher(b[:n])
+	if err != nil {
+		return nil, err
+	}
+
+	return open(aead, b[n:], key)
+}
+
+// cipher returns the cipher for a wrapped data key, unwrapping it if it has not been seen before.
+func (e *Encryptor) cipher(wrapped []byte) (cipher.AEAD, error) {
+	e.mu.RLock()
+	aead, ok := e.keys[string(wrapped)]
+	e.mu.RUnlock()
+	if ok {
+		return aead, nil
+	}
+
+	key, err := e.unwrap(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+
+	aead, err = newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	e.keys[string(wrapped)] = aead
+	e.mu.Unlock()
+
+	return aead, nil
+}
+
+// newGCM returns an AES-GCM cipher for a key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidEncryptionKey, err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts data with a random nonce, authenticating the additional data ad, and returns
+// the nonce followed by the ciphertext.
+func seal(aead cipher.AEAD, data, ad []byte) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	_, _ = rand.Read(nonce)
+	return aead.Seal(nonce, nonce, data, ad)
+}
+
+// open decrypts data produced by seal with the same additional data.
+func open(aead cipher.AEAD, data, ad []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, ErrInvalidEncryptedData
+	}
+
+	b, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], ad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidEncryptedData, err)
+	}
+
+	return b, nil
+}
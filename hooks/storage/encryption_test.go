@@ -0,0 +1,206 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testEncryptionKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	testStorageKey    = []byte("CL_cl1")
+)
+
+func TestNewEncryptorNil(t *testing.T) {
+	e, err := NewEncryptor(nil)
+	require.NoError(t, err)
+	require.Nil(t, e)
+
+	data := []byte(`{"id":"cl1"}`)
+	b, err := e.Encrypt(testStorageKey, data)
+	require.NoError(t, err)
+	require.Equal(t, data, b)
+
+	b, err = e.Decrypt(testStorageKey, data)
+	require.NoError(t, err)
+	require.Equal(t, data, b)
+}
+
+func TestNewEncryptorBadKey(t *testing.T) {
+	_, err := NewEncryptor(&Encryption{Key: "not base64!"})
+	require.ErrorIs(t, err, ErrInvalidEncryptionKey)
+
+	_, err = NewEncryptor(&Encryption{Key: base64.StdEncoding.EncodeToString([]byte("short"))})
+	require.ErrorIs(t, err, ErrInvalidEncryptionKey)
+
+	_, err = NewEncryptor(&Encryption{})
+	require.ErrorIs(t, err, ErrInvalidEncryptionKey)
+}
+
+func TestNewEncryptorMissingCallback(t *testing.T) {
+	_, err := NewEncryptor(&Encryption{
+		WrapKey: func(key []byte) ([]byte, error) { return key, nil },
+	})
+	require.ErrorIs(t, err, ErrInvalidEncryptionKey)
+}
+
+func TestNewEncryptorWrapError(t *testing.T) {
+	_, err := NewEncryptor(&Encryption{
+		WrapKey:   func(key []byte) ([]byte, error) { return nil, errors.New("kms unavailable") },
+		UnwrapKey: func(wrapped []byte) ([]byte, error) { return wrapped, nil },
+	})
+	require.ErrorContains(t, err, "kms unavailable")
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	e, err := NewEncryptor(&Encryption{Key: testEncryptionKey})
+	require.NoError(t, err)
+
+	data := []byte(`{"id":"cl1","payload":"secret"}`)
+	b, err := e.Encrypt(testStorageKey, data)
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(b, encryptedMagic))
+	require.NotContains(t, string(b), "secret")
+
+	b2, err := e.Encrypt(testStorageKey, data)
+	require.NoError(t, err)
+	require.NotEqual(t, b, b2)
+
+	d, err := e.Decrypt(testStorageKey, b)
+	require.NoError(t, err)
+	require.Equal(t, data, d)
+}
+
+func TestDecryptOtherDataKey(t *testing.T) {
+	e1, err := NewEncryptor(&Encryption{Key: testEncryptionKey})
+	require.NoError(t, err)
+
+	e2, err := NewEncryptor(&Encryption{Key: testEncryptionKey})
+	require.NoError(t, err)
+
+	data := []byte("hello")
+	b, err := e1.Encrypt(testStorageKey, data)
+	require.NoError(t, err)
+
+	d, err := e2.Decrypt(testStorageKey, b)
+	require.NoError(t, err)
+	require.Equal(t, data, d)
+	require.Len(t, e2.keys, 2)
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	e1, err := NewEncryptor(&Encryption{Key: testEncryptionKey})
+	require.NoError(t, err)
+
+	e2, err := NewEncryptor(&Encryption{Key: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, 32))})
+	require.NoError(t, err)
+
+	b, err := e1.Encrypt(testStorageKey, []byte("hello"))
+	require.NoError(t, err)
+
+	_, err = e2.Decrypt(testStorageKey, b)
+	require.ErrorIs(t, err, ErrInvalidEncryptedData)
+}
+
+func TestDecryptOtherStorageKey(t *testing.T) {
+	e, err := NewEncryptor(&Encryption{Key: testEncryptionKey})
+	require.NoError(t, err)
+
+	b, err := e.Encrypt(testStorageKey, []byte("hello"))
+	require.NoError(t, err)
+
+	_, err = e.Decrypt([]byte("CL_cl2"), b)
+	require.ErrorIs(t, err, ErrInvalidEncryptedData)
+}
+
+func TestDecryptUnencrypted(t *testing.T) {
+	e, err := NewEncryptor(&Encryption{Key: testEncryptionKey})
+	require.NoError(t, err)
+
+	_, err = e.Decrypt(testStorageKey, []byte(`{"id":"cl1"}`))
+	require.ErrorIs(t, err, ErrUnencryptedData)
+}
+
+func TestDecryptUnencryptedMigrate(t *testing.T) {
+	e, err := NewEncryptor(&Encryption{Key: testEncryptionKey, Migrate: true})
+	require.NoError(t, err)
+
+	data := []byte(`{"id":"cl1"}`)
+	d, err := e.Decrypt(testStorageKey, data)
+	require.NoError(t, err)
+	require.Equal(t, data, d)
+}
+
+func TestDecryptMalformed(t *testing.T) {
+	e, err := NewEncryptor(&Encryption{Key: testEncryptionKey})
+	require.NoError(t, err)
+
+	b, err := e.Encrypt(testStorageKey, []byte("hello"))
+	require.NoError(t, err)
+
+	tt := [][]byte{
+		encryptedMagic,
+		append(append([]byte{}, encryptedMagic...), 0xff, 0xff),
+		b[:len(encryptedMagic)+2+len(e.wrapped)+4],
+		append(append([]byte{}, b[:len(b)-1]...), b[len(b)-1]^1),
+	}
+
+	for _, tx := range tt {
+		_, err = e.Decrypt(testStorageKey, tx)
+		require.ErrorIs(t, err, ErrInvalidEncryptedData)
+	}
+}
+
+func TestEncryptorKMSCallbacks(t *testing.T) {
+	var wraps, unwraps int
+	c := &Encryption{
+		WrapKey: func(key []byte) ([]byte, error) {
+			wraps++
+			return append([]byte("kms:"), key...), nil
+		},
+		UnwrapKey: func(wrapped []byte) ([]byte, error) {
+			unwraps++
+			return bytes.TrimPrefix(wrapped, []byte("kms:")), nil
+		},
+	}
+
+	e1, err := NewEncryptor(c)
+	require.NoError(t, err)
+	e2, err := NewEncryptor(c)
+	require.NoError(t, err)
+	require.Equal(t, 2, wraps)
+
+	b, err := e1.Encrypt(testStorageKey, []byte("hello"))
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		d, err := e2.Decrypt(testStorageKey, b)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello"), d)
+	}
+	require.Equal(t, 1, unwraps)
+}
+
+func TestEncryptorUnwrapError(t *testing.T) {
+	e1, err := NewEncryptor(&Encryption{Key: testEncryptionKey})
+	require.NoError(t, err)
+
+	e2, err := NewEncryptor(&Encryption{
+		WrapKey:   func(key []byte) ([]byte, error) { return key, nil },
+		UnwrapKey: func(wrapped []byte) ([]byte, error) { return nil, errors.New("access denied") },
+	})
+	require.NoError(t, err)
+
+	b, err := e1.Encrypt(testStorageKey, []byte("hello"))
+	require.NoError(t, err)
+
+	_, err = e2.Decrypt(testStorageKey, b)
+	require.ErrorContains(t, err, "access denied")
+}
@@ -0,0 +1,191 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidExportRecord indicates a record in an export is malformed or of an unknown type.
+	ErrInvalidExportRecord = errors.New("invalid export record")
+)
+
+// Exporter provides the stored data of a store for export. It is satisfied by each storage hook.
+type Exporter interface {
+	StoredClients() ([]Client, error)
+	StoredSubscriptions() ([]Subscription, error)
+	StoredRetainedMessages() ([]Message, error)
+	StoredInflightMessages() ([]Message, error)
+	StoredQueuedMessages() ([]Message, error)
+	StoredSysInfo() (SystemInfo, error)
+}
+
+// Export writes the system info, clients, subscriptions, retained messages, inflight messages
+// and queued messages of a store to w as JSON Lines, one record per line. The type of each
+// record is given by its t field. Unlike Backup, exports do not depend on the key format of a
+// store, so they can be imported into any storage hook. Payloads are written uncompressed and
+// unencrypted.
+func Export(w io.Writer, e Exporter) error {
+	bw := bufio.NewWriter(w)
+	write := func(v Serializable) error {
+		b, err := v.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		_, _ = bw.Write(b)
+		return bw.WriteByte('\n')
+	}
+
+	sys, err := e.StoredSysInfo()
+	if err != nil {
+		return fmt.Errorf("failed to read system info: %w", err)
+	}
+
+	if sys.ID != "" || sys.T != "" {
+		sys.T = SysInfoKey
+		if err := write(&sys); err != nil {
+			return err
+		}
+	}
+
+	clients, err := e.StoredClients()
+	if err != nil {
+		return fmt.Errorf("failed to read clients: %w", err)
+	}
+
+	for i := range clients {
+		clients[i].T = ClientKey
+		if err := write(&clients[i]); err != nil {
+			return err
+		}
+	}
+
+	subs, err := e.StoredSubscriptions()
+	if err != nil {
+		return fmt.Errorf("failed to read subscriptions: %w", err)
+	}
+
+	for i := range subs {
+		subs[i].T = SubscriptionKey
+		if err := write(&subs[i]); err != nil {
+			return err
+		}
+	}
+
+	retained, err := e.StoredRetainedMessages()
+	if err != nil {
+		return fmt.Errorf("failed to read retained messages: %w", err)
+	}
+
+	for i := range retained {
+		retained[i].T = RetainedKey
+		if err := write(&retained[i]); err != nil {
+			return err
+		}
+	}
+
+	inflight, err := e.StoredInflightMessages()
+	if err != nil {
+		return fmt.Errorf("failed to read inflight messages: %w", err)
+	}
+
+	for i := range inflight {
+		inflight[i].T = InflightKey
+		if inflight[i].PacketID == 0 {
+			inflight[i].PacketID = inflightPacketID(inflight[i].ID)
+		}
+
+		if err := write(&inflight[i]); err != nil {
+			return err
+		}
+	}
+
+	queued, err := e.StoredQueuedMessages()
+	if err != nil {
+		return fmt.Errorf("failed to read queued messages: %w", err)
+	}
+
+	for i := range queued {
+		queued[i].T = QueuedKey
+		if queued[i].PacketID == 0 {
+			queued[i].PacketID = inflightPacketID(queued[i].ID)
+		}
+
+		if err := write(&queued[i]); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Import reads records written by Export from r, and calls set with each decoded record, which
+// is one of *Client, *Subscription, *Message or *SystemInfo. The T field of a message indicates
+// whether it is a retained, inflight or queued message. The ID field of each record is the key
+// it was stored under in the exporting store, and should be replaced by the key of the importing
+// store.
+func Import(r io.Reader, set func(v Serializable) error) error {
+	dec := json.NewDecoder(r)
+	for n := 1; ; n++ {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("%w: record %d: %w", ErrInvalidExportRecord, n, err)
+		}
+
+		var head struct {
+			T string `json:"t"`
+		}
+		if err := json.Unmarshal(raw, &head); err != nil {
+			return fmt.Errorf("%w: record %d: %w", ErrInvalidExportRecord, n, err)
+		}
+
+		var v Serializable
+		switch head.T {
+		case ClientKey:
+			v = new(Client)
+		case SubscriptionKey:
+			v = new(Subscription)
+		case RetainedKey, InflightKey, QueuedKey:
+			v = new(Message)
+		case SysInfoKey:
+			v = new(SystemInfo)
+		default:
+			return fmt.Errorf("%w: record %d: unknown type %q", ErrInvalidExportRecord, n, head.T)
+		}
+
+		if err := v.UnmarshalBinary(raw); err != nil {
+			return fmt.Errorf("%w: record %d: %w", ErrInvalidExportRecord, n, err)
+		}
+
+		if err := set(v); err != nil {
+			return err
+		}
+	}
+}
+
+// inflightPacketID returns the packet id from the key of an inflight or queued message, for
+// stores which do not record the packet id separately. These keys end with :<packet id>.
+func inflightPacketID(key string) uint16 {
+	i := strings.LastIndexByte(key, ':')
+	if i < 0 {
+		return 0
+	}
+
+	id, _ := strconv.ParseUint(key[i+1:], 10, 16)
+	return uint16(id)
+}
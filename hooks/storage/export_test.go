@@ -0,0 +1,132 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/AMuzykus/mochi-mqtt-server/v2/system"
+	"github.com/stretchr/testify/require"
+)
+
+// memExporter is an in-memory Exporter implementation.
+type memExporter struct {
+	clients  []Client
+	subs     []Subscription
+	retained []Message
+	inflight []Message
+	queued   []Message
+	sys      SystemInfo
+	fail     error
+}
+
+func (m *memExporter) StoredClients() ([]Client, error)             { return m.clients, m.fail }
+func (m *memExporter) StoredSubscriptions() ([]Subscription, error) { return m.subs, nil }
+func (m *memExporter) StoredRetainedMessages() ([]Message, error)   { return m.retained, nil }
+func (m *memExporter) StoredInflightMessages() ([]Message, error)   { return m.inflight, nil }
+func (m *memExporter) StoredQueuedMessages() ([]Message, error)     { return m.queued, nil }
+func (m *memExporter) StoredSysInfo() (SystemInfo, error)           { return m.sys, nil }
+
+func TestExportImport(t *testing.T) {
+	e := &memExporter{
+		clients:  []Client{{ID: "cl1", T: ClientKey, Username: []byte("mochi")}},
+		subs:     []Subscription{{ID: "SUB_cl1:a/b", T: SubscriptionKey, Client: "cl1", Filter: "a/b", Qos: 1}},
+		retained: []Message{{ID: "RET_a/b", T: RetainedKey, TopicName: "a/b", Payload: []byte("hello")}},
+		inflight: []Message{{ID: "IFM_cl1:7", T: InflightKey, Client: "cl1", TopicName: "a/b", Payload: []byte("hi")}},
+		queued:   []Message{{ID: "QUE_cl1:8", T: QueuedKey, Client: "cl1", TopicName: "a/b", PacketID: 8}},
+		sys:      SystemInfo{ID: SysInfoKey, T: SysInfoKey, Info: system.Info{Version: "2.0.0"}},
+	}
+
+	buf := new(bytes.Buffer)
+	err := Export(buf, e)
+	require.NoError(t, err)
+	require.Len(t, strings.Split(strings.TrimSpace(buf.String()), "\n"), 6)
+
+	var got []Serializable
+	err = Import(buf, func(v Serializable) error {
+		got = append(got, v)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, got, 6)
+
+	require.Equal(t, &e.sys, got[0])
+	require.Equal(t, &e.clients[0], got[1])
+	require.Equal(t, &e.subs[0], got[2])
+	require.Equal(t, &e.retained[0], got[3])
+
+	ifm := got[4].(*Message)
+	require.Equal(t, InflightKey, ifm.T)
+	require.Equal(t, uint16(7), ifm.PacketID)
+	require.Equal(t, []byte("hi"), ifm.Payload)
+	require.Equal(t, &e.queued[0], got[5])
+}
+
+func TestExportSetsTypes(t *testing.T) {
+	e := &memExporter{
+		retained: []Message{{ID: "a/b", TopicName: "a/b"}},
+		inflight: []Message{{ID: "cl1:3", Client: "cl1", PacketID: 3}},
+		queued:   []Message{{ID: "cl1:4", Client: "cl1"}},
+	}
+
+	buf := new(bytes.Buffer)
+	err := Export(buf, e)
+	require.NoError(t, err)
+
+	var types []string
+	err = Import(buf, func(v Serializable) error {
+		types = append(types, v.(*Message).T)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{RetainedKey, InflightKey, QueuedKey}, types)
+}
+
+func TestExportDecompressesPayload(t *testing.T) {
+	m := Message{T: RetainedKey, TopicName: "a/b", Payload: bytes.Repeat([]byte("a"), 2048)}
+	err := Compression{Algorithm: CompressionSnappy}.CompressMessage(&m)
+	require.NoError(t, err)
+
+	b, err := m.MarshalBinary()
+	require.NoError(t, err)
+
+	var stored Message
+	err = stored.UnmarshalBinary(b)
+	require.NoError(t, err)
+
+	buf := new(bytes.Buffer)
+	err = Export(buf, &memExporter{retained: []Message{stored}})
+	require.NoError(t, err)
+	require.NotContains(t, buf.String(), "compression")
+}
+
+func TestExportError(t *testing.T) {
+	err := Export(new(bytes.Buffer), &memExporter{fail: errors.New("test")})
+	require.ErrorContains(t, err, "failed to read clients: test")
+}
+
+func TestImportInvalid(t *testing.T) {
+	tt := []string{
+		`{"t":"CL","id":"cl1"`,
+		`{"t":"NOPE"}`,
+		`[]`,
+		`{"t":"CL","id":1}`,
+	}
+
+	for _, tx := range tt {
+		err := Import(strings.NewReader(tx), func(v Serializable) error { return nil })
+		require.ErrorIs(t, err, ErrInvalidExportRecord, tx)
+	}
+}
+
+func TestImportSetError(t *testing.T) {
+	err := Import(strings.NewReader(`{"t":"CL","id":"cl1"}`), func(v Serializable) error {
+		return errors.New("test")
+	})
+	require.ErrorContains(t, err, "test")
+}
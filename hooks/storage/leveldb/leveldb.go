@@ -0,0 +1,980 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+// Package leveldb provides a storage hook using goleveldb, for deployments already standardized
+// on LevelDB files.
+package leveldb
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/system"
+	goleveldb "github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	// defaultDbFile is the default file path for the leveldb files.
+	defaultDbFile = ".leveldb"
+)
+
+// clientKey returns a primary key for a client.
+func clientKey(cl *mqtt.Client) string {
+	return storage.ClientKey + "_" + cl.ID
+}
+
+// subscriptionKey returns a primary key for a subscription.
+func subscriptionKey(cl *mqtt.Client, filter string) string {
+	return storage.SubscriptionKey + "_" + cl.ID + ":" + filter
+}
+
+// retainedKey returns a primary key for a retained message.
+func retainedKey(topic string) string {
+	return storage.RetainedKey + "_" + topic
+}
+
+// inflightKey returns a primary key for an inflight message.
+func inflightKey(cl *mqtt.Client, pk packets.Packet) string {
+	return storage.InflightKey + "_" + cl.ID + ":" + pk.FormatID()
+}
+
+// queuedKey returns a primary key for a message queued for a disconnected client.
+func queuedKey(cl *mqtt.Client, pk packets.Packet) string {
+	return storage.QueuedKey + "_" + cl.ID + ":" + pk.FormatID()
+}
+
+// sysInfoKey returns a primary key for system info.
+func sysInfoKey() string {
+	return storage.SysInfoKey
+}
+
+const (
+	NoSync = "NoSync" // NoSync specifies the default write options for writes which do not synchronize to disk.
+	Sync   = "Sync"   // Sync specifies the default write options for writes which synchronize to disk.
+)
+
+// Options contains configuration settings for the leveldb instance.
+type Options struct {
+	Options *opt.Options
+	Mode    string `yaml:"mode" json:"mode"`
+	Path    string `yaml:"path" json:"path"`
+
+	// Compression compresses retained and inflight message payloads above a size threshold.
+	Compression storage.Compression `yaml:"compression" json:"compression"`
+
+	// Encryption encrypts stored values with AES-GCM, if set.
+	Encryption *storage.Encryption `yaml:"encryption" json:"encryption"`
+
+	// Namespace prefixes the keys of stored values, so several brokers can share a database.
+	Namespace storage.Namespace `yaml:"namespace" json:"namespace"`
+
+	// ReadOnly opens the database read-only, so a standby broker can restore from it without
+	// writing to it. A read-only hook only provides the methods which read from the store.
+	ReadOnly bool `yaml:"read_only" json:"read_only"`
+}
+
+// Hook is a persistent storage hook using leveldb files as a backend.
+type Hook struct {
+	mqtt.HookBase
+	config *Options           // options for configuring the leveldb instance.
+	db     *goleveldb.DB      // the leveldb instance.
+	mode   *opt.WriteOptions  // the write options used for Put and Delete operations.
+	crypt  *storage.Encryptor // encrypts stored values, if encryption is enabled
+	stats  storage.Recorder   // records the reads, writes and deletes of the hook
+}
+
+// ID returns the id of the hook.
+func (h *Hook) ID() string {
+	return "leveldb"
+}
+
+// Provides indicates which hook methods this hook provides. A read-only hook only provides
+// the methods which read from the store.
+func (h *Hook) Provides(b byte) bool {
+	if bytes.Contains([]byte{
+		mqtt.StoredClients,
+		mqtt.StoredInflightMessages,
+		mqtt.StoredQueuedMessages,
+		mqtt.StoredRetainedMessages,
+		mqtt.StoredSubscriptions,
+		mqtt.StoredSysInfo,
+		mqtt.StoredSession,
+	}, []byte{b}) {
+		return true
+	}
+
+	return (h.config == nil || !h.config.ReadOnly) && bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+		mqtt.OnRetainMessage,
+		mqtt.OnWillSent,
+		mqtt.OnQosPublish,
+		mqtt.OnQosComplete,
+		mqtt.OnQosDropped,
+		mqtt.OnQueuedMessage,
+		mqtt.OnSysInfoTick,
+		mqtt.OnClientExpired,
+		mqtt.OnRetainedExpired,
+	}, []byte{b})
+}
+
+// Init initializes and opens the leveldb instance.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.config = config.(*Options)
+	if err := h.config.Compression.Validate(); err != nil {
+		return err
+	}
+
+	if err := h.config.Namespace.Validate(); err != nil {
+		return err
+	}
+
+	var err error
+	h.crypt, err = storage.NewEncryptor(h.config.Encryption)
+	if err != nil {
+		return err
+	}
+
+	if len(h.config.Path) == 0 {
+		h.config.Path = defaultDbFile
+	}
+
+	if h.config.Options == nil {
+		h.config.Options = &opt.Options{}
+	}
+
+	if h.config.ReadOnly {
+		h.config.Options.ReadOnly = true
+	}
+
+	h.mode = &opt.WriteOptions{Sync: strings.EqualFold(h.config.Mode, Sync)}
+
+	h.db, err = goleveldb.OpenFile(h.config.Path, h.config.Options)
+	if err != nil {
+		return err
+	}
+
+	if err := h.migrateSchema(); err != nil {
+		_ = h.db.Close()
+		h.db = nil
+		return err
+	}
+
+	return nil
+}
+
+// Stop closes the leveldb instance.
+func (h *Hook) Stop() error {
+	if h.db == nil {
+		return nil
+	}
+
+	err := h.db.Close()
+	h.db = nil
+	return err
+}
+
+// Health returns an error if the database is not open.
+func (h *Hook) Health() error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return nil
+}
+
+// StorageStats returns the counters and latencies of the reads, writes and deletes of the hook.
+func (h *Hook) StorageStats() storage.Stats {
+	return h.stats.Stats()
+}
+
+// Compact manually compacts the entire keyspace, which may be used to reclaim space
+// after many deletions.
+func (h *Hook) Compact() error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return h.db.CompactRange(util.Range{})
+}
+
+// OnSessionEstablished adds a client to the store when their session is established.
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// OnWillSent is called when a client sends a Will Message and the Will Message is removed from the client record.
+func (h *Hook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// updateClient writes the client data to the store.
+func (h *Hook) updateClient(cl *mqtt.Client) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := cl.Properties.Props.Copy(false)
+	in := &storage.Client{
+		ID:              cl.ID,
+		T:               storage.ClientKey,
+		Remote:          cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		Username:        cl.Properties.Username,
+		Clean:           cl.Properties.Clean,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Properties: storage.ClientProperties{
+			SessionExpiryInterval: props.SessionExpiryInterval,
+			AuthenticationMethod:  props.AuthenticationMethod,
+			AuthenticationData:    props.AuthenticationData,
+			RequestProblemInfo:    props.RequestProblemInfo,
+			RequestResponseInfo:   props.RequestResponseInfo,
+			ReceiveMaximum:        props.ReceiveMaximum,
+			TopicAliasMaximum:     props.TopicAliasMaximum,
+			User:                  props.User,
+			MaximumPacketSize:     props.MaximumPacketSize,
+		},
+		Will: storage.ClientWill(cl.Properties.Will),
+	}
+
+	_ = h.setKv(clientKey(cl), in)
+}
+
+// OnDisconnect removes a client from the store if they were using a clean session.
+func (h *Hook) OnDisconnect(cl *mqtt.Client, _ error, expire bool) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if !expire {
+		return
+	}
+
+	if cl.StopCause() == packets.ErrSessionTakenOver {
+		return
+	}
+
+	_ = h.delKv(clientKey(cl))
+}
+
+// OnSubscribed adds one or more client subscriptions to the store.
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	var in *storage.Subscription
+	for i := 0; i < len(pk.Filters); i++ {
+		in = &storage.Subscription{
+			ID:                subscriptionKey(cl, pk.Filters[i].Filter),
+			T:                 storage.SubscriptionKey,
+			Client:            cl.ID,
+			Qos:               reasonCodes[i],
+			Filter:            pk.Filters[i].Filter,
+			Identifier:        pk.Filters[i].Identifier,
+			NoLocal:           pk.Filters[i].NoLocal,
+			RetainHandling:    pk.Filters[i].RetainHandling,
+			RetainAsPublished: pk.Filters[i].RetainAsPublished,
+		}
+		_ = h.setKv(in.ID, in)
+	}
+}
+
+// OnUnsubscribed removes one or more client subscriptions from the store.
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	for i := 0; i < len(pk.Filters); i++ {
+		_ = h.delKv(subscriptionKey(cl, pk.Filters[i].Filter))
+	}
+}
+
+// OnRetainMessage adds a retained message for a topic to the store.
+func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if r == -1 {
+		_ = h.delKv(retainedKey(pk.TopicName))
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:              retainedKey(pk.TopicName),
+		T:               storage.RetainedKey,
+		FixedHeader:     pk.FixedHeader,
+		TopicName:       pk.TopicName,
+		Payload:         pk.Payload,
+		Created:         pk.Created,
+		Expiry:          pk.Expiry,
+		ProtocolVersion: pk.ProtocolVersion,
+		Client:          cl.ID,
+		Origin:          pk.Origin,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	if err := h.config.Compression.CompressMessage(in); err != nil {
+		h.Log.Error("failed to compress payload", "error", err, "key", in.ID)
+	}
+
+	_ = h.setKv(in.ID, in)
+}
+
+// OnQosPublish adds or updates an inflight message in the store.
+func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, resends int) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in := h.message(storage.InflightKey, inflightKey(cl, pk), cl, pk, sent)
+	_ = h.setKv(in.ID, in)
+
+	// queued messages are resent as duplicates once the client reconnects, and are inflight from then on.
+	if pk.FixedHeader.Dup {
+		_ = h.delKv(queuedKey(cl, pk))
+	}
+}
+
+// OnQueuedMessage adds a message queued for a disconnected client to the store.
+func (h *Hook) OnQueuedMessage(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in := h.message(storage.QueuedKey, queuedKey(cl, pk), cl, pk, 0)
+	_ = h.setKv(in.ID, in)
+}
+
+// message returns a storable inflight or queued message, compressing the payload if enabled.
+func (h *Hook) message(t, id string, cl *mqtt.Client, pk packets.Packet, sent int64) *storage.Message {
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:              id,
+		T:               t,
+		Client:          cl.ID,
+		Origin:          pk.Origin,
+		PacketID:        pk.PacketID,
+		FixedHeader:     pk.FixedHeader,
+		TopicName:       pk.TopicName,
+		Payload:         pk.Payload,
+		Sent:            sent,
+		Created:         pk.Created,
+		Expiry:          pk.Expiry,
+		ProtocolVersion: pk.ProtocolVersion,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	if err := h.config.Compression.CompressMessage(in); err != nil {
+		h.Log.Error("failed to compress payload", "error", err, "key", in.ID)
+	}
+
+	return in
+}
+
+// OnQosComplete removes a resolved inflight message from the store.
+func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	_ = h.delKv(inflightKey(cl, pk))
+}
+
+// OnQosDropped removes a dropped inflight or queued message from the store.
+func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.OnQosComplete(cl, pk)
+	_ = h.delKv(queuedKey(cl, pk))
+}
+
+// OnSysInfoTick stores the latest system info in the store.
+func (h *Hook) OnSysInfoTick(sys *system.Info) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in := &storage.SystemInfo{
+		ID:   sysInfoKey(),
+		T:    storage.SysInfoKey,
+		Info: *sys,
+	}
+
+	_ = h.setKv(in.ID, in)
+}
+
+// OnRetainedExpired deletes expired retained messages from the store.
+func (h *Hook) OnRetainedExpired(filter string) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+	_ = h.delKv(retainedKey(filter))
+}
+
+// OnClientExpired deleted expired clients from the store.
+func (h *Hook) OnClientExpired(cl *mqtt.Client) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+	_ = h.delKv(clientKey(cl))
+}
+
+// StoredClients returns all stored clients from the store.
+func (h *Hook) StoredClients() (v []storage.Client, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	err = h.iterKv(storage.ClientKey, func(value []byte) error {
+		obj := storage.Client{}
+		err = obj.UnmarshalBinary(value)
+		if err == nil {
+			v = append(v, obj)
+		}
+		return err
+	})
+	return v, nil
+}
+
+// StoredSubscriptions returns all stored subscriptions from the store.
+func (h *Hook) StoredSubscriptions() (v []storage.Subscription, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	v = make([]storage.Subscription, 0)
+	err = h.iterKv(storage.SubscriptionKey, func(value []byte) error {
+		obj := storage.Subscription{}
+		err = obj.UnmarshalBinary(value)
+		if err == nil {
+			v = append(v, obj)
+		}
+		return err
+	})
+	return
+}
+
+// StoredRetainedMessages returns all stored retained messages from the store.
+func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	v = make([]storage.Message, 0)
+	err = h.iterKv(storage.RetainedKey, func(value []byte) error {
+		obj := storage.Message{}
+		err = obj.UnmarshalBinary(value)
+		if err == nil {
+			v = append(v, obj)
+		}
+		return err
+	})
+	return
+}
+
+// StoredInflightMessages returns all stored inflight messages from the store.
+func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	v = make([]storage.Message, 0)
+	err = h.iterKv(storage.InflightKey, func(value []byte) error {
+		obj := storage.Message{}
+		err = obj.UnmarshalBinary(value)
+		if err == nil {
+			v = append(v, obj)
+		}
+		return err
+	})
+	return
+}
+
+// StoredQueuedMessages returns all messages queued for disconnected clients from the store.
+func (h *Hook) StoredQueuedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	v = make([]storage.Message, 0)
+	err = h.iterKv(storage.QueuedKey, func(value []byte) error {
+		obj := storage.Message{}
+		err = obj.UnmarshalBinary(value)
+		if err == nil {
+			v = append(v, obj)
+		}
+		return err
+	})
+	return
+}
+
+// IterClients calls fn with each stored client in the store.
+func (h *Hook) IterClients(fn func(v storage.Client) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return storage.ErrDBFileNotOpen
+	}
+
+	return h.iterKv(storage.ClientKey, func(value []byte) error {
+		obj := storage.Client{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		return fn(obj)
+	})
+}
+
+// IterSubscriptions calls fn with each stored subscription in the store.
+func (h *Hook) IterSubscriptions(fn func(v storage.Subscription) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return storage.ErrDBFileNotOpen
+	}
+
+	return h.iterKv(storage.SubscriptionKey, func(value []byte) error {
+		obj := storage.Subscription{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		return fn(obj)
+	})
+}
+
+// IterRetainedMessages calls fn with each stored retained message in the store.
+func (h *Hook) IterRetainedMessages(fn func(v storage.Message) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return storage.ErrDBFileNotOpen
+	}
+
+	return h.iterKv(storage.RetainedKey, func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		return fn(obj)
+	})
+}
+
+// IterInflightMessages calls fn with each stored inflight message in the store.
+func (h *Hook) IterInflightMessages(fn func(v storage.Message) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return storage.ErrDBFileNotOpen
+	}
+
+	return h.iterKv(storage.InflightKey, func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		return fn(obj)
+	})
+}
+
+// IterQueuedMessages calls fn with each message queued for a disconnected client in the store.
+func (h *Hook) IterQueuedMessages(fn func(v storage.Message) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return storage.ErrDBFileNotOpen
+	}
+
+	return h.iterKv(storage.QueuedKey, func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		return fn(obj)
+	})
+}
+
+// StoredSysInfo returns the system info from the store.
+func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	err = h.getKv(storage.SysInfoKey, &v)
+	if err != nil && !errors.Is(err, goleveldb.ErrNotFound) {
+		return
+	}
+
+	return v, nil
+}
+
+// StoredSession returns the stored client, subscriptions, and inflight and queued messages
+// of a single client from the store.
+func (h *Hook) StoredSession(id string) (v storage.Session, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	err = h.getKv(storage.ClientKey+"_"+id, &v.Client)
+	if errors.Is(err, goleveldb.ErrNotFound) {
+		return v, nil
+	} else if err != nil {
+		return
+	}
+
+	err = h.iterKv(storage.SubscriptionKey+"_"+id+":", func(value []byte) error {
+		obj := storage.Subscription{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		if obj.Client == id {
+			v.Subscriptions = append(v.Subscriptions, obj)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	err = h.iterKv(storage.InflightKey+"_"+id+":", func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		if obj.Client == id {
+			v.Inflight = append(v.Inflight, obj)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	err = h.iterKv(storage.QueuedKey+"_"+id+":", func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		if obj.Client == id {
+			v.Queued = append(v.Queued, obj)
+		}
+		return nil
+	})
+	return
+}
+
+// setKv stores a key-value pair in the database.
+func (h *Hook) setKv(k string, v storage.Serializable) error {
+	k = h.config.Namespace.Key(k)
+	data, _ := v.MarshalBinary()
+	data, err := h.crypt.Encrypt([]byte(k), data)
+	if err != nil {
+		h.Log.Error("failed to encrypt data", "error", err, "key", k)
+		return err
+	}
+
+	start := time.Now()
+	err = h.db.Put([]byte(k), data, h.mode)
+	h.stats.Write(start, err)
+	if err != nil {
+		h.Log.Error("failed to upsert data", "error", err, "key", k)
+	}
+	return err
+}
+
+// delKv deletes a key-value pair from the database.
+func (h *Hook) delKv(k string) error {
+	k = h.config.Namespace.Key(k)
+	start := time.Now()
+	err := h.db.Delete([]byte(k), h.mode)
+	h.stats.Delete(start, err)
+	if err != nil {
+		h.Log.Error("failed to delete data", "error", err, "key", k)
+	}
+	return err
+}
+
+// getKv retrieves the value associated with a key from the database.
+func (h *Hook) getKv(k string, v storage.Serializable) error {
+	k = h.config.Namespace.Key(k)
+	start := time.Now()
+	value, err := h.db.Get([]byte(k), nil)
+	if errors.Is(err, goleveldb.ErrNotFound) {
+		h.stats.Read(start, nil) // a missing key is not a failed read
+		return err
+	}
+
+	if err == nil {
+		err = h.unmarshal([]byte(k), value, v)
+	}
+	h.stats.Read(start, err)
+	if err != nil {
+		h.Log.Error("failed to get data", "error", err, "key", k)
+	}
+	return err
+}
+
+// iterKv iterates over the decrypted values of keys having the specified prefix in the database.
+// The iterator reads from an implicit snapshot, so visit may write to the database.
+func (h *Hook) iterKv(prefix string, visit func([]byte) error) error {
+	prefix = h.config.Namespace.Key(prefix)
+	start := time.Now()
+	iter := h.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	err := func() error {
+		defer iter.Release()
+		for iter.Next() {
+			value, err := h.crypt.Decrypt(iter.Key(), iter.Value())
+			if err != nil {
+				return err
+			}
+
+			if err := visit(bytes.Clone(value)); err != nil {
+				return err
+			}
+		}
+		return iter.Error()
+	}()
+	h.stats.Read(start, err)
+
+	if err != nil {
+		h.Log.Error("failed to iter data", "error", err, "prefix", prefix)
+	}
+	return err
+}
+
+// unmarshal decrypts a value stored under key and decodes it into v.
+func (h *Hook) unmarshal(key, data []byte, v storage.Serializable) error {
+	data, err := h.crypt.Decrypt(key, data)
+	if err != nil {
+		return err
+	}
+
+	return v.UnmarshalBinary(data)
+}
+
+// Backup writes a consistent backup of the records in the store to w.
+func (h *Hook) Backup(w io.Writer) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return storage.Backup(w, records{h: h})
+}
+
+// Restore replaces the records in the store with a backup read from r. It should be
+// called before the server is started, as restored records are only loaded on startup.
+func (h *Hook) Restore(r io.Reader) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	if h.config.ReadOnly {
+		return storage.ErrReadOnly
+	}
+
+	return storage.Restore(r, records{h: h})
+}
+
+// Export writes the clients, subscriptions, retained messages, inflight messages and
+// system info in the store to w as JSON Lines, which can be imported into any storage hook.
+func (h *Hook) Export(w io.Writer) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return storage.Export(w, h)
+}
+
+// Import adds the records of an export read from r to the store, replacing any existing
+// records with the same keys. It should be called before the server is started, as imported
+// records are only loaded on startup.
+func (h *Hook) Import(r io.Reader) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	if h.config.ReadOnly {
+		return storage.ErrReadOnly
+	}
+
+	return storage.Import(r, h.importRecord)
+}
+
+// importRecord stores an imported record under the key used by the hook.
+func (h *Hook) importRecord(v storage.Serializable) error {
+	switch v := v.(type) {
+	case *storage.Client:
+		return h.setKv(clientKey(&mqtt.Client{ID: v.ID}), v)
+	case *storage.Subscription:
+		v.ID = subscriptionKey(&mqtt.Client{ID: v.Client}, v.Filter)
+		return h.setKv(v.ID, v)
+	case *storage.Message:
+		switch v.T {
+		case storage.RetainedKey:
+			v.ID = retainedKey(v.TopicName)
+		case storage.QueuedKey:
+			v.ID = queuedKey(&mqtt.Client{ID: v.Client}, packets.Packet{PacketID: v.PacketID})
+		default:
+			v.ID = inflightKey(&mqtt.Client{ID: v.Client}, packets.Packet{PacketID: v.PacketID})
+		}
+
+		if err := h.config.Compression.CompressMessage(v); err != nil {
+			h.Log.Error("failed to compress payload", "error", err, "key", v.ID)
+		}
+		return h.setKv(v.ID, v)
+	case *storage.SystemInfo:
+		v.ID = sysInfoKey()
+		return h.setKv(v.ID, v)
+	}
+
+	return nil
+}
+
+// migrateSchema upgrades the records of the store to the current schema version. The records
+// of a read-only store are only checked, as they cannot be migrated.
+func (h *Hook) migrateSchema() error {
+	if h.config.ReadOnly {
+		_, err := storage.CheckSchema(records{h: h}, storage.Migrations, storage.SchemaVersion)
+		return err
+	}
+
+	from, err := storage.Migrate(records{h: h}, storage.Migrations, storage.SchemaVersion)
+	if err != nil {
+		return err
+	}
+
+	if from != storage.SchemaVersion {
+		h.Log.Info("migrated storage schema", "from", from, "to", storage.SchemaVersion)
+	}
+
+	return nil
+}
+
+// records provides the raw records of the store to schema migrations.
+type records struct {
+	h *Hook
+}
+
+// SchemaVersion returns the schema version of the store.
+func (r records) SchemaVersion() (int, bool, error) {
+	value, err := r.h.db.Get([]byte(r.h.config.Namespace.Key(storage.SchemaVersionKey)), nil)
+	if errors.Is(err, goleveldb.ErrNotFound) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	v, err := strconv.Atoi(string(value))
+	return v, err == nil, err
+}
+
+// SetSchemaVersion stores the schema version of the store.
+func (r records) SetSchemaVersion(v int) error {
+	return r.h.db.Put([]byte(r.h.config.Namespace.Key(storage.SchemaVersionKey)), []byte(strconv.Itoa(v)), &opt.WriteOptions{Sync: true})
+}
+
+// Each calls visit with the key, without the namespace, and decrypted value of each record
+// in the namespace, read from a consistent snapshot of the database.
+func (r records) Each(visit func(key string, value []byte) error) error {
+	snap, err := r.h.db.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	prefix := []byte(r.h.config.Namespace.Key(""))
+	iter := snap.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		if string(iter.Key()) == r.h.config.Namespace.Key(storage.SchemaVersionKey) {
+			continue
+		}
+
+		value, err := r.h.crypt.Decrypt(iter.Key(), iter.Value())
+		if err != nil {
+			return err
+		}
+
+		if err := visit(string(iter.Key()[len(prefix):]), bytes.Clone(value)); err != nil {
+			return err
+		}
+	}
+
+	return iter.Error()
+}
+
+// Set encrypts and sets the value of a record.
+func (r records) Set(key string, value []byte) error {
+	k := []byte(r.h.config.Namespace.Key(key))
+	value, err := r.h.crypt.Encrypt(k, value)
+	if err != nil {
+		return err
+	}
+
+	return r.h.db.Put(k, value, &opt.WriteOptions{Sync: true})
+}
+
+// Delete deletes a record.
+func (r records) Delete(key string) error {
+	return r.h.db.Delete([]byte(r.h.config.Namespace.Key(key)), &opt.WriteOptions{Sync: true})
+}
@@ -0,0 +1,1363 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package leveldb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/system"
+
+	"github.com/stretchr/testify/require"
+	goleveldb "github.com/syndtr/goleveldb/leveldb"
+)
+
+var (
+	logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	client = &mqtt.Client{
+		ID: "test",
+		Net: mqtt.ClientConnection{
+			Remote:   "test.addr",
+			Listener: "listener",
+		},
+		Properties: mqtt.ClientProperties{
+			Username: []byte("username"),
+			Clean:    false,
+		},
+	}
+
+	pkf = packets.Packet{Filters: packets.Subscriptions{{Filter: "a/b/c"}}}
+)
+
+func teardown(t *testing.T, path string, h *Hook) {
+	_ = h.Stop()
+	err := os.RemoveAll(path)
+	require.NoError(t, err)
+}
+
+func TestClientKey(t *testing.T) {
+	k := clientKey(&mqtt.Client{ID: "cl1"})
+	require.Equal(t, "CL_cl1", k)
+}
+
+func TestSubscriptionKey(t *testing.T) {
+	k := subscriptionKey(&mqtt.Client{ID: "cl1"}, "a/b/c")
+	require.Equal(t, storage.SubscriptionKey+"_cl1:a/b/c", k)
+}
+
+func TestRetainedKey(t *testing.T) {
+	k := retainedKey("a/b/c")
+	require.Equal(t, storage.RetainedKey+"_a/b/c", k)
+}
+
+func TestInflightKey(t *testing.T) {
+	k := inflightKey(&mqtt.Client{ID: "cl1"}, packets.Packet{PacketID: 1})
+	require.Equal(t, storage.InflightKey+"_cl1:1", k)
+}
+
+func TestSysInfoKey(t *testing.T) {
+	require.Equal(t, storage.SysInfoKey, sysInfoKey())
+}
+
+func TestID(t *testing.T) {
+	h := new(Hook)
+	require.Equal(t, "leveldb", h.ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := new(Hook)
+	require.True(t, h.Provides(mqtt.OnSessionEstablished))
+	require.True(t, h.Provides(mqtt.OnDisconnect))
+	require.True(t, h.Provides(mqtt.OnSubscribed))
+	require.True(t, h.Provides(mqtt.OnUnsubscribed))
+	require.True(t, h.Provides(mqtt.OnRetainMessage))
+	require.True(t, h.Provides(mqtt.OnQosPublish))
+	require.True(t, h.Provides(mqtt.OnQosComplete))
+	require.True(t, h.Provides(mqtt.OnQosDropped))
+	require.True(t, h.Provides(mqtt.OnSysInfoTick))
+	require.True(t, h.Provides(mqtt.StoredClients))
+	require.True(t, h.Provides(mqtt.StoredInflightMessages))
+	require.True(t, h.Provides(mqtt.StoredRetainedMessages))
+	require.True(t, h.Provides(mqtt.StoredSubscriptions))
+	require.True(t, h.Provides(mqtt.StoredSysInfo))
+	require.False(t, h.Provides(mqtt.OnACLCheck))
+	require.False(t, h.Provides(mqtt.OnConnectAuthenticate))
+}
+
+func TestInitBadConfig(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(map[string]any{})
+	require.Error(t, err)
+}
+
+func TestInitUseDefaults(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	require.Equal(t, defaultDbFile, h.config.Path)
+}
+
+func TestInitBadPath(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(path, nil, 0600))
+	err := h.Init(&Options{
+		Path: path,
+	})
+	require.Error(t, err)
+}
+
+func TestHealth(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Health(), storage.ErrDBFileNotOpen)
+
+	err := h.Init(nil)
+	require.NoError(t, err)
+	require.NoError(t, h.Health())
+
+	teardown(t, h.config.Path, h)
+	require.ErrorIs(t, h.Health(), storage.ErrDBFileNotOpen)
+}
+
+func TestOnSessionEstablishedThenOnDisconnect(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+
+	r := new(storage.Client)
+	err = h.getKv(clientKey(client), r)
+	require.NoError(t, err)
+	require.Equal(t, client.ID, r.ID)
+	require.Equal(t, client.Net.Remote, r.Remote)
+	require.Equal(t, client.Net.Listener, r.Listener)
+	require.Equal(t, client.Properties.Username, r.Username)
+	require.Equal(t, client.Properties.Clean, r.Clean)
+	require.NotSame(t, client, r)
+
+	h.OnDisconnect(client, nil, false)
+	r2 := new(storage.Client)
+	err = h.getKv(clientKey(client), r2)
+	require.NoError(t, err)
+	require.Equal(t, client.ID, r.ID)
+
+	h.OnDisconnect(client, nil, true)
+	r3 := new(storage.Client)
+	err = h.getKv(clientKey(client), r3)
+	require.Error(t, err)
+	require.ErrorIs(t, goleveldb.ErrNotFound, err)
+	require.Empty(t, r3.ID)
+}
+
+func TestOnSessionEstablishedNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnSessionEstablished(client, packets.Packet{})
+}
+
+func TestOnSessionEstablishedClosedDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	teardown(t, h.config.Path, h)
+	h.OnSessionEstablished(client, packets.Packet{})
+}
+
+func TestOnWillSent(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	c1 := client
+	c1.Properties.Will.Flag = 1
+	h.OnWillSent(c1, packets.Packet{})
+
+	r := new(storage.Client)
+	err = h.getKv(clientKey(client), r)
+	require.NoError(t, err)
+
+	require.Equal(t, uint32(1), r.Will.Flag)
+	require.NotSame(t, client, r)
+}
+
+func TestOnClientExpired(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	cl := &mqtt.Client{ID: "cl1"}
+	clientKey := clientKey(cl)
+
+	err = h.setKv(clientKey, &storage.Client{ID: cl.ID})
+	require.NoError(t, err)
+
+	r := new(storage.Client)
+	err = h.getKv(clientKey, r)
+	require.NoError(t, err)
+	require.Equal(t, cl.ID, r.ID)
+
+	h.OnClientExpired(cl)
+	err = h.getKv(clientKey, r)
+	require.Error(t, err)
+	require.ErrorIs(t, goleveldb.ErrNotFound, err)
+}
+
+func TestOnClientExpiredClosedDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	teardown(t, h.config.Path, h)
+	h.OnClientExpired(client)
+}
+
+func TestOnClientExpiredNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnClientExpired(client)
+}
+
+func TestOnDisconnectNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnDisconnect(client, nil, false)
+}
+
+func TestOnDisconnectClosedDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	teardown(t, h.config.Path, h)
+	h.OnDisconnect(client, nil, false)
+}
+
+func TestOnDisconnectSessionTakenOver(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+
+	testClient := &mqtt.Client{
+		ID: "test",
+		Net: mqtt.ClientConnection{
+			Remote:   "test.addr",
+			Listener: "listener",
+		},
+		Properties: mqtt.ClientProperties{
+			Username: []byte("username"),
+			Clean:    false,
+		},
+	}
+
+	testClient.Stop(packets.ErrSessionTakenOver)
+	teardown(t, h.config.Path, h)
+	h.OnDisconnect(testClient, nil, true)
+}
+
+func TestOnSubscribedThenOnUnsubscribed(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	h.OnSubscribed(client, pkf, []byte{0})
+	r := new(storage.Subscription)
+
+	err = h.getKv(subscriptionKey(client, pkf.Filters[0].Filter), r)
+	require.NoError(t, err)
+	require.Equal(t, client.ID, r.Client)
+	require.Equal(t, pkf.Filters[0].Filter, r.Filter)
+	require.Equal(t, byte(0), r.Qos)
+
+	h.OnUnsubscribed(client, pkf)
+	err = h.getKv(subscriptionKey(client, pkf.Filters[0].Filter), r)
+	require.Error(t, err)
+	require.Equal(t, goleveldb.ErrNotFound, err)
+}
+
+func TestOnSubscribedNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnSubscribed(client, pkf, []byte{0})
+}
+
+func TestOnSubscribedClosedDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	teardown(t, h.config.Path, h)
+	h.OnSubscribed(client, pkf, []byte{0})
+}
+
+func TestOnUnsubscribedNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnUnsubscribed(client, pkf)
+}
+
+func TestOnUnsubscribedClosedDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	teardown(t, h.config.Path, h)
+	h.OnUnsubscribed(client, pkf)
+}
+
+func TestOnRetainMessageThenUnset(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Retain: true,
+		},
+		Payload:   []byte("hello"),
+		TopicName: "a/b/c",
+	}
+
+	h.OnRetainMessage(client, pk, 1)
+
+	r := new(storage.Message)
+	err = h.getKv(retainedKey(pk.TopicName), r)
+	require.NoError(t, err)
+	require.Equal(t, pk.TopicName, r.TopicName)
+	require.Equal(t, pk.Payload, r.Payload)
+
+	h.OnRetainMessage(client, pk, -1)
+	err = h.getKv(retainedKey(pk.TopicName), r)
+	require.Error(t, err)
+	require.Equal(t, goleveldb.ErrNotFound, err)
+
+	// coverage: delete deleted
+	h.OnRetainMessage(client, pk, -1)
+	err = h.getKv(retainedKey(pk.TopicName), r)
+	require.Error(t, err)
+	require.Equal(t, goleveldb.ErrNotFound, err)
+}
+
+func TestOnRetainedExpired(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	m := &storage.Message{
+		ID:        retainedKey("a/b/c"),
+		T:         storage.RetainedKey,
+		TopicName: "a/b/c",
+	}
+
+	err = h.setKv(m.ID, m)
+	require.NoError(t, err)
+
+	r := new(storage.Message)
+	err = h.getKv(m.ID, r)
+	require.NoError(t, err)
+	require.Equal(t, m.TopicName, r.TopicName)
+
+	h.OnRetainedExpired(m.TopicName)
+	err = h.getKv(m.ID, r)
+	require.Error(t, err)
+	require.Equal(t, goleveldb.ErrNotFound, err)
+}
+
+func TestOnRetainedExpiredClosedDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	teardown(t, h.config.Path, h)
+	h.OnRetainedExpired("a/b/c")
+}
+
+func TestOnRetainedExpiredNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnRetainedExpired("a/b/c")
+}
+
+func TestOnRetainMessageNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnRetainMessage(client, packets.Packet{}, 0)
+}
+
+func TestOnRetainMessageClosedDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	teardown(t, h.config.Path, h)
+	h.OnRetainMessage(client, packets.Packet{}, 0)
+}
+
+func TestOnQosPublishThenQOSComplete(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Retain: true,
+			Qos:    2,
+		},
+		Payload:   []byte("hello"),
+		TopicName: "a/b/c",
+	}
+
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	r := new(storage.Message)
+	err = h.getKv(inflightKey(client, pk), r)
+	require.NoError(t, err)
+	require.Equal(t, pk.TopicName, r.TopicName)
+	require.Equal(t, pk.Payload, r.Payload)
+
+	// ensure dates are properly saved to leveldb
+	require.True(t, r.Sent > 0)
+	require.True(t, time.Now().Unix()-1 < r.Sent)
+
+	// OnQosDropped is a passthrough to OnQosComplete here
+	h.OnQosDropped(client, pk)
+	err = h.getKv(inflightKey(client, pk), r)
+	require.Error(t, err)
+	require.Equal(t, goleveldb.ErrNotFound, err)
+}
+
+func TestOnQosPublishNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnQosPublish(client, packets.Packet{}, time.Now().Unix(), 0)
+}
+
+func TestOnQosPublishClosedDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	teardown(t, h.config.Path, h)
+	h.OnQosPublish(client, packets.Packet{}, time.Now().Unix(), 0)
+}
+
+func TestOnQosCompleteNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnQosComplete(client, packets.Packet{})
+}
+
+func TestOnQosCompleteClosedDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	teardown(t, h.config.Path, h)
+	h.OnQosComplete(client, packets.Packet{})
+}
+
+func TestOnQosDroppedNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnQosDropped(client, packets.Packet{})
+}
+
+func TestOnQueuedMessageThenResend(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b/c",
+		Payload:     []byte("hello"),
+		PacketID:    7,
+	}
+	h.OnQueuedMessage(client, pk)
+
+	queued, err := h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Len(t, queued, 1)
+	require.Equal(t, storage.QueuedKey, queued[0].T)
+	require.Equal(t, uint16(7), queued[0].PacketID)
+	require.Equal(t, pk.Payload, queued[0].Payload)
+
+	inflight, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Empty(t, inflight)
+
+	// the queued message is resent as a duplicate when the client reconnects
+	pk.FixedHeader.Dup = true
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	queued, err = h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Empty(t, queued)
+
+	inflight, err = h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+	require.Equal(t, uint16(7), inflight[0].PacketID)
+}
+
+func TestOnQueuedMessageThenDropped(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+	pk := packets.Packet{TopicName: "a/b/c", PacketID: 7}
+	h.OnQueuedMessage(client, pk)
+	h.OnQosDropped(client, pk)
+
+	queued, err := h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Empty(t, queued)
+}
+
+func TestOnQueuedMessageNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnQueuedMessage(client, packets.Packet{})
+	v, _ := h.StoredQueuedMessages()
+	require.Empty(t, v)
+}
+
+func TestOnSysInfoTick(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	info := &system.Info{
+		Version:       "2.0.0",
+		BytesReceived: 100,
+	}
+
+	h.OnSysInfoTick(info)
+
+	r := new(storage.SystemInfo)
+	err = h.getKv(storage.SysInfoKey, r)
+	require.NoError(t, err)
+	require.Equal(t, info.Version, r.Version)
+	require.Equal(t, info.BytesReceived, r.BytesReceived)
+	require.NotSame(t, info, r)
+}
+
+func TestOnSysInfoTickNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnSysInfoTick(new(system.Info))
+}
+
+func TestOnSysInfoTickClosedDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	teardown(t, h.config.Path, h)
+	h.OnSysInfoTick(new(system.Info))
+}
+
+func TestStoredClients(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	// populate with clients
+	err = h.setKv(storage.ClientKey+"_"+"cl1", &storage.Client{ID: "cl1"})
+	require.NoError(t, err)
+
+	err = h.setKv(storage.ClientKey+"_"+"cl2", &storage.Client{ID: "cl2"})
+	require.NoError(t, err)
+
+	err = h.setKv(storage.ClientKey+"_"+"cl3", &storage.Client{ID: "cl3"})
+	require.NoError(t, err)
+
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 3)
+	require.Equal(t, "cl1", r[0].ID)
+	require.Equal(t, "cl2", r[1].ID)
+	require.Equal(t, "cl3", r[2].ID)
+}
+
+func TestStoredClientsNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	v, err := h.StoredClients()
+	require.Empty(t, v)
+	require.ErrorIs(t, storage.ErrDBFileNotOpen, err)
+}
+
+func TestStoredClientsClosedDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	teardown(t, h.config.Path, h)
+	v, err := h.StoredClients()
+	require.Empty(t, v)
+	require.ErrorIs(t, storage.ErrDBFileNotOpen, err)
+}
+
+func TestStoredSubscriptions(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	// populate with subscriptions
+	err = h.setKv(storage.SubscriptionKey+"_"+"sub1", &storage.Subscription{ID: "sub1"})
+	require.NoError(t, err)
+
+	err = h.setKv(storage.SubscriptionKey+"_"+"sub2", &storage.Subscription{ID: "sub2"})
+	require.NoError(t, err)
+
+	err = h.setKv(storage.SubscriptionKey+"_"+"sub3", &storage.Subscription{ID: "sub3"})
+	require.NoError(t, err)
+
+	r, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, r, 3)
+	require.Equal(t, "sub1", r[0].ID)
+	require.Equal(t, "sub2", r[1].ID)
+	require.Equal(t, "sub3", r[2].ID)
+}
+
+func TestStoredSubscriptionsNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	v, err := h.StoredSubscriptions()
+	require.Empty(t, v)
+	require.ErrorIs(t, storage.ErrDBFileNotOpen, err)
+}
+
+func TestStoredSubscriptionsClosedDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	teardown(t, h.config.Path, h)
+	v, err := h.StoredSubscriptions()
+	require.Empty(t, v)
+	require.ErrorIs(t, storage.ErrDBFileNotOpen, err)
+}
+
+func TestStoredRetainedMessages(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	// populate with messages
+	err = h.setKv(storage.RetainedKey+"_"+"m1", &storage.Message{ID: "m1"})
+	require.NoError(t, err)
+
+	err = h.setKv(storage.RetainedKey+"_"+"m2", &storage.Message{ID: "m2"})
+	require.NoError(t, err)
+
+	err = h.setKv(storage.RetainedKey+"_"+"m3", &storage.Message{ID: "m3"})
+	require.NoError(t, err)
+
+	err = h.setKv(storage.InflightKey+"_"+"i3", &storage.Message{ID: "i3"})
+	require.NoError(t, err)
+
+	r, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 3)
+	require.Equal(t, "m1", r[0].ID)
+	require.Equal(t, "m2", r[1].ID)
+	require.Equal(t, "m3", r[2].ID)
+}
+
+func TestStoredRetainedMessagesNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	v, err := h.StoredRetainedMessages()
+	require.Empty(t, v)
+	require.ErrorIs(t, storage.ErrDBFileNotOpen, err)
+}
+
+func TestStoredRetainedMessagesClosedDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	teardown(t, h.config.Path, h)
+	v, err := h.StoredRetainedMessages()
+	require.Empty(t, v)
+	require.Error(t, err)
+}
+
+func TestStoredInflightMessages(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	// populate with messages
+	err = h.setKv(storage.InflightKey+"_"+"i1", &storage.Message{ID: "i1"})
+	require.NoError(t, err)
+
+	err = h.setKv(storage.InflightKey+"_"+"i2", &storage.Message{ID: "i2"})
+	require.NoError(t, err)
+
+	err = h.setKv(storage.InflightKey+"_"+"i3", &storage.Message{ID: "i3"})
+	require.NoError(t, err)
+
+	err = h.setKv(storage.RetainedKey+"_"+"m1", &storage.Message{ID: "m1"})
+	require.NoError(t, err)
+
+	r, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 3)
+	require.Equal(t, "i1", r[0].ID)
+	require.Equal(t, "i2", r[1].ID)
+	require.Equal(t, "i3", r[2].ID)
+}
+
+func TestStoredInflightMessagesV5Properties(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	pk := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:       "a/b/c",
+		Payload:         []byte("hello"),
+		PacketID:        1,
+		ProtocolVersion: 5,
+		Created:         time.Now().Unix(),
+		Expiry:          time.Now().Unix() + 30,
+		Properties: packets.Properties{
+			PayloadFormat:          1,
+			PayloadFormatFlag:      true,
+			MessageExpiryInterval:  30,
+			SubscriptionIdentifier: []int{2},
+			User:                   []packets.UserProperty{{Key: "k", Val: "v"}},
+		},
+	}
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	r, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+
+	out := r[0].ToPacket()
+	require.Equal(t, pk.Expiry, out.Expiry)
+	require.Equal(t, pk.ProtocolVersion, out.ProtocolVersion)
+	require.Equal(t, pk.Properties.PayloadFormatFlag, out.Properties.PayloadFormatFlag)
+	require.Equal(t, pk.Properties.MessageExpiryInterval, out.Properties.MessageExpiryInterval)
+	require.Equal(t, pk.Properties.SubscriptionIdentifier, out.Properties.SubscriptionIdentifier)
+	require.Equal(t, pk.Properties.User, out.Properties.User)
+}
+
+func TestStoredInflightMessagesNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	v, err := h.StoredInflightMessages()
+	require.Empty(t, v)
+	require.ErrorIs(t, storage.ErrDBFileNotOpen, err)
+}
+
+func TestStoredInflightMessagesClosedDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	teardown(t, h.config.Path, h)
+	v, err := h.StoredInflightMessages()
+	require.Empty(t, v)
+	require.ErrorIs(t, storage.ErrDBFileNotOpen, err)
+}
+
+func TestStoredSysInfo(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	// populate with sys info
+	err = h.setKv(storage.SysInfoKey, &storage.SystemInfo{
+		ID: storage.SysInfoKey,
+		Info: system.Info{
+			Version: "2.0.0",
+		},
+		T: storage.SysInfoKey,
+	})
+	require.NoError(t, err)
+
+	r, err := h.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, "2.0.0", r.Info.Version)
+}
+
+func TestStoredSysInfoNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	v, err := h.StoredSysInfo()
+	require.Empty(t, v)
+	require.ErrorIs(t, storage.ErrDBFileNotOpen, err)
+}
+
+func TestStoredSysInfoClosedDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	teardown(t, h.config.Path, h)
+	v, err := h.StoredSysInfo()
+	require.Empty(t, v)
+	require.Error(t, err)
+}
+
+func TestStoredSession(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	// a client with an id prefixed by the id of the client
+	other := &mqtt.Client{ID: client.ID + ":2"}
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b/c",
+		PacketID:    7,
+	}
+	for _, cl := range []*mqtt.Client{client, other} {
+		h.OnSessionEstablished(cl, packets.Packet{})
+		h.OnSubscribed(cl, pkf, []byte{0})
+		h.OnQosPublish(cl, pk, time.Now().Unix(), 0)
+	}
+	pk.PacketID = 8
+	h.OnQueuedMessage(client, pk)
+
+	v, err := h.StoredSession(client.ID)
+	require.NoError(t, err)
+	require.Equal(t, client.ID, v.Client.ID)
+	require.Len(t, v.Subscriptions, 1)
+	require.Equal(t, "a/b/c", v.Subscriptions[0].Filter)
+	require.Len(t, v.Inflight, 1)
+	require.Equal(t, uint16(7), v.Inflight[0].PacketID)
+	require.Len(t, v.Queued, 1)
+	require.Equal(t, uint16(8), v.Queued[0].PacketID)
+
+	v, err = h.StoredSession("absent")
+	require.NoError(t, err)
+	require.Empty(t, v)
+}
+
+func TestStoredSessionNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	v, err := h.StoredSession(client.ID)
+	require.Empty(t, v)
+	require.ErrorIs(t, storage.ErrDBFileNotOpen, err)
+}
+
+func TestStorageStats(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	_, err = h.StoredSession("absent")
+	require.NoError(t, err)
+	h.OnClientExpired(client)
+
+	stats := h.StorageStats()
+	require.Positive(t, stats.Writes.Count)
+	require.Equal(t, int64(0), stats.Writes.Errors)
+	require.Equal(t, int64(1), stats.Reads.Count)
+	require.Equal(t, int64(0), stats.Reads.Errors) // a missing key is not a failed read
+	require.Equal(t, int64(1), stats.Deletes.Count)
+}
+
+func TestIterStored(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{0})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b/c",
+		PacketID:    7,
+	}
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+	pk.PacketID = 8
+	h.OnQueuedMessage(client, pk)
+
+	var got []string
+	require.NoError(t, h.IterClients(func(v storage.Client) error {
+		got = append(got, v.ID)
+		return nil
+	}))
+	require.NoError(t, h.IterSubscriptions(func(v storage.Subscription) error {
+		got = append(got, v.Filter)
+		return nil
+	}))
+	visit := func(v storage.Message) error {
+		got = append(got, v.T)
+		return nil
+	}
+	require.NoError(t, h.IterRetainedMessages(visit))
+	require.NoError(t, h.IterInflightMessages(visit))
+	require.NoError(t, h.IterQueuedMessages(visit))
+	require.Equal(t, []string{client.ID, "a/b/c", storage.RetainedKey, storage.InflightKey, storage.QueuedKey}, got)
+
+	errVisit := errors.New("visit")
+	err = h.IterClients(func(v storage.Client) error {
+		return errVisit
+	})
+	require.ErrorIs(t, err, errVisit)
+}
+
+func TestGetSetDelKv(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	defer teardown(t, h.config.Path, h)
+	require.NoError(t, err)
+
+	err = h.setKv("testId", &storage.Client{ID: "testId"})
+	require.NoError(t, err)
+
+	var obj storage.Client
+	err = h.getKv("testId", &obj)
+	require.NoError(t, err)
+
+	err = h.delKv("testId")
+	require.NoError(t, err)
+
+	err = h.getKv("testId", &obj)
+	require.Error(t, err)
+	require.ErrorIs(t, goleveldb.ErrNotFound, err)
+}
+
+func TestIterKv(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(nil)
+	defer teardown(t, h.config.Path, h)
+	require.NoError(t, err)
+
+	h.setKv("prefix_a_1", &storage.Client{ID: "1"})
+	h.setKv("prefix_a_2", &storage.Client{ID: "2"})
+	h.setKv("prefix_b_2", &storage.Client{ID: "3"})
+
+	var clients []storage.Client
+	err = h.iterKv("prefix_a", func(data []byte) error {
+		var item storage.Client
+		item.UnmarshalBinary(data)
+		clients = append(clients, item)
+		return nil
+	})
+	require.Equal(t, 2, len(clients))
+	require.NoError(t, err)
+
+	visitErr := errors.New("iter visit error")
+	err = h.iterKv("prefix_b", func(data []byte) error {
+		return visitErr
+	})
+	require.ErrorIs(t, visitErr, err)
+}
+
+func TestInitBadCompression(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Compression: storage.Compression{Algorithm: "lz4"},
+	})
+	require.ErrorIs(t, err, storage.ErrUnknownCompression)
+}
+
+func TestInitBadNamespace(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Namespace: "a:b"})
+	require.ErrorIs(t, err, storage.ErrInvalidNamespace)
+}
+
+func TestNamespace(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Namespace: "t1"})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+
+	raw, err := h.db.Get([]byte("t1:"+clientKey(client)), nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, raw)
+
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+
+	_, ok, err := records{h: h}.SchemaVersion()
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	h.config.Namespace = "t2" // another broker sharing the database
+	r, err = h.StoredClients()
+	require.NoError(t, err)
+	require.Empty(t, r)
+
+	_, ok, err = records{h: h}.SchemaVersion()
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestReadOnly(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	h.OnSessionEstablished(client, packets.Packet{})
+	require.NoError(t, h.Stop())
+
+	s := new(Hook)
+	s.SetOpts(logger, nil)
+	err = s.Init(&Options{ReadOnly: true})
+	require.NoError(t, err)
+	defer teardown(t, s.config.Path, s)
+
+	require.True(t, s.Provides(mqtt.StoredClients))
+	require.False(t, s.Provides(mqtt.OnSessionEstablished))
+	require.False(t, s.Provides(mqtt.OnSysInfoTick))
+
+	r, err := s.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, client.ID, r[0].ID)
+
+	require.ErrorIs(t, s.Restore(new(bytes.Buffer)), storage.ErrReadOnly)
+	require.ErrorIs(t, s.Import(new(bytes.Buffer)), storage.ErrReadOnly)
+}
+
+func TestOnRetainMessageCompressed(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Compression: storage.Compression{Algorithm: storage.CompressionZstd},
+	})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Retain: true, Qos: 1},
+		Payload:     bytes.Repeat([]byte("hello"), 1000),
+		TopicName:   "a/b/c",
+		PacketID:    1,
+	}
+
+	h.OnRetainMessage(client, pk, 1)
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	raw, err := h.db.Get([]byte(retainedKey(pk.TopicName)), nil)
+	require.NoError(t, err)
+	require.Contains(t, string(raw), `"compression":"zstd"`)
+
+	r, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, pk.Payload, r[0].Payload)
+
+	r, err = h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, pk.Payload, r[0].Payload)
+}
+
+func TestInitBadEncryption(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Encryption: &storage.Encryption{Key: "bad"},
+	})
+	require.ErrorIs(t, err, storage.ErrInvalidEncryptionKey)
+}
+
+func TestEncryption(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Encryption: &storage.Encryption{Key: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)), Migrate: true},
+	})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	// values stored before encryption was enabled can still be read while migrating
+	plain, err := storage.Message{ID: retainedKey("d/e/f"), T: storage.RetainedKey, TopicName: "d/e/f"}.MarshalBinary()
+	require.NoError(t, err)
+	err = h.db.Put([]byte(retainedKey("d/e/f")), plain, nil)
+	require.NoError(t, err)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Retain: true},
+		Payload:     []byte("hello"),
+		TopicName:   "a/b/c",
+	}
+	h.OnRetainMessage(client, pk, 1)
+
+	raw, err := h.db.Get([]byte(retainedKey(pk.TopicName)), nil)
+	require.NoError(t, err)
+	require.NotContains(t, string(raw), "topic_name")
+
+	r, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+	require.ElementsMatch(t, []string{"a/b/c", "d/e/f"}, []string{r[0].TopicName, r[1].TopicName})
+
+	// encrypted values cannot be moved to another key
+	err = h.db.Put([]byte(retainedKey("x/y/z")), raw, nil)
+	require.NoError(t, err)
+	require.ErrorIs(t, h.getKv(retainedKey("x/y/z"), new(storage.Message)), storage.ErrInvalidEncryptedData)
+
+	// unencrypted values are refused once the store has been migrated
+	h.crypt, err = storage.NewEncryptor(&storage.Encryption{Key: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))})
+	require.NoError(t, err)
+	require.ErrorIs(t, h.getKv(retainedKey("d/e/f"), new(storage.Message)), storage.ErrUnencryptedData)
+}
+
+func TestInitSchemaVersion(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	v, ok, err := records{h: h}.SchemaVersion()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, storage.SchemaVersion, v)
+}
+
+func TestInitNewerSchemaVersion(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	require.NoError(t, records{h: h}.SetSchemaVersion(storage.SchemaVersion+1))
+	require.NoError(t, h.Stop())
+
+	h = new(Hook)
+	h.SetOpts(logger, nil)
+	err = h.Init(nil)
+	require.ErrorIs(t, err, storage.ErrNewerSchemaVersion)
+	require.NoError(t, os.RemoveAll(defaultDbFile))
+}
+
+func TestInitMigratesSchema(t *testing.T) {
+	migrations := storage.Migrations
+	defer func() {
+		storage.Migrations = migrations
+	}()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	h.OnSessionEstablished(&mqtt.Client{ID: "cl1", Net: mqtt.ClientConnection{Remote: "old"}}, packets.Packet{})
+	require.NoError(t, records{h: h}.Delete(storage.SchemaVersionKey)) // an unversioned store
+	require.NoError(t, h.Stop())
+
+	storage.Migrations = []storage.Migration{
+		{
+			Version: storage.SchemaVersion,
+			Upgrade: func(key string, value []byte) ([]byte, error) {
+				return bytes.Replace(value, []byte(`"old"`), []byte(`"new"`), 1), nil
+			},
+		},
+	}
+
+	h = new(Hook)
+	h.SetOpts(logger, nil)
+	err = h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, "new", r[0].Remote)
+
+	v, ok, err := records{h: h}.SchemaVersion()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, storage.SchemaVersion, v)
+}
+
+func TestBackupRestore(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{0})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, h.Backup(buf))
+
+	// changes made after the backup are discarded by the restore
+	h.OnSessionEstablished(&mqtt.Client{ID: "cl2"}, packets.Packet{})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c"}, -1)
+
+	require.NoError(t, h.Restore(buf))
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	require.Equal(t, client.ID, clients[0].ID)
+
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+
+	retained, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+	require.Equal(t, []byte("hello"), retained[0].Payload)
+
+	v, ok, err := records{h: h}.SchemaVersion()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, storage.SchemaVersion, v)
+}
+
+func TestBackupRestoreNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Backup(new(bytes.Buffer)), storage.ErrDBFileNotOpen)
+	require.ErrorIs(t, h.Restore(new(bytes.Buffer)), storage.ErrDBFileNotOpen)
+}
+
+func TestExportImport(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+	pk := packets.Packet{TopicName: "a/b/c", Payload: []byte("hi"), PacketID: 7}
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{1})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+	h.OnQueuedMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("later"), PacketID: 8})
+	h.OnSysInfoTick(&system.Info{Version: "2.0.0"})
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, h.Export(buf))
+
+	// records exported by other storage hooks have keys in a different format
+	buf.WriteString(`{"t":"SUB","id":"SUB_cl2:d/e","client":"cl2","filter":"d/e","qos":2}` + "\n")
+
+	h2 := new(Hook)
+	h2.SetOpts(logger, nil)
+	err = h2.Init(&Options{Path: filepath.Join(t.TempDir(), "import.db")})
+	require.NoError(t, err)
+	defer h2.Stop()
+	require.NoError(t, h2.Import(buf))
+
+	clients, err := h2.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	require.Equal(t, client.ID, clients[0].ID)
+	require.Equal(t, client.Properties.Username, clients[0].Username)
+
+	subs, err := h2.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Filter < subs[j].Filter })
+	require.Equal(t, "a/b/c", subs[0].Filter)
+	require.Equal(t, subscriptionKey(&mqtt.Client{ID: "cl2"}, "d/e"), subs[1].ID)
+	require.Equal(t, byte(2), subs[1].Qos)
+
+	retained, err := h2.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+	require.Equal(t, []byte("hello"), retained[0].Payload)
+
+	inflight, err := h2.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+	require.Equal(t, []byte("hi"), inflight[0].Payload)
+	require.Equal(t, inflightKey(client, pk), inflight[0].ID)
+
+	queued, err := h2.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Len(t, queued, 1)
+	require.Equal(t, []byte("later"), queued[0].Payload)
+	require.Equal(t, uint16(8), queued[0].PacketID)
+
+	sys, err := h2.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, "2.0.0", sys.Version)
+}
+
+func TestExportImportNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Export(new(bytes.Buffer)), storage.ErrDBFileNotOpen)
+	require.ErrorIs(t, h.Import(new(bytes.Buffer)), storage.ErrDBFileNotOpen)
+}
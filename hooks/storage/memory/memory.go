@@ -0,0 +1,871 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+// Package memory provides a lightweight storage hook which keeps stored values in memory and
+// periodically writes them to a snapshot file, for devices where a full database is not needed
+// but sessions and retained messages should survive a restart.
+package memory
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/system"
+)
+
+var (
+	ErrKeyNotFound = errors.New("key not found")
+)
+
+const (
+	// defaultPath is the default file path for the snapshot file.
+	defaultPath = ".memory"
+
+	// defaultSnapshotInterval is the default number of seconds between snapshots.
+	defaultSnapshotInterval = 60
+)
+
+// clientKey returns a primary key for a client.
+func clientKey(cl *mqtt.Client) string {
+	return storage.ClientKey + "_" + cl.ID
+}
+
+// subscriptionKey returns a primary key for a subscription.
+func subscriptionKey(cl *mqtt.Client, filter string) string {
+	return storage.SubscriptionKey + "_" + cl.ID + ":" + filter
+}
+
+// retainedKey returns a primary key for a retained message.
+func retainedKey(topic string) string {
+	return storage.RetainedKey + "_" + topic
+}
+
+// inflightKey returns a primary key for an inflight message.
+func inflightKey(cl *mqtt.Client, pk packets.Packet) string {
+	return storage.InflightKey + "_" + cl.ID + ":" + pk.FormatID()
+}
+
+// queuedKey returns a primary key for a message queued for a disconnected client.
+func queuedKey(cl *mqtt.Client, pk packets.Packet) string {
+	return storage.QueuedKey + "_" + cl.ID + ":" + pk.FormatID()
+}
+
+// sysInfoKey returns a primary key for system info.
+func sysInfoKey() string {
+	return storage.SysInfoKey
+}
+
+// Options contains configuration settings for the memory store.
+type Options struct {
+	// Path is the snapshot file the store is restored from on start, and written to
+	// periodically and when the hook is stopped.
+	Path string `yaml:"path" json:"path"`
+
+	// SnapshotInterval is the seconds between snapshots (default 60). A snapshot is only
+	// written if the store has changed since the last one. A negative interval disables
+	// periodic snapshots, so the store is only written when the hook is stopped.
+	SnapshotInterval int64 `yaml:"snapshot_interval" json:"snapshot_interval"`
+
+	// Compression compresses retained and inflight message payloads above a size threshold.
+	Compression storage.Compression `yaml:"compression" json:"compression"`
+}
+
+// Hook is a persistent storage hook which keeps stored values in memory, and snapshots them to a file.
+type Hook struct {
+	mqtt.HookBase
+	config  *Options          // options for configuring the memory store.
+	mu      sync.RWMutex      // guards data and changes.
+	data    map[string][]byte // the stored values, keyed by primary key.
+	changes uint64            // the number of writes and deletes made to the store.
+	saved   uint64            // the number of changes written in the last snapshot.
+	snapMu  sync.Mutex        // serializes snapshots.
+	snapErr error             // the error of the last snapshot, if it failed.
+	done    chan struct{}     // closed to stop the snapshot loop.
+	stopped chan struct{}     // closed when the snapshot loop has stopped.
+	stats   storage.Recorder  // records the reads, writes and deletes of the hook
+}
+
+// ID returns the id of the hook.
+func (h *Hook) ID() string {
+	return "memory-db"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+		mqtt.OnRetainMessage,
+		mqtt.OnWillSent,
+		mqtt.OnQosPublish,
+		mqtt.OnQosComplete,
+		mqtt.OnQosDropped,
+		mqtt.OnQueuedMessage,
+		mqtt.OnSysInfoTick,
+		mqtt.OnClientExpired,
+		mqtt.OnRetainedExpired,
+		mqtt.StoredClients,
+		mqtt.StoredInflightMessages,
+		mqtt.StoredQueuedMessages,
+		mqtt.StoredRetainedMessages,
+		mqtt.StoredSubscriptions,
+		mqtt.StoredSysInfo,
+		mqtt.StoredSession,
+	}, []byte{b})
+}
+
+// Init restores the store from the snapshot file, if it exists, and starts taking snapshots.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.config = config.(*Options)
+	if err := h.config.Compression.Validate(); err != nil {
+		return err
+	}
+
+	if len(h.config.Path) == 0 {
+		h.config.Path = defaultPath
+	}
+
+	if h.config.SnapshotInterval == 0 {
+		h.config.SnapshotInterval = defaultSnapshotInterval
+	}
+
+	h.data = make(map[string][]byte)
+	if err := h.load(); err != nil {
+		h.data = nil
+		return err
+	}
+
+	if h.config.SnapshotInterval > 0 {
+		h.done = make(chan struct{})
+		h.stopped = make(chan struct{})
+		go h.snapshotLoop(time.Duration(h.config.SnapshotInterval) * time.Second)
+	}
+
+	return nil
+}
+
+// load restores the store from the snapshot file, and migrates it to the current schema version.
+func (h *Hook) load() error {
+	f, err := os.Open(h.config.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, err = storage.Migrate(records{h: h}, storage.Migrations, storage.SchemaVersion)
+		return err
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := storage.Restore(f, records{h: h}); err != nil {
+		return err
+	}
+
+	h.saved = h.changes
+	return nil
+}
+
+// snapshotLoop writes a snapshot of the store every interval, if it has changed.
+func (h *Hook) snapshotLoop(interval time.Duration) {
+	defer close(h.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := h.snapshotChanges(); err != nil {
+				h.Log.Error("failed to write snapshot", "error", err, "path", h.config.Path)
+			}
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// Stop stops taking snapshots, and writes a final snapshot of the store.
+func (h *Hook) Stop() error {
+	if h.done != nil {
+		close(h.done)
+		<-h.stopped
+		h.done = nil
+	}
+
+	if h.data == nil {
+		return nil
+	}
+
+	err := h.snapshotChanges()
+	h.mu.Lock()
+	h.data = nil
+	h.mu.Unlock()
+	return err
+}
+
+// Health returns an error if the store is not open, or the last snapshot failed.
+func (h *Hook) Health() error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.data == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return h.snapErr
+}
+
+// isOpen returns true if the store is open.
+func (h *Hook) isOpen() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.data != nil
+}
+
+// StorageStats returns the counters and latencies of the reads, writes and deletes of the hook.
+func (h *Hook) StorageStats() storage.Stats {
+	return h.stats.Stats()
+}
+
+// Snapshot atomically writes the store to the snapshot file, by writing a temporary file and
+// renaming it over the previous snapshot.
+func (h *Hook) Snapshot() error {
+	h.snapMu.Lock()
+	defer h.snapMu.Unlock()
+
+	h.mu.RLock()
+	if h.data == nil {
+		h.mu.RUnlock()
+		return storage.ErrDBFileNotOpen
+	}
+	changes := h.changes
+	h.mu.RUnlock()
+
+	err := h.writeSnapshot()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.snapErr = err
+	if err == nil {
+		h.saved = changes
+	}
+
+	return err
+}
+
+// snapshotChanges writes a snapshot of the store, if it has changed since the last snapshot.
+func (h *Hook) snapshotChanges() error {
+	h.mu.RLock()
+	changed := h.changes != h.saved
+	h.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+
+	return h.Snapshot()
+}
+
+// writeSnapshot writes the store to a temporary file, and renames it to the snapshot file.
+func (h *Hook) writeSnapshot() error {
+	tmp := h.config.Path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = storage.Backup(f, records{h: h})
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, h.config.Path)
+}
+
+// OnSessionEstablished adds a client to the store when their session is established.
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// OnWillSent is called when a client sends a Will Message and the Will Message is removed from the client record.
+func (h *Hook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// updateClient writes the client data to the store.
+func (h *Hook) updateClient(cl *mqtt.Client) {
+	props := cl.Properties.Props.Copy(false)
+	in := &storage.Client{
+		ID:              cl.ID,
+		T:               storage.ClientKey,
+		Remote:          cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		Username:        cl.Properties.Username,
+		Clean:           cl.Properties.Clean,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Properties: storage.ClientProperties{
+			SessionExpiryInterval: props.SessionExpiryInterval,
+			AuthenticationMethod:  props.AuthenticationMethod,
+			AuthenticationData:    props.AuthenticationData,
+			RequestProblemInfo:    props.RequestProblemInfo,
+			RequestResponseInfo:   props.RequestResponseInfo,
+			ReceiveMaximum:        props.ReceiveMaximum,
+			TopicAliasMaximum:     props.TopicAliasMaximum,
+			User:                  props.User,
+			MaximumPacketSize:     props.MaximumPacketSize,
+		},
+		Will: storage.ClientWill(cl.Properties.Will),
+	}
+
+	_ = h.setKv(clientKey(cl), in)
+}
+
+// OnDisconnect removes a client from the store if they were using a clean session.
+func (h *Hook) OnDisconnect(cl *mqtt.Client, _ error, expire bool) {
+	if !expire {
+		return
+	}
+
+	if cl.StopCause() == packets.ErrSessionTakenOver {
+		return
+	}
+
+	_ = h.delKv(clientKey(cl))
+}
+
+// OnSubscribed adds one or more client subscriptions to the store.
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	var in *storage.Subscription
+	for i := 0; i < len(pk.Filters); i++ {
+		in = &storage.Subscription{
+			ID:                subscriptionKey(cl, pk.Filters[i].Filter),
+			T:                 storage.SubscriptionKey,
+			Client:            cl.ID,
+			Qos:               reasonCodes[i],
+			Filter:            pk.Filters[i].Filter,
+			Identifier:        pk.Filters[i].Identifier,
+			NoLocal:           pk.Filters[i].NoLocal,
+			RetainHandling:    pk.Filters[i].RetainHandling,
+			RetainAsPublished: pk.Filters[i].RetainAsPublished,
+		}
+		_ = h.setKv(in.ID, in)
+	}
+}
+
+// OnUnsubscribed removes one or more client subscriptions from the store.
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	for i := 0; i < len(pk.Filters); i++ {
+		_ = h.delKv(subscriptionKey(cl, pk.Filters[i].Filter))
+	}
+}
+
+// OnRetainMessage adds a retained message for a topic to the store.
+func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	if r == -1 {
+		_ = h.delKv(retainedKey(pk.TopicName))
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:              retainedKey(pk.TopicName),
+		T:               storage.RetainedKey,
+		FixedHeader:     pk.FixedHeader,
+		TopicName:       pk.TopicName,
+		Payload:         pk.Payload,
+		Created:         pk.Created,
+		Expiry:          pk.Expiry,
+		ProtocolVersion: pk.ProtocolVersion,
+		Client:          cl.ID,
+		Origin:          pk.Origin,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	if err := h.config.Compression.CompressMessage(in); err != nil {
+		h.Log.Error("failed to compress payload", "error", err, "key", in.ID)
+	}
+
+	_ = h.setKv(in.ID, in)
+}
+
+// OnQosPublish adds or updates an inflight message in the store.
+func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, resends int) {
+	in := h.message(storage.InflightKey, inflightKey(cl, pk), cl, pk, sent)
+	_ = h.setKv(in.ID, in)
+
+	// queued messages are resent as duplicates once the client reconnects, and are inflight from then on.
+	if pk.FixedHeader.Dup {
+		_ = h.delKv(queuedKey(cl, pk))
+	}
+}
+
+// OnQueuedMessage adds a message queued for a disconnected client to the store.
+func (h *Hook) OnQueuedMessage(cl *mqtt.Client, pk packets.Packet) {
+	in := h.message(storage.QueuedKey, queuedKey(cl, pk), cl, pk, 0)
+	_ = h.setKv(in.ID, in)
+}
+
+// message returns a storable inflight or queued message, compressing the payload if enabled.
+func (h *Hook) message(t, id string, cl *mqtt.Client, pk packets.Packet, sent int64) *storage.Message {
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:              id,
+		T:               t,
+		Client:          cl.ID,
+		Origin:          pk.Origin,
+		PacketID:        pk.PacketID,
+		FixedHeader:     pk.FixedHeader,
+		TopicName:       pk.TopicName,
+		Payload:         pk.Payload,
+		Sent:            sent,
+		Created:         pk.Created,
+		Expiry:          pk.Expiry,
+		ProtocolVersion: pk.ProtocolVersion,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	if err := h.config.Compression.CompressMessage(in); err != nil {
+		h.Log.Error("failed to compress payload", "error", err, "key", in.ID)
+	}
+
+	return in
+}
+
+// OnQosComplete removes a resolved inflight message from the store.
+func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
+	_ = h.delKv(inflightKey(cl, pk))
+}
+
+// OnQosDropped removes a dropped inflight or queued message from the store.
+func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	h.OnQosComplete(cl, pk)
+	_ = h.delKv(queuedKey(cl, pk))
+}
+
+// OnSysInfoTick stores the latest system info in the store.
+func (h *Hook) OnSysInfoTick(sys *system.Info) {
+	in := &storage.SystemInfo{
+		ID:   sysInfoKey(),
+		T:    storage.SysInfoKey,
+		Info: *sys,
+	}
+
+	_ = h.setKv(in.ID, in)
+}
+
+// OnRetainedExpired deletes expired retained messages from the store.
+func (h *Hook) OnRetainedExpired(filter string) {
+	_ = h.delKv(retainedKey(filter))
+}
+
+// OnClientExpired deleted expired clients from the store.
+func (h *Hook) OnClientExpired(cl *mqtt.Client) {
+	_ = h.delKv(clientKey(cl))
+}
+
+// StoredClients returns all stored clients from the store.
+func (h *Hook) StoredClients() (v []storage.Client, err error) {
+	err = h.iterKv(storage.ClientKey+"_", func(value []byte) error {
+		obj := storage.Client{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		v = append(v, obj)
+		return nil
+	})
+	return
+}
+
+// StoredSubscriptions returns all stored subscriptions from the store.
+func (h *Hook) StoredSubscriptions() (v []storage.Subscription, err error) {
+	v = make([]storage.Subscription, 0)
+	err = h.iterKv(storage.SubscriptionKey+"_", func(value []byte) error {
+		obj := storage.Subscription{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		v = append(v, obj)
+		return nil
+	})
+	return
+}
+
+// StoredRetainedMessages returns all stored retained messages from the store.
+func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
+	return h.storedMessages(storage.RetainedKey)
+}
+
+// StoredInflightMessages returns all stored inflight messages from the store.
+func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
+	return h.storedMessages(storage.InflightKey)
+}
+
+// StoredQueuedMessages returns all messages queued for disconnected clients from the store.
+func (h *Hook) StoredQueuedMessages() (v []storage.Message, err error) {
+	return h.storedMessages(storage.QueuedKey)
+}
+
+// storedMessages returns all stored messages of type t from the store.
+func (h *Hook) storedMessages(t string) (v []storage.Message, err error) {
+	v = make([]storage.Message, 0)
+	err = h.iterKv(t+"_", func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		v = append(v, obj)
+		return nil
+	})
+	return
+}
+
+// StoredSysInfo returns the system info from the store.
+func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
+	err = h.getKv(sysInfoKey(), &v)
+	if errors.Is(err, ErrKeyNotFound) {
+		return v, nil
+	}
+
+	return
+}
+
+// StoredSession returns the stored client, subscriptions, and inflight and queued messages
+// of a single client from the store.
+func (h *Hook) StoredSession(id string) (v storage.Session, err error) {
+	err = h.getKv(storage.ClientKey+"_"+id, &v.Client)
+	if errors.Is(err, ErrKeyNotFound) {
+		return v, nil
+	} else if err != nil {
+		return
+	}
+
+	err = h.iterKv(storage.SubscriptionKey+"_"+id+":", func(value []byte) error {
+		obj := storage.Subscription{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		if obj.Client == id {
+			v.Subscriptions = append(v.Subscriptions, obj)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	err = h.iterKv(storage.InflightKey+"_"+id+":", func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		if obj.Client == id {
+			v.Inflight = append(v.Inflight, obj)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	err = h.iterKv(storage.QueuedKey+"_"+id+":", func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		if obj.Client == id {
+			v.Queued = append(v.Queued, obj)
+		}
+		return nil
+	})
+	return
+}
+
+// setKv stores a key-value pair in the store.
+func (h *Hook) setKv(k string, v storage.Serializable) error {
+	start := time.Now()
+	data, err := v.MarshalBinary()
+	if err != nil {
+		h.stats.Write(start, err)
+		h.Log.Error("failed to marshal data", "error", err, "key", k)
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.data == nil {
+		h.stats.Write(start, storage.ErrDBFileNotOpen)
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return storage.ErrDBFileNotOpen
+	}
+
+	h.data[k] = data
+	h.changes++
+	h.stats.Write(start, nil)
+	return nil
+}
+
+// delKv deletes a key-value pair from the store.
+func (h *Hook) delKv(k string) error {
+	start := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.data == nil {
+		h.stats.Delete(start, storage.ErrDBFileNotOpen)
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return storage.ErrDBFileNotOpen
+	}
+
+	if _, ok := h.data[k]; ok {
+		delete(h.data, k)
+		h.changes++
+	}
+	h.stats.Delete(start, nil)
+	return nil
+}
+
+// getKv retrieves the value associated with a key from the store.
+func (h *Hook) getKv(k string, v storage.Serializable) error {
+	start := time.Now()
+	h.mu.RLock()
+	if h.data == nil {
+		h.mu.RUnlock()
+		h.stats.Read(start, storage.ErrDBFileNotOpen)
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return storage.ErrDBFileNotOpen
+	}
+	value, ok := h.data[k]
+	h.mu.RUnlock()
+	h.stats.Read(start, nil) // a missing key is not a failed read
+
+	if !ok {
+		return ErrKeyNotFound
+	}
+
+	return v.UnmarshalBinary(value)
+}
+
+// iterKv calls visit with the value of each key having the specified prefix in the store, in key
+// order. Values are visited outside of the lock, so visit may write to the store.
+func (h *Hook) iterKv(prefix string, visit func([]byte) error) error {
+	start := time.Now()
+	keys, values, err := h.match(prefix)
+	h.stats.Read(start, err)
+	if err != nil {
+		h.Log.Error("", "error", err)
+		return err
+	}
+
+	for i := range keys {
+		if err := visit(values[i]); err != nil {
+			h.Log.Error("failed to iter data", "error", err, "prefix", prefix)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// match returns the sorted keys having the specified prefix in the store, and their values.
+func (h *Hook) match(prefix string) (keys []string, values [][]byte, err error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.data == nil {
+		return nil, nil, storage.ErrDBFileNotOpen
+	}
+
+	for k := range h.data {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	values = make([][]byte, len(keys))
+	for i, k := range keys {
+		values[i] = h.data[k] // stored values are replaced rather than modified, so may be shared
+	}
+
+	return keys, values, nil
+}
+
+// Backup writes a consistent backup of the records in the store to w.
+func (h *Hook) Backup(w io.Writer) error {
+	if !h.isOpen() {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return storage.Backup(w, records{h: h})
+}
+
+// Restore replaces the records in the store with a backup read from r. It should be
+// called before the server is started, as restored records are only loaded on startup.
+func (h *Hook) Restore(r io.Reader) error {
+	if !h.isOpen() {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return storage.Restore(r, records{h: h})
+}
+
+// Export writes the clients, subscriptions, retained messages, inflight messages and
+// system info in the store to w as JSON Lines, which can be imported into any storage hook.
+func (h *Hook) Export(w io.Writer) error {
+	if !h.isOpen() {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return storage.Export(w, h)
+}
+
+// Import adds the records of an export read from r to the store, replacing any existing
+// records with the same keys. It should be called before the server is started, as imported
+// records are only loaded on startup.
+func (h *Hook) Import(r io.Reader) error {
+	if !h.isOpen() {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return storage.Import(r, h.importRecord)
+}
+
+// importRecord stores an imported record under the key used by the hook.
+func (h *Hook) importRecord(v storage.Serializable) error {
+	switch v := v.(type) {
+	case *storage.Client:
+		return h.setKv(clientKey(&mqtt.Client{ID: v.ID}), v)
+	case *storage.Subscription:
+		v.ID = subscriptionKey(&mqtt.Client{ID: v.Client}, v.Filter)
+		return h.setKv(v.ID, v)
+	case *storage.Message:
+		switch v.T {
+		case storage.RetainedKey:
+			v.ID = retainedKey(v.TopicName)
+		case storage.QueuedKey:
+			v.ID = queuedKey(&mqtt.Client{ID: v.Client}, packets.Packet{PacketID: v.PacketID})
+		default:
+			v.ID = inflightKey(&mqtt.Client{ID: v.Client}, packets.Packet{PacketID: v.PacketID})
+		}
+
+		if err := h.config.Compression.CompressMessage(v); err != nil {
+			h.Log.Error("failed to compress payload", "error", err, "key", v.ID)
+		}
+		return h.setKv(v.ID, v)
+	case *storage.SystemInfo:
+		v.ID = sysInfoKey()
+		return h.setKv(v.ID, v)
+	}
+
+	return nil
+}
+
+// records provides the raw records of the store to schema migrations and snapshots.
+type records struct {
+	h *Hook
+}
+
+// SchemaVersion returns the schema version of the store.
+func (r records) SchemaVersion() (v int, ok bool, err error) {
+	r.h.mu.RLock()
+	value, ok := r.h.data[storage.SchemaVersionKey]
+	r.h.mu.RUnlock()
+	if !ok {
+		return 0, false, nil
+	}
+
+	v, err = strconv.Atoi(string(value))
+	return v, true, err
+}
+
+// SetSchemaVersion stores the schema version of the store.
+func (r records) SetSchemaVersion(v int) error {
+	r.h.mu.Lock()
+	defer r.h.mu.Unlock()
+	r.h.data[storage.SchemaVersionKey] = []byte(strconv.Itoa(v))
+	r.h.changes++
+	return nil
+}
+
+// Each calls visit with the key and value of each record in key order. The records are
+// read under the lock and visited outside of it, so visit may write to the store.
+func (r records) Each(visit func(key string, value []byte) error) error {
+	keys, values, err := r.h.match("")
+	if err != nil {
+		return err
+	}
+
+	for i, k := range keys {
+		if k == storage.SchemaVersionKey {
+			continue
+		}
+
+		if err := visit(k, values[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Set sets the value of a record.
+func (r records) Set(key string, value []byte) error {
+	r.h.mu.Lock()
+	defer r.h.mu.Unlock()
+	r.h.data[key] = value
+	r.h.changes++
+	return nil
+}
+
+// Delete deletes a record.
+func (r records) Delete(key string) error {
+	r.h.mu.Lock()
+	defer r.h.mu.Unlock()
+	delete(r.h.data, key)
+	r.h.changes++
+	return nil
+}
@@ -0,0 +1,540 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package memory
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/system"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	client = &mqtt.Client{
+		ID: "test",
+		Net: mqtt.ClientConnection{
+			Remote:   "test.addr",
+			Listener: "listener",
+		},
+		Properties: mqtt.ClientProperties{
+			Username: []byte("username"),
+			Clean:    false,
+		},
+	}
+
+	pkf = packets.Packet{Filters: packets.Subscriptions{{Filter: "a/b/c"}}}
+)
+
+func newHook(t *testing.T, opts *Options) *Hook {
+	if opts == nil {
+		opts = new(Options)
+	}
+
+	if opts.Path == "" {
+		opts.Path = filepath.Join(t.TempDir(), "mochi.snapshot")
+	}
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(opts)
+	require.NoError(t, err)
+	return h
+}
+
+func TestClientKey(t *testing.T) {
+	k := clientKey(&mqtt.Client{ID: "cl1"})
+	require.Equal(t, storage.ClientKey+"_cl1", k)
+}
+
+func TestSubscriptionKey(t *testing.T) {
+	k := subscriptionKey(&mqtt.Client{ID: "cl1"}, "a/b/c")
+	require.Equal(t, storage.SubscriptionKey+"_cl1:a/b/c", k)
+}
+
+func TestRetainedKey(t *testing.T) {
+	k := retainedKey("a/b/c")
+	require.Equal(t, storage.RetainedKey+"_a/b/c", k)
+}
+
+func TestInflightKey(t *testing.T) {
+	k := inflightKey(&mqtt.Client{ID: "cl1"}, packets.Packet{PacketID: 1})
+	require.Equal(t, storage.InflightKey+"_cl1:1", k)
+}
+
+func TestSysInfoKey(t *testing.T) {
+	require.Equal(t, storage.SysInfoKey, sysInfoKey())
+}
+
+func TestID(t *testing.T) {
+	h := new(Hook)
+	require.Equal(t, "memory-db", h.ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := new(Hook)
+	require.True(t, h.Provides(mqtt.OnSessionEstablished))
+	require.True(t, h.Provides(mqtt.OnDisconnect))
+	require.True(t, h.Provides(mqtt.OnSubscribed))
+	require.True(t, h.Provides(mqtt.OnUnsubscribed))
+	require.True(t, h.Provides(mqtt.OnRetainMessage))
+	require.True(t, h.Provides(mqtt.OnQosPublish))
+	require.True(t, h.Provides(mqtt.OnQosComplete))
+	require.True(t, h.Provides(mqtt.OnQosDropped))
+	require.True(t, h.Provides(mqtt.OnQueuedMessage))
+	require.True(t, h.Provides(mqtt.OnSysInfoTick))
+	require.True(t, h.Provides(mqtt.StoredClients))
+	require.True(t, h.Provides(mqtt.StoredInflightMessages))
+	require.True(t, h.Provides(mqtt.StoredQueuedMessages))
+	require.True(t, h.Provides(mqtt.StoredRetainedMessages))
+	require.True(t, h.Provides(mqtt.StoredSubscriptions))
+	require.True(t, h.Provides(mqtt.StoredSysInfo))
+	require.True(t, h.Provides(mqtt.StoredSession))
+	require.False(t, h.Provides(mqtt.OnACLCheck))
+	require.False(t, h.Provides(mqtt.OnConnectAuthenticate))
+}
+
+func TestInitBadConfig(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(map[string]any{})
+	require.Error(t, err)
+}
+
+func TestInitBadCompression(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Compression: storage.Compression{Algorithm: "lz77"}})
+	require.ErrorIs(t, err, storage.ErrUnknownCompression)
+}
+
+func TestInitUseDefaults(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer os.Remove(defaultPath)
+	defer h.Stop()
+
+	require.Equal(t, defaultPath, h.config.Path)
+	require.Equal(t, int64(defaultSnapshotInterval), h.config.SnapshotInterval)
+	require.NotNil(t, h.done)
+}
+
+func TestInitBadSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mochi.snapshot")
+	require.NoError(t, os.WriteFile(path, []byte("not a snapshot"), 0600))
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Path: path})
+	require.ErrorIs(t, err, storage.ErrInvalidBackup)
+	require.Nil(t, h.data)
+}
+
+func TestHealth(t *testing.T) {
+	h := new(Hook)
+	require.ErrorIs(t, h.Health(), storage.ErrDBFileNotOpen)
+
+	h = newHook(t, nil)
+	require.NoError(t, h.Health())
+	require.NoError(t, h.Stop())
+	require.ErrorIs(t, h.Health(), storage.ErrDBFileNotOpen)
+}
+
+func TestOnSessionEstablishedThenOnDisconnect(t *testing.T) {
+	h := newHook(t, nil)
+	defer h.Stop()
+
+	h.OnSessionEstablished(client, packets.Packet{})
+
+	r := new(storage.Client)
+	err := h.getKv(clientKey(client), r)
+	require.NoError(t, err)
+	require.Equal(t, client.ID, r.ID)
+	require.Equal(t, client.Net.Remote, r.Remote)
+	require.Equal(t, client.Properties.Username, r.Username)
+
+	h.OnDisconnect(client, nil, false)
+	err = h.getKv(clientKey(client), r)
+	require.NoError(t, err)
+
+	h.OnDisconnect(client, nil, true)
+	err = h.getKv(clientKey(client), r)
+	require.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestOnSessionEstablishedNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnSessionEstablished(client, packets.Packet{})
+	require.Equal(t, int64(1), h.StorageStats().Writes.Errors)
+}
+
+func TestOnSubscribedThenOnUnsubscribed(t *testing.T) {
+	h := newHook(t, nil)
+	defer h.Stop()
+
+	h.OnSubscribed(client, pkf, []byte{0})
+
+	r := new(storage.Subscription)
+	err := h.getKv(subscriptionKey(client, pkf.Filters[0].Filter), r)
+	require.NoError(t, err)
+	require.Equal(t, client.ID, r.Client)
+	require.Equal(t, pkf.Filters[0].Filter, r.Filter)
+	require.Equal(t, byte(0), r.Qos)
+
+	h.OnUnsubscribed(client, pkf)
+	err = h.getKv(subscriptionKey(client, pkf.Filters[0].Filter), r)
+	require.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestOnRetainMessageThenUnset(t *testing.T) {
+	h := newHook(t, nil)
+	defer h.Stop()
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Retain: true,
+		},
+		Payload:   []byte("hello"),
+		TopicName: "a/b/c",
+	}
+
+	h.OnRetainMessage(client, pk, 1)
+
+	r := new(storage.Message)
+	err := h.getKv(retainedKey(pk.TopicName), r)
+	require.NoError(t, err)
+	require.Equal(t, pk.TopicName, r.TopicName)
+	require.Equal(t, pk.Payload, r.Payload)
+
+	h.OnRetainMessage(client, pk, -1)
+	err = h.getKv(retainedKey(pk.TopicName), r)
+	require.ErrorIs(t, err, ErrKeyNotFound)
+
+	h.OnRetainMessage(client, pk, 1)
+	h.OnRetainedExpired(pk.TopicName)
+	err = h.getKv(retainedKey(pk.TopicName), r)
+	require.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestOnRetainMessageCompressed(t *testing.T) {
+	h := newHook(t, &Options{
+		Compression: storage.Compression{Algorithm: storage.CompressionZstd},
+	})
+	defer h.Stop()
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Retain: true, Qos: 1},
+		Payload:     bytes.Repeat([]byte("hello"), 1000),
+		TopicName:   "a/b/c",
+	}
+	h.OnRetainMessage(client, pk, 1)
+
+	require.Less(t, len(h.data[retainedKey(pk.TopicName)]), len(pk.Payload))
+
+	r, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, pk.Payload, r[0].Payload)
+}
+
+func TestOnQosPublishThenQOSComplete(t *testing.T) {
+	h := newHook(t, nil)
+	defer h.Stop()
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Retain: true,
+			Qos:    2,
+		},
+		Payload:   []byte("hello"),
+		TopicName: "a/b/c",
+		PacketID:  3,
+	}
+
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	r, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, pk.TopicName, r[0].TopicName)
+	require.Equal(t, pk.Payload, r[0].Payload)
+
+	h.OnQosComplete(client, pk)
+	r, err = h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Empty(t, r)
+}
+
+func TestOnQueuedMessageThenResend(t *testing.T) {
+	h := newHook(t, nil)
+	defer h.Stop()
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b/c",
+		Payload:     []byte("hello"),
+		PacketID:    7,
+	}
+	h.OnQueuedMessage(client, pk)
+
+	queued, err := h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Len(t, queued, 1)
+	require.Equal(t, storage.QueuedKey, queued[0].T)
+
+	// the queued message is resent as a duplicate when the client reconnects
+	pk.FixedHeader.Dup = true
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	queued, err = h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Empty(t, queued)
+
+	inflight, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+
+	h.OnQosDropped(client, pk)
+	inflight, err = h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Empty(t, inflight)
+}
+
+func TestOnSysInfoTick(t *testing.T) {
+	h := newHook(t, nil)
+	defer h.Stop()
+
+	info := &system.Info{
+		Version:       "2.0.0",
+		BytesReceived: 100,
+	}
+	h.OnSysInfoTick(info)
+
+	r, err := h.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, info.Version, r.Version)
+	require.Equal(t, info.BytesReceived, r.BytesReceived)
+}
+
+func TestStoredSysInfoEmpty(t *testing.T) {
+	h := newHook(t, nil)
+	defer h.Stop()
+
+	r, err := h.StoredSysInfo()
+	require.NoError(t, err)
+	require.Empty(t, r)
+}
+
+func TestStoredClientsNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	v, err := h.StoredClients()
+	require.Empty(t, v)
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+}
+
+func TestStoredSession(t *testing.T) {
+	h := newHook(t, nil)
+	defer h.Stop()
+
+	// a client with an id prefixed by the id of the client
+	other := &mqtt.Client{ID: client.ID + ":2"}
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b/c",
+		PacketID:    7,
+	}
+	for _, cl := range []*mqtt.Client{client, other} {
+		h.OnSessionEstablished(cl, packets.Packet{})
+		h.OnSubscribed(cl, pkf, []byte{0})
+		h.OnQosPublish(cl, pk, time.Now().Unix(), 0)
+	}
+	pk.PacketID = 8
+	h.OnQueuedMessage(client, pk)
+
+	v, err := h.StoredSession(client.ID)
+	require.NoError(t, err)
+	require.Equal(t, client.ID, v.Client.ID)
+	require.Len(t, v.Subscriptions, 1)
+	require.Len(t, v.Inflight, 1)
+	require.Equal(t, uint16(7), v.Inflight[0].PacketID)
+	require.Len(t, v.Queued, 1)
+	require.Equal(t, uint16(8), v.Queued[0].PacketID)
+
+	v, err = h.StoredSession("absent")
+	require.NoError(t, err)
+	require.Empty(t, v)
+}
+
+func TestStorageStats(t *testing.T) {
+	h := newHook(t, nil)
+	defer h.Stop()
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	_, err := h.StoredSession("absent")
+	require.NoError(t, err)
+	h.OnClientExpired(client)
+
+	stats := h.StorageStats()
+	require.Equal(t, int64(1), stats.Writes.Count)
+	require.Equal(t, int64(1), stats.Reads.Count)
+	require.Equal(t, int64(0), stats.Reads.Errors) // a missing key is not a failed read
+	require.Equal(t, int64(1), stats.Deletes.Count)
+}
+
+func TestStopWritesSnapshot(t *testing.T) {
+	h := newHook(t, &Options{SnapshotInterval: -1})
+	require.Nil(t, h.done)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{1})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+	require.NoError(t, h.Stop())
+	require.NoError(t, h.Stop())
+
+	_, err := os.Stat(h.config.Path + ".tmp")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	r := newHook(t, &Options{Path: h.config.Path})
+	defer r.Stop()
+
+	cl, err := r.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, cl, 1)
+	require.Equal(t, client.ID, cl[0].ID)
+
+	subs, err := r.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	require.Equal(t, byte(1), subs[0].Qos)
+
+	retained, err := r.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+	require.Equal(t, []byte("hello"), retained[0].Payload)
+
+	v, ok, err := records{h: r}.SchemaVersion()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, storage.SchemaVersion, v)
+}
+
+func TestSnapshotInterval(t *testing.T) {
+	h := newHook(t, &Options{SnapshotInterval: 1})
+	defer h.Stop()
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(h.config.Path)
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	require.Equal(t, h.changes, h.saved)
+}
+
+func TestSnapshotUnchanged(t *testing.T) {
+	h := newHook(t, &Options{SnapshotInterval: -1})
+
+	require.NoError(t, h.snapshotChanges())
+	require.NoError(t, h.Snapshot())
+	info, err := os.Stat(h.config.Path)
+	require.NoError(t, err)
+
+	require.NoError(t, os.Remove(h.config.Path))
+	require.NoError(t, h.Stop()) // no changes since the last snapshot
+	_, err = os.Stat(h.config.Path)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.Positive(t, info.Size())
+}
+
+func TestSnapshotFailed(t *testing.T) {
+	h := newHook(t, &Options{
+		Path:             filepath.Join(t.TempDir(), "missing", "mochi.snapshot"),
+		SnapshotInterval: -1,
+	})
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	require.Error(t, h.Snapshot())
+	require.Error(t, h.Health())
+
+	require.NoError(t, os.Mkdir(filepath.Dir(h.config.Path), 0700))
+	require.NoError(t, h.Snapshot())
+	require.NoError(t, h.Health())
+	require.NoError(t, h.Stop())
+}
+
+func TestSnapshotNoDB(t *testing.T) {
+	h := new(Hook)
+	require.ErrorIs(t, h.Snapshot(), storage.ErrDBFileNotOpen)
+}
+
+func TestBackupRestore(t *testing.T) {
+	h := newHook(t, nil)
+	defer h.Stop()
+	h.OnSessionEstablished(client, packets.Packet{})
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, h.Backup(buf))
+
+	r := newHook(t, nil)
+	defer r.Stop()
+	r.OnSubscribed(client, pkf, []byte{0})
+	require.NoError(t, r.Restore(buf))
+
+	cl, err := r.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, cl, 1)
+
+	subs, err := r.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Empty(t, subs)
+}
+
+func TestExportImport(t *testing.T) {
+	h := newHook(t, nil)
+	defer h.Stop()
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnQueuedMessage(client, packets.Packet{TopicName: "a/b/c", PacketID: 7})
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, h.Export(buf))
+
+	r := newHook(t, nil)
+	defer r.Stop()
+	require.NoError(t, r.Import(buf))
+
+	cl, err := r.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, cl, 1)
+
+	queued, err := r.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Len(t, queued, 1)
+	require.Equal(t, uint16(7), queued[0].PacketID)
+}
+
+func TestBackupNoDB(t *testing.T) {
+	h := new(Hook)
+	require.ErrorIs(t, h.Backup(new(bytes.Buffer)), storage.ErrDBFileNotOpen)
+	require.ErrorIs(t, h.Restore(new(bytes.Buffer)), storage.ErrDBFileNotOpen)
+	require.ErrorIs(t, h.Export(new(bytes.Buffer)), storage.ErrDBFileNotOpen)
+	require.ErrorIs(t, h.Import(new(bytes.Buffer)), storage.ErrDBFileNotOpen)
+}
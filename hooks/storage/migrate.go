@@ -0,0 +1,203 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	SchemaVersionKey = "VER" // unique key to denote the schema version in a store
+	SchemaVersion    = 1     // the current version of the storage schema
+)
+
+var (
+	// ErrNewerSchemaVersion indicates a store was written by a newer version of the server.
+	ErrNewerSchemaVersion = errors.New("store schema version is newer than supported")
+)
+
+// Migration upgrades the records of a store to a schema version.
+type Migration struct {
+	Version     int    // the schema version the migration upgrades records to
+	Description string // a description of the changes made by the migration
+
+	// Upgrade returns the upgraded value of a record, or nil if the record should be deleted.
+	Upgrade func(key string, value []byte) ([]byte, error)
+}
+
+// Migrations are the migrations applied to stores with older schema versions. Stores written
+// before schema versioning was introduced have a schema version of 0.
+var Migrations = []Migration{}
+
+// Records provides access to the raw records of a store for migrations.
+type Records interface {
+	// SchemaVersion returns the schema version of the store, and false if no version is stored.
+	SchemaVersion() (int, bool, error)
+
+	// SetSchemaVersion stores the schema version of the store.
+	SetSchemaVersion(v int) error
+
+	// Each calls visit with the key and value of each record, excluding the schema version.
+	Each(visit func(key string, value []byte) error) error
+
+	// Set sets the value of a record.
+	Set(key string, value []byte) error
+
+	// Delete deletes a record.
+	Delete(key string) error
+}
+
+// Migrate upgrades the records of a store to the target schema version by applying each
+// migration with a newer version, in version order. An empty store is assumed to be new and
+// is given the target version. An error is returned if the store has a newer version than the
+// target, as it cannot be safely read. The version of the store before migration is returned.
+func Migrate(r Records, migrations []Migration, target int) (int, error) {
+	from, ok, err := r.SchemaVersion()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	if !ok {
+		empty, err := isEmpty(r)
+		if err != nil {
+			return 0, err
+		}
+
+		if empty {
+			return target, r.SetSchemaVersion(target)
+		}
+	}
+
+	if from > target {
+		return from, fmt.Errorf("%w: store version %d, supported version %d", ErrNewerSchemaVersion, from, target)
+	}
+
+	if from == target {
+		return from, nil
+	}
+
+	pending := make([]Migration, 0, len(migrations))
+	for _, m := range migrations {
+		if m.Version > from && m.Version <= target {
+			pending = append(pending, m)
+		}
+	}
+
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].Version < pending[j].Version
+	})
+
+	v := from
+	for _, m := range pending {
+		if err := migrate(r, m); err != nil {
+			return from, fmt.Errorf("failed to migrate to schema version %d: %w", m.Version, err)
+		}
+
+		v = m.Version
+		if err := r.SetSchemaVersion(v); err != nil {
+			return from, err
+		}
+	}
+
+	if v != target {
+		return from, r.SetSchemaVersion(target)
+	}
+
+	return from, nil
+}
+
+// CheckSchema returns an error if the records of a read-only store cannot be read at the target
+// schema version, as they cannot be migrated. Records need migrating if any migration with an
+// Upgrade has a newer version than the store. An empty store can always be read. The version of
+// the store is returned.
+func CheckSchema(r Records, migrations []Migration, target int) (int, error) {
+	from, ok, err := r.SchemaVersion()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	if !ok {
+		empty, err := isEmpty(r)
+		if err != nil {
+			return 0, err
+		}
+
+		if empty {
+			return target, nil
+		}
+	}
+
+	if from > target {
+		return from, fmt.Errorf("%w: store version %d, supported version %d", ErrNewerSchemaVersion, from, target)
+	}
+
+	for _, m := range migrations {
+		if m.Version > from && m.Version <= target && m.Upgrade != nil {
+			return from, fmt.Errorf("%w: store version %d must be migrated to version %d", ErrReadOnly, from, target)
+		}
+	}
+
+	return from, nil
+}
+
+// errStopEach stops a call to Records.Each.
+var errStopEach = errors.New("stop")
+
+// isEmpty returns true if a store has no records.
+func isEmpty(r Records) (bool, error) {
+	empty := true
+	err := r.Each(func(string, []byte) error {
+		empty = false
+		return errStopEach
+	})
+	if err != nil && !errors.Is(err, errStopEach) {
+		return false, err
+	}
+
+	return empty, nil
+}
+
+// migrate applies a single migration to each record of a store.
+func migrate(r Records, m Migration) error {
+	if m.Upgrade == nil {
+		return nil
+	}
+
+	type record struct {
+		key   string
+		value []byte
+	}
+
+	// records are collected first, as stores may not support writes while iterating.
+	var records []record
+	err := r.Each(func(key string, value []byte) error {
+		v, err := m.Upgrade(key, value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+
+		records = append(records, record{key: key, value: v})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range records {
+		if rec.value == nil {
+			err = r.Delete(rec.key)
+		} else {
+			err = r.Set(rec.key, rec.value)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
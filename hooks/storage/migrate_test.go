@@ -0,0 +1,196 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memRecords is an in-memory Records implementation.
+type memRecords struct {
+	version  int
+	versions []int
+	hasVer   bool
+	data     map[string][]byte
+	fail     error
+}
+
+func (m *memRecords) SchemaVersion() (int, bool, error) {
+	return m.version, m.hasVer, m.fail
+}
+
+func (m *memRecords) SetSchemaVersion(v int) error {
+	m.version = v
+	m.hasVer = true
+	m.versions = append(m.versions, v)
+	return nil
+}
+
+func (m *memRecords) Each(visit func(key string, value []byte) error) error {
+	keys := make([]string, 0, len(m.data))
+	for k := range m.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err := visit(k, m.data[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memRecords) Set(key string, value []byte) error {
+	m.data[key] = value
+	return nil
+}
+
+func (m *memRecords) Delete(key string) error {
+	delete(m.data, key)
+	return nil
+}
+
+var testMigrations = []Migration{
+	{
+		Version: 3,
+		Upgrade: func(key string, value []byte) ([]byte, error) {
+			return append(value, '3'), nil
+		},
+	},
+	{
+		Version: 2,
+		Upgrade: func(key string, value []byte) ([]byte, error) {
+			if strings.HasPrefix(key, "OLD") {
+				return nil, nil
+			}
+			return append(value, '2'), nil
+		},
+	},
+	{
+		Version:     4,
+		Description: "no changes to records",
+	},
+}
+
+func TestMigrateEmptyStore(t *testing.T) {
+	m := &memRecords{data: map[string][]byte{}}
+	from, err := Migrate(m, testMigrations, 4)
+	require.NoError(t, err)
+	require.Equal(t, 4, from)
+	require.Equal(t, 4, m.version)
+	require.Equal(t, []int{4}, m.versions)
+}
+
+func TestMigrateUnversionedStore(t *testing.T) {
+	m := &memRecords{data: map[string][]byte{
+		"CL_a":  []byte("a"),
+		"OLD_b": []byte("b"),
+	}}
+	from, err := Migrate(m, testMigrations, 4)
+	require.NoError(t, err)
+	require.Equal(t, 0, from)
+	require.Equal(t, 4, m.version)
+	require.Equal(t, []int{2, 3, 4}, m.versions)
+	require.Equal(t, map[string][]byte{"CL_a": []byte("a23")}, m.data)
+}
+
+func TestMigrateFromVersion(t *testing.T) {
+	m := &memRecords{version: 2, hasVer: true, data: map[string][]byte{
+		"CL_a": []byte("a"),
+	}}
+	from, err := Migrate(m, testMigrations, 3)
+	require.NoError(t, err)
+	require.Equal(t, 2, from)
+	require.Equal(t, 3, m.version)
+	require.Equal(t, []byte("a3"), m.data["CL_a"])
+}
+
+func TestMigrateCurrentVersion(t *testing.T) {
+	m := &memRecords{version: 3, hasVer: true, data: map[string][]byte{
+		"CL_a": []byte("a"),
+	}}
+	from, err := Migrate(m, testMigrations, 3)
+	require.NoError(t, err)
+	require.Equal(t, 3, from)
+	require.Empty(t, m.versions)
+	require.Equal(t, []byte("a"), m.data["CL_a"])
+}
+
+func TestMigrateNewerVersion(t *testing.T) {
+	m := &memRecords{version: 5, hasVer: true, data: map[string][]byte{}}
+	from, err := Migrate(m, testMigrations, 4)
+	require.ErrorIs(t, err, ErrNewerSchemaVersion)
+	require.Equal(t, 5, from)
+	require.Empty(t, m.versions)
+}
+
+func TestMigrateVersionError(t *testing.T) {
+	m := &memRecords{fail: errors.New("test"), data: map[string][]byte{}}
+	_, err := Migrate(m, testMigrations, 4)
+	require.ErrorContains(t, err, "failed to read schema version")
+}
+
+func TestMigrateUpgradeError(t *testing.T) {
+	m := &memRecords{version: 1, hasVer: true, data: map[string][]byte{
+		"CL_a": []byte("a"),
+	}}
+	_, err := Migrate(m, []Migration{
+		{
+			Version: 2,
+			Upgrade: func(key string, value []byte) ([]byte, error) {
+				return nil, errors.New("bad record")
+			},
+		},
+	}, 2)
+	require.ErrorContains(t, err, "failed to migrate to schema version 2: CL_a: bad record")
+	require.Equal(t, 1, m.version)
+	require.Equal(t, []byte("a"), m.data["CL_a"])
+}
+
+func TestCheckSchemaEmptyStore(t *testing.T) {
+	m := &memRecords{data: map[string][]byte{}}
+	from, err := CheckSchema(m, testMigrations, 4)
+	require.NoError(t, err)
+	require.Equal(t, 4, from)
+	require.Empty(t, m.versions)
+}
+
+func TestCheckSchemaCurrentVersion(t *testing.T) {
+	m := &memRecords{version: 3, hasVer: true, data: map[string][]byte{
+		"CL_a": []byte("a"),
+	}}
+	from, err := CheckSchema(m, testMigrations, 4) // version 4 makes no changes to records
+	require.NoError(t, err)
+	require.Equal(t, 3, from)
+	require.Empty(t, m.versions)
+}
+
+func TestCheckSchemaNeedsMigration(t *testing.T) {
+	m := &memRecords{data: map[string][]byte{
+		"CL_a": []byte("a"),
+	}}
+	from, err := CheckSchema(m, testMigrations, 4)
+	require.ErrorIs(t, err, ErrReadOnly)
+	require.Equal(t, 0, from)
+	require.Equal(t, []byte("a"), m.data["CL_a"])
+}
+
+func TestCheckSchemaNewerVersion(t *testing.T) {
+	m := &memRecords{version: 5, hasVer: true, data: map[string][]byte{}}
+	_, err := CheckSchema(m, testMigrations, 4)
+	require.ErrorIs(t, err, ErrNewerSchemaVersion)
+}
+
+func TestCheckSchemaVersionError(t *testing.T) {
+	m := &memRecords{fail: errors.New("test"), data: map[string][]byte{}}
+	_, err := CheckSchema(m, testMigrations, 4)
+	require.ErrorContains(t, err, "failed to read schema version")
+}
@@ -0,0 +1,52 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+var (
+	// ErrInvalidNamespace indicates a namespace contains characters other than letters, digits and underscores.
+	ErrInvalidNamespace = errors.New("invalid namespace")
+
+	validNamespace = regexp.MustCompile(`^[a-zA-Z0-9_]{0,32}$`)
+)
+
+// Namespace separates the values stored by a broker from those of other brokers sharing the
+// same database, such as other broker instances or tenants. Each broker sharing a database
+// should use a different namespace. An empty namespace stores values without separation.
+type Namespace string
+
+// Validate returns an error if the namespace is longer than 32 characters, or contains
+// characters other than letters, digits and underscores.
+func (n Namespace) Validate() error {
+	if !validNamespace.MatchString(string(n)) {
+		return fmt.Errorf("%w: %s", ErrInvalidNamespace, string(n))
+	}
+
+	return nil
+}
+
+// Key returns k prefixed by the namespace and a colon, or k if the namespace is empty.
+func (n Namespace) Key(k string) string {
+	if n == "" {
+		return k
+	}
+
+	return string(n) + ":" + k
+}
+
+// Table returns the name of a table prefixed by the namespace and an underscore, or name
+// if the namespace is empty.
+func (n Namespace) Table(name string) string {
+	if n == "" {
+		return name
+	}
+
+	return string(n) + "_" + name
+}
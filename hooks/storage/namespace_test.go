@@ -0,0 +1,30 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespaceValidate(t *testing.T) {
+	require.NoError(t, Namespace("").Validate())
+	require.NoError(t, Namespace("tenant_1").Validate())
+	require.ErrorIs(t, Namespace("a:b").Validate(), ErrInvalidNamespace)
+	require.ErrorIs(t, Namespace("a*").Validate(), ErrInvalidNamespace)
+	require.ErrorIs(t, Namespace(strings.Repeat("a", 33)).Validate(), ErrInvalidNamespace)
+}
+
+func TestNamespaceKey(t *testing.T) {
+	require.Equal(t, "CL_a", Namespace("").Key("CL_a"))
+	require.Equal(t, "t1:CL_a", Namespace("t1").Key("CL_a"))
+}
+
+func TestNamespaceTable(t *testing.T) {
+	require.Equal(t, "clients", Namespace("").Table("clients"))
+	require.Equal(t, "t1_clients", Namespace("t1").Table("clients"))
+}
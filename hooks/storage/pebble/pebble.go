@@ -8,7 +8,10 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"strconv"
 	"strings"
+	"time"
 
 	pebbledb "github.com/cockroachdb/pebble"
 	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
@@ -42,6 +45,11 @@ func inflightKey(cl *mqtt.Client, pk packets.Packet) string {
 	return storage.InflightKey + "_" + cl.ID + ":" + pk.FormatID()
 }
 
+// queuedKey returns a primary key for a message queued for a disconnected client.
+func queuedKey(cl *mqtt.Client, pk packets.Packet) string {
+	return storage.QueuedKey + "_" + cl.ID + ":" + pk.FormatID()
+}
+
 // sysInfoKey returns a primary key for system info.
 func sysInfoKey() string {
 	return storage.SysInfoKey
@@ -71,6 +79,53 @@ type Options struct {
 	Options *pebbledb.Options
 	Mode    string `yaml:"mode" json:"mode"`
 	Path    string `yaml:"path" json:"path"`
+
+	// Compaction settings, applied to Options when set. See the pebble.Options documentation for details.
+	L0CompactionThreshold       int   `yaml:"l0_compaction_threshold" json:"l0_compaction_threshold"`
+	L0StopWritesThreshold       int   `yaml:"l0_stop_writes_threshold" json:"l0_stop_writes_threshold"`
+	LBaseMaxBytes               int64 `yaml:"lbase_max_bytes" json:"lbase_max_bytes"`
+	MaxConcurrentCompactions    int   `yaml:"max_concurrent_compactions" json:"max_concurrent_compactions"`
+	DisableAutomaticCompactions bool  `yaml:"disable_automatic_compactions" json:"disable_automatic_compactions"`
+
+	// Compression compresses retained and inflight message payloads above a size threshold.
+	Compression storage.Compression `yaml:"compression" json:"compression"`
+
+	// Encryption encrypts stored values with AES-GCM, if set.
+	Encryption *storage.Encryption `yaml:"encryption" json:"encryption"`
+
+	// Durability sets when writes are synchronized to disk, overriding Mode if set.
+	Durability storage.Durability `yaml:"durability" json:"durability"`
+
+	// Namespace prefixes the keys of stored values, so several brokers can share a database.
+	Namespace storage.Namespace `yaml:"namespace" json:"namespace"`
+
+	// ReadOnly opens the database read-only, so a standby broker can restore from it without
+	// writing to it. A read-only hook only provides the methods which read from the store.
+	ReadOnly bool `yaml:"read_only" json:"read_only"`
+}
+
+// LevelStats contains the metrics of a single level of the LSM tree.
+type LevelStats struct {
+	Level     int     `json:"level"`     // the level number, from 0
+	Sublevels int32   `json:"sublevels"` // the number of sublevels, which contribute to read amplification
+	Files     int64   `json:"files"`     // the number of sstables in the level
+	Size      int64   `json:"size"`      // the size of the sstables in the level in bytes
+	Score     float64 `json:"score"`     // the compaction score of the level; levels scoring above 1 need compacting
+}
+
+// Stats contains metrics of the pebble instance which indicate whether persistence is keeping up with writes.
+type Stats struct {
+	Levels                []LevelStats `json:"levels"`                  // metrics for each level of the LSM tree
+	ReadAmp               int          `json:"read_amp"`                // the current read amplification
+	Compactions           int64        `json:"compactions"`             // the total number of compactions
+	CompactionsInProgress int64        `json:"compactions_in_progress"` // the number of running compactions
+	CompactionDebt        uint64       `json:"compaction_debt"`         // estimated bytes to compact before the LSM tree is stable
+	Flushes               int64        `json:"flushes"`                 // the total number of memtable flushes
+	MemTableSize          uint64       `json:"memtable_size"`           // bytes allocated by memtables
+	WALFiles              int64        `json:"wal_files"`               // the number of live WAL files
+	WALSize               uint64       `json:"wal_size"`                // the size of the live data in the WAL files
+	WALPhysicalSize       uint64       `json:"wal_physical_size"`       // the size of the WAL files on disk
+	DiskSpaceUsage        uint64       `json:"disk_space_usage"`        // the total disk space used by the database
 }
 
 // Hook is a persistent storage hook based using pebble DB file store as a backend.
@@ -79,6 +134,9 @@ type Hook struct {
 	config *Options               // options for configuring the pebble DB instance.
 	db     *pebbledb.DB           // the pebble DB instance
 	mode   *pebbledb.WriteOptions // mode holds the optional per-query parameters for Set and Delete operations
+	crypt  *storage.Encryptor     // encrypts stored values, if encryption is enabled
+	syncer *storage.Syncer        // synchronizes the database periodically, under the interval durability policy
+	stats  storage.Recorder       // records the reads, writes and deletes of the hook
 }
 
 // ID returns the id of the hook.
@@ -86,9 +144,22 @@ func (h *Hook) ID() string {
 	return "pebble-db"
 }
 
-// Provides indicates which hook methods this hook provides.
+// Provides indicates which hook methods this hook provides. A read-only hook only provides
+// the methods which read from the store.
 func (h *Hook) Provides(b byte) bool {
-	return bytes.Contains([]byte{
+	if bytes.Contains([]byte{
+		mqtt.StoredClients,
+		mqtt.StoredInflightMessages,
+		mqtt.StoredQueuedMessages,
+		mqtt.StoredRetainedMessages,
+		mqtt.StoredSubscriptions,
+		mqtt.StoredSysInfo,
+		mqtt.StoredSession,
+	}, []byte{b}) {
+		return true
+	}
+
+	return (h.config == nil || !h.config.ReadOnly) && bytes.Contains([]byte{
 		mqtt.OnSessionEstablished,
 		mqtt.OnDisconnect,
 		mqtt.OnSubscribed,
@@ -98,14 +169,10 @@ func (h *Hook) Provides(b byte) bool {
 		mqtt.OnQosPublish,
 		mqtt.OnQosComplete,
 		mqtt.OnQosDropped,
+		mqtt.OnQueuedMessage,
 		mqtt.OnSysInfoTick,
 		mqtt.OnClientExpired,
 		mqtt.OnRetainedExpired,
-		mqtt.StoredClients,
-		mqtt.StoredInflightMessages,
-		mqtt.StoredRetainedMessages,
-		mqtt.StoredSubscriptions,
-		mqtt.StoredSysInfo,
 	}, []byte{b})
 }
 
@@ -121,6 +188,24 @@ func (h *Hook) Init(config any) error {
 		h.config = config.(*Options)
 	}
 
+	if err := h.config.Compression.Validate(); err != nil {
+		return err
+	}
+
+	if err := h.config.Durability.Validate(); err != nil {
+		return err
+	}
+
+	if err := h.config.Namespace.Validate(); err != nil {
+		return err
+	}
+
+	var err error
+	h.crypt, err = storage.NewEncryptor(h.config.Encryption)
+	if err != nil {
+		return err
+	}
+
 	if len(h.config.Path) == 0 {
 		h.config.Path = defaultDbFile
 	}
@@ -129,27 +214,157 @@ func (h *Hook) Init(config any) error {
 		h.config.Options = &pebbledb.Options{}
 	}
 
+	if h.config.L0CompactionThreshold > 0 {
+		h.config.Options.L0CompactionThreshold = h.config.L0CompactionThreshold
+	}
+
+	if h.config.L0StopWritesThreshold > 0 {
+		h.config.Options.L0StopWritesThreshold = h.config.L0StopWritesThreshold
+	}
+
+	if h.config.LBaseMaxBytes > 0 {
+		h.config.Options.LBaseMaxBytes = h.config.LBaseMaxBytes
+	}
+
+	if n := h.config.MaxConcurrentCompactions; n > 0 {
+		h.config.Options.MaxConcurrentCompactions = func() int { return n }
+	}
+
+	if h.config.DisableAutomaticCompactions {
+		h.config.Options.DisableAutomaticCompactions = true
+	}
+
+	if h.config.ReadOnly {
+		h.config.Options.ReadOnly = true
+	}
+
 	h.mode = pebbledb.NoSync
-	if strings.EqualFold(h.config.Mode, "Sync") {
+	if h.config.Durability.SyncEach(strings.EqualFold(h.config.Mode, Sync)) {
 		h.mode = pebbledb.Sync
 	}
 
-	var err error
 	h.db, err = pebbledb.Open(h.config.Path, h.config.Options)
 	if err != nil {
 		return err
 	}
 
+	if err := h.migrateSchema(); err != nil {
+		_ = h.db.Close()
+		h.db = nil
+		return err
+	}
+
+	if !h.config.ReadOnly {
+		h.syncer = storage.NewSyncer(h.config.Durability.SyncInterval(), h.sync)
+	}
+
 	return nil
 }
 
-// Stop closes the pebble instance.
+// sync synchronizes the write-ahead log of the pebble instance to disk.
+func (h *Hook) sync() error {
+	return h.db.LogData(nil, pebbledb.Sync)
+}
+
+// Stop synchronizes and closes the pebble instance.
 func (h *Hook) Stop() error {
+	serr := h.syncer.Stop()
+	h.syncer = nil
 	err := h.db.Close()
 	h.db = nil
+	if err == nil {
+		err = serr
+	}
 	return err
 }
 
+// Stats returns metrics describing the levels, compactions and WAL of the pebble instance.
+func (h *Hook) Stats() (Stats, error) {
+	if h.db == nil {
+		return Stats{}, storage.ErrDBFileNotOpen
+	}
+
+	m := h.db.Metrics()
+	s := Stats{
+		Levels:                make([]LevelStats, len(m.Levels)),
+		ReadAmp:               m.ReadAmp(),
+		Compactions:           m.Compact.Count,
+		CompactionsInProgress: m.Compact.NumInProgress,
+		CompactionDebt:        m.Compact.EstimatedDebt,
+		Flushes:               m.Flush.Count,
+		MemTableSize:          m.MemTable.Size,
+		WALFiles:              m.WAL.Files,
+		WALSize:               m.WAL.Size,
+		WALPhysicalSize:       m.WAL.PhysicalSize,
+		DiskSpaceUsage:        m.DiskSpaceUsage(),
+	}
+
+	for i, l := range m.Levels {
+		s.Levels[i] = LevelStats{
+			Level:     i,
+			Sublevels: l.Sublevels,
+			Files:     l.NumFiles,
+			Size:      l.Size,
+			Score:     l.Score,
+		}
+	}
+
+	return s, nil
+}
+
+// Compact manually compacts the entire keyspace, which may be used to reclaim space when
+// automatic compactions are disabled.
+func (h *Hook) Compact() error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return h.db.Compact([]byte{0x00}, []byte{0xff}, true)
+}
+
+// logStats logs the pebble metrics, warning if writes are close to being stalled
+// because compactions are falling behind.
+func (h *Hook) logStats() {
+	s, err := h.Stats()
+	if err != nil {
+		return
+	}
+
+	attrs := []any{
+		"read_amp", s.ReadAmp,
+		"l0_sublevels", s.Levels[0].Sublevels,
+		"l0_files", s.Levels[0].Files,
+		"compactions", s.Compactions,
+		"compactions_in_progress", s.CompactionsInProgress,
+		"compaction_debt", s.CompactionDebt,
+		"wal_files", s.WALFiles,
+		"wal_size", s.WALSize,
+		"disk_space_usage", s.DiskSpaceUsage,
+	}
+
+	if int(s.Levels[0].Sublevels) >= max(h.config.Options.L0StopWritesThreshold/2, 1) {
+		h.Log.Warn("pebble compactions are falling behind, writes may stall", attrs...)
+		return
+	}
+
+	h.Log.Debug("pebble stats", attrs...)
+}
+
+// Health returns an error if the database is not open, or if it failed to be synchronized
+// to disk under the interval durability policy.
+func (h *Hook) Health() error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return h.syncer.Err()
+}
+
+// StorageStats returns the counters and latencies of the reads, writes and deletes of the hook.
+func (h *Hook) StorageStats() storage.Stats {
+	return h.stats.Stats()
+}
+
 // OnSessionEstablished adds a client to the store when their session is established.
 func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
 	h.updateClient(cl)
@@ -262,16 +477,19 @@ func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
 
 	props := pk.Properties.Copy(false)
 	in := &storage.Message{
-		ID:          retainedKey(pk.TopicName),
-		T:           storage.RetainedKey,
-		FixedHeader: pk.FixedHeader,
-		TopicName:   pk.TopicName,
-		Payload:     pk.Payload,
-		Created:     pk.Created,
-		Client:      cl.ID,
-		Origin:      pk.Origin,
+		ID:              retainedKey(pk.TopicName),
+		T:               storage.RetainedKey,
+		FixedHeader:     pk.FixedHeader,
+		TopicName:       pk.TopicName,
+		Payload:         pk.Payload,
+		Created:         pk.Created,
+		Expiry:          pk.Expiry,
+		ProtocolVersion: pk.ProtocolVersion,
+		Client:          cl.ID,
+		Origin:          pk.Origin,
 		Properties: storage.MessageProperties{
 			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
 			MessageExpiryInterval:  props.MessageExpiryInterval,
 			ContentType:            props.ContentType,
 			ResponseTopic:          props.ResponseTopic,
@@ -282,6 +500,10 @@ func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
 		},
 	}
 
+	if err := h.config.Compression.CompressMessage(in); err != nil {
+		h.Log.Error("failed to compress payload", "error", err, "key", in.ID)
+	}
+
 	h.setKv(in.ID, in)
 }
 
@@ -292,20 +514,45 @@ func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, rese
 		return
 	}
 
+	in := h.message(storage.InflightKey, inflightKey(cl, pk), cl, pk, sent)
+	h.setKv(in.ID, in)
+
+	// queued messages are resent as duplicates once the client reconnects, and are inflight from then on.
+	if pk.FixedHeader.Dup {
+		h.delKv(queuedKey(cl, pk))
+	}
+}
+
+// OnQueuedMessage adds a message queued for a disconnected client to the store.
+func (h *Hook) OnQueuedMessage(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in := h.message(storage.QueuedKey, queuedKey(cl, pk), cl, pk, 0)
+	h.setKv(in.ID, in)
+}
+
+// message returns a storable inflight or queued message, compressing the payload if enabled.
+func (h *Hook) message(t, id string, cl *mqtt.Client, pk packets.Packet, sent int64) *storage.Message {
 	props := pk.Properties.Copy(false)
 	in := &storage.Message{
-		ID:          inflightKey(cl, pk),
-		T:           storage.InflightKey,
-		Client:      cl.ID,
-		Origin:      pk.Origin,
-		PacketID:    pk.PacketID,
-		FixedHeader: pk.FixedHeader,
-		TopicName:   pk.TopicName,
-		Payload:     pk.Payload,
-		Sent:        sent,
-		Created:     pk.Created,
+		ID:              id,
+		T:               t,
+		Client:          cl.ID,
+		Origin:          pk.Origin,
+		PacketID:        pk.PacketID,
+		FixedHeader:     pk.FixedHeader,
+		TopicName:       pk.TopicName,
+		Payload:         pk.Payload,
+		Sent:            sent,
+		Created:         pk.Created,
+		Expiry:          pk.Expiry,
+		ProtocolVersion: pk.ProtocolVersion,
 		Properties: storage.MessageProperties{
 			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
 			MessageExpiryInterval:  props.MessageExpiryInterval,
 			ContentType:            props.ContentType,
 			ResponseTopic:          props.ResponseTopic,
@@ -315,7 +562,12 @@ func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, rese
 			User:                   props.User,
 		},
 	}
-	h.setKv(in.ID, in)
+
+	if err := h.config.Compression.CompressMessage(in); err != nil {
+		h.Log.Error("failed to compress payload", "error", err, "key", in.ID)
+	}
+
+	return in
 }
 
 // OnQosComplete removes a resolved inflight message from the store.
@@ -327,13 +579,15 @@ func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
 	h.delKv(inflightKey(cl, pk))
 }
 
-// OnQosDropped removes a dropped inflight message from the store.
+// OnQosDropped removes a dropped inflight or queued message from the store.
 func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
 	if h.db == nil {
 		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
 	}
 
 	h.OnQosComplete(cl, pk)
+	h.delKv(queuedKey(cl, pk))
 }
 
 // OnSysInfoTick stores the latest system info in the store.
@@ -349,6 +603,7 @@ func (h *Hook) OnSysInfoTick(sys *system.Info) {
 		Info: *sys.Clone(),
 	}
 	h.setKv(in.ID, in)
+	h.logStats()
 }
 
 // OnRetainedExpired deletes expired retained messages from the store.
@@ -376,14 +631,16 @@ func (h *Hook) StoredClients() (v []storage.Client, err error) {
 		return
 	}
 
+	defer h.stats.Read(time.Now(), nil)
+	prefix := []byte(h.config.Namespace.Key(storage.ClientKey))
 	iter, _ := h.db.NewIter(&pebbledb.IterOptions{
-		LowerBound: []byte(storage.ClientKey),
-		UpperBound: keyUpperBound([]byte(storage.ClientKey)),
+		LowerBound: prefix,
+		UpperBound: keyUpperBound(prefix),
 	})
 
 	for iter.First(); iter.Valid(); iter.Next() {
 		item := storage.Client{}
-		if err := item.UnmarshalBinary(iter.Value()); err == nil {
+		if err := h.unmarshal(iter.Key(), iter.Value(), &item); err == nil {
 			v = append(v, item)
 		}
 	}
@@ -397,14 +654,16 @@ func (h *Hook) StoredSubscriptions() (v []storage.Subscription, err error) {
 		return
 	}
 
+	defer h.stats.Read(time.Now(), nil)
+	prefix := []byte(h.config.Namespace.Key(storage.SubscriptionKey))
 	iter, _ := h.db.NewIter(&pebbledb.IterOptions{
-		LowerBound: []byte(storage.SubscriptionKey),
-		UpperBound: keyUpperBound([]byte(storage.SubscriptionKey)),
+		LowerBound: prefix,
+		UpperBound: keyUpperBound(prefix),
 	})
 
 	for iter.First(); iter.Valid(); iter.Next() {
 		item := storage.Subscription{}
-		if err := item.UnmarshalBinary(iter.Value()); err == nil {
+		if err := h.unmarshal(iter.Key(), iter.Value(), &item); err == nil {
 			v = append(v, item)
 		}
 	}
@@ -418,14 +677,16 @@ func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
 		return
 	}
 
+	defer h.stats.Read(time.Now(), nil)
+	prefix := []byte(h.config.Namespace.Key(storage.RetainedKey))
 	iter, _ := h.db.NewIter(&pebbledb.IterOptions{
-		LowerBound: []byte(storage.RetainedKey),
-		UpperBound: keyUpperBound([]byte(storage.RetainedKey)),
+		LowerBound: prefix,
+		UpperBound: keyUpperBound(prefix),
 	})
 
 	for iter.First(); iter.Valid(); iter.Next() {
 		item := storage.Message{}
-		if err := item.UnmarshalBinary(iter.Value()); err == nil {
+		if err := h.unmarshal(iter.Key(), iter.Value(), &item); err == nil {
 			v = append(v, item)
 		}
 	}
@@ -439,20 +700,125 @@ func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
 		return
 	}
 
+	defer h.stats.Read(time.Now(), nil)
+	prefix := []byte(h.config.Namespace.Key(storage.InflightKey))
 	iter, _ := h.db.NewIter(&pebbledb.IterOptions{
-		LowerBound: []byte(storage.InflightKey),
-		UpperBound: keyUpperBound([]byte(storage.InflightKey)),
+		LowerBound: prefix,
+		UpperBound: keyUpperBound(prefix),
 	})
 
 	for iter.First(); iter.Valid(); iter.Next() {
 		item := storage.Message{}
-		if err := item.UnmarshalBinary(iter.Value()); err == nil {
+		if err := h.unmarshal(iter.Key(), iter.Value(), &item); err == nil {
 			v = append(v, item)
 		}
 	}
 	return v, nil
 }
 
+// StoredQueuedMessages returns all messages queued for disconnected clients from the store.
+func (h *Hook) StoredQueuedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	defer h.stats.Read(time.Now(), nil)
+	prefix := []byte(h.config.Namespace.Key(storage.QueuedKey))
+	iter, _ := h.db.NewIter(&pebbledb.IterOptions{
+		LowerBound: prefix,
+		UpperBound: keyUpperBound(prefix),
+	})
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		item := storage.Message{}
+		if err := h.unmarshal(iter.Key(), iter.Value(), &item); err == nil {
+			v = append(v, item)
+		}
+	}
+	return v, nil
+}
+
+// IterClients calls fn with each stored client in the store.
+func (h *Hook) IterClients(fn func(v storage.Client) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	return h.iterKv(storage.ClientKey, func(value []byte) error {
+		obj := storage.Client{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		return fn(obj)
+	})
+}
+
+// IterSubscriptions calls fn with each stored subscription in the store.
+func (h *Hook) IterSubscriptions(fn func(v storage.Subscription) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	return h.iterKv(storage.SubscriptionKey, func(value []byte) error {
+		obj := storage.Subscription{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		return fn(obj)
+	})
+}
+
+// IterRetainedMessages calls fn with each stored retained message in the store.
+func (h *Hook) IterRetainedMessages(fn func(v storage.Message) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	return h.iterKv(storage.RetainedKey, func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		return fn(obj)
+	})
+}
+
+// IterInflightMessages calls fn with each stored inflight message in the store.
+func (h *Hook) IterInflightMessages(fn func(v storage.Message) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	return h.iterKv(storage.InflightKey, func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		return fn(obj)
+	})
+}
+
+// IterQueuedMessages calls fn with each message queued for a disconnected client in the store.
+func (h *Hook) IterQueuedMessages(fn func(v storage.Message) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	return h.iterKv(storage.QueuedKey, func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		return fn(obj)
+	})
+}
+
 // StoredSysInfo returns the system info from the store.
 func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
 	if h.db == nil {
@@ -468,6 +834,62 @@ func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
 	return
 }
 
+// StoredSession returns the stored client, subscriptions, and inflight and queued messages
+// of a single client from the store.
+func (h *Hook) StoredSession(id string) (v storage.Session, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err = h.getKv(storage.ClientKey+"_"+id, &v.Client)
+	if errors.Is(err, pebbledb.ErrNotFound) {
+		return v, nil
+	} else if err != nil {
+		return
+	}
+
+	err = h.iterKv(storage.SubscriptionKey+"_"+id+":", func(value []byte) error {
+		obj := storage.Subscription{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		if obj.Client == id {
+			v.Subscriptions = append(v.Subscriptions, obj)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	err = h.iterKv(storage.InflightKey+"_"+id+":", func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		if obj.Client == id {
+			v.Inflight = append(v.Inflight, obj)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	err = h.iterKv(storage.QueuedKey+"_"+id+":", func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		if obj.Client == id {
+			v.Queued = append(v.Queued, obj)
+		}
+		return nil
+	})
+	return
+}
+
 // Errorf satisfies the pebble interface for an error logger.
 func (h *Hook) Errorf(m string, v ...any) {
 	h.Log.Error(fmt.Sprintf(strings.ToLower(strings.Trim(m, "\n")), v...), "v", v)
@@ -491,7 +913,10 @@ func (h *Hook) Debugf(m string, v ...any) {
 
 // delKv deletes a key-value pair from the database.
 func (h *Hook) delKv(k string) error {
+	k = h.config.Namespace.Key(k)
+	start := time.Now()
 	err := h.db.Delete([]byte(k), h.mode)
+	h.stats.Delete(start, err)
 	if err != nil {
 		h.Log.Error("failed to delete data", "error", err, "key", k)
 		return err
@@ -501,8 +926,15 @@ func (h *Hook) delKv(k string) error {
 
 // setKv stores a key-value pair in the database.
 func (h *Hook) setKv(k string, v storage.Serializable) error {
+	k = h.config.Namespace.Key(k)
 	bs, _ := v.MarshalBinary()
-	err := h.db.Set([]byte(k), bs, h.mode)
+	bs, err := h.crypt.Encrypt([]byte(k), bs)
+	if err == nil {
+		start := time.Now()
+		err = h.db.Set([]byte(k), bs, h.mode)
+		h.stats.Write(start, err)
+	}
+
 	if err != nil {
 		h.Log.Error("failed to update data", "error", err, "key", k)
 		return err
@@ -511,8 +943,18 @@ func (h *Hook) setKv(k string, v storage.Serializable) error {
 }
 
 // getKv retrieves the value associated with a key from the database.
-func (h *Hook) getKv(k string, v storage.Serializable) error {
-	value, closer, err := h.db.Get([]byte(k))
+func (h *Hook) getKv(k string, v storage.Serializable) (err error) {
+	start := time.Now()
+	defer func() {
+		if errors.Is(err, pebbledb.ErrNotFound) {
+			h.stats.Read(start, nil) // a missing key is not a failed read
+		} else {
+			h.stats.Read(start, err)
+		}
+	}()
+
+	key := []byte(h.config.Namespace.Key(k))
+	value, closer, err := h.db.Get(key)
 	if err != nil {
 		return err
 	}
@@ -522,5 +964,211 @@ func (h *Hook) getKv(k string, v storage.Serializable) error {
 			closer.Close()
 		}
 	}()
-	return v.UnmarshalBinary(value)
+	return h.unmarshal(key, value, v)
+}
+
+// iterKv iterates over the decrypted values of keys having the specified prefix in the database.
+func (h *Hook) iterKv(prefix string, visit func([]byte) error) (err error) {
+	defer func(start time.Time) { h.stats.Read(start, err) }(time.Now())
+	prefix = h.config.Namespace.Key(prefix)
+	iter, err := h.db.NewIter(&pebbledb.IterOptions{
+		LowerBound: []byte(prefix),
+		UpperBound: keyUpperBound([]byte(prefix)),
+	})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		value, err := h.crypt.Decrypt(iter.Key(), iter.Value())
+		if err != nil {
+			return err
+		}
+
+		if err := visit(value); err != nil {
+			return err
+		}
+	}
+
+	return iter.Error()
+}
+
+// unmarshal decrypts a value stored under key and decodes it into v.
+func (h *Hook) unmarshal(key, data []byte, v storage.Serializable) error {
+	data, err := h.crypt.Decrypt(key, data)
+	if err != nil {
+		return err
+	}
+
+	return v.UnmarshalBinary(data)
+}
+
+// Backup writes a consistent backup of the records in the store to w.
+func (h *Hook) Backup(w io.Writer) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return storage.Backup(w, records{h: h})
+}
+
+// Restore replaces the records in the store with a backup read from r. It should be
+// called before the server is started, as restored records are only loaded on startup.
+func (h *Hook) Restore(r io.Reader) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	if h.config.ReadOnly {
+		return storage.ErrReadOnly
+	}
+
+	return storage.Restore(r, records{h: h})
+}
+
+// Export writes the clients, subscriptions, retained messages, inflight messages and
+// system info in the store to w as JSON Lines, which can be imported into any storage hook.
+func (h *Hook) Export(w io.Writer) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return storage.Export(w, h)
+}
+
+// Import adds the records of an export read from r to the store, replacing any existing
+// records with the same keys. It should be called before the server is started, as imported
+// records are only loaded on startup.
+func (h *Hook) Import(r io.Reader) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	if h.config.ReadOnly {
+		return storage.ErrReadOnly
+	}
+
+	return storage.Import(r, h.importRecord)
+}
+
+// importRecord stores an imported record under the key used by the hook.
+func (h *Hook) importRecord(v storage.Serializable) error {
+	switch v := v.(type) {
+	case *storage.Client:
+		return h.setKv(clientKey(&mqtt.Client{ID: v.ID}), v)
+	case *storage.Subscription:
+		v.ID = subscriptionKey(&mqtt.Client{ID: v.Client}, v.Filter)
+		return h.setKv(v.ID, v)
+	case *storage.Message:
+		switch v.T {
+		case storage.RetainedKey:
+			v.ID = retainedKey(v.TopicName)
+		case storage.QueuedKey:
+			v.ID = queuedKey(&mqtt.Client{ID: v.Client}, packets.Packet{PacketID: v.PacketID})
+		default:
+			v.ID = inflightKey(&mqtt.Client{ID: v.Client}, packets.Packet{PacketID: v.PacketID})
+		}
+
+		if err := h.config.Compression.CompressMessage(v); err != nil {
+			h.Log.Error("failed to compress payload", "error", err, "key", v.ID)
+		}
+		return h.setKv(v.ID, v)
+	case *storage.SystemInfo:
+		v.ID = sysInfoKey()
+		return h.setKv(v.ID, v)
+	}
+
+	return nil
+}
+
+// migrateSchema upgrades the records of the store to the current schema version. The records
+// of a read-only store are only checked, as they cannot be migrated.
+func (h *Hook) migrateSchema() error {
+	if h.config.ReadOnly {
+		_, err := storage.CheckSchema(records{h: h}, storage.Migrations, storage.SchemaVersion)
+		return err
+	}
+
+	from, err := storage.Migrate(records{h: h}, storage.Migrations, storage.SchemaVersion)
+	if err != nil {
+		return err
+	}
+
+	if from != storage.SchemaVersion {
+		h.Log.Info("migrated storage schema", "from", from, "to", storage.SchemaVersion)
+	}
+
+	return nil
+}
+
+// records provides the raw records of the store to schema migrations.
+type records struct {
+	h *Hook
+}
+
+// SchemaVersion returns the schema version of the store.
+func (r records) SchemaVersion() (int, bool, error) {
+	value, closer, err := r.h.db.Get([]byte(r.h.config.Namespace.Key(storage.SchemaVersionKey)))
+	if errors.Is(err, pebbledb.ErrNotFound) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	defer closer.Close()
+
+	v, err := strconv.Atoi(string(value))
+	return v, err == nil, err
+}
+
+// SetSchemaVersion stores the schema version of the store.
+func (r records) SetSchemaVersion(v int) error {
+	return r.h.db.Set([]byte(r.h.config.Namespace.Key(storage.SchemaVersionKey)), []byte(strconv.Itoa(v)), pebbledb.Sync)
+}
+
+// Each calls visit with the key, without the namespace, and decrypted value of each record
+// in the namespace.
+func (r records) Each(visit func(key string, value []byte) error) error {
+	prefix := []byte(r.h.config.Namespace.Key(""))
+	iter, err := r.h.db.NewIter(&pebbledb.IterOptions{
+		LowerBound: prefix,
+		UpperBound: keyUpperBound(prefix),
+	})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		if string(iter.Key()) == r.h.config.Namespace.Key(storage.SchemaVersionKey) {
+			continue
+		}
+
+		value, err := r.h.crypt.Decrypt(iter.Key(), iter.Value())
+		if err != nil {
+			return err
+		}
+
+		if err := visit(string(iter.Key()[len(prefix):]), append([]byte{}, value...)); err != nil {
+			return err
+		}
+	}
+
+	return iter.Error()
+}
+
+// Set encrypts and sets the value of a record.
+func (r records) Set(key string, value []byte) error {
+	k := []byte(r.h.config.Namespace.Key(key))
+	value, err := r.h.crypt.Encrypt(k, value)
+	if err != nil {
+		return err
+	}
+
+	return r.h.db.Set(k, value, pebbledb.Sync)
+}
+
+// Delete deletes a record.
+func (r records) Delete(key string) error {
+	return r.h.db.Delete([]byte(r.h.config.Namespace.Key(key)), pebbledb.Sync)
 }
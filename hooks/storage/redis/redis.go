@@ -9,6 +9,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
 	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage"
@@ -21,9 +28,36 @@ import (
 // defaultAddr is the default address to the redis service.
 const defaultAddr = "localhost:6379"
 
-// defaultHPrefix is a prefix to better identify hsets created by mochi mqtt.
+// defaultHPrefix is a prefix to better identify keys created by mochi mqtt.
 const defaultHPrefix = "mochi-"
 
+// scanCount is the number of keys requested by each scan, and read by each pipeline.
+const scanCount = 1000
+
+const (
+	defaultHealthCheckInterval = 1000  // the default milliseconds between health checks
+	defaultReconnectBackoff    = 100   // the default milliseconds before the first reconnect attempt
+	defaultMaxReconnectBackoff = 30000 // the default maximum milliseconds between reconnect attempts
+)
+
+var (
+	// ErrUnreachable indicates that the redis service could not be reached.
+	ErrUnreachable = errors.New("redis service unreachable")
+)
+
+// globEscaper escapes the special characters of a redis glob pattern.
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// keyTypes are the types of data stored by the hook.
+var keyTypes = []string{
+	storage.ClientKey,
+	storage.SubscriptionKey,
+	storage.RetainedKey,
+	storage.InflightKey,
+	storage.QueuedKey,
+	storage.SysInfoKey,
+}
+
 // clientKey returns a primary key for a client.
 func clientKey(cl *mqtt.Client) string {
 	return cl.ID
@@ -39,7 +73,7 @@ func retainedKey(topic string) string {
 	return topic
 }
 
-// inflightKey returns a primary key for an inflight message.
+// inflightKey returns a primary key for an inflight or queued message.
 func inflightKey(cl *mqtt.Client, pk packets.Packet) string {
 	return cl.ID + ":" + pk.FormatID()
 }
@@ -49,22 +83,74 @@ func sysInfoKey() string {
 	return storage.SysInfoKey
 }
 
-// Options contains configuration settings for the bolt instance.
+// Options contains configuration settings for the redis instance.
+// A single node is used unless Addresses, MasterName or Cluster are set, in which case
+// a Redis Cluster or a Redis Sentinel monitored master is used.
 type Options struct {
-	Address  string `yaml:"address" json:"address"`
-	Username string `yaml:"username" json:"username"`
-	Password string `yaml:"password" json:"password"`
-	Database int    `yaml:"database" json:"database"`
-	HPrefix  string `yaml:"h_prefix" json:"h_prefix"`
-	Options  *redis.Options
+	Address          string   `yaml:"address" json:"address"`
+	Addresses        []string `yaml:"addresses" json:"addresses"`                   // cluster nodes or sentinel addresses
+	MasterName       string   `yaml:"master_name" json:"master_name"`               // the sentinel master name
+	Cluster          bool     `yaml:"cluster" json:"cluster"`                       // use redis cluster, even with a single seed address
+	ReadFromReplicas bool     `yaml:"read_from_replicas" json:"read_from_replicas"` // route read commands to replicas
+	Username         string   `yaml:"username" json:"username"`
+	Password         string   `yaml:"password" json:"password"`
+	Database         int      `yaml:"database" json:"database"`
+	HPrefix          string   `yaml:"h_prefix" json:"h_prefix"`
+	Options          *redis.Options
+	UniversalOptions *redis.UniversalOptions
+
+	// Compression compresses retained and inflight message payloads above a size threshold.
+	Compression storage.Compression `yaml:"compression" json:"compression"`
+
+	// Encryption encrypts stored values with AES-GCM, if set.
+	Encryption *storage.Encryption `yaml:"encryption" json:"encryption"`
+
+	// Namespace follows HPrefix in the keys of stored values, so several brokers can share
+	// a redis service.
+	Namespace storage.Namespace `yaml:"namespace" json:"namespace"`
+
+	// ReadOnly stops the hook writing to the service, so a standby broker can restore from a
+	// replica. A read-only hook only provides the methods which read from the store.
+	ReadOnly bool `yaml:"read_only" json:"read_only"`
+
+	// HealthCheckInterval is the milliseconds between checks of the connection (default 1000).
+	// While the service is unreachable, reconnects are attempted with an exponential backoff of
+	// ReconnectBackoff (default 100) to MaxReconnectBackoff (default 30000) milliseconds, and up
+	// to WriteBufferSize writes are buffered and replayed once the service can be reached again.
+	// Writes are dropped and counted once the buffer is full, or if WriteBufferSize is 0.
+	HealthCheckInterval int64 `yaml:"health_check_interval" json:"health_check_interval"`
+	ReconnectBackoff    int64 `yaml:"reconnect_backoff" json:"reconnect_backoff"`
+	MaxReconnectBackoff int64 `yaml:"max_reconnect_backoff" json:"max_reconnect_backoff"`
+	WriteBufferSize     int   `yaml:"write_buffer_size" json:"write_buffer_size"`
 }
 
+// Status describes the connection to the redis service.
+type Status struct {
+	Connected  bool   `json:"connected"`       // true if the redis service can be reached
+	Error      string `json:"error,omitempty"` // the error which made the service unreachable
+	Buffered   int    `json:"buffered"`        // the number of writes waiting to be replayed
+	Dropped    int64  `json:"dropped"`         // the total number of writes dropped while unreachable
+	Reconnects int64  `json:"reconnects"`      // the total number of times the service was reconnected
+}
+
+// write is a write to the store, which is buffered while the redis service is unreachable.
+type write func(pipe redis.Pipeliner)
+
 // Hook is a persistent storage hook based using Redis as a backend.
 type Hook struct {
 	mqtt.HookBase
-	config *Options        // options for connecting to the Redis instance.
-	db     *redis.Client   // the Redis instance
-	ctx    context.Context // a context for the connection
+	config     *Options              // options for connecting to the Redis instance.
+	db         redis.UniversalClient // the Redis instance
+	ctx        context.Context       // a context for the connection
+	crypt      *storage.Encryptor    // encrypts stored values, if encryption is enabled
+	mu         sync.Mutex            // protects the connection state and write buffer
+	down       error                 // the error which made the service unreachable, if unreachable
+	buffered   []write               // writes waiting to be replayed once the service is reachable
+	dropped    int64                 // the total number of writes dropped while unreachable
+	reconnects int64                 // the total number of times the service was reconnected
+	done       chan struct{}         // closed to stop the health check loop
+	stopped    chan struct{}         // closed when the health check loop has stopped
+	stats      storage.Recorder      // records the reads, writes and deletes of the hook
 }
 
 // ID returns the id of the hook.
@@ -72,9 +158,22 @@ func (h *Hook) ID() string {
 	return "redis-db"
 }
 
-// Provides indicates which hook methods this hook provides.
+// Provides indicates which hook methods this hook provides. A read-only hook only provides
+// the methods which read from the store.
 func (h *Hook) Provides(b byte) bool {
-	return bytes.Contains([]byte{
+	if bytes.Contains([]byte{
+		mqtt.StoredClients,
+		mqtt.StoredInflightMessages,
+		mqtt.StoredQueuedMessages,
+		mqtt.StoredRetainedMessages,
+		mqtt.StoredSubscriptions,
+		mqtt.StoredSysInfo,
+		mqtt.StoredSession,
+	}, []byte{b}) {
+		return true
+	}
+
+	return (h.config == nil || !h.config.ReadOnly) && bytes.Contains([]byte{
 		mqtt.OnSessionEstablished,
 		mqtt.OnDisconnect,
 		mqtt.OnSubscribed,
@@ -83,21 +182,23 @@ func (h *Hook) Provides(b byte) bool {
 		mqtt.OnQosPublish,
 		mqtt.OnQosComplete,
 		mqtt.OnQosDropped,
+		mqtt.OnQueuedMessage,
 		mqtt.OnWillSent,
 		mqtt.OnSysInfoTick,
 		mqtt.OnClientExpired,
 		mqtt.OnRetainedExpired,
-		mqtt.StoredClients,
-		mqtt.StoredInflightMessages,
-		mqtt.StoredRetainedMessages,
-		mqtt.StoredSubscriptions,
-		mqtt.StoredSysInfo,
 	}, []byte{b})
 }
 
-// hKey returns a hash set key with a unique prefix.
+// hKey returns a key with a unique prefix, and the namespace if set.
 func (h *Hook) hKey(s string) string {
-	return h.config.HPrefix + s
+	return h.config.HPrefix + h.config.Namespace.Key(s)
+}
+
+// key returns the key of a stored value of a type. Each value is stored in its own
+// key, so values are distributed across the slots of a cluster.
+func (h *Hook) key(t, id string) string {
+	return h.hKey(t) + ":" + id
 }
 
 // Init initializes and connects to the redis service.
@@ -107,64 +208,593 @@ func (h *Hook) Init(config any) error {
 	}
 
 	h.ctx = context.Background()
+	h.stopMonitor() // the hook may be reinitialized
 
 	if config == nil {
 		config = new(Options)
 	}
 	h.config = config.(*Options)
-	if h.config.Options == nil {
-		h.config.Options = &redis.Options{
-			Addr: defaultAddr,
+	if err := h.config.Compression.Validate(); err != nil {
+		return err
+	}
+
+	if err := h.config.Namespace.Validate(); err != nil {
+		return err
+	}
+
+	var err error
+	h.crypt, err = storage.NewEncryptor(h.config.Encryption)
+	if err != nil {
+		return err
+	}
+
+	if h.config.Options == nil && h.config.UniversalOptions == nil {
+		if len(h.config.Addresses) > 0 || h.config.MasterName != "" || h.config.Cluster {
+			h.config.UniversalOptions = &redis.UniversalOptions{
+				Addrs:         h.config.Addresses,
+				MasterName:    h.config.MasterName,
+				DB:            h.config.Database,
+				Username:      h.config.Username,
+				Password:      h.config.Password,
+				ReadOnly:      h.config.ReadFromReplicas,
+				RouteRandomly: h.config.ReadFromReplicas,
+			}
+
+			if len(h.config.Addresses) == 0 && h.config.Address != "" {
+				h.config.UniversalOptions.Addrs = []string{h.config.Address}
+			}
+		} else {
+			h.config.Options = &redis.Options{
+				Addr: defaultAddr,
+			}
+			h.config.Options.Addr = h.config.Address
+			h.config.Options.DB = h.config.Database
+			h.config.Options.Username = h.config.Username
+			h.config.Options.Password = h.config.Password
 		}
-		h.config.Options.Addr = h.config.Address
-		h.config.Options.DB = h.config.Database
-		h.config.Options.Username = h.config.Username
-		h.config.Options.Password = h.config.Password
 	}
 
 	if h.config.HPrefix == "" {
 		h.config.HPrefix = defaultHPrefix
 	}
 
-	h.Log.Info(
-		"connecting to redis service",
-		"prefix", h.config.HPrefix,
-		"address", h.config.Options.Addr,
-		"username", h.config.Options.Username,
-		"password-len", len(h.config.Options.Password),
-		"db", h.config.Options.DB,
-	)
+	if h.config.HealthCheckInterval <= 0 {
+		h.config.HealthCheckInterval = defaultHealthCheckInterval
+	}
+
+	if h.config.ReconnectBackoff <= 0 {
+		h.config.ReconnectBackoff = defaultReconnectBackoff
+	}
+
+	if h.config.MaxReconnectBackoff < h.config.ReconnectBackoff {
+		h.config.MaxReconnectBackoff = max(defaultMaxReconnectBackoff, h.config.ReconnectBackoff)
+	}
+
+	if h.config.Options != nil {
+		h.Log.Info(
+			"connecting to redis service",
+			"prefix", h.config.HPrefix,
+			"namespace", h.config.Namespace,
+			"address", h.config.Options.Addr,
+			"username", h.config.Options.Username,
+			"password-len", len(h.config.Options.Password),
+			"db", h.config.Options.DB,
+		)
+	} else {
+		h.Log.Info(
+			"connecting to redis service",
+			"prefix", h.config.HPrefix,
+			"namespace", h.config.Namespace,
+			"addresses", h.config.UniversalOptions.Addrs,
+			"master", h.config.UniversalOptions.MasterName,
+			"cluster", h.config.Cluster,
+			"read-from-replicas", h.config.UniversalOptions.ReadOnly || h.config.UniversalOptions.RouteRandomly,
+			"username", h.config.UniversalOptions.Username,
+			"password-len", len(h.config.UniversalOptions.Password),
+			"db", h.config.UniversalOptions.DB,
+		)
+	}
 
-	h.db = redis.NewClient(h.config.Options)
-	_, err := h.db.Ping(context.Background()).Result()
+	h.db = h.newClient()
+	_, err = h.db.Ping(context.Background()).Result()
 	if err != nil {
 		return fmt.Errorf("failed to ping service: %w", err)
 	}
 
 	h.Log.Info("connected to redis service")
 
+	if err := h.migrate(); err != nil {
+		return err
+	}
+
+	if err := h.migrateSchema(); err != nil {
+		return err
+	}
+
+	h.done = make(chan struct{})
+	h.stopped = make(chan struct{})
+	go h.monitor(h.db, h.done, h.stopped)
+
+	return nil
+}
+
+// newClient returns a single node, cluster, or sentinel client for the configured options.
+func (h *Hook) newClient() redis.UniversalClient {
+	if h.config.Options != nil {
+		return redis.NewClient(h.config.Options)
+	}
+
+	o := h.config.UniversalOptions
+	switch {
+	case o.MasterName != "" && (o.RouteRandomly || o.RouteByLatency):
+		fo := o.Failover()
+		fo.RouteRandomly = o.RouteRandomly
+		fo.RouteByLatency = o.RouteByLatency
+		return redis.NewFailoverClusterClient(fo) // reads are routed to replicas
+	case o.MasterName != "":
+		return redis.NewFailoverClient(o.Failover())
+	case h.config.Cluster || len(o.Addrs) > 1:
+		return redis.NewClusterClient(o.Cluster())
+	default:
+		return redis.NewClient(o.Simple())
+	}
+}
+
+// migrate moves any values stored in the hash sets used by previous versions of the hook
+// into their own keys. A read-only hook cannot move the values, so returns an error if
+// any hash sets remain.
+func (h *Hook) migrate() error {
+	for _, t := range keyTypes {
+		rows, err := h.db.HGetAll(h.ctx, h.hKey(t)).Result()
+		if err != nil {
+			return fmt.Errorf("failed to read %s hash set: %w", h.hKey(t), err)
+		}
+
+		if len(rows) == 0 {
+			continue
+		}
+
+		if h.config.ReadOnly {
+			return fmt.Errorf("%w: %s hash set must be migrated to keys", storage.ErrReadOnly, h.hKey(t))
+		}
+
+		pipe := h.db.Pipeline()
+		for id, row := range rows {
+			pipe.Set(h.ctx, h.key(t, id), row, 0)
+		}
+		pipe.Del(h.ctx, h.hKey(t))
+
+		if _, err := pipe.Exec(h.ctx); err != nil {
+			return fmt.Errorf("failed to migrate %s hash set: %w", h.hKey(t), err)
+		}
+
+		h.Log.Info("migrated redis hash set to keys", "key", h.hKey(t), "count", len(rows))
+	}
+
 	return nil
 }
 
-// Stop closes the redis connection.
+// scanKeys returns the keys of the stored values of a type with ids matching a glob
+// pattern. The keys of a cluster are scanned on each master node.
+func (h *Hook) scanKeys(t, match string) ([]string, error) {
+	var mu sync.Mutex
+	var keys []string
+
+	scan := func(ctx context.Context, c redis.Cmdable) error {
+		iter := c.Scan(ctx, 0, h.key(t, match), scanCount).Iterator()
+		for iter.Next(ctx) {
+			mu.Lock()
+			keys = append(keys, iter.Val())
+			mu.Unlock()
+		}
+		return iter.Err()
+	}
+
+	var err error
+	if cc, ok := h.db.(*redis.ClusterClient); ok {
+		err = cc.ForEachMaster(h.ctx, func(ctx context.Context, c *redis.Client) error {
+			return scan(ctx, c)
+		})
+	} else {
+		err = scan(h.ctx, h.db)
+	}
+
+	return keys, err
+}
+
+// storedValue is a stored value and the key it is stored under.
+type storedValue struct {
+	key  string
+	data string
+}
+
+// getAll returns all stored values of a type, read using pipelines of scanCount keys.
+// Values deleted after their key was scanned are skipped.
+func (h *Hook) getAll(t string) ([]storedValue, error) {
+	return h.getMatching(t, "*")
+}
+
+// getMatching returns the stored values of a type with ids matching a glob pattern.
+func (h *Hook) getMatching(t, match string) ([]storedValue, error) {
+	rows := []storedValue{}
+	err := h.eachMatching(t, match, func(key, row string) error {
+		rows = append(rows, storedValue{key: key, data: row})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+// eachMatching calls visit with the key and value of each stored value of a type with an id
+// matching a glob pattern, reading the values using pipelines of scanCount keys. Values
+// deleted after their key was scanned are skipped.
+func (h *Hook) eachMatching(t, match string, visit func(key, row string) error) (err error) {
+	defer func(start time.Time) { h.stats.Read(start, err) }(time.Now())
+	keys, err := h.scanKeys(t, match)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(keys); i += scanCount {
+		pipe := h.db.Pipeline()
+		cmds := make([]*redis.StringCmd, 0, scanCount)
+		batch := keys[i:min(i+scanCount, len(keys))]
+		for _, k := range batch {
+			cmds = append(cmds, pipe.Get(h.ctx, k))
+		}
+
+		if _, err := pipe.Exec(h.ctx); err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+
+		for j, cmd := range cmds {
+			if row, err := cmd.Result(); err == nil {
+				if err := visit(batch[j], row); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Stop closes the redis connection. Any buffered writes are replayed if the redis
+// service can be reached, and are otherwise discarded.
 func (h *Hook) Stop() error {
 	h.Log.Info("disconnecting from redis service")
 
+	h.stopMonitor()
+
+	if h.Status().Buffered > 0 && !h.reconnect() {
+		h.Log.Warn("discarding buffered writes", "writes", h.Status().Buffered)
+	}
+
 	return h.db.Close()
 }
 
-// OnSessionEstablished adds a client to the store when their session is established.
+// Health returns an error if the redis service is unreachable. The service is pinged
+// unless it is already known to be unreachable from a failed write or health check.
+func (h *Hook) Health() error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	if h.Status().Connected {
+		if err := h.db.Ping(h.ctx).Err(); err != nil {
+			h.setUnreachable(err)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.down != nil {
+		return fmt.Errorf("%w: %w", ErrUnreachable, h.down)
+	}
+
+	return nil
+}
+
+// StorageStats returns the counters and latencies of the reads, writes and deletes of the hook.
+func (h *Hook) StorageStats() storage.Stats {
+	return h.stats.Stats()
+}
+
+// Status returns the state of the connection to the redis service, and the number of
+// writes buffered or dropped while it was unreachable.
+func (h *Hook) Status() Status {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := Status{
+		Connected:  h.down == nil,
+		Buffered:   len(h.buffered),
+		Dropped:    h.dropped,
+		Reconnects: h.reconnects,
+	}
+
+	if h.down != nil {
+		s.Error = h.down.Error()
+	}
+
+	return s
+}
+
+// monitor pings the redis service through db every HealthCheckInterval milliseconds until done is
+// closed. While the service is unreachable, it is pinged with an exponential backoff
+// until it can be reached, at which point any buffered writes are replayed.
+func (h *Hook) monitor(db redis.UniversalClient, done, stopped chan struct{}) {
+	defer close(stopped)
+
+	interval := time.Duration(h.config.HealthCheckInterval) * time.Millisecond
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	var retry time.Duration
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+
+		err := db.Ping(h.ctx).Err()
+		if err == nil && h.reconnect() {
+			retry = 0
+			timer.Reset(interval)
+			continue
+		}
+
+		if err != nil {
+			h.setUnreachable(err)
+		}
+
+		retry = min(max(retry*2, time.Duration(h.config.ReconnectBackoff)*time.Millisecond), time.Duration(h.config.MaxReconnectBackoff)*time.Millisecond)
+		timer.Reset(retry)
+	}
+}
+
+// stopMonitor stops the health check loop, if it is running.
+func (h *Hook) stopMonitor() {
+	if h.done != nil {
+		close(h.done)
+		<-h.stopped
+		h.done = nil
+	}
+}
+
+// setUnreachable marks the redis service as unreachable because of err.
+func (h *Hook) setUnreachable(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.down == nil {
+		h.Log.Warn("redis service unreachable", "error", err, "buffer", h.config.WriteBufferSize)
+	}
+
+	h.down = err
+}
+
+// reconnect replays any buffered writes and marks the redis service as reachable,
+// returning false if the service could not be reached.
+func (h *Hook) reconnect() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.down == nil && len(h.buffered) == 0 {
+		return true
+	}
+
+	if len(h.buffered) > 0 {
+		pipe := h.db.Pipeline()
+		for _, w := range h.buffered {
+			w(pipe)
+		}
+
+		if _, err := pipe.Exec(h.ctx); err != nil {
+			if isUnreachable(err) {
+				h.down = err
+				return false
+			}
+
+			h.Log.Error("failed to replay buffered writes", "error", err, "writes", len(h.buffered))
+		}
+	}
+
+	if h.down != nil {
+		h.reconnects++
+		h.Log.Info("reconnected to redis service", "replayed", len(h.buffered), "dropped", h.dropped)
+	}
+
+	h.down = nil
+	h.buffered = nil
+	return true
+}
+
+// exec runs writes in a single pipeline. While the redis service is unreachable, the
+// writes are buffered to be replayed once it can be reached, or are dropped if the
+// buffer is full.
+func (h *Hook) exec(writes ...write) error {
+	h.mu.Lock()
+	if h.down != nil {
+		h.buffer(writes)
+		h.mu.Unlock()
+		return nil
+	}
+	h.mu.Unlock()
+
+	pipe := h.db.Pipeline()
+	for _, w := range writes {
+		w(pipe)
+	}
+
+	start := time.Now()
+	cmds, err := pipe.Exec(h.ctx)
+	h.record(start, cmds)
+	if err != nil && isUnreachable(err) {
+		h.setUnreachable(err)
+		h.mu.Lock()
+		h.buffer(writes)
+		h.mu.Unlock()
+		return nil
+	}
+
+	return err
+}
+
+// record records the commands of an executed pipeline as writes and deletes.
+func (h *Hook) record(start time.Time, cmds []redis.Cmder) {
+	for _, cmd := range cmds {
+		err := cmd.Err()
+		if errors.Is(err, redis.Nil) {
+			err = nil
+		}
+
+		if cmd.Name() == "del" {
+			h.stats.Delete(start, err)
+		} else {
+			h.stats.Write(start, err)
+		}
+	}
+}
+
+// recordGet records a read of a single key, where a missing key is not a failed read.
+func (h *Hook) recordGet(start time.Time, err error) {
+	if errors.Is(err, redis.Nil) {
+		err = nil
+	}
+	h.stats.Read(start, err)
+}
+
+// buffer adds writes to the buffer, or drops them if the buffer is full. The caller
+// must hold the lock.
+func (h *Hook) buffer(writes []write) {
+	if len(h.buffered)+len(writes) > h.config.WriteBufferSize {
+		h.dropped += int64(len(writes))
+		return
+	}
+
+	h.buffered = append(h.buffered, writes...)
+}
+
+// set returns a write which sets the value of a key, with a ttl.
+func (h *Hook) set(key string, v storage.Serializable, ttl time.Duration) write {
+	value := h.seal(key, v)
+	return func(pipe redis.Pipeliner) {
+		pipe.Set(h.ctx, key, value, ttl)
+	}
+}
+
+// del returns a write which deletes a key.
+func (h *Hook) del(key string) write {
+	return func(pipe redis.Pipeliner) {
+		pipe.Del(h.ctx, key)
+	}
+}
+
+// isUnreachable returns true if err indicates the redis service could not be reached,
+// rather than that a command failed.
+func isUnreachable(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// sessionTTL returns the time a client's session is kept after the client disconnects,
+// or 0 if the session does not expire.
+func (h *Hook) sessionTTL(cl *mqtt.Client) time.Duration {
+	expire := uint32(math.MaxUint32)
+	if h.Opts != nil && h.Opts.Capabilities != nil {
+		expire = h.Opts.Capabilities.MaximumSessionExpiryInterval
+	}
+
+	if cl.Properties.ProtocolVersion == 5 && cl.Properties.Props.SessionExpiryIntervalFlag {
+		expire = cl.Properties.Props.SessionExpiryInterval
+	}
+
+	if expire == math.MaxUint32 { // the session does not expire
+		return 0
+	}
+
+	return time.Duration(expire) * time.Second
+}
+
+// messageTTL returns the time remaining until a message expires, or 0 if the message does
+// not expire. Messages are expired by the message expiry interval, or by the server's
+// maximum message expiry interval.
+func (h *Hook) messageTTL(pk packets.Packet) time.Duration {
+	expiry := pk.Expiry
+	if h.Opts != nil && h.Opts.Capabilities != nil && h.Opts.Capabilities.MaximumMessageExpiryInterval > 0 && pk.Created > 0 {
+		enforced := pk.Created + h.Opts.Capabilities.MaximumMessageExpiryInterval
+		if expiry <= 0 || enforced < expiry {
+			expiry = enforced
+		}
+	}
+
+	if expiry <= 0 {
+		return 0
+	}
+
+	return max(time.Until(time.Unix(expiry, 0)), time.Second)
+}
+
+// expireSession sets the ttl of the client, subscription, and inflight message keys of
+// a client's session, or removes their ttl if ttl is 0. Inflight messages never outlive
+// their own message expiry.
+func (h *Hook) expireSession(cl *mqtt.Client, ttl time.Duration) {
+	var writes []write
+	expire := func(key string, ttl time.Duration) {
+		writes = append(writes, func(pipe redis.Pipeliner) {
+			if ttl > 0 {
+				pipe.Expire(h.ctx, key, ttl)
+			} else {
+				pipe.Persist(h.ctx, key)
+			}
+		})
+	}
+
+	expire(h.key(storage.ClientKey, clientKey(cl)), ttl)
+	if cl.State.Subscriptions != nil {
+		for filter := range cl.State.Subscriptions.GetAll() {
+			expire(h.key(storage.SubscriptionKey, subscriptionKey(cl, filter)), ttl)
+		}
+	}
+
+	if cl.State.Inflight != nil {
+		for _, pk := range cl.State.Inflight.GetAll(false) {
+			mt := h.messageTTL(pk)
+			if ttl > 0 && (mt == 0 || ttl < mt) {
+				mt = ttl
+			}
+			expire(h.key(storage.InflightKey, inflightKey(cl, pk)), mt)
+			expire(h.key(storage.QueuedKey, inflightKey(cl, pk)), mt)
+		}
+	}
+
+	err := h.exec(writes...)
+	if err != nil {
+		h.Log.Error("failed to set session expiry", "error", err, "id", clientKey(cl), "ttl", ttl)
+	}
+}
+
+// OnSessionEstablished adds a client to the store when their session is established,
+// and removes the expiry from any keys of a resumed session.
 func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
-	h.updateClient(cl)
+	h.updateClient(cl, 0)
+	if h.db != nil {
+		h.expireSession(cl, 0)
+	}
 }
 
 // OnWillSent is called when a client sends a Will Message and the Will Message is removed from the client record.
 func (h *Hook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
-	h.updateClient(cl)
+	h.updateClient(cl, redis.KeepTTL)
 }
 
-// updateClient writes the client data to the store.
-func (h *Hook) updateClient(cl *mqtt.Client) {
+// updateClient writes the client data to the store, with a ttl.
+func (h *Hook) updateClient(cl *mqtt.Client, ttl time.Duration) {
 	if h.db == nil {
 		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
 		return
@@ -193,28 +823,32 @@ func (h *Hook) updateClient(cl *mqtt.Client) {
 		Will: storage.ClientWill(cl.Properties.Will),
 	}
 
-	err := h.db.HSet(h.ctx, h.hKey(storage.ClientKey), clientKey(cl), in).Err()
+	err := h.exec(h.set(h.key(storage.ClientKey, clientKey(cl)), in, ttl))
 	if err != nil {
-		h.Log.Error("failed to hset client data", "error", err, "data", in)
+		h.Log.Error("failed to set client data", "error", err, "data", in)
 	}
 }
 
-// OnDisconnect removes a client from the store if they were using a clean session.
+// OnDisconnect removes a client from the store if they were using a clean session, or
+// otherwise sets the keys of the session to expire after the session expiry interval.
 func (h *Hook) OnDisconnect(cl *mqtt.Client, _ error, expire bool) {
 	if h.db == nil {
 		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
 		return
 	}
 
-	if !expire {
+	if cl.StopCause() == packets.ErrSessionTakenOver {
 		return
 	}
 
-	if cl.StopCause() == packets.ErrSessionTakenOver {
+	if !expire {
+		if ttl := h.sessionTTL(cl); ttl > 0 {
+			h.expireSession(cl, ttl)
+		}
 		return
 	}
 
-	err := h.db.HDel(h.ctx, h.hKey(storage.ClientKey), clientKey(cl)).Err()
+	err := h.exec(h.del(h.key(storage.ClientKey, clientKey(cl))))
 	if err != nil {
 		h.Log.Error("failed to delete client", "error", err, "id", clientKey(cl))
 	}
@@ -241,9 +875,9 @@ func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []by
 			RetainAsPublished: pk.Filters[i].RetainAsPublished,
 		}
 
-		err := h.db.HSet(h.ctx, h.hKey(storage.SubscriptionKey), subscriptionKey(cl, pk.Filters[i].Filter), in).Err()
+		err := h.exec(h.set(h.key(storage.SubscriptionKey, subscriptionKey(cl, pk.Filters[i].Filter)), in, 0))
 		if err != nil {
-			h.Log.Error("failed to hset subscription data", "error", err, "data", in)
+			h.Log.Error("failed to set subscription data", "error", err, "data", in)
 		}
 	}
 }
@@ -256,7 +890,7 @@ func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
 	}
 
 	for i := 0; i < len(pk.Filters); i++ {
-		err := h.db.HDel(h.ctx, h.hKey(storage.SubscriptionKey), subscriptionKey(cl, pk.Filters[i].Filter)).Err()
+		err := h.exec(h.del(h.key(storage.SubscriptionKey, subscriptionKey(cl, pk.Filters[i].Filter))))
 		if err != nil {
 			h.Log.Error("failed to delete subscription data", "error", err, "id", clientKey(cl))
 		}
@@ -271,7 +905,7 @@ func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
 	}
 
 	if r == -1 {
-		err := h.db.HDel(h.ctx, h.hKey(storage.RetainedKey), retainedKey(pk.TopicName)).Err()
+		err := h.exec(h.del(h.key(storage.RetainedKey, retainedKey(pk.TopicName))))
 		if err != nil {
 			h.Log.Error("failed to delete retained message data", "error", err, "id", retainedKey(pk.TopicName))
 		}
@@ -281,16 +915,19 @@ func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
 
 	props := pk.Properties.Copy(false)
 	in := &storage.Message{
-		ID:          retainedKey(pk.TopicName),
-		T:           storage.RetainedKey,
-		FixedHeader: pk.FixedHeader,
-		TopicName:   pk.TopicName,
-		Payload:     pk.Payload,
-		Created:     pk.Created,
-		Client:      cl.ID,
-		Origin:      pk.Origin,
+		ID:              retainedKey(pk.TopicName),
+		T:               storage.RetainedKey,
+		FixedHeader:     pk.FixedHeader,
+		TopicName:       pk.TopicName,
+		Payload:         pk.Payload,
+		Created:         pk.Created,
+		Expiry:          pk.Expiry,
+		ProtocolVersion: pk.ProtocolVersion,
+		Client:          cl.ID,
+		Origin:          pk.Origin,
 		Properties: storage.MessageProperties{
 			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
 			MessageExpiryInterval:  props.MessageExpiryInterval,
 			ContentType:            props.ContentType,
 			ResponseTopic:          props.ResponseTopic,
@@ -301,9 +938,13 @@ func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
 		},
 	}
 
-	err := h.db.HSet(h.ctx, h.hKey(storage.RetainedKey), retainedKey(pk.TopicName), in).Err()
+	if err := h.config.Compression.CompressMessage(in); err != nil {
+		h.Log.Error("failed to compress payload", "error", err, "key", in.ID)
+	}
+
+	err := h.exec(h.set(h.key(storage.RetainedKey, retainedKey(pk.TopicName)), in, h.messageTTL(pk)))
 	if err != nil {
-		h.Log.Error("failed to hset retained message data", "error", err, "data", in)
+		h.Log.Error("failed to set retained message data", "error", err, "data", in)
 	}
 }
 
@@ -314,19 +955,52 @@ func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, rese
 		return
 	}
 
+	in := h.message(storage.InflightKey, inflightKey(cl, pk), cl, pk, sent)
+	writes := []write{h.set(h.key(storage.InflightKey, inflightKey(cl, pk)), in, h.messageTTL(pk))}
+
+	// queued messages are resent as duplicates once the client reconnects, and are inflight from then on.
+	if pk.FixedHeader.Dup {
+		writes = append(writes, h.del(h.key(storage.QueuedKey, inflightKey(cl, pk))))
+	}
+
+	if err := h.exec(writes...); err != nil {
+		h.Log.Error("failed to set qos inflight message data", "error", err, "data", in)
+	}
+}
+
+// OnQueuedMessage adds a message queued for a disconnected client to the store.
+func (h *Hook) OnQueuedMessage(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in := h.message(storage.QueuedKey, inflightKey(cl, pk), cl, pk, 0)
+	err := h.exec(h.set(h.key(storage.QueuedKey, inflightKey(cl, pk)), in, h.messageTTL(pk)))
+	if err != nil {
+		h.Log.Error("failed to set queued message data", "error", err, "data", in)
+	}
+}
+
+// message returns a storable inflight or queued message, compressing the payload if enabled.
+func (h *Hook) message(t, id string, cl *mqtt.Client, pk packets.Packet, sent int64) *storage.Message {
 	props := pk.Properties.Copy(false)
 	in := &storage.Message{
-		ID:          inflightKey(cl, pk),
-		T:           storage.InflightKey,
-		Client:      cl.ID,
-		Origin:      pk.Origin,
-		FixedHeader: pk.FixedHeader,
-		TopicName:   pk.TopicName,
-		Payload:     pk.Payload,
-		Sent:        sent,
-		Created:     pk.Created,
+		ID:              id,
+		T:               t,
+		Client:          cl.ID,
+		Origin:          pk.Origin,
+		PacketID:        pk.PacketID,
+		FixedHeader:     pk.FixedHeader,
+		TopicName:       pk.TopicName,
+		Payload:         pk.Payload,
+		Sent:            sent,
+		Created:         pk.Created,
+		Expiry:          pk.Expiry,
+		ProtocolVersion: pk.ProtocolVersion,
 		Properties: storage.MessageProperties{
 			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
 			MessageExpiryInterval:  props.MessageExpiryInterval,
 			ContentType:            props.ContentType,
 			ResponseTopic:          props.ResponseTopic,
@@ -337,10 +1011,11 @@ func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, rese
 		},
 	}
 
-	err := h.db.HSet(h.ctx, h.hKey(storage.InflightKey), inflightKey(cl, pk), in).Err()
-	if err != nil {
-		h.Log.Error("failed to hset qos inflight message data", "error", err, "data", in)
+	if err := h.config.Compression.CompressMessage(in); err != nil {
+		h.Log.Error("failed to compress payload", "error", err, "key", in.ID)
 	}
+
+	return in
 }
 
 // OnQosComplete removes a resolved inflight message from the store.
@@ -350,19 +1025,24 @@ func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
 		return
 	}
 
-	err := h.db.HDel(h.ctx, h.hKey(storage.InflightKey), inflightKey(cl, pk)).Err()
+	err := h.exec(h.del(h.key(storage.InflightKey, inflightKey(cl, pk))))
 	if err != nil {
 		h.Log.Error("failed to delete qos inflight message data", "error", err, "id", inflightKey(cl, pk))
 	}
 }
 
-// OnQosDropped removes a dropped inflight message from the store.
+// OnQosDropped removes a dropped inflight or queued message from the store.
 func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
 	if h.db == nil {
 		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
 	}
 
 	h.OnQosComplete(cl, pk)
+	err := h.exec(h.del(h.key(storage.QueuedKey, inflightKey(cl, pk))))
+	if err != nil {
+		h.Log.Error("failed to delete queued message data", "error", err, "id", inflightKey(cl, pk))
+	}
 }
 
 // OnSysInfoTick stores the latest system info in the store.
@@ -378,9 +1058,9 @@ func (h *Hook) OnSysInfoTick(sys *system.Info) {
 		Info: *sys,
 	}
 
-	err := h.db.HSet(h.ctx, h.hKey(storage.SysInfoKey), sysInfoKey(), in).Err()
+	err := h.exec(h.set(h.key(storage.SysInfoKey, sysInfoKey()), in, 0))
 	if err != nil {
-		h.Log.Error("failed to hset server info data", "error", err, "data", in)
+		h.Log.Error("failed to set server info data", "error", err, "data", in)
 	}
 }
 
@@ -391,7 +1071,7 @@ func (h *Hook) OnRetainedExpired(filter string) {
 		return
 	}
 
-	err := h.db.HDel(h.ctx, h.hKey(storage.RetainedKey), retainedKey(filter)).Err()
+	err := h.exec(h.del(h.key(storage.RetainedKey, retainedKey(filter))))
 	if err != nil {
 		h.Log.Error("failed to delete expired retained message", "error", err, "id", retainedKey(filter))
 	}
@@ -404,7 +1084,7 @@ func (h *Hook) OnClientExpired(cl *mqtt.Client) {
 		return
 	}
 
-	err := h.db.HDel(h.ctx, h.hKey(storage.ClientKey), clientKey(cl)).Err()
+	err := h.exec(h.del(h.key(storage.ClientKey, clientKey(cl))))
 	if err != nil {
 		h.Log.Error("failed to delete expired client", "error", err, "id", clientKey(cl))
 	}
@@ -417,16 +1097,16 @@ func (h *Hook) StoredClients() (v []storage.Client, err error) {
 		return
 	}
 
-	rows, err := h.db.HGetAll(h.ctx, h.hKey(storage.ClientKey)).Result()
-	if err != nil && !errors.Is(err, redis.Nil) {
-		h.Log.Error("failed to HGetAll client data", "error", err)
+	rows, err := h.getAll(storage.ClientKey)
+	if err != nil {
+		h.Log.Error("failed to read client data", "error", err)
 		return
 	}
 
 	for _, row := range rows {
 		var d storage.Client
-		if err = d.UnmarshalBinary([]byte(row)); err != nil {
-			h.Log.Error("failed to unmarshal client data", "error", err, "data", row)
+		if err = h.unmarshal(row.key, []byte(row.data), &d); err != nil {
+			h.Log.Error("failed to unmarshal client data", "error", err, "data", row.data)
 		}
 
 		v = append(v, d)
@@ -442,16 +1122,16 @@ func (h *Hook) StoredSubscriptions() (v []storage.Subscription, err error) {
 		return
 	}
 
-	rows, err := h.db.HGetAll(h.ctx, h.hKey(storage.SubscriptionKey)).Result()
-	if err != nil && !errors.Is(err, redis.Nil) {
-		h.Log.Error("failed to HGetAll subscription data", "error", err)
+	rows, err := h.getAll(storage.SubscriptionKey)
+	if err != nil {
+		h.Log.Error("failed to read subscription data", "error", err)
 		return
 	}
 
 	for _, row := range rows {
 		var d storage.Subscription
-		if err = d.UnmarshalBinary([]byte(row)); err != nil {
-			h.Log.Error("failed to unmarshal subscription data", "error", err, "data", row)
+		if err = h.unmarshal(row.key, []byte(row.data), &d); err != nil {
+			h.Log.Error("failed to unmarshal subscription data", "error", err, "data", row.data)
 		}
 
 		v = append(v, d)
@@ -467,16 +1147,16 @@ func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
 		return
 	}
 
-	rows, err := h.db.HGetAll(h.ctx, h.hKey(storage.RetainedKey)).Result()
-	if err != nil && !errors.Is(err, redis.Nil) {
-		h.Log.Error("failed to HGetAll retained message data", "error", err)
+	rows, err := h.getAll(storage.RetainedKey)
+	if err != nil {
+		h.Log.Error("failed to read retained message data", "error", err)
 		return
 	}
 
 	for _, row := range rows {
 		var d storage.Message
-		if err = d.UnmarshalBinary([]byte(row)); err != nil {
-			h.Log.Error("failed to unmarshal retained message data", "error", err, "data", row)
+		if err = h.unmarshal(row.key, []byte(row.data), &d); err != nil {
+			h.Log.Error("failed to unmarshal retained message data", "error", err, "data", row.data)
 		}
 
 		v = append(v, d)
@@ -492,16 +1172,16 @@ func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
 		return
 	}
 
-	rows, err := h.db.HGetAll(h.ctx, h.hKey(storage.InflightKey)).Result()
-	if err != nil && !errors.Is(err, redis.Nil) {
-		h.Log.Error("failed to HGetAll inflight message data", "error", err)
+	rows, err := h.getAll(storage.InflightKey)
+	if err != nil {
+		h.Log.Error("failed to read inflight message data", "error", err)
 		return
 	}
 
 	for _, row := range rows {
 		var d storage.Message
-		if err = d.UnmarshalBinary([]byte(row)); err != nil {
-			h.Log.Error("failed to unmarshal inflight message data", "error", err, "data", row)
+		if err = h.unmarshal(row.key, []byte(row.data), &d); err != nil {
+			h.Log.Error("failed to unmarshal inflight message data", "error", err, "data", row.data)
 		}
 
 		v = append(v, d)
@@ -510,6 +1190,121 @@ func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
 	return v, nil
 }
 
+// StoredQueuedMessages returns all messages queued for disconnected clients from the store.
+func (h *Hook) StoredQueuedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.getAll(storage.QueuedKey)
+	if err != nil {
+		h.Log.Error("failed to read queued message data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Message
+		if err = h.unmarshal(row.key, []byte(row.data), &d); err != nil {
+			h.Log.Error("failed to unmarshal queued message data", "error", err, "data", row.data)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// IterClients calls fn with each stored client in the store.
+func (h *Hook) IterClients(fn func(v storage.Client) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	return h.eachMatching(storage.ClientKey, "*", func(key, row string) error {
+		var d storage.Client
+		if err := h.unmarshal(key, []byte(row), &d); err != nil {
+			h.Log.Error("failed to unmarshal client data", "error", err, "data", row)
+			return nil
+		}
+
+		return fn(d)
+	})
+}
+
+// IterSubscriptions calls fn with each stored subscription in the store.
+func (h *Hook) IterSubscriptions(fn func(v storage.Subscription) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	return h.eachMatching(storage.SubscriptionKey, "*", func(key, row string) error {
+		var d storage.Subscription
+		if err := h.unmarshal(key, []byte(row), &d); err != nil {
+			h.Log.Error("failed to unmarshal subscription data", "error", err, "data", row)
+			return nil
+		}
+
+		return fn(d)
+	})
+}
+
+// IterRetainedMessages calls fn with each stored retained message in the store.
+func (h *Hook) IterRetainedMessages(fn func(v storage.Message) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	return h.eachMatching(storage.RetainedKey, "*", func(key, row string) error {
+		var d storage.Message
+		if err := h.unmarshal(key, []byte(row), &d); err != nil {
+			h.Log.Error("failed to unmarshal retained message data", "error", err, "data", row)
+			return nil
+		}
+
+		return fn(d)
+	})
+}
+
+// IterInflightMessages calls fn with each stored inflight message in the store.
+func (h *Hook) IterInflightMessages(fn func(v storage.Message) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	return h.eachMatching(storage.InflightKey, "*", func(key, row string) error {
+		var d storage.Message
+		if err := h.unmarshal(key, []byte(row), &d); err != nil {
+			h.Log.Error("failed to unmarshal inflight message data", "error", err, "data", row)
+			return nil
+		}
+
+		return fn(d)
+	})
+}
+
+// IterQueuedMessages calls fn with each message queued for a disconnected client in the store.
+func (h *Hook) IterQueuedMessages(fn func(v storage.Message) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	return h.eachMatching(storage.QueuedKey, "*", func(key, row string) error {
+		var d storage.Message
+		if err := h.unmarshal(key, []byte(row), &d); err != nil {
+			h.Log.Error("failed to unmarshal queued message data", "error", err, "data", row)
+			return nil
+		}
+
+		return fn(d)
+	})
+}
+
 // StoredSysInfo returns the system info from the store.
 func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
 	if h.db == nil {
@@ -517,14 +1312,290 @@ func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
 		return
 	}
 
-	row, err := h.db.HGet(h.ctx, h.hKey(storage.SysInfoKey), storage.SysInfoKey).Result()
+	start := time.Now()
+	key := h.key(storage.SysInfoKey, sysInfoKey())
+	row, err := h.db.Get(h.ctx, key).Result()
+	h.recordGet(start, err)
 	if err != nil && !errors.Is(err, redis.Nil) {
 		return
 	}
 
-	if err = v.UnmarshalBinary([]byte(row)); err != nil {
+	if err = h.unmarshal(key, []byte(row), &v); err != nil {
 		h.Log.Error("failed to unmarshal sys info data", "error", err, "data", row)
 	}
 
 	return v, nil
 }
+
+// StoredSession returns the stored client, subscriptions, and inflight and queued messages
+// of a single client from the store.
+func (h *Hook) StoredSession(id string) (v storage.Session, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	start := time.Now()
+	key := h.key(storage.ClientKey, id)
+	row, err := h.db.Get(h.ctx, key).Result()
+	h.recordGet(start, err)
+	if errors.Is(err, redis.Nil) {
+		return v, nil
+	} else if err != nil {
+		return
+	}
+
+	if err = h.unmarshal(key, []byte(row), &v.Client); err != nil {
+		return
+	}
+
+	match := globEscaper.Replace(id) + ":*"
+	rows, err := h.getMatching(storage.SubscriptionKey, match)
+	if err != nil {
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Subscription
+		if err = h.unmarshal(row.key, []byte(row.data), &d); err != nil {
+			return
+		}
+
+		if d.Client == id {
+			v.Subscriptions = append(v.Subscriptions, d)
+		}
+	}
+
+	rows, err = h.getMatching(storage.InflightKey, match)
+	if err != nil {
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Message
+		if err = h.unmarshal(row.key, []byte(row.data), &d); err != nil {
+			return
+		}
+
+		if d.Client == id {
+			v.Inflight = append(v.Inflight, d)
+		}
+	}
+
+	rows, err = h.getMatching(storage.QueuedKey, match)
+	if err != nil {
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Message
+		if err = h.unmarshal(row.key, []byte(row.data), &d); err != nil {
+			return
+		}
+
+		if d.Client == id {
+			v.Queued = append(v.Queued, d)
+		}
+	}
+
+	return v, nil
+}
+
+// unmarshal decrypts a value stored under key and decodes it into v.
+func (h *Hook) unmarshal(key string, data []byte, v storage.Serializable) error {
+	data, err := h.crypt.Decrypt([]byte(key), data)
+	if err != nil {
+		return err
+	}
+
+	return v.UnmarshalBinary(data)
+}
+
+// sealed is a value which is encrypted when it is marshalled for storage under key.
+type sealed struct {
+	key   string
+	v     storage.Serializable
+	crypt *storage.Encryptor
+}
+
+// MarshalBinary encodes and encrypts the value.
+func (s sealed) MarshalBinary() ([]byte, error) {
+	data, err := s.v.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.crypt.Encrypt([]byte(s.key), data)
+}
+
+// seal returns a value which is encrypted when it is written under key, if encryption is enabled.
+func (h *Hook) seal(key string, v storage.Serializable) any {
+	if h.crypt == nil {
+		return v
+	}
+
+	return sealed{key: key, v: v, crypt: h.crypt}
+}
+
+// Backup writes a backup of the records in the store to w. Records are read
+// individually, so the backup is not a point-in-time snapshot if the store is in use.
+func (h *Hook) Backup(w io.Writer) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return storage.Backup(w, records{h: h})
+}
+
+// Restore replaces the records in the store with a backup read from r. It should be
+// called before the server is started, as restored records are only loaded on startup.
+func (h *Hook) Restore(r io.Reader) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	if h.config.ReadOnly {
+		return storage.ErrReadOnly
+	}
+
+	return storage.Restore(r, records{h: h})
+}
+
+// Export writes the clients, subscriptions, retained messages, inflight messages and
+// system info in the store to w as JSON Lines, which can be imported into any storage hook.
+func (h *Hook) Export(w io.Writer) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return storage.Export(w, h)
+}
+
+// Import adds the records of an export read from r to the store, replacing any existing
+// records with the same keys. Imported records are stored without a ttl, and expired sessions
+// and messages are removed by the server when they are loaded. It should be called before the
+// server is started, as imported records are only loaded on startup.
+func (h *Hook) Import(r io.Reader) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	if h.config.ReadOnly {
+		return storage.ErrReadOnly
+	}
+
+	return storage.Import(r, h.importRecord)
+}
+
+// importRecord stores an imported record under the key used by the hook.
+func (h *Hook) importRecord(v storage.Serializable) error {
+	var key string
+	switch v := v.(type) {
+	case *storage.Client:
+		key = h.key(storage.ClientKey, clientKey(&mqtt.Client{ID: v.ID}))
+	case *storage.Subscription:
+		v.ID = subscriptionKey(&mqtt.Client{ID: v.Client}, v.Filter)
+		key = h.key(storage.SubscriptionKey, v.ID)
+	case *storage.Message:
+		if v.T == storage.RetainedKey {
+			v.ID = retainedKey(v.TopicName)
+		} else {
+			v.ID = inflightKey(&mqtt.Client{ID: v.Client}, packets.Packet{PacketID: v.PacketID})
+		}
+		key = h.key(v.T, v.ID)
+
+		if err := h.config.Compression.CompressMessage(v); err != nil {
+			h.Log.Error("failed to compress payload", "error", err, "key", v.ID)
+		}
+	case *storage.SystemInfo:
+		v.ID = sysInfoKey()
+		key = h.key(storage.SysInfoKey, v.ID)
+	}
+
+	return h.db.Set(h.ctx, key, h.seal(key, v), 0).Err()
+}
+
+// migrateSchema upgrades the records of the store to the current schema version. The records
+// of a read-only store are only checked, as they cannot be migrated.
+func (h *Hook) migrateSchema() error {
+	if h.config.ReadOnly {
+		_, err := storage.CheckSchema(records{h: h}, storage.Migrations, storage.SchemaVersion)
+		return err
+	}
+
+	from, err := storage.Migrate(records{h: h}, storage.Migrations, storage.SchemaVersion)
+	if err != nil {
+		return err
+	}
+
+	if from != storage.SchemaVersion {
+		h.Log.Info("migrated storage schema", "from", from, "to", storage.SchemaVersion)
+	}
+
+	return nil
+}
+
+// records provides the raw records of the store to schema migrations.
+type records struct {
+	h *Hook
+}
+
+// SchemaVersion returns the schema version of the store.
+func (r records) SchemaVersion() (int, bool, error) {
+	v, err := r.h.db.Get(r.h.ctx, r.h.hKey(storage.SchemaVersionKey)).Int()
+	if errors.Is(err, redis.Nil) {
+		return 0, false, nil
+	}
+
+	return v, err == nil, err
+}
+
+// SetSchemaVersion stores the schema version of the store.
+func (r records) SetSchemaVersion(v int) error {
+	return r.h.db.Set(r.h.ctx, r.h.hKey(storage.SchemaVersionKey), strconv.Itoa(v), 0).Err()
+}
+
+// Each calls visit with the key and decrypted value of each record.
+func (r records) Each(visit func(key string, value []byte) error) error {
+	for _, t := range keyTypes {
+		keys, err := r.h.scanKeys(t, "*")
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			value, err := r.h.db.Get(r.h.ctx, key).Bytes()
+			if errors.Is(err, redis.Nil) {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			value, err = r.h.crypt.Decrypt([]byte(key), value)
+			if err != nil {
+				return err
+			}
+
+			if err := visit(key, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Set encrypts and sets the value of a record, keeping any expiry.
+func (r records) Set(key string, value []byte) error {
+	value, err := r.h.crypt.Encrypt([]byte(key), value)
+	if err != nil {
+		return err
+	}
+
+	return r.h.db.Set(r.h.ctx, key, value, redis.KeepTTL).Err()
+}
+
+// Delete deletes a record.
+func (r records) Delete(key string) error {
+	return r.h.db.Del(r.h.ctx, key).Err()
+}
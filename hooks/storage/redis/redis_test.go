@@ -5,9 +5,14 @@
 package redis
 
 import (
+	"bytes"
+	"encoding/base64"
+	"errors"
 	"log/slog"
+	"math"
 	"os"
 	"sort"
+	"strconv"
 	"testing"
 	"time"
 
@@ -120,6 +125,13 @@ func TestHKey(t *testing.T) {
 	require.Equal(t, defaultHPrefix+"test", h.hKey("test"))
 }
 
+func TestKey(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	require.Equal(t, defaultHPrefix+"CL:cl1", h.key(storage.ClientKey, "cl1"))
+}
+
 func TestInitUseDefaults(t *testing.T) {
 	s := miniredis.RunT(t)
 	s.StartAddr(defaultAddr)
@@ -177,6 +189,207 @@ func TestInitBadAddr(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestInitCluster(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Address: s.Addr(),
+		Cluster: true,
+	})
+	require.NoError(t, err)
+	defer teardown(t, h)
+
+	require.Nil(t, h.config.Options)
+	require.Equal(t, []string{s.Addr()}, h.config.UniversalOptions.Addrs)
+	require.IsType(t, new(redis.ClusterClient), h.db)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, client.ID, r[0].ID)
+}
+
+func TestInitSentinelUnreachable(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Addresses:        []string{"127.0.0.1:1"},
+		MasterName:       "mymaster",
+		Database:         1,
+		ReadFromReplicas: true,
+	})
+	require.Error(t, err)
+	require.Equal(t, "mymaster", h.config.UniversalOptions.MasterName)
+	require.Equal(t, 1, h.config.UniversalOptions.DB)
+	require.True(t, h.config.UniversalOptions.ReadOnly)
+	require.True(t, h.config.UniversalOptions.RouteRandomly)
+}
+
+func TestNewClient(t *testing.T) {
+	h := new(Hook)
+	h.config = &Options{Options: &redis.Options{}}
+	require.IsType(t, new(redis.Client), h.newClient())
+
+	h.config = &Options{UniversalOptions: &redis.UniversalOptions{Addrs: []string{"n1:6379"}}}
+	require.IsType(t, new(redis.Client), h.newClient())
+
+	h.config = &Options{UniversalOptions: &redis.UniversalOptions{Addrs: []string{"n1:6379", "n2:6379"}}}
+	require.IsType(t, new(redis.ClusterClient), h.newClient())
+
+	h.config = &Options{Cluster: true, UniversalOptions: &redis.UniversalOptions{Addrs: []string{"n1:6379"}}}
+	require.IsType(t, new(redis.ClusterClient), h.newClient())
+
+	h.config = &Options{UniversalOptions: &redis.UniversalOptions{Addrs: []string{"s1:26379"}, MasterName: "mymaster"}}
+	require.IsType(t, new(redis.Client), h.newClient())
+
+	h.config = &Options{UniversalOptions: &redis.UniversalOptions{Addrs: []string{"s1:26379"}, MasterName: "mymaster", RouteRandomly: true}}
+	require.IsType(t, new(redis.ClusterClient), h.newClient())
+}
+
+func TestInitMigratesHashSets(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	s.HSet(defaultHPrefix+storage.ClientKey, "cl1", "a")
+	s.HSet(defaultHPrefix+storage.ClientKey, "cl2", "b")
+	s.HSet(defaultHPrefix+storage.RetainedKey, "a/b/c", "c")
+
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	require.False(t, s.Exists(defaultHPrefix+storage.ClientKey))
+	require.False(t, s.Exists(defaultHPrefix+storage.RetainedKey))
+
+	v, err := h.db.Get(h.ctx, h.key(storage.ClientKey, "cl2")).Result()
+	require.NoError(t, err)
+	require.Equal(t, "b", v)
+
+	v, err = h.db.Get(h.ctx, h.key(storage.RetainedKey, "a/b/c")).Result()
+	require.NoError(t, err)
+	require.Equal(t, "c", v)
+}
+
+func TestGetAll(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	for i := 0; i < scanCount+10; i++ {
+		err := h.db.Set(h.ctx, h.key(storage.InflightKey, strconv.Itoa(i)), "v", 0).Err()
+		require.NoError(t, err)
+	}
+
+	err := h.db.Set(h.ctx, h.key(storage.RetainedKey, "a/b/c"), "v", 0).Err()
+	require.NoError(t, err)
+
+	rows, err := h.getAll(storage.InflightKey)
+	require.NoError(t, err)
+	require.Len(t, rows, scanCount+10)
+}
+
+func TestHealth(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Health(), storage.ErrDBFileNotOpen)
+
+	s := miniredis.RunT(t)
+	h = newHook(t, s.Addr())
+	defer h.Stop()
+	require.NoError(t, h.Health())
+
+	s.Close()
+	require.Error(t, h.Health())
+}
+
+func TestInitHealthCheckDefaults(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	require.Equal(t, int64(defaultHealthCheckInterval), h.config.HealthCheckInterval)
+	require.Equal(t, int64(defaultReconnectBackoff), h.config.ReconnectBackoff)
+	require.Equal(t, int64(defaultMaxReconnectBackoff), h.config.MaxReconnectBackoff)
+	require.Equal(t, 0, h.config.WriteBufferSize)
+}
+
+func TestWritesBufferedWhileUnreachable(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Options:             &redis.Options{Addr: s.Addr(), MaxRetries: -1},
+		HealthCheckInterval: 10,
+		ReconnectBackoff:    10,
+		MaxReconnectBackoff: 20,
+		WriteBufferSize:     3,
+	})
+	require.NoError(t, err)
+	defer teardown(t, h)
+
+	s.Close()
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{0})
+	h.OnSysInfoTick(new(system.Info))
+
+	require.ErrorIs(t, h.Health(), ErrUnreachable)
+	status := h.Status()
+	require.False(t, status.Connected)
+	require.NotEmpty(t, status.Error)
+	require.Equal(t, 3, status.Buffered) // the client, its session expiry, and the subscription
+	require.Equal(t, int64(1), status.Dropped)
+
+	require.NoError(t, s.Restart())
+	require.Eventually(t, func() bool {
+		return h.Status().Connected
+	}, time.Second, time.Millisecond*5)
+
+	status = h.Status()
+	require.Equal(t, 0, status.Buffered)
+	require.Equal(t, int64(1), status.Reconnects)
+	require.NoError(t, h.Health())
+
+	r := new(storage.Client)
+	row, err := h.db.Get(h.ctx, h.key(storage.ClientKey, clientKey(client))).Result()
+	require.NoError(t, err)
+	require.NoError(t, r.UnmarshalBinary([]byte(row)))
+	require.Equal(t, client.ID, r.ID)
+
+	require.Equal(t, int64(1), h.db.Exists(h.ctx, h.key(storage.SubscriptionKey, subscriptionKey(client, "a/b/c"))).Val())
+	require.Equal(t, int64(0), h.db.Exists(h.ctx, h.key(storage.SysInfoKey, sysInfoKey())).Val())
+}
+
+func TestWritesDroppedWhileUnreachable(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Options:             &redis.Options{Addr: s.Addr(), MaxRetries: -1},
+		HealthCheckInterval: 10000,
+	})
+	require.NoError(t, err)
+
+	s.Close()
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+	h.OnRetainedExpired("a/b/c")
+
+	status := h.Status()
+	require.False(t, status.Connected)
+	require.Equal(t, 0, status.Buffered)
+	require.Equal(t, int64(2), status.Dropped)
+	require.NoError(t, h.Stop())
+}
+
 func TestOnSessionEstablishedThenOnDisconnect(t *testing.T) {
 	s := miniredis.RunT(t)
 	defer s.Close()
@@ -186,7 +399,7 @@ func TestOnSessionEstablishedThenOnDisconnect(t *testing.T) {
 	h.OnSessionEstablished(client, packets.Packet{})
 
 	r := new(storage.Client)
-	row, err := h.db.HGet(h.ctx, h.hKey(storage.ClientKey), clientKey(client)).Result()
+	row, err := h.db.Get(h.ctx, h.key(storage.ClientKey, clientKey(client))).Result()
 	require.NoError(t, err)
 	err = r.UnmarshalBinary([]byte(row))
 	require.NoError(t, err)
@@ -200,7 +413,7 @@ func TestOnSessionEstablishedThenOnDisconnect(t *testing.T) {
 
 	h.OnDisconnect(client, nil, false)
 	r2 := new(storage.Client)
-	row, err = h.db.HGet(h.ctx, h.hKey(storage.ClientKey), clientKey(client)).Result()
+	row, err = h.db.Get(h.ctx, h.key(storage.ClientKey, clientKey(client))).Result()
 	require.NoError(t, err)
 	err = r2.UnmarshalBinary([]byte(row))
 	require.NoError(t, err)
@@ -208,7 +421,7 @@ func TestOnSessionEstablishedThenOnDisconnect(t *testing.T) {
 
 	h.OnDisconnect(client, nil, true)
 	r3 := new(storage.Client)
-	_, err = h.db.HGet(h.ctx, h.hKey(storage.ClientKey), clientKey(client)).Result()
+	_, err = h.db.Get(h.ctx, h.key(storage.ClientKey, clientKey(client))).Result()
 	require.Error(t, err)
 	require.ErrorIs(t, err, redis.Nil)
 	require.Empty(t, r3.ID)
@@ -242,7 +455,7 @@ func TestOnWillSent(t *testing.T) {
 	h.OnWillSent(c1, packets.Packet{})
 
 	r := new(storage.Client)
-	row, err := h.db.HGet(h.ctx, h.hKey(storage.ClientKey), clientKey(client)).Result()
+	row, err := h.db.Get(h.ctx, h.key(storage.ClientKey, clientKey(client))).Result()
 	require.NoError(t, err)
 	err = r.UnmarshalBinary([]byte(row))
 	require.NoError(t, err)
@@ -260,18 +473,18 @@ func TestOnClientExpired(t *testing.T) {
 	cl := &mqtt.Client{ID: "cl1"}
 	clientKey := clientKey(cl)
 
-	err := h.db.HSet(h.ctx, h.hKey(storage.ClientKey), clientKey, &storage.Client{ID: cl.ID}).Err()
+	err := h.db.Set(h.ctx, h.key(storage.ClientKey, clientKey), &storage.Client{ID: cl.ID}, 0).Err()
 	require.NoError(t, err)
 
 	r := new(storage.Client)
-	row, err := h.db.HGet(h.ctx, h.hKey(storage.ClientKey), clientKey).Result()
+	row, err := h.db.Get(h.ctx, h.key(storage.ClientKey, clientKey)).Result()
 	require.NoError(t, err)
 	err = r.UnmarshalBinary([]byte(row))
 	require.NoError(t, err)
 	require.Equal(t, clientKey, r.ID)
 
 	h.OnClientExpired(cl)
-	_, err = h.db.HGet(h.ctx, h.hKey(storage.ClientKey), clientKey).Result()
+	_, err = h.db.Get(h.ctx, h.key(storage.ClientKey, clientKey)).Result()
 	require.Error(t, err)
 	require.ErrorIs(t, redis.Nil, err)
 }
@@ -330,6 +543,134 @@ func TestOnDisconnectSessionTakenOver(t *testing.T) {
 	h.OnDisconnect(testClient, nil, true)
 }
 
+func TestSessionTTL(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.Equal(t, time.Duration(0), h.sessionTTL(&mqtt.Client{}))
+
+	h.SetOpts(logger, &mqtt.HookOptions{Capabilities: &mqtt.Capabilities{MaximumSessionExpiryInterval: 100}})
+	require.Equal(t, 100*time.Second, h.sessionTTL(&mqtt.Client{}))
+
+	cl := &mqtt.Client{}
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Props.SessionExpiryInterval = 30
+	cl.Properties.Props.SessionExpiryIntervalFlag = true
+	require.Equal(t, 30*time.Second, h.sessionTTL(cl))
+
+	cl.Properties.Props.SessionExpiryInterval = math.MaxUint32
+	require.Equal(t, time.Duration(0), h.sessionTTL(cl))
+}
+
+func TestMessageTTL(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.Equal(t, time.Duration(0), h.messageTTL(packets.Packet{}))
+	require.Equal(t, time.Duration(0), h.messageTTL(packets.Packet{Expiry: -1}))
+	require.InDelta(t, float64(time.Minute), float64(h.messageTTL(packets.Packet{Expiry: time.Now().Unix() + 60})), float64(time.Second))
+	require.Equal(t, time.Second, h.messageTTL(packets.Packet{Expiry: time.Now().Unix() - 60}))
+
+	h.SetOpts(logger, &mqtt.HookOptions{Capabilities: &mqtt.Capabilities{MaximumMessageExpiryInterval: 30}})
+	now := time.Now().Unix()
+	require.Equal(t, time.Duration(0), h.messageTTL(packets.Packet{}))
+	require.InDelta(t, float64(30*time.Second), float64(h.messageTTL(packets.Packet{Created: now})), float64(time.Second))
+	require.InDelta(t, float64(30*time.Second), float64(h.messageTTL(packets.Packet{Created: now, Expiry: now + 60})), float64(time.Second))
+	require.InDelta(t, float64(10*time.Second), float64(h.messageTTL(packets.Packet{Created: now, Expiry: now + 10})), float64(time.Second))
+}
+
+func TestOnDisconnectExpiresSession(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+	h.SetOpts(logger, &mqtt.HookOptions{Capabilities: &mqtt.Capabilities{MaximumSessionExpiryInterval: 100}})
+
+	cl := &mqtt.Client{ID: "cl1"}
+	cl.State.Subscriptions = mqtt.NewSubscriptions()
+	cl.State.Subscriptions.Add("a/b/c", packets.Subscription{Filter: "a/b/c"})
+	cl.State.Inflight = mqtt.NewInflights()
+	pki := packets.Packet{PacketID: 1, Created: time.Now().Unix(), Expiry: time.Now().Unix() + 10}
+	cl.State.Inflight.Set(pki)
+
+	h.OnSessionEstablished(cl, packets.Packet{})
+	h.OnSubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a/b/c"}}}, []byte{0})
+	h.OnQosPublish(cl, pki, pki.Created, 0)
+
+	clKey := h.key(storage.ClientKey, clientKey(cl))
+	subKey := h.key(storage.SubscriptionKey, subscriptionKey(cl, "a/b/c"))
+	ifmKey := h.key(storage.InflightKey, inflightKey(cl, pki))
+	require.Equal(t, time.Duration(0), s.TTL(clKey))
+	require.Equal(t, time.Duration(0), s.TTL(subKey))
+	require.InDelta(t, float64(10*time.Second), float64(s.TTL(ifmKey)), float64(time.Second))
+
+	h.OnDisconnect(cl, nil, false)
+	require.Equal(t, 100*time.Second, s.TTL(clKey))
+	require.Equal(t, 100*time.Second, s.TTL(subKey))
+	require.InDelta(t, float64(10*time.Second), float64(s.TTL(ifmKey)), float64(time.Second))
+
+	h.OnWillSent(cl, packets.Packet{})
+	require.Equal(t, 100*time.Second, s.TTL(clKey))
+
+	s.FastForward(101 * time.Second)
+	require.False(t, s.Exists(clKey))
+	require.False(t, s.Exists(subKey))
+	require.False(t, s.Exists(ifmKey))
+}
+
+func TestOnSessionEstablishedPersistsSession(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+	h.SetOpts(logger, &mqtt.HookOptions{Capabilities: &mqtt.Capabilities{MaximumSessionExpiryInterval: 100}})
+
+	cl := &mqtt.Client{ID: "cl1"}
+	cl.State.Subscriptions = mqtt.NewSubscriptions()
+	cl.State.Subscriptions.Add("a/b/c", packets.Subscription{Filter: "a/b/c"})
+	cl.State.Inflight = mqtt.NewInflights()
+
+	h.OnSubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a/b/c"}}}, []byte{0})
+	h.OnDisconnect(cl, nil, false)
+
+	subKey := h.key(storage.SubscriptionKey, subscriptionKey(cl, "a/b/c"))
+	require.Equal(t, 100*time.Second, s.TTL(subKey))
+
+	h.OnSessionEstablished(cl, packets.Packet{})
+	require.Equal(t, time.Duration(0), s.TTL(subKey))
+	require.Equal(t, time.Duration(0), s.TTL(h.key(storage.ClientKey, clientKey(cl))))
+}
+
+func TestOnDisconnectNoSessionExpiry(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnDisconnect(client, nil, false)
+	require.True(t, s.Exists(h.key(storage.ClientKey, clientKey(client))))
+	require.Equal(t, time.Duration(0), s.TTL(h.key(storage.ClientKey, clientKey(client))))
+}
+
+func TestOnRetainMessageExpiry(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	pk := packets.Packet{
+		TopicName: "a/b/c",
+		Created:   time.Now().Unix(),
+		Expiry:    time.Now().Unix() + 30,
+	}
+	h.OnRetainMessage(client, pk, 1)
+
+	key := h.key(storage.RetainedKey, retainedKey(pk.TopicName))
+	require.InDelta(t, float64(30*time.Second), float64(s.TTL(key)), float64(time.Second))
+
+	s.FastForward(31 * time.Second)
+	require.False(t, s.Exists(key))
+}
+
 func TestOnSubscribedThenOnUnsubscribed(t *testing.T) {
 	s := miniredis.RunT(t)
 	defer s.Close()
@@ -339,7 +680,7 @@ func TestOnSubscribedThenOnUnsubscribed(t *testing.T) {
 	h.OnSubscribed(client, pkf, []byte{0})
 
 	r := new(storage.Subscription)
-	row, err := h.db.HGet(h.ctx, h.hKey(storage.SubscriptionKey), subscriptionKey(client, pkf.Filters[0].Filter)).Result()
+	row, err := h.db.Get(h.ctx, h.key(storage.SubscriptionKey, subscriptionKey(client, pkf.Filters[0].Filter))).Result()
 	require.NoError(t, err)
 	err = r.UnmarshalBinary([]byte(row))
 	require.NoError(t, err)
@@ -348,7 +689,7 @@ func TestOnSubscribedThenOnUnsubscribed(t *testing.T) {
 	require.Equal(t, byte(0), r.Qos)
 
 	h.OnUnsubscribed(client, pkf)
-	_, err = h.db.HGet(h.ctx, h.hKey(storage.SubscriptionKey), subscriptionKey(client, pkf.Filters[0].Filter)).Result()
+	_, err = h.db.Get(h.ctx, h.key(storage.SubscriptionKey, subscriptionKey(client, pkf.Filters[0].Filter))).Result()
 	require.Error(t, err)
 	require.ErrorIs(t, err, redis.Nil)
 }
@@ -402,7 +743,7 @@ func TestOnRetainMessageThenUnset(t *testing.T) {
 	h.OnRetainMessage(client, pk, 1)
 
 	r := new(storage.Message)
-	row, err := h.db.HGet(h.ctx, h.hKey(storage.RetainedKey), retainedKey(pk.TopicName)).Result()
+	row, err := h.db.Get(h.ctx, h.key(storage.RetainedKey, retainedKey(pk.TopicName))).Result()
 	require.NoError(t, err)
 	err = r.UnmarshalBinary([]byte(row))
 	require.NoError(t, err)
@@ -412,13 +753,13 @@ func TestOnRetainMessageThenUnset(t *testing.T) {
 	require.Equal(t, pk.Payload, r.Payload)
 
 	h.OnRetainMessage(client, pk, -1)
-	_, err = h.db.HGet(h.ctx, h.hKey(storage.RetainedKey), retainedKey(pk.TopicName)).Result()
+	_, err = h.db.Get(h.ctx, h.key(storage.RetainedKey, retainedKey(pk.TopicName))).Result()
 	require.Error(t, err)
 	require.ErrorIs(t, err, redis.Nil)
 
 	// coverage: delete deleted
 	h.OnRetainMessage(client, pk, -1)
-	_, err = h.db.HGet(h.ctx, h.hKey(storage.RetainedKey), retainedKey(pk.TopicName)).Result()
+	_, err = h.db.Get(h.ctx, h.key(storage.RetainedKey, retainedKey(pk.TopicName))).Result()
 	require.Error(t, err)
 	require.ErrorIs(t, err, redis.Nil)
 }
@@ -435,11 +776,11 @@ func TestOnRetainedExpired(t *testing.T) {
 		TopicName: "a/b/c",
 	}
 
-	err := h.db.HSet(h.ctx, h.hKey(storage.RetainedKey), m.ID, m).Err()
+	err := h.db.Set(h.ctx, h.key(storage.RetainedKey, m.ID), m, 0).Err()
 	require.NoError(t, err)
 
 	r := new(storage.Message)
-	row, err := h.db.HGet(h.ctx, h.hKey(storage.RetainedKey), m.ID).Result()
+	row, err := h.db.Get(h.ctx, h.key(storage.RetainedKey, m.ID)).Result()
 	require.NoError(t, err)
 	err = r.UnmarshalBinary([]byte(row))
 	require.NoError(t, err)
@@ -448,7 +789,7 @@ func TestOnRetainedExpired(t *testing.T) {
 
 	h.OnRetainedExpired(m.TopicName)
 
-	_, err = h.db.HGet(h.ctx, h.hKey(storage.RetainedKey), m.ID).Result()
+	_, err = h.db.Get(h.ctx, h.key(storage.RetainedKey, m.ID)).Result()
 	require.Error(t, err)
 	require.ErrorIs(t, err, redis.Nil)
 }
@@ -503,7 +844,7 @@ func TestOnQosPublishThenQOSComplete(t *testing.T) {
 	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
 
 	r := new(storage.Message)
-	row, err := h.db.HGet(h.ctx, h.hKey(storage.InflightKey), inflightKey(client, pk)).Result()
+	row, err := h.db.Get(h.ctx, h.key(storage.InflightKey, inflightKey(client, pk))).Result()
 	require.NoError(t, err)
 	err = r.UnmarshalBinary([]byte(row))
 	require.NoError(t, err)
@@ -516,7 +857,7 @@ func TestOnQosPublishThenQOSComplete(t *testing.T) {
 
 	// OnQosDropped is a passthrough to OnQosComplete here
 	h.OnQosDropped(client, pk)
-	_, err = h.db.HGet(h.ctx, h.hKey(storage.InflightKey), inflightKey(client, pk)).Result()
+	_, err = h.db.Get(h.ctx, h.key(storage.InflightKey, inflightKey(client, pk))).Result()
 	require.Error(t, err)
 	require.ErrorIs(t, err, redis.Nil)
 }
@@ -561,6 +902,68 @@ func TestOnQosDroppedNoDB(t *testing.T) {
 	h.OnQosDropped(client, packets.Packet{})
 }
 
+func TestOnQueuedMessageThenResend(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b/c",
+		Payload:     []byte("hello"),
+		PacketID:    7,
+	}
+	h.OnQueuedMessage(client, pk)
+
+	queued, err := h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Len(t, queued, 1)
+	require.Equal(t, storage.QueuedKey, queued[0].T)
+	require.Equal(t, uint16(7), queued[0].PacketID)
+	require.Equal(t, pk.Payload, queued[0].Payload)
+
+	inflight, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Empty(t, inflight)
+
+	// the queued message is resent as a duplicate when the client reconnects
+	pk.FixedHeader.Dup = true
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	queued, err = h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Empty(t, queued)
+
+	inflight, err = h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+	require.Equal(t, uint16(7), inflight[0].PacketID)
+}
+
+func TestOnQueuedMessageThenDropped(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+	pk := packets.Packet{TopicName: "a/b/c", PacketID: 7}
+	h.OnQueuedMessage(client, pk)
+	h.OnQosDropped(client, pk)
+
+	queued, err := h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Empty(t, queued)
+}
+
+func TestOnQueuedMessageNoDB(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	h.db = nil
+	h.OnQueuedMessage(client, packets.Packet{})
+	v, _ := h.StoredQueuedMessages()
+	require.Empty(t, v)
+}
+
 func TestOnSysInfoTick(t *testing.T) {
 	s := miniredis.RunT(t)
 	defer s.Close()
@@ -575,7 +978,7 @@ func TestOnSysInfoTick(t *testing.T) {
 	h.OnSysInfoTick(info)
 
 	r := new(storage.SystemInfo)
-	row, err := h.db.HGet(h.ctx, h.hKey(storage.SysInfoKey), storage.SysInfoKey).Result()
+	row, err := h.db.Get(h.ctx, h.key(storage.SysInfoKey, storage.SysInfoKey)).Result()
 	require.NoError(t, err)
 	err = r.UnmarshalBinary([]byte(row))
 	require.NoError(t, err)
@@ -606,13 +1009,13 @@ func TestStoredClients(t *testing.T) {
 	defer teardown(t, h)
 
 	// populate with clients
-	err := h.db.HSet(h.ctx, h.hKey(storage.ClientKey), "cl1", &storage.Client{ID: "cl1", T: storage.ClientKey}).Err()
+	err := h.db.Set(h.ctx, h.key(storage.ClientKey, "cl1"), &storage.Client{ID: "cl1", T: storage.ClientKey}, 0).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.ClientKey), "cl2", &storage.Client{ID: "cl2", T: storage.ClientKey}).Err()
+	err = h.db.Set(h.ctx, h.key(storage.ClientKey, "cl2"), &storage.Client{ID: "cl2", T: storage.ClientKey}, 0).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.ClientKey), "cl3", &storage.Client{ID: "cl3", T: storage.ClientKey}).Err()
+	err = h.db.Set(h.ctx, h.key(storage.ClientKey, "cl3"), &storage.Client{ID: "cl3", T: storage.ClientKey}, 0).Err()
 	require.NoError(t, err)
 
 	r, err := h.StoredClients()
@@ -653,13 +1056,13 @@ func TestStoredSubscriptions(t *testing.T) {
 	defer teardown(t, h)
 
 	// populate with subscriptions
-	err := h.db.HSet(h.ctx, h.hKey(storage.SubscriptionKey), "sub1", &storage.Subscription{ID: "sub1", T: storage.SubscriptionKey}).Err()
+	err := h.db.Set(h.ctx, h.key(storage.SubscriptionKey, "sub1"), &storage.Subscription{ID: "sub1", T: storage.SubscriptionKey}, 0).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.SubscriptionKey), "sub2", &storage.Subscription{ID: "sub2", T: storage.SubscriptionKey}).Err()
+	err = h.db.Set(h.ctx, h.key(storage.SubscriptionKey, "sub2"), &storage.Subscription{ID: "sub2", T: storage.SubscriptionKey}, 0).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.SubscriptionKey), "sub3", &storage.Subscription{ID: "sub3", T: storage.SubscriptionKey}).Err()
+	err = h.db.Set(h.ctx, h.key(storage.SubscriptionKey, "sub3"), &storage.Subscription{ID: "sub3", T: storage.SubscriptionKey}, 0).Err()
 	require.NoError(t, err)
 
 	r, err := h.StoredSubscriptions()
@@ -699,16 +1102,16 @@ func TestStoredRetainedMessages(t *testing.T) {
 	defer teardown(t, h)
 
 	// populate with messages
-	err := h.db.HSet(h.ctx, h.hKey(storage.RetainedKey), "m1", &storage.Message{ID: "m1", T: storage.RetainedKey}).Err()
+	err := h.db.Set(h.ctx, h.key(storage.RetainedKey, "m1"), &storage.Message{ID: "m1", T: storage.RetainedKey}, 0).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.RetainedKey), "m2", &storage.Message{ID: "m2", T: storage.RetainedKey}).Err()
+	err = h.db.Set(h.ctx, h.key(storage.RetainedKey, "m2"), &storage.Message{ID: "m2", T: storage.RetainedKey}, 0).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.RetainedKey), "m3", &storage.Message{ID: "m3", T: storage.RetainedKey}).Err()
+	err = h.db.Set(h.ctx, h.key(storage.RetainedKey, "m3"), &storage.Message{ID: "m3", T: storage.RetainedKey}, 0).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.InflightKey), "i3", &storage.Message{ID: "i3", T: storage.InflightKey}).Err()
+	err = h.db.Set(h.ctx, h.key(storage.InflightKey, "i3"), &storage.Message{ID: "i3", T: storage.InflightKey}, 0).Err()
 	require.NoError(t, err)
 
 	r, err := h.StoredRetainedMessages()
@@ -748,16 +1151,16 @@ func TestStoredInflightMessages(t *testing.T) {
 	defer teardown(t, h)
 
 	// populate with messages
-	err := h.db.HSet(h.ctx, h.hKey(storage.InflightKey), "i1", &storage.Message{ID: "i1", T: storage.InflightKey}).Err()
+	err := h.db.Set(h.ctx, h.key(storage.InflightKey, "i1"), &storage.Message{ID: "i1", T: storage.InflightKey}, 0).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.InflightKey), "i2", &storage.Message{ID: "i2", T: storage.InflightKey}).Err()
+	err = h.db.Set(h.ctx, h.key(storage.InflightKey, "i2"), &storage.Message{ID: "i2", T: storage.InflightKey}, 0).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.InflightKey), "i3", &storage.Message{ID: "i3", T: storage.InflightKey}).Err()
+	err = h.db.Set(h.ctx, h.key(storage.InflightKey, "i3"), &storage.Message{ID: "i3", T: storage.InflightKey}, 0).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.RetainedKey), "m3", &storage.Message{ID: "m3", T: storage.RetainedKey}).Err()
+	err = h.db.Set(h.ctx, h.key(storage.RetainedKey, "m3"), &storage.Message{ID: "m3", T: storage.RetainedKey}, 0).Err()
 	require.NoError(t, err)
 
 	r, err := h.StoredInflightMessages()
@@ -769,6 +1172,43 @@ func TestStoredInflightMessages(t *testing.T) {
 	require.Equal(t, "i3", r[2].ID)
 }
 
+func TestStoredInflightMessagesV5Properties(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	pk := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:       "a/b/c",
+		Payload:         []byte("hello"),
+		PacketID:        1,
+		ProtocolVersion: 5,
+		Created:         time.Now().Unix(),
+		Expiry:          time.Now().Unix() + 30,
+		Properties: packets.Properties{
+			PayloadFormat:          1,
+			PayloadFormatFlag:      true,
+			MessageExpiryInterval:  30,
+			SubscriptionIdentifier: []int{2},
+			User:                   []packets.UserProperty{{Key: "k", Val: "v"}},
+		},
+	}
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	r, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+
+	out := r[0].ToPacket()
+	require.Equal(t, pk.Expiry, out.Expiry)
+	require.Equal(t, pk.ProtocolVersion, out.ProtocolVersion)
+	require.Equal(t, pk.Properties.PayloadFormatFlag, out.Properties.PayloadFormatFlag)
+	require.Equal(t, pk.Properties.MessageExpiryInterval, out.Properties.MessageExpiryInterval)
+	require.Equal(t, pk.Properties.SubscriptionIdentifier, out.Properties.SubscriptionIdentifier)
+	require.Equal(t, pk.Properties.User, out.Properties.User)
+}
+
 func TestStoredInflightMessagesNoDB(t *testing.T) {
 	s := miniredis.RunT(t)
 	defer s.Close()
@@ -797,14 +1237,14 @@ func TestStoredSysInfo(t *testing.T) {
 	defer teardown(t, h)
 
 	// populate with sys info
-	err := h.db.HSet(h.ctx, h.hKey(storage.SysInfoKey), storage.SysInfoKey,
+	err := h.db.Set(h.ctx, h.key(storage.SysInfoKey, storage.SysInfoKey),
 		&storage.SystemInfo{
 			ID: storage.SysInfoKey,
 			Info: system.Info{
 				Version: "2.0.0",
 			},
 			T: storage.SysInfoKey,
-		}).Err()
+		}, 0).Err()
 	require.NoError(t, err)
 
 	r, err := h.StoredSysInfo()
@@ -832,3 +1272,504 @@ func TestStoredSysInfoClosedDB(t *testing.T) {
 	require.Empty(t, v)
 	require.Error(t, err)
 }
+
+func TestStoredSession(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	// a client with an id prefixed by the id of the client
+	other := &mqtt.Client{ID: client.ID + ":2"}
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b/c",
+		PacketID:    7,
+	}
+	for _, cl := range []*mqtt.Client{client, other} {
+		h.OnSessionEstablished(cl, packets.Packet{})
+		h.OnSubscribed(cl, pkf, []byte{0})
+		h.OnQosPublish(cl, pk, time.Now().Unix(), 0)
+	}
+	pk.PacketID = 8
+	h.OnQueuedMessage(client, pk)
+
+	v, err := h.StoredSession(client.ID)
+	require.NoError(t, err)
+	require.Equal(t, client.ID, v.Client.ID)
+	require.Len(t, v.Subscriptions, 1)
+	require.Equal(t, "a/b/c", v.Subscriptions[0].Filter)
+	require.Len(t, v.Inflight, 1)
+	require.Equal(t, uint16(7), v.Inflight[0].PacketID)
+	require.Len(t, v.Queued, 1)
+	require.Equal(t, uint16(8), v.Queued[0].PacketID)
+
+	v, err = h.StoredSession("absent")
+	require.NoError(t, err)
+	require.Empty(t, v)
+}
+
+func TestStoredSessionNoDB(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	h.db = nil
+	v, err := h.StoredSession(client.ID)
+	require.Empty(t, v)
+	require.NoError(t, err)
+}
+
+func TestStorageStats(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	_, err := h.StoredSession("absent")
+	require.NoError(t, err)
+	h.OnClientExpired(client)
+
+	stats := h.StorageStats()
+	require.Positive(t, stats.Writes.Count)
+	require.Equal(t, int64(0), stats.Writes.Errors)
+	require.Equal(t, int64(1), stats.Reads.Count)
+	require.Equal(t, int64(0), stats.Reads.Errors) // a missing key is not a failed read
+	require.Equal(t, int64(1), stats.Deletes.Count)
+}
+
+func TestIterStored(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{0})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b/c",
+		PacketID:    7,
+	}
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+	pk.PacketID = 8
+	h.OnQueuedMessage(client, pk)
+
+	var got []string
+	require.NoError(t, h.IterClients(func(v storage.Client) error {
+		got = append(got, v.ID)
+		return nil
+	}))
+	require.NoError(t, h.IterSubscriptions(func(v storage.Subscription) error {
+		got = append(got, v.Filter)
+		return nil
+	}))
+	visit := func(v storage.Message) error {
+		got = append(got, v.T)
+		return nil
+	}
+	require.NoError(t, h.IterRetainedMessages(visit))
+	require.NoError(t, h.IterInflightMessages(visit))
+	require.NoError(t, h.IterQueuedMessages(visit))
+	require.Equal(t, []string{client.ID, "a/b/c", storage.RetainedKey, storage.InflightKey, storage.QueuedKey}, got)
+
+	errVisit := errors.New("visit")
+	err := h.IterClients(func(v storage.Client) error {
+		return errVisit
+	})
+	require.ErrorIs(t, err, errVisit)
+}
+
+func TestInitBadCompression(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Compression: storage.Compression{Algorithm: "lz4"},
+	})
+	require.ErrorIs(t, err, storage.ErrUnknownCompression)
+}
+
+func TestInitBadNamespace(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Namespace: "a:b"})
+	require.ErrorIs(t, err, storage.ErrInvalidNamespace)
+}
+
+func TestNamespace(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Options:   &redis.Options{Addr: s.Addr()},
+		Namespace: "t1",
+	})
+	require.NoError(t, err)
+	defer teardown(t, h)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	require.True(t, s.Exists(defaultHPrefix+"t1:"+storage.ClientKey+":"+clientKey(client)))
+
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+
+	h.config.Namespace = "t2" // another broker sharing the service
+	r, err = h.StoredClients()
+	require.NoError(t, err)
+	require.Empty(t, r)
+}
+
+func TestReadOnly(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+	h.OnSessionEstablished(client, packets.Packet{})
+
+	r := new(Hook)
+	r.SetOpts(logger, nil)
+	err := r.Init(&Options{
+		Options:  &redis.Options{Addr: s.Addr()},
+		ReadOnly: true,
+	})
+	require.NoError(t, err)
+	defer r.Stop()
+
+	require.True(t, r.Provides(mqtt.StoredClients))
+	require.False(t, r.Provides(mqtt.OnSessionEstablished))
+	require.False(t, r.Provides(mqtt.OnSysInfoTick))
+
+	cl, err := r.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, cl, 1)
+	require.Equal(t, client.ID, cl[0].ID)
+
+	require.ErrorIs(t, r.Restore(new(bytes.Buffer)), storage.ErrReadOnly)
+	require.ErrorIs(t, r.Import(new(bytes.Buffer)), storage.ErrReadOnly)
+}
+
+func TestReadOnlyHashSets(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	s.HSet(defaultHPrefix+storage.ClientKey, "cl1", "a")
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Options:  &redis.Options{Addr: s.Addr()},
+		ReadOnly: true,
+	})
+	require.ErrorIs(t, err, storage.ErrReadOnly)
+	defer h.Stop()
+
+	require.True(t, s.Exists(defaultHPrefix+storage.ClientKey))
+	require.Equal(t, "a", s.HGet(defaultHPrefix+storage.ClientKey, "cl1"))
+	require.False(t, s.Exists(h.key(storage.ClientKey, "cl1")))
+}
+
+func TestOnRetainMessageCompressed(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Options:     &redis.Options{Addr: s.Addr()},
+		Compression: storage.Compression{Algorithm: storage.CompressionZstd},
+	})
+	require.NoError(t, err)
+	defer teardown(t, h)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Retain: true, Qos: 1},
+		Payload:     bytes.Repeat([]byte("hello"), 1000),
+		TopicName:   "a/b/c",
+		PacketID:    1,
+	}
+
+	h.OnRetainMessage(client, pk, 1)
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	raw, err := h.db.Get(h.ctx, h.key(storage.RetainedKey, retainedKey(pk.TopicName))).Bytes()
+	require.NoError(t, err)
+	require.Contains(t, string(raw), `"compression":"zstd"`)
+
+	r, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, pk.Payload, r[0].Payload)
+
+	r, err = h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, pk.Payload, r[0].Payload)
+}
+
+func TestInitBadEncryption(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Encryption: &storage.Encryption{Key: "bad"},
+	})
+	require.ErrorIs(t, err, storage.ErrInvalidEncryptionKey)
+}
+
+func TestEncryption(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Options:    &redis.Options{Addr: s.Addr()},
+		Encryption: &storage.Encryption{Key: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)), Migrate: true},
+	})
+	require.NoError(t, err)
+	defer teardown(t, h)
+
+	// values stored before encryption was enabled can still be read while migrating
+	plain, err := storage.Message{ID: retainedKey("d/e/f"), T: storage.RetainedKey, TopicName: "d/e/f"}.MarshalBinary()
+	require.NoError(t, err)
+	err = h.db.Set(h.ctx, h.key(storage.RetainedKey, retainedKey("d/e/f")), plain, 0).Err()
+	require.NoError(t, err)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Retain: true},
+		Payload:     []byte("hello"),
+		TopicName:   "a/b/c",
+	}
+	h.OnRetainMessage(client, pk, 1)
+
+	raw, err := h.db.Get(h.ctx, h.key(storage.RetainedKey, retainedKey(pk.TopicName))).Bytes()
+	require.NoError(t, err)
+	require.NotContains(t, string(raw), "topic_name")
+
+	r, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+	require.ElementsMatch(t, []string{"a/b/c", "d/e/f"}, []string{r[0].TopicName, r[1].TopicName})
+
+	// encrypted values cannot be moved to another key
+	err = h.unmarshal(h.key(storage.RetainedKey, retainedKey("x/y/z")), raw, new(storage.Message))
+	require.ErrorIs(t, err, storage.ErrInvalidEncryptedData)
+
+	// unencrypted values are refused once the store has been migrated
+	h.crypt, err = storage.NewEncryptor(&storage.Encryption{Key: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))})
+	require.NoError(t, err)
+	err = h.unmarshal(h.key(storage.RetainedKey, retainedKey("d/e/f")), plain, new(storage.Message))
+	require.ErrorIs(t, err, storage.ErrUnencryptedData)
+}
+
+func TestInitSchemaVersion(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Options: &redis.Options{
+			Addr: s.Addr(),
+		},
+	})
+	require.NoError(t, err)
+	defer teardown(t, h)
+
+	v, ok, err := records{h: h}.SchemaVersion()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, storage.SchemaVersion, v)
+}
+
+func TestInitNewerSchemaVersion(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Options: &redis.Options{
+			Addr: s.Addr(),
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, records{h: h}.SetSchemaVersion(storage.SchemaVersion+1))
+	require.NoError(t, h.Stop())
+
+	h = new(Hook)
+	h.SetOpts(logger, nil)
+	err = h.Init(&Options{
+		Options: &redis.Options{
+			Addr: s.Addr(),
+		},
+	})
+	require.ErrorIs(t, err, storage.ErrNewerSchemaVersion)
+}
+
+func TestInitMigratesSchema(t *testing.T) {
+	migrations := storage.Migrations
+	defer func() {
+		storage.Migrations = migrations
+	}()
+
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Options: &redis.Options{
+			Addr: s.Addr(),
+		},
+	})
+	require.NoError(t, err)
+	h.OnSessionEstablished(&mqtt.Client{ID: "cl1", Net: mqtt.ClientConnection{Remote: "old"}}, packets.Packet{})
+	require.NoError(t, records{h: h}.Delete(h.hKey(storage.SchemaVersionKey))) // an unversioned store
+	require.NoError(t, h.Stop())
+
+	storage.Migrations = []storage.Migration{
+		{
+			Version: storage.SchemaVersion,
+			Upgrade: func(key string, value []byte) ([]byte, error) {
+				return bytes.Replace(value, []byte(`"old"`), []byte(`"new"`), 1), nil
+			},
+		},
+	}
+
+	h = new(Hook)
+	h.SetOpts(logger, nil)
+	err = h.Init(&Options{
+		Options: &redis.Options{
+			Addr: s.Addr(),
+		},
+	})
+	require.NoError(t, err)
+	defer teardown(t, h)
+
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, "new", r[0].Remote)
+
+	v, ok, err := records{h: h}.SchemaVersion()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, storage.SchemaVersion, v)
+}
+
+func TestBackupRestore(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{0})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, h.Backup(buf))
+
+	// changes made after the backup are discarded by the restore
+	h.OnSessionEstablished(&mqtt.Client{ID: "cl2"}, packets.Packet{})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c"}, -1)
+
+	require.NoError(t, h.Restore(buf))
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	require.Equal(t, client.ID, clients[0].ID)
+
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+
+	retained, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+	require.Equal(t, []byte("hello"), retained[0].Payload)
+
+	v, ok, err := records{h: h}.SchemaVersion()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, storage.SchemaVersion, v)
+}
+
+func TestBackupRestoreNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Backup(new(bytes.Buffer)), storage.ErrDBFileNotOpen)
+	require.ErrorIs(t, h.Restore(new(bytes.Buffer)), storage.ErrDBFileNotOpen)
+}
+
+func TestExportImport(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+	pk := packets.Packet{TopicName: "a/b/c", Payload: []byte("hi"), PacketID: 7}
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{1})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+	h.OnQueuedMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("later"), PacketID: 8})
+	h.OnSysInfoTick(&system.Info{Version: "2.0.0"})
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, h.Export(buf))
+
+	// records exported by other storage hooks have keys in a different format
+	buf.WriteString(`{"t":"SUB","id":"SUB_cl2:d/e","client":"cl2","filter":"d/e","qos":2}` + "\n")
+
+	h2 := newHook(t, s.Addr())
+	h2.config.HPrefix = "imported:"
+	require.NoError(t, h2.Import(buf))
+
+	clients, err := h2.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	require.Equal(t, client.ID, clients[0].ID)
+	require.Equal(t, client.Properties.Username, clients[0].Username)
+
+	subs, err := h2.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Filter < subs[j].Filter })
+	require.Equal(t, "a/b/c", subs[0].Filter)
+	require.Equal(t, subscriptionKey(&mqtt.Client{ID: "cl2"}, "d/e"), subs[1].ID)
+	require.Equal(t, byte(2), subs[1].Qos)
+
+	retained, err := h2.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+	require.Equal(t, []byte("hello"), retained[0].Payload)
+
+	inflight, err := h2.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+	require.Equal(t, []byte("hi"), inflight[0].Payload)
+	require.Equal(t, inflightKey(client, pk), inflight[0].ID)
+
+	queued, err := h2.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Len(t, queued, 1)
+	require.Equal(t, []byte("later"), queued[0].Payload)
+	require.Equal(t, uint16(8), queued[0].PacketID)
+
+	sys, err := h2.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, "2.0.0", sys.Version)
+}
+
+func TestExportImportNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Export(new(bytes.Buffer)), storage.ErrDBFileNotOpen)
+	require.ErrorIs(t, h.Import(new(bytes.Buffer)), storage.ErrDBFileNotOpen)
+}
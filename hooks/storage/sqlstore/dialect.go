@@ -0,0 +1,117 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package sqlstore
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrUnknownDialect indicates no dialect exists for a database or driver name.
+var ErrUnknownDialect = errors.New("unknown sql dialect")
+
+// Dialect provides the statements which differ between databases. Each table used by the
+// hook has a text primary key k and a binary data column. A dialect can be extended by
+// embedding one of the provided dialects and overriding its methods.
+type Dialect interface {
+	// Name returns the name of the dialect.
+	Name() string
+
+	// Placeholder returns the bind parameter for the nth (from 1) argument of a statement.
+	Placeholder(n int) string
+
+	// CreateTable returns a statement which creates a table if it does not exist.
+	CreateTable(table string) string
+
+	// Upsert returns a statement which inserts or replaces a row, taking the key and
+	// the data as arguments.
+	Upsert(table string) string
+}
+
+// DialectByName returns the dialect for a database or database/sql driver name.
+func DialectByName(name string) (Dialect, error) {
+	switch strings.ToLower(name) {
+	case "postgres", "postgresql", "pgx":
+		return PostgresDialect{}, nil
+	case "mysql", "mariadb":
+		return MySQLDialect{}, nil
+	case "sqlite", "sqlite3":
+		return SQLiteDialect{}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownDialect, name)
+	}
+}
+
+// PostgresDialect is the dialect for PostgreSQL.
+type PostgresDialect struct{}
+
+// Name returns the name of the dialect.
+func (PostgresDialect) Name() string {
+	return "postgres"
+}
+
+// Placeholder returns the numbered bind parameter for the nth argument of a statement.
+func (PostgresDialect) Placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+// CreateTable returns a statement which creates a table if it does not exist.
+func (PostgresDialect) CreateTable(table string) string {
+	return "CREATE TABLE IF NOT EXISTS " + table + " (k TEXT PRIMARY KEY, data BYTEA NOT NULL)"
+}
+
+// Upsert returns a statement which inserts or replaces a row.
+func (PostgresDialect) Upsert(table string) string {
+	return "INSERT INTO " + table + " (k, data) VALUES ($1, $2) ON CONFLICT (k) DO UPDATE SET data = EXCLUDED.data"
+}
+
+// MySQLDialect is the dialect for MySQL and MariaDB.
+type MySQLDialect struct{}
+
+// Name returns the name of the dialect.
+func (MySQLDialect) Name() string {
+	return "mysql"
+}
+
+// Placeholder returns the bind parameter for the nth argument of a statement.
+func (MySQLDialect) Placeholder(_ int) string {
+	return "?"
+}
+
+// CreateTable returns a statement which creates a table if it does not exist. Keys are
+// limited to 512 characters, as text columns cannot be used as primary keys.
+func (MySQLDialect) CreateTable(table string) string {
+	return "CREATE TABLE IF NOT EXISTS " + table + " (k VARCHAR(512) NOT NULL PRIMARY KEY, data LONGBLOB NOT NULL)"
+}
+
+// Upsert returns a statement which inserts or replaces a row.
+func (MySQLDialect) Upsert(table string) string {
+	return "INSERT INTO " + table + " (k, data) VALUES (?, ?) ON DUPLICATE KEY UPDATE data = VALUES(data)"
+}
+
+// SQLiteDialect is the dialect for SQLite.
+type SQLiteDialect struct{}
+
+// Name returns the name of the dialect.
+func (SQLiteDialect) Name() string {
+	return "sqlite"
+}
+
+// Placeholder returns the bind parameter for the nth argument of a statement.
+func (SQLiteDialect) Placeholder(_ int) string {
+	return "?"
+}
+
+// CreateTable returns a statement which creates a table if it does not exist.
+func (SQLiteDialect) CreateTable(table string) string {
+	return "CREATE TABLE IF NOT EXISTS " + table + " (k TEXT PRIMARY KEY, data BLOB NOT NULL)"
+}
+
+// Upsert returns a statement which inserts or replaces a row.
+func (SQLiteDialect) Upsert(table string) string {
+	return "INSERT INTO " + table + " (k, data) VALUES (?, ?) ON CONFLICT (k) DO UPDATE SET data = excluded.data"
+}
@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package sqlstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// extendedDialect is a dialect which overrides the table definition of an embedded dialect.
+type extendedDialect struct {
+	PostgresDialect
+}
+
+func (extendedDialect) CreateTable(table string) string {
+	return "CREATE UNLOGGED TABLE IF NOT EXISTS " + table + " (k TEXT PRIMARY KEY, data BYTEA NOT NULL)"
+}
+
+func TestDialectByName(t *testing.T) {
+	tt := []struct {
+		name   string
+		expect Dialect
+	}{
+		{name: "postgres", expect: PostgresDialect{}},
+		{name: "postgresql", expect: PostgresDialect{}},
+		{name: "pgx", expect: PostgresDialect{}},
+		{name: "mysql", expect: MySQLDialect{}},
+		{name: "MariaDB", expect: MySQLDialect{}},
+		{name: "sqlite", expect: SQLiteDialect{}},
+		{name: "sqlite3", expect: SQLiteDialect{}},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.name, func(t *testing.T) {
+			d, err := DialectByName(tx.name)
+			require.NoError(t, err)
+			require.Equal(t, tx.expect, d)
+		})
+	}
+
+	_, err := DialectByName("oracle")
+	require.ErrorIs(t, err, ErrUnknownDialect)
+}
+
+func TestPostgresDialect(t *testing.T) {
+	d := PostgresDialect{}
+	require.Equal(t, "postgres", d.Name())
+	require.Equal(t, "$2", d.Placeholder(2))
+	require.Equal(t, "CREATE TABLE IF NOT EXISTS t (k TEXT PRIMARY KEY, data BYTEA NOT NULL)", d.CreateTable("t"))
+	require.Equal(t, "INSERT INTO t (k, data) VALUES ($1, $2) ON CONFLICT (k) DO UPDATE SET data = EXCLUDED.data", d.Upsert("t"))
+}
+
+func TestMySQLDialect(t *testing.T) {
+	d := MySQLDialect{}
+	require.Equal(t, "mysql", d.Name())
+	require.Equal(t, "?", d.Placeholder(2))
+	require.Equal(t, "CREATE TABLE IF NOT EXISTS t (k VARCHAR(512) NOT NULL PRIMARY KEY, data LONGBLOB NOT NULL)", d.CreateTable("t"))
+	require.Equal(t, "INSERT INTO t (k, data) VALUES (?, ?) ON DUPLICATE KEY UPDATE data = VALUES(data)", d.Upsert("t"))
+}
+
+func TestSQLiteDialect(t *testing.T) {
+	d := SQLiteDialect{}
+	require.Equal(t, "sqlite", d.Name())
+	require.Equal(t, "?", d.Placeholder(2))
+	require.Equal(t, "CREATE TABLE IF NOT EXISTS t (k TEXT PRIMARY KEY, data BLOB NOT NULL)", d.CreateTable("t"))
+	require.Equal(t, "INSERT INTO t (k, data) VALUES (?, ?) ON CONFLICT (k) DO UPDATE SET data = excluded.data", d.Upsert("t"))
+}
+
+func TestExtendedDialect(t *testing.T) {
+	var d Dialect = extendedDialect{}
+	require.Equal(t, "postgres", d.Name())
+	require.Equal(t, "$1", d.Placeholder(1))
+	require.Contains(t, d.CreateTable("t"), "CREATE UNLOGGED TABLE")
+}
@@ -0,0 +1,976 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package sqlstore
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/system"
+)
+
+// defaultTablePrefix is a prefix to better identify tables created by mochi mqtt.
+const defaultTablePrefix = "mochi_"
+
+// pageSize is the number of rows read in each query when iterating over stored values.
+const pageSize = 1000
+
+// Tables are the names of the tables used to store each type of data, before the table prefix is applied.
+const (
+	clientsTable       = "clients"
+	subscriptionsTable = "subscriptions"
+	retainedTable      = "retained"
+	inflightTable      = "inflight"
+	queuedTable        = "queued"
+	sysInfoTable       = "sysinfo"
+)
+
+var (
+	// ErrMissingDatabase indicates neither a database nor a driver was configured.
+	ErrMissingDatabase = errors.New("no sql database or driver configured")
+
+	// ErrInvalidTablePrefix indicates the table prefix is not a valid sql identifier.
+	ErrInvalidTablePrefix = errors.New("invalid table prefix")
+
+	validTablePrefix = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]{0,31}$`)
+	tables           = []string{clientsTable, subscriptionsTable, retainedTable, inflightTable, queuedTable, sysInfoTable}
+)
+
+// clientKey returns a primary key for a client.
+func clientKey(cl *mqtt.Client) string {
+	return cl.ID
+}
+
+// subscriptionKey returns a primary key for a subscription.
+func subscriptionKey(cl *mqtt.Client, filter string) string {
+	return cl.ID + ":" + filter
+}
+
+// retainedKey returns a primary key for a retained message.
+func retainedKey(topic string) string {
+	return topic
+}
+
+// inflightKey returns a primary key for an inflight or queued message.
+func inflightKey(cl *mqtt.Client, pk packets.Packet) string {
+	return cl.ID + ":" + pk.FormatID()
+}
+
+// sysInfoKey returns a primary key for system info.
+func sysInfoKey() string {
+	return storage.SysInfoKey
+}
+
+// Options contains configuration settings for the sql database.
+type Options struct {
+	Driver       string `yaml:"driver" json:"driver"`               // the database/sql driver name, used with DSN if DB is not set
+	DSN          string `yaml:"dsn" json:"dsn"`                     // the data source name passed to the driver
+	DialectName  string `yaml:"dialect" json:"dialect"`             // the name of the dialect, if it differs from the driver name
+	TablePrefix  string `yaml:"table_prefix" json:"table_prefix"`   // a prefix for the names of the tables
+	CreateSchema bool   `yaml:"create_schema" json:"create_schema"` // create the tables if they do not exist
+
+	// Namespace follows TablePrefix in the names of the tables, so several brokers can share a database.
+	Namespace storage.Namespace `yaml:"namespace" json:"namespace"`
+
+	// ReadOnly stops the hook writing to the database, so a standby broker can restore from a
+	// replica. A read-only hook only provides the methods which read from the store, and never
+	// creates the tables.
+	ReadOnly bool `yaml:"read_only" json:"read_only"`
+
+	// DB is an optional database handle, which takes precedence over Driver and DSN.
+	// A handle passed in DB is not closed when the hook stops.
+	DB *sql.DB `yaml:"-" json:"-"`
+
+	// Dialect is an optional dialect, which takes precedence over DialectName.
+	Dialect Dialect `yaml:"-" json:"-"`
+}
+
+// queries are the statements used for a table.
+type queries struct {
+	upsert string // inserts or replaces a row
+	delete string // deletes a row by key
+	get    string // selects the data of a row by key
+	scan   string // selects the data of all rows
+	within string // selects the data of rows with keys in a range
+	page   string // selects the keys and data of a page of rows ordered by key, after a key
+}
+
+// Hook is a persistent storage hook using a sql database as a backend, with the
+// statements for each database provided by a dialect.
+type Hook struct {
+	mqtt.HookBase
+	config  *Options           // options for connecting to the database
+	db      *sql.DB            // the database handle
+	dialect Dialect            // the dialect of the database
+	queries map[string]queries // the statements for each table
+	owned   bool               // the database was opened by the hook, and is closed when it stops
+	stats   storage.Recorder   // records the reads, writes and deletes of the hook
+}
+
+// ID returns the id of the hook.
+func (h *Hook) ID() string {
+	return "sql-db"
+}
+
+// Provides indicates which hook methods this hook provides. A read-only hook only provides
+// the methods which read from the store.
+func (h *Hook) Provides(b byte) bool {
+	if bytes.Contains([]byte{
+		mqtt.StoredClients,
+		mqtt.StoredInflightMessages,
+		mqtt.StoredQueuedMessages,
+		mqtt.StoredRetainedMessages,
+		mqtt.StoredSubscriptions,
+		mqtt.StoredSysInfo,
+		mqtt.StoredSession,
+	}, []byte{b}) {
+		return true
+	}
+
+	return (h.config == nil || !h.config.ReadOnly) && bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+		mqtt.OnRetainMessage,
+		mqtt.OnQosPublish,
+		mqtt.OnQosComplete,
+		mqtt.OnQosDropped,
+		mqtt.OnQueuedMessage,
+		mqtt.OnWillSent,
+		mqtt.OnSysInfoTick,
+		mqtt.OnClientExpired,
+		mqtt.OnRetainedExpired,
+	}, []byte{b})
+}
+
+// Init initializes and connects to the database, creating the tables if configured.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.config = config.(*Options)
+	if h.config.DB == nil && h.config.Driver == "" {
+		return ErrMissingDatabase
+	}
+
+	if h.config.TablePrefix == "" {
+		h.config.TablePrefix = defaultTablePrefix
+	}
+
+	if !validTablePrefix.MatchString(h.config.TablePrefix) {
+		return fmt.Errorf("%w: %s", ErrInvalidTablePrefix, h.config.TablePrefix)
+	}
+
+	if err := h.config.Namespace.Validate(); err != nil {
+		return err
+	}
+
+	h.dialect = h.config.Dialect
+	if h.dialect == nil {
+		name := h.config.DialectName
+		if name == "" {
+			name = h.config.Driver
+		}
+
+		var err error
+		h.dialect, err = DialectByName(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	h.Log.Info(
+		"connecting to sql database",
+		"driver", h.config.Driver,
+		"dialect", h.dialect.Name(),
+		"table-prefix", h.config.TablePrefix,
+		"namespace", h.config.Namespace,
+	)
+
+	h.db = h.config.DB
+	if h.db == nil {
+		db, err := sql.Open(h.config.Driver, h.config.DSN)
+		if err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+
+		h.db = db
+		h.owned = true
+	}
+
+	if err := h.db.Ping(); err != nil {
+		h.Stop()
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	h.queries = make(map[string]queries, len(tables))
+	for _, table := range tables {
+		name := h.config.TablePrefix + h.config.Namespace.Table(table)
+		if h.config.CreateSchema && !h.config.ReadOnly {
+			if _, err := h.db.Exec(h.dialect.CreateTable(name)); err != nil {
+				h.Stop()
+				return fmt.Errorf("failed to create table %s: %w", name, err)
+			}
+		}
+
+		h.queries[table] = queries{
+			upsert: h.dialect.Upsert(name),
+			delete: "DELETE FROM " + name + " WHERE k = " + h.dialect.Placeholder(1),
+			get:    "SELECT data FROM " + name + " WHERE k = " + h.dialect.Placeholder(1),
+			scan:   "SELECT data FROM " + name,
+			within: "SELECT data FROM " + name + " WHERE k >= " + h.dialect.Placeholder(1) + " AND k < " + h.dialect.Placeholder(2),
+			page:   "SELECT k, data FROM " + name + " WHERE k > " + h.dialect.Placeholder(1) + " ORDER BY k LIMIT " + strconv.Itoa(pageSize),
+		}
+	}
+
+	h.Log.Info("connected to sql database")
+
+	return nil
+}
+
+// Stop closes the database, if it was opened by the hook.
+func (h *Hook) Stop() error {
+	h.Log.Info("disconnecting from sql database")
+
+	db := h.db
+	h.db = nil
+	if db != nil && h.owned {
+		return db.Close()
+	}
+
+	return nil
+}
+
+// Health returns an error if the database cannot be reached.
+func (h *Hook) Health() error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return h.db.Ping()
+}
+
+// StorageStats returns the counters and latencies of the reads, writes and deletes of the hook.
+func (h *Hook) StorageStats() storage.Stats {
+	return h.stats.Stats()
+}
+
+// setKv stores an encoded value in a table.
+func (h *Hook) setKv(table, k string, v encoding.BinaryMarshaler) {
+	data, err := v.MarshalBinary()
+	if err != nil {
+		h.Log.Error("failed to marshal data", "error", err, "table", table, "key", k)
+		return
+	}
+
+	start := time.Now()
+	_, err = h.db.Exec(h.queries[table].upsert, k, data)
+	h.stats.Write(start, err)
+	if err != nil {
+		h.Log.Error("failed to upsert data", "error", err, "table", table, "key", k)
+	}
+}
+
+// delKv deletes a value from a table.
+func (h *Hook) delKv(table, k string) {
+	start := time.Now()
+	_, err := h.db.Exec(h.queries[table].delete, k)
+	h.stats.Delete(start, err)
+	if err != nil {
+		h.Log.Error("failed to delete data", "error", err, "table", table, "key", k)
+	}
+}
+
+// scan calls fn with the data of every row in a table.
+func (h *Hook) scan(table string, fn func(data []byte)) (err error) {
+	defer func(start time.Time) { h.stats.Read(start, err) }(time.Now())
+	rows, err := h.db.Query(h.queries[table].scan)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+		fn(data)
+	}
+
+	return rows.Err()
+}
+
+// scanWithin calls fn with the data of every row in a table with a key from lower to, but
+// not including, upper.
+func (h *Hook) scanWithin(table, lower, upper string, fn func(data []byte)) (err error) {
+	defer func(start time.Time) { h.stats.Read(start, err) }(time.Now())
+	rows, err := h.db.Query(h.queries[table].within, lower, upper)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+		fn(data)
+	}
+
+	return rows.Err()
+}
+
+// get returns the data of the row with a key in a table, or sql.ErrNoRows if there is no such row.
+func (h *Hook) get(table, k string) ([]byte, error) {
+	var data []byte
+	start := time.Now()
+	err := h.db.QueryRow(h.queries[table].get, k).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		h.stats.Read(start, nil) // a missing row is not a failed read
+	} else {
+		h.stats.Read(start, err)
+	}
+
+	return data, err
+}
+
+// page calls fn with the data of every row in a table, reading pageSize rows in each query
+// in order of key. Rows are visited after each page is read, so fn may write to the database.
+func (h *Hook) page(table string, fn func(data []byte) error) error {
+	var after string
+	for {
+		start := time.Now()
+		rows, err := h.db.Query(h.queries[table].page, after)
+		if err != nil {
+			h.stats.Read(start, err)
+			return err
+		}
+
+		page := make([][]byte, 0, pageSize)
+		for rows.Next() {
+			var data []byte
+			if err := rows.Scan(&after, &data); err != nil {
+				rows.Close()
+				h.stats.Read(start, err)
+				return err
+			}
+			page = append(page, data)
+		}
+
+		err = rows.Err()
+		rows.Close()
+		h.stats.Read(start, err)
+		if err != nil {
+			return err
+		}
+
+		for _, data := range page {
+			if err := fn(data); err != nil {
+				return err
+			}
+		}
+
+		if len(page) < pageSize {
+			return nil
+		}
+	}
+}
+
+// OnSessionEstablished adds a client to the store when their session is established.
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// OnWillSent is called when a client sends a Will Message and the Will Message is removed from the client record.
+func (h *Hook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// updateClient writes the client data to the store.
+func (h *Hook) updateClient(cl *mqtt.Client) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := cl.Properties.Props.Copy(false)
+	in := &storage.Client{
+		ID:              clientKey(cl),
+		T:               storage.ClientKey,
+		Remote:          cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		Username:        cl.Properties.Username,
+		Clean:           cl.Properties.Clean,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Properties: storage.ClientProperties{
+			SessionExpiryInterval: props.SessionExpiryInterval,
+			AuthenticationMethod:  props.AuthenticationMethod,
+			AuthenticationData:    props.AuthenticationData,
+			RequestProblemInfo:    props.RequestProblemInfo,
+			RequestResponseInfo:   props.RequestResponseInfo,
+			ReceiveMaximum:        props.ReceiveMaximum,
+			TopicAliasMaximum:     props.TopicAliasMaximum,
+			User:                  props.User,
+			MaximumPacketSize:     props.MaximumPacketSize,
+		},
+		Will: storage.ClientWill(cl.Properties.Will),
+	}
+
+	h.setKv(clientsTable, clientKey(cl), in)
+}
+
+// OnDisconnect removes a client from the store if they were using a clean session.
+func (h *Hook) OnDisconnect(cl *mqtt.Client, _ error, expire bool) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if !expire {
+		return
+	}
+
+	if cl.StopCause() == packets.ErrSessionTakenOver {
+		return
+	}
+
+	h.delKv(clientsTable, clientKey(cl))
+}
+
+// OnSubscribed adds one or more client subscriptions to the store.
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	var in *storage.Subscription
+	for i := 0; i < len(pk.Filters); i++ {
+		in = &storage.Subscription{
+			ID:                subscriptionKey(cl, pk.Filters[i].Filter),
+			T:                 storage.SubscriptionKey,
+			Client:            cl.ID,
+			Qos:               reasonCodes[i],
+			Filter:            pk.Filters[i].Filter,
+			Identifier:        pk.Filters[i].Identifier,
+			NoLocal:           pk.Filters[i].NoLocal,
+			RetainHandling:    pk.Filters[i].RetainHandling,
+			RetainAsPublished: pk.Filters[i].RetainAsPublished,
+		}
+
+		h.setKv(subscriptionsTable, in.ID, in)
+	}
+}
+
+// OnUnsubscribed removes one or more client subscriptions from the store.
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	for i := 0; i < len(pk.Filters); i++ {
+		h.delKv(subscriptionsTable, subscriptionKey(cl, pk.Filters[i].Filter))
+	}
+}
+
+// OnRetainMessage adds a retained message for a topic to the store.
+func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if r == -1 {
+		h.delKv(retainedTable, retainedKey(pk.TopicName))
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:              retainedKey(pk.TopicName),
+		T:               storage.RetainedKey,
+		FixedHeader:     pk.FixedHeader,
+		TopicName:       pk.TopicName,
+		Payload:         pk.Payload,
+		Created:         pk.Created,
+		Expiry:          pk.Expiry,
+		ProtocolVersion: pk.ProtocolVersion,
+		Client:          cl.ID,
+		Origin:          pk.Origin,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	h.setKv(retainedTable, in.ID, in)
+}
+
+// OnQosPublish adds or updates an inflight message in the store.
+func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, resends int) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in := h.message(storage.InflightKey, inflightKey(cl, pk), cl, pk, sent)
+	h.setKv(inflightTable, in.ID, in)
+
+	// queued messages are resent as duplicates once the client reconnects, and are inflight from then on.
+	if pk.FixedHeader.Dup {
+		h.delKv(queuedTable, in.ID)
+	}
+}
+
+// OnQueuedMessage adds a message queued for a disconnected client to the store.
+func (h *Hook) OnQueuedMessage(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in := h.message(storage.QueuedKey, inflightKey(cl, pk), cl, pk, 0)
+	h.setKv(queuedTable, in.ID, in)
+}
+
+// message returns a storable inflight or queued message.
+func (h *Hook) message(t, id string, cl *mqtt.Client, pk packets.Packet, sent int64) *storage.Message {
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:              id,
+		T:               t,
+		Client:          cl.ID,
+		Origin:          pk.Origin,
+		PacketID:        pk.PacketID,
+		FixedHeader:     pk.FixedHeader,
+		TopicName:       pk.TopicName,
+		Payload:         pk.Payload,
+		Sent:            sent,
+		Created:         pk.Created,
+		Expiry:          pk.Expiry,
+		ProtocolVersion: pk.ProtocolVersion,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	return in
+}
+
+// OnQosComplete removes a resolved inflight message from the store.
+func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.delKv(inflightTable, inflightKey(cl, pk))
+}
+
+// OnQosDropped removes a dropped inflight or queued message from the store.
+func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.OnQosComplete(cl, pk)
+	h.delKv(queuedTable, inflightKey(cl, pk))
+}
+
+// OnSysInfoTick stores the latest system info in the store.
+func (h *Hook) OnSysInfoTick(sys *system.Info) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in := &storage.SystemInfo{
+		ID:   sysInfoKey(),
+		T:    storage.SysInfoKey,
+		Info: *sys.Clone(),
+	}
+
+	h.setKv(sysInfoTable, sysInfoKey(), in)
+}
+
+// OnRetainedExpired deletes expired retained messages from the store.
+func (h *Hook) OnRetainedExpired(filter string) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.delKv(retainedTable, retainedKey(filter))
+}
+
+// OnClientExpired deleted expired clients from the store.
+func (h *Hook) OnClientExpired(cl *mqtt.Client) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.delKv(clientsTable, clientKey(cl))
+}
+
+// StoredClients returns all stored clients from the store.
+func (h *Hook) StoredClients() (v []storage.Client, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err = h.scan(clientsTable, func(data []byte) {
+		var d storage.Client
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal client data", "error", err, "data", data)
+			return
+		}
+		v = append(v, d)
+	})
+
+	return v, err
+}
+
+// StoredSubscriptions returns all stored subscriptions from the store.
+func (h *Hook) StoredSubscriptions() (v []storage.Subscription, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err = h.scan(subscriptionsTable, func(data []byte) {
+		var d storage.Subscription
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal subscription data", "error", err, "data", data)
+			return
+		}
+		v = append(v, d)
+	})
+
+	return v, err
+}
+
+// StoredRetainedMessages returns all stored retained messages from the store.
+func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err = h.scan(retainedTable, func(data []byte) {
+		var d storage.Message
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal retained message data", "error", err, "data", data)
+			return
+		}
+		v = append(v, d)
+	})
+
+	return v, err
+}
+
+// StoredInflightMessages returns all stored inflight messages from the store.
+func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err = h.scan(inflightTable, func(data []byte) {
+		var d storage.Message
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal inflight message data", "error", err, "data", data)
+			return
+		}
+		v = append(v, d)
+	})
+
+	return v, err
+}
+
+// StoredQueuedMessages returns all messages queued for disconnected clients from the store.
+func (h *Hook) StoredQueuedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err = h.scan(queuedTable, func(data []byte) {
+		var d storage.Message
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal queued message data", "error", err, "data", data)
+			return
+		}
+		v = append(v, d)
+	})
+
+	return v, err
+}
+
+// IterClients calls fn with each stored client in the store.
+func (h *Hook) IterClients(fn func(v storage.Client) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	return h.page(clientsTable, func(data []byte) error {
+		var d storage.Client
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal client data", "error", err, "data", data)
+			return nil
+		}
+		return fn(d)
+	})
+}
+
+// IterSubscriptions calls fn with each stored subscription in the store.
+func (h *Hook) IterSubscriptions(fn func(v storage.Subscription) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	return h.page(subscriptionsTable, func(data []byte) error {
+		var d storage.Subscription
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal subscription data", "error", err, "data", data)
+			return nil
+		}
+		return fn(d)
+	})
+}
+
+// IterRetainedMessages calls fn with each stored retained message in the store.
+func (h *Hook) IterRetainedMessages(fn func(v storage.Message) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	return h.page(retainedTable, func(data []byte) error {
+		var d storage.Message
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal retained message data", "error", err, "data", data)
+			return nil
+		}
+		return fn(d)
+	})
+}
+
+// IterInflightMessages calls fn with each stored inflight message in the store.
+func (h *Hook) IterInflightMessages(fn func(v storage.Message) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	return h.page(inflightTable, func(data []byte) error {
+		var d storage.Message
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal inflight message data", "error", err, "data", data)
+			return nil
+		}
+		return fn(d)
+	})
+}
+
+// IterQueuedMessages calls fn with each message queued for a disconnected client in the store.
+func (h *Hook) IterQueuedMessages(fn func(v storage.Message) error) error {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return nil
+	}
+
+	return h.page(queuedTable, func(data []byte) error {
+		var d storage.Message
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal queued message data", "error", err, "data", data)
+			return nil
+		}
+		return fn(d)
+	})
+}
+
+// StoredSysInfo returns the system info from the store.
+func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	data, err := h.get(sysInfoTable, sysInfoKey())
+	if errors.Is(err, sql.ErrNoRows) {
+		return v, nil
+	}
+
+	if err != nil {
+		return v, err
+	}
+
+	if err = v.UnmarshalBinary(data); err != nil {
+		h.Log.Error("failed to unmarshal sys info data", "error", err, "data", data)
+	}
+
+	return v, nil
+}
+
+// StoredSession returns the stored client, subscriptions, and inflight and queued messages
+// of a single client from the store. The keys of the rows of a client are prefixed with the
+// client id and a colon, so they are selected by range.
+func (h *Hook) StoredSession(id string) (v storage.Session, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	data, err := h.get(clientsTable, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return v, nil
+	} else if err != nil {
+		return
+	}
+
+	if err = v.Client.UnmarshalBinary(data); err != nil {
+		return
+	}
+
+	lower, upper := id+":", id+";" // ';' follows ':'
+	err = h.scanWithin(subscriptionsTable, lower, upper, func(data []byte) {
+		var d storage.Subscription
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal subscription data", "error", err, "data", data)
+			return
+		}
+		if d.Client == id {
+			v.Subscriptions = append(v.Subscriptions, d)
+		}
+	})
+	if err != nil {
+		return
+	}
+
+	err = h.scanWithin(inflightTable, lower, upper, func(data []byte) {
+		var d storage.Message
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal inflight message data", "error", err, "data", data)
+			return
+		}
+		if d.Client == id {
+			v.Inflight = append(v.Inflight, d)
+		}
+	})
+	if err != nil {
+		return
+	}
+
+	err = h.scanWithin(queuedTable, lower, upper, func(data []byte) {
+		var d storage.Message
+		if err := d.UnmarshalBinary(data); err != nil {
+			h.Log.Error("failed to unmarshal queued message data", "error", err, "data", data)
+			return
+		}
+		if d.Client == id {
+			v.Queued = append(v.Queued, d)
+		}
+	})
+
+	return v, err
+}
+
+// Export writes the clients, subscriptions, retained messages, inflight messages and
+// system info in the store to w as JSON Lines, which can be imported into any storage hook.
+func (h *Hook) Export(w io.Writer) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return storage.Export(w, h)
+}
+
+// Import adds the records of an export read from r to the store, replacing any existing
+// records with the same keys. It should be called before the server is started, as imported
+// records are only loaded on startup.
+func (h *Hook) Import(r io.Reader) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	if h.config.ReadOnly {
+		return storage.ErrReadOnly
+	}
+
+	return storage.Import(r, h.importRecord)
+}
+
+// importRecord stores an imported record in the table and under the key used by the hook.
+func (h *Hook) importRecord(v storage.Serializable) error {
+	var table, key string
+	switch v := v.(type) {
+	case *storage.Client:
+		table, key = clientsTable, clientKey(&mqtt.Client{ID: v.ID})
+		v.ID = key
+	case *storage.Subscription:
+		table, key = subscriptionsTable, subscriptionKey(&mqtt.Client{ID: v.Client}, v.Filter)
+		v.ID = key
+	case *storage.Message:
+		switch v.T {
+		case storage.RetainedKey:
+			table, key = retainedTable, retainedKey(v.TopicName)
+		case storage.QueuedKey:
+			table, key = queuedTable, inflightKey(&mqtt.Client{ID: v.Client}, packets.Packet{PacketID: v.PacketID})
+		default:
+			table, key = inflightTable, inflightKey(&mqtt.Client{ID: v.Client}, packets.Packet{PacketID: v.PacketID})
+		}
+		v.ID = key
+	case *storage.SystemInfo:
+		table, key = sysInfoTable, sysInfoKey()
+		v.ID = key
+	}
+
+	data, err := v.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	_, err = h.db.Exec(h.queries[table].upsert, key, data)
+	return err
+}
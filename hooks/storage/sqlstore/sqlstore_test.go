@@ -0,0 +1,901 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package sqlstore
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/system"
+
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+var (
+	logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	client = &mqtt.Client{
+		ID: "test",
+		Net: mqtt.ClientConnection{
+			Remote:   "test.addr",
+			Listener: "listener",
+		},
+		Properties: mqtt.ClientProperties{
+			Username: []byte("username"),
+			Clean:    false,
+		},
+	}
+
+	pkf = packets.Packet{Filters: packets.Subscriptions{{Filter: "a/b/c"}}}
+)
+
+// newHook returns a hook using a new sqlite database in a temporary directory.
+func newHook(t *testing.T) *Hook {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(&Options{
+		Driver:       "sqlite",
+		DSN:          filepath.Join(t.TempDir(), "mochi.db"),
+		CreateSchema: true,
+	})
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		_ = h.Stop()
+	})
+
+	return h
+}
+
+// get returns the data of a row in a table, or nil if it does not exist.
+func get(t *testing.T, h *Hook, table, k string) []byte {
+	var data []byte
+	err := h.db.QueryRow(h.queries[table].get, k).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+
+	require.NoError(t, err)
+	return data
+}
+
+func TestClientKey(t *testing.T) {
+	k := clientKey(&mqtt.Client{ID: "cl1"})
+	require.Equal(t, "cl1", k)
+}
+
+func TestSubscriptionKey(t *testing.T) {
+	k := subscriptionKey(&mqtt.Client{ID: "cl1"}, "a/b/c")
+	require.Equal(t, "cl1:a/b/c", k)
+}
+
+func TestRetainedKey(t *testing.T) {
+	k := retainedKey("a/b/c")
+	require.Equal(t, "a/b/c", k)
+}
+
+func TestInflightKey(t *testing.T) {
+	k := inflightKey(&mqtt.Client{ID: "cl1"}, packets.Packet{PacketID: 1})
+	require.Equal(t, "cl1:1", k)
+}
+
+func TestSysInfoKey(t *testing.T) {
+	require.Equal(t, storage.SysInfoKey, sysInfoKey())
+}
+
+func TestID(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.Equal(t, "sql-db", h.ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.True(t, h.Provides(mqtt.OnSessionEstablished))
+	require.True(t, h.Provides(mqtt.OnDisconnect))
+	require.True(t, h.Provides(mqtt.OnSubscribed))
+	require.True(t, h.Provides(mqtt.OnUnsubscribed))
+	require.True(t, h.Provides(mqtt.OnRetainMessage))
+	require.True(t, h.Provides(mqtt.OnQosPublish))
+	require.True(t, h.Provides(mqtt.OnQosComplete))
+	require.True(t, h.Provides(mqtt.OnQosDropped))
+	require.True(t, h.Provides(mqtt.OnSysInfoTick))
+	require.True(t, h.Provides(mqtt.StoredClients))
+	require.True(t, h.Provides(mqtt.StoredInflightMessages))
+	require.True(t, h.Provides(mqtt.StoredRetainedMessages))
+	require.True(t, h.Provides(mqtt.StoredSubscriptions))
+	require.True(t, h.Provides(mqtt.StoredSysInfo))
+	require.False(t, h.Provides(mqtt.OnACLCheck))
+	require.False(t, h.Provides(mqtt.OnConnectAuthenticate))
+}
+
+func TestInitBadConfig(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(map[string]any{})
+	require.ErrorIs(t, err, mqtt.ErrInvalidConfigType)
+}
+
+func TestInitMissingDatabase(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(nil)
+	require.ErrorIs(t, err, ErrMissingDatabase)
+}
+
+func TestInitBadTablePrefix(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(&Options{Driver: "sqlite", TablePrefix: "mochi; DROP TABLE x"})
+	require.ErrorIs(t, err, ErrInvalidTablePrefix)
+}
+
+func TestInitBadNamespace(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Driver: "sqlite", Namespace: "a:b"})
+	require.ErrorIs(t, err, storage.ErrInvalidNamespace)
+}
+
+func TestNamespace(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "mochi.db")
+	hooks := make([]*Hook, 2)
+	for i, ns := range []storage.Namespace{"t1", "t2"} {
+		hooks[i] = new(Hook)
+		hooks[i].SetOpts(logger, nil)
+		err := hooks[i].Init(&Options{Driver: "sqlite", DSN: dsn, CreateSchema: true, Namespace: ns})
+		require.NoError(t, err)
+		defer hooks[i].Stop()
+	}
+
+	hooks[0].OnSessionEstablished(client, packets.Packet{})
+
+	var n int
+	err := hooks[0].db.QueryRow("SELECT COUNT(*) FROM " + defaultTablePrefix + "t1_" + clientsTable).Scan(&n)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	r, err := hooks[0].StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+
+	r, err = hooks[1].StoredClients()
+	require.NoError(t, err)
+	require.Empty(t, r)
+}
+
+func TestReadOnly(t *testing.T) {
+	h := newHook(t)
+	h.OnSessionEstablished(client, packets.Packet{})
+
+	r := new(Hook)
+	r.SetOpts(logger, nil)
+	err := r.Init(&Options{DB: h.db, Driver: "sqlite", CreateSchema: true, ReadOnly: true})
+	require.NoError(t, err)
+
+	require.True(t, r.Provides(mqtt.StoredClients))
+	require.False(t, r.Provides(mqtt.OnSessionEstablished))
+	require.False(t, r.Provides(mqtt.OnSysInfoTick))
+
+	cl, err := r.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, cl, 1)
+	require.Equal(t, client.ID, cl[0].ID)
+
+	require.ErrorIs(t, r.Import(new(bytes.Buffer)), storage.ErrReadOnly)
+}
+
+func TestReadOnlyNoSchema(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Driver:       "sqlite",
+		DSN:          filepath.Join(t.TempDir(), "mochi.db"),
+		CreateSchema: true,
+		ReadOnly:     true,
+	})
+	require.NoError(t, err)
+	defer h.Stop()
+
+	_, err = h.StoredClients()
+	require.Error(t, err)
+}
+
+func TestInitUnknownDialect(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(&Options{Driver: "oracle"})
+	require.ErrorIs(t, err, ErrUnknownDialect)
+}
+
+func TestInitUnknownDriver(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(&Options{Driver: "mysql"})
+	require.Error(t, err)
+	require.Nil(t, h.db)
+}
+
+func TestInitWithDB(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "mochi.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err = h.Init(&Options{
+		DB:           db,
+		Dialect:      SQLiteDialect{},
+		TablePrefix:  "test_",
+		CreateSchema: true,
+	})
+	require.NoError(t, err)
+	require.False(t, h.owned)
+	require.Equal(t, "SELECT data FROM test_clients", h.queries[clientsTable].scan)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	require.NoError(t, h.Stop())
+	require.NoError(t, db.Ping()) // not closed by the hook
+}
+
+func TestInitDialectName(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "mochi.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err = h.Init(&Options{DB: db, DialectName: "sqlite3"})
+	require.NoError(t, err)
+	require.Equal(t, "sqlite", h.dialect.Name())
+	require.Equal(t, defaultTablePrefix, h.config.TablePrefix)
+}
+
+func TestInitCreateSchemaFails(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "mochi.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err = h.Init(&Options{DB: db, Dialect: extendedDialect{}, CreateSchema: true})
+	require.Error(t, err) // sqlite does not support unlogged tables
+	require.Nil(t, h.db)
+	require.NoError(t, db.Ping())
+}
+
+func TestStop(t *testing.T) {
+	h := newHook(t)
+	db := h.db
+	require.NoError(t, h.Stop())
+	require.Nil(t, h.db)
+	require.Error(t, db.Ping())
+	require.NoError(t, h.Stop())
+}
+
+func TestHealth(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Health(), storage.ErrDBFileNotOpen)
+
+	h = newHook(t)
+	require.NoError(t, h.Health())
+}
+
+func TestOnSessionEstablishedThenOnDisconnect(t *testing.T) {
+	h := newHook(t)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+
+	r := new(storage.Client)
+	err := r.UnmarshalBinary(get(t, h, clientsTable, clientKey(client)))
+	require.NoError(t, err)
+	require.Equal(t, client.ID, r.ID)
+	require.Equal(t, client.Net.Remote, r.Remote)
+	require.Equal(t, client.Net.Listener, r.Listener)
+	require.Equal(t, client.Properties.Username, r.Username)
+	require.Equal(t, client.Properties.Clean, r.Clean)
+
+	h.OnSessionEstablished(client, packets.Packet{}) // upsert
+	h.OnDisconnect(client, nil, false)
+	require.NotNil(t, get(t, h, clientsTable, clientKey(client)))
+
+	h.OnDisconnect(client, nil, true)
+	require.Nil(t, get(t, h, clientsTable, clientKey(client)))
+}
+
+func TestOnDisconnectSessionTakenOver(t *testing.T) {
+	h := newHook(t)
+
+	cl := &mqtt.Client{ID: "test"}
+	h.OnSessionEstablished(cl, packets.Packet{})
+	cl.Stop(packets.ErrSessionTakenOver)
+
+	h.OnDisconnect(cl, nil, true)
+	require.NotNil(t, get(t, h, clientsTable, clientKey(cl)))
+}
+
+func TestOnSessionEstablishedNoDB(t *testing.T) {
+	h := newHook(t)
+	h.db = nil
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnDisconnect(client, nil, true)
+}
+
+func TestOnSessionEstablishedClosedDB(t *testing.T) {
+	h := newHook(t)
+	require.NoError(t, h.db.Close())
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnDisconnect(client, nil, true)
+}
+
+func TestOnWillSent(t *testing.T) {
+	h := newHook(t)
+
+	c1 := &mqtt.Client{ID: client.ID}
+	c1.Properties.Will.Flag = 1
+	h.OnWillSent(c1, packets.Packet{})
+
+	r := new(storage.Client)
+	require.NoError(t, r.UnmarshalBinary(get(t, h, clientsTable, clientKey(client))))
+	require.Equal(t, uint32(1), r.Will.Flag)
+}
+
+func TestOnClientExpired(t *testing.T) {
+	h := newHook(t)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	require.NotNil(t, get(t, h, clientsTable, clientKey(client)))
+
+	h.OnClientExpired(client)
+	require.Nil(t, get(t, h, clientsTable, clientKey(client)))
+}
+
+func TestOnClientExpiredNoDB(t *testing.T) {
+	h := newHook(t)
+	h.db = nil
+	h.OnClientExpired(client)
+}
+
+func TestOnSubscribedThenOnUnsubscribed(t *testing.T) {
+	h := newHook(t)
+
+	h.OnSubscribed(client, pkf, []byte{0})
+
+	r := new(storage.Subscription)
+	require.NoError(t, r.UnmarshalBinary(get(t, h, subscriptionsTable, subscriptionKey(client, "a/b/c"))))
+	require.Equal(t, client.ID, r.Client)
+	require.Equal(t, pkf.Filters[0].Filter, r.Filter)
+	require.Equal(t, byte(0), r.Qos)
+
+	h.OnUnsubscribed(client, pkf)
+	require.Nil(t, get(t, h, subscriptionsTable, subscriptionKey(client, "a/b/c")))
+}
+
+func TestOnSubscribedNoDB(t *testing.T) {
+	h := newHook(t)
+	h.db = nil
+	h.OnSubscribed(client, pkf, []byte{0})
+	h.OnUnsubscribed(client, pkf)
+}
+
+func TestOnRetainMessageThenUnset(t *testing.T) {
+	h := newHook(t)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Retain: true,
+		},
+		Payload:   []byte("hello"),
+		TopicName: "a/b/c",
+	}
+
+	h.OnRetainMessage(client, pk, 1)
+
+	r := new(storage.Message)
+	require.NoError(t, r.UnmarshalBinary(get(t, h, retainedTable, retainedKey(pk.TopicName))))
+	require.Equal(t, pk.TopicName, r.TopicName)
+	require.Equal(t, pk.Payload, r.Payload)
+
+	h.OnRetainMessage(client, pk, -1)
+	require.Nil(t, get(t, h, retainedTable, retainedKey(pk.TopicName)))
+
+	h.OnRetainMessage(client, pk, 1)
+	h.OnRetainedExpired(pk.TopicName)
+	require.Nil(t, get(t, h, retainedTable, retainedKey(pk.TopicName)))
+}
+
+func TestOnRetainMessageNoDB(t *testing.T) {
+	h := newHook(t)
+	h.db = nil
+	h.OnRetainMessage(client, packets.Packet{}, 0)
+	h.OnRetainedExpired("a/b/c")
+}
+
+func TestOnQosPublishThenQOSComplete(t *testing.T) {
+	h := newHook(t)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Retain: true,
+			Qos:    2,
+		},
+		Payload:   []byte("hello"),
+		TopicName: "a/b/c",
+		PacketID:  7,
+	}
+
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	r := new(storage.Message)
+	require.NoError(t, r.UnmarshalBinary(get(t, h, inflightTable, inflightKey(client, pk))))
+	require.Equal(t, pk.TopicName, r.TopicName)
+	require.Equal(t, pk.Payload, r.Payload)
+	require.NotZero(t, r.Sent)
+
+	h.OnQosComplete(client, pk)
+	require.Nil(t, get(t, h, inflightTable, inflightKey(client, pk)))
+
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+	h.OnQosDropped(client, pk)
+	require.Nil(t, get(t, h, inflightTable, inflightKey(client, pk)))
+}
+
+func TestOnQosPublishNoDB(t *testing.T) {
+	h := newHook(t)
+	h.db = nil
+	h.OnQosPublish(client, packets.Packet{}, time.Now().Unix(), 0)
+	h.OnQosComplete(client, packets.Packet{})
+	h.OnQosDropped(client, packets.Packet{})
+}
+
+func TestOnQueuedMessageThenResend(t *testing.T) {
+	h := newHook(t)
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b/c",
+		Payload:     []byte("hello"),
+		PacketID:    7,
+	}
+	h.OnQueuedMessage(client, pk)
+
+	queued, err := h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Len(t, queued, 1)
+	require.Equal(t, storage.QueuedKey, queued[0].T)
+	require.Equal(t, uint16(7), queued[0].PacketID)
+	require.Equal(t, pk.Payload, queued[0].Payload)
+
+	inflight, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Empty(t, inflight)
+
+	// the queued message is resent as a duplicate when the client reconnects
+	pk.FixedHeader.Dup = true
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	queued, err = h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Empty(t, queued)
+
+	inflight, err = h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+	require.Equal(t, uint16(7), inflight[0].PacketID)
+}
+
+func TestOnQueuedMessageThenDropped(t *testing.T) {
+	h := newHook(t)
+	pk := packets.Packet{TopicName: "a/b/c", PacketID: 7}
+	h.OnQueuedMessage(client, pk)
+	h.OnQosDropped(client, pk)
+
+	queued, err := h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Empty(t, queued)
+}
+
+func TestOnQueuedMessageNoDB(t *testing.T) {
+	h := newHook(t)
+	h.db = nil
+	h.OnQueuedMessage(client, packets.Packet{})
+	v, _ := h.StoredQueuedMessages()
+	require.Empty(t, v)
+}
+
+func TestOnSysInfoTick(t *testing.T) {
+	h := newHook(t)
+
+	info := &system.Info{
+		Version:       "2.0.0",
+		BytesReceived: 100,
+	}
+
+	h.OnSysInfoTick(info)
+
+	r, err := h.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, info.Version, r.Version)
+	require.Equal(t, info.BytesReceived, r.BytesReceived)
+}
+
+func TestOnSysInfoTickNoDB(t *testing.T) {
+	h := newHook(t)
+	h.db = nil
+	h.OnSysInfoTick(new(system.Info))
+}
+
+func TestStoredClients(t *testing.T) {
+	h := newHook(t)
+
+	h.OnSessionEstablished(&mqtt.Client{ID: "cl1"}, packets.Packet{})
+	h.OnSessionEstablished(&mqtt.Client{ID: "cl2"}, packets.Packet{})
+	h.OnSessionEstablished(&mqtt.Client{ID: "cl3"}, packets.Packet{})
+
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 3)
+
+	sort.Slice(r, func(i, j int) bool { return r[i].ID < r[j].ID })
+	require.Equal(t, "cl1", r[0].ID)
+	require.Equal(t, "cl2", r[1].ID)
+	require.Equal(t, "cl3", r[2].ID)
+}
+
+func TestStoredClientsNoDB(t *testing.T) {
+	h := newHook(t)
+	h.db = nil
+	v, err := h.StoredClients()
+	require.Empty(t, v)
+	require.NoError(t, err)
+}
+
+func TestStoredClientsClosedDB(t *testing.T) {
+	h := newHook(t)
+	require.NoError(t, h.db.Close())
+	v, err := h.StoredClients()
+	require.Empty(t, v)
+	require.Error(t, err)
+}
+
+func TestStoredClientsBadData(t *testing.T) {
+	h := newHook(t)
+	_, err := h.db.Exec(h.queries[clientsTable].upsert, "cl1", []byte("{"))
+	require.NoError(t, err)
+
+	v, err := h.StoredClients()
+	require.Empty(t, v)
+	require.NoError(t, err)
+}
+
+func TestStoredSubscriptions(t *testing.T) {
+	h := newHook(t)
+
+	h.OnSubscribed(&mqtt.Client{ID: "cl1"}, pkf, []byte{0})
+	h.OnSubscribed(&mqtt.Client{ID: "cl2"}, pkf, []byte{1})
+
+	r, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+
+	sort.Slice(r, func(i, j int) bool { return r[i].ID < r[j].ID })
+	require.Equal(t, "cl1:a/b/c", r[0].ID)
+	require.Equal(t, "cl2:a/b/c", r[1].ID)
+	require.Equal(t, byte(1), r[1].Qos)
+}
+
+func TestStoredSubscriptionsNoDB(t *testing.T) {
+	h := newHook(t)
+	h.db = nil
+	v, err := h.StoredSubscriptions()
+	require.Empty(t, v)
+	require.NoError(t, err)
+}
+
+func TestStoredSubscriptionsClosedDB(t *testing.T) {
+	h := newHook(t)
+	require.NoError(t, h.db.Close())
+	v, err := h.StoredSubscriptions()
+	require.Empty(t, v)
+	require.Error(t, err)
+}
+
+func TestStoredRetainedMessages(t *testing.T) {
+	h := newHook(t)
+
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c"}, 1)
+	h.OnRetainMessage(client, packets.Packet{TopicName: "d/e/f"}, 1)
+	h.OnQosPublish(client, packets.Packet{TopicName: "g/h/i", PacketID: 1}, 0, 0)
+
+	r, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+
+	sort.Slice(r, func(i, j int) bool { return r[i].ID < r[j].ID })
+	require.Equal(t, "a/b/c", r[0].ID)
+	require.Equal(t, "d/e/f", r[1].ID)
+}
+
+func TestStoredRetainedMessagesNoDB(t *testing.T) {
+	h := newHook(t)
+	h.db = nil
+	v, err := h.StoredRetainedMessages()
+	require.Empty(t, v)
+	require.NoError(t, err)
+}
+
+func TestStoredRetainedMessagesClosedDB(t *testing.T) {
+	h := newHook(t)
+	require.NoError(t, h.db.Close())
+	v, err := h.StoredRetainedMessages()
+	require.Empty(t, v)
+	require.Error(t, err)
+}
+
+func TestStoredInflightMessages(t *testing.T) {
+	h := newHook(t)
+
+	h.OnQosPublish(client, packets.Packet{TopicName: "a/b/c", PacketID: 1}, 0, 0)
+	h.OnQosPublish(client, packets.Packet{TopicName: "a/b/c", PacketID: 2}, 0, 0)
+	h.OnRetainMessage(client, packets.Packet{TopicName: "d/e/f"}, 1)
+
+	r, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+
+	sort.Slice(r, func(i, j int) bool { return r[i].ID < r[j].ID })
+	require.Equal(t, "test:1", r[0].ID)
+	require.Equal(t, "test:2", r[1].ID)
+}
+
+func TestStoredInflightMessagesV5Properties(t *testing.T) {
+	h := newHook(t)
+
+	pk := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:       "a/b/c",
+		Payload:         []byte("hello"),
+		PacketID:        1,
+		ProtocolVersion: 5,
+		Created:         time.Now().Unix(),
+		Expiry:          time.Now().Unix() + 30,
+		Properties: packets.Properties{
+			PayloadFormat:          1,
+			PayloadFormatFlag:      true,
+			MessageExpiryInterval:  30,
+			SubscriptionIdentifier: []int{2},
+			User:                   []packets.UserProperty{{Key: "k", Val: "v"}},
+		},
+	}
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	r, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+
+	out := r[0].ToPacket()
+	require.Equal(t, pk.Expiry, out.Expiry)
+	require.Equal(t, pk.ProtocolVersion, out.ProtocolVersion)
+	require.Equal(t, pk.Properties.PayloadFormatFlag, out.Properties.PayloadFormatFlag)
+	require.Equal(t, pk.Properties.MessageExpiryInterval, out.Properties.MessageExpiryInterval)
+	require.Equal(t, pk.Properties.SubscriptionIdentifier, out.Properties.SubscriptionIdentifier)
+	require.Equal(t, pk.Properties.User, out.Properties.User)
+}
+
+func TestStoredInflightMessagesNoDB(t *testing.T) {
+	h := newHook(t)
+	h.db = nil
+	v, err := h.StoredInflightMessages()
+	require.Empty(t, v)
+	require.NoError(t, err)
+}
+
+func TestStoredInflightMessagesClosedDB(t *testing.T) {
+	h := newHook(t)
+	require.NoError(t, h.db.Close())
+	v, err := h.StoredInflightMessages()
+	require.Empty(t, v)
+	require.Error(t, err)
+}
+
+func TestStoredSysInfoEmpty(t *testing.T) {
+	h := newHook(t)
+	v, err := h.StoredSysInfo()
+	require.NoError(t, err)
+	require.Empty(t, v)
+}
+
+func TestStoredSysInfoNoDB(t *testing.T) {
+	h := newHook(t)
+	h.db = nil
+	v, err := h.StoredSysInfo()
+	require.Empty(t, v)
+	require.NoError(t, err)
+}
+
+func TestStoredSysInfoClosedDB(t *testing.T) {
+	h := newHook(t)
+	require.NoError(t, h.db.Close())
+	v, err := h.StoredSysInfo()
+	require.Empty(t, v)
+	require.Error(t, err)
+}
+
+func TestStoredSession(t *testing.T) {
+	h := newHook(t)
+
+	// a client with an id prefixed by the id of the client
+	other := &mqtt.Client{ID: client.ID + ":2"}
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b/c",
+		PacketID:    7,
+	}
+	for _, cl := range []*mqtt.Client{client, other} {
+		h.OnSessionEstablished(cl, packets.Packet{})
+		h.OnSubscribed(cl, pkf, []byte{0})
+		h.OnQosPublish(cl, pk, time.Now().Unix(), 0)
+	}
+	pk.PacketID = 8
+	h.OnQueuedMessage(client, pk)
+
+	v, err := h.StoredSession(client.ID)
+	require.NoError(t, err)
+	require.Equal(t, client.ID, v.Client.ID)
+	require.Len(t, v.Subscriptions, 1)
+	require.Equal(t, "a/b/c", v.Subscriptions[0].Filter)
+	require.Len(t, v.Inflight, 1)
+	require.Equal(t, uint16(7), v.Inflight[0].PacketID)
+	require.Len(t, v.Queued, 1)
+	require.Equal(t, uint16(8), v.Queued[0].PacketID)
+
+	v, err = h.StoredSession("absent")
+	require.NoError(t, err)
+	require.Empty(t, v)
+}
+
+func TestStoredSessionNoDB(t *testing.T) {
+	h := newHook(t)
+	h.db = nil
+	v, err := h.StoredSession(client.ID)
+	require.Empty(t, v)
+	require.NoError(t, err)
+}
+
+func TestStorageStats(t *testing.T) {
+	h := newHook(t)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	_, err := h.StoredSession("absent")
+	require.NoError(t, err)
+	h.OnClientExpired(client)
+
+	stats := h.StorageStats()
+	require.Positive(t, stats.Writes.Count)
+	require.Equal(t, int64(0), stats.Writes.Errors)
+	require.Equal(t, int64(1), stats.Reads.Count)
+	require.Equal(t, int64(0), stats.Reads.Errors) // a missing key is not a failed read
+	require.Equal(t, int64(1), stats.Deletes.Count)
+}
+
+func TestIterStored(t *testing.T) {
+	h := newHook(t)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{0})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b/c",
+		PacketID:    7,
+	}
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+	pk.PacketID = 8
+	h.OnQueuedMessage(client, pk)
+
+	var got []string
+	require.NoError(t, h.IterClients(func(v storage.Client) error {
+		got = append(got, v.ID)
+		return nil
+	}))
+	require.NoError(t, h.IterSubscriptions(func(v storage.Subscription) error {
+		got = append(got, v.Filter)
+		return nil
+	}))
+	visit := func(v storage.Message) error {
+		got = append(got, v.T)
+		return nil
+	}
+	require.NoError(t, h.IterRetainedMessages(visit))
+	require.NoError(t, h.IterInflightMessages(visit))
+	require.NoError(t, h.IterQueuedMessages(visit))
+	require.Equal(t, []string{client.ID, "a/b/c", storage.RetainedKey, storage.InflightKey, storage.QueuedKey}, got)
+
+	errVisit := errors.New("visit")
+	err := h.IterClients(func(v storage.Client) error {
+		return errVisit
+	})
+	require.ErrorIs(t, err, errVisit)
+}
+
+func TestExportImport(t *testing.T) {
+	h := newHook(t)
+	pk := packets.Packet{TopicName: "a/b/c", Payload: []byte("hi"), PacketID: 7}
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{1})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+	h.OnQueuedMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("later"), PacketID: 8})
+	h.OnSysInfoTick(&system.Info{Version: "2.0.0"})
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, h.Export(buf))
+
+	// records exported by other storage hooks have keys in a different format
+	buf.WriteString(`{"t":"SUB","id":"SUB_cl2:d/e","client":"cl2","filter":"d/e","qos":2}` + "\n")
+
+	h2 := newHook(t)
+	require.NoError(t, h2.Import(buf))
+
+	clients, err := h2.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	require.Equal(t, client.ID, clients[0].ID)
+	require.Equal(t, client.Properties.Username, clients[0].Username)
+
+	subs, err := h2.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Filter < subs[j].Filter })
+	require.Equal(t, "a/b/c", subs[0].Filter)
+	require.Equal(t, subscriptionKey(&mqtt.Client{ID: "cl2"}, "d/e"), subs[1].ID)
+	require.Equal(t, byte(2), subs[1].Qos)
+
+	retained, err := h2.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+	require.Equal(t, []byte("hello"), retained[0].Payload)
+
+	inflight, err := h2.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+	require.Equal(t, []byte("hi"), inflight[0].Payload)
+	require.Equal(t, inflightKey(client, pk), inflight[0].ID)
+
+	queued, err := h2.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Len(t, queued, 1)
+	require.Equal(t, []byte("later"), queued[0].Payload)
+	require.Equal(t, uint16(8), queued[0].PacketID)
+
+	sys, err := h2.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, "2.0.0", sys.Version)
+}
+
+func TestExportImportNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Export(new(bytes.Buffer)), storage.ErrDBFileNotOpen)
+	require.ErrorIs(t, h.Import(new(bytes.Buffer)), storage.ErrDBFileNotOpen)
+}
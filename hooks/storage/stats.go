@@ -0,0 +1,110 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the buckets of the latency histograms of storage
+// operations. Operations slower than the last bound are counted in a final bucket.
+var LatencyBuckets = [...]time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// Stats contains the counters and latency histograms of the operations of a storage hook.
+type Stats struct {
+	Reads   OperationStats `json:"reads"`   // reads of stored values, including iterations
+	Writes  OperationStats `json:"writes"`  // inserts and updates of stored values
+	Deletes OperationStats `json:"deletes"` // deletions of stored values
+}
+
+// OperationStats contains the counters and latency histogram of a type of storage operation.
+type OperationStats struct {
+	Count   int64   `json:"count"`   // the number of operations
+	Errors  int64   `json:"errors"`  // the number of operations which failed
+	Latency int64   `json:"latency"` // the total duration of the operations in microseconds
+	Buckets []int64 `json:"buckets"` // the number of operations within each of LatencyBuckets, then slower
+}
+
+// Recorder records the operations of a storage hook. It is safe for concurrent use,
+// and the zero value is ready to use.
+type Recorder struct {
+	reads   operationRecorder
+	writes  operationRecorder
+	deletes operationRecorder
+}
+
+// operationRecorder records a type of storage operation.
+type operationRecorder struct {
+	count   atomic.Int64
+	errors  atomic.Int64
+	latency atomic.Int64
+	buckets [len(LatencyBuckets) + 1]atomic.Int64
+}
+
+// Read records a read which started at start and returned err.
+func (r *Recorder) Read(start time.Time, err error) {
+	r.reads.record(time.Since(start), err)
+}
+
+// Write records a write which started at start and returned err.
+func (r *Recorder) Write(start time.Time, err error) {
+	r.writes.record(time.Since(start), err)
+}
+
+// Delete records a delete which started at start and returned err.
+func (r *Recorder) Delete(start time.Time, err error) {
+	r.deletes.record(time.Since(start), err)
+}
+
+// Stats returns the counters and latency histograms of the recorded operations.
+func (r *Recorder) Stats() Stats {
+	return Stats{
+		Reads:   r.reads.stats(),
+		Writes:  r.writes.stats(),
+		Deletes: r.deletes.stats(),
+	}
+}
+
+// record adds an operation which took d to the counters and the histogram.
+func (o *operationRecorder) record(d time.Duration, err error) {
+	o.count.Add(1)
+	if err != nil {
+		o.errors.Add(1)
+	}
+	o.latency.Add(d.Microseconds())
+
+	i := 0
+	for i < len(LatencyBuckets) && d > LatencyBuckets[i] {
+		i++
+	}
+	o.buckets[i].Add(1)
+}
+
+// stats returns the recorded values.
+func (o *operationRecorder) stats() OperationStats {
+	v := OperationStats{
+		Count:   o.count.Load(),
+		Errors:  o.errors.Load(),
+		Latency: o.latency.Load(),
+		Buckets: make([]int64, len(o.buckets)),
+	}
+
+	for i := range o.buckets {
+		v.Buckets[i] = o.buckets[i].Load()
+	}
+
+	return v
+}
@@ -0,0 +1,63 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorderZero(t *testing.T) {
+	var r Recorder
+	v := r.Stats()
+	require.Equal(t, int64(0), v.Reads.Count)
+	require.Len(t, v.Reads.Buckets, len(LatencyBuckets)+1)
+	require.Len(t, v.Writes.Buckets, len(LatencyBuckets)+1)
+	require.Len(t, v.Deletes.Buckets, len(LatencyBuckets)+1)
+}
+
+func TestRecorderRecord(t *testing.T) {
+	var r Recorder
+	now := time.Now()
+	r.Read(now, nil)
+	r.Read(now.Add(-2*time.Millisecond), errors.New("test"))
+	r.Write(now.Add(-2*time.Second), nil)
+	r.Delete(now, nil)
+	r.Delete(now, nil)
+
+	v := r.Stats()
+	require.Equal(t, int64(2), v.Reads.Count)
+	require.Equal(t, int64(1), v.Reads.Errors)
+	require.GreaterOrEqual(t, v.Reads.Latency, int64(2000))
+	require.Equal(t, int64(1), v.Reads.Buckets[0])
+	require.Equal(t, int64(1), v.Reads.Buckets[3]) // up to 5ms
+
+	require.Equal(t, int64(1), v.Writes.Count)
+	require.Equal(t, int64(0), v.Writes.Errors)
+	require.Equal(t, int64(1), v.Writes.Buckets[len(LatencyBuckets)]) // slower than the last bucket
+
+	require.Equal(t, int64(2), v.Deletes.Count)
+}
+
+func TestRecorderConcurrent(t *testing.T) {
+	var r Recorder
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				r.Write(time.Now(), nil)
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, int64(1000), r.Stats().Writes.Count)
+}
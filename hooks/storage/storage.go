@@ -17,12 +17,16 @@ const (
 	SysInfoKey      = "SYS" // unique key to denote server system information in a store
 	RetainedKey     = "RET" // unique key to denote retained messages in a store
 	InflightKey     = "IFM" // unique key to denote inflight messages in a store
+	QueuedKey       = "QUE" // unique key to denote messages queued for disconnected clients in a store
 	ClientKey       = "CL"  // unique key to denote clients in a store
 )
 
 var (
 	// ErrDBFileNotOpen indicates that the file database (e.g. bolt/badger) wasn't open for reading.
 	ErrDBFileNotOpen = errors.New("db file not open")
+
+	// ErrReadOnly indicates a write was attempted on a store opened in read-only mode.
+	ErrReadOnly = errors.New("store is read-only")
 )
 
 // Serializable is an interface for objects that can be serialized and deserialized.
@@ -68,6 +72,7 @@ type ClientWill struct {
 	WillDelayInterval uint32                 `json:"willDelayInterval,omitempty"`
 	Qos               byte                   `json:"qos,omitempty"`
 	Retain            bool                   `json:"retain,omitempty"`
+	Expiry            int64                  `json:"expiry,omitempty"`
 }
 
 // MarshalBinary encodes the values into a json string.
@@ -85,17 +90,20 @@ func (d *Client) UnmarshalBinary(data []byte) error {
 
 // Message is a storable representation of an MQTT message (specifically publish).
 type Message struct {
-	Properties  MessageProperties   `json:"properties"`              // -
-	Payload     []byte              `json:"payload"`                 // the message payload (if retained)
-	T           string              `json:"t,omitempty"`             // the data type
-	ID          string              `json:"id,omitempty" storm:"id"` // the storage key
-	Client      string              `json:"client,omitempty"`        // the client id the message is for
-	Origin      string              `json:"origin,omitempty"`        // the id of the client who sent the message
-	TopicName   string              `json:"topic_name,omitempty"`    // the topic the message was sent to (if retained)
-	FixedHeader packets.FixedHeader `json:"fixedheader"`             // the header properties of the message
-	Created     int64               `json:"created,omitempty"`       // the time the message was created in unixtime
-	Sent        int64               `json:"sent,omitempty"`          // the last time the message was sent (for retries) in unixtime (if inflight)
-	PacketID    uint16              `json:"packet_id,omitempty"`     // the unique id of the packet (if inflight)
+	Properties      MessageProperties   `json:"properties"`                // -
+	Payload         []byte              `json:"payload"`                   // the message payload (if retained)
+	T               string              `json:"t,omitempty"`               // the data type
+	ID              string              `json:"id,omitempty" storm:"id"`   // the storage key
+	Client          string              `json:"client,omitempty"`          // the client id the message is for
+	Origin          string              `json:"origin,omitempty"`          // the id of the client who sent the message
+	TopicName       string              `json:"topic_name,omitempty"`      // the topic the message was sent to (if retained)
+	FixedHeader     packets.FixedHeader `json:"fixedheader"`               // the header properties of the message
+	Created         int64               `json:"created,omitempty"`         // the time the message was created in unixtime
+	Sent            int64               `json:"sent,omitempty"`            // the last time the message was sent (for retries) in unixtime (if inflight)
+	PacketID        uint16              `json:"packet_id,omitempty"`       // the unique id of the packet (if inflight)
+	Compression     string              `json:"compression,omitempty"`     // the algorithm the payload was compressed with, if compressed
+	Expiry          int64               `json:"expiry,omitempty"`          // the time the message expires in unixtime, if it expires
+	ProtocolVersion byte                `json:"protocolVersion,omitempty"` // the mqtt protocol version of the message
 }
 
 // MessageProperties contains a limited subset of mqtt v5 properties specific to publish messages.
@@ -116,23 +124,30 @@ func (d Message) MarshalBinary() (data []byte, err error) {
 	return json.Marshal(d)
 }
 
-// UnmarshalBinary decodes a json string into a struct.
+// UnmarshalBinary decodes a json string into a struct, decompressing the payload if it was compressed.
 func (d *Message) UnmarshalBinary(data []byte) error {
 	if len(data) == 0 {
 		return nil
 	}
-	return json.Unmarshal(data, d)
+
+	if err := json.Unmarshal(data, d); err != nil {
+		return err
+	}
+
+	return decompressMessage(d)
 }
 
 // ToPacket converts a storage.Message to a standard packet.
 func (d *Message) ToPacket() packets.Packet {
 	pk := packets.Packet{
-		FixedHeader: d.FixedHeader,
-		PacketID:    d.PacketID,
-		TopicName:   d.TopicName,
-		Payload:     d.Payload,
-		Origin:      d.Origin,
-		Created:     d.Created,
+		FixedHeader:     d.FixedHeader,
+		PacketID:        d.PacketID,
+		TopicName:       d.TopicName,
+		Payload:         d.Payload,
+		Origin:          d.Origin,
+		Created:         d.Created,
+		Expiry:          d.Expiry,
+		ProtocolVersion: d.ProtocolVersion,
 		Properties: packets.Properties{
 			PayloadFormat:          d.Properties.PayloadFormat,
 			PayloadFormatFlag:      d.Properties.PayloadFormatFlag,
@@ -180,6 +195,15 @@ func (d *Subscription) UnmarshalBinary(data []byte) error {
 	return json.Unmarshal(data, d)
 }
 
+// Session is the stored state of a single client, used to restore the session of a
+// client when it reconnects. The Client ID is empty if no session is stored.
+type Session struct {
+	Client        Client         // the stored client
+	Subscriptions []Subscription // the subscriptions of the client
+	Inflight      []Message      // the inflight messages of the client
+	Queued        []Message      // the messages queued for the client while disconnected
+}
+
 // SystemInfo is a storable representation of the system information values.
 type SystemInfo struct {
 	system.Info        // embed the system info struct
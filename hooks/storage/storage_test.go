@@ -76,11 +76,13 @@ var (
 				{Key: "k2", Val: "v2"},
 			},
 		},
-		Created:  time.Date(2019, time.September, 21, 1, 2, 3, 4, time.UTC).Unix(),
-		Sent:     time.Date(2019, time.September, 21, 1, 2, 3, 4, time.UTC).Unix(),
-		PacketID: 100,
+		Created:         time.Date(2019, time.September, 21, 1, 2, 3, 4, time.UTC).Unix(),
+		Sent:            time.Date(2019, time.September, 21, 1, 2, 3, 4, time.UTC).Unix(),
+		Expiry:          time.Date(2019, time.September, 21, 1, 2, 23, 4, time.UTC).Unix(),
+		PacketID:        100,
+		ProtocolVersion: 5,
 	}
-	messageJSON = []byte(`{"properties":{"correlationData":"cg==","subscriptionIdentifier":[1],"user":[{"k":"k2","v":"v2"}],"contentType":"type","responseTopic":"a/b/r","messageExpiry":20,"topicAlias":2,"payloadFormat":1,"payloadFormatFlag":true},"payload":"cGF5bG9hZA==","t":"message","id":"id","origin":"mochi","topic_name":"topic","fixedheader":{"remaining":2,"type":3,"qos":1,"dup":true,"retain":true},"created":1569027723,"sent":1569027723,"packet_id":100}`)
+	messageJSON = []byte(`{"properties":{"correlationData":"cg==","subscriptionIdentifier":[1],"user":[{"k":"k2","v":"v2"}],"contentType":"type","responseTopic":"a/b/r","messageExpiry":20,"topicAlias":2,"payloadFormat":1,"payloadFormatFlag":true},"payload":"cGF5bG9hZA==","t":"message","id":"id","origin":"mochi","topic_name":"topic","fixedheader":{"remaining":2,"type":3,"qos":1,"dup":true,"retain":true},"created":1569027723,"sent":1569027723,"expiry":1569027743,"packet_id":100,"protocolVersion":5}`)
 
 	subscriptionStruct = Subscription{
 		T:      "subscription",
@@ -221,8 +223,10 @@ func TestMessageToPacket(t *testing.T) {
 			TopicAlias:             d.Properties.TopicAlias,
 			User:                   d.Properties.User,
 		},
-		PacketID: 100,
-		Created:  d.Created,
+		PacketID:        100,
+		Created:         d.Created,
+		Expiry:          d.Expiry,
+		ProtocolVersion: 5,
 	}, pk)
 
 }
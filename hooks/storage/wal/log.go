@@ -0,0 +1,192 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	opSet    byte = 1 // a record which sets the value of a key
+	opDelete byte = 2 // a record which deletes a key
+
+	// recordHeaderSize is the size of the length and checksum which prefix each record.
+	recordHeaderSize = 8
+
+	// maxRecordSize is the maximum size of a record read from a log segment.
+	maxRecordSize = 256 << 20
+
+	segmentExt    = ".wal"        // the file extension of log segments
+	checkpointExt = ".checkpoint" // the file extension of checkpoints
+)
+
+var (
+	// ErrCorruptLog indicates a log segment other than the newest is damaged, so the store
+	// cannot be recovered without losing writes.
+	ErrCorruptLog = errors.New("corrupt write-ahead log")
+
+	// crcTable is the table used to checksum records.
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// segmentPath returns the path of the log segment with sequence number seq.
+func segmentPath(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+// checkpointPath returns the path of the checkpoint which covers the log segments before seq.
+func checkpointPath(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", seq, checkpointExt))
+}
+
+// listFiles returns the sorted sequence numbers of the log segments and checkpoints in dir.
+func listFiles(dir string) (segments, checkpoints []uint64, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		ext := filepath.Ext(name)
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+		if err != nil || e.IsDir() {
+			continue
+		}
+
+		switch ext {
+		case segmentExt:
+			segments = append(segments, seq)
+		case checkpointExt:
+			checkpoints = append(checkpoints, seq)
+		}
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	sort.Slice(checkpoints, func(i, j int) bool { return checkpoints[i] < checkpoints[j] })
+	return segments, checkpoints, nil
+}
+
+// encodeRecord appends a record of an operation on a key to buf. Each record is prefixed by
+// the length and CRC-32C checksum of the operation, key and value which follow it.
+func encodeRecord(buf []byte, op byte, key string, value []byte) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, recordHeaderSize)...)
+	buf = append(buf, op)
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+
+	payload := buf[start+recordHeaderSize:]
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[start+4:], crc32.Checksum(payload, crcTable))
+	return buf
+}
+
+// replayLog calls apply with each record read from a log segment, and returns the offset of
+// the end of the last whole record. The replay ends at the first torn or corrupt record, such
+// as one which was being written when the process crashed, and torn is returned as true.
+func replayLog(r io.Reader, apply func(op byte, key string, value []byte)) (offset int64, torn bool, err error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := io.ReadFull(br, header); errors.Is(err, io.EOF) {
+			return offset, false, nil
+		} else if errors.Is(err, io.ErrUnexpectedEOF) {
+			return offset, true, nil
+		} else if err != nil {
+			return offset, false, err
+		}
+
+		n := binary.LittleEndian.Uint32(header)
+		if n == 0 || n > maxRecordSize {
+			return offset, true, nil
+		}
+
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(br, payload); errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			return offset, true, nil
+		} else if err != nil {
+			return offset, false, err
+		}
+
+		if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:]) {
+			return offset, true, nil
+		}
+
+		op := payload[0]
+		k, m := binary.Uvarint(payload[1:])
+		if m <= 0 || k > uint64(len(payload)-1-m) || (op != opSet && op != opDelete) {
+			return offset, true, nil
+		}
+
+		key := string(payload[1+m : 1+m+int(k)])
+		apply(op, key, payload[1+m+int(k):])
+		offset += int64(recordHeaderSize + n)
+	}
+}
+
+// segment is a log segment which records are appended to.
+type segment struct {
+	seq  uint64   // the sequence number of the segment
+	f    *os.File // the segment file
+	size int64    // the size of the records written to the segment
+	sync bool     // synchronize each record to disk when it is written
+	buf  []byte   // a buffer reused to encode records
+}
+
+// openSegment opens the log segment with sequence number seq for appending, creating it if
+// it does not exist.
+func openSegment(dir string, seq uint64, sync bool) (*segment, error) {
+	f, err := os.OpenFile(segmentPath(dir, seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return &segment{seq: seq, f: f, size: info.Size(), sync: sync}, nil
+}
+
+// append writes a record of an operation on a key to the segment. A record which fails to be
+// written is truncated from the segment, so later records are not lost behind it.
+func (s *segment) append(op byte, key string, value []byte) error {
+	s.buf = encodeRecord(s.buf[:0], op, key, value)
+	_, err := s.f.Write(s.buf)
+	if err == nil && s.sync {
+		err = s.f.Sync()
+	}
+
+	if err != nil {
+		_ = s.f.Truncate(s.size)
+		return err
+	}
+
+	s.size += int64(len(s.buf))
+	return nil
+}
+
+// close synchronizes the segment to disk and closes it.
+func (s *segment) close() error {
+	err := s.f.Sync()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package wal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type replayed struct {
+	op    byte
+	key   string
+	value string
+}
+
+func replayAll(t *testing.T, b []byte) ([]replayed, int64, bool) {
+	var got []replayed
+	offset, torn, err := replayLog(bytes.NewReader(b), func(op byte, key string, value []byte) {
+		got = append(got, replayed{op, key, string(value)})
+	})
+	require.NoError(t, err)
+	return got, offset, torn
+}
+
+func TestReplayLog(t *testing.T) {
+	b := encodeRecord(nil, opSet, "a", []byte("1"))
+	b = encodeRecord(b, opSet, "b", nil)
+	b = encodeRecord(b, opDelete, "a", nil)
+
+	got, offset, torn := replayAll(t, b)
+	require.False(t, torn)
+	require.Equal(t, int64(len(b)), offset)
+	require.Equal(t, []replayed{
+		{opSet, "a", "1"},
+		{opSet, "b", ""},
+		{opDelete, "a", ""},
+	}, got)
+}
+
+func TestReplayLogEmpty(t *testing.T) {
+	got, offset, torn := replayAll(t, nil)
+	require.False(t, torn)
+	require.Equal(t, int64(0), offset)
+	require.Empty(t, got)
+}
+
+func TestReplayLogTorn(t *testing.T) {
+	first := encodeRecord(nil, opSet, "a", []byte("1"))
+	b := encodeRecord(first, opSet, "b", []byte("2"))
+
+	for _, n := range []int{len(first) + 1, len(first) + recordHeaderSize, len(b) - 1} {
+		got, offset, torn := replayAll(t, b[:n])
+		require.True(t, torn)
+		require.Equal(t, int64(len(first)), offset)
+		require.Len(t, got, 1)
+	}
+}
+
+func TestReplayLogChecksumMismatch(t *testing.T) {
+	first := encodeRecord(nil, opSet, "a", []byte("1"))
+	b := encodeRecord(first, opSet, "b", []byte("2"))
+	b = encodeRecord(b, opSet, "c", []byte("3"))
+	b[len(first)+recordHeaderSize+2] ^= 0xff
+
+	got, offset, torn := replayAll(t, b)
+	require.True(t, torn)
+	require.Equal(t, int64(len(first)), offset)
+	require.Equal(t, []replayed{{opSet, "a", "1"}}, got)
+}
+
+func TestReplayLogBadOp(t *testing.T) {
+	got, offset, torn := replayAll(t, encodeRecord(nil, 9, "a", nil))
+	require.True(t, torn)
+	require.Equal(t, int64(0), offset)
+	require.Empty(t, got)
+}
+
+func TestListFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		filepath.Base(segmentPath(dir, 10)),
+		filepath.Base(segmentPath(dir, 2)),
+		filepath.Base(checkpointPath(dir, 2)),
+		"00000000000000000003.checkpoint.tmp",
+		"notes.wal",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0600))
+	}
+
+	segments, checkpoints, err := listFiles(dir)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2, 10}, segments)
+	require.Equal(t, []uint64{2}, checkpoints)
+}
+
+func TestSegmentAppend(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSegment(dir, 1, true)
+	require.NoError(t, err)
+	require.NoError(t, s.append(opSet, "a", []byte("1")))
+	require.NoError(t, s.close())
+
+	s, err = openSegment(dir, 1, false)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(encodeRecord(nil, opSet, "a", []byte("1")))), s.size)
+	require.NoError(t, s.append(opDelete, "a", nil))
+	require.NoError(t, s.close())
+
+	b, err := os.ReadFile(segmentPath(dir, 1))
+	require.NoError(t, err)
+	got, _, torn := replayAll(t, b)
+	require.False(t, torn)
+	require.Len(t, got, 2)
+}
+
+func TestSegmentAppendClosed(t *testing.T) {
+	s, err := openSegment(t.TempDir(), 1, false)
+	require.NoError(t, err)
+	require.NoError(t, s.close())
+	require.Error(t, s.append(opSet, "a", nil))
+	require.Equal(t, int64(0), s.size)
+}
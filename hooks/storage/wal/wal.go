@@ -0,0 +1,1064 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+// Package wal provides a storage hook which keeps stored values in memory and appends each
+// write to a crash-consistent write-ahead log, which is periodically checkpointed. Appending
+// to a log sustains a higher write throughput than updating a database, which suits the
+// frequent writes and deletes of inflight messages.
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/hooks/storage"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/system"
+)
+
+var (
+	ErrKeyNotFound = errors.New("key not found")
+)
+
+const (
+	// defaultPath is the default directory of the log segments and checkpoints.
+	defaultPath = ".wal"
+
+	// defaultCheckpointInterval is the default number of seconds between checkpoints.
+	defaultCheckpointInterval = 60
+
+	// defaultCheckpointSize is the default size of the log in bytes which triggers a checkpoint.
+	defaultCheckpointSize = 64 << 20
+)
+
+// clientKey returns a primary key for a client.
+func clientKey(cl *mqtt.Client) string {
+	return storage.ClientKey + "_" + cl.ID
+}
+
+// subscriptionKey returns a primary key for a subscription.
+func subscriptionKey(cl *mqtt.Client, filter string) string {
+	return storage.SubscriptionKey + "_" + cl.ID + ":" + filter
+}
+
+// retainedKey returns a primary key for a retained message.
+func retainedKey(topic string) string {
+	return storage.RetainedKey + "_" + topic
+}
+
+// inflightKey returns a primary key for an inflight message.
+func inflightKey(cl *mqtt.Client, pk packets.Packet) string {
+	return storage.InflightKey + "_" + cl.ID + ":" + pk.FormatID()
+}
+
+// queuedKey returns a primary key for a message queued for a disconnected client.
+func queuedKey(cl *mqtt.Client, pk packets.Packet) string {
+	return storage.QueuedKey + "_" + cl.ID + ":" + pk.FormatID()
+}
+
+// sysInfoKey returns a primary key for system info.
+func sysInfoKey() string {
+	return storage.SysInfoKey
+}
+
+// Options contains configuration settings for the write-ahead log.
+type Options struct {
+	// Path is the directory of the log segments and checkpoints, which is created if it does not exist.
+	Path string `yaml:"path" json:"path"`
+
+	// Sync synchronizes each write to disk before it is applied. Otherwise, writes are handed to
+	// the operating system as they are made, so survive a crash of the process, but the most
+	// recent writes may be lost if the machine fails.
+	Sync bool `yaml:"sync" json:"sync"`
+
+	// CheckpointInterval is the seconds between checkpoints (default 60). A checkpoint is only
+	// taken if the log has been written to since the last one.
+	CheckpointInterval int64 `yaml:"checkpoint_interval" json:"checkpoint_interval"`
+
+	// CheckpointSize is the size of the log in bytes at which a checkpoint is taken before the
+	// interval has passed (default 64MB).
+	CheckpointSize int64 `yaml:"checkpoint_size" json:"checkpoint_size"`
+
+	// Compression compresses retained and inflight message payloads above a size threshold.
+	Compression storage.Compression `yaml:"compression" json:"compression"`
+}
+
+// Hook is a persistent storage hook which keeps stored values in memory, and appends each write
+// to a write-ahead log.
+type Hook struct {
+	mqtt.HookBase
+	config     *Options          // options for configuring the write-ahead log.
+	mu         sync.RWMutex      // guards data, log and err.
+	data       map[string][]byte // the stored values, keyed by primary key.
+	log        *segment          // the log segment writes are appended to.
+	err        error             // the error of the last failed append or checkpoint, if any.
+	checkMu    sync.Mutex        // serializes checkpoints.
+	checkpoint chan struct{}     // signals the checkpoint loop to take a checkpoint.
+	done       chan struct{}     // closed to stop the checkpoint loop.
+	stopped    chan struct{}     // closed when the checkpoint loop has stopped.
+	stats      storage.Recorder  // records the reads, writes and deletes of the hook
+}
+
+// ID returns the id of the hook.
+func (h *Hook) ID() string {
+	return "wal"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+		mqtt.OnRetainMessage,
+		mqtt.OnWillSent,
+		mqtt.OnQosPublish,
+		mqtt.OnQosComplete,
+		mqtt.OnQosDropped,
+		mqtt.OnQueuedMessage,
+		mqtt.OnSysInfoTick,
+		mqtt.OnClientExpired,
+		mqtt.OnRetainedExpired,
+		mqtt.StoredClients,
+		mqtt.StoredInflightMessages,
+		mqtt.StoredQueuedMessages,
+		mqtt.StoredRetainedMessages,
+		mqtt.StoredSubscriptions,
+		mqtt.StoredSysInfo,
+		mqtt.StoredSession,
+	}, []byte{b})
+}
+
+// Init recovers the store from the latest checkpoint and the log written since, and starts
+// taking checkpoints.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.config = config.(*Options)
+	if err := h.config.Compression.Validate(); err != nil {
+		return err
+	}
+
+	if len(h.config.Path) == 0 {
+		h.config.Path = defaultPath
+	}
+
+	if h.config.CheckpointInterval <= 0 {
+		h.config.CheckpointInterval = defaultCheckpointInterval
+	}
+
+	if h.config.CheckpointSize <= 0 {
+		h.config.CheckpointSize = defaultCheckpointSize
+	}
+
+	if err := os.MkdirAll(h.config.Path, 0700); err != nil {
+		return err
+	}
+
+	h.data = make(map[string][]byte)
+	next, err := h.recover()
+	if err != nil {
+		h.data = nil
+		return err
+	}
+
+	h.log, err = openSegment(h.config.Path, next, h.config.Sync)
+	if err != nil {
+		h.data = nil
+		return err
+	}
+
+	from, err := storage.Migrate(records{h: h}, storage.Migrations, storage.SchemaVersion)
+	if err != nil {
+		_ = h.log.close()
+		h.log, h.data = nil, nil
+		return err
+	}
+
+	if from != storage.SchemaVersion {
+		h.Log.Info("migrated storage schema", "from", from, "to", storage.SchemaVersion)
+	}
+
+	h.checkpoint = make(chan struct{}, 1)
+	h.done = make(chan struct{})
+	h.stopped = make(chan struct{})
+	go h.checkpointLoop(time.Duration(h.config.CheckpointInterval) * time.Second)
+
+	return nil
+}
+
+// recover restores the store from the latest checkpoint, and replays the log segments written
+// since. A torn record at the end of the newest segment, left by a crash while it was being
+// written, is truncated. The sequence number of the next log segment is returned.
+func (h *Hook) recover() (uint64, error) {
+	segments, checkpoints, err := listFiles(h.config.Path)
+	if err != nil {
+		return 0, err
+	}
+
+	var next uint64
+	if n := len(checkpoints); n > 0 {
+		next = checkpoints[n-1]
+		f, err := os.Open(checkpointPath(h.config.Path, next))
+		if err != nil {
+			return 0, err
+		}
+
+		err = storage.Restore(f, records{h: h})
+		_ = f.Close()
+		if err != nil {
+			return 0, fmt.Errorf("failed to restore checkpoint %d: %w", next, err)
+		}
+	}
+
+	for i, seq := range segments {
+		if seq < next {
+			continue
+		}
+
+		path := segmentPath(h.config.Path, seq)
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+
+		offset, torn, err := replayLog(f, h.apply)
+		_ = f.Close()
+		if err != nil {
+			return 0, err
+		}
+
+		if torn {
+			if i != len(segments)-1 {
+				return 0, fmt.Errorf("%w: segment %d", ErrCorruptLog, seq)
+			}
+
+			h.Log.Warn("truncating torn write-ahead log record", "segment", seq, "offset", offset)
+			if err := os.Truncate(path, offset); err != nil {
+				return 0, err
+			}
+		}
+
+		next = seq + 1
+	}
+
+	return next, nil
+}
+
+// apply applies an operation from the log to the stored values.
+func (h *Hook) apply(op byte, key string, value []byte) {
+	if op == opDelete {
+		delete(h.data, key)
+		return
+	}
+
+	h.data[key] = value
+}
+
+// checkpointLoop takes a checkpoint every interval, or when the log reaches the checkpoint size.
+func (h *Hook) checkpointLoop(interval time.Duration) {
+	defer close(h.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-h.checkpoint:
+		case <-h.done:
+			return
+		}
+
+		if err := h.checkpointChanges(); err != nil {
+			h.Log.Error("failed to take checkpoint", "error", err, "path", h.config.Path)
+		}
+	}
+}
+
+// Stop stops taking checkpoints, takes a final checkpoint, and closes the log.
+func (h *Hook) Stop() error {
+	if h.done != nil {
+		close(h.done)
+		<-h.stopped
+		h.done = nil
+	}
+
+	if h.data == nil {
+		return nil
+	}
+
+	err := h.checkpointChanges()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if cerr := h.log.close(); err == nil {
+		err = cerr
+	}
+	h.log, h.data = nil, nil
+	return err
+}
+
+// Health returns an error if the store is not open, or the last write to the log or
+// checkpoint failed.
+func (h *Hook) Health() error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.data == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return h.err
+}
+
+// isOpen returns true if the store is open.
+func (h *Hook) isOpen() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.data != nil
+}
+
+// StorageStats returns the counters and latencies of the reads, writes and deletes of the hook.
+func (h *Hook) StorageStats() storage.Stats {
+	return h.stats.Stats()
+}
+
+// Checkpoint writes the stored values to a new checkpoint, and removes the log segments and
+// checkpoints it replaces. Writes continue to a new log segment while the checkpoint is written,
+// and the checkpoint is written to a temporary file and renamed, so a crash while it is being
+// written never loses the previous checkpoint or the log.
+func (h *Hook) Checkpoint() error {
+	h.checkMu.Lock()
+	defer h.checkMu.Unlock()
+
+	h.mu.Lock()
+	if h.data == nil {
+		h.mu.Unlock()
+		return storage.ErrDBFileNotOpen
+	}
+
+	values := make(snapshot, len(h.data))
+	for k, v := range h.data {
+		values[k] = v // stored values are replaced rather than modified, so may be shared
+	}
+
+	seq := h.log.seq + 1
+	log, err := openSegment(h.config.Path, seq, h.config.Sync)
+	if err == nil {
+		err = h.log.close()
+		h.log = log // a segment which failed to close is replayed, as it is not checkpointed
+	}
+	h.mu.Unlock()
+
+	if err == nil {
+		err = h.writeCheckpoint(seq, values)
+	}
+
+	h.mu.Lock()
+	h.err = err
+	h.mu.Unlock()
+	return err
+}
+
+// checkpointChanges takes a checkpoint, if the log has been written to since the last one.
+func (h *Hook) checkpointChanges() error {
+	h.mu.RLock()
+	changed := h.log != nil && h.log.size > 0
+	h.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+
+	return h.Checkpoint()
+}
+
+// writeCheckpoint writes values to the checkpoint which replaces the log segments before seq,
+// and removes the log segments and checkpoints which it replaces.
+func (h *Hook) writeCheckpoint(seq uint64, values snapshot) error {
+	path := checkpointPath(h.config.Path, seq)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = storage.Backup(f, values)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	if dir, err := os.Open(h.config.Path); err == nil {
+		_ = dir.Sync() // persist the rename before the replaced files are removed
+		_ = dir.Close()
+	}
+
+	segments, checkpoints, err := listFiles(h.config.Path)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range segments {
+		if s < seq {
+			_ = os.Remove(segmentPath(h.config.Path, s))
+		}
+	}
+
+	for _, c := range checkpoints {
+		if c < seq {
+			_ = os.Remove(checkpointPath(h.config.Path, c))
+		}
+	}
+
+	return nil
+}
+
+// OnSessionEstablished adds a client to the store when their session is established.
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// OnWillSent is called when a client sends a Will Message and the Will Message is removed from the client record.
+func (h *Hook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// updateClient writes the client data to the store.
+func (h *Hook) updateClient(cl *mqtt.Client) {
+	props := cl.Properties.Props.Copy(false)
+	in := &storage.Client{
+		ID:              cl.ID,
+		T:               storage.ClientKey,
+		Remote:          cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		Username:        cl.Properties.Username,
+		Clean:           cl.Properties.Clean,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Properties: storage.ClientProperties{
+			SessionExpiryInterval: props.SessionExpiryInterval,
+			AuthenticationMethod:  props.AuthenticationMethod,
+			AuthenticationData:    props.AuthenticationData,
+			RequestProblemInfo:    props.RequestProblemInfo,
+			RequestResponseInfo:   props.RequestResponseInfo,
+			ReceiveMaximum:        props.ReceiveMaximum,
+			TopicAliasMaximum:     props.TopicAliasMaximum,
+			User:                  props.User,
+			MaximumPacketSize:     props.MaximumPacketSize,
+		},
+		Will: storage.ClientWill(cl.Properties.Will),
+	}
+
+	_ = h.setKv(clientKey(cl), in)
+}
+
+// OnDisconnect removes a client from the store if they were using a clean session.
+func (h *Hook) OnDisconnect(cl *mqtt.Client, _ error, expire bool) {
+	if !expire {
+		return
+	}
+
+	if cl.StopCause() == packets.ErrSessionTakenOver {
+		return
+	}
+
+	_ = h.delKv(clientKey(cl))
+}
+
+// OnSubscribed adds one or more client subscriptions to the store.
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	var in *storage.Subscription
+	for i := 0; i < len(pk.Filters); i++ {
+		in = &storage.Subscription{
+			ID:                subscriptionKey(cl, pk.Filters[i].Filter),
+			T:                 storage.SubscriptionKey,
+			Client:            cl.ID,
+			Qos:               reasonCodes[i],
+			Filter:            pk.Filters[i].Filter,
+			Identifier:        pk.Filters[i].Identifier,
+			NoLocal:           pk.Filters[i].NoLocal,
+			RetainHandling:    pk.Filters[i].RetainHandling,
+			RetainAsPublished: pk.Filters[i].RetainAsPublished,
+		}
+		_ = h.setKv(in.ID, in)
+	}
+}
+
+// OnUnsubscribed removes one or more client subscriptions from the store.
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	for i := 0; i < len(pk.Filters); i++ {
+		_ = h.delKv(subscriptionKey(cl, pk.Filters[i].Filter))
+	}
+}
+
+// OnRetainMessage adds a retained message for a topic to the store.
+func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	if r == -1 {
+		_ = h.delKv(retainedKey(pk.TopicName))
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:              retainedKey(pk.TopicName),
+		T:               storage.RetainedKey,
+		FixedHeader:     pk.FixedHeader,
+		TopicName:       pk.TopicName,
+		Payload:         pk.Payload,
+		Created:         pk.Created,
+		Expiry:          pk.Expiry,
+		ProtocolVersion: pk.ProtocolVersion,
+		Client:          cl.ID,
+		Origin:          pk.Origin,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	if err := h.config.Compression.CompressMessage(in); err != nil {
+		h.Log.Error("failed to compress payload", "error", err, "key", in.ID)
+	}
+
+	_ = h.setKv(in.ID, in)
+}
+
+// OnQosPublish adds or updates an inflight message in the store.
+func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, resends int) {
+	in := h.message(storage.InflightKey, inflightKey(cl, pk), cl, pk, sent)
+	_ = h.setKv(in.ID, in)
+
+	// queued messages are resent as duplicates once the client reconnects, and are inflight from then on.
+	if pk.FixedHeader.Dup {
+		_ = h.delKv(queuedKey(cl, pk))
+	}
+}
+
+// OnQueuedMessage adds a message queued for a disconnected client to the store.
+func (h *Hook) OnQueuedMessage(cl *mqtt.Client, pk packets.Packet) {
+	in := h.message(storage.QueuedKey, queuedKey(cl, pk), cl, pk, 0)
+	_ = h.setKv(in.ID, in)
+}
+
+// message returns a storable inflight or queued message, compressing the payload if enabled.
+func (h *Hook) message(t, id string, cl *mqtt.Client, pk packets.Packet, sent int64) *storage.Message {
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:              id,
+		T:               t,
+		Client:          cl.ID,
+		Origin:          pk.Origin,
+		PacketID:        pk.PacketID,
+		FixedHeader:     pk.FixedHeader,
+		TopicName:       pk.TopicName,
+		Payload:         pk.Payload,
+		Sent:            sent,
+		Created:         pk.Created,
+		Expiry:          pk.Expiry,
+		ProtocolVersion: pk.ProtocolVersion,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	if err := h.config.Compression.CompressMessage(in); err != nil {
+		h.Log.Error("failed to compress payload", "error", err, "key", in.ID)
+	}
+
+	return in
+}
+
+// OnQosComplete removes a resolved inflight message from the store.
+func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
+	_ = h.delKv(inflightKey(cl, pk))
+}
+
+// OnQosDropped removes a dropped inflight or queued message from the store.
+func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	h.OnQosComplete(cl, pk)
+	_ = h.delKv(queuedKey(cl, pk))
+}
+
+// OnSysInfoTick stores the latest system info in the store.
+func (h *Hook) OnSysInfoTick(sys *system.Info) {
+	in := &storage.SystemInfo{
+		ID:   sysInfoKey(),
+		T:    storage.SysInfoKey,
+		Info: *sys,
+	}
+
+	_ = h.setKv(in.ID, in)
+}
+
+// OnRetainedExpired deletes expired retained messages from the store.
+func (h *Hook) OnRetainedExpired(filter string) {
+	_ = h.delKv(retainedKey(filter))
+}
+
+// OnClientExpired deleted expired clients from the store.
+func (h *Hook) OnClientExpired(cl *mqtt.Client) {
+	_ = h.delKv(clientKey(cl))
+}
+
+// StoredClients returns all stored clients from the store.
+func (h *Hook) StoredClients() (v []storage.Client, err error) {
+	err = h.iterKv(storage.ClientKey+"_", func(value []byte) error {
+		obj := storage.Client{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		v = append(v, obj)
+		return nil
+	})
+	return
+}
+
+// StoredSubscriptions returns all stored subscriptions from the store.
+func (h *Hook) StoredSubscriptions() (v []storage.Subscription, err error) {
+	v = make([]storage.Subscription, 0)
+	err = h.iterKv(storage.SubscriptionKey+"_", func(value []byte) error {
+		obj := storage.Subscription{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		v = append(v, obj)
+		return nil
+	})
+	return
+}
+
+// StoredRetainedMessages returns all stored retained messages from the store.
+func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
+	return h.storedMessages(storage.RetainedKey)
+}
+
+// StoredInflightMessages returns all stored inflight messages from the store.
+func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
+	return h.storedMessages(storage.InflightKey)
+}
+
+// StoredQueuedMessages returns all messages queued for disconnected clients from the store.
+func (h *Hook) StoredQueuedMessages() (v []storage.Message, err error) {
+	return h.storedMessages(storage.QueuedKey)
+}
+
+// storedMessages returns all stored messages of type t from the store.
+func (h *Hook) storedMessages(t string) (v []storage.Message, err error) {
+	v = make([]storage.Message, 0)
+	err = h.iterKv(t+"_", func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		v = append(v, obj)
+		return nil
+	})
+	return
+}
+
+// StoredSysInfo returns the system info from the store.
+func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
+	err = h.getKv(sysInfoKey(), &v)
+	if errors.Is(err, ErrKeyNotFound) {
+		return v, nil
+	}
+
+	return
+}
+
+// StoredSession returns the stored client, subscriptions, and inflight and queued messages
+// of a single client from the store.
+func (h *Hook) StoredSession(id string) (v storage.Session, err error) {
+	err = h.getKv(storage.ClientKey+"_"+id, &v.Client)
+	if errors.Is(err, ErrKeyNotFound) {
+		return v, nil
+	} else if err != nil {
+		return
+	}
+
+	err = h.iterKv(storage.SubscriptionKey+"_"+id+":", func(value []byte) error {
+		obj := storage.Subscription{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		if obj.Client == id {
+			v.Subscriptions = append(v.Subscriptions, obj)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	err = h.iterKv(storage.InflightKey+"_"+id+":", func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		if obj.Client == id {
+			v.Inflight = append(v.Inflight, obj)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	err = h.iterKv(storage.QueuedKey+"_"+id+":", func(value []byte) error {
+		obj := storage.Message{}
+		if err := obj.UnmarshalBinary(value); err != nil {
+			return err
+		}
+		if obj.Client == id {
+			v.Queued = append(v.Queued, obj)
+		}
+		return nil
+	})
+	return
+}
+
+// write appends an operation to the log, and then applies it to the stored values.
+func (h *Hook) write(op byte, k string, v []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.data == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	if h.log != nil {
+		if err := h.log.append(op, k, v); err != nil {
+			h.err = err
+			return err
+		}
+
+		if h.log.size >= h.config.CheckpointSize {
+			select {
+			case h.checkpoint <- struct{}{}:
+			default:
+			}
+		}
+	}
+
+	h.apply(op, k, v)
+	return nil
+}
+
+// setKv stores a key-value pair in the store.
+func (h *Hook) setKv(k string, v storage.Serializable) error {
+	start := time.Now()
+	data, err := v.MarshalBinary()
+	if err == nil {
+		err = h.write(opSet, k, data)
+	}
+
+	h.stats.Write(start, err)
+	if err != nil {
+		h.Log.Error("failed to upsert data", "error", err, "key", k)
+	}
+	return err
+}
+
+// delKv deletes a key-value pair from the store.
+func (h *Hook) delKv(k string) error {
+	start := time.Now()
+	h.mu.RLock()
+	_, ok := h.data[k]
+	h.mu.RUnlock()
+
+	var err error
+	if ok {
+		err = h.write(opDelete, k, nil)
+	} else if !h.isOpen() {
+		err = storage.ErrDBFileNotOpen
+	}
+
+	h.stats.Delete(start, err)
+	if err != nil {
+		h.Log.Error("failed to delete data", "error", err, "key", k)
+	}
+	return err
+}
+
+// getKv retrieves the value associated with a key from the store.
+func (h *Hook) getKv(k string, v storage.Serializable) error {
+	start := time.Now()
+	h.mu.RLock()
+	if h.data == nil {
+		h.mu.RUnlock()
+		h.stats.Read(start, storage.ErrDBFileNotOpen)
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return storage.ErrDBFileNotOpen
+	}
+	value, ok := h.data[k]
+	h.mu.RUnlock()
+	h.stats.Read(start, nil) // a missing key is not a failed read
+
+	if !ok {
+		return ErrKeyNotFound
+	}
+
+	return v.UnmarshalBinary(value)
+}
+
+// iterKv calls visit with the value of each key having the specified prefix in the store, in key
+// order. Values are visited outside of the lock, so visit may write to the store.
+func (h *Hook) iterKv(prefix string, visit func([]byte) error) error {
+	start := time.Now()
+	keys, values, err := h.match(prefix)
+	h.stats.Read(start, err)
+	if err != nil {
+		h.Log.Error("", "error", err)
+		return err
+	}
+
+	for i := range keys {
+		if err := visit(values[i]); err != nil {
+			h.Log.Error("failed to iter data", "error", err, "prefix", prefix)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// match returns the sorted keys having the specified prefix in the store, and their values.
+func (h *Hook) match(prefix string) (keys []string, values [][]byte, err error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.data == nil {
+		return nil, nil, storage.ErrDBFileNotOpen
+	}
+
+	for k := range h.data {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	values = make([][]byte, len(keys))
+	for i, k := range keys {
+		values[i] = h.data[k] // stored values are replaced rather than modified, so may be shared
+	}
+
+	return keys, values, nil
+}
+
+// Backup writes a consistent backup of the records in the store to w.
+func (h *Hook) Backup(w io.Writer) error {
+	if !h.isOpen() {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return storage.Backup(w, records{h: h})
+}
+
+// Restore replaces the records in the store with a backup read from r. It should be
+// called before the server is started, as restored records are only loaded on startup.
+func (h *Hook) Restore(r io.Reader) error {
+	if !h.isOpen() {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return storage.Restore(r, records{h: h})
+}
+
+// Export writes the clients, subscriptions, retained messages, inflight messages and
+// system info in the store to w as JSON Lines, which can be imported into any storage hook.
+func (h *Hook) Export(w io.Writer) error {
+	if !h.isOpen() {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return storage.Export(w, h)
+}
+
+// Import adds the records of an export read from r to the store, replacing any existing
+// records with the same keys. It should be called before the server is started, as imported
+// records are only loaded on startup.
+func (h *Hook) Import(r io.Reader) error {
+	if !h.isOpen() {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return storage.Import(r, h.importRecord)
+}
+
+// importRecord stores an imported record under the key used by the hook.
+func (h *Hook) importRecord(v storage.Serializable) error {
+	switch v := v.(type) {
+	case *storage.Client:
+		return h.setKv(clientKey(&mqtt.Client{ID: v.ID}), v)
+	case *storage.Subscription:
+		v.ID = subscriptionKey(&mqtt.Client{ID: v.Client}, v.Filter)
+		return h.setKv(v.ID, v)
+	case *storage.Message:
+		switch v.T {
+		case storage.RetainedKey:
+			v.ID = retainedKey(v.TopicName)
+		case storage.QueuedKey:
+			v.ID = queuedKey(&mqtt.Client{ID: v.Client}, packets.Packet{PacketID: v.PacketID})
+		default:
+			v.ID = inflightKey(&mqtt.Client{ID: v.Client}, packets.Packet{PacketID: v.PacketID})
+		}
+
+		if err := h.config.Compression.CompressMessage(v); err != nil {
+			h.Log.Error("failed to compress payload", "error", err, "key", v.ID)
+		}
+		return h.setKv(v.ID, v)
+	case *storage.SystemInfo:
+		v.ID = sysInfoKey()
+		return h.setKv(v.ID, v)
+	}
+
+	return nil
+}
+
+// records provides the raw records of the store to schema migrations and backups. Changes
+// made through records are written to the log once it is open.
+type records struct {
+	h *Hook
+}
+
+// SchemaVersion returns the schema version of the store.
+func (r records) SchemaVersion() (v int, ok bool, err error) {
+	r.h.mu.RLock()
+	value, ok := r.h.data[storage.SchemaVersionKey]
+	r.h.mu.RUnlock()
+	if !ok {
+		return 0, false, nil
+	}
+
+	v, err = strconv.Atoi(string(value))
+	return v, true, err
+}
+
+// SetSchemaVersion stores the schema version of the store.
+func (r records) SetSchemaVersion(v int) error {
+	return r.h.write(opSet, storage.SchemaVersionKey, []byte(strconv.Itoa(v)))
+}
+
+// Each calls visit with the key and value of each record in key order. The records are
+// read under the lock and visited outside of it, so visit may write to the store.
+func (r records) Each(visit func(key string, value []byte) error) error {
+	keys, values, err := r.h.match("")
+	if err != nil {
+		return err
+	}
+
+	for i, k := range keys {
+		if k == storage.SchemaVersionKey {
+			continue
+		}
+
+		if err := visit(k, values[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Set sets the value of a record.
+func (r records) Set(key string, value []byte) error {
+	return r.h.write(opSet, key, value)
+}
+
+// Delete deletes a record.
+func (r records) Delete(key string) error {
+	return r.h.write(opDelete, key, nil)
+}
+
+// snapshot is a copy of the stored values, which is written to a checkpoint.
+type snapshot map[string][]byte
+
+// SchemaVersion returns the schema version of the snapshot.
+func (s snapshot) SchemaVersion() (int, bool, error) {
+	value, ok := s[storage.SchemaVersionKey]
+	if !ok {
+		return 0, false, nil
+	}
+
+	v, err := strconv.Atoi(string(value))
+	return v, true, err
+}
+
+// SetSchemaVersion sets the schema version of the snapshot.
+func (s snapshot) SetSchemaVersion(v int) error {
+	s[storage.SchemaVersionKey] = []byte(strconv.Itoa(v))
+	return nil
+}
+
+// Each calls visit with the key and value of each record of the snapshot in key order.
+func (s snapshot) Each(visit func(key string, value []byte) error) error {
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		if k != storage.SchemaVersionKey {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err := visit(k, s[k]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Set sets the value of a record of the snapshot.
+func (s snapshot) Set(key string, value []byte) error {
+	s[key] = value
+	return nil
+}
+
+// Delete deletes a record of the snapshot.
+func (s snapshot) Delete(key string) error {
+	delete(s, key)
+	return nil
+}
@@ -0,0 +1,480 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+// Package wasm provides a hook which runs connect, ACL and publish checks in a sandboxed
+// WebAssembly module using wazero, so custom logic can be deployed without recompiling the broker.
+//
+// A module must export its memory as "memory", and an allocator which returns a pointer to size
+// bytes of memory for the host to write an event to:
+//
+//	alloc(size i32) i32
+//
+// If the module exports dealloc(ptr i32, size i32), it is called once the event has been handled.
+// Each check the module exports is called with the pointer and size of a json encoded event, and
+// returns 0 to deny, 1 to allow, or 2 to allow a connecting client as a superuser:
+//
+//	on_connect_authenticate(ptr i32, size i32) i32 // called with a ConnectEvent
+//	on_acl_check(ptr i32, size i32) i32            // called with an ACLEvent
+//	on_publish(ptr i32, size i32) i32              // called with a PublishEvent
+//
+// Modules may log to the server logger by importing log(level i32, ptr i32, size i32) from the
+// "mochi" module, where level is 0 for debug, 1 for info, 2 for warn and 3 for error. WASI is
+// available, so modules built with TinyGo or the wasm32-wasi Rust target can be used, and the
+// _initialize function of reactor modules is called when each instance is created.
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"time"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+const (
+	// Deny is returned by a check to deny access.
+	Deny = 0
+
+	// Allow is returned by a check to allow access.
+	Allow = 1
+
+	// AllowSuperuser is returned by on_connect_authenticate to allow a client as a superuser.
+	AllowSuperuser = 2
+)
+
+const (
+	// defaultTimeout is the default milliseconds a check may run for.
+	defaultTimeout = 1000
+
+	// hostModule is the name of the module providing the host functions.
+	hostModule = "mochi"
+
+	// allocFunction is the name of the exported function which allocates memory for an event.
+	allocFunction = "alloc"
+
+	// deallocFunction is the name of the optional exported function which frees an event.
+	deallocFunction = "dealloc"
+
+	// connectFunction is the name of the exported connect check.
+	connectFunction = "on_connect_authenticate"
+
+	// aclFunction is the name of the exported ACL check.
+	aclFunction = "on_acl_check"
+
+	// publishFunction is the name of the exported publish check.
+	publishFunction = "on_publish"
+)
+
+var (
+	// ErrNoModule indicates neither a module path nor the module bytes were configured.
+	ErrNoModule = errors.New("no wasm module")
+
+	// ErrNoAlloc indicates the module does not export the alloc function or its memory.
+	ErrNoAlloc = errors.New("wasm module does not export memory and alloc")
+
+	// ErrNoChecks indicates the module does not export any of the check functions.
+	ErrNoChecks = errors.New("wasm module does not export any checks")
+
+	// ErrOutOfBounds indicates the pointer returned by alloc is outside of the module memory.
+	ErrOutOfBounds = errors.New("wasm alloc returned pointer out of bounds")
+
+	// ErrBadResult indicates a function of the module did not return a single value.
+	ErrBadResult = errors.New("wasm function returned unexpected results")
+)
+
+// Options contains the configuration of the wasm hook.
+type Options struct {
+	// Path is the path of the .wasm file to load.
+	Path string `yaml:"path" json:"path"`
+
+	// Instances is the number of instances of the module, which bounds the number of checks
+	// run at once (default GOMAXPROCS). Each instance has its own memory.
+	Instances int `yaml:"instances" json:"instances"`
+
+	// MemoryLimitPages is the maximum number of 64KiB pages of memory of each instance. The
+	// wazero default of 65536 pages (4GiB) is used if 0.
+	MemoryLimitPages uint32 `yaml:"memory_limit_pages" json:"memory_limit_pages"`
+
+	// Timeout is the milliseconds a check may run for before it is stopped and fails
+	// (default 1000). The instance running it is replaced.
+	Timeout int64 `yaml:"timeout" json:"timeout"`
+
+	// FailOpen allows access when a check fails or times out. By default access is denied
+	// (fail-closed).
+	FailOpen bool `yaml:"fail_open" json:"fail_open"`
+
+	// Module is the compiled module, used instead of reading Path if set.
+	Module []byte `yaml:"-" json:"-"`
+}
+
+// ConnectEvent is the event passed to on_connect_authenticate.
+type ConnectEvent struct {
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Remote   string `json:"remote"`
+	Listener string `json:"listener"`
+}
+
+// ACLEvent is the event passed to on_acl_check.
+type ACLEvent struct {
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Topic    string `json:"topic"`
+	Write    bool   `json:"write"`
+	Remote   string `json:"remote"`
+	Listener string `json:"listener"`
+}
+
+// PublishEvent is the event passed to on_publish. The payload is base64 encoded.
+type PublishEvent struct {
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Topic    string `json:"topic"`
+	Payload  []byte `json:"payload"`
+	Qos      byte   `json:"qos"`
+	Retain   bool   `json:"retain"`
+	Remote   string `json:"remote"`
+	Listener string `json:"listener"`
+}
+
+// instance is an instantiated module.
+type instance struct {
+	mod     api.Module
+	alloc   api.Function
+	dealloc api.Function // nil if the module does not export dealloc
+}
+
+// Hook is a hook which runs connect, ACL and publish checks in a WebAssembly module.
+type Hook struct {
+	mqtt.HookBase
+	config   *Options
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	pool     chan *instance // the idle instances, or nil for an instance to be recreated
+	provides []byte         // the events of the checks exported by the module
+}
+
+// ID returns the ID of the hook.
+func (h *Hook) ID() string {
+	return "wasm"
+}
+
+// Provides indicates which hook methods this hook provides, which are the checks exported
+// by the module.
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains(h.provides, []byte{b})
+}
+
+// Init compiles the module and creates its instances.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.config = config.(*Options)
+	if h.config.Path == "" && h.config.Module == nil {
+		return ErrNoModule
+	}
+
+	if h.config.Instances <= 0 {
+		h.config.Instances = runtime.GOMAXPROCS(0)
+	}
+
+	if h.config.Timeout <= 0 {
+		h.config.Timeout = defaultTimeout
+	}
+
+	code := h.config.Module
+	if code == nil {
+		b, err := os.ReadFile(h.config.Path)
+		if err != nil {
+			return fmt.Errorf("failed to read wasm module: %w", err)
+		}
+		code = b
+	}
+
+	ctx := context.Background()
+	rc := wazero.NewRuntimeConfig().WithCloseOnContextDone(true)
+	if h.config.MemoryLimitPages > 0 {
+		rc = rc.WithMemoryLimitPages(h.config.MemoryLimitPages)
+	}
+	h.runtime = wazero.NewRuntimeWithConfig(ctx, rc)
+
+	if err := h.instantiateHost(ctx); err != nil {
+		_ = h.Stop()
+		return err
+	}
+
+	compiled, err := h.runtime.CompileModule(ctx, code)
+	if err != nil {
+		_ = h.Stop()
+		return fmt.Errorf("failed to compile wasm module: %w", err)
+	}
+	h.compiled = compiled
+
+	exports := compiled.ExportedFunctions()
+	if _, ok := exports[allocFunction]; !ok || len(compiled.ExportedMemories()) == 0 {
+		_ = h.Stop()
+		return ErrNoAlloc
+	}
+
+	h.provides = nil
+	for name, event := range map[string]byte{
+		connectFunction: mqtt.OnConnectAuthenticate,
+		aclFunction:     mqtt.OnACLCheck,
+		publishFunction: mqtt.OnPublish,
+	} {
+		if _, ok := exports[name]; ok {
+			h.provides = append(h.provides, event)
+		}
+	}
+
+	if len(h.provides) == 0 {
+		_ = h.Stop()
+		return ErrNoChecks
+	}
+
+	h.pool = make(chan *instance, h.config.Instances)
+	for i := 0; i < h.config.Instances; i++ {
+		in, err := h.instantiate(ctx)
+		if err != nil {
+			_ = h.Stop()
+			return err
+		}
+		h.pool <- in
+	}
+
+	h.Log.Info("loaded wasm module",
+		"path", h.config.Path,
+		"instances", h.config.Instances,
+		"timeout", h.config.Timeout,
+		"fail_open", h.config.FailOpen)
+
+	return nil
+}
+
+// Stop closes the instances and the runtime.
+func (h *Hook) Stop() error {
+	if h.runtime == nil {
+		return nil
+	}
+
+	r := h.runtime
+	h.runtime = nil
+	return r.Close(context.Background())
+}
+
+// instantiateHost instantiates WASI and the host module which provides the log function.
+func (h *Hook) instantiateHost(ctx context.Context) error {
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, h.runtime); err != nil {
+		return fmt.Errorf("failed to instantiate wasi: %w", err)
+	}
+
+	_, err := h.runtime.NewHostModuleBuilder(hostModule).
+		NewFunctionBuilder().
+		WithFunc(h.log).
+		Export("log").
+		Instantiate(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to instantiate wasm host module: %w", err)
+	}
+
+	return nil
+}
+
+// log writes a message from the module to the server logger.
+func (h *Hook) log(ctx context.Context, m api.Module, level, ptr, size uint32) {
+	msg, ok := m.Memory().Read(ptr, size)
+	if !ok {
+		return
+	}
+
+	lvl := slog.LevelDebug
+	switch level {
+	case 1:
+		lvl = slog.LevelInfo
+	case 2:
+		lvl = slog.LevelWarn
+	case 3:
+		lvl = slog.LevelError
+	}
+
+	h.Log.Log(ctx, lvl, string(msg), "hook", h.ID())
+}
+
+// instantiate creates a new instance of the module.
+func (h *Hook) instantiate(ctx context.Context) (*instance, error) {
+	mod, err := h.runtime.InstantiateModule(ctx, h.compiled, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to instantiate wasm module: %w", err)
+	}
+
+	return &instance{
+		mod:     mod,
+		alloc:   mod.ExportedFunction(allocFunction),
+		dealloc: mod.ExportedFunction(deallocFunction),
+	}, nil
+}
+
+// OnConnectAuthenticate returns true if the module allows the client to connect, marking the
+// client as a superuser if the module decides so.
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	res, err := h.call(cl.Context(), connectFunction, &ConnectEvent{
+		ClientID: cl.ID,
+		Username: string(pk.Connect.Username),
+		Password: string(pk.Connect.Password),
+		Remote:   cl.Net.Remote,
+		Listener: cl.Net.Listener,
+	})
+	if err != nil {
+		h.Log.Warn("wasm check failed", "error", err, "function", connectFunction, "fail_open", h.config.FailOpen)
+		return h.config.FailOpen
+	}
+
+	if res == Deny {
+		h.Log.Info("client failed authentication check",
+			"username", string(pk.Connect.Username),
+			"remote", cl.Net.Remote)
+		return false
+	}
+
+	if res == AllowSuperuser {
+		cl.SetSuperuser(true)
+	}
+
+	return true
+}
+
+// OnACLCheck returns true if the module allows the client to publish or subscribe to a topic.
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	res, err := h.call(cl.Context(), aclFunction, &ACLEvent{
+		ClientID: cl.ID,
+		Username: string(cl.Properties.Username),
+		Topic:    topic,
+		Write:    write,
+		Remote:   cl.Net.Remote,
+		Listener: cl.Net.Listener,
+	})
+	if err != nil {
+		h.Log.Warn("wasm check failed", "error", err, "function", aclFunction, "fail_open", h.config.FailOpen)
+		return h.config.FailOpen
+	}
+
+	if res == Deny {
+		h.Log.Debug("client failed allowed ACL check",
+			"client", cl.ID,
+			"username", string(cl.Properties.Username),
+			"topic", topic)
+		return false
+	}
+
+	return true
+}
+
+// OnPublish rejects the packet if the module denies it.
+func (h *Hook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	res, err := h.call(cl.Context(), publishFunction, &PublishEvent{
+		ClientID: cl.ID,
+		Username: string(cl.Properties.Username),
+		Topic:    pk.TopicName,
+		Payload:  pk.Payload,
+		Qos:      pk.FixedHeader.Qos,
+		Retain:   pk.FixedHeader.Retain,
+		Remote:   cl.Net.Remote,
+		Listener: cl.Net.Listener,
+	})
+	if err != nil {
+		h.Log.Warn("wasm check failed", "error", err, "function", publishFunction, "fail_open", h.config.FailOpen)
+		if h.config.FailOpen {
+			return pk, nil
+		}
+		return pk, packets.ErrRejectPacket
+	}
+
+	if res == Deny {
+		h.Log.Debug("module rejected publish", "client", cl.ID, "topic", pk.TopicName)
+		return pk, packets.ErrRejectPacket
+	}
+
+	return pk, nil
+}
+
+// call writes a json encoded event to the memory of an idle instance and calls a check
+// with it, returning the result of the check. An instance which was stopped by the timeout
+// is replaced.
+func (h *Hook) call(ctx context.Context, name string, event any) (uint32, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(h.config.Timeout)*time.Millisecond)
+	defer cancel()
+
+	var in *instance
+	select {
+	case in = <-h.pool:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	if in == nil {
+		if in, err = h.instantiate(context.Background()); err != nil {
+			h.pool <- nil
+			return 0, err
+		}
+	}
+
+	defer func() {
+		if in.mod.IsClosed() {
+			in = nil
+		}
+		h.pool <- in
+	}()
+
+	res, err := in.alloc.Call(ctx, uint64(len(data)))
+	if err != nil {
+		return 0, err
+	} else if len(res) != 1 {
+		return 0, ErrBadResult
+	}
+
+	ptr := uint32(res[0])
+	if !in.mod.Memory().Write(ptr, data) {
+		return 0, ErrOutOfBounds
+	}
+
+	if in.dealloc != nil {
+		defer func() {
+			_, _ = in.dealloc.Call(ctx, uint64(ptr), uint64(len(data)))
+		}()
+	}
+
+	res, err = in.mod.ExportedFunction(name).Call(ctx, uint64(ptr), uint64(len(data)))
+	if err != nil {
+		return 0, err
+	} else if len(res) != 1 {
+		return 0, ErrBadResult
+	}
+
+	return uint32(res[0]), nil
+}
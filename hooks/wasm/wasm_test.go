@@ -0,0 +1,159 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package wasm
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	mqtt "github.com/AMuzykus/mochi-mqtt-server/v2"
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+var logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+// testModule is a module which allows every client to connect as a superuser, denies every
+// ACL check, and loops forever on publish.
+var testModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, // magic and version
+
+	// types: (i32) -> i32, (i32, i32) -> i32
+	0x01, 0x0c, 0x02,
+	0x60, 0x01, 0x7f, 0x01, 0x7f,
+	0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7f,
+
+	// functions: alloc, on_connect_authenticate, on_acl_check, on_publish
+	0x03, 0x05, 0x04, 0x00, 0x01, 0x01, 0x01,
+
+	// memory: 1 page
+	0x05, 0x03, 0x01, 0x00, 0x01,
+
+	// exports
+	0x07, 0x48, 0x05,
+	0x06, 'm', 'e', 'm', 'o', 'r', 'y', 0x02, 0x00,
+	0x05, 'a', 'l', 'l', 'o', 'c', 0x00, 0x00,
+	0x17, 'o', 'n', '_', 'c', 'o', 'n', 'n', 'e', 'c', 't', '_',
+	'a', 'u', 't', 'h', 'e', 'n', 't', 'i', 'c', 'a', 't', 'e', 0x00, 0x01,
+	0x0c, 'o', 'n', '_', 'a', 'c', 'l', '_', 'c', 'h', 'e', 'c', 'k', 0x00, 0x02,
+	0x0a, 'o', 'n', '_', 'p', 'u', 'b', 'l', 'i', 's', 'h', 0x00, 0x03,
+
+	// code
+	0x0a, 0x1b, 0x04,
+	0x05, 0x00, 0x41, 0x80, 0x08, 0x0b, // alloc: return 1024
+	0x04, 0x00, 0x41, 0x02, 0x0b, // on_connect_authenticate: return 2
+	0x04, 0x00, 0x41, 0x00, 0x0b, // on_acl_check: return 0
+	0x09, 0x00, 0x03, 0x40, 0x0c, 0x00, 0x0b, 0x41, 0x00, 0x0b, // on_publish: loop forever
+}
+
+func newTestHook(t *testing.T, opts *Options) *Hook {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	if opts == nil {
+		opts = new(Options)
+	}
+	if opts.Path == "" {
+		opts.Module = testModule
+	}
+
+	require.NoError(t, h.Init(opts))
+	t.Cleanup(func() { _ = h.Stop() })
+	return h
+}
+
+func TestID(t *testing.T) {
+	h := new(Hook)
+	require.Equal(t, "wasm", h.ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := newTestHook(t, nil)
+	require.True(t, h.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, h.Provides(mqtt.OnACLCheck))
+	require.True(t, h.Provides(mqtt.OnPublish))
+	require.False(t, h.Provides(mqtt.OnDisconnect))
+}
+
+func TestInitBadConfig(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(map[string]any{})
+	require.ErrorIs(t, err, mqtt.ErrInvalidConfigType)
+}
+
+func TestInitNoModule(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.ErrorIs(t, err, ErrNoModule)
+}
+
+func TestInitBadModule(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Module: []byte("not wasm")})
+	require.Error(t, err)
+}
+
+func TestInitPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wasm")
+	require.NoError(t, os.WriteFile(path, testModule, 0600))
+
+	h := newTestHook(t, &Options{Path: path, Instances: 2})
+	require.Equal(t, 2, cap(h.pool))
+	require.Equal(t, int64(defaultTimeout), h.config.Timeout)
+}
+
+func TestInitPathMissing(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Path: filepath.Join(t.TempDir(), "missing.wasm")})
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	h := newTestHook(t, nil)
+	cl := &mqtt.Client{ID: "cl1"}
+	ok := h.OnConnectAuthenticate(cl, packets.Packet{
+		Connect: packets.ConnectParams{Username: []byte("mochi"), Password: []byte("pass")},
+	})
+	require.True(t, ok)
+	require.True(t, cl.IsSuperuser())
+}
+
+func TestOnACLCheck(t *testing.T) {
+	h := newTestHook(t, nil)
+	cl := &mqtt.Client{ID: "cl1"}
+	require.False(t, h.OnACLCheck(cl, "a/b/c", true))
+}
+
+func TestOnPublishTimeout(t *testing.T) {
+	h := newTestHook(t, &Options{Instances: 1, Timeout: 50})
+	cl := &mqtt.Client{ID: "cl1"}
+	_, err := h.OnPublish(cl, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")})
+	require.ErrorIs(t, err, packets.ErrRejectPacket)
+
+	// the stopped instance is replaced on the next check
+	require.False(t, h.OnACLCheck(cl, "a/b/c", true))
+	require.Len(t, h.pool, 1)
+}
+
+func TestOnPublishTimeoutFailOpen(t *testing.T) {
+	h := newTestHook(t, &Options{Instances: 1, Timeout: 50, FailOpen: true})
+	cl := &mqtt.Client{ID: "cl1"}
+	pk := packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}
+	out, err := h.OnPublish(cl, pk)
+	require.NoError(t, err)
+	require.Equal(t, pk.TopicName, out.TopicName)
+}
+
+func TestStop(t *testing.T) {
+	h := newTestHook(t, nil)
+	require.NoError(t, h.Stop())
+	require.Nil(t, h.runtime)
+	require.NoError(t, h.Stop())
+}
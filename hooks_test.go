@@ -5,8 +5,11 @@
 package mqtt
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -158,6 +161,30 @@ func (h *modifiedHookBase) StoredInflightMessages() (v []storage.Message, err er
 	}, nil
 }
 
+func (h *modifiedHookBase) StoredQueuedMessages() (v []storage.Message, err error) {
+	if h.fail || h.failAt == 6 {
+		return v, errTestHook
+	}
+
+	return []storage.Message{
+		{ID: "q1"},
+		{ID: "q2"},
+	}, nil
+}
+
+func (h *modifiedHookBase) StoredSession(id string) (v storage.Session, err error) {
+	if h.fail || h.failAt == 7 {
+		return v, errTestHook
+	}
+
+	return storage.Session{
+		Client:        storage.Client{ID: id},
+		Subscriptions: []storage.Subscription{{ID: "sub1", Client: id}},
+		Inflight:      []storage.Message{{ID: "i1", Client: id}},
+		Queued:        []storage.Message{{ID: "q1", Client: id}},
+	}, nil
+}
+
 func (h *modifiedHookBase) StoredSysInfo() (v storage.SystemInfo, err error) {
 	if h.fail || h.failAt == 5 {
 		return v, errTestHook
@@ -213,79 +240,902 @@ func TestHooksAddInitFailure(t *testing.T) {
 	require.Equal(t, int64(0), atomic.LoadInt64(&h.qty))
 }
 
-func TestHooksStop(t *testing.T) {
+func TestHooksStop(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+
+	err := h.Add(new(HookBase), nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), atomic.LoadInt64(&h.qty))
+	require.Equal(t, int64(1), h.Len())
+
+	h.Stop()
+}
+
+// coverage: also cover some empty functions
+func TestHooksNonReturns(t *testing.T) {
+	h := new(Hooks)
+	cl := new(Client)
+
+	for i := 0; i < 2; i++ {
+		t.Run("step-"+strconv.Itoa(i), func(t *testing.T) {
+			// on first iteration, check without hook methods
+			h.OnStarted()
+			h.OnStopped()
+			h.OnSysInfoTick(new(system.Info))
+			h.OnSessionEstablish(cl, packets.Packet{})
+			h.OnSessionEstablished(cl, packets.Packet{})
+			h.OnSessionTakenOver(cl, cl)
+			h.OnDisconnect(cl, nil, false)
+			h.OnKeepAliveTimeout(cl)
+			h.OnPacketSent(cl, packets.Packet{}, []byte{})
+			h.OnPacketWritten(cl, PacketWritten{Type: packets.Publish, Size: 10})
+			h.OnPacketProcessed(cl, packets.Packet{}, nil)
+			h.OnSubscribed(cl, packets.Packet{}, []byte{1})
+			h.OnUnsubscribed(cl, packets.Packet{})
+			h.OnPublished(cl, packets.Packet{})
+			h.OnPublishDropped(cl, packets.Packet{})
+			h.OnMessageDropped(cl, packets.Packet{}, DropQueueFull)
+			h.OnRetainMessage(cl, packets.Packet{}, 0)
+			h.OnRetainPublished(cl, packets.Packet{})
+			h.OnRetainedDelivered(cl, "a/b/c", 1)
+			h.OnQosPublish(cl, packets.Packet{}, time.Now().Unix(), 0)
+			h.OnQosComplete(cl, packets.Packet{})
+			h.OnQosDropped(cl, packets.Packet{})
+			h.OnQueuedMessage(cl, packets.Packet{})
+			h.OnPacketIDExhausted(cl, packets.Packet{})
+			h.OnWillSent(cl, packets.Packet{})
+			h.OnClientExpired(cl)
+			h.OnRetainedExpired("a/b/c")
+			h.OnListenerConnection("t1", ListenerConnectionAccepted, nil)
+			h.OnAuthFailed(cl, packets.ErrNotAuthorized)
+
+			// on second iteration, check added hook methods
+			err := h.Add(new(modifiedHookBase), nil)
+			require.NoError(t, err)
+		})
+	}
+}
+
+type healthHook struct {
+	HookBase
+	err error
+}
+
+func (h *healthHook) ID() string {
+	return "health"
+}
+
+func (h *healthHook) Health() error {
+	return h.err
+}
+
+func TestHooksHealth(t *testing.T) {
+	h := new(Hooks)
+	require.NoError(t, h.Health())
+
+	hook := new(healthHook)
+	err := h.Add(new(HookBase), nil)
+	require.NoError(t, err)
+	err = h.Add(hook, nil)
+	require.NoError(t, err)
+	require.NoError(t, h.Health())
+
+	hook.err = errTestHook
+	err = h.Health()
+	require.ErrorIs(t, err, errTestHook)
+	require.Contains(t, err.Error(), "health: ")
+}
+
+// reloadHook records the config of each reload, rejecting configs which are not strings.
+type reloadHook struct {
+	HookBase
+	config any
+}
+
+func (h *reloadHook) ID() string {
+	return "reload"
+}
+
+func (h *reloadHook) Reload(config any) error {
+	if _, ok := config.(string); !ok {
+		return ErrInvalidConfigType
+	}
+
+	h.config = config
+	return nil
+}
+
+func TestHooksReload(t *testing.T) {
+	h := new(Hooks)
+	hook := new(reloadHook)
+	err := h.Add(new(HookBase), nil)
+	require.NoError(t, err)
+	err = h.Add(hook, nil)
+	require.NoError(t, err)
+
+	err = h.Reload("reload", "new")
+	require.NoError(t, err)
+	require.Equal(t, "new", hook.config)
+
+	err = h.Reload("reload", 1)
+	require.ErrorIs(t, err, ErrInvalidConfigType)
+	require.Equal(t, "new", hook.config)
+
+	err = h.Reload("base", "new")
+	require.ErrorIs(t, err, ErrHookReloadUnsupported)
+
+	err = h.Reload("missing", "new")
+	require.ErrorIs(t, err, ErrHookNotFound)
+}
+
+type statsHook struct {
+	HookBase
+	stats storage.Stats
+}
+
+func (h *statsHook) ID() string {
+	return "stats"
+}
+
+func (h *statsHook) StorageStats() storage.Stats {
+	return h.stats
+}
+
+func TestHooksStorageStats(t *testing.T) {
+	h := new(Hooks)
+	require.Empty(t, h.StorageStats())
+
+	hook := &statsHook{stats: storage.Stats{Writes: storage.OperationStats{Count: 3}}}
+	err := h.Add(new(HookBase), nil)
+	require.NoError(t, err)
+	err = h.Add(hook, nil)
+	require.NoError(t, err)
+
+	stats := h.StorageStats()
+	require.Len(t, stats, 1)
+	require.Equal(t, int64(3), stats["stats"].Writes.Count)
+}
+
+func TestHooksOnConnectAuthenticate(t *testing.T) {
+	h := new(Hooks)
+
+	ok := h.OnConnectAuthenticate(new(Client), packets.Packet{})
+	require.False(t, ok)
+
+	err := h.Add(new(modifiedHookBase), nil)
+	require.NoError(t, err)
+
+	ok = h.OnConnectAuthenticate(new(Client), packets.Packet{})
+	require.True(t, ok)
+}
+
+func TestHooksOnACLCheck(t *testing.T) {
+	h := new(Hooks)
+
+	ok := h.OnACLCheck(new(Client), "a/b/c", true)
+	require.False(t, ok)
+
+	err := h.Add(new(modifiedHookBase), nil)
+	require.NoError(t, err)
+
+	ok = h.OnACLCheck(new(Client), "a/b/c", true)
+	require.True(t, ok)
+}
+
+type deciderHook struct {
+	HookBase
+	prefix string
+}
+
+func (h *deciderHook) ID() string {
+	return "decider"
+}
+
+func (h *deciderHook) Provides(b byte) bool {
+	return b == OnConnectAuthenticate || b == OnACLCheck
+}
+
+func (h *deciderHook) DecideConnect(cl *Client, pk packets.Packet) AuthDecision {
+	if !strings.HasPrefix(cl.ID, h.prefix) {
+		return AuthPass
+	}
+
+	if string(pk.Connect.Password) == "secret" {
+		return AuthAllow
+	}
+
+	return AuthDeny
+}
+
+func (h *deciderHook) DecideACL(cl *Client, topic string, write bool) AuthDecision {
+	if strings.HasPrefix(topic, "private/") {
+		return AuthDeny
+	}
+
+	return AuthPass
+}
+
+func TestHooksAuthDecider(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	require.NoError(t, h.Add(&deciderHook{prefix: "ldap-"}, nil))
+	require.NoError(t, h.Add(new(modifiedHookBase), nil)) // allows everything
+
+	allowed := packets.Packet{Connect: packets.ConnectParams{Password: []byte("secret")}}
+	require.True(t, h.OnConnectAuthenticate(&Client{ID: "ldap-a"}, allowed))
+	require.False(t, h.OnConnectAuthenticate(&Client{ID: "ldap-a"}, packets.Packet{}))
+	require.True(t, h.OnConnectAuthenticate(&Client{ID: "other"}, packets.Packet{}))
+
+	require.False(t, h.OnACLCheck(new(Client), "private/a", true))
+	require.True(t, h.OnACLCheck(new(Client), "public/a", true))
+}
+
+func TestHooksAuthDeciderTimeout(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	require.NoError(t, h.AddWithTimeout(&deciderHook{prefix: "ldap-"}, nil, TimeoutOptions{Timeout: 1000}))
+	require.NoError(t, h.Add(new(modifiedHookBase), nil))
+
+	require.False(t, h.OnConnectAuthenticate(&Client{ID: "ldap-a"}, packets.Packet{}))
+	require.False(t, h.OnACLCheck(new(Client), "private/a", true))
+	require.True(t, h.OnACLCheck(new(Client), "public/a", true))
+	h.Stop()
+}
+
+type stopHook struct {
+	HookBase
+}
+
+func (h *stopHook) ID() string {
+	return "stop"
+}
+
+func (h *stopHook) Provides(b byte) bool {
+	return b == OnPacketRead || b == OnSubscribeFilter || b == OnPublish
+}
+
+func (h *stopHook) OnPacketRead(cl *Client, pk packets.Packet) (packets.Packet, error) {
+	pk.PacketID = 1
+	return pk, ErrStopHookChain
+}
+
+func (h *stopHook) OnSubscribeFilter(cl *Client, sub packets.Subscription) (packets.Subscription, error) {
+	sub.Filter = "handled/" + sub.Filter
+	return sub, ErrStopHookChain
+}
+
+func (h *stopHook) OnPublish(cl *Client, pk packets.Packet) (packets.Packet, error) {
+	pk.Payload = []byte("handled")
+	return pk, fmt.Errorf("handled: %w", ErrStopHookChain)
+}
+
+func TestHooksStopChain(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	require.NoError(t, h.Add(new(stopHook), nil))
+	later := &modifiedHookBase{fail: true} // would fail if called
+	require.NoError(t, h.Add(later, nil))
+	require.NoError(t, h.Add(&filterHook{prefix: "x/", qos: 2}, nil))
+
+	pk, err := h.OnPacketRead(new(Client), packets.Packet{PacketID: 10})
+	require.NoError(t, err)
+	require.Equal(t, uint16(1), pk.PacketID)
+
+	sub, err := h.OnSubscribeFilter(new(Client), packets.Subscription{Filter: "a/b"})
+	require.NoError(t, err)
+	require.Equal(t, "handled/a/b", sub.Filter)
+
+	pk, err = h.OnPublish(new(Client), packets.Packet{PacketID: 10})
+	require.NoError(t, err)
+	require.Equal(t, []byte("handled"), pk.Payload)
+	require.Equal(t, uint16(10), pk.PacketID)
+}
+
+func TestHooksOnACLActionCheck(t *testing.T) {
+	h := new(Hooks)
+	require.True(t, h.OnACLActionCheck(new(Client), "a/b/c", ACLActionRetain))
+
+	err := h.Add(new(modifiedHookBase), nil)
+	require.NoError(t, err)
+	require.True(t, h.OnACLActionCheck(new(Client), "a/b/c", ACLActionRetain))
+
+	err = h.AddForListeners(&denyActionHook{action: ACLActionWill}, nil, []string{"public"})
+	require.NoError(t, err)
+
+	public := &Client{Net: ClientConnection{Listener: "public"}}
+	require.False(t, h.OnACLActionCheck(public, "a/b/c", ACLActionWill))
+	require.True(t, h.OnACLActionCheck(public, "a/b/c", ACLActionRetain))
+	require.True(t, h.OnACLActionCheck(new(Client), "a/b/c", ACLActionWill))
+}
+
+func TestHooksOnACLDenied(t *testing.T) {
+	h := new(Hooks)
+	h.OnACLDenied(new(Client), "a/b/c", ACLActionWrite)
+
+	hook := new(aclDeniedHook)
+	err := h.AddForListeners(hook, nil, []string{"internal"}) // only describes denials of internal clients
+	require.NoError(t, err)
+
+	public := &Client{Net: ClientConnection{Listener: "public"}}
+	internal := &Client{Net: ClientConnection{Listener: "internal"}}
+	h.OnACLDenied(public, "a/b/c", ACLActionWrite)
+	h.OnACLDenied(internal, "a/b/c", ACLActionRead)
+
+	require.Equal(t, []ACLDenial{
+		{Topic: "a/b/c", Action: ACLActionWrite},
+		{Topic: "a/b/c", Action: ACLActionRead, Hook: "acl-denied", Rule: "rule-read"},
+	}, hook.denials)
+}
+
+func TestHooksOnPublishQuota(t *testing.T) {
+	h := new(Hooks)
+	require.True(t, h.OnPublishQuota(new(Client), packets.Packet{TopicName: "over"}))
+
+	hook := new(quotaHook)
+	err := h.AddForListeners(hook, nil, []string{"public"})
+	require.NoError(t, err)
+
+	public := &Client{Net: ClientConnection{Listener: "public"}}
+	require.True(t, h.OnPublishQuota(public, packets.Packet{TopicName: "a/b/c"}))
+	require.False(t, h.OnPublishQuota(public, packets.Packet{TopicName: "over"}))
+	require.True(t, h.OnPublishQuota(new(Client), packets.Packet{TopicName: "over"}))
+
+	hook.throttle = true
+	require.True(t, h.OnPublishQuota(public, packets.Packet{TopicName: "over"}))
+
+	require.Equal(t, []QuotaExceeded{
+		{Topic: "over", Hook: "quota", Rule: "rule", Limit: "messages"},
+		{Topic: "over", Hook: "quota", Rule: "rule", Limit: "messages", Throttled: true},
+	}, hook.exceeded)
+}
+
+func TestACLActionString(t *testing.T) {
+	require.Equal(t, "retain", ACLActionRetain.String())
+	require.Equal(t, "will", ACLActionWill.String())
+	require.Equal(t, "read", ACLActionRead.String())
+	require.Equal(t, "write", ACLActionWrite.String())
+	require.Equal(t, "unknown", ACLAction(9).String())
+}
+
+func TestHooksAddForListeners(t *testing.T) {
+	h := new(Hooks)
+	err := h.AddForListeners(new(modifiedHookBase), nil, []string{"internal"})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), h.Len())
+
+	internal := &Client{Net: ClientConnection{Listener: "internal"}}
+	public := &Client{Net: ClientConnection{Listener: "public"}}
+
+	require.True(t, h.OnConnectAuthenticate(internal, packets.Packet{}))
+	require.True(t, h.OnACLCheck(internal, "a/b/c", true))
+	require.False(t, h.OnConnectAuthenticate(public, packets.Packet{}))
+	require.False(t, h.OnACLCheck(public, "a/b/c", true))
+
+	err = h.Add(new(modifiedHookBase), nil) // unscoped hooks apply to all listeners
+	require.NoError(t, err)
+	require.True(t, h.OnConnectAuthenticate(public, packets.Packet{}))
+	require.True(t, h.OnACLCheck(public, "a/b/c", true))
+}
+
+func TestHooksAddWithPriority(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	base := new(HookBase)
+	internal := new(modifiedHookBase)
+	public := &modifiedHookBase{fail: true}
+	last := new(modifiedHookBase)
+
+	require.NoError(t, h.Add(base, nil))
+	require.NoError(t, h.AddWithPriority(internal, nil, 10, []string{"internal"}))
+	require.NoError(t, h.AddWithPriority(public, nil, 5, []string{"public"}))
+	require.NoError(t, h.AddWithPriority(last, nil, -1, nil))
+	require.Equal(t, int64(4), h.Len())
+	require.Equal(t, []Hook{internal, public, base, last}, h.GetAll())
+
+	// the scopes move with their hooks
+	hs := h.load()
+	require.Equal(t, map[string]bool{"internal": true}, hs.scopes[0])
+	require.Equal(t, map[string]bool{"public": true}, hs.scopes[1])
+	require.Nil(t, hs.scopes[2])
+	require.Nil(t, hs.scopes[3])
+
+	// hooks with the same priority keep the order they were added in
+	second := new(HookBase)
+	require.NoError(t, h.AddWithPriority(second, nil, 5, nil))
+	require.Equal(t, []Hook{internal, public, second, base, last}, h.GetAll())
+
+	require.NoError(t, h.Remove("base")) // the first hook with the id is removed
+	require.Equal(t, []Hook{internal, public, base, last}, h.GetAll())
+	require.Equal(t, []int{10, 5, 0, -1}, h.load().priorities)
+	h.Stop()
+}
+
+// blockingHook blocks its acl checks until release is closed, and records when it is stopped.
+type blockingHook struct {
+	HookBase
+	started chan struct{}
+	release chan struct{}
+	stopped atomic.Bool
+}
+
+func (h *blockingHook) ID() string {
+	return "blocking"
+}
+
+func (h *blockingHook) Provides(b byte) bool {
+	return b == OnACLCheck
+}
+
+func (h *blockingHook) OnACLCheck(cl *Client, topic string, write bool) bool {
+	close(h.started)
+	<-h.release
+	return !h.stopped.Load()
+}
+
+func (h *blockingHook) Stop() error {
+	h.stopped.Store(true)
+	return nil
+}
+
+func TestHooksRemove(t *testing.T) {
+	h := new(Hooks)
+	require.ErrorIs(t, h.Remove("modified"), ErrHookNotFound)
+
+	require.NoError(t, h.Add(new(HookBase), nil))
+	require.NoError(t, h.AddForListeners(new(modifiedHookBase), nil, []string{"internal"}))
+	require.NoError(t, h.AddForListeners(&modifiedHookBase{fail: true}, nil, []string{"public"}))
+	require.Equal(t, int64(3), h.Len())
+
+	require.NoError(t, h.Remove("base"))
+	require.Equal(t, int64(2), h.Len())
+	require.Equal(t, "modified", h.GetAll()[0].ID())
+
+	// the scopes of the remaining hooks are kept
+	internal := &Client{Net: ClientConnection{Listener: "internal"}}
+	public := &Client{Net: ClientConnection{Listener: "public"}}
+	other := &Client{Net: ClientConnection{Listener: "other"}}
+	require.True(t, h.OnACLCheck(internal, "a/b/c", true))
+	require.True(t, h.OnACLCheck(public, "a/b/c", true))
+	require.False(t, h.OnACLCheck(other, "a/b/c", true))
+
+	require.NoError(t, h.Remove("modified"))
+	require.False(t, h.OnACLCheck(internal, "a/b/c", true))
+	require.True(t, h.OnACLCheck(public, "a/b/c", true))
+
+	require.ErrorIs(t, h.Remove("modified"), errTestHook) // the error of the stopped hook is returned
+	require.Equal(t, int64(0), h.Len())
+	require.Empty(t, h.GetAll())
+	h.Stop()
+}
+
+func TestHooksAddScoped(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	err := h.AddScoped(&modifiedHookBase{fail: true}, nil, HookScope{
+		Listeners:      []string{"tcp"},
+		ClientPrefixes: []string{"t1-"},
+		Topics:         []string{"t1/#"},
+	})
+	require.NoError(t, err)
+
+	tenant := &Client{ID: "t1-a", Net: ClientConnection{Listener: "tcp"}}
+	other := &Client{ID: "t2-a", Net: ClientConnection{Listener: "tcp"}}
+	ws := &Client{ID: "t1-b", Net: ClientConnection{Listener: "ws"}}
+
+	require.ErrorIs(t, h.OnConnect(tenant, packets.Packet{}), errTestHook)
+	require.NoError(t, h.OnConnect(other, packets.Packet{}))
+	require.NoError(t, h.OnConnect(ws, packets.Packet{}))
+
+	require.True(t, h.OnACLCheck(tenant, "t1/a", true))
+	require.False(t, h.OnACLCheck(tenant, "t2/a", true))
+	require.False(t, h.OnACLCheck(other, "t1/a", true))
+
+	err = h.AddScoped(&filterHook{prefix: "x/", qos: 2}, nil, HookScope{Topics: []string{"t1/#"}})
+	require.NoError(t, err)
+
+	sub, err := h.OnSubscribeFilter(other, packets.Subscription{Filter: "t1/+/c"})
+	require.NoError(t, err)
+	require.Equal(t, "x/t1/+/c", sub.Filter)
+
+	sub, err = h.OnSubscribeFilter(other, packets.Subscription{Filter: "#"})
+	require.NoError(t, err)
+	require.Equal(t, "#", sub.Filter)
+}
+
+func TestHooksRemoveScoped(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	require.NoError(t, h.Add(new(HookBase), nil))
+	require.NoError(t, h.AddScoped(new(modifiedHookBase), nil, HookScope{ClientPrefixes: []string{"t1-"}}))
+	require.Nil(t, h.load().filters[0])
+	require.NotNil(t, h.load().filters[1])
+
+	require.NoError(t, h.Remove("base"))
+	require.Len(t, h.load().filters, 1)
+	require.True(t, h.OnACLCheck(&Client{ID: "t1-a"}, "a/b/c", true))
+	require.False(t, h.OnACLCheck(&Client{ID: "t2-a"}, "a/b/c", true))
+}
+
+func TestHooksRemoveDrains(t *testing.T) {
+	h := new(Hooks)
+	hook := &blockingHook{started: make(chan struct{}), release: make(chan struct{})}
+	require.NoError(t, h.Add(hook, nil))
+	require.NoError(t, h.Add(new(HookBase), nil))
+
+	allowed := make(chan bool)
+	go func() {
+		allowed <- h.OnACLCheck(new(Client), "a/b/c", true)
+	}()
+	<-hook.started
+
+	removed := make(chan error)
+	go func() {
+		removed <- h.Remove("blocking")
+	}()
+
+	select {
+	case <-removed:
+		t.Fatal("hook removed during a call")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	require.Len(t, h.GetAll(), 1) // new calls no longer see the hook
+	require.False(t, hook.stopped.Load())
+
+	close(hook.release)
+	require.True(t, <-allowed) // the call completed before the hook was stopped
+	require.NoError(t, <-removed)
+	require.True(t, hook.stopped.Load())
+}
+
+// asyncHook blocks its published events until release is closed, and counts them.
+type asyncHook struct {
+	HookBase
+	release   chan struct{}
+	published atomic.Int64
+	stopped   atomic.Int64 // the number of published events when the hook was stopped
+}
+
+func (h *asyncHook) ID() string {
+	return "async"
+}
+
+func (h *asyncHook) Provides(b byte) bool {
+	return b == OnPublished || b == OnACLCheck
+}
+
+func (h *asyncHook) OnACLCheck(cl *Client, topic string, write bool) bool {
+	return true
+}
+
+func (h *asyncHook) OnPublished(cl *Client, pk packets.Packet) {
+	<-h.release
+	h.published.Add(1)
+}
+
+func (h *asyncHook) Stop() error {
+	h.stopped.Store(h.published.Load())
+	return nil
+}
+
+func TestHooksAddAsync(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	hook := &asyncHook{release: make(chan struct{})}
+	require.NoError(t, h.AddAsync(hook, nil, AsyncOptions{Workers: 2}))
+	require.NoError(t, h.AddWithPriority(new(HookBase), nil, 1, nil))
+	require.Nil(t, h.load().dispatcher(0))
+	require.NotNil(t, h.load().dispatcher(1)) // the dispatcher moves with its hook
+
+	cl := &Client{ID: "cl1"}
+	for i := 0; i < 3; i++ {
+		h.OnPublished(cl, packets.Packet{}) // returns without waiting for the hook
+	}
+	require.Equal(t, int64(0), hook.published.Load())
+	require.True(t, h.OnACLCheck(cl, "a/b/c", true)) // events returning values are called inline
+	require.Equal(t, map[string]int64{"async": 0}, h.AsyncDropped())
+
+	close(hook.release)
+	require.NoError(t, h.Remove("async"))
+	require.Equal(t, int64(3), hook.stopped.Load()) // queued events are called before the hook is stopped
+	require.Nil(t, h.load().async[0])
+	require.Empty(t, h.AsyncDropped())
+	h.Stop()
+}
+
+func TestHooksStopAsync(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	hook := &asyncHook{release: make(chan struct{})}
+	require.NoError(t, h.AddAsync(hook, nil, AsyncOptions{}))
+
+	h.OnPublished(&Client{ID: "cl1"}, packets.Packet{})
+	close(hook.release)
+	h.Stop()
+	require.Equal(t, int64(1), hook.stopped.Load())
+}
+
+// panicHook panics in each of the hook methods it provides.
+type panicHook struct {
+	HookBase
+	stopped atomic.Bool
+}
+
+func (h *panicHook) ID() string {
+	return "panic"
+}
+
+func (h *panicHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		OnConnectAuthenticate,
+		OnACLCheck,
+		OnPublish,
+		OnPublished,
+		OnPacketEncode,
+	}, []byte{b})
+}
+
+func (h *panicHook) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool {
+	panic("connect")
+}
+
+func (h *panicHook) OnACLCheck(cl *Client, topic string, write bool) bool {
+	panic("acl")
+}
+
+func (h *panicHook) OnPublish(cl *Client, pk packets.Packet) (packets.Packet, error) {
+	panic("publish")
+}
+
+func (h *panicHook) OnPublished(cl *Client, pk packets.Packet) {
+	panic("published")
+}
+
+func (h *panicHook) OnPacketEncode(cl *Client, pk packets.Packet) packets.Packet {
+	panic("encode")
+}
+
+func (h *panicHook) Stop() error {
+	h.stopped.Store(true)
+	return nil
+}
+
+func TestHooksRecoverPanic(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	require.NoError(t, h.Add(new(panicHook), nil))
+
+	cl := &Client{ID: "cl1"}
+	pk := packets.Packet{TopicName: "a/b/c"}
+	require.False(t, h.OnConnectAuthenticate(cl, packets.Packet{})) // a panicking auth hook denies the client
+	require.False(t, h.OnACLCheck(cl, "a/b/c", true))
+
+	npk, err := h.OnPublish(cl, pk)
+	require.NoError(t, err)
+	require.Equal(t, pk, npk) // the packet is unchanged
+	require.Equal(t, pk, h.OnPacketEncode(cl, pk))
+	h.OnPublished(cl, pk)
+
+	// the hooks after a panicking hook are still called
+	require.NoError(t, h.Add(new(modifiedHookBase), nil))
+	require.True(t, h.OnACLCheck(cl, "a/b/c", true))
+	require.Equal(t, map[string]int64{"panic": 6}, h.Panics())
+	require.Equal(t, int64(2), h.Len())
+	h.Stop()
+}
+
+func TestHooksRecoverPanicAsync(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	require.NoError(t, h.AddAsync(new(panicHook), nil, AsyncOptions{}))
+
+	h.OnPublished(&Client{ID: "cl1"}, packets.Packet{})
+	require.Eventually(t, func() bool {
+		return h.Panics()["panic"] == 1
+	}, time.Second, time.Millisecond)
+	h.Stop()
+}
+
+func TestHooksPanicLimit(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	h.PanicLimit = 2
+	hook := new(panicHook)
+	require.NoError(t, h.Add(hook, nil))
+
+	cl := &Client{ID: "cl1"}
+	h.OnPublished(cl, packets.Packet{})
+	require.Equal(t, int64(1), h.Len())
+
+	h.OnPublished(cl, packets.Packet{})
+	require.Eventually(t, func() bool {
+		return h.Len() == 0 && hook.stopped.Load()
+	}, time.Second, time.Millisecond)
+	require.Equal(t, map[string]int64{"panic": 2}, h.Panics())
+}
+
+// slowHook blocks its checks until release is closed.
+type slowHook struct {
+	HookBase
+	release chan struct{}
+}
+
+func (h *slowHook) ID() string {
+	return "slow"
+}
+
+func (h *slowHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		OnConnectAuthenticate,
+		OnACLCheck,
+		OnPublish,
+	}, []byte{b})
+}
+
+func (h *slowHook) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool {
+	<-h.release
+	return true
+}
+
+func (h *slowHook) OnACLCheck(cl *Client, topic string, write bool) bool {
+	<-h.release
+	return topic == "allowed"
+}
+
+func (h *slowHook) OnPublish(cl *Client, pk packets.Packet) (packets.Packet, error) {
+	<-h.release
+	pk.TopicName = "modified"
+	return pk, nil
+}
+
+func TestHooksTimeout(t *testing.T) {
+	tt := []struct {
+		policy  TimeoutPolicy
+		allowed bool
+		err     error
+	}{
+		{policy: TimeoutDeny, allowed: false, err: packets.ErrRejectPacket},
+		{policy: TimeoutAllow, allowed: true},
+		{policy: TimeoutSkip, allowed: true}, // the next hook allows the client
+	}
+
+	for _, tx := range tt {
+		t.Run(strconv.Itoa(int(tx.policy)), func(t *testing.T) {
+			h := new(Hooks)
+			h.Log = logger
+			hook := &slowHook{release: make(chan struct{})}
+			require.NoError(t, h.AddWithTimeout(hook, nil, TimeoutOptions{Timeout: 10, Policy: tx.policy}))
+			require.NoError(t, h.Add(new(modifiedHookBase), nil))
+
+			cl := &Client{ID: "cl1"}
+			require.Equal(t, tx.allowed, h.OnConnectAuthenticate(cl, packets.Packet{}))
+			require.Equal(t, tx.allowed, h.OnACLCheck(cl, "a/b/c", true))
+
+			pk, err := h.OnPublish(cl, packets.Packet{TopicName: "a/b/c"})
+			require.ErrorIs(t, err, tx.err)
+			require.Equal(t, "a/b/c", pk.TopicName) // the packet is not modified by the abandoned call
+
+			close(hook.release)
+			h.Stop()
+		})
+	}
+}
+
+func TestHooksTimeoutReturns(t *testing.T) {
 	h := new(Hooks)
 	h.Log = logger
+	hook := &slowHook{release: make(chan struct{})}
+	close(hook.release)
+	require.NoError(t, h.AddWithTimeout(hook, nil, TimeoutOptions{Timeout: 1000}))
 
-	err := h.Add(new(HookBase), nil)
-	require.NoError(t, err)
-	require.Equal(t, int64(1), atomic.LoadInt64(&h.qty))
-	require.Equal(t, int64(1), h.Len())
+	cl := &Client{ID: "cl1"}
+	require.True(t, h.OnConnectAuthenticate(cl, packets.Packet{}))
+	require.True(t, h.OnACLCheck(cl, "allowed", true))
+	require.False(t, h.OnACLCheck(cl, "a/b/c", true))
 
+	pk, err := h.OnPublish(cl, packets.Packet{TopicName: "a/b/c"})
+	require.NoError(t, err)
+	require.Equal(t, "modified", pk.TopicName)
 	h.Stop()
 }
 
-// coverage: also cover some empty functions
-func TestHooksNonReturns(t *testing.T) {
+func TestHooksTimeoutPanic(t *testing.T) {
 	h := new(Hooks)
-	cl := new(Client)
+	h.Log = logger
+	require.NoError(t, h.AddWithTimeout(new(panicHook), nil, TimeoutOptions{Timeout: 1000}))
 
-	for i := 0; i < 2; i++ {
-		t.Run("step-"+strconv.Itoa(i), func(t *testing.T) {
-			// on first iteration, check without hook methods
-			h.OnStarted()
-			h.OnStopped()
-			h.OnSysInfoTick(new(system.Info))
-			h.OnSessionEstablish(cl, packets.Packet{})
-			h.OnSessionEstablished(cl, packets.Packet{})
-			h.OnDisconnect(cl, nil, false)
-			h.OnPacketSent(cl, packets.Packet{}, []byte{})
-			h.OnPacketProcessed(cl, packets.Packet{}, nil)
-			h.OnSubscribed(cl, packets.Packet{}, []byte{1})
-			h.OnUnsubscribed(cl, packets.Packet{})
-			h.OnPublished(cl, packets.Packet{})
-			h.OnPublishDropped(cl, packets.Packet{})
-			h.OnRetainMessage(cl, packets.Packet{}, 0)
-			h.OnRetainPublished(cl, packets.Packet{})
-			h.OnQosPublish(cl, packets.Packet{}, time.Now().Unix(), 0)
-			h.OnQosComplete(cl, packets.Packet{})
-			h.OnQosDropped(cl, packets.Packet{})
-			h.OnPacketIDExhausted(cl, packets.Packet{})
-			h.OnWillSent(cl, packets.Packet{})
-			h.OnClientExpired(cl)
-			h.OnRetainedExpired("a/b/c")
+	cl := &Client{ID: "cl1"}
+	require.False(t, h.OnConnectAuthenticate(cl, packets.Packet{}))
+	pk, err := h.OnPublish(cl, packets.Packet{TopicName: "a/b/c"})
+	require.NoError(t, err)
+	require.Equal(t, "a/b/c", pk.TopicName)
+	require.Equal(t, map[string]int64{"panic": 2}, h.Panics())
+	h.Stop()
+}
 
-			// on second iteration, check added hook methods
-			err := h.Add(new(modifiedHookBase), nil)
-			require.NoError(t, err)
-		})
+func TestHooksTimeoutRemoveAbandoned(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	hook := &slowHook{release: make(chan struct{})}
+	defer close(hook.release)
+	require.NoError(t, h.AddWithTimeout(hook, nil, TimeoutOptions{Timeout: 1}))
+	require.False(t, h.OnACLCheck(&Client{ID: "cl1"}, "a/b/c", true))
+
+	removed := make(chan error)
+	go func() {
+		removed <- h.Remove("slow")
+	}()
+
+	select {
+	case err := <-removed:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("expected remove not to wait for the abandoned call")
 	}
 }
 
-func TestHooksOnConnectAuthenticate(t *testing.T) {
+func TestHooksTimeoutReturnsReleased(t *testing.T) {
 	h := new(Hooks)
+	h.Log = logger
+	hook := &slowHook{release: make(chan struct{})}
+	close(hook.release)
+	require.NoError(t, h.AddWithTimeout(hook, nil, TimeoutOptions{Timeout: 1000}))
+	require.True(t, h.OnACLCheck(&Client{ID: "cl1"}, "allowed", true))
+	require.Equal(t, int64(0), atomic.LoadInt64(&h.load().refs))
+}
 
-	ok := h.OnConnectAuthenticate(new(Client), packets.Packet{})
-	require.False(t, ok)
-
-	err := h.Add(new(modifiedHookBase), nil)
-	require.NoError(t, err)
+func TestHooksMetrics(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	h.RecordMetrics = true
+	require.NoError(t, h.Add(new(modifiedHookBase), nil))
+	require.NoError(t, h.Add(new(panicHook), nil))
+
+	cl := &Client{ID: "cl1"}
+	require.True(t, h.OnACLCheck(cl, "a/b/c", true))
+	h.OnPublished(cl, packets.Packet{})
+
+	metrics := h.Metrics()
+	require.Equal(t, int64(1), metrics["modified"]["OnACLCheck"].Calls)
+	require.Equal(t, int64(0), metrics["modified"]["OnACLCheck"].Errors)
+	require.Equal(t, int64(1), metrics["panic"]["OnPublished"].Calls)
+	require.Equal(t, int64(1), metrics["panic"]["OnPublished"].Errors) // the panic is counted as an error
+	require.NotContains(t, metrics["panic"], "OnACLCheck")             // not reached, as modified allowed the client
+	h.Stop()
+}
 
-	ok = h.OnConnectAuthenticate(new(Client), packets.Packet{})
-	require.True(t, ok)
+func TestHooksMetricsDisabled(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	require.NoError(t, h.Add(new(modifiedHookBase), nil))
+	require.True(t, h.OnACLCheck(new(Client), "a/b/c", true))
+	require.Empty(t, h.Metrics())
+	h.Stop()
 }
 
-func TestHooksOnACLCheck(t *testing.T) {
+func TestHooksMetricsTimeout(t *testing.T) {
 	h := new(Hooks)
+	h.Log = logger
+	h.RecordMetrics = true
+	hook := &slowHook{release: make(chan struct{})}
+	require.NoError(t, h.AddWithTimeout(hook, nil, TimeoutOptions{Timeout: 1}))
+	require.False(t, h.OnACLCheck(&Client{ID: "cl1"}, "a/b/c", true))
 
-	ok := h.OnACLCheck(new(Client), "a/b/c", true)
-	require.False(t, ok)
+	require.Equal(t, int64(1), h.Metrics()["slow"]["OnACLCheck"].Errors) // the timeout is counted as an error
 
-	err := h.Add(new(modifiedHookBase), nil)
-	require.NoError(t, err)
+	close(hook.release)
+	require.Eventually(t, func() bool {
+		return h.Metrics()["slow"]["OnACLCheck"].Calls == 1 // the abandoned call is recorded once it returns
+	}, time.Second, time.Millisecond)
+	h.Stop()
+}
 
-	ok = h.OnACLCheck(new(Client), "a/b/c", true)
-	require.True(t, ok)
+func TestHooksAddForListenersInitError(t *testing.T) {
+	h := new(Hooks)
+	err := h.AddForListeners(new(modifiedHookBase), map[string]any{}, []string{"internal"})
+	require.Error(t, err)
+	require.Equal(t, int64(0), h.Len())
 }
 
 func TestHooksOnSubscribe(t *testing.T) {
@@ -302,6 +1152,50 @@ func TestHooksOnSubscribe(t *testing.T) {
 	require.EqualValues(t, pk, pki)
 }
 
+// filterHook prefixes subscription filters, caps their qos, and rejects filters beginning
+// with deny.
+type filterHook struct {
+	HookBase
+	prefix string
+	qos    byte
+}
+
+func (h *filterHook) ID() string {
+	return "filter-" + h.prefix
+}
+
+func (h *filterHook) Provides(b byte) bool {
+	return b == OnSubscribeFilter
+}
+
+func (h *filterHook) OnSubscribeFilter(cl *Client, sub packets.Subscription) (packets.Subscription, error) {
+	if strings.HasPrefix(sub.Filter, "deny/") {
+		return sub, packets.ErrNotAuthorized
+	}
+
+	sub.Filter = h.prefix + sub.Filter
+	sub.Qos = min(sub.Qos, h.qos)
+	return sub, nil
+}
+
+func TestHooksOnSubscribeFilter(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	err := h.Add(&filterHook{prefix: "tenant/", qos: 2}, nil)
+	require.NoError(t, err)
+	err = h.Add(&filterHook{prefix: "x/", qos: 1}, nil)
+	require.NoError(t, err)
+
+	sub, err := h.OnSubscribeFilter(new(Client), packets.Subscription{Filter: "a/b/c", Qos: 2})
+	require.NoError(t, err)
+	require.Equal(t, "x/tenant/a/b/c", sub.Filter)
+	require.Equal(t, byte(1), sub.Qos)
+
+	sub, err = h.OnSubscribeFilter(new(Client), packets.Subscription{Filter: "deny/a", Qos: 2})
+	require.ErrorIs(t, err, packets.ErrNotAuthorized)
+	require.Equal(t, "deny/a", sub.Filter)
+}
+
 func TestHooksOnSelectSubscribers(t *testing.T) {
 	h := new(Hooks)
 	err := h.Add(new(modifiedHookBase), nil)
@@ -402,6 +1296,51 @@ func TestHooksOnAuthPacket(t *testing.T) {
 	require.Equal(t, uint16(10), pk.PacketID)
 }
 
+// methodHook is an enhanced auth hook which supports a single authentication method.
+type methodHook struct {
+	HookBase
+	method string
+}
+
+func (h *methodHook) ID() string {
+	return h.method
+}
+
+func (h *methodHook) Provides(b byte) bool {
+	return b == OnEnhancedAuth
+}
+
+func (h *methodHook) OnEnhancedAuth(cl *Client, ea EnhancedAuth) (packets.Code, []byte) {
+	if ea.Method != h.method {
+		return packets.ErrBadAuthenticationMethod, nil
+	}
+
+	return packets.CodeSuccess, []byte(h.method)
+}
+
+func TestHooksOnEnhancedAuth(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+
+	code, data := h.OnEnhancedAuth(new(Client), EnhancedAuth{Method: "a"})
+	require.Equal(t, packets.ErrBadAuthenticationMethod, code)
+	require.Nil(t, data)
+
+	require.NoError(t, h.Add(&methodHook{method: "a"}, nil))
+	require.NoError(t, h.AddForListeners(&methodHook{method: "b"}, nil, []string{"t1"}))
+
+	code, data = h.OnEnhancedAuth(new(Client), EnhancedAuth{Method: "a"})
+	require.Equal(t, packets.CodeSuccess, code)
+	require.Equal(t, []byte("a"), data)
+
+	code, _ = h.OnEnhancedAuth(&Client{Net: ClientConnection{Listener: "t2"}}, EnhancedAuth{Method: "b"})
+	require.Equal(t, packets.ErrBadAuthenticationMethod, code)
+
+	code, data = h.OnEnhancedAuth(&Client{Net: ClientConnection{Listener: "t1"}}, EnhancedAuth{Method: "b"})
+	require.Equal(t, packets.CodeSuccess, code)
+	require.Equal(t, []byte("b"), data)
+}
+
 func TestHooksOnConnect(t *testing.T) {
 	h := new(Hooks)
 	h.Log = logger
@@ -535,6 +1474,28 @@ func TestHooksStoredInflightMessages(t *testing.T) {
 	require.Len(t, v, 0)
 }
 
+func TestHooksStoredQueuedMessages(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+
+	v, err := h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Len(t, v, 0)
+
+	hook := new(modifiedHookBase)
+	err = h.Add(hook, nil)
+	require.NoError(t, err)
+
+	v, err = h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Len(t, v, 2)
+
+	hook.fail = true
+	v, err = h.StoredQueuedMessages()
+	require.Error(t, err)
+	require.Len(t, v, 0)
+}
+
 func TestHooksStoredSysInfo(t *testing.T) {
 	h := new(Hooks)
 	h.Log = logger
@@ -557,6 +1518,174 @@ func TestHooksStoredSysInfo(t *testing.T) {
 	require.Equal(t, "", v.Info.Version)
 }
 
+func TestHooksStoredSession(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+
+	v, err := h.StoredSession("cl1")
+	require.NoError(t, err)
+	require.Equal(t, "", v.Client.ID)
+
+	hook := new(modifiedHookBase)
+	err = h.Add(hook, nil)
+	require.NoError(t, err)
+
+	v, err = h.StoredSession("cl1")
+	require.NoError(t, err)
+	require.Equal(t, "cl1", v.Client.ID)
+	require.Len(t, v.Subscriptions, 1)
+	require.Len(t, v.Inflight, 1)
+	require.Len(t, v.Queued, 1)
+
+	hook.fail = true
+	v, err = h.StoredSession("cl1")
+	require.Error(t, err)
+	require.Equal(t, "", v.Client.ID)
+}
+
+// iterHook is a storage hook which streams its stored values.
+type iterHook struct {
+	modifiedHookBase
+}
+
+func (h *iterHook) IterClients(fn func(v storage.Client) error) error {
+	if h.fail {
+		return errTestHook
+	}
+
+	for _, id := range []string{"cl1", "cl2"} {
+		if err := fn(storage.Client{ID: id}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *iterHook) IterSubscriptions(fn func(v storage.Subscription) error) error {
+	return fn(storage.Subscription{ID: "sub1"})
+}
+
+func (h *iterHook) IterInflightMessages(fn func(v storage.Message) error) error {
+	return fn(storage.Message{ID: "i1"})
+}
+
+func (h *iterHook) IterQueuedMessages(fn func(v storage.Message) error) error {
+	return fn(storage.Message{ID: "q1"})
+}
+
+func (h *iterHook) IterRetainedMessages(fn func(v storage.Message) error) error {
+	return fn(storage.Message{ID: "r1"})
+}
+
+func TestHooksIterClients(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+
+	var ids []string
+	visit := func(v storage.Client) error {
+		ids = append(ids, v.ID)
+		return nil
+	}
+
+	err := h.IterClients(visit)
+	require.NoError(t, err)
+	require.Empty(t, ids)
+
+	hook := new(modifiedHookBase)
+	err = h.Add(hook, nil)
+	require.NoError(t, err)
+
+	err = h.IterClients(visit)
+	require.NoError(t, err)
+	require.Equal(t, []string{"cl1", "cl2", "cl3"}, ids)
+
+	err = h.IterClients(func(v storage.Client) error {
+		return errTestHook
+	})
+	require.ErrorIs(t, err, errTestHook)
+
+	hook.fail = true
+	err = h.IterClients(visit)
+	require.Error(t, err)
+}
+
+func TestHooksIterStoredIterator(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	hook := new(iterHook)
+	err := h.Add(hook, nil)
+	require.NoError(t, err)
+
+	var ids []string
+	err = h.IterClients(func(v storage.Client) error {
+		ids = append(ids, v.ID)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"cl1", "cl2"}, ids) // streamed rather than StoredClients
+
+	err = h.IterSubscriptions(func(v storage.Subscription) error {
+		ids = append(ids, v.ID)
+		return nil
+	})
+	require.NoError(t, err)
+
+	visit := func(v storage.Message) error {
+		ids = append(ids, v.ID)
+		return nil
+	}
+	require.NoError(t, h.IterInflightMessages(visit))
+	require.NoError(t, h.IterQueuedMessages(visit))
+	require.NoError(t, h.IterRetainedMessages(visit))
+	require.Equal(t, []string{"cl1", "cl2", "sub1", "i1", "q1", "r1"}, ids)
+
+	var n int
+	err = h.IterClients(func(v storage.Client) error {
+		n++
+		return errTestHook
+	})
+	require.ErrorIs(t, err, errTestHook)
+	require.Equal(t, 1, n)
+
+	hook.fail = true
+	err = h.IterClients(func(v storage.Client) error {
+		return nil
+	})
+	require.ErrorIs(t, err, errTestHook)
+}
+
+func TestHooksIterStoredFallback(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	hook := new(modifiedHookBase)
+	err := h.Add(hook, nil)
+	require.NoError(t, err)
+
+	var n int
+	err = h.IterSubscriptions(func(v storage.Subscription) error {
+		n++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	n = 0
+	visit := func(v storage.Message) error {
+		n++
+		return nil
+	}
+	require.NoError(t, h.IterInflightMessages(visit))
+	require.NoError(t, h.IterQueuedMessages(visit))
+	require.NoError(t, h.IterRetainedMessages(visit))
+	require.Equal(t, 8, n)
+
+	hook.fail = true
+	require.Error(t, h.IterSubscriptions(func(v storage.Subscription) error { return nil }))
+	require.Error(t, h.IterInflightMessages(visit))
+	require.Error(t, h.IterQueuedMessages(visit))
+	require.Error(t, h.IterRetainedMessages(visit))
+}
+
 func TestHookBaseID(t *testing.T) {
 	h := new(HookBase)
 	require.Equal(t, "base", h.ID())
@@ -597,6 +1726,72 @@ func TestHookBaseOnACLCheck(t *testing.T) {
 	require.False(t, v)
 }
 
+func TestHookBaseOnACLActionCheck(t *testing.T) {
+	h := new(HookBase)
+	v := h.OnACLActionCheck(new(Client), "topic", ACLActionWill)
+	require.True(t, v)
+}
+
+func TestHookBaseOnACLDenied(t *testing.T) {
+	h := new(HookBase)
+	h.OnACLDenied(new(Client), ACLDenial{Topic: "topic", Action: ACLActionRead})
+}
+
+func TestHookBaseOnPublishQuota(t *testing.T) {
+	h := new(HookBase)
+	_, over := h.OnPublishQuota(new(Client), packets.Packet{TopicName: "topic"})
+	require.False(t, over)
+}
+
+func TestHookBaseOnQuotaExceeded(t *testing.T) {
+	h := new(HookBase)
+	h.OnQuotaExceeded(new(Client), QuotaExceeded{Topic: "topic"})
+}
+
+func TestHookBaseOnPacketWritten(t *testing.T) {
+	h := new(HookBase)
+	h.OnPacketWritten(new(Client), PacketWritten{Type: packets.Publish, Size: 10})
+}
+
+func TestHookBaseOnSubscribeFilter(t *testing.T) {
+	h := new(HookBase)
+	sub, err := h.OnSubscribeFilter(new(Client), packets.Subscription{Filter: "a/b/c", Qos: 1})
+	require.NoError(t, err)
+	require.Equal(t, packets.Subscription{Filter: "a/b/c", Qos: 1}, sub)
+}
+
+func TestHookBaseOnMessageDropped(t *testing.T) {
+	h := new(HookBase)
+	h.OnMessageDropped(new(Client), packets.Packet{}, DropExpired)
+}
+
+func TestDropReasonString(t *testing.T) {
+	require.Equal(t, "queue_full", DropQueueFull.String())
+	require.Equal(t, "inflight_full", DropInflightFull.String())
+	require.Equal(t, "packet_ids_exhausted", DropPacketIDsExhausted.String())
+	require.Equal(t, "expired", DropExpired.String())
+	require.Equal(t, "offline", DropOffline.String())
+	require.Equal(t, "not_authorized", DropNotAuthorized.String())
+	require.Equal(t, "no_subscribers", DropNoSubscribers.String())
+	require.Equal(t, "queue_limit", DropQueueLimit.String())
+	require.Equal(t, "unknown", DropReason(255).String())
+}
+
+func TestHookBaseOnKeepAliveTimeout(t *testing.T) {
+	h := new(HookBase)
+	h.OnKeepAliveTimeout(new(Client))
+}
+
+func TestHookBaseOnSessionTakenOver(t *testing.T) {
+	h := new(HookBase)
+	h.OnSessionTakenOver(new(Client), new(Client))
+}
+
+func TestHookBaseOnRetainedDelivered(t *testing.T) {
+	h := new(HookBase)
+	h.OnRetainedDelivered(new(Client), "a/b/c", 1)
+}
+
 func TestHookBaseOnConnect(t *testing.T) {
 	h := new(HookBase)
 	err := h.OnConnect(new(Client), packets.Packet{})
@@ -617,6 +1812,13 @@ func TestHookBaseOnPacketRead(t *testing.T) {
 	require.Equal(t, uint16(10), pk.PacketID)
 }
 
+func TestHookBaseOnEnhancedAuth(t *testing.T) {
+	h := new(HookBase)
+	code, data := h.OnEnhancedAuth(new(Client), EnhancedAuth{Method: "a"})
+	require.Equal(t, packets.ErrBadAuthenticationMethod, code)
+	require.Nil(t, data)
+}
+
 func TestHookBaseOnAuthPacket(t *testing.T) {
 	h := new(HookBase)
 	pk, err := h.OnAuthPacket(new(Client), packets.Packet{PacketID: 10})
@@ -652,6 +1854,13 @@ func TestHookBaseStoredInflightMessages(t *testing.T) {
 	require.Empty(t, v)
 }
 
+func TestHookBaseStoredQueuedMessages(t *testing.T) {
+	h := new(HookBase)
+	v, err := h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Empty(t, v)
+}
+
 func TestHookBaseStoredRetainedMessages(t *testing.T) {
 	h := new(HookBase)
 	v, err := h.StoredRetainedMessages()
@@ -659,6 +1868,13 @@ func TestHookBaseStoredRetainedMessages(t *testing.T) {
 	require.Empty(t, v)
 }
 
+func TestHookBaseStoredSession(t *testing.T) {
+	h := new(HookBase)
+	v, err := h.StoredSession("cl1")
+	require.NoError(t, err)
+	require.Equal(t, "", v.Client.ID)
+}
+
 func TestHookBaseStoreSysInfo(t *testing.T) {
 	h := new(HookBase)
 	v, err := h.StoredSysInfo()
@@ -20,6 +20,7 @@ type Inflight struct {
 	sendQuota           int32                     // remaining outbound qos quota for flow control
 	maximumReceiveQuota int32                     // maximum allowed receive quota
 	maximumSendQuota    int32                     // maximum allowed send quota
+	bytes               int64                     // total topic and payload size of the inflight packets
 }
 
 // NewInflights returns a new instance of an Inflight packets map.
@@ -34,8 +35,12 @@ func (i *Inflight) Set(m packets.Packet) bool {
 	i.Lock()
 	defer i.Unlock()
 
-	_, ok := i.internal[m.PacketID]
+	old, ok := i.internal[m.PacketID]
+	if ok {
+		i.bytes -= queuedSize(old)
+	}
 	i.internal[m.PacketID] = m
+	i.bytes += queuedSize(m)
 	return !ok
 }
 
@@ -67,9 +72,33 @@ func (i *Inflight) Clone() *Inflight {
 	for k, v := range i.internal {
 		c.internal[k] = v
 	}
+	c.bytes = i.bytes
 	return c
 }
 
+// Size returns the number of inflight packets and their total topic and payload size.
+func (i *Inflight) Size() (int, int64) {
+	i.RLock()
+	defer i.RUnlock()
+	return len(i.internal), i.bytes
+}
+
+// Oldest returns the inflight packet which was created first.
+func (i *Inflight) Oldest() (packets.Packet, bool) {
+	i.RLock()
+	defer i.RUnlock()
+
+	var oldest packets.Packet
+	var ok bool
+	for _, v := range i.internal {
+		if !ok || v.Created < oldest.Created || v.Created == oldest.Created && v.PacketID < oldest.PacketID {
+			oldest, ok = v, true
+		}
+	}
+
+	return oldest, ok
+}
+
 // GetAll returns all the inflight messages.
 func (i *Inflight) GetAll(immediate bool) []packets.Packet {
 	i.RLock()
@@ -109,7 +138,10 @@ func (i *Inflight) Delete(id uint16) bool {
 	i.Lock()
 	defer i.Unlock()
 
-	_, ok := i.internal[id]
+	m, ok := i.internal[id]
+	if ok {
+		i.bytes -= queuedSize(m)
+	}
 	delete(i.internal, id)
 
 	return ok
@@ -71,6 +71,48 @@ func TestInflightClone(t *testing.T) {
 	require.NotSame(t, cloned, cl.State.Inflight)
 }
 
+func TestInflightSize(t *testing.T) {
+	i := NewInflights()
+	i.Set(packets.Packet{PacketID: 1, TopicName: "a/b", Payload: []byte("hello")})
+	i.Set(packets.Packet{PacketID: 2, TopicName: "a/b/c", Payload: []byte("hi")})
+	n, bytes := i.Size()
+	require.Equal(t, 2, n)
+	require.Equal(t, int64(15), bytes)
+
+	i.Set(packets.Packet{PacketID: 1, TopicName: "a/b"}) // replaced packets are counted once
+	n, bytes = i.Size()
+	require.Equal(t, 2, n)
+	require.Equal(t, int64(10), bytes)
+
+	c := i.Clone()
+	i.Delete(2)
+	i.Delete(3)
+	n, bytes = i.Size()
+	require.Equal(t, 1, n)
+	require.Equal(t, int64(3), bytes)
+
+	n, bytes = c.Size()
+	require.Equal(t, 2, n)
+	require.Equal(t, int64(10), bytes)
+}
+
+func TestInflightOldest(t *testing.T) {
+	i := NewInflights()
+	_, ok := i.Oldest()
+	require.False(t, ok)
+
+	i.Set(packets.Packet{PacketID: 3, Created: 1 << 20}) // created first, though its packet id is the highest
+	i.Set(packets.Packet{PacketID: 1, Created: 1<<20 + 1})
+	i.Set(packets.Packet{PacketID: 2, Created: 1<<20 + 2})
+	pk, ok := i.Oldest()
+	require.True(t, ok)
+	require.Equal(t, uint16(3), pk.PacketID)
+
+	i.Set(packets.Packet{PacketID: 4, Created: 1 << 20})
+	pk, _ = i.Oldest()
+	require.Equal(t, uint16(3), pk.PacketID) // ties are broken by packet id
+}
+
 func TestInflightDelete(t *testing.T) {
 	cl, _, _ := newTestClient()
 
@@ -0,0 +1,88 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+// Package protowire encodes and decodes the fields of the protobuf messages used by the grpc
+// listener and hooks, without generated code. Fields with zero values are omitted, as in proto3.
+package protowire
+
+import "google.golang.org/protobuf/encoding/protowire"
+
+// Number is the number of a field in a protobuf message.
+type Number = protowire.Number
+
+// AppendString appends a string field to b, if it is not empty.
+func AppendString(b []byte, num Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// AppendBytes appends a bytes field to b, if it is not empty.
+func AppendBytes(b []byte, num Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// AppendVarint appends a varint field to b, if it is not 0.
+func AppendVarint(b []byte, num Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// AppendBool appends a bool field to b, if it is true.
+func AppendBool(b []byte, num Number, v bool) []byte {
+	if !v {
+		return b
+	}
+
+	return AppendVarint(b, num, 1)
+}
+
+// Consume calls fn with the value of each varint and bytes field in a protobuf encoded
+// message, skipping fields of any other type.
+func Consume(b []byte, fn func(num Number, u uint64, v []byte)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch typ {
+		case protowire.VarintType:
+			u, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			fn(num, u, nil)
+			b = b[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			fn(num, 0, v)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+
+	return nil
+}
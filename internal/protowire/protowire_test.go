@@ -0,0 +1,48 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package protowire
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestAppendOmitsZeroValues(t *testing.T) {
+	var b []byte
+	b = AppendString(b, 1, "")
+	b = AppendBytes(b, 2, nil)
+	b = AppendVarint(b, 3, 0)
+	b = AppendBool(b, 4, false)
+	require.Empty(t, b)
+}
+
+func TestAppendConsume(t *testing.T) {
+	var b []byte
+	b = AppendString(b, 1, "a/b/c")
+	b = AppendBytes(b, 2, []byte("hello"))
+	b = AppendVarint(b, 3, 300)
+	b = AppendBool(b, 4, true)
+	b = protowire.AppendTag(b, 5, protowire.Fixed32Type) // skipped
+	b = protowire.AppendFixed32(b, 1)
+
+	got := map[Number]any{}
+	err := Consume(b, func(num Number, u uint64, v []byte) {
+		if v != nil {
+			got[num] = string(v)
+			return
+		}
+		got[num] = u
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[Number]any{1: "a/b/c", 2: "hello", 3: uint64(300), 4: uint64(1)}, got)
+}
+
+func TestConsumeInvalid(t *testing.T) {
+	b := AppendString(nil, 1, "a/b/c")
+	require.Error(t, Consume(b[:len(b)-1], func(num Number, u uint64, v []byte) {}))
+	require.Error(t, Consume([]byte{0x80}, func(num Number, u uint64, v []byte) {}))
+}
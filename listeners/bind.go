@@ -0,0 +1,86 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+var (
+	ErrBindToDeviceUnsupported = errors.New("SO_BINDTODEVICE is not supported on this platform") // binding sockets to a device is only available on linux
+	ErrInterfaceNoAddress      = errors.New("network interface has no usable address")           // the selected interface has no address to listen on
+)
+
+// bind applies the interface selection and device binding configured for the listener, returning
+// the address which should be listened on, and chaining any device binding to the control function of lc.
+func (c Config) bind(lc *net.ListenConfig, address string) (string, error) {
+	if c.BindToDevice != "" {
+		next := lc.Control
+		lc.Control = func(network, address string, rc syscall.RawConn) error {
+			if next != nil {
+				if err := next(network, address, rc); err != nil {
+					return err
+				}
+			}
+
+			return bindToDeviceControl(c.BindToDevice, rc)
+		}
+	}
+
+	if c.Interface == "" {
+		return address, nil
+	}
+
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+
+	ip, err := interfaceIP(c.Interface)
+	if err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// interfaceIP returns an address of a network interface by name, preferring ipv4 addresses.
+// Link-local ipv6 addresses are ignored, as they cannot be listened on without a zone.
+func interfaceIP(name string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var ip net.IP
+	for _, addr := range addrs {
+		ipn, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		if ipn.IP.To4() != nil {
+			return ipn.IP, nil
+		}
+
+		if ip == nil && !ipn.IP.IsLinkLocalUnicast() {
+			ip = ipn.IP
+		}
+	}
+
+	if ip == nil {
+		return nil, fmt.Errorf("%w: %s", ErrInterfaceNoAddress, name)
+	}
+
+	return ip, nil
+}
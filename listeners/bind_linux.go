@@ -0,0 +1,27 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+//go:build linux
+
+package listeners
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindToDeviceControl sets SO_BINDTODEVICE on a socket before it is bound, so that
+// it only receives packets arriving on the named network interface.
+func bindToDeviceControl(device string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = unix.BindToDevice(int(fd), device)
+	})
+	if err != nil {
+		return err
+	}
+
+	return serr
+}
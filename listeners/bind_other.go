@@ -0,0 +1,16 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+//go:build !linux
+
+package listeners
+
+import (
+	"syscall"
+)
+
+// bindToDeviceControl returns an error, as SO_BINDTODEVICE is not available on this platform.
+func bindToDeviceControl(device string, c syscall.RawConn) error {
+	return ErrBindToDeviceUnsupported
+}
@@ -0,0 +1,120 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// loopbackInterface returns the name of a loopback interface with an ipv4 address.
+func loopbackInterface(t *testing.T) string {
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+
+		if ip, err := interfaceIP(iface.Name); err == nil && ip.To4() != nil {
+			return iface.Name
+		}
+	}
+
+	t.Skip("no loopback interface available")
+	return ""
+}
+
+func TestConfigBindNone(t *testing.T) {
+	var lc net.ListenConfig
+	address, err := Config{}.bind(&lc, testAddr)
+	require.NoError(t, err)
+	require.Equal(t, testAddr, address)
+	require.Nil(t, lc.Control)
+}
+
+func TestConfigBindInterface(t *testing.T) {
+	name := loopbackInterface(t)
+
+	var lc net.ListenConfig
+	address, err := Config{Interface: name}.bind(&lc, ":1883")
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1:1883", address)
+}
+
+func TestConfigBindInterfaceNotFound(t *testing.T) {
+	var lc net.ListenConfig
+	_, err := Config{Interface: "mochi-missing0"}.bind(&lc, ":1883")
+	require.Error(t, err)
+}
+
+func TestConfigBindInterfaceInvalidAddress(t *testing.T) {
+	var lc net.ListenConfig
+	_, err := Config{Interface: "lo"}.bind(&lc, "wrong")
+	require.Error(t, err)
+}
+
+func TestConfigBindDeviceChainsControl(t *testing.T) {
+	var called bool
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			called = true
+			return ErrReusePortUnsupported
+		},
+	}
+
+	_, err := Config{BindToDevice: "lo"}.bind(&lc, testAddr)
+	require.NoError(t, err)
+
+	err = lc.Control("tcp", testAddr, nil)
+	require.ErrorIs(t, err, ErrReusePortUnsupported)
+	require.True(t, called)
+}
+
+func TestTCPBindToDevice(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		l := NewTCP(Config{ID: "t1", Address: "127.0.0.1:0", BindToDevice: "lo"})
+		require.ErrorIs(t, l.Init(logger), ErrBindToDeviceUnsupported)
+		return
+	}
+
+	name := loopbackInterface(t)
+	l := NewTCP(Config{ID: "t1", Address: "127.0.0.1:0", BindToDevice: name, Interface: name})
+	err := l.Init(logger)
+	if err != nil {
+		t.Skipf("unable to bind to device: %v", err) // requires CAP_NET_RAW on older kernels
+	}
+	defer l.Close(MockCloser)
+
+	go l.Serve(MockEstablisher)
+	conn, err := net.Dial("tcp", l.Address())
+	require.NoError(t, err)
+	_ = conn.Close()
+}
+
+func TestTCPBindToDeviceNotFound(t *testing.T) {
+	l := NewTCP(Config{ID: "t1", Address: "127.0.0.1:0", BindToDevice: "mochi-missing0"})
+	require.Error(t, l.Init(logger))
+}
+
+func TestTCPInitInterfaceNotFound(t *testing.T) {
+	l := NewTCP(Config{ID: "t1", Address: ":0", Interface: "mochi-missing0"})
+	require.Error(t, l.Init(logger))
+}
+
+func TestMQTTSNInitInterface(t *testing.T) {
+	name := loopbackInterface(t)
+	l := NewMQTTSN(Config{ID: "t1", Address: ":0", Interface: name}, nil, nil, nil)
+	require.NoError(t, l.Init(logger))
+	defer l.Close(MockCloser)
+
+	host, _, err := net.SplitHostPort(l.Address())
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", host)
+}
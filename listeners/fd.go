@@ -0,0 +1,90 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const TypeSystemd = "systemd"
+
+// listenFDsStart is the first file descriptor passed by systemd socket activation.
+const listenFDsStart = 3
+
+var (
+	ErrNoSocketActivation = errors.New("no sockets passed by socket activation") // LISTEN_FDS was not set for this process
+	ErrSocketNotFound     = errors.New("socket activation socket not found")     // no passed socket matched the name
+)
+
+// NewFromFD initializes and returns a new listener serving connections from a pre-opened
+// listening socket file descriptor, such as one inherited from a parent process. The listener
+// holds a duplicate of the descriptor, and the original is closed, so each may only be used once.
+func NewFromFD(id string, fd uintptr) (*Net, error) {
+	f := os.NewFile(fd, "listener-"+id)
+	if f == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	defer f.Close() // net.FileListener duplicates the descriptor
+
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewNet(id, l), nil
+}
+
+// NewFromSystemd initializes and returns a new listener serving connections from a socket
+// passed by systemd socket activation. The name should match the FileDescriptorName of the
+// socket unit (LISTEN_FDNAMES), or the number of the file descriptor, e.g. "3".
+func NewFromSystemd(id, name string) (*Net, error) {
+	fds, err := systemdFDs()
+	if err != nil {
+		return nil, err
+	}
+
+	fd, ok := fds[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrSocketNotFound, name)
+	}
+
+	return NewFromFD(id, fd)
+}
+
+// systemdFDs returns the file descriptors passed by systemd socket activation, keyed
+// on both their names and their descriptor numbers.
+func systemdFDs() (map[string]uintptr, error) {
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, ErrNoSocketActivation // the sockets were intended for another process
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, ErrNoSocketActivation
+	}
+
+	var names []string
+	if v := os.Getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+
+	fds := make(map[string]uintptr, n*2)
+	for i := 0; i < n; i++ {
+		fd := uintptr(listenFDsStart + i)
+		fds[strconv.Itoa(int(fd))] = fd
+		if i < len(names) && names[i] != "" {
+			if _, ok := fds[names[i]]; !ok { // the first socket with a name takes precedence
+				fds[names[i]] = fd
+			}
+		}
+	}
+
+	return fds, nil
+}
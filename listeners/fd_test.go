@@ -0,0 +1,113 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testListenerFile returns a listening tcp socket and its file, which holds a duplicate descriptor.
+func testListenerFile(t *testing.T) (net.Listener, *os.File) {
+	n, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	f, err := n.(*net.TCPListener).File()
+	require.NoError(t, err)
+	return n, f
+}
+
+func TestNewFromFD(t *testing.T) {
+	n, f := testListenerFile(t)
+	defer n.Close()
+	defer f.Close()
+
+	l, err := NewFromFD("t1", f.Fd())
+	require.NoError(t, err)
+	require.Equal(t, "t1", l.ID())
+	require.Equal(t, n.Addr().String(), l.Address())
+	require.Equal(t, "tcp", l.Protocol())
+
+	require.NoError(t, l.Init(logger))
+	o := make(chan bool)
+	go func() {
+		l.Serve(func(id string, c net.Conn) error {
+			o <- true
+			return nil
+		})
+	}()
+
+	c, err := net.Dial("tcp", n.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	require.True(t, <-o)
+	l.Close(MockCloser)
+}
+
+func TestNewFromFDInvalid(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "fd")
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = NewFromFD("t1", f.Fd())
+	require.Error(t, err)
+}
+
+func TestNewFromSystemd(t *testing.T) {
+	n, f := testListenerFile(t)
+	defer n.Close()
+	defer f.Close()
+
+	fd := int(f.Fd())
+	names := make([]string, fd-listenFDsStart+1)
+	names[len(names)-1] = "mqtt"
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", strconv.Itoa(len(names)))
+	t.Setenv("LISTEN_FDNAMES", strings.Join(names, ":"))
+
+	_, err := NewFromSystemd("t1", "missing")
+	require.ErrorIs(t, err, ErrSocketNotFound)
+
+	l, err := NewFromSystemd("t2", "mqtt")
+	require.NoError(t, err)
+	require.Equal(t, n.Addr().String(), l.Address())
+	l.Close(MockCloser)
+
+	_, err = NewFromSystemd("t3", strconv.Itoa(fd))
+	require.Error(t, err) // the descriptor has already been used
+}
+
+func TestNewFromSystemdByNumber(t *testing.T) {
+	n, f := testListenerFile(t)
+	defer n.Close()
+	defer f.Close()
+
+	fd := int(f.Fd())
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv("LISTEN_FDS", strconv.Itoa(fd-listenFDsStart+1))
+	t.Setenv("LISTEN_FDNAMES", "")
+
+	l, err := NewFromSystemd("t1", strconv.Itoa(fd))
+	require.NoError(t, err)
+	require.Equal(t, n.Addr().String(), l.Address())
+	l.Close(MockCloser)
+}
+
+func TestNewFromSystemdNotActivated(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv("LISTEN_FDS", "")
+	_, err := NewFromSystemd("t1", "mqtt")
+	require.ErrorIs(t, err, ErrNoSocketActivation)
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	_, err = NewFromSystemd("t1", "3")
+	require.ErrorIs(t, err, ErrNoSocketActivation)
+}
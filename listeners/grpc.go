@@ -0,0 +1,382 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AMuzykus/mochi-mqtt-server/v2/internal/protowire"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+const TypeGRPC = "grpc"
+
+const (
+	grpcBufferSize = 256 // the number of messages buffered for each stream
+)
+
+// grpcServiceDesc describes the mqtt.Broker service defined in grpc.proto.
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: "mqtt.Broker",
+	HandlerType: (*any)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Stream",
+			Handler:       grpcStreamHandler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "grpc.proto",
+}
+
+// GRPC is a listener for publishing and subscribing to broker topics using the
+// bidirectional grpc stream described in grpc.proto.
+type GRPC struct {
+	sync.RWMutex
+	id        string        // the internal id of the listener
+	address   string        // the network address to bind to
+	config    Config        // configuration values for the listener
+	listen    net.Listener  // a net.Listener which will listen for new clients
+	server    *grpc.Server  // the grpc server
+	publish   PublishFn     // publishes messages into the broker
+	subscribe SubscribeFn   // subscribes to filters in the broker
+	auth      HTTPAuthFn    // checks the stream credentials, if set
+	log       *slog.Logger  // server logger
+	done      chan struct{} // closed when the listener is closing, ending all streams
+	end       uint32        // ensure the close methods are only called once
+}
+
+// NewGRPC initializes and returns a new grpc listener, listening on an address.
+// If auth is nil, streams are not authenticated.
+func NewGRPC(config Config, publish PublishFn, subscribe SubscribeFn, auth HTTPAuthFn) *GRPC {
+	return &GRPC{
+		id:        config.ID,
+		address:   config.Address,
+		config:    config,
+		publish:   publish,
+		subscribe: subscribe,
+		auth:      auth,
+		done:      make(chan struct{}),
+	}
+}
+
+// ID returns the id of the listener.
+func (l *GRPC) ID() string {
+	return l.id
+}
+
+// Address returns the address of the listener.
+func (l *GRPC) Address() string {
+	if l.listen != nil {
+		return l.listen.Addr().String()
+	}
+	return l.address
+}
+
+// Protocol returns the address of the listener.
+func (l *GRPC) Protocol() string {
+	return "grpc"
+}
+
+// Init initializes the listener.
+func (l *GRPC) Init(log *slog.Logger) error {
+	l.log = log
+
+	if err := l.config.ValidateTLS(); err != nil {
+		return err
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.ForceServerCodec(grpcCodec{}),
+	}
+
+	if tc := l.config.ServerTLSConfig(); tc != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tc)))
+	}
+
+	filter, err := newIPFilter(l.config)
+	if err != nil {
+		return err
+	}
+
+	var lc net.ListenConfig
+	address, err := l.config.bind(&lc, l.address)
+	if err != nil {
+		return err
+	}
+
+	l.listen, err = lc.Listen(context.Background(), "tcp", address)
+	if err != nil {
+		return err
+	}
+
+	if filter != nil {
+		l.listen = &filteredListener{Listener: l.listen, filter: filter, log: log}
+	}
+
+	l.server = grpc.NewServer(opts...)
+	l.server.RegisterService(&grpcServiceDesc, l)
+
+	return nil
+}
+
+// Serve starts listening for new connections and serving streams.
+func (l *GRPC) Serve(establish EstablishFn) {
+	err := l.server.Serve(l.listen)
+
+	// After the listener has been shutdown, no need to print the grpc.ErrServerStopped error.
+	if err != nil && atomic.LoadUint32(&l.end) == 0 {
+		l.log.Error("failed to serve.", "error", err, "listener", l.id)
+	}
+}
+
+// Close closes the listener and any client connections.
+func (l *GRPC) Close(closeClients CloseFn) {
+	l.Lock()
+	defer l.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		close(l.done)
+
+		stopped := make(chan struct{})
+		go func() {
+			l.server.GracefulStop()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			l.server.Stop()
+		}
+	}
+
+	closeClients(l.id)
+}
+
+// grpcStreamHandler handles a call to the Stream method of the mqtt.Broker service.
+func grpcStreamHandler(srv any, stream grpc.ServerStream) error {
+	return srv.(*GRPC).stream(stream)
+}
+
+// stream publishes and subscribes to topics according to the requests received on a stream,
+// and sends any messages matching its subscriptions, until the stream ends.
+func (l *GRPC) stream(stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	out := make(chan *grpcMessage, grpcBufferSize)
+
+	var username, password []byte
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("username"); len(v) > 0 {
+			username = []byte(v[0])
+		}
+		if v := md.Get("password"); len(v) > 0 {
+			password = []byte(v[0])
+		}
+	}
+
+	var remote string
+	if p, ok := peer.FromContext(ctx); ok {
+		remote = p.Addr.String()
+	}
+
+	authorized := func(topic string, write bool) bool {
+		return l.auth == nil || l.auth(l.id, remote, username, password, topic, write)
+	}
+
+	reply := func(msg *grpcMessage) {
+		select {
+		case out <- msg:
+		case <-ctx.Done():
+		}
+	}
+
+	received := make(chan error, 1)
+	go func() {
+		subs := map[string]func(){}
+		defer func() {
+			for _, unsubscribe := range subs {
+				unsubscribe()
+			}
+		}()
+
+		for {
+			req := new(grpcRequest)
+			if err := stream.RecvMsg(req); err != nil {
+				received <- err
+				return
+			}
+
+			switch req.action {
+			case grpcActionPublish:
+				if !isValidPublishTopic(req.topic) || req.qos > 2 {
+					reply(&grpcMessage{topic: req.topic, err: "invalid publish"})
+				} else if !authorized(req.topic, true) {
+					reply(&grpcMessage{topic: req.topic, err: "not authorized"})
+				} else if err := l.publish(req.topic, req.payload, req.retain, req.qos); err != nil {
+					reply(&grpcMessage{topic: req.topic, err: err.Error()})
+				}
+			case grpcActionSubscribe:
+				if _, ok := subs[req.topic]; ok {
+					continue
+				}
+
+				if !authorized(req.topic, false) {
+					reply(&grpcMessage{topic: req.topic, err: "not authorized"})
+					continue
+				}
+
+				filter := req.topic
+				unsubscribe, err := l.subscribe(filter, func(topic string, payload []byte, retain bool, qos byte) {
+					select {
+					case out <- &grpcMessage{topic: topic, payload: payload, qos: qos, retain: retain}:
+					default: // drop messages for slow streams rather than blocking the broker
+						l.log.Debug("dropped grpc stream message", "listener", l.id, "filter", filter, "topic", topic)
+					}
+				})
+				if err != nil {
+					reply(&grpcMessage{topic: req.topic, err: err.Error()})
+					continue
+				}
+				subs[filter] = unsubscribe
+			case grpcActionUnsubscribe:
+				if unsubscribe, ok := subs[req.topic]; ok {
+					unsubscribe()
+					delete(subs, req.topic)
+				}
+			default:
+				reply(&grpcMessage{topic: req.topic, err: "invalid action"})
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg := <-out:
+			if err := stream.SendMsg(msg); err != nil {
+				return err
+			}
+		case err := <-received:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.done:
+			return nil
+		}
+	}
+}
+
+// grpcAction is the action of a grpc stream request.
+type grpcAction uint64
+
+const (
+	grpcActionPublish grpcAction = iota
+	grpcActionSubscribe
+	grpcActionUnsubscribe
+)
+
+// grpcRequest is a Request message received on a grpc stream.
+type grpcRequest struct {
+	action  grpcAction
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+}
+
+// grpcMessage is a Message sent on a grpc stream.
+type grpcMessage struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+	err     string
+}
+
+// grpcCodec encodes and decodes the messages of the mqtt.Broker service in the protobuf
+// wire format, as described by grpc.proto.
+type grpcCodec struct{}
+
+// Name returns the name of the codec.
+func (grpcCodec) Name() string {
+	return "proto"
+}
+
+// Marshal encodes a grpc stream message.
+func (grpcCodec) Marshal(v any) ([]byte, error) {
+	var b []byte
+	switch m := v.(type) {
+	case *grpcRequest:
+		b = protowire.AppendVarint(b, 1, uint64(m.action))
+		b = protowire.AppendString(b, 2, m.topic)
+		b = protowire.AppendBytes(b, 3, m.payload)
+		b = protowire.AppendVarint(b, 4, uint64(m.qos))
+		b = protowire.AppendBool(b, 5, m.retain)
+	case *grpcMessage:
+		b = protowire.AppendString(b, 1, m.topic)
+		b = protowire.AppendBytes(b, 2, m.payload)
+		b = protowire.AppendVarint(b, 3, uint64(m.qos))
+		b = protowire.AppendBool(b, 4, m.retain)
+		b = protowire.AppendString(b, 5, m.err)
+	default:
+		return nil, fmt.Errorf("grpc codec: unsupported type %T", v)
+	}
+
+	return b, nil
+}
+
+// Unmarshal decodes a grpc stream message.
+func (grpcCodec) Unmarshal(data []byte, v any) error {
+	switch m := v.(type) {
+	case *grpcRequest:
+		return protowire.Consume(data, func(num protowire.Number, u uint64, b []byte) {
+			switch num {
+			case 1:
+				m.action = grpcAction(u)
+			case 2:
+				m.topic = string(b)
+			case 3:
+				m.payload = append([]byte{}, b...)
+			case 4:
+				m.qos = byte(u)
+			case 5:
+				m.retain = u != 0
+			}
+		})
+	case *grpcMessage:
+		return protowire.Consume(data, func(num protowire.Number, u uint64, b []byte) {
+			switch num {
+			case 1:
+				m.topic = string(b)
+			case 2:
+				m.payload = append([]byte{}, b...)
+			case 3:
+				m.qos = byte(u)
+			case 4:
+				m.retain = u != 0
+			case 5:
+				m.err = string(b)
+			}
+		})
+	default:
+		return fmt.Errorf("grpc codec: unsupported type %T", v)
+	}
+}
@@ -0,0 +1,226 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+type testGRPCBroker struct {
+	published    chan string
+	handlers     chan MessageFn
+	unsubscribed chan string
+}
+
+func newTestGRPC(t *testing.T, auth HTTPAuthFn) (*GRPC, *testGRPCBroker) {
+	b := &testGRPCBroker{
+		published:    make(chan string, 1),
+		handlers:     make(chan MessageFn, 1),
+		unsubscribed: make(chan string, 1),
+	}
+
+	l := NewGRPC(Config{ID: "t1", Address: "127.0.0.1:0"}, func(topic string, payload []byte, retain bool, qos byte) error {
+		if topic == "fail" {
+			return errors.New("test")
+		}
+		b.published <- topic + ":" + string(payload)
+		return nil
+	}, func(filter string, handler MessageFn) (func(), error) {
+		b.handlers <- handler
+		return func() {
+			b.unsubscribed <- filter
+		}, nil
+	}, auth)
+
+	require.NoError(t, l.Init(logger))
+	go l.Serve(MockEstablisher)
+	return l, b
+}
+
+func newTestGRPCStream(t *testing.T, l *GRPC, md ...string) (grpc.ClientStream, func()) {
+	conn, err := grpc.NewClient(l.Address(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(grpcCodec{})),
+	)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx = metadata.AppendToOutgoingContext(ctx, md...)
+	stream, err := conn.NewStream(ctx, &grpcServiceDesc.Streams[0], "/mqtt.Broker/Stream")
+	require.NoError(t, err)
+
+	return stream, func() {
+		cancel()
+		_ = conn.Close()
+	}
+}
+
+func TestNewGRPC(t *testing.T) {
+	l := NewGRPC(basicConfig, nil, nil, nil)
+	require.Equal(t, "t1", l.id)
+	require.Equal(t, testAddr, l.address)
+	require.Equal(t, "t1", l.ID())
+	require.Equal(t, testAddr, l.Address())
+	require.Equal(t, "grpc", l.Protocol())
+}
+
+func TestGRPCInitTLS(t *testing.T) {
+	l := NewGRPC(Config{ID: "t1", Address: "127.0.0.1:0", TLSConfig: tlsConfigBasic}, nil, nil, nil)
+	require.NoError(t, l.Init(logger))
+	l.Close(MockCloser)
+}
+
+func TestGRPCInitBadAddress(t *testing.T) {
+	l := NewGRPC(Config{ID: "t1", Address: "bad_address"}, nil, nil, nil)
+	require.Error(t, l.Init(logger))
+}
+
+func TestGRPCServeAndClose(t *testing.T) {
+	l, _ := newTestGRPC(t, nil)
+
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+
+	require.True(t, closed)
+	l.Close(MockCloser) // coverage: close twice
+}
+
+func TestGRPCCodec(t *testing.T) {
+	c := grpcCodec{}
+	require.Equal(t, "proto", c.Name())
+
+	req := &grpcRequest{action: grpcActionSubscribe, topic: "a/b", payload: []byte("hello"), qos: 1, retain: true}
+	b, err := c.Marshal(req)
+	require.NoError(t, err)
+	got := new(grpcRequest)
+	require.NoError(t, c.Unmarshal(b, got))
+	require.Equal(t, req, got)
+
+	msg := &grpcMessage{topic: "a/b", payload: []byte("hello"), qos: 2, retain: true, err: "test"}
+	b, err = c.Marshal(msg)
+	require.NoError(t, err)
+	gotMsg := new(grpcMessage)
+	require.NoError(t, c.Unmarshal(b, gotMsg))
+	require.Equal(t, msg, gotMsg)
+
+	b, err = c.Marshal(&grpcRequest{})
+	require.NoError(t, err)
+	require.Empty(t, b)
+}
+
+func TestGRPCCodecUnknownFields(t *testing.T) {
+	got := new(grpcRequest)
+	// topic "a", then an unknown fixed32 field 9, then action 2
+	require.NoError(t, grpcCodec{}.Unmarshal([]byte{0x12, 0x01, 'a', 0x4d, 1, 2, 3, 4, 0x08, 0x02}, got))
+	require.Equal(t, "a", got.topic)
+	require.Equal(t, grpcActionUnsubscribe, got.action)
+}
+
+func TestGRPCCodecErrors(t *testing.T) {
+	_, err := grpcCodec{}.Marshal("bad")
+	require.Error(t, err)
+	require.Error(t, grpcCodec{}.Unmarshal(nil, "bad"))
+	require.Error(t, grpcCodec{}.Unmarshal([]byte{0x12, 0x05, 'a'}, new(grpcRequest)))
+	require.Error(t, grpcCodec{}.Unmarshal([]byte{0x08}, new(grpcMessage)))
+}
+
+func TestGRPCStreamPublish(t *testing.T) {
+	l, b := newTestGRPC(t, nil)
+	defer l.Close(MockCloser)
+
+	stream, done := newTestGRPCStream(t, l)
+	defer done()
+
+	require.NoError(t, stream.SendMsg(&grpcRequest{action: grpcActionPublish, topic: "a/b", payload: []byte("hello")}))
+	require.Equal(t, "a/b:hello", <-b.published)
+
+	require.NoError(t, stream.SendMsg(&grpcRequest{action: grpcActionPublish, topic: "a/#"}))
+	msg := new(grpcMessage)
+	require.NoError(t, stream.RecvMsg(msg))
+	require.Equal(t, "a/#", msg.topic)
+	require.Equal(t, "invalid publish", msg.err)
+
+	require.NoError(t, stream.SendMsg(&grpcRequest{action: grpcActionPublish, topic: "fail"}))
+	msg = new(grpcMessage)
+	require.NoError(t, stream.RecvMsg(msg))
+	require.Equal(t, "test", msg.err)
+
+	require.NoError(t, stream.SendMsg(&grpcRequest{action: 9, topic: "a/b"}))
+	msg = new(grpcMessage)
+	require.NoError(t, stream.RecvMsg(msg))
+	require.Equal(t, "invalid action", msg.err)
+}
+
+func TestGRPCStreamSubscribe(t *testing.T) {
+	l, b := newTestGRPC(t, nil)
+	defer l.Close(MockCloser)
+
+	stream, done := newTestGRPCStream(t, l)
+	defer done()
+
+	require.NoError(t, stream.SendMsg(&grpcRequest{action: grpcActionSubscribe, topic: "a/#"}))
+	handler := <-b.handlers
+	handler("a/b", []byte("hello"), true, 1)
+
+	msg := new(grpcMessage)
+	require.NoError(t, stream.RecvMsg(msg))
+	require.Equal(t, &grpcMessage{topic: "a/b", payload: []byte("hello"), qos: 1, retain: true}, msg)
+
+	require.NoError(t, stream.SendMsg(&grpcRequest{action: grpcActionUnsubscribe, topic: "a/#"}))
+	require.Equal(t, "a/#", <-b.unsubscribed)
+}
+
+func TestGRPCStreamUnsubscribeOnClose(t *testing.T) {
+	l, b := newTestGRPC(t, nil)
+	defer l.Close(MockCloser)
+
+	stream, done := newTestGRPCStream(t, l)
+	defer done()
+
+	require.NoError(t, stream.SendMsg(&grpcRequest{action: grpcActionSubscribe, topic: "a/#"}))
+	<-b.handlers
+
+	require.NoError(t, stream.CloseSend())
+	require.Equal(t, "a/#", <-b.unsubscribed)
+}
+
+func TestGRPCStreamUnauthorized(t *testing.T) {
+	var gotRemote string
+	l, b := newTestGRPC(t, func(listener, remote string, username, password []byte, topic string, write bool) bool {
+		gotRemote = remote
+		return string(username) == "mochi" && string(password) == "pass" && !write
+	})
+	defer l.Close(MockCloser)
+
+	stream, done := newTestGRPCStream(t, l, "username", "mochi", "password", "pass")
+	defer done()
+
+	require.NoError(t, stream.SendMsg(&grpcRequest{action: grpcActionPublish, topic: "a/b"}))
+	msg := new(grpcMessage)
+	require.NoError(t, stream.RecvMsg(msg))
+	require.Equal(t, "not authorized", msg.err)
+	require.NotEmpty(t, gotRemote)
+
+	require.NoError(t, stream.SendMsg(&grpcRequest{action: grpcActionSubscribe, topic: "a/#"}))
+	require.NotNil(t, <-b.handlers)
+
+	other, done2 := newTestGRPCStream(t, l, "username", "other")
+	defer done2()
+
+	require.NoError(t, other.SendMsg(&grpcRequest{action: grpcActionSubscribe, topic: "a/#"}))
+	msg = new(grpcMessage)
+	require.NoError(t, other.RecvMsg(msg))
+	require.Equal(t, "not authorized", msg.err)
+}
@@ -15,6 +15,9 @@ import (
 
 const TypeHealthCheck = "healthcheck"
 
+// HealthFn is a callback function which returns an error if the broker is not ready to serve clients.
+type HealthFn func() error
+
 // HTTPHealthCheck is a listener for providing an HTTP healthcheck endpoint.
 type HTTPHealthCheck struct {
 	sync.RWMutex
@@ -22,6 +25,7 @@ type HTTPHealthCheck struct {
 	address string       // the network address to bind to
 	config  Config       // configuration values for the listener
 	listen  *http.Server // the http server
+	health  HealthFn     // checks the readiness of the broker, if set
 	end     uint32       // ensure the close methods are only called once
 }
 
@@ -34,6 +38,14 @@ func NewHTTPHealthCheck(config Config) *HTTPHealthCheck {
 	}
 }
 
+// NewHTTPReadinessCheck initializes and returns a new HTTP healthcheck listener which also
+// serves a /readiness endpoint, responding 503 Service Unavailable when health returns an error.
+func NewHTTPReadinessCheck(config Config, health HealthFn) *HTTPHealthCheck {
+	l := NewHTTPHealthCheck(config)
+	l.health = health
+	return l
+}
+
 // ID returns the id of the listener.
 func (l *HTTPHealthCheck) ID() string {
 	return l.id
@@ -55,12 +67,17 @@ func (l *HTTPHealthCheck) Protocol() string {
 
 // Init initializes the listener.
 func (l *HTTPHealthCheck) Init(_ *slog.Logger) error {
+	if err := l.config.ValidateTLS(); err != nil {
+		return err
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthcheck", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 		}
 	})
+	mux.HandleFunc("/readiness", l.readinessHandler)
 	l.listen = &http.Server{
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 5 * time.Second,
@@ -68,8 +85,8 @@ func (l *HTTPHealthCheck) Init(_ *slog.Logger) error {
 		Handler:      mux,
 	}
 
-	if l.config.TLSConfig != nil {
-		l.listen.TLSConfig = l.config.TLSConfig
+	if tc := l.config.ServerTLSConfig(); tc != nil {
+		l.listen.TLSConfig = tc
 	}
 
 	return nil
@@ -97,3 +114,21 @@ func (l *HTTPHealthCheck) Close(closeClients CloseFn) {
 
 	closeClients(l.id)
 }
+
+// readinessHandler is an HTTP handler which responds 503 Service Unavailable if the
+// broker is not ready, such as when a storage or auth backend is unreachable.
+func (l *HTTPHealthCheck) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if l.health != nil {
+		if err := l.health(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -5,8 +5,10 @@
 package listeners
 
 import (
+	"errors"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -135,3 +137,44 @@ func TestHTTPHealthCheckServeTLSAndClose(t *testing.T) {
 	time.Sleep(time.Millisecond)
 	l.Close(MockCloser)
 }
+
+func TestNewHTTPReadinessCheck(t *testing.T) {
+	l := NewHTTPReadinessCheck(basicConfig, func() error { return nil })
+	require.Equal(t, basicConfig.ID, l.ID())
+	require.NotNil(t, l.health)
+}
+
+func TestHTTPHealthCheckReadiness(t *testing.T) {
+	var unhealthy error
+	l := NewHTTPReadinessCheck(basicConfig, func() error { return unhealthy })
+	err := l.Init(logger)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	l.listen.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readiness", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	unhealthy = errors.New("storage: unreachable")
+	w = httptest.NewRecorder()
+	l.listen.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readiness", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Contains(t, w.Body.String(), "storage: unreachable")
+
+	w = httptest.NewRecorder()
+	l.listen.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthcheck", nil))
+	require.Equal(t, http.StatusOK, w.Code) // liveness is not affected by readiness
+
+	w = httptest.NewRecorder()
+	l.listen.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/readiness", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestHTTPHealthCheckReadinessNoHealthFn(t *testing.T) {
+	l := NewHTTPHealthCheck(basicConfig)
+	err := l.Init(logger)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	l.listen.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readiness", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+}
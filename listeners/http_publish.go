@@ -0,0 +1,202 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const TypeHTTPPublish = "http_publish"
+
+// maxHTTPPublishSize is the largest request body accepted by the publish endpoint,
+// matching the maximum payload size of an mqtt publish packet.
+const maxHTTPPublishSize = 268435455
+
+// PublishFn is a callback function for publishing a message into the broker.
+type PublishFn func(topic string, payload []byte, retain bool, qos byte) error
+
+// HTTPAuthFn is a callback function for authenticating the credentials of an http request
+// and checking if the request may read (subscribe) or write (publish) to a topic.
+type HTTPAuthFn func(listener, remote string, username, password []byte, topic string, write bool) bool
+
+// HTTPPublish is a listener for publishing messages into the broker using http requests,
+// in the form of POST /publish/{topic}?qos=1&retain=true.
+type HTTPPublish struct {
+	sync.RWMutex
+	id      string       // the internal id of the listener
+	address string       // the network address to bind to
+	config  Config       // configuration values for the listener
+	listen  *http.Server // the http server
+	publish PublishFn    // publishes messages into the broker
+	auth    HTTPAuthFn   // checks the request credentials, if set
+	log     *slog.Logger // server logger
+	end     uint32       // ensure the close methods are only called once
+}
+
+// NewHTTPPublish initializes and returns a new HTTP publish listener, listening on an address.
+// If auth is nil, requests are not authenticated.
+func NewHTTPPublish(config Config, publish PublishFn, auth HTTPAuthFn) *HTTPPublish {
+	return &HTTPPublish{
+		id:      config.ID,
+		address: config.Address,
+		config:  config,
+		publish: publish,
+		auth:    auth,
+	}
+}
+
+// ID returns the id of the listener.
+func (l *HTTPPublish) ID() string {
+	return l.id
+}
+
+// Address returns the address of the listener.
+func (l *HTTPPublish) Address() string {
+	return l.address
+}
+
+// Protocol returns the address of the listener.
+func (l *HTTPPublish) Protocol() string {
+	if l.listen != nil && l.listen.TLSConfig != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// Init initializes the listener.
+func (l *HTTPPublish) Init(log *slog.Logger) error {
+	l.log = log
+
+	if err := l.config.ValidateTLS(); err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/publish/{topic...}", l.publishHandler)
+	l.listen = &http.Server{
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		Addr:         l.address,
+		Handler:      mux,
+	}
+
+	if tc := l.config.ServerTLSConfig(); tc != nil {
+		l.listen.TLSConfig = tc
+	}
+
+	return nil
+}
+
+// Serve starts listening for new connections and serving responses.
+func (l *HTTPPublish) Serve(establish EstablishFn) {
+	var err error
+	if l.listen.TLSConfig != nil {
+		err = l.listen.ListenAndServeTLS("", "")
+	} else {
+		err = l.listen.ListenAndServe()
+	}
+
+	// After the listener has been shutdown, no need to print the http.ErrServerClosed error.
+	if err != nil && atomic.LoadUint32(&l.end) == 0 {
+		l.log.Error("failed to serve.", "error", err, "listener", l.id)
+	}
+}
+
+// Close closes the listener and any client connections.
+func (l *HTTPPublish) Close(closeClients CloseFn) {
+	l.Lock()
+	defer l.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = l.listen.Shutdown(ctx)
+	}
+
+	closeClients(l.id)
+}
+
+// publishHandler is an HTTP handler which publishes the request body to the topic in the request path.
+func (l *HTTPPublish) publishHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	topic := r.PathValue("topic")
+	if !isValidPublishTopic(topic) {
+		http.Error(w, "invalid topic", http.StatusBadRequest)
+		return
+	}
+
+	var qos byte
+	if v := r.URL.Query().Get("qos"); v != "" {
+		q, err := strconv.ParseUint(v, 10, 8)
+		if err != nil || q > 2 {
+			http.Error(w, "invalid qos", http.StatusBadRequest)
+			return
+		}
+		qos = byte(q)
+	}
+
+	var retain bool
+	if v := r.URL.Query().Get("retain"); v != "" {
+		var err error
+		retain, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "invalid retain", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !authorizeRequest(w, r, l.auth, l.id, topic, true) {
+		return
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxHTTPPublishSize))
+	if err != nil {
+		http.Error(w, "invalid payload", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err := l.publish(topic, payload, retain, qos); err != nil {
+		l.log.Warn("failed to publish http message", "error", err, "listener", l.id, "topic", topic)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// isValidPublishTopic returns true if a topic may be published to by a listener outside of
+// the mqtt protocol; wildcards and $SYS topics are not allowed.
+func isValidPublishTopic(topic string) bool {
+	return topic != "" && !strings.HasPrefix(topic, "$") && !strings.ContainsAny(topic, "+#")
+}
+
+// authorizeRequest checks the basic auth credentials of a request against the auth callback,
+// writing an error response and returning false if the request should not proceed.
+func authorizeRequest(w http.ResponseWriter, r *http.Request, auth HTTPAuthFn, id, topic string, write bool) bool {
+	if auth == nil {
+		return true
+	}
+
+	username, password, _ := r.BasicAuth()
+	if !auth(id, r.RemoteAddr, []byte(username), []byte(password), topic, write) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mqtt"`)
+		http.Error(w, "not authorized", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
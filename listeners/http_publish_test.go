@@ -0,0 +1,118 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testPublished struct {
+	topic   string
+	payload []byte
+	retain  bool
+	qos     byte
+}
+
+func newTestHTTPPublish(auth HTTPAuthFn) (*HTTPPublish, chan testPublished) {
+	out := make(chan testPublished, 1)
+	l := NewHTTPPublish(basicConfig, func(topic string, payload []byte, retain bool, qos byte) error {
+		if topic == "fail" {
+			return errors.New("test")
+		}
+		out <- testPublished{topic, payload, retain, qos}
+		return nil
+	}, auth)
+	_ = l.Init(logger)
+	return l, out
+}
+
+func TestNewHTTPPublish(t *testing.T) {
+	l := NewHTTPPublish(basicConfig, nil, nil)
+	require.Equal(t, "t1", l.id)
+	require.Equal(t, testAddr, l.address)
+	require.Equal(t, "t1", l.ID())
+	require.Equal(t, testAddr, l.Address())
+	require.Equal(t, "http", l.Protocol())
+}
+
+func TestHTTPPublishTLSProtocol(t *testing.T) {
+	l := NewHTTPPublish(tlsConfig, nil, nil)
+	_ = l.Init(logger)
+	require.Equal(t, "https", l.Protocol())
+}
+
+func TestHTTPPublishServeAndClose(t *testing.T) {
+	l, out := newTestHTTPPublish(nil)
+
+	o := make(chan bool)
+	go func(o chan bool) {
+		l.Serve(MockEstablisher)
+		o <- true
+	}(o)
+
+	time.Sleep(time.Millisecond)
+
+	resp, err := http.Post("http://localhost"+testAddr+"/publish/a/b/c?qos=1&retain=true", "text/plain", strings.NewReader("hello"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	_ = resp.Body.Close()
+	require.Equal(t, testPublished{"a/b/c", []byte("hello"), true, 1}, <-out)
+
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+
+	require.True(t, closed)
+	<-o
+}
+
+func TestHTTPPublishHandlerErrors(t *testing.T) {
+	l, _ := newTestHTTPPublish(nil)
+
+	tt := []struct {
+		method string
+		url    string
+		code   int
+	}{
+		{http.MethodGet, "/publish/a/b", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/publish/a/+", http.StatusBadRequest},
+		{http.MethodPost, "/publish/$SYS/a", http.StatusBadRequest},
+		{http.MethodPost, "/publish/a?qos=3", http.StatusBadRequest},
+		{http.MethodPost, "/publish/a?retain=maybe", http.StatusBadRequest},
+		{http.MethodPost, "/publish/fail", http.StatusInternalServerError},
+	}
+
+	for _, tx := range tt {
+		w := httptest.NewRecorder()
+		l.listen.Handler.ServeHTTP(w, httptest.NewRequest(tx.method, tx.url, strings.NewReader("x")))
+		require.Equal(t, tx.code, w.Code, tx.url)
+	}
+}
+
+func TestHTTPPublishAuth(t *testing.T) {
+	l, out := newTestHTTPPublish(func(listener, remote string, username, password []byte, topic string, write bool) bool {
+		return listener == "t1" && string(username) == "mochi" && string(password) == "pass" && topic == "a/b" && write
+	})
+
+	w := httptest.NewRecorder()
+	l.listen.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/publish/a/b", strings.NewReader("x")))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+
+	r := httptest.NewRequest(http.MethodPost, "/publish/a/b", strings.NewReader("x"))
+	r.SetBasicAuth("mochi", "pass")
+	w = httptest.NewRecorder()
+	l.listen.Handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusNoContent, w.Code)
+	require.Equal(t, "a/b", (<-out).topic)
+}
@@ -0,0 +1,205 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const TypeSSE = "sse"
+
+const (
+	sseBufferSize        = 256              // the number of messages buffered for each event stream
+	sseKeepaliveInterval = 15 * time.Second // the interval between keepalive comments on idle streams
+)
+
+// MessageFn is a callback function which receives messages matching a subscription.
+type MessageFn func(topic string, payload []byte, retain bool, qos byte)
+
+// SubscribeFn is a callback function for subscribing to a topic filter in the broker.
+// It returns a function which removes the subscription.
+type SubscribeFn func(filter string, handler MessageFn) (unsubscribe func(), err error)
+
+// SSEMessage is a message delivered to an event stream.
+type SSEMessage struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	Qos     byte   `json:"qos"`
+	Retain  bool   `json:"retain"`
+}
+
+// SSE is a listener for streaming messages to http clients as server-sent events,
+// using GET /subscribe?filter=a/%23.
+type SSE struct {
+	sync.RWMutex
+	id        string        // the internal id of the listener
+	address   string        // the network address to bind to
+	config    Config        // configuration values for the listener
+	listen    *http.Server  // the http server
+	subscribe SubscribeFn   // subscribes to filters in the broker
+	auth      HTTPAuthFn    // checks the request credentials, if set
+	log       *slog.Logger  // server logger
+	done      chan struct{} // closed when the listener is closing, ending all streams
+	end       uint32        // ensure the close methods are only called once
+}
+
+// NewSSE initializes and returns a new server-sent events listener, listening on an address.
+// If auth is nil, requests are not authenticated.
+func NewSSE(config Config, subscribe SubscribeFn, auth HTTPAuthFn) *SSE {
+	return &SSE{
+		id:        config.ID,
+		address:   config.Address,
+		config:    config,
+		subscribe: subscribe,
+		auth:      auth,
+		done:      make(chan struct{}),
+	}
+}
+
+// ID returns the id of the listener.
+func (l *SSE) ID() string {
+	return l.id
+}
+
+// Address returns the address of the listener.
+func (l *SSE) Address() string {
+	return l.address
+}
+
+// Protocol returns the address of the listener.
+func (l *SSE) Protocol() string {
+	if l.listen != nil && l.listen.TLSConfig != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// Init initializes the listener.
+func (l *SSE) Init(log *slog.Logger) error {
+	l.log = log
+
+	if err := l.config.ValidateTLS(); err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/subscribe", l.subscribeHandler)
+	l.listen = &http.Server{
+		ReadTimeout: 5 * time.Second, // no write timeout, as event streams are long-lived
+		Addr:        l.address,
+		Handler:     mux,
+	}
+
+	if tc := l.config.ServerTLSConfig(); tc != nil {
+		l.listen.TLSConfig = tc
+	}
+
+	return nil
+}
+
+// Serve starts listening for new connections and serving responses.
+func (l *SSE) Serve(establish EstablishFn) {
+	var err error
+	if l.listen.TLSConfig != nil {
+		err = l.listen.ListenAndServeTLS("", "")
+	} else {
+		err = l.listen.ListenAndServe()
+	}
+
+	// After the listener has been shutdown, no need to print the http.ErrServerClosed error.
+	if err != nil && atomic.LoadUint32(&l.end) == 0 {
+		l.log.Error("failed to serve.", "error", err, "listener", l.id)
+	}
+}
+
+// Close closes the listener and any client connections.
+func (l *SSE) Close(closeClients CloseFn) {
+	l.Lock()
+	defer l.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		close(l.done)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = l.listen.Shutdown(ctx)
+	}
+
+	closeClients(l.id)
+}
+
+// subscribeHandler is an HTTP handler which streams messages matching the filter in
+// the request query as server-sent events, until the client disconnects.
+func (l *SSE) subscribeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	filter := r.URL.Query().Get("filter")
+	if filter == "" {
+		http.Error(w, "invalid filter", http.StatusBadRequest)
+		return
+	}
+
+	if !authorizeRequest(w, r, l.auth, l.id, filter, false) {
+		return
+	}
+
+	messages := make(chan SSEMessage, sseBufferSize)
+	unsubscribe, err := l.subscribe(filter, func(topic string, payload []byte, retain bool, qos byte) {
+		select {
+		case messages <- SSEMessage{Topic: topic, Payload: string(payload), Qos: qos, Retain: retain}:
+		default: // drop messages for slow streams rather than blocking the broker
+			l.log.Debug("dropped event stream message", "listener", l.id, "filter", filter, "topic", topic)
+		}
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(sseKeepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case msg := <-messages:
+			data, _ := json.Marshal(msg)
+			if _, err := fmt.Fprintf(w, "event: message\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-l.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testSSEBroker struct {
+	handlers     chan MessageFn
+	unsubscribed chan string
+}
+
+func newTestSSE(auth HTTPAuthFn) (*SSE, *testSSEBroker) {
+	b := &testSSEBroker{
+		handlers:     make(chan MessageFn, 1),
+		unsubscribed: make(chan string, 1),
+	}
+
+	l := NewSSE(basicConfig, func(filter string, handler MessageFn) (func(), error) {
+		if filter == "fail" {
+			return nil, errors.New("test")
+		}
+		b.handlers <- handler
+		return func() {
+			b.unsubscribed <- filter
+		}, nil
+	}, auth)
+	_ = l.Init(logger)
+	return l, b
+}
+
+func TestNewSSE(t *testing.T) {
+	l := NewSSE(basicConfig, nil, nil)
+	require.Equal(t, "t1", l.id)
+	require.Equal(t, testAddr, l.address)
+	require.Equal(t, "t1", l.ID())
+	require.Equal(t, testAddr, l.Address())
+	require.Equal(t, "http", l.Protocol())
+}
+
+func TestSSETLSProtocol(t *testing.T) {
+	l := NewSSE(tlsConfig, nil, nil)
+	_ = l.Init(logger)
+	require.Equal(t, "https", l.Protocol())
+}
+
+func TestSSEServeAndClose(t *testing.T) {
+	l, _ := newTestSSE(nil)
+
+	o := make(chan bool)
+	go func(o chan bool) {
+		l.Serve(MockEstablisher)
+		o <- true
+	}(o)
+
+	time.Sleep(time.Millisecond)
+
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+
+	require.True(t, closed)
+	<-o
+
+	select {
+	case <-l.done:
+	default:
+		t.Fatal("expected done to be closed")
+	}
+}
+
+func TestSSEHandlerErrors(t *testing.T) {
+	l, _ := newTestSSE(nil)
+
+	tt := []struct {
+		desc   string
+		method string
+		target string
+		code   int
+	}{
+		{desc: "method", method: http.MethodPost, target: "/subscribe?filter=a/b", code: http.StatusMethodNotAllowed},
+		{desc: "no filter", method: http.MethodGet, target: "/subscribe", code: http.StatusBadRequest},
+		{desc: "subscribe error", method: http.MethodGet, target: "/subscribe?filter=fail", code: http.StatusBadRequest},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			l.listen.Handler.ServeHTTP(w, httptest.NewRequest(tx.method, tx.target, nil))
+			require.Equal(t, tx.code, w.Code)
+		})
+	}
+}
+
+func TestSSEHandlerUnauthorized(t *testing.T) {
+	var gotFilter string
+	var gotWrite bool
+	l, _ := newTestSSE(func(listener, remote string, username, password []byte, topic string, write bool) bool {
+		gotFilter, gotWrite = topic, write
+		return string(username) == "mochi"
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/subscribe?filter=a/%23", nil)
+	r.SetBasicAuth("other", "pass")
+	l.listen.Handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+	require.Equal(t, "a/#", gotFilter)
+	require.False(t, gotWrite)
+}
+
+func TestSSEHandlerStream(t *testing.T) {
+	l, b := newTestSSE(nil)
+	srv := httptest.NewServer(l.listen.Handler)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/subscribe?filter=a/%23")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	handler := <-b.handlers
+	handler("a/b", []byte("hello"), true, 1)
+
+	rd := bufio.NewReader(resp.Body)
+	line, err := rd.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "event: message\n", line)
+
+	line, err = rd.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, `data: {"topic":"a/b","payload":"hello","qos":1,"retain":true}`, strings.TrimSpace(line))
+
+	l.Close(MockCloser)
+	require.Equal(t, "a/#", <-b.unsubscribed)
+}
@@ -62,6 +62,10 @@ func (l *HTTPStats) Protocol() string {
 
 // Init initializes the listener.
 func (l *HTTPStats) Init(log *slog.Logger) error {
+	if err := l.config.ValidateTLS(); err != nil {
+		return err
+	}
+
 	l.log = log
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", l.jsonHandler)
@@ -72,8 +76,8 @@ func (l *HTTPStats) Init(log *slog.Logger) error {
 		Handler:      mux,
 	}
 
-	if l.config.TLSConfig != nil {
-		l.listen.TLSConfig = l.config.TLSConfig
+	if tc := l.config.ServerTLSConfig(); tc != nil {
+		l.listen.TLSConfig = tc
 	}
 
 	return nil
@@ -0,0 +1,127 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ErrInvalidCIDR indicates an entry in the allow or deny list of a listener is not a valid cidr or ip address.
+var ErrInvalidCIDR = errors.New("invalid cidr")
+
+// ipFilter drops connections from remote addresses according to the allow and deny lists of a listener.
+type ipFilter struct {
+	allow []netip.Prefix // if not empty, only addresses within these prefixes are allowed
+	deny  []netip.Prefix // addresses within these prefixes are denied
+}
+
+// newIPFilter returns an ip filter for the allow and deny lists in a listener config,
+// or nil if neither list is set.
+func newIPFilter(config Config) (*ipFilter, error) {
+	if len(config.AllowCIDRs) == 0 && len(config.DenyCIDRs) == 0 {
+		return nil, nil
+	}
+
+	allow, err := parsePrefixes(config.AllowCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	deny, err := parsePrefixes(config.DenyCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ipFilter{allow: allow, deny: deny}, nil
+}
+
+// parsePrefixes parses a list of cidrs, treating plain ip addresses as single address prefixes.
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrInvalidCIDR, cidr)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidCIDR, cidr)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// allowed returns true if connections from a remote address are allowed. Addresses
+// within the deny list are always denied, and if an allow list is set, any addresses
+// outside of it are denied. Remote addresses which are not ip addresses are denied.
+func (f *ipFilter) allowed(remote string) bool {
+	if f == nil {
+		return true
+	}
+
+	var addr netip.Addr
+	if ap, err := netip.ParseAddrPort(remote); err == nil {
+		addr = ap.Addr()
+	} else if addr, err = netip.ParseAddr(remote); err != nil {
+		return false
+	}
+
+	addr = addr.Unmap().WithZone("")
+	for _, p := range f.deny {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+
+	if len(f.allow) == 0 {
+		return true
+	}
+
+	for _, p := range f.allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filteredListener is a net.Listener which closes connections from remote addresses
+// denied by an ip filter as soon as they are accepted.
+type filteredListener struct {
+	net.Listener
+	filter *ipFilter
+	log    *slog.Logger
+}
+
+// Accept waits for and returns the next allowed connection to the listener.
+func (l *filteredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if l.filter.allowed(conn.RemoteAddr().String()) {
+			return conn, nil
+		}
+
+		l.log.Debug("connection denied by ip filter", "remote", conn.RemoteAddr())
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,142 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewIPFilterNone(t *testing.T) {
+	f, err := newIPFilter(basicConfig)
+	require.NoError(t, err)
+	require.Nil(t, f)
+	require.True(t, f.allowed("10.0.0.1:1883"))
+}
+
+func TestNewIPFilterInvalid(t *testing.T) {
+	_, err := newIPFilter(Config{AllowCIDRs: []string{"10.0.0.0/33"}})
+	require.ErrorIs(t, err, ErrInvalidCIDR)
+
+	_, err = newIPFilter(Config{DenyCIDRs: []string{"mochi"}})
+	require.ErrorIs(t, err, ErrInvalidCIDR)
+}
+
+func TestIPFilterAllowed(t *testing.T) {
+	f, err := newIPFilter(Config{
+		AllowCIDRs: []string{"10.0.0.0/8", "192.168.1.10", "2001:db8::/32"},
+		DenyCIDRs:  []string{"10.1.0.0/16", " 10.2.3.4 "},
+	})
+	require.NoError(t, err)
+
+	tt := []struct {
+		remote  string
+		allowed bool
+	}{
+		{remote: "10.0.0.1:1883", allowed: true},
+		{remote: "10.1.2.3:1883", allowed: false},
+		{remote: "10.2.3.4:1883", allowed: false},
+		{remote: "10.2.3.5:1883", allowed: true},
+		{remote: "192.168.1.10:1883", allowed: true},
+		{remote: "192.168.1.11:1883", allowed: false},
+		{remote: "[::ffff:10.0.0.1]:1883", allowed: true},
+		{remote: "[2001:db8::1]:1883", allowed: true},
+		{remote: "[2001:db9::1]:1883", allowed: false},
+		{remote: "10.0.0.1", allowed: true},
+		{remote: "@", allowed: false},
+	}
+
+	for _, tx := range tt {
+		require.Equal(t, tx.allowed, f.allowed(tx.remote), tx.remote)
+	}
+}
+
+func TestIPFilterDenyOnly(t *testing.T) {
+	f, err := newIPFilter(Config{DenyCIDRs: []string{"127.0.0.0/8"}})
+	require.NoError(t, err)
+	require.False(t, f.allowed("127.0.0.1:1883"))
+	require.True(t, f.allowed("10.0.0.1:1883"))
+}
+
+func TestTCPInitInvalidCIDR(t *testing.T) {
+	l := NewTCP(Config{ID: "t1", Address: "127.0.0.1:0", DenyCIDRs: []string{"x"}})
+	require.ErrorIs(t, l.Init(logger), ErrInvalidCIDR)
+}
+
+func TestTCPServeDenied(t *testing.T) {
+	l := NewTCP(Config{ID: "t1", Address: "127.0.0.1:0", DenyCIDRs: []string{"127.0.0.0/8"}})
+	require.NoError(t, l.Init(logger))
+	defer l.Close(MockCloser)
+
+	established := make(chan bool, 1)
+	go l.Serve(func(id string, c net.Conn) error {
+		established <- true
+		return nil
+	})
+
+	conn, err := net.Dial("tcp", l.Address())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+	require.Empty(t, established)
+}
+
+func TestTCPServeAllowed(t *testing.T) {
+	l := NewTCP(Config{ID: "t1", Address: "127.0.0.1:0", AllowCIDRs: []string{"127.0.0.1"}})
+	require.NoError(t, l.Init(logger))
+	defer l.Close(MockCloser)
+
+	established := make(chan bool, 1)
+	go l.Serve(func(id string, c net.Conn) error {
+		established <- true
+		return nil
+	})
+
+	conn, err := net.Dial("tcp", l.Address())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.True(t, <-established)
+}
+
+func TestWebsocketServeDenied(t *testing.T) {
+	l := NewWebsocket(Config{ID: "t1", Address: "127.0.0.1:22223", AllowCIDRs: []string{"10.0.0.0/8"}})
+	require.NoError(t, l.Init(logger))
+	go l.Serve(MockEstablisher)
+	defer l.Close(MockCloser)
+	time.Sleep(10 * time.Millisecond)
+
+	d := websocket.Dialer{Subprotocols: []string{"mqtt"}}
+	_, resp, err := d.Dial("ws://127.0.0.1:22223", nil)
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestMQTTSNServeDenied(t *testing.T) {
+	l := NewMQTTSN(Config{ID: "t1", Address: "127.0.0.1:0", DenyCIDRs: []string{"127.0.0.1"}}, nil, nil, nil)
+	require.NoError(t, l.Init(logger))
+	go l.Serve(MockEstablisher)
+	defer l.Close(MockCloser)
+
+	conn, err := net.Dial("udp", l.Address())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write(encodeSNPacket(snPingreq, nil))
+	require.NoError(t, err)
+
+	_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 16))
+	require.Error(t, err)
+}
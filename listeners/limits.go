@@ -0,0 +1,96 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// connectionLimiter enforces the maximum number of concurrent connections and
+// the rate at which new connections are accepted by a listener.
+type connectionLimiter struct {
+	sync.Mutex
+	active int64     // the number of connections currently open
+	max    int64     // the maximum number of open connections, unlimited if 0
+	rate   float64   // the number of connections accepted per second, unlimited if 0
+	burst  float64   // the number of connections which may be accepted at once
+	tokens float64   // the number of connections which may currently be accepted
+	last   time.Time // the time the tokens were last replenished
+}
+
+// newConnectionLimiter returns a connection limiter for the limits in a listener config.
+func newConnectionLimiter(config Config) *connectionLimiter {
+	burst := math.Max(1, math.Ceil(config.AcceptRate))
+	return &connectionLimiter{
+		max:    config.MaxConnections,
+		rate:   config.AcceptRate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// replenish adds any tokens which have accrued since the last replenish. Must be called under lock.
+func (c *connectionLimiter) replenish(now time.Time) {
+	c.tokens = math.Min(c.burst, c.tokens+now.Sub(c.last).Seconds()*c.rate)
+	c.last = now
+}
+
+// delay reserves the next connection from the accept rate, returning how long the
+// accept loop should wait before accepting it.
+func (c *connectionLimiter) delay() time.Duration {
+	if c.rate <= 0 {
+		return 0
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.replenish(time.Now())
+	c.tokens--
+	if c.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-c.tokens / c.rate * float64(time.Second))
+}
+
+// allow returns true if a connection may be accepted now without exceeding the accept rate.
+func (c *connectionLimiter) allow() bool {
+	if c.rate <= 0 {
+		return true
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.replenish(time.Now())
+	if c.tokens < 1 {
+		return false
+	}
+
+	c.tokens--
+	return true
+}
+
+// acquire returns true and counts the connection as open if the maximum number
+// of connections has not been reached.
+func (c *connectionLimiter) acquire() bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.max > 0 && c.active >= c.max {
+		return false
+	}
+
+	c.active++
+	return true
+}
+
+// release counts a connection previously acquired as closed.
+func (c *connectionLimiter) release() {
+	c.Lock()
+	defer c.Unlock()
+	c.active--
+}
@@ -0,0 +1,53 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectionLimiterUnlimited(t *testing.T) {
+	c := newConnectionLimiter(basicConfig)
+	for i := 0; i < 100; i++ {
+		require.True(t, c.acquire())
+		require.True(t, c.allow())
+		require.Equal(t, time.Duration(0), c.delay())
+	}
+	require.Equal(t, int64(100), c.active)
+}
+
+func TestConnectionLimiterMaxConnections(t *testing.T) {
+	c := newConnectionLimiter(Config{MaxConnections: 2})
+	require.True(t, c.acquire())
+	require.True(t, c.acquire())
+	require.False(t, c.acquire())
+
+	c.release()
+	require.True(t, c.acquire())
+}
+
+func TestConnectionLimiterAllow(t *testing.T) {
+	c := newConnectionLimiter(Config{AcceptRate: 2})
+	require.Equal(t, float64(2), c.burst)
+	require.True(t, c.allow())
+	require.True(t, c.allow())
+	require.False(t, c.allow())
+
+	c.last = c.last.Add(-time.Second) // replenish the bucket
+	require.True(t, c.allow())
+}
+
+func TestConnectionLimiterDelay(t *testing.T) {
+	c := newConnectionLimiter(Config{AcceptRate: 0.5})
+	require.Equal(t, float64(1), c.burst)
+	require.Equal(t, time.Duration(0), c.delay())
+
+	d := c.delay()
+	require.Greater(t, d, time.Second)
+	require.LessOrEqual(t, d, 2*time.Second)
+}
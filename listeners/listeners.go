@@ -5,9 +5,12 @@
 package listeners
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
+	"strings"
 	"sync"
+	"time"
 
 	"log/slog"
 )
@@ -19,6 +22,163 @@ type Config struct {
 	Address string
 	// TLSConfig is a tls.Config configuration to be used with the listener. See examples folder for basic and mutual-tls use.
 	TLSConfig *tls.Config
+	// TLSCertificates is a map of certificates keyed on the server name (SNI) requested by the client,
+	// allowing a single listener to terminate tls for multiple hostnames. Keys may use a leading
+	// wildcard, e.g. *.example.com. If no certificate matches, the TLSConfig certificates are used.
+	TLSCertificates map[string]*tls.Certificate `yaml:"-" json:"-"`
+	// GetCertificate is an optional callback for selecting a certificate based on the client hello.
+	// It takes precedence over TLSCertificates, and may return nil to fall through to them.
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error) `yaml:"-" json:"-"`
+	// TLSMinVersion and TLSMaxVersion restrict the tls versions accepted by the listener, e.g. 1.2 or 1.3,
+	// overriding those of TLSConfig. Go's defaults are used if empty.
+	TLSMinVersion string `yaml:"tls_min_version" json:"tls_min_version"`
+	TLSMaxVersion string `yaml:"tls_max_version" json:"tls_max_version"`
+	// TLS13Only only accepts tls 1.3 connections.
+	TLS13Only bool `yaml:"tls13_only" json:"tls13_only"`
+	// TLSCipherSuites restricts the tls 1.0-1.2 cipher suites accepted by the listener to those named,
+	// e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Insecure cipher suites are rejected.
+	TLSCipherSuites []string `yaml:"tls_cipher_suites" json:"tls_cipher_suites"`
+	// TLSCurvePreferences sets the elliptic curves used for key exchange in order of
+	// preference, from X25519, P256, P384, and P521.
+	TLSCurvePreferences []string `yaml:"tls_curve_preferences" json:"tls_curve_preferences"`
+	// MaxConnections is the maximum number of concurrent connections accepted by a tcp, unix socket,
+	// or websocket listener, unlimited if 0. Connections over the limit are closed immediately.
+	MaxConnections int64 `yaml:"max_connections" json:"max_connections"`
+	// AcceptRate is the maximum number of new connections accepted per second by a tcp, unix socket,
+	// or websocket listener, unlimited if 0. Accept loops are paused to stay within the rate, while
+	// websocket upgrades over the rate are refused.
+	AcceptRate float64 `yaml:"accept_rate" json:"accept_rate"`
+	// TCP contains additional socket tuning configuration values for tcp listeners.
+	TCP *TCPConfig `yaml:"tcp" json:"tcp"`
+	// Websocket contains additional configuration values for websocket listeners.
+	Websocket *WebsocketConfig `yaml:"websocket" json:"websocket"`
+	// MQTTSN contains additional configuration values for mqtt-sn gateway listeners.
+	MQTTSN *MQTTSNConfig `yaml:"mqttsn" json:"mqttsn"`
+	// Revocation contains certificate revocation configuration values for tls listeners.
+	Revocation *RevocationConfig `yaml:"revocation" json:"revocation"`
+	// BindToDevice binds the sockets of a tcp, multiplex, grpc, mqtt-sn, or webtransport listener to a
+	// network interface by name using SO_BINDTODEVICE, so that only traffic arriving on the interface
+	// is served, e.g. eth1. Available on linux only.
+	BindToDevice string `yaml:"bind_to_device" json:"bind_to_device"`
+	// Interface selects the local address of a tcp, multiplex, grpc, mqtt-sn, or webtransport listener
+	// from the addresses of a network interface by name, replacing the host of Address.
+	Interface string `yaml:"interface" json:"interface"`
+	// AllowCIDRs only allows connections from remote addresses within the listed cidrs or ip addresses
+	// to a tcp, multiplex, websocket, webtransport, grpc, or mqtt-sn listener. All addresses are allowed if empty.
+	AllowCIDRs []string `yaml:"allow_cidrs" json:"allow_cidrs"`
+	// DenyCIDRs drops connections from remote addresses within the listed cidrs or ip addresses before
+	// any packets are read, taking precedence over AllowCIDRs.
+	DenyCIDRs []string `yaml:"deny_cidrs" json:"deny_cidrs"`
+}
+
+// tlsEnabled returns true if the listener has been configured to serve tls.
+func (c Config) tlsEnabled() bool {
+	return c.TLSConfig != nil || len(c.TLSCertificates) > 0 || c.GetCertificate != nil
+}
+
+// ServerTLSConfig returns the tls configuration to be used by the listener, with any
+// SNI-based certificate selection, revocation checking, and tls versions, cipher suites, and curves
+// applied. Returns nil if tls is not enabled.
+func (c Config) ServerTLSConfig() *tls.Config {
+	if !c.tlsEnabled() {
+		return nil
+	}
+
+	rc := c.Revocation
+	sni := len(c.TLSCertificates) > 0 || c.GetCertificate != nil
+	staple := rc != nil && rc.OCSPStaple
+	enforce := rc != nil && rc.Enforce
+	settings := c.hasTLSSettings()
+	if !sni && !staple && !enforce && !settings {
+		return c.TLSConfig
+	}
+
+	var tc *tls.Config
+	if c.TLSConfig != nil {
+		tc = c.TLSConfig.Clone()
+	} else {
+		tc = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	if settings {
+		c.applyTLSSettings(tc)
+	}
+
+	if sni || staple {
+		fallback := tc.GetCertificate
+		certs := tc.Certificates
+		tc.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := c.selectCertificate(hello, fallback)
+			if err != nil || !staple {
+				return cert, err
+			}
+
+			if cert == nil && len(certs) > 0 {
+				cert = &certs[0]
+			}
+
+			return rc.staple(cert), nil
+		}
+	}
+
+	if enforce {
+		verify := tc.VerifyConnection
+		tc.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verify != nil {
+				if err := verify(cs); err != nil {
+					return err
+				}
+			}
+
+			return rc.Check(cs)
+		}
+	}
+
+	return tc
+}
+
+// selectCertificate returns the certificate to present for a client hello, or nil to use
+// the tls.Config certificates.
+func (c Config) selectCertificate(hello *tls.ClientHelloInfo, fallback func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (*tls.Certificate, error) {
+	if c.GetCertificate != nil {
+		cert, err := c.GetCertificate(hello)
+		if err != nil || cert != nil {
+			return cert, err
+		}
+	}
+
+	if cert := c.certificateForName(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+
+	if fallback != nil {
+		return fallback(hello)
+	}
+
+	return nil, nil // use the tls.Config certificates
+}
+
+// certificateForName returns the certificate matching a server name, checking
+// for an exact match first, and then for a wildcard match.
+func (c Config) certificateForName(name string) *tls.Certificate {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return nil
+	}
+
+	if cert, ok := c.TLSCertificates[name]; ok {
+		return cert
+	}
+
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := c.TLSCertificates["*"+name[i:]]; ok {
+			return cert
+		}
+	}
+
+	return nil
 }
 
 // EstablishFn is a callback function for establishing new clients.
@@ -40,8 +200,9 @@ type Listener interface {
 
 // Listeners contains the network listeners for the broker.
 type Listeners struct {
-	ClientsWg sync.WaitGroup      // a waitgroup that waits for all clients in all listeners to finish.
-	internal  map[string]Listener // a map of active listeners.
+	ClientsWg sync.WaitGroup              // a waitgroup that waits for all clients in all listeners to finish.
+	internal  map[string]Listener         // a map of active listeners.
+	clients   map[string]*listenerClients // the tracked clients of each listener, keyed on listener id.
 	sync.RWMutex
 }
 
@@ -49,6 +210,7 @@ type Listeners struct {
 func New() *Listeners {
 	return &Listeners{
 		internal: map[string]Listener{},
+		clients:  map[string]*listenerClients{},
 	}
 }
 
@@ -79,6 +241,62 @@ func (l *Listeners) Delete(id string) {
 	l.Lock()
 	defer l.Unlock()
 	delete(l.internal, id)
+	delete(l.clients, id)
+}
+
+// listenerClients counts the tracked clients of a listener.
+type listenerClients struct {
+	n       int           // the number of clients which have not finished
+	drained chan struct{} // closed when n falls to 0, if a caller is waiting
+}
+
+// TrackClient registers an active client on a listener, returning a function
+// which must be called when the client has finished.
+func (l *Listeners) TrackClient(id string) (done func()) {
+	l.Lock()
+	c, ok := l.clients[id]
+	if !ok {
+		c = new(listenerClients)
+		l.clients[id] = c
+	}
+	c.n++
+	l.ClientsWg.Add(1)
+	l.Unlock()
+
+	return func() {
+		l.Lock()
+		c.n--
+		if c.n == 0 && c.drained != nil {
+			close(c.drained)
+			c.drained = nil
+		}
+		l.Unlock()
+		l.ClientsWg.Done()
+	}
+}
+
+// WaitClients blocks until all the tracked clients of a listener have finished, returning
+// the context error if ctx ends first.
+func (l *Listeners) WaitClients(ctx context.Context, id string) error {
+	l.Lock()
+	c, ok := l.clients[id]
+	if !ok || c.n == 0 {
+		l.Unlock()
+		return nil
+	}
+
+	if c.drained == nil {
+		c.drained = make(chan struct{})
+	}
+	drained := c.drained
+	l.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Serve starts a listener serving from the internal map.
@@ -117,8 +335,33 @@ func (l *Listeners) Close(id string, closer CloseFn) {
 	}
 }
 
-// CloseAll iterates and closes all registered listeners.
+// CloseAll iterates and closes all registered listeners, waiting for all clients to finish.
 func (l *Listeners) CloseAll(closer CloseFn) {
+	l.closeAll(closer)
+	l.ClientsWg.Wait()
+}
+
+// CloseAllTimeout iterates and closes all registered listeners, waiting up to timeout
+// for all clients to finish. Returns false if the clients did not finish in time.
+func (l *Listeners) CloseAllTimeout(closer CloseFn, timeout time.Duration) bool {
+	l.closeAll(closer)
+
+	done := make(chan struct{})
+	go func() {
+		l.ClientsWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// closeAll iterates and closes all registered listeners.
+func (l *Listeners) closeAll(closer CloseFn) {
 	l.RLock()
 	i := 0
 	ids := make([]string, len(l.internal))
@@ -131,5 +374,4 @@ func (l *Listeners) CloseAll(closer CloseFn) {
 	for _, id := range ids {
 		l.Close(id, closer)
 	}
-	l.ClientsWg.Wait()
 }
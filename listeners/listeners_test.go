@@ -5,6 +5,7 @@
 package listeners
 
 import (
+	"context"
 	"crypto/tls"
 	"log"
 	"os"
@@ -180,3 +181,124 @@ func TestCloseAllListeners(t *testing.T) {
 	require.True(t, closed["t2"])
 	require.True(t, closed["t3"])
 }
+
+func TestConfigServerTLSConfigDisabled(t *testing.T) {
+	require.Nil(t, basicConfig.ServerTLSConfig())
+	require.Equal(t, tlsConfigBasic, tlsConfig.ServerTLSConfig())
+}
+
+func TestConfigServerTLSConfigSNI(t *testing.T) {
+	a := &tls.Certificate{Certificate: [][]byte{[]byte("a")}}
+	b := &tls.Certificate{Certificate: [][]byte{[]byte("b")}}
+	c := Config{
+		ID:      "t1",
+		Address: testAddr,
+		TLSCertificates: map[string]*tls.Certificate{
+			"a.example.com": a,
+			"*.example.org": b,
+		},
+	}
+
+	tc := c.ServerTLSConfig()
+	require.NotNil(t, tc)
+	require.Equal(t, uint16(tls.VersionTLS12), tc.MinVersion)
+
+	cert, err := tc.GetCertificate(&tls.ClientHelloInfo{ServerName: "A.example.com"})
+	require.NoError(t, err)
+	require.Equal(t, a, cert)
+
+	cert, err = tc.GetCertificate(&tls.ClientHelloInfo{ServerName: "b.example.org"})
+	require.NoError(t, err)
+	require.Equal(t, b, cert)
+
+	cert, err = tc.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.net"})
+	require.NoError(t, err)
+	require.Nil(t, cert)
+}
+
+func TestConfigServerTLSConfigGetCertificate(t *testing.T) {
+	a := &tls.Certificate{Certificate: [][]byte{[]byte("a")}}
+	b := &tls.Certificate{Certificate: [][]byte{[]byte("b")}}
+	c := Config{
+		ID:              "t1",
+		Address:         testAddr,
+		TLSConfig:       tlsConfigBasic,
+		TLSCertificates: map[string]*tls.Certificate{"a.example.com": a},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName == "b.example.com" {
+				return b, nil
+			}
+			return nil, nil
+		},
+	}
+
+	tc := c.ServerTLSConfig()
+	require.NotSame(t, tlsConfigBasic, tc)
+	require.Equal(t, tlsConfigBasic.Certificates, tc.Certificates)
+	require.Nil(t, tlsConfigBasic.GetCertificate)
+
+	cert, err := tc.GetCertificate(&tls.ClientHelloInfo{ServerName: "b.example.com"})
+	require.NoError(t, err)
+	require.Equal(t, b, cert)
+
+	cert, err = tc.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+	require.NoError(t, err)
+	require.Equal(t, a, cert)
+}
+
+func TestTrackClient(t *testing.T) {
+	l := New()
+	done := l.TrackClient("t1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, l.WaitClients(ctx, "t1"), context.DeadlineExceeded)
+
+	waited := make(chan bool)
+	go func() {
+		waited <- l.WaitClients(context.Background(), "t1") == nil
+	}()
+
+	select {
+	case <-waited:
+		t.Fatal("expected WaitClients to block")
+	case <-time.After(5 * time.Millisecond):
+	}
+
+	done()
+	require.True(t, <-waited)
+	l.ClientsWg.Wait()
+
+	require.NoError(t, l.WaitClients(context.Background(), "t1")) // the drained listener returns immediately
+	l.Delete("t1")
+	require.NoError(t, l.WaitClients(context.Background(), "t1")) // no tracked clients returns immediately
+}
+
+func TestCloseAllTimeout(t *testing.T) {
+	l := New()
+	mocks := map[string]*MockListener{
+		"t1": NewMockListener("t1", ":1882"),
+		"t2": NewMockListener("t2", ":1883"),
+	}
+	for _, m := range mocks {
+		l.Add(m)
+	}
+
+	l.ServeAll(MockEstablisher)
+	time.Sleep(time.Millisecond)
+
+	done := l.TrackClient("t1")
+	require.False(t, l.CloseAllTimeout(MockCloser, 5*time.Millisecond))
+	for _, m := range mocks {
+		require.False(t, m.IsServing())
+	}
+
+	done()
+	l.ClientsWg.Wait()
+
+	l = New()
+	l.Add(NewMockListener("t3", ":1884"))
+	l.ServeAll(MockEstablisher)
+	time.Sleep(time.Millisecond)
+	require.True(t, l.CloseAllTimeout(MockCloser, time.Second))
+}
@@ -87,7 +87,11 @@ func (l *MockListener) Close(closer CloseFn) {
 	defer l.Unlock()
 	l.Serving = false
 	closer(l.id)
-	close(l.done)
+	select {
+	case <-l.done: // the listener may be closed again, such as when a drain is resumed
+	default:
+		close(l.done)
+	}
 }
 
 // IsServing indicates whether the mock listener is serving.
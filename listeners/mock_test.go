@@ -96,4 +96,6 @@ func TestMockListenerClose(t *testing.T) {
 		closed = true
 	})
 	require.Equal(t, true, closed)
+
+	mocked.Close(MockCloser) // closing again does not panic
 }
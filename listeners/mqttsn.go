@@ -0,0 +1,694 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const TypeMQTTSN = "mqttsn"
+
+const (
+	snMaxPacketSize     = 65535 // the maximum size of an mqtt-sn packet
+	snDefaultKeepalive  = 60    // the keepalive duration of clients which do not set one, in seconds
+	snExpiryCheckPeriod = time.Second
+)
+
+// MQTT-SN message types.
+const (
+	snConnect     byte = 0x04
+	snConnack     byte = 0x05
+	snRegister    byte = 0x0A
+	snRegack      byte = 0x0B
+	snPublish     byte = 0x0C
+	snPuback      byte = 0x0D
+	snPubcomp     byte = 0x0E
+	snPubrec      byte = 0x0F
+	snPubrel      byte = 0x10
+	snSubscribe   byte = 0x12
+	snSuback      byte = 0x13
+	snUnsubscribe byte = 0x14
+	snUnsuback    byte = 0x15
+	snPingreq     byte = 0x16
+	snPingresp    byte = 0x17
+	snDisconnect  byte = 0x18
+)
+
+// MQTT-SN return codes.
+const (
+	snAccepted           byte = 0x00
+	snRejectedCongestion byte = 0x01 // rejected: congestion, used when the broker fails to accept a message
+	snRejectedTopic      byte = 0x02 // rejected: invalid topic id
+	snNotSupported       byte = 0x03 // rejected: not supported, used for invalid topics and unauthorized clients
+)
+
+// MQTT-SN flags.
+const (
+	snFlagRetain      byte = 0x10
+	snFlagWill        byte = 0x08
+	snTopicTypeNormal byte = 0x00
+	snTopicTypePredef byte = 0x01
+	snTopicTypeShort  byte = 0x02
+	snTopicTypeMask   byte = 0x03
+	snQosMinusOne     byte = 0x03
+	snQosShift             = 5
+)
+
+var (
+	ErrInvalidMQTTSNPacket = errors.New("invalid mqtt-sn packet") // the datagram was not a valid mqtt-sn packet
+)
+
+// MQTTSNConfig contains mqtt-sn specific configuration values for a listener.
+type MQTTSNConfig struct {
+	// PredefinedTopics are topic names known in advance by the gateway and clients, keyed
+	// on topic id. Predefined topics may be used without registering, including by QoS -1 publishes.
+	PredefinedTopics map[uint16]string `yaml:"predefined_topics" json:"predefined_topics"`
+}
+
+// MQTTSN is a gateway listener for MQTT-SN clients over UDP, such as sensor networks which
+// cannot run TCP. It translates MQTT-SN topic registration and topic ids into normal topic names,
+// publishing messages into the broker and subscribing to filters on behalf of each client.
+// Messages are delivered to MQTT-SN clients at QoS 0, and sleeping clients and wills are not supported.
+type MQTTSN struct {
+	sync.RWMutex
+	id         string                // the internal id of the listener
+	address    string                // the network address to bind to
+	config     Config                // configuration values for the listener
+	conn       net.PacketConn        // the udp socket receiving client datagrams
+	publish    PublishFn             // publishes messages into the broker
+	subscribe  SubscribeFn           // subscribes to filters in the broker
+	auth       HTTPAuthFn            // checks the client id may read or write to a topic, if set
+	predefined map[uint16]string     // predefined topic names, keyed on topic id
+	predefIDs  map[string]uint16     // predefined topic ids, keyed on topic name
+	sessions   map[string]*snSession // client sessions, keyed on remote address
+	filter     *ipFilter             // drops datagrams from denied remote addresses
+	log        *slog.Logger          // server logger
+	done       chan struct{}         // closed when the listener is closing
+	end        uint32                // ensure the close methods are only called once
+}
+
+// snSession contains the state of a connected mqtt-sn client.
+type snSession struct {
+	sync.Mutex
+	addr      net.Addr                    // the remote address of the client
+	clientID  string                      // the client id of the client
+	keepalive time.Duration               // the keepalive duration of the client
+	lastSeen  time.Time                   // the time a packet was last received from the client
+	topics    map[uint16]string           // registered topic names, keyed on topic id
+	topicIDs  map[string]uint16           // registered topic ids, keyed on topic name
+	nextTopic uint16                      // the last topic id assigned
+	nextMsgID uint16                      // the last message id used by the gateway
+	subs      map[string]func()           // unsubscribe functions for the client subscriptions, keyed on filter
+	pending   map[uint16]snPendingPublish // qos 2 messages awaiting PUBREL, keyed on message id
+}
+
+// snPendingPublish is a qos 2 message received from a client awaiting release.
+type snPendingPublish struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// NewMQTTSN initializes and returns a new mqtt-sn gateway listener, listening on a udp address.
+// The client id of each client is passed as the username to auth, if set.
+func NewMQTTSN(config Config, publish PublishFn, subscribe SubscribeFn, auth HTTPAuthFn) *MQTTSN {
+	l := &MQTTSN{
+		id:         config.ID,
+		address:    config.Address,
+		config:     config,
+		publish:    publish,
+		subscribe:  subscribe,
+		auth:       auth,
+		predefined: map[uint16]string{},
+		predefIDs:  map[string]uint16{},
+		sessions:   map[string]*snSession{},
+		done:       make(chan struct{}),
+	}
+
+	if config.MQTTSN != nil {
+		for id, topic := range config.MQTTSN.PredefinedTopics {
+			l.predefined[id] = topic
+			l.predefIDs[topic] = id
+		}
+	}
+
+	return l
+}
+
+// ID returns the id of the listener.
+func (l *MQTTSN) ID() string {
+	return l.id
+}
+
+// Address returns the address of the listener.
+func (l *MQTTSN) Address() string {
+	if l.conn != nil {
+		return l.conn.LocalAddr().String()
+	}
+	return l.address
+}
+
+// Protocol returns the address of the listener.
+func (l *MQTTSN) Protocol() string {
+	return "mqttsn"
+}
+
+// Init initializes the listener.
+func (l *MQTTSN) Init(log *slog.Logger) error {
+	l.log = log
+
+	var err error
+	l.filter, err = newIPFilter(l.config)
+	if err != nil {
+		return err
+	}
+
+	var lc net.ListenConfig
+	address, err := l.config.bind(&lc, l.address)
+	if err != nil {
+		return err
+	}
+
+	l.conn, err = lc.ListenPacket(context.Background(), "udp", address)
+	return err
+}
+
+// Serve starts reading datagrams from mqtt-sn clients.
+func (l *MQTTSN) Serve(establish EstablishFn) {
+	go l.expireSessions()
+
+	buf := make([]byte, snMaxPacketSize)
+	for {
+		if atomic.LoadUint32(&l.end) == 1 {
+			return
+		}
+
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if atomic.LoadUint32(&l.end) == 0 {
+				l.log.Error("failed to read mqtt-sn datagram", "error", err, "listener", l.id)
+			}
+			return
+		}
+
+		if !l.filter.allowed(addr.String()) {
+			continue
+		}
+
+		if err := l.handle(addr, buf[:n]); err != nil {
+			l.log.Debug("dropped mqtt-sn datagram", "error", err, "listener", l.id, "remote", addr.String())
+		}
+	}
+}
+
+// Close closes the listener and any client sessions.
+func (l *MQTTSN) Close(closeClients CloseFn) {
+	l.Lock()
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		close(l.done)
+		if l.conn != nil {
+			_ = l.conn.Close()
+		}
+
+		for key, s := range l.sessions {
+			s.unsubscribeAll()
+			delete(l.sessions, key)
+		}
+	}
+	l.Unlock()
+
+	closeClients(l.id)
+}
+
+// expireSessions removes the sessions of clients which have not been seen within
+// one and a half times their keepalive.
+func (l *MQTTSN) expireSessions() {
+	ticker := time.NewTicker(snExpiryCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case now := <-ticker.C:
+			l.Lock()
+			for key, s := range l.sessions {
+				s.Lock()
+				expired := now.Sub(s.lastSeen) > s.keepalive+s.keepalive/2
+				s.Unlock()
+				if expired {
+					l.log.Debug("mqtt-sn client keepalive expired", "listener", l.id, "client", s.clientID)
+					s.unsubscribeAll()
+					delete(l.sessions, key)
+				}
+			}
+			l.Unlock()
+		}
+	}
+}
+
+// session returns the session for a remote address, if the client is connected.
+func (l *MQTTSN) session(addr net.Addr) *snSession {
+	l.RLock()
+	defer l.RUnlock()
+	s, ok := l.sessions[addr.String()]
+	if ok {
+		s.Lock()
+		s.lastSeen = time.Now()
+		s.Unlock()
+	}
+	return s
+}
+
+// authorized returns true if a client may read or write to a topic.
+func (l *MQTTSN) authorized(addr net.Addr, clientID, topic string, write bool) bool {
+	return l.auth == nil || l.auth(l.id, addr.String(), []byte(clientID), nil, topic, write)
+}
+
+// send writes a packet to a client.
+func (l *MQTTSN) send(addr net.Addr, msgType byte, body ...byte) {
+	if _, err := l.conn.WriteTo(encodeSNPacket(msgType, body), addr); err != nil {
+		l.log.Debug("failed to write mqtt-sn packet", "error", err, "listener", l.id, "remote", addr.String())
+	}
+}
+
+// handle handles a datagram received from a client.
+func (l *MQTTSN) handle(addr net.Addr, b []byte) error {
+	msgType, body, err := decodeSNPacket(b)
+	if err != nil {
+		return err
+	}
+
+	switch msgType {
+	case snConnect:
+		return l.handleConnect(addr, body)
+	case snPublish:
+		return l.handlePublish(addr, body)
+	case snPingreq:
+		if l.session(addr) != nil {
+			l.send(addr, snPingresp)
+		}
+		return nil
+	}
+
+	s := l.session(addr)
+	if s == nil {
+		return nil // only CONNECT, QoS -1 PUBLISH, and PINGREQ are accepted from unconnected clients
+	}
+
+	switch msgType {
+	case snRegister:
+		return l.handleRegister(s, body)
+	case snPubrel:
+		return l.handlePubrel(s, body)
+	case snSubscribe:
+		return l.handleSubscribe(s, body)
+	case snUnsubscribe:
+		return l.handleUnsubscribe(s, body)
+	case snDisconnect:
+		l.Lock()
+		delete(l.sessions, addr.String())
+		l.Unlock()
+		s.unsubscribeAll()
+		l.send(addr, snDisconnect)
+	case snRegack, snPuback:
+		// messages are delivered to clients at qos 0, so acknowledgements require no action
+	}
+
+	return nil
+}
+
+// handleConnect handles a CONNECT packet, starting a new session for the client.
+func (l *MQTTSN) handleConnect(addr net.Addr, body []byte) error {
+	if len(body) < 4 {
+		return ErrInvalidMQTTSNPacket
+	}
+
+	flags := body[0]
+	keepalive := time.Duration(binary.BigEndian.Uint16(body[2:4])) * time.Second
+	if keepalive == 0 {
+		keepalive = snDefaultKeepalive * time.Second
+	}
+	clientID := string(body[4:])
+
+	if flags&snFlagWill > 0 {
+		l.send(addr, snConnack, snNotSupported)
+		return nil
+	}
+
+	s := &snSession{
+		addr:      addr,
+		clientID:  clientID,
+		keepalive: keepalive,
+		lastSeen:  time.Now(),
+		topics:    map[uint16]string{},
+		topicIDs:  map[string]uint16{},
+		subs:      map[string]func(){},
+		pending:   map[uint16]snPendingPublish{},
+	}
+
+	l.Lock()
+	if old, ok := l.sessions[addr.String()]; ok {
+		old.unsubscribeAll() // a reconnecting client starts a clean session
+	}
+	l.sessions[addr.String()] = s
+	l.Unlock()
+
+	l.send(addr, snConnack, snAccepted)
+	return nil
+}
+
+// handleRegister handles a REGISTER packet, assigning a topic id to a topic name.
+func (l *MQTTSN) handleRegister(s *snSession, body []byte) error {
+	if len(body) < 5 {
+		return ErrInvalidMQTTSNPacket
+	}
+
+	msgID := body[2:4]
+	id := s.register(string(body[4:]))
+	l.send(s.addr, snRegack, append(appendUint16(nil, id), append(msgID, snAccepted)...)...)
+	return nil
+}
+
+// handlePublish handles a PUBLISH packet, publishing the message into the broker.
+func (l *MQTTSN) handlePublish(addr net.Addr, body []byte) error {
+	if len(body) < 5 {
+		return ErrInvalidMQTTSNPacket
+	}
+
+	flags := body[0]
+	topicID := binary.BigEndian.Uint16(body[1:3])
+	msgID := binary.BigEndian.Uint16(body[3:5])
+	payload := append([]byte{}, body[5:]...)
+	retain := flags&snFlagRetain > 0
+	qosFlag := (flags >> snQosShift) & 0x03
+
+	s := l.session(addr)
+	if s == nil && qosFlag != snQosMinusOne {
+		return nil
+	}
+
+	var clientID string
+	if s != nil {
+		clientID = s.clientID
+	}
+
+	// qos 1 messages are acknowledged, and rejected messages of qos 0 to 2 are acknowledged
+	// with the reason, while qos -1 messages are never acknowledged.
+	ack := func(code byte) {
+		if qosFlag == snQosMinusOne || (code == snAccepted && qosFlag != 1) {
+			return
+		}
+		l.send(addr, snPuback, append(appendUint16(appendUint16(nil, topicID), msgID), code)...)
+	}
+
+	topic, ok := l.topicName(s, flags&snTopicTypeMask, body[1:3])
+	if !ok {
+		ack(snRejectedTopic)
+		return nil
+	}
+
+	if !isValidPublishTopic(topic) || !l.authorized(addr, clientID, topic, true) {
+		ack(snNotSupported)
+		return nil
+	}
+
+	qos := qosFlag
+	if qosFlag == snQosMinusOne {
+		qos = 0
+	}
+
+	if qos == 2 {
+		s.Lock()
+		s.pending[msgID] = snPendingPublish{topic: topic, payload: payload, retain: retain}
+		s.Unlock()
+		l.send(addr, snPubrec, appendUint16(nil, msgID)...)
+		return nil
+	}
+
+	if err := l.publish(topic, payload, retain, qos); err != nil {
+		l.log.Warn("failed to publish mqtt-sn message", "error", err, "listener", l.id, "topic", topic)
+		ack(snRejectedCongestion)
+		return nil
+	}
+
+	ack(snAccepted)
+	return nil
+}
+
+// handlePubrel handles a PUBREL packet, publishing a pending qos 2 message into the broker.
+func (l *MQTTSN) handlePubrel(s *snSession, body []byte) error {
+	if len(body) < 2 {
+		return ErrInvalidMQTTSNPacket
+	}
+
+	msgID := binary.BigEndian.Uint16(body[0:2])
+	s.Lock()
+	pk, ok := s.pending[msgID]
+	delete(s.pending, msgID)
+	s.Unlock()
+
+	if ok {
+		if err := l.publish(pk.topic, pk.payload, pk.retain, 2); err != nil {
+			l.log.Warn("failed to publish mqtt-sn message", "error", err, "listener", l.id, "topic", pk.topic)
+		}
+	}
+
+	l.send(s.addr, snPubcomp, appendUint16(nil, msgID)...)
+	return nil
+}
+
+// handleSubscribe handles a SUBSCRIBE packet, subscribing the client to a topic filter.
+func (l *MQTTSN) handleSubscribe(s *snSession, body []byte) error {
+	if len(body) < 4 {
+		return ErrInvalidMQTTSNPacket
+	}
+
+	flags := body[0]
+	msgID := binary.BigEndian.Uint16(body[1:3])
+	suback := func(topicID uint16, code byte) {
+		l.send(s.addr, snSuback, append(appendUint16(appendUint16([]byte{0}, topicID), msgID), code)...)
+	}
+
+	var filter string
+	topicType := flags & snTopicTypeMask
+	if topicType == snTopicTypeNormal {
+		filter = string(body[3:])
+	} else {
+		var ok bool
+		if filter, ok = l.topicName(s, topicType, body[3:]); !ok {
+			suback(0, snRejectedTopic)
+			return nil
+		}
+	}
+
+	if filter == "" || !l.authorized(s.addr, s.clientID, filter, false) {
+		suback(0, snNotSupported)
+		return nil
+	}
+
+	var topicID uint16
+	if topicType == snTopicTypeNormal && !isWildcard(filter) {
+		topicID = s.register(filter)
+	} else if topicType != snTopicTypeNormal {
+		topicID = binary.BigEndian.Uint16(body[3:5])
+	}
+
+	s.Lock()
+	_, exists := s.subs[filter]
+	s.Unlock()
+	if !exists {
+		unsubscribe, err := l.subscribe(filter, func(topic string, payload []byte, retain bool, qos byte) {
+			l.deliver(s, topic, payload, retain)
+		})
+		if err != nil {
+			suback(0, snNotSupported)
+			return nil
+		}
+
+		s.Lock()
+		s.subs[filter] = unsubscribe
+		s.Unlock()
+	}
+
+	suback(topicID, snAccepted)
+	return nil
+}
+
+// handleUnsubscribe handles an UNSUBSCRIBE packet, unsubscribing the client from a topic filter.
+func (l *MQTTSN) handleUnsubscribe(s *snSession, body []byte) error {
+	if len(body) < 4 {
+		return ErrInvalidMQTTSNPacket
+	}
+
+	flags := body[0]
+	msgID := binary.BigEndian.Uint16(body[1:3])
+
+	filter := string(body[3:])
+	if topicType := flags & snTopicTypeMask; topicType != snTopicTypeNormal {
+		filter, _ = l.topicName(s, topicType, body[3:])
+	}
+
+	s.Lock()
+	unsubscribe, ok := s.subs[filter]
+	delete(s.subs, filter)
+	s.Unlock()
+	if ok {
+		unsubscribe()
+	}
+
+	l.send(s.addr, snUnsuback, appendUint16(nil, msgID)...)
+	return nil
+}
+
+// deliver sends a message matching a client subscription to the client, registering
+// the topic name with the client first if it does not yet have a topic id.
+func (l *MQTTSN) deliver(s *snSession, topic string, payload []byte, retain bool) {
+	flags := snTopicTypeNormal
+	if retain {
+		flags |= snFlagRetain
+	}
+
+	var topicID []byte
+	if len(topic) == 2 {
+		flags |= snTopicTypeShort
+		topicID = []byte(topic)
+	} else if id, ok := l.predefIDs[topic]; ok {
+		flags |= snTopicTypePredef
+		topicID = appendUint16(nil, id)
+	} else {
+		s.Lock()
+		id, ok := s.topicIDs[topic]
+		s.Unlock()
+		if !ok {
+			id = s.register(topic)
+			l.send(s.addr, snRegister, append(appendUint16(appendUint16(nil, id), s.nextMessageID()), topic...)...)
+		}
+		topicID = appendUint16(nil, id)
+	}
+
+	body := append([]byte{flags}, topicID...)
+	body = appendUint16(body, 0) // qos 0 messages have no message id
+	l.send(s.addr, snPublish, append(body, payload...)...)
+}
+
+// topicName returns the topic name for a topic id of a given topic id type.
+func (l *MQTTSN) topicName(s *snSession, topicType byte, b []byte) (string, bool) {
+	if len(b) < 2 {
+		return "", false
+	}
+
+	switch topicType {
+	case snTopicTypeShort:
+		return string(b[:2]), true
+	case snTopicTypePredef:
+		topic, ok := l.predefined[binary.BigEndian.Uint16(b)]
+		return topic, ok
+	case snTopicTypeNormal:
+		if s == nil {
+			return "", false
+		}
+		s.Lock()
+		defer s.Unlock()
+		topic, ok := s.topics[binary.BigEndian.Uint16(b)]
+		return topic, ok
+	default:
+		return "", false
+	}
+}
+
+// register returns the topic id of a topic name, assigning a new id if the topic is not yet registered.
+func (s *snSession) register(topic string) uint16 {
+	s.Lock()
+	defer s.Unlock()
+
+	if id, ok := s.topicIDs[topic]; ok {
+		return id
+	}
+
+	s.nextTopic++
+	s.topics[s.nextTopic] = topic
+	s.topicIDs[topic] = s.nextTopic
+	return s.nextTopic
+}
+
+// nextMessageID returns the next message id for a packet sent by the gateway.
+func (s *snSession) nextMessageID() uint16 {
+	s.Lock()
+	defer s.Unlock()
+	s.nextMsgID++
+	if s.nextMsgID == 0 {
+		s.nextMsgID = 1
+	}
+	return s.nextMsgID
+}
+
+// unsubscribeAll removes all the subscriptions of the client.
+func (s *snSession) unsubscribeAll() {
+	s.Lock()
+	subs := s.subs
+	s.subs = map[string]func(){}
+	s.Unlock()
+
+	for _, unsubscribe := range subs {
+		unsubscribe()
+	}
+}
+
+// isWildcard returns true if a topic filter contains wildcards.
+func isWildcard(filter string) bool {
+	for i := 0; i < len(filter); i++ {
+		if filter[i] == '+' || filter[i] == '#' {
+			return true
+		}
+	}
+	return false
+}
+
+// appendUint16 appends a big endian uint16 to b.
+func appendUint16(b []byte, v uint16) []byte {
+	return binary.BigEndian.AppendUint16(b, v)
+}
+
+// encodeSNPacket encodes an mqtt-sn packet with a message type and body.
+func encodeSNPacket(msgType byte, body []byte) []byte {
+	n := len(body) + 2
+	if n < 256 {
+		return append([]byte{byte(n), msgType}, body...)
+	}
+
+	b := []byte{0x01}
+	b = appendUint16(b, uint16(n+2))
+	b = append(b, msgType)
+	return append(b, body...)
+}
+
+// decodeSNPacket decodes the message type and body of an mqtt-sn packet.
+func decodeSNPacket(b []byte) (byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, ErrInvalidMQTTSNPacket
+	}
+
+	n, header := int(b[0]), 1
+	if b[0] == 0x01 {
+		if len(b) < 4 {
+			return 0, nil, ErrInvalidMQTTSNPacket
+		}
+		n, header = int(binary.BigEndian.Uint16(b[1:3])), 3
+	}
+
+	if n != len(b) || n < header+1 {
+		return 0, nil, ErrInvalidMQTTSNPacket
+	}
+
+	return b[header], b[header+1:], nil
+}
@@ -0,0 +1,391 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testSNBroker struct {
+	published    chan string
+	handlers     chan MessageFn
+	unsubscribed chan string
+}
+
+type testSNClient struct {
+	t    *testing.T
+	conn net.PacketConn
+	addr net.Addr
+}
+
+func (c *testSNClient) send(msgType byte, body ...byte) {
+	_, err := c.conn.WriteTo(encodeSNPacket(msgType, body), c.addr)
+	require.NoError(c.t, err)
+}
+
+func (c *testSNClient) recv() (byte, []byte) {
+	buf := make([]byte, snMaxPacketSize)
+	_ = c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := c.conn.ReadFrom(buf)
+	require.NoError(c.t, err)
+
+	msgType, body, err := decodeSNPacket(buf[:n])
+	require.NoError(c.t, err)
+	return msgType, body
+}
+
+func (c *testSNClient) connect() {
+	c.send(snConnect, append([]byte{0x04, 0x01, 0x00, 0x3c}, "sn1"...)...)
+	msgType, body := c.recv()
+	require.Equal(c.t, snConnack, msgType)
+	require.Equal(c.t, []byte{snAccepted}, body)
+}
+
+func newTestMQTTSN(t *testing.T, config *MQTTSNConfig, auth HTTPAuthFn) (*MQTTSN, *testSNBroker, *testSNClient) {
+	b := &testSNBroker{
+		published:    make(chan string, 4),
+		handlers:     make(chan MessageFn, 1),
+		unsubscribed: make(chan string, 1),
+	}
+
+	l := NewMQTTSN(Config{ID: "t1", Address: "127.0.0.1:0", MQTTSN: config}, func(topic string, payload []byte, retain bool, qos byte) error {
+		if topic == "fail" {
+			return errors.New("test")
+		}
+		b.published <- topic + ":" + string(payload)
+		return nil
+	}, func(filter string, handler MessageFn) (func(), error) {
+		if filter == "fail" {
+			return nil, errors.New("test")
+		}
+		b.handlers <- handler
+		return func() {
+			b.unsubscribed <- filter
+		}, nil
+	}, auth)
+
+	require.NoError(t, l.Init(logger))
+	go l.Serve(MockEstablisher)
+	t.Cleanup(func() {
+		l.Close(MockCloser)
+	})
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	return l, b, &testSNClient{t: t, conn: conn, addr: l.conn.LocalAddr()}
+}
+
+func TestNewMQTTSN(t *testing.T) {
+	l := NewMQTTSN(Config{ID: "t1", Address: testAddr, MQTTSN: &MQTTSNConfig{PredefinedTopics: map[uint16]string{1: "a/b"}}}, nil, nil, nil)
+	require.Equal(t, "t1", l.id)
+	require.Equal(t, testAddr, l.address)
+	require.Equal(t, "t1", l.ID())
+	require.Equal(t, testAddr, l.Address())
+	require.Equal(t, "mqttsn", l.Protocol())
+	require.Equal(t, "a/b", l.predefined[1])
+	require.Equal(t, uint16(1), l.predefIDs["a/b"])
+}
+
+func TestMQTTSNInitBadAddress(t *testing.T) {
+	l := NewMQTTSN(Config{ID: "t1", Address: "bad_address"}, nil, nil, nil)
+	require.Error(t, l.Init(logger))
+}
+
+func TestMQTTSNServeAndClose(t *testing.T) {
+	l := NewMQTTSN(Config{ID: "t1", Address: "127.0.0.1:0"}, nil, nil, nil)
+	require.NoError(t, l.Init(logger))
+
+	o := make(chan bool)
+	go func(o chan bool) {
+		l.Serve(MockEstablisher)
+		o <- true
+	}(o)
+
+	time.Sleep(time.Millisecond)
+
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+
+	require.True(t, closed)
+	<-o
+
+	l.Close(MockCloser) // coverage: close twice
+}
+
+func TestEncodeDecodeSNPacket(t *testing.T) {
+	b := encodeSNPacket(snPingreq, nil)
+	require.Equal(t, []byte{0x02, snPingreq}, b)
+
+	msgType, body, err := decodeSNPacket(b)
+	require.NoError(t, err)
+	require.Equal(t, snPingreq, msgType)
+	require.Empty(t, body)
+
+	long := bytes.Repeat([]byte{'a'}, 300)
+	b = encodeSNPacket(snPublish, long)
+	require.Equal(t, []byte{0x01, 0x01, 0x30, snPublish}, b[:4])
+
+	msgType, body, err = decodeSNPacket(b)
+	require.NoError(t, err)
+	require.Equal(t, snPublish, msgType)
+	require.Equal(t, long, body)
+}
+
+func TestDecodeSNPacketInvalid(t *testing.T) {
+	for _, b := range [][]byte{
+		{0x02},
+		{0x05, snPingreq},
+		{0x01, 0x00},
+		{0x01, 0x00, 0x03, snPingreq},
+	} {
+		_, _, err := decodeSNPacket(b)
+		require.ErrorIs(t, err, ErrInvalidMQTTSNPacket)
+	}
+}
+
+func TestMQTTSNConnectWillNotSupported(t *testing.T) {
+	_, _, c := newTestMQTTSN(t, nil, nil)
+
+	c.send(snConnect, append([]byte{snFlagWill, 0x01, 0x00, 0x3c}, "sn1"...)...)
+	msgType, body := c.recv()
+	require.Equal(t, snConnack, msgType)
+	require.Equal(t, []byte{snNotSupported}, body)
+}
+
+func TestMQTTSNPingreq(t *testing.T) {
+	_, _, c := newTestMQTTSN(t, nil, nil)
+	c.connect()
+
+	c.send(snPingreq)
+	msgType, _ := c.recv()
+	require.Equal(t, snPingresp, msgType)
+}
+
+func TestMQTTSNRegisterAndPublish(t *testing.T) {
+	_, b, c := newTestMQTTSN(t, nil, nil)
+	c.connect()
+
+	c.send(snRegister, append([]byte{0x00, 0x00, 0x00, 0x01}, "a/b"...)...)
+	msgType, body := c.recv()
+	require.Equal(t, snRegack, msgType)
+	require.Equal(t, []byte{0x00, 0x01, 0x00, 0x01, snAccepted}, body)
+
+	// qos 0 publishes are not acknowledged
+	c.send(snPublish, append([]byte{0x00, 0x00, 0x01, 0x00, 0x00}, "hello"...)...)
+	require.Equal(t, "a/b:hello", <-b.published)
+
+	// qos 1 publishes are acknowledged
+	c.send(snPublish, append([]byte{0x20, 0x00, 0x01, 0x00, 0x02}, "world"...)...)
+	require.Equal(t, "a/b:world", <-b.published)
+	msgType, body = c.recv()
+	require.Equal(t, snPuback, msgType)
+	require.Equal(t, []byte{0x00, 0x01, 0x00, 0x02, snAccepted}, body)
+}
+
+func TestMQTTSNPublishQos2(t *testing.T) {
+	_, b, c := newTestMQTTSN(t, nil, nil)
+	c.connect()
+
+	c.send(snPublish, append([]byte{0x40 | snTopicTypeShort, 'a', 'b', 0x00, 0x03}, "hello"...)...)
+	msgType, body := c.recv()
+	require.Equal(t, snPubrec, msgType)
+	require.Equal(t, []byte{0x00, 0x03}, body)
+
+	c.send(snPubrel, 0x00, 0x03)
+	require.Equal(t, "ab:hello", <-b.published)
+	msgType, body = c.recv()
+	require.Equal(t, snPubcomp, msgType)
+	require.Equal(t, []byte{0x00, 0x03}, body)
+}
+
+func TestMQTTSNPublishQosMinusOne(t *testing.T) {
+	_, b, c := newTestMQTTSN(t, &MQTTSNConfig{PredefinedTopics: map[uint16]string{7: "sensors/temp"}}, nil)
+
+	// qos -1 publishes are accepted from unconnected clients using predefined topics
+	c.send(snPublish, append([]byte{0x60 | snTopicTypePredef, 0x00, 0x07, 0x00, 0x00}, "21"...)...)
+	require.Equal(t, "sensors/temp:21", <-b.published)
+
+	// other publishes from unconnected clients are ignored
+	c.send(snPublish, append([]byte{0x20 | snTopicTypePredef, 0x00, 0x07, 0x00, 0x01}, "22"...)...)
+	c.send(snPingreq)
+	_ = c.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err := c.conn.ReadFrom(make([]byte, 16))
+	require.Error(t, err)
+	require.Empty(t, b.published)
+}
+
+func TestMQTTSNPublishRejected(t *testing.T) {
+	_, _, c := newTestMQTTSN(t, nil, func(listener, remote string, username, password []byte, topic string, write bool) bool {
+		return string(username) == "sn1" && topic != "no"
+	})
+	c.connect()
+
+	// unregistered topic id
+	c.send(snPublish, append([]byte{0x00, 0x00, 0x09, 0x00, 0x00}, "hello"...)...)
+	msgType, body := c.recv()
+	require.Equal(t, snPuback, msgType)
+	require.Equal(t, []byte{0x00, 0x09, 0x00, 0x00, snRejectedTopic}, body)
+
+	// not authorized
+	c.send(snPublish, append([]byte{0x20 | snTopicTypeShort, 'n', 'o', 0x00, 0x04}, "hello"...)...)
+	msgType, body = c.recv()
+	require.Equal(t, snPuback, msgType)
+	require.Equal(t, []byte{'n', 'o', 0x00, 0x04, snNotSupported}, body)
+
+	// broker publish failure
+	c.send(snRegister, append([]byte{0x00, 0x00, 0x00, 0x05}, "fail"...)...)
+	_, body = c.recv()
+	c.send(snPublish, append([]byte{0x20, body[0], body[1], 0x00, 0x06}, "hello"...)...)
+	msgType, body = c.recv()
+	require.Equal(t, snPuback, msgType)
+	require.Equal(t, snRejectedCongestion, body[4])
+}
+
+func TestMQTTSNSubscribeAndDeliver(t *testing.T) {
+	_, b, c := newTestMQTTSN(t, &MQTTSNConfig{PredefinedTopics: map[uint16]string{7: "sensors/temp"}}, nil)
+	c.connect()
+
+	c.send(snSubscribe, append([]byte{0x00, 0x00, 0x01}, "a/#"...)...)
+	msgType, body := c.recv()
+	require.Equal(t, snSuback, msgType)
+	require.Equal(t, []byte{0x00, 0x00, 0x00, 0x00, 0x01, snAccepted}, body) // wildcards have no topic id
+	handler := <-b.handlers
+
+	// the gateway registers new topics with the client before publishing
+	handler("a/b/c", []byte("hello"), true, 1)
+	msgType, body = c.recv()
+	require.Equal(t, snRegister, msgType)
+	require.Equal(t, append([]byte{0x00, 0x01, 0x00, 0x01}, "a/b/c"...), body)
+	msgType, body = c.recv()
+	require.Equal(t, snPublish, msgType)
+	require.Equal(t, append([]byte{snFlagRetain, 0x00, 0x01, 0x00, 0x00}, "hello"...), body)
+
+	// registered topics are not registered again
+	handler("a/b/c", []byte("again"), false, 0)
+	msgType, body = c.recv()
+	require.Equal(t, snPublish, msgType)
+	require.Equal(t, append([]byte{0x00, 0x00, 0x01, 0x00, 0x00}, "again"...), body)
+
+	// short and predefined topics use their topic ids
+	handler("ab", []byte("short"), false, 0)
+	_, body = c.recv()
+	require.Equal(t, append([]byte{snTopicTypeShort, 'a', 'b', 0x00, 0x00}, "short"...), body)
+
+	handler("sensors/temp", []byte("21"), false, 0)
+	_, body = c.recv()
+	require.Equal(t, append([]byte{snTopicTypePredef, 0x00, 0x07, 0x00, 0x00}, "21"...), body)
+
+	c.send(snUnsubscribe, append([]byte{0x00, 0x00, 0x02}, "a/#"...)...)
+	msgType, body = c.recv()
+	require.Equal(t, snUnsuback, msgType)
+	require.Equal(t, []byte{0x00, 0x02}, body)
+	require.Equal(t, "a/#", <-b.unsubscribed)
+}
+
+func TestMQTTSNSubscribeTopicIDs(t *testing.T) {
+	_, b, c := newTestMQTTSN(t, &MQTTSNConfig{PredefinedTopics: map[uint16]string{7: "sensors/temp"}}, nil)
+	c.connect()
+
+	c.send(snSubscribe, append([]byte{0x00, 0x00, 0x01}, "x/y"...)...)
+	_, body := c.recv()
+	require.Equal(t, []byte{0x00, 0x00, 0x01, 0x00, 0x01, snAccepted}, body) // topic names are registered
+	<-b.handlers
+
+	c.send(snSubscribe, snTopicTypePredef, 0x00, 0x02, 0x00, 0x07)
+	_, body = c.recv()
+	require.Equal(t, []byte{0x00, 0x00, 0x07, 0x00, 0x02, snAccepted}, body)
+	<-b.handlers
+
+	c.send(snSubscribe, snTopicTypePredef, 0x00, 0x03, 0x00, 0x08)
+	_, body = c.recv()
+	require.Equal(t, snRejectedTopic, body[5])
+
+	c.send(snUnsubscribe, snTopicTypePredef, 0x00, 0x04, 0x00, 0x07)
+	msgType, _ := c.recv()
+	require.Equal(t, snUnsuback, msgType)
+	require.Equal(t, "sensors/temp", <-b.unsubscribed)
+}
+
+func TestMQTTSNSubscribeRejected(t *testing.T) {
+	_, _, c := newTestMQTTSN(t, nil, func(listener, remote string, username, password []byte, topic string, write bool) bool {
+		return topic != "no"
+	})
+	c.connect()
+
+	c.send(snSubscribe, append([]byte{0x00, 0x00, 0x01}, "no"...)...)
+	_, body := c.recv()
+	require.Equal(t, snNotSupported, body[5])
+
+	c.send(snSubscribe, append([]byte{0x00, 0x00, 0x02}, "fail"...)...)
+	_, body = c.recv()
+	require.Equal(t, snNotSupported, body[5])
+}
+
+func TestMQTTSNDisconnect(t *testing.T) {
+	l, b, c := newTestMQTTSN(t, nil, nil)
+	c.connect()
+
+	c.send(snSubscribe, append([]byte{0x00, 0x00, 0x01}, "a/#"...)...)
+	c.recv()
+	<-b.handlers
+
+	c.send(snDisconnect)
+	msgType, _ := c.recv()
+	require.Equal(t, snDisconnect, msgType)
+	require.Equal(t, "a/#", <-b.unsubscribed)
+
+	l.RLock()
+	defer l.RUnlock()
+	require.Empty(t, l.sessions)
+}
+
+func TestMQTTSNKeepaliveExpiry(t *testing.T) {
+	l, b, c := newTestMQTTSN(t, nil, nil)
+	c.send(snConnect, append([]byte{0x04, 0x01, 0x00, 0x01}, "sn1"...)...) // 1 second keepalive
+	c.recv()
+
+	c.send(snSubscribe, append([]byte{0x00, 0x00, 0x01}, "a/#"...)...)
+	c.recv()
+	<-b.handlers
+
+	select {
+	case filter := <-b.unsubscribed:
+		require.Equal(t, "a/#", filter)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected session to expire")
+	}
+
+	l.RLock()
+	defer l.RUnlock()
+	require.Empty(t, l.sessions)
+}
+
+func TestMQTTSNInvalidPackets(t *testing.T) {
+	l, _, c := newTestMQTTSN(t, nil, nil)
+	addr := c.conn.LocalAddr()
+
+	require.ErrorIs(t, l.handle(addr, []byte{0x01}), ErrInvalidMQTTSNPacket)
+	require.ErrorIs(t, l.handle(addr, []byte{0x03, snConnect, 0x00}), ErrInvalidMQTTSNPacket)
+	require.ErrorIs(t, l.handle(addr, []byte{0x03, snPublish, 0x00}), ErrInvalidMQTTSNPacket)
+	require.NoError(t, l.handle(addr, []byte{0x02, snRegister})) // not connected
+
+	c.connect()
+	require.ErrorIs(t, l.handle(addr, []byte{0x03, snRegister, 0x00}), ErrInvalidMQTTSNPacket)
+	require.ErrorIs(t, l.handle(addr, []byte{0x03, snPubrel, 0x00}), ErrInvalidMQTTSNPacket)
+	require.ErrorIs(t, l.handle(addr, []byte{0x03, snSubscribe, 0x00}), ErrInvalidMQTTSNPacket)
+	require.ErrorIs(t, l.handle(addr, []byte{0x03, snUnsubscribe, 0x00}), ErrInvalidMQTTSNPacket)
+}
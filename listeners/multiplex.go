@@ -0,0 +1,332 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const TypeMultiplex = "multiplex"
+
+const (
+	alpnMQTT = "mqtt"     // the alpn protocol id for mqtt connections
+	alpnHTTP = "http/1.1" // the alpn protocol id for websocket connections
+
+	multiplexSniffTimeout = 10 * time.Second // the time allowed for a tls handshake and the first byte to arrive
+)
+
+// Multiplex is a listener which serves both mqtt and mqtt-over-websocket connections on a single
+// port, so that deployments restricted to one open port (e.g. 443) do not need a separate demultiplexer.
+// The protocol is selected by the tls alpn protocol negotiated by the client ("mqtt" or "http/1.1"),
+// or by inspecting the first byte received if no protocol was negotiated.
+type Multiplex struct {
+	sync.RWMutex
+	id      string             // the internal id of the listener
+	address string             // the network address to bind to
+	config  Config             // configuration values for the listener
+	limits  *connectionLimiter // limits the connections accepted by the listener
+	filter  *ipFilter          // drops connections from denied remote addresses
+	listen  net.Listener       // a net.Listener which will listen for new clients
+	ws      *Websocket         // serves the websocket connections
+	wsConns *connListener      // passes websocket connections to the websocket http server
+	log     *slog.Logger       // server logger
+	end     uint32             // ensure the close methods are only called once
+}
+
+// NewMultiplex initializes and returns a new multiplexing listener, listening on an address.
+func NewMultiplex(config Config) *Multiplex {
+	wsConfig := config
+	wsConfig.MaxConnections = 0 // connections are limited when they are accepted
+	wsConfig.AcceptRate = 0
+	wsConfig.AllowCIDRs = nil // connections are filtered when they are accepted
+	wsConfig.DenyCIDRs = nil
+
+	return &Multiplex{
+		id:      config.ID,
+		address: config.Address,
+		config:  config,
+		limits:  newConnectionLimiter(config),
+		ws:      NewWebsocket(wsConfig),
+	}
+}
+
+// ID returns the id of the listener.
+func (l *Multiplex) ID() string {
+	return l.id
+}
+
+// Address returns the address of the listener.
+func (l *Multiplex) Address() string {
+	if l.listen != nil {
+		return l.listen.Addr().String()
+	}
+	return l.address
+}
+
+// Protocol returns the address of the listener.
+func (l *Multiplex) Protocol() string {
+	return "tcp"
+}
+
+// CheckRevocation checks whether the certificate presented by a client has been revoked,
+// if revocation checking is configured for the listener.
+func (l *Multiplex) CheckRevocation(state tls.ConnectionState) error {
+	return l.config.Revocation.Check(state)
+}
+
+// Init initializes the listener.
+func (l *Multiplex) Init(log *slog.Logger) error {
+	l.log = log
+
+	if err := l.config.ValidateTLS(); err != nil {
+		return err
+	}
+
+	if err := l.ws.Init(log); err != nil {
+		return err
+	}
+
+	var err error
+	l.filter, err = newIPFilter(l.config)
+	if err != nil {
+		return err
+	}
+
+	lc := l.config.TCP.listenConfig()
+	address, err := l.config.bind(&lc, l.address)
+	if err != nil {
+		return err
+	}
+
+	l.listen, err = lc.Listen(context.Background(), "tcp", address)
+	if err != nil {
+		return err
+	}
+
+	l.wsConns = newConnListener(l.listen.Addr())
+
+	if l.filter != nil {
+		l.listen = &filteredListener{Listener: l.listen, filter: l.filter, log: log}
+	}
+
+	if tc := l.config.ServerTLSConfig(); tc != nil {
+		tc = tc.Clone()
+		for _, proto := range []string{alpnMQTT, alpnHTTP} {
+			if !slices.Contains(tc.NextProtos, proto) {
+				tc.NextProtos = append(tc.NextProtos, proto)
+			}
+		}
+		l.listen = tls.NewListener(l.listen, tc)
+	}
+
+	return nil
+}
+
+// Serve starts waiting for new connections, and calls the connection establishment
+// callback for mqtt connections, or upgrades websocket connections.
+func (l *Multiplex) Serve(establish EstablishFn) {
+	l.ws.establish = establish
+	go func() {
+		_ = l.ws.listen.Serve(l.wsConns)
+	}()
+
+	for {
+		if atomic.LoadUint32(&l.end) == 1 {
+			return
+		}
+
+		time.Sleep(l.limits.delay())
+		conn, err := l.listen.Accept()
+		if err != nil {
+			return
+		}
+
+		if atomic.LoadUint32(&l.end) == 0 {
+			if !l.limits.acquire() {
+				l.log.Warn("listener connection limit reached", "listener", l.id, "remote", conn.RemoteAddr())
+				_ = conn.Close()
+				continue
+			}
+
+			go l.route(conn, establish)
+		}
+	}
+}
+
+// route selects the protocol of a connection, and passes it to the mqtt or websocket handler.
+func (l *Multiplex) route(conn net.Conn, establish EstablishFn) {
+	var release sync.Once
+	defer release.Do(l.limits.release)
+
+	isWebsocket, conn, err := l.sniff(conn)
+	if err != nil {
+		l.log.Debug("failed to select connection protocol", "error", err, "listener", l.id, "remote", conn.RemoteAddr())
+		_ = conn.Close()
+		return
+	}
+
+	if isWebsocket {
+		l.wsConns.push(&releaseConn{Conn: conn, release: func() { release.Do(l.limits.release) }})
+		return
+	}
+
+	err = establish(l.id, conn)
+	if err != nil {
+		l.log.Warn("", "error", err)
+	}
+}
+
+// sniff returns true if a connection is a websocket connection, according to the negotiated alpn
+// protocol or the first byte received, and the connection to be used for reading from it.
+func (l *Multiplex) sniff(conn net.Conn) (bool, net.Conn, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(multiplexSniffTimeout))
+	defer func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			return false, conn, err
+		}
+
+		switch tc.ConnectionState().NegotiatedProtocol {
+		case alpnMQTT:
+			return false, conn, nil
+		case alpnHTTP:
+			return true, conn, nil
+		}
+	}
+
+	pc := &peekConn{Conn: conn, r: bufio.NewReader(conn)}
+	b, err := pc.r.Peek(1)
+	if err != nil {
+		return false, conn, err
+	}
+
+	return b[0] == 'G', pc, nil // an http GET request, rather than an mqtt CONNECT packet
+}
+
+// Close closes the listener and any client connections.
+func (l *Multiplex) Close(closeClients CloseFn) {
+	l.Lock()
+	defer l.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		if l.listen != nil {
+			_ = l.listen.Close()
+		}
+
+		if l.ws.listen != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = l.ws.listen.Shutdown(ctx)
+		}
+
+		if l.wsConns != nil {
+			_ = l.wsConns.Close()
+		}
+	}
+
+	closeClients(l.id)
+}
+
+// peekConn is a connection from which bytes have been peeked to select its protocol.
+type peekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read reads from the peeked bytes before reading from the connection.
+func (c *peekConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// ConnectionState returns the tls connection state of the underlying connection, if it
+// is a tls connection. Otherwise, an empty state is returned.
+func (c *peekConn) ConnectionState() tls.ConnectionState {
+	if tc, ok := c.Conn.(*tls.Conn); ok {
+		return tc.ConnectionState()
+	}
+
+	return tls.ConnectionState{}
+}
+
+// releaseConn is a connection which releases its connection limit when closed.
+type releaseConn struct {
+	net.Conn
+	release func()
+}
+
+// Close closes the connection and releases its connection limit.
+func (c *releaseConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+// ConnectionState returns the tls connection state of the underlying connection.
+func (c *releaseConn) ConnectionState() tls.ConnectionState {
+	if cs, ok := c.Conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		return cs.ConnectionState()
+	}
+
+	return tls.ConnectionState{}
+}
+
+// connListener is a net.Listener which accepts connections pushed to it by another listener.
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// newConnListener returns a new connListener reporting an address.
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// push passes a connection to the listener, closing it if the listener has been closed.
+func (l *connListener) push(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		_ = conn.Close()
+	}
+}
+
+// Accept waits for and returns the next connection pushed to the listener.
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener.
+func (l *connListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+// Addr returns the address of the listener.
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,259 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// serveMultiplex starts a multiplex listener on a random port, passing established connections to conns.
+func serveMultiplex(t *testing.T, config Config) (*Multiplex, chan net.Conn) {
+	config.Address = "127.0.0.1:0"
+	l := NewMultiplex(config)
+	require.NoError(t, l.Init(logger))
+
+	conns := make(chan net.Conn, 1)
+	go l.Serve(func(id string, c net.Conn) error {
+		require.Equal(t, "t1", id)
+		b := make([]byte, 4)
+		_, err := io.ReadFull(c, b)
+		if err != nil {
+			return err
+		}
+		_, err = c.Write(b)
+		conns <- c
+		return err
+	})
+
+	t.Cleanup(func() {
+		l.Close(MockCloser)
+	})
+
+	return l, conns
+}
+
+func TestNewMultiplex(t *testing.T) {
+	l := NewMultiplex(basicConfig)
+	require.Equal(t, "t1", l.id)
+	require.Equal(t, testAddr, l.address)
+	require.NotNil(t, l.ws)
+}
+
+func TestMultiplexID(t *testing.T) {
+	l := NewMultiplex(basicConfig)
+	require.Equal(t, "t1", l.ID())
+}
+
+func TestMultiplexAddress(t *testing.T) {
+	l := NewMultiplex(basicConfig)
+	require.Equal(t, testAddr, l.Address())
+}
+
+func TestMultiplexProtocol(t *testing.T) {
+	l := NewMultiplex(basicConfig)
+	require.Equal(t, "tcp", l.Protocol())
+}
+
+func TestMultiplexInit(t *testing.T) {
+	l := NewMultiplex(basicConfig)
+	err := l.Init(logger)
+	require.NoError(t, err)
+	require.NotNil(t, l.listen)
+	require.NotNil(t, l.ws.listen)
+	l.Close(MockCloser)
+}
+
+func TestMultiplexInitInvalidAddress(t *testing.T) {
+	l := NewMultiplex(Config{ID: "t1", Address: "wrong"})
+	err := l.Init(logger)
+	require.Error(t, err)
+}
+
+func TestMultiplexInitTLSNextProtos(t *testing.T) {
+	l := NewMultiplex(tlsConfig)
+	err := l.Init(logger)
+	require.NoError(t, err)
+	defer l.Close(MockCloser)
+	require.Empty(t, tlsConfigBasic.NextProtos)
+}
+
+func TestMultiplexServeAndClose(t *testing.T) {
+	l := NewMultiplex(basicConfig)
+	err := l.Init(logger)
+	require.NoError(t, err)
+
+	o := make(chan bool)
+	go func(o chan bool) {
+		l.Serve(MockEstablisher)
+		o <- true
+	}(o)
+
+	time.Sleep(time.Millisecond)
+
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+
+	require.True(t, closed)
+	<-o
+
+	l.Close(MockCloser)
+	l.Serve(MockEstablisher)
+}
+
+func TestMultiplexServeMQTT(t *testing.T) {
+	l, conns := serveMultiplex(t, basicConfig)
+
+	conn, err := net.Dial("tcp", l.Address())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte{0x10, 0x00, 0x01, 0x02})
+	require.NoError(t, err)
+
+	b := make([]byte, 4)
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x10, 0x00, 0x01, 0x02}, b)
+
+	c := <-conns
+	_, ok := c.(*peekConn)
+	require.True(t, ok)
+}
+
+func TestMultiplexServeWebsocket(t *testing.T) {
+	l, conns := serveMultiplex(t, basicConfig)
+
+	d := websocket.Dialer{Subprotocols: []string{"mqtt"}}
+	ws, _, err := d.Dial("ws://"+l.Address(), nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	err = ws.WriteMessage(websocket.BinaryMessage, []byte{0x10, 0x00, 0x01, 0x02})
+	require.NoError(t, err)
+
+	_, b, err := ws.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x10, 0x00, 0x01, 0x02}, b)
+
+	c := <-conns
+	_, ok := c.(*wsConn)
+	require.True(t, ok)
+}
+
+func TestMultiplexServeTLSALPN(t *testing.T) {
+	l, conns := serveMultiplex(t, tlsConfig)
+
+	conn, err := tls.Dial("tcp", l.Address(), &tls.Config{
+		InsecureSkipVerify: true, // nolint:gosec // test certificate
+		NextProtos:         []string{alpnMQTT},
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, alpnMQTT, conn.ConnectionState().NegotiatedProtocol)
+
+	_, err = conn.Write([]byte{0x10, 0x00, 0x01, 0x02})
+	require.NoError(t, err)
+
+	b := make([]byte, 4)
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err)
+
+	c := <-conns
+	tc, ok := c.(*tls.Conn)
+	require.True(t, ok)
+	require.True(t, tc.ConnectionState().HandshakeComplete)
+}
+
+func TestMultiplexServeTLSWebsocket(t *testing.T) {
+	l, conns := serveMultiplex(t, tlsConfig)
+
+	d := websocket.Dialer{
+		Subprotocols: []string{"mqtt"},
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true, // nolint:gosec // test certificate
+		},
+	}
+	ws, _, err := d.Dial("wss://"+l.Address(), nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	err = ws.WriteMessage(websocket.BinaryMessage, []byte{0x10, 0x00, 0x01, 0x02})
+	require.NoError(t, err)
+
+	_, _, err = ws.ReadMessage()
+	require.NoError(t, err)
+
+	c := <-conns
+	wc, ok := c.(*wsConn)
+	require.True(t, ok)
+	require.True(t, wc.ConnectionState().HandshakeComplete)
+}
+
+func TestMultiplexServeTLSNoALPN(t *testing.T) {
+	l, conns := serveMultiplex(t, tlsConfig)
+
+	conn, err := tls.Dial("tcp", l.Address(), &tls.Config{
+		InsecureSkipVerify: true, // nolint:gosec // test certificate
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte{0x10, 0x00, 0x01, 0x02})
+	require.NoError(t, err)
+
+	b := make([]byte, 4)
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err)
+
+	c := <-conns
+	pc, ok := c.(*peekConn)
+	require.True(t, ok)
+	require.True(t, pc.ConnectionState().HandshakeComplete)
+}
+
+func TestMultiplexServeSubprotocolRequired(t *testing.T) {
+	l, _ := serveMultiplex(t, basicConfig)
+
+	resp, err := http.Get("http://" + l.Address())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestConnListener(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1883}
+	l := newConnListener(addr)
+	require.Equal(t, addr, l.Addr())
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go l.push(c1)
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	require.Equal(t, c1, conn)
+
+	require.NoError(t, l.Close())
+	require.NoError(t, l.Close())
+
+	_, err = l.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+
+	c3, c4 := net.Pipe()
+	defer c4.Close()
+	l.push(c3)
+	_, err = c3.Write([]byte{0})
+	require.ErrorIs(t, err, io.ErrClosedPipe)
+}
@@ -0,0 +1,16 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package listeners
+
+import (
+	"syscall"
+)
+
+// reusePortControl returns an error, as SO_REUSEPORT is not available on this platform.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return ErrReusePortUnsupported
+}
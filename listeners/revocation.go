@@ -0,0 +1,307 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	defaultOCSPTimeout = 5 // the default timeout for ocsp requests, in seconds
+)
+
+var (
+	ErrCertificateRevoked = errors.New("certificate has been revoked")                       // the client certificate was revoked by its issuer
+	ErrRevocationUnknown  = errors.New("certificate revocation status could not be checked") // the revocation status of the client certificate is unknown
+)
+
+// RevocationChecker is implemented by listeners which can check whether the certificate
+// presented by a client has been revoked.
+type RevocationChecker interface {
+	CheckRevocation(state tls.ConnectionState) error
+}
+
+// RevocationConfig contains certificate revocation configuration values for a tls listener.
+type RevocationConfig struct {
+	// OCSPStaple staples an ocsp response for the server certificate to each tls handshake. The
+	// response is fetched from the responder named in the certificate, and refreshed before it expires.
+	OCSPStaple bool `yaml:"ocsp_staple" json:"ocsp_staple"`
+	// OCSP checks client certificates against the ocsp responders named in the certificates.
+	OCSP bool `yaml:"ocsp" json:"ocsp"`
+	// CRLFiles are paths to PEM or DER encoded certificate revocation lists which client
+	// certificates are checked against.
+	CRLFiles []string `yaml:"crl_files" json:"crl_files"`
+	// SoftFail accepts client certificates whose revocation status could not be determined,
+	// e.g. because the ocsp responder was unavailable.
+	SoftFail bool `yaml:"soft_fail" json:"soft_fail"`
+	// Enforce fails the tls handshake of clients whose certificates have been revoked. Otherwise,
+	// the result of the check is set in Client.Net.Revocation and the server denies the connection.
+	Enforce bool `yaml:"enforce" json:"enforce"`
+	// Timeout is the timeout for ocsp requests in seconds, 5 seconds if 0.
+	Timeout int64 `yaml:"timeout" json:"timeout"`
+
+	once    sync.Once
+	crls    []*x509.RevocationList // the loaded revocation lists
+	crlErr  error                  // an error loading the revocation lists
+	mu      sync.Mutex
+	ocsp    map[string]ocspResult            // ocsp results for client certificates, keyed on issuer and serial number
+	staples map[*tls.Certificate]*ocspStaple // ocsp staples for server certificates
+}
+
+// ocspResult is a cached ocsp response status for a client certificate.
+type ocspResult struct {
+	err        error     // the result of the check
+	nextUpdate time.Time // when the result expires
+}
+
+// ocspStaple is a server certificate with an ocsp response stapled.
+type ocspStaple struct {
+	cert       *tls.Certificate // a copy of the certificate with the staple, nil if not yet fetched
+	refresh    time.Time        // when the staple should be refreshed
+	nextUpdate time.Time        // when the staple expires
+	fetching   bool             // true if the staple is being fetched
+}
+
+// client returns the http client for ocsp requests.
+func (r *RevocationConfig) client() *http.Client {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = defaultOCSPTimeout
+	}
+
+	return &http.Client{Timeout: time.Duration(timeout) * time.Second}
+}
+
+// loadCRLs loads the revocation lists from the configured files.
+func (r *RevocationConfig) loadCRLs() {
+	for _, f := range r.CRLFiles {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			r.crlErr = err
+			return
+		}
+
+		if block, _ := pem.Decode(b); block != nil {
+			b = block.Bytes
+		}
+
+		crl, err := x509.ParseRevocationList(b)
+		if err != nil {
+			r.crlErr = fmt.Errorf("invalid crl %s: %w", f, err)
+			return
+		}
+
+		r.crls = append(r.crls, crl)
+	}
+}
+
+// Check returns ErrCertificateRevoked if the leaf certificate presented by the client has
+// been revoked, or ErrRevocationUnknown if the revocation status could not be determined
+// and SoftFail is not set. Connections without a client certificate are not checked.
+func (r *RevocationConfig) Check(state tls.ConnectionState) error {
+	if r == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+
+	leaf := state.PeerCertificates[0]
+	var issuer *x509.Certificate
+	if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 1 {
+		issuer = state.VerifiedChains[0][1]
+	} else if len(state.PeerCertificates) > 1 {
+		issuer = state.PeerCertificates[1]
+	}
+
+	err := r.checkCRLs(leaf, issuer)
+	if err == nil && r.OCSP {
+		err = r.checkOCSP(leaf, issuer)
+	}
+
+	if errors.Is(err, ErrRevocationUnknown) && r.SoftFail {
+		return nil
+	}
+
+	return err
+}
+
+// checkCRLs checks a certificate against the revocation lists of its issuer.
+func (r *RevocationConfig) checkCRLs(leaf, issuer *x509.Certificate) error {
+	if len(r.CRLFiles) == 0 {
+		return nil
+	}
+
+	r.once.Do(r.loadCRLs)
+	if r.crlErr != nil {
+		return fmt.Errorf("%w: %w", ErrRevocationUnknown, r.crlErr)
+	}
+
+	for _, crl := range r.crls {
+		if !bytes.Equal(crl.RawIssuer, leaf.RawIssuer) {
+			continue
+		}
+
+		if issuer != nil {
+			if err := crl.CheckSignatureFrom(issuer); err != nil {
+				return fmt.Errorf("%w: %w", ErrRevocationUnknown, err)
+			}
+		}
+
+		for _, entry := range crl.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+				return ErrCertificateRevoked
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkOCSP checks a certificate with the ocsp responder named in the certificate,
+// caching the result until the response expires.
+func (r *RevocationConfig) checkOCSP(leaf, issuer *x509.Certificate) error {
+	if issuer == nil || len(leaf.OCSPServer) == 0 {
+		return fmt.Errorf("%w: no issuer or ocsp responder", ErrRevocationUnknown)
+	}
+
+	key := string(leaf.RawIssuer) + leaf.SerialNumber.String()
+	r.mu.Lock()
+	if res, ok := r.ocsp[key]; ok && time.Now().Before(res.nextUpdate) {
+		r.mu.Unlock()
+		return res.err
+	}
+	r.mu.Unlock()
+
+	resp, err := r.fetchOCSP(leaf, issuer)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRevocationUnknown, err)
+	}
+
+	switch resp.Status {
+	case ocsp.Good:
+		err = nil
+	case ocsp.Revoked:
+		err = ErrCertificateRevoked
+	default:
+		return fmt.Errorf("%w: ocsp status unknown", ErrRevocationUnknown)
+	}
+
+	if !resp.NextUpdate.IsZero() {
+		r.mu.Lock()
+		if r.ocsp == nil {
+			r.ocsp = map[string]ocspResult{}
+		}
+		r.ocsp[key] = ocspResult{err: err, nextUpdate: resp.NextUpdate}
+		r.mu.Unlock()
+	}
+
+	return err
+}
+
+// fetchOCSP requests the ocsp status of a certificate from its responder.
+func (r *RevocationConfig) fetchOCSP(leaf, issuer *x509.Certificate) (*ocsp.Response, error) {
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	hr, err := r.client().Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer hr.Body.Close()
+
+	if hr.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ocsp responder returned %s", hr.Status)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(hr.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	return ocsp.ParseResponseForCert(b, leaf, issuer)
+}
+
+// staple returns the certificate with an ocsp response stapled, if one is available. Staples
+// are fetched in the background, so handshakes are not delayed by the ocsp responder.
+func (r *RevocationConfig) staple(cert *tls.Certificate) *tls.Certificate {
+	if cert == nil || len(cert.Certificate) < 2 {
+		return cert // the issuer is required to request a staple
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.staples == nil {
+		r.staples = map[*tls.Certificate]*ocspStaple{}
+	}
+
+	s, ok := r.staples[cert]
+	if !ok {
+		s = new(ocspStaple)
+		r.staples[cert] = s
+	}
+
+	if !s.fetching && !now.Before(s.refresh) {
+		s.fetching = true
+		go r.fetchStaple(cert, s)
+	}
+
+	if s.cert != nil && now.Before(s.nextUpdate) {
+		return s.cert
+	}
+
+	return cert
+}
+
+// fetchStaple fetches an ocsp response for a server certificate and stores it in s.
+func (r *RevocationConfig) fetchStaple(cert *tls.Certificate, s *ocspStaple) {
+	var staple *tls.Certificate
+	var next time.Time
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err == nil {
+		var issuer *x509.Certificate
+		issuer, err = x509.ParseCertificate(cert.Certificate[1])
+		if err == nil && len(leaf.OCSPServer) > 0 {
+			var resp *ocsp.Response
+			resp, err = r.fetchOCSP(leaf, issuer)
+			if err == nil && resp.Status == ocsp.Good {
+				c := *cert
+				c.OCSPStaple = resp.Raw
+				staple, next = &c, resp.NextUpdate
+			}
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s.fetching = false
+	now := time.Now()
+	if staple == nil {
+		s.refresh = now.Add(time.Minute) // retry later
+		return
+	}
+
+	if next.IsZero() {
+		next = now.Add(time.Hour)
+	}
+
+	s.cert = staple
+	s.nextUpdate = next
+	s.refresh = now.Add(next.Sub(now) / 2)
+}
@@ -0,0 +1,355 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ocsp"
+)
+
+// testPKI is a certificate authority with an ocsp responder for testing revocation.
+type testPKI struct {
+	ca        *x509.Certificate
+	key       crypto.Signer
+	status    int   // the ocsp status returned by the responder
+	requests  int32 // the number of requests made to the responder
+	responder *httptest.Server
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mochi test ca", SerialNumber: strconv.FormatInt(time.Now().UnixNano(), 10)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, key.Public(), key)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	p := &testPKI{ca: ca, key: key, status: ocsp.Good}
+	p.responder = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&p.requests, 1)
+		b, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(b)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		resp, err := ocsp.CreateResponse(p.ca, p.ca, ocsp.Response{
+			Status:       p.status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+			RevokedAt:    time.Now().Add(-time.Minute),
+		}, p.key)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(resp)
+	}))
+	t.Cleanup(p.responder.Close)
+
+	return p
+}
+
+// issue returns a new certificate issued by the test ca, naming the test ocsp responder.
+func (p *testPKI) issue(t *testing.T, serial int64) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "mochi"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		OCSPServer:   []string{p.responder.URL},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, p.ca, key.Public(), p.key)
+	require.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, p.ca.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+// state returns a tls connection state for a client presenting a certificate.
+func (p *testPKI) state(cert *tls.Certificate) tls.ConnectionState {
+	return tls.ConnectionState{
+		HandshakeComplete: true,
+		PeerCertificates:  []*x509.Certificate{cert.Leaf},
+		VerifiedChains:    [][]*x509.Certificate{{cert.Leaf, p.ca}},
+	}
+}
+
+// crl writes a pem encoded revocation list revoking the serial numbers, and returns its path.
+func (p *testPKI) crl(t *testing.T, serials ...int64) string {
+	rl := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, s := range serials {
+		rl.RevokedCertificateEntries = append(rl.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(s),
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, rl, p.ca, p.key)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "ca.crl")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0600))
+	return path
+}
+
+func TestRevocationCheckNotConfigured(t *testing.T) {
+	var r *RevocationConfig
+	require.NoError(t, r.Check(tls.ConnectionState{}))
+
+	r = new(RevocationConfig)
+	require.NoError(t, r.Check(tls.ConnectionState{})) // no client certificate
+}
+
+func TestRevocationCheckCRL(t *testing.T) {
+	p := newTestPKI(t)
+	r := &RevocationConfig{CRLFiles: []string{p.crl(t, 3)}}
+
+	require.NoError(t, r.Check(p.state(p.issue(t, 2))))
+	require.ErrorIs(t, r.Check(p.state(p.issue(t, 3))), ErrCertificateRevoked)
+}
+
+func TestRevocationCheckCRLOtherIssuer(t *testing.T) {
+	p := newTestPKI(t)
+	other := newTestPKI(t)
+	r := &RevocationConfig{CRLFiles: []string{other.crl(t, 3)}}
+
+	require.NoError(t, r.Check(p.state(p.issue(t, 3))))
+}
+
+func TestRevocationCheckCRLBadSignature(t *testing.T) {
+	p := newTestPKI(t)
+	other := newTestPKI(t)
+	r := &RevocationConfig{CRLFiles: []string{p.crl(t, 3)}}
+
+	cert := p.issue(t, 2)
+	state := p.state(cert)
+	state.VerifiedChains = [][]*x509.Certificate{{cert.Leaf, other.ca}}
+	require.ErrorIs(t, r.Check(state), ErrRevocationUnknown)
+}
+
+func TestRevocationCheckCRLFileErrors(t *testing.T) {
+	p := newTestPKI(t)
+	r := &RevocationConfig{CRLFiles: []string{filepath.Join(t.TempDir(), "missing.crl")}}
+	require.ErrorIs(t, r.Check(p.state(p.issue(t, 2))), ErrRevocationUnknown)
+
+	bad := filepath.Join(t.TempDir(), "bad.crl")
+	require.NoError(t, os.WriteFile(bad, []byte("bad"), 0600))
+	r = &RevocationConfig{CRLFiles: []string{bad}}
+	require.ErrorIs(t, r.Check(p.state(p.issue(t, 2))), ErrRevocationUnknown)
+
+	r = &RevocationConfig{CRLFiles: []string{bad}, SoftFail: true}
+	require.NoError(t, r.Check(p.state(p.issue(t, 2))))
+}
+
+func TestRevocationCheckOCSP(t *testing.T) {
+	p := newTestPKI(t)
+	r := &RevocationConfig{OCSP: true}
+
+	cert := p.issue(t, 2)
+	require.NoError(t, r.Check(p.state(cert)))
+	require.NoError(t, r.Check(p.state(cert)))
+	require.Equal(t, int32(1), atomic.LoadInt32(&p.requests)) // cached until the next update
+
+	p.status = ocsp.Revoked
+	require.ErrorIs(t, r.Check(p.state(p.issue(t, 3))), ErrCertificateRevoked)
+
+	p.status = ocsp.Unknown
+	require.ErrorIs(t, r.Check(p.state(p.issue(t, 4))), ErrRevocationUnknown)
+}
+
+func TestRevocationCheckOCSPUnavailable(t *testing.T) {
+	p := newTestPKI(t)
+	cert := p.issue(t, 2)
+	p.responder.Close()
+
+	r := &RevocationConfig{OCSP: true, Timeout: 1}
+	require.ErrorIs(t, r.Check(p.state(cert)), ErrRevocationUnknown)
+
+	r = &RevocationConfig{OCSP: true, Timeout: 1, SoftFail: true}
+	require.NoError(t, r.Check(p.state(cert)))
+}
+
+func TestRevocationCheckOCSPNoIssuer(t *testing.T) {
+	p := newTestPKI(t)
+	cert := p.issue(t, 2)
+
+	r := &RevocationConfig{OCSP: true}
+	require.ErrorIs(t, r.Check(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert.Leaf}}), ErrRevocationUnknown)
+
+	// the issuer may be taken from the presented chain
+	require.NoError(t, r.Check(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert.Leaf, p.ca}}))
+}
+
+func TestRevocationCheckOCSPResponderError(t *testing.T) {
+	p := newTestPKI(t)
+	cert := p.issue(t, 2)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	cert.Leaf.OCSPServer = []string{failing.URL}
+
+	r := &RevocationConfig{OCSP: true}
+	require.ErrorIs(t, r.Check(p.state(cert)), ErrRevocationUnknown)
+}
+
+func TestRevocationStaple(t *testing.T) {
+	p := newTestPKI(t)
+	cert := p.issue(t, 2)
+	r := &RevocationConfig{OCSPStaple: true}
+
+	require.Nil(t, r.staple(nil))
+	require.Equal(t, cert, r.staple(cert)) // fetched in the background
+
+	require.Eventually(t, func() bool {
+		return len(r.staple(cert).OCSPStaple) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	resp, err := ocsp.ParseResponse(r.staple(cert).OCSPStaple, p.ca)
+	require.NoError(t, err)
+	require.Equal(t, ocsp.Good, resp.Status)
+	require.Empty(t, cert.OCSPStaple) // the original certificate is not modified
+}
+
+func TestRevocationStapleNotGood(t *testing.T) {
+	p := newTestPKI(t)
+	p.status = ocsp.Revoked
+	cert := p.issue(t, 2)
+	r := &RevocationConfig{OCSPStaple: true}
+
+	require.Equal(t, cert, r.staple(cert))
+	require.Eventually(t, func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return !r.staples[cert].fetching
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Empty(t, r.staple(cert).OCSPStaple)
+}
+
+func TestRevocationStapleNoIssuer(t *testing.T) {
+	p := newTestPKI(t)
+	cert := p.issue(t, 2)
+	cert.Certificate = cert.Certificate[:1]
+
+	r := &RevocationConfig{OCSPStaple: true}
+	require.Equal(t, cert, r.staple(cert))
+}
+
+func TestServerTLSConfigRevocation(t *testing.T) {
+	p := newTestPKI(t)
+	cert := p.issue(t, 2)
+
+	config := Config{
+		TLSConfig:  &tls.Config{Certificates: []tls.Certificate{*cert}, MinVersion: tls.VersionTLS12},
+		Revocation: &RevocationConfig{OCSPStaple: true, Enforce: true, CRLFiles: []string{p.crl(t, 3)}},
+	}
+
+	tc := config.ServerTLSConfig()
+	require.NotSame(t, config.TLSConfig, tc)
+	require.NotNil(t, tc.GetCertificate)
+	require.NotNil(t, tc.VerifyConnection)
+
+	require.Eventually(t, func() bool {
+		c, err := tc.GetCertificate(&tls.ClientHelloInfo{})
+		require.NoError(t, err)
+		return len(c.OCSPStaple) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, tc.VerifyConnection(p.state(p.issue(t, 2))))
+	require.ErrorIs(t, tc.VerifyConnection(p.state(p.issue(t, 3))), ErrCertificateRevoked)
+}
+
+func TestServerTLSConfigRevocationVerifyConnection(t *testing.T) {
+	p := newTestPKI(t)
+	config := Config{
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				return ErrInvalidMessage
+			},
+		},
+		Revocation: &RevocationConfig{Enforce: true},
+	}
+
+	tc := config.ServerTLSConfig()
+	require.Nil(t, tc.GetCertificate)
+	require.ErrorIs(t, tc.VerifyConnection(p.state(p.issue(t, 2))), ErrInvalidMessage)
+}
+
+func TestServerTLSConfigRevocationNotEnforced(t *testing.T) {
+	config := Config{
+		TLSConfig:  tlsConfigBasic,
+		Revocation: &RevocationConfig{OCSP: true},
+	}
+
+	require.Same(t, tlsConfigBasic, config.ServerTLSConfig())
+}
+
+func TestTCPCheckRevocation(t *testing.T) {
+	p := newTestPKI(t)
+	config := Config{ID: "t1", Address: testAddr, Revocation: &RevocationConfig{CRLFiles: []string{p.crl(t, 3)}}}
+
+	var rc RevocationChecker = NewTCP(config)
+	require.ErrorIs(t, rc.CheckRevocation(p.state(p.issue(t, 3))), ErrCertificateRevoked)
+
+	rc = NewWebsocket(config)
+	require.ErrorIs(t, rc.CheckRevocation(p.state(p.issue(t, 3))), ErrCertificateRevoked)
+
+	rc = NewWebTransport(config)
+	require.NoError(t, rc.CheckRevocation(p.state(p.issue(t, 2))))
+
+	rc = NewTCP(basicConfig)
+	require.NoError(t, rc.CheckRevocation(p.state(p.issue(t, 3))))
+}
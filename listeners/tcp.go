@@ -5,25 +5,112 @@
 package listeners
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"log/slog"
 )
 
 const TypeTCP = "tcp"
 
+// ErrReusePortUnsupported indicates SO_REUSEPORT acceptors are not available on the platform.
+var ErrReusePortUnsupported = errors.New("SO_REUSEPORT is not supported on this platform")
+
+// TCPConfig contains tcp socket tuning configuration values for a listener.
+// Durations are in seconds, and zero values retain the operating system or Go defaults.
+type TCPConfig struct {
+	// DisableKeepAlive disables tcp keepalive probes on accepted connections.
+	DisableKeepAlive bool `yaml:"disable_keep_alive" json:"disable_keep_alive"`
+	// KeepAliveIdle is the time a connection must be idle before keepalive probes are sent.
+	KeepAliveIdle int `yaml:"keep_alive_idle" json:"keep_alive_idle"`
+	// KeepAliveInterval is the time between keepalive probes.
+	KeepAliveInterval int `yaml:"keep_alive_interval" json:"keep_alive_interval"`
+	// KeepAliveCount is the number of unanswered keepalive probes before the connection is dropped.
+	KeepAliveCount int `yaml:"keep_alive_count" json:"keep_alive_count"`
+	// NoDelay sets TCP_NODELAY, disabling Nagle's algorithm when true. Go enables it by default.
+	NoDelay *bool `yaml:"no_delay" json:"no_delay"`
+	// Linger sets SO_LINGER on accepted connections; see net.TCPConn.SetLinger.
+	Linger *int `yaml:"linger" json:"linger"`
+	// Acceptors is the number of sockets to open on the address using SO_REUSEPORT, each with
+	// its own accept loop, allowing the kernel to balance new connections across them.
+	// A value of 0 or 1 opens a single socket.
+	Acceptors int `yaml:"acceptors" json:"acceptors"`
+}
+
+// acceptors returns the number of sockets which should be opened for the listener.
+func (c *TCPConfig) acceptors() int {
+	if c == nil || c.Acceptors < 1 {
+		return 1
+	}
+
+	return c.Acceptors
+}
+
+// listenConfig returns a net.ListenConfig applying the keepalive settings.
+func (c *TCPConfig) listenConfig() net.ListenConfig {
+	var lc net.ListenConfig
+	if c == nil {
+		return lc
+	}
+
+	if c.DisableKeepAlive {
+		lc.KeepAlive = -1
+		return lc
+	}
+
+	lc.KeepAliveConfig = net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     time.Duration(c.KeepAliveIdle) * time.Second,
+		Interval: time.Duration(c.KeepAliveInterval) * time.Second,
+		Count:    c.KeepAliveCount,
+	}
+
+	return lc
+}
+
+// tunedListener is a net.Listener which applies per-connection tcp settings
+// to each connection it accepts.
+type tunedListener struct {
+	net.Listener
+	config *TCPConfig
+}
+
+// Accept waits for and returns the next connection, with the tcp settings applied.
+func (l *tunedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if tc, ok := conn.(*net.TCPConn); ok {
+		if l.config.NoDelay != nil {
+			_ = tc.SetNoDelay(*l.config.NoDelay)
+		}
+		if l.config.Linger != nil {
+			_ = tc.SetLinger(*l.config.Linger)
+		}
+	}
+
+	return conn, nil
+}
+
 // TCP is a listener for establishing client connections on basic TCP protocol.
 type TCP struct { // [MQTT-4.2.0-1]
 	sync.RWMutex
-	id      string       // the internal id of the listener
-	address string       // the network address to bind to
-	listen  net.Listener // a net.Listener which will listen for new clients
-	config  Config       // configuration values for the listener
-	log     *slog.Logger // server logger
-	end     uint32       // ensure the close methods are only called once
+	id      string             // the internal id of the listener
+	address string             // the network address to bind to
+	listen  net.Listener       // a net.Listener which will listen for new clients
+	extra   []net.Listener     // additional SO_REUSEPORT sockets sharing the address of listen
+	config  Config             // configuration values for the listener
+	limits  *connectionLimiter // limits the connections accepted by the listener
+	filter  *ipFilter          // drops connections from denied remote addresses
+	log     *slog.Logger       // server logger
+	end     uint32             // ensure the close methods are only called once
 }
 
 // NewTCP initializes and returns a new TCP listener, listening on an address.
@@ -32,6 +119,7 @@ func NewTCP(config Config) *TCP {
 		id:      config.ID,
 		address: config.Address,
 		config:  config,
+		limits:  newConnectionLimiter(config),
 	}
 }
 
@@ -53,35 +141,126 @@ func (l *TCP) Protocol() string {
 	return "tcp"
 }
 
+// CheckRevocation checks whether the certificate presented by a client has been revoked,
+// if revocation checking is configured for the listener.
+func (l *TCP) CheckRevocation(state tls.ConnectionState) error {
+	return l.config.Revocation.Check(state)
+}
+
 // Init initializes the listener.
 func (l *TCP) Init(log *slog.Logger) error {
 	l.log = log
 
+	if err := l.config.ValidateTLS(); err != nil {
+		return err
+	}
+
 	var err error
-	if l.config.TLSConfig != nil {
-		l.listen, err = tls.Listen("tcp", l.address, l.config.TLSConfig)
-	} else {
-		l.listen, err = net.Listen("tcp", l.address)
+	l.filter, err = newIPFilter(l.config)
+	if err != nil {
+		return err
+	}
+
+	lc := l.config.TCP.listenConfig()
+	acceptors := l.config.TCP.acceptors()
+	if acceptors > 1 {
+		lc.Control = reusePortControl
+	}
+
+	address, err := l.config.bind(&lc, l.address)
+	if err != nil {
+		return err
 	}
 
-	return err
+	l.listen, err = l.openSocket(lc, address)
+	if err != nil {
+		return err
+	}
+
+	for i := 1; i < acceptors; i++ {
+		// use the bound address, in case the configured address requested an ephemeral port.
+		listen, err := l.openSocket(lc, l.listen.Addr().String())
+		if err != nil {
+			l.closeSockets()
+			return err
+		}
+		l.extra = append(l.extra, listen)
+	}
+
+	return nil
+}
+
+// openSocket opens a listening socket on an address, applying the tcp and tls configuration.
+func (l *TCP) openSocket(lc net.ListenConfig, address string) (net.Listener, error) {
+	listen, err := lc.Listen(context.Background(), "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.filter != nil {
+		listen = &filteredListener{Listener: listen, filter: l.filter, log: l.log}
+	}
+
+	if l.config.TCP != nil && (l.config.TCP.NoDelay != nil || l.config.TCP.Linger != nil) {
+		listen = &tunedListener{Listener: listen, config: l.config.TCP}
+	}
+
+	if tc := l.config.ServerTLSConfig(); tc != nil {
+		listen = tls.NewListener(listen, tc)
+	}
+
+	return listen, nil
+}
+
+// closeSockets closes all the sockets opened by the listener.
+func (l *TCP) closeSockets() {
+	for _, listen := range l.extra {
+		_ = listen.Close()
+	}
+
+	if l.listen != nil {
+		_ = l.listen.Close()
+	}
 }
 
 // Serve starts waiting for new TCP connections, and calls the establish
 // connection callback for any received.
 func (l *TCP) Serve(establish EstablishFn) {
+	var wg sync.WaitGroup
+	for _, listen := range l.extra {
+		wg.Add(1)
+		go func(listen net.Listener) {
+			defer wg.Done()
+			l.accept(listen, establish)
+		}(listen)
+	}
+
+	l.accept(l.listen, establish)
+	wg.Wait()
+}
+
+// accept runs an accept loop on a socket until it is closed.
+func (l *TCP) accept(listen net.Listener, establish EstablishFn) {
 	for {
 		if atomic.LoadUint32(&l.end) == 1 {
 			return
 		}
 
-		conn, err := l.listen.Accept()
+		time.Sleep(l.limits.delay())
+		conn, err := listen.Accept()
 		if err != nil {
 			return
 		}
 
 		if atomic.LoadUint32(&l.end) == 0 {
+			if !l.limits.acquire() {
+				l.log.Warn("listener connection limit reached", "listener", l.id, "remote", conn.RemoteAddr())
+				_ = conn.Close()
+				continue
+			}
+
 			go func() {
+				defer l.limits.release()
 				err = establish(l.id, conn)
 				if err != nil {
 					l.log.Warn("", "error", err)
@@ -100,10 +279,5 @@ func (l *TCP) Close(closeClients CloseFn) {
 		closeClients(l.id)
 	}
 
-	if l.listen != nil {
-		err := l.listen.Close()
-		if err != nil {
-			return
-		}
-	}
+	l.closeSockets()
 }
@@ -5,6 +5,7 @@
 package listeners
 
 import (
+	"crypto/tls"
 	"errors"
 	"net"
 	"testing"
@@ -122,3 +123,188 @@ func TestTCPEstablishThenEnd(t *testing.T) {
 	l.Close(MockCloser)
 	<-o
 }
+
+func TestTCPConfigListenConfig(t *testing.T) {
+	var c *TCPConfig
+	require.Equal(t, net.ListenConfig{}, c.listenConfig())
+
+	c = &TCPConfig{DisableKeepAlive: true, KeepAliveIdle: 30}
+	require.Equal(t, time.Duration(-1), c.listenConfig().KeepAlive)
+	require.False(t, c.listenConfig().KeepAliveConfig.Enable)
+
+	c = &TCPConfig{KeepAliveIdle: 30, KeepAliveInterval: 10, KeepAliveCount: 3}
+	require.Equal(t, net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     30 * time.Second,
+		Interval: 10 * time.Second,
+		Count:    3,
+	}, c.listenConfig().KeepAliveConfig)
+}
+
+func TestTCPInitTuned(t *testing.T) {
+	noDelay := false
+	linger := 0
+	l := NewTCP(Config{
+		ID:      "t1",
+		Address: testAddr,
+		TCP: &TCPConfig{
+			KeepAliveIdle: 30,
+			NoDelay:       &noDelay,
+			Linger:        &linger,
+		},
+	})
+	err := l.Init(logger)
+	require.NoError(t, err)
+	defer l.listen.Close()
+
+	_, ok := l.listen.(*tunedListener)
+	require.True(t, ok)
+
+	o := make(chan net.Conn)
+	go func() {
+		conn, err := l.listen.Accept()
+		require.NoError(t, err)
+		o <- conn
+	}()
+
+	c, err := net.Dial("tcp", l.listen.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+
+	conn := <-o
+	_, ok = conn.(*net.TCPConn)
+	require.True(t, ok)
+	_ = conn.Close()
+}
+
+func TestTCPInitTunedTLS(t *testing.T) {
+	noDelay := true
+	l := NewTCP(Config{
+		ID:        "t1",
+		Address:   testAddr,
+		TLSConfig: tlsConfigBasic,
+		TCP:       &TCPConfig{NoDelay: &noDelay},
+	})
+	err := l.Init(logger)
+	require.NoError(t, err)
+	defer l.listen.Close()
+	_, ok := l.listen.(*tunedListener)
+	require.False(t, ok) // the tuned listener is wrapped by the tls listener
+	require.Equal(t, "tcp", l.listen.Addr().Network())
+}
+
+func TestTCPConfigAcceptors(t *testing.T) {
+	var c *TCPConfig
+	require.Equal(t, 1, c.acceptors())
+	require.Equal(t, 1, (&TCPConfig{}).acceptors())
+	require.Equal(t, 4, (&TCPConfig{Acceptors: 4}).acceptors())
+}
+
+func TestTCPServeReusePort(t *testing.T) {
+	l := NewTCP(Config{ID: "t1", Address: "127.0.0.1:0", TCP: &TCPConfig{Acceptors: 4}})
+	err := l.Init(logger)
+	if errors.Is(err, ErrReusePortUnsupported) {
+		t.Skip(err)
+	}
+	require.NoError(t, err)
+	require.Len(t, l.extra, 3)
+	for _, listen := range l.extra {
+		require.Equal(t, l.Address(), listen.Addr().String())
+	}
+
+	o := make(chan bool)
+	established := make(chan bool, 8)
+	go func() {
+		l.Serve(func(id string, c net.Conn) error {
+			established <- true
+			return nil
+		})
+		o <- true
+	}()
+
+	for i := 0; i < 8; i++ {
+		c, err := net.Dial("tcp", l.Address())
+		require.NoError(t, err)
+		_ = c.Close()
+		require.True(t, <-established)
+	}
+
+	l.Close(MockCloser)
+	<-o // serve returns once every accept loop has ended
+}
+
+func TestTCPInitReusePortAddressInUse(t *testing.T) {
+	n, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer n.Close()
+
+	l := NewTCP(Config{ID: "t1", Address: n.Addr().String(), TCP: &TCPConfig{Acceptors: 2}})
+	err = l.Init(logger)
+	require.Error(t, err) // the existing socket was not opened with SO_REUSEPORT
+}
+
+func TestTCPServeMaxConnections(t *testing.T) {
+	l := NewTCP(Config{ID: "t1", Address: testAddr, MaxConnections: 1})
+	err := l.Init(logger)
+	require.NoError(t, err)
+
+	o := make(chan bool)
+	established := make(chan bool)
+	release := make(chan bool)
+	go func() {
+		l.Serve(func(id string, c net.Conn) error {
+			established <- true
+			<-release
+			return nil
+		})
+		o <- true
+	}()
+
+	time.Sleep(time.Millisecond)
+	first, err := net.Dial("tcp", l.listen.Addr().String())
+	require.NoError(t, err)
+	defer first.Close()
+	require.Equal(t, true, <-established)
+
+	second, err := net.Dial("tcp", l.listen.Addr().String())
+	require.NoError(t, err)
+	defer second.Close()
+	_ = second.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = second.Read(make([]byte, 1))
+	require.Error(t, err) // the over-limit connection is closed by the listener
+
+	release <- true
+	require.Eventually(t, func() bool {
+		return l.limits.acquire()
+	}, time.Second, time.Millisecond)
+
+	l.Close(MockCloser)
+	<-o
+}
+
+func TestTCPServeSNI(t *testing.T) {
+	cert, err := tls.X509KeyPair(testCertificate, testPrivateKey)
+	require.NoError(t, err)
+
+	l := NewTCP(Config{
+		ID:              "t1",
+		Address:         testAddr,
+		TLSCertificates: map[string]*tls.Certificate{"mochi.local": &cert},
+	})
+	err = l.Init(logger)
+	require.NoError(t, err)
+	defer l.Close(MockCloser)
+
+	go l.Serve(func(id string, c net.Conn) error {
+		return c.(*tls.Conn).Handshake()
+	})
+
+	conn, err := tls.Dial("tcp", l.listen.Addr().String(), &tls.Config{
+		ServerName:         "mochi.local",
+		InsecureSkipVerify: true, // nolint:gosec // test certificate
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.Equal(t, cert.Certificate[0], conn.ConnectionState().PeerCertificates[0].Raw)
+}
@@ -0,0 +1,148 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidTLSConfig indicates the tls versions, cipher suites, or curves of a listener are invalid.
+var ErrInvalidTLSConfig = errors.New("invalid listener tls configuration")
+
+// tlsVersions are the tls versions which can be selected by name.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCurves are the curves which can be selected by name.
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// hasTLSSettings returns true if any tls versions, cipher suites, or curves are configured.
+func (c Config) hasTLSSettings() bool {
+	return c.TLSMinVersion != "" || c.TLSMaxVersion != "" || c.TLS13Only ||
+		len(c.TLSCipherSuites) > 0 || len(c.TLSCurvePreferences) > 0
+}
+
+// ValidateTLS returns an error if the tls versions, cipher suites, or curves configured
+// for the listener are unknown, insecure, or contradictory.
+func (c Config) ValidateTLS() error {
+	tc := new(tls.Config)
+	if c.TLSConfig != nil {
+		tc = c.TLSConfig.Clone()
+	}
+
+	_, err := c.tlsSettings(tc)
+	return err
+}
+
+// applyTLSSettings sets the configured tls versions, cipher suites, and curves on tc. Invalid
+// settings are ignored, as they are rejected by ValidateTLS when the listener is initialized.
+func (c Config) applyTLSSettings(tc *tls.Config) {
+	if s, err := c.tlsSettings(tc.Clone()); err == nil {
+		tc.MinVersion = s.MinVersion
+		tc.MaxVersion = s.MaxVersion
+		tc.CipherSuites = s.CipherSuites
+		tc.CurvePreferences = s.CurvePreferences
+	}
+}
+
+// tlsSettings parses the configured tls versions, cipher suites, and curves into tc.
+func (c Config) tlsSettings(tc *tls.Config) (*tls.Config, error) {
+	var err error
+	if c.TLSMinVersion != "" {
+		if tc.MinVersion, err = parseTLSVersion(c.TLSMinVersion); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.TLSMaxVersion != "" {
+		if tc.MaxVersion, err = parseTLSVersion(c.TLSMaxVersion); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.TLS13Only {
+		if c.TLSMinVersion != "" && tc.MinVersion != tls.VersionTLS13 {
+			return nil, fmt.Errorf("%w: minimum version %s conflicts with tls 1.3 only", ErrInvalidTLSConfig, c.TLSMinVersion)
+		}
+
+		if c.TLSMaxVersion != "" && tc.MaxVersion != tls.VersionTLS13 {
+			return nil, fmt.Errorf("%w: maximum version %s conflicts with tls 1.3 only", ErrInvalidTLSConfig, c.TLSMaxVersion)
+		}
+
+		if len(c.TLSCipherSuites) > 0 {
+			return nil, fmt.Errorf("%w: tls 1.3 cipher suites are not configurable", ErrInvalidTLSConfig)
+		}
+
+		tc.MinVersion = tls.VersionTLS13
+	}
+
+	if tc.MinVersion != 0 && tc.MaxVersion != 0 && tc.MinVersion > tc.MaxVersion {
+		return nil, fmt.Errorf("%w: minimum version %s is above maximum version %s", ErrInvalidTLSConfig, c.TLSMinVersion, c.TLSMaxVersion)
+	}
+
+	if len(c.TLSCipherSuites) > 0 {
+		tc.CipherSuites = make([]uint16, 0, len(c.TLSCipherSuites))
+		for _, name := range c.TLSCipherSuites {
+			id, err := parseCipherSuite(name)
+			if err != nil {
+				return nil, err
+			}
+			tc.CipherSuites = append(tc.CipherSuites, id)
+		}
+	}
+
+	if len(c.TLSCurvePreferences) > 0 {
+		tc.CurvePreferences = make([]tls.CurveID, 0, len(c.TLSCurvePreferences))
+		for _, name := range c.TLSCurvePreferences {
+			curve, ok := tlsCurves[strings.ToUpper(strings.ReplaceAll(name, "-", ""))]
+			if !ok {
+				return nil, fmt.Errorf("%w: unknown curve %s", ErrInvalidTLSConfig, name)
+			}
+			tc.CurvePreferences = append(tc.CurvePreferences, curve)
+		}
+	}
+
+	return tc, nil
+}
+
+// parseTLSVersion returns the tls version for a version name, e.g. 1.2 or TLS1.2.
+func parseTLSVersion(name string) (uint16, error) {
+	v, ok := tlsVersions[strings.TrimPrefix(strings.ToUpper(name), "TLS")]
+	if !ok {
+		return 0, fmt.Errorf("%w: unknown version %s", ErrInvalidTLSConfig, name)
+	}
+
+	return v, nil
+}
+
+// parseCipherSuite returns the id of a secure cipher suite by its IANA name,
+// e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+func parseCipherSuite(name string) (uint16, error) {
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name == name {
+			return cs.ID, nil
+		}
+	}
+
+	for _, cs := range tls.InsecureCipherSuites() {
+		if cs.Name == name {
+			return 0, fmt.Errorf("%w: insecure cipher suite %s", ErrInvalidTLSConfig, name)
+		}
+	}
+
+	return 0, fmt.Errorf("%w: unknown cipher suite %s", ErrInvalidTLSConfig, name)
+}
@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigValidateTLS(t *testing.T) {
+	tt := []struct {
+		desc   string
+		config Config
+		err    bool
+	}{
+		{desc: "none", config: Config{}},
+		{desc: "versions", config: Config{TLSMinVersion: "1.2", TLSMaxVersion: "TLS1.3"}},
+		{desc: "unknown min version", config: Config{TLSMinVersion: "2.0"}, err: true},
+		{desc: "unknown max version", config: Config{TLSMaxVersion: "ssl3"}, err: true},
+		{desc: "min above max", config: Config{TLSMinVersion: "1.3", TLSMaxVersion: "1.2"}, err: true},
+		{desc: "max below tls config min", config: Config{TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12}, TLSMaxVersion: "1.1"}, err: true},
+		{desc: "tls 1.3 only", config: Config{TLS13Only: true, TLSMinVersion: "1.3"}},
+		{desc: "tls 1.3 only min conflict", config: Config{TLS13Only: true, TLSMinVersion: "1.2"}, err: true},
+		{desc: "tls 1.3 only max conflict", config: Config{TLS13Only: true, TLSMaxVersion: "1.2"}, err: true},
+		{desc: "tls 1.3 only cipher suites", config: Config{TLS13Only: true, TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}, err: true},
+		{desc: "cipher suites", config: Config{TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"}}},
+		{desc: "insecure cipher suite", config: Config{TLSCipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, err: true},
+		{desc: "unknown cipher suite", config: Config{TLSCipherSuites: []string{"TLS_MOCHI"}}, err: true},
+		{desc: "curves", config: Config{TLSCurvePreferences: []string{"X25519", "P-256", "p384"}}},
+		{desc: "unknown curve", config: Config{TLSCurvePreferences: []string{"P224"}}, err: true},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			err := tx.config.ValidateTLS()
+			if tx.err {
+				require.ErrorIs(t, err, ErrInvalidTLSConfig)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestServerTLSConfigSettings(t *testing.T) {
+	c := Config{
+		TLSConfig:           tlsConfigBasic,
+		TLSMinVersion:       "1.2",
+		TLSMaxVersion:       "1.2",
+		TLSCipherSuites:     []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+		TLSCurvePreferences: []string{"P256", "X25519"},
+	}
+
+	tc := c.ServerTLSConfig()
+	require.NotSame(t, tlsConfigBasic, tc)
+	require.Equal(t, uint16(tls.VersionTLS12), tc.MinVersion)
+	require.Equal(t, uint16(tls.VersionTLS12), tc.MaxVersion)
+	require.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, tc.CipherSuites)
+	require.Equal(t, []tls.CurveID{tls.CurveP256, tls.X25519}, tc.CurvePreferences)
+	require.Equal(t, tlsConfigBasic.Certificates, tc.Certificates)
+	require.Nil(t, tlsConfigBasic.CipherSuites)
+}
+
+func TestServerTLSConfigSettingsTLS13Only(t *testing.T) {
+	c := Config{TLSConfig: tlsConfigBasic, TLS13Only: true}
+	tc := c.ServerTLSConfig()
+	require.Equal(t, uint16(tls.VersionTLS13), tc.MinVersion)
+}
+
+func TestServerTLSConfigSettingsInvalidIgnored(t *testing.T) {
+	c := Config{TLSConfig: tlsConfigBasic, TLSMinVersion: "2.0"}
+	tc := c.ServerTLSConfig()
+	require.Equal(t, tlsConfigBasic.MinVersion, tc.MinVersion)
+}
+
+func TestTCPInitInvalidTLSSettings(t *testing.T) {
+	l := NewTCP(Config{ID: "t1", Address: "127.0.0.1:0", TLSConfig: tlsConfigBasic, TLSMinVersion: "2.0"})
+	err := l.Init(logger)
+	require.ErrorIs(t, err, ErrInvalidTLSConfig)
+}
+
+func TestTCPServeTLS13Only(t *testing.T) {
+	l := NewTCP(Config{ID: "t1", Address: "127.0.0.1:0", TLSConfig: tlsConfigBasic, TLS13Only: true})
+	require.NoError(t, l.Init(logger))
+	defer l.Close(MockCloser)
+	go l.Serve(func(id string, c net.Conn) error {
+		return c.(*tls.Conn).Handshake()
+	})
+
+	_, err := tls.Dial("tcp", l.Address(), &tls.Config{
+		InsecureSkipVerify: true, // nolint:gosec // test certificate
+		MaxVersion:         tls.VersionTLS12,
+	})
+	require.Error(t, err)
+
+	conn, err := tls.Dial("tcp", l.Address(), &tls.Config{
+		InsecureSkipVerify: true, // nolint:gosec // test certificate
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, uint16(tls.VersionTLS13), conn.ConnectionState().Version)
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"log/slog"
 )
@@ -18,12 +19,13 @@ const TypeUnix = "unix"
 // UnixSock is a listener for establishing client connections on basic UnixSock protocol.
 type UnixSock struct {
 	sync.RWMutex
-	id      string       // the internal id of the listener.
-	address string       // the network address to bind to.
-	config  Config       // configuration values for the listener
-	listen  net.Listener // a net.Listener which will listen for new clients.
-	log     *slog.Logger // server logger
-	end     uint32       // ensure the close methods are only called once.
+	id      string             // the internal id of the listener.
+	address string             // the network address to bind to.
+	config  Config             // configuration values for the listener
+	limits  *connectionLimiter // limits the connections accepted by the listener
+	listen  net.Listener       // a net.Listener which will listen for new clients.
+	log     *slog.Logger       // server logger
+	end     uint32             // ensure the close methods are only called once.
 }
 
 // NewUnixSock initializes and returns a new UnixSock listener, listening on an address.
@@ -32,6 +34,7 @@ func NewUnixSock(config Config) *UnixSock {
 		id:      config.ID,
 		address: config.Address,
 		config:  config,
+		limits:  newConnectionLimiter(config),
 	}
 }
 
@@ -68,13 +71,21 @@ func (l *UnixSock) Serve(establish EstablishFn) {
 			return
 		}
 
+		time.Sleep(l.limits.delay())
 		conn, err := l.listen.Accept()
 		if err != nil {
 			return
 		}
 
 		if atomic.LoadUint32(&l.end) == 0 {
+			if !l.limits.acquire() {
+				l.log.Warn("listener connection limit reached", "listener", l.id, "remote", conn.RemoteAddr())
+				_ = conn.Close()
+				continue
+			}
+
 			go func() {
+				defer l.limits.release()
 				err = establish(l.id, conn)
 				if err != nil {
 					l.log.Warn("", "error", err)
@@ -6,10 +6,12 @@ package listeners
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -26,12 +28,26 @@ var (
 	ErrInvalidMessage = errors.New("message type not binary")
 )
 
+// WebsocketConfig contains websocket specific configuration values for a listener.
+type WebsocketConfig struct {
+	// AllowedOrigins is a list of origins (e.g. https://example.com) which are permitted to
+	// connect. A value of "*" allows any origin. If empty, all origins are allowed.
+	AllowedOrigins []string `yaml:"allowed_origins" json:"allowed_origins"`
+	// CheckOrigin is an optional callback which overrides AllowedOrigins when deciding
+	// if a connection from a given request origin should be accepted.
+	CheckOrigin func(r *http.Request) bool `yaml:"-" json:"-"`
+	// RequireSubprotocol rejects any connection which does not request the mqtt subprotocol.
+	RequireSubprotocol bool `yaml:"require_subprotocol" json:"require_subprotocol"`
+}
+
 // Websocket is a listener for establishing websocket connections.
 type Websocket struct { // [MQTT-4.2.0-1]
 	sync.RWMutex
 	id        string              // the internal id of the listener
 	address   string              // the network address to bind to
 	config    Config              // configuration values for the listener
+	limits    *connectionLimiter  // limits the connections accepted by the listener
+	filter    *ipFilter           // refuses connections from denied remote addresses
 	listen    *http.Server        // a http server for serving websocket connections
 	log       *slog.Logger        // server logger
 	establish EstablishFn         // the server's establish connection handler
@@ -41,17 +57,69 @@ type Websocket struct { // [MQTT-4.2.0-1]
 
 // NewWebsocket initializes and returns a new Websocket listener, listening on an address.
 func NewWebsocket(config Config) *Websocket {
-	return &Websocket{
+	l := &Websocket{
 		id:      config.ID,
 		address: config.Address,
 		config:  config,
-		upgrader: &websocket.Upgrader{
-			Subprotocols: []string{"mqtt"},
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
-		},
+		limits:  newConnectionLimiter(config),
+	}
+
+	l.upgrader = &websocket.Upgrader{
+		Subprotocols: []string{"mqtt"},
+		CheckOrigin:  l.checkOrigin,
+	}
+
+	return l
+}
+
+// checkOrigin returns true if the origin of the request is permitted to connect.
+func (l *Websocket) checkOrigin(r *http.Request) bool {
+	return allowedOrigin(l.config.Websocket, r)
+}
+
+// allowedOrigin returns true if the origin of a browser request is permitted by the
+// origin settings of a websocket config.
+func allowedOrigin(wc *WebsocketConfig, r *http.Request) bool {
+	if wc == nil {
+		return true
+	}
+
+	if wc.CheckOrigin != nil {
+		return wc.CheckOrigin(r)
+	}
+
+	if len(wc.AllowedOrigins) == 0 {
+		return true
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true // not a browser request
 	}
+
+	for _, allowed := range wc.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasSubprotocol returns true if the request asks for the mqtt subprotocol, or
+// if the subprotocol is not required by the listener.
+func (l *Websocket) hasSubprotocol(r *http.Request) bool {
+	if l.config.Websocket == nil || !l.config.Websocket.RequireSubprotocol {
+		return true
+	}
+
+	for _, p := range websocket.Subprotocols(r) {
+		if p == "mqtt" {
+			return true
+		}
+	}
+
+	return false
 }
 
 // ID returns the id of the listener.
@@ -66,23 +134,39 @@ func (l *Websocket) Address() string {
 
 // Protocol returns the address of the listener.
 func (l *Websocket) Protocol() string {
-	if l.config.TLSConfig != nil {
+	if l.config.tlsEnabled() {
 		return "wss"
 	}
 
 	return "ws"
 }
 
+// CheckRevocation checks whether the certificate presented by a client has been revoked,
+// if revocation checking is configured for the listener.
+func (l *Websocket) CheckRevocation(state tls.ConnectionState) error {
+	return l.config.Revocation.Check(state)
+}
+
 // Init initializes the listener.
 func (l *Websocket) Init(log *slog.Logger) error {
 	l.log = log
 
+	if err := l.config.ValidateTLS(); err != nil {
+		return err
+	}
+
+	var err error
+	l.filter, err = newIPFilter(l.config)
+	if err != nil {
+		return err
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", l.handler)
 	l.listen = &http.Server{
 		Addr:         l.address,
 		Handler:      mux,
-		TLSConfig:    l.config.TLSConfig,
+		TLSConfig:    l.config.ServerTLSConfig(),
 		ReadTimeout:  60 * time.Second,
 		WriteTimeout: 60 * time.Second,
 	}
@@ -92,6 +176,28 @@ func (l *Websocket) Init(log *slog.Logger) error {
 
 // handler upgrades and handles an incoming websocket connection.
 func (l *Websocket) handler(w http.ResponseWriter, r *http.Request) {
+	if !l.filter.allowed(r.RemoteAddr) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if !l.hasSubprotocol(r) {
+		http.Error(w, "mqtt subprotocol required", http.StatusBadRequest)
+		return
+	}
+
+	if !l.limits.allow() {
+		http.Error(w, "connection rate exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	if !l.limits.acquire() {
+		l.log.Warn("listener connection limit reached", "listener", l.id, "remote", r.RemoteAddr)
+		http.Error(w, "connection limit reached", http.StatusServiceUnavailable)
+		return
+	}
+	defer l.limits.release()
+
 	c, err := l.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return
@@ -193,6 +299,16 @@ func (ws *wsConn) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
+// ConnectionState returns the tls connection state of the underlying connection, if the
+// websocket was established over tls. Otherwise, an empty state is returned.
+func (ws *wsConn) ConnectionState() tls.ConnectionState {
+	if tc, ok := ws.Conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		return tc.ConnectionState()
+	}
+
+	return tls.ConnectionState{}
+}
+
 // Close signals the underlying websocket conn to close.
 func (ws *wsConn) Close() error {
 	return ws.Conn.Close()
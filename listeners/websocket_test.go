@@ -171,3 +171,155 @@ func TestWebsocketConnectionReads(t *testing.T) {
 	s.Close()
 	_ = ws.Close()
 }
+
+func TestWebsocketConnectionStateNoTLS(t *testing.T) {
+	r, _ := net.Pipe()
+	ws := &wsConn{Conn: r}
+	require.False(t, ws.ConnectionState().HandshakeComplete)
+}
+
+func TestWebsocketCheckOrigin(t *testing.T) {
+	l := NewWebsocket(basicConfig)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Origin", "https://evil.example")
+	require.True(t, l.checkOrigin(r))
+
+	l = NewWebsocket(Config{
+		ID:      "t1",
+		Address: testAddr,
+		Websocket: &WebsocketConfig{
+			AllowedOrigins: []string{"https://mochi.example"},
+		},
+	})
+	require.False(t, l.checkOrigin(r))
+
+	r.Header.Set("Origin", "https://MOCHI.example")
+	require.True(t, l.checkOrigin(r))
+
+	r.Header.Del("Origin")
+	require.True(t, l.checkOrigin(r))
+
+	l.config.Websocket.AllowedOrigins = []string{"*"}
+	r.Header.Set("Origin", "https://evil.example")
+	require.True(t, l.checkOrigin(r))
+}
+
+func TestWebsocketCheckOriginCallback(t *testing.T) {
+	l := NewWebsocket(Config{
+		ID:      "t1",
+		Address: testAddr,
+		Websocket: &WebsocketConfig{
+			AllowedOrigins: []string{"*"},
+			CheckOrigin: func(r *http.Request) bool {
+				return r.Header.Get("Origin") == "https://mochi.example"
+			},
+		},
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Origin", "https://evil.example")
+	require.False(t, l.checkOrigin(r))
+
+	r.Header.Set("Origin", "https://mochi.example")
+	require.True(t, l.checkOrigin(r))
+}
+
+func TestWebsocketUpgradeOriginRejected(t *testing.T) {
+	l := NewWebsocket(Config{
+		ID:      "t1",
+		Address: testAddr,
+		Websocket: &WebsocketConfig{
+			AllowedOrigins: []string{"https://mochi.example"},
+		},
+	})
+	_ = l.Init(logger)
+
+	s := httptest.NewServer(http.HandlerFunc(l.handler))
+	defer s.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), http.Header{
+		"Origin": []string{"https://evil.example"},
+	})
+	require.Error(t, err)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestWebsocketUpgradeSubprotocolRequired(t *testing.T) {
+	l := NewWebsocket(Config{
+		ID:      "t1",
+		Address: testAddr,
+		Websocket: &WebsocketConfig{
+			RequireSubprotocol: true,
+		},
+	})
+	_ = l.Init(logger)
+
+	e := make(chan bool, 1)
+	l.establish = func(id string, c net.Conn) error {
+		e <- true
+		return nil
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(l.handler))
+	defer s.Close()
+
+	url := "ws" + strings.TrimPrefix(s.URL, "http")
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	dialer := &websocket.Dialer{Subprotocols: []string{"mqtt"}}
+	ws, _, err := dialer.Dial(url, nil)
+	require.NoError(t, err)
+	require.Equal(t, "mqtt", ws.Subprotocol())
+	require.True(t, <-e)
+	_ = ws.Close()
+}
+
+func TestWebsocketUpgradeMaxConnections(t *testing.T) {
+	l := NewWebsocket(Config{ID: "t1", Address: testAddr, MaxConnections: 1})
+	_ = l.Init(logger)
+
+	e := make(chan bool, 1)
+	release := make(chan bool)
+	l.establish = func(id string, c net.Conn) error {
+		e <- true
+		<-release
+		return nil
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(l.handler))
+	defer s.Close()
+
+	url := "ws" + strings.TrimPrefix(s.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	require.True(t, <-e)
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	release <- true
+	_ = ws.Close()
+}
+
+func TestWebsocketUpgradeAcceptRate(t *testing.T) {
+	l := NewWebsocket(Config{ID: "t1", Address: testAddr, AcceptRate: 1})
+	_ = l.Init(logger)
+	l.establish = func(id string, c net.Conn) error {
+		return nil
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(l.handler))
+	defer s.Close()
+
+	url := "ws" + strings.TrimPrefix(s.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	_ = ws.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
@@ -0,0 +1,226 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+const TypeWebTransport = "webtransport"
+
+var (
+	// ErrWebTransportTLSRequired indicates that a webtransport listener was configured without tls.
+	ErrWebTransportTLSRequired = errors.New("webtransport listener requires tls")
+)
+
+// WebTransport is a listener for establishing WebTransport (HTTP/3) connections. Each
+// session carries mqtt packets on the first bidirectional stream opened by the client,
+// in the same way as the binary messages of a websocket connection.
+type WebTransport struct {
+	sync.RWMutex
+	id        string               // the internal id of the listener
+	address   string               // the network address to bind to
+	config    Config               // configuration values for the listener
+	limits    *connectionLimiter   // limits the connections accepted by the listener
+	filter    *ipFilter            // refuses sessions from denied remote addresses
+	conn      net.PacketConn       // the udp socket serving quic connections
+	listen    *webtransport.Server // a http/3 server for serving webtransport sessions
+	log       *slog.Logger         // server logger
+	establish EstablishFn          // the server's establish connection handler
+	end       uint32               // ensure the close methods are only called once
+}
+
+// NewWebTransport initializes and returns a new WebTransport listener, listening on an address.
+// The listener must be configured with tls. Origins are checked against the websocket config,
+// if set.
+func NewWebTransport(config Config) *WebTransport {
+	return &WebTransport{
+		id:      config.ID,
+		address: config.Address,
+		config:  config,
+		limits:  newConnectionLimiter(config),
+	}
+}
+
+// ID returns the id of the listener.
+func (l *WebTransport) ID() string {
+	return l.id
+}
+
+// Address returns the address of the listener.
+func (l *WebTransport) Address() string {
+	if l.conn != nil {
+		return l.conn.LocalAddr().String()
+	}
+	return l.address
+}
+
+// Protocol returns the address of the listener.
+func (l *WebTransport) Protocol() string {
+	return "webtransport"
+}
+
+// CheckRevocation checks whether the certificate presented by a client has been revoked,
+// if revocation checking is configured for the listener.
+func (l *WebTransport) CheckRevocation(state tls.ConnectionState) error {
+	return l.config.Revocation.Check(state)
+}
+
+// Init initializes the listener.
+func (l *WebTransport) Init(log *slog.Logger) error {
+	l.log = log
+
+	if err := l.config.ValidateTLS(); err != nil {
+		return err
+	}
+
+	tc := l.config.ServerTLSConfig()
+	if tc == nil {
+		return ErrWebTransportTLSRequired
+	}
+
+	var err error
+	l.filter, err = newIPFilter(l.config)
+	if err != nil {
+		return err
+	}
+
+	var lc net.ListenConfig
+	address, err := l.config.bind(&lc, l.address)
+	if err != nil {
+		return err
+	}
+
+	l.conn, err = lc.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", l.handler)
+	l.listen = &webtransport.Server{
+		H3: http3.Server{
+			Handler:   mux,
+			TLSConfig: http3.ConfigureTLSConfig(tc),
+		},
+		CheckOrigin: l.checkOrigin,
+	}
+
+	return nil
+}
+
+// checkOrigin returns true if the origin of the request is permitted to connect.
+func (l *WebTransport) checkOrigin(r *http.Request) bool {
+	return allowedOrigin(l.config.Websocket, r)
+}
+
+// handler upgrades and handles an incoming webtransport session.
+func (l *WebTransport) handler(w http.ResponseWriter, r *http.Request) {
+	if !l.filter.allowed(r.RemoteAddr) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if !l.limits.allow() {
+		http.Error(w, "connection rate exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	if !l.limits.acquire() {
+		l.log.Warn("listener connection limit reached", "listener", l.id, "remote", r.RemoteAddr)
+		http.Error(w, "connection limit reached", http.StatusServiceUnavailable)
+		return
+	}
+	defer l.limits.release()
+
+	session, err := l.listen.Upgrade(w, r)
+	if err != nil {
+		l.log.Debug("failed to upgrade webtransport session", "error", err, "listener", l.id, "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	stream, err := session.AcceptStream(session.Context())
+	if err != nil {
+		_ = session.CloseWithError(0, "")
+		return
+	}
+
+	c := &wtConn{Stream: stream, session: session}
+	defer c.Close()
+
+	err = l.establish(l.id, c)
+	if err != nil {
+		l.log.Warn("", "error", err)
+	}
+}
+
+// Serve starts waiting for new WebTransport sessions, and calls the connection
+// establishment callback for any received.
+func (l *WebTransport) Serve(establish EstablishFn) {
+	l.establish = establish
+
+	err := l.listen.Serve(l.conn)
+
+	// After the listener has been shutdown, no need to print the http.ErrServerClosed error.
+	if err != nil && atomic.LoadUint32(&l.end) == 0 {
+		l.log.Error("failed to serve.", "error", err, "listener", l.id)
+	}
+}
+
+// Close closes the listener and any client connections.
+func (l *WebTransport) Close(closeClients CloseFn) {
+	l.Lock()
+	defer l.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		if l.listen != nil {
+			_ = l.listen.Close()
+		}
+		if l.conn != nil {
+			_ = l.conn.Close()
+		}
+	}
+
+	closeClients(l.id)
+}
+
+// wtConn is a webtransport stream which satisfies the net.Conn interface.
+type wtConn struct {
+	webtransport.Stream
+	session *webtransport.Session
+}
+
+// LocalAddr returns the local address of the webtransport session.
+func (c *wtConn) LocalAddr() net.Addr {
+	return c.session.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the webtransport session.
+func (c *wtConn) RemoteAddr() net.Addr {
+	return c.session.RemoteAddr()
+}
+
+// ConnectionState returns the tls connection state of the underlying quic connection.
+func (c *wtConn) ConnectionState() tls.ConnectionState {
+	return c.session.ConnectionState().TLS
+}
+
+// Close closes the stream and the webtransport session.
+func (c *wtConn) Close() error {
+	c.Stream.CancelRead(0)
+	_ = c.Stream.Close()
+	return c.session.CloseWithError(0, "")
+}
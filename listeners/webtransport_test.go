@@ -0,0 +1,147 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestWebTransport(t *testing.T, config Config) *WebTransport {
+	config.ID = "t1"
+	config.Address = "127.0.0.1:0"
+	config.TLSConfig = tlsConfigBasic
+
+	l := NewWebTransport(config)
+	require.NoError(t, l.Init(logger))
+	return l
+}
+
+func dialTestWebTransport(t *testing.T, l *WebTransport, header http.Header) (*http.Response, *webtransport.Session, error) {
+	d := webtransport.Dialer{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // #nosec G402 -- test certificate
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return d.Dial(ctx, "https://"+l.Address()+"/", header)
+}
+
+func TestNewWebTransport(t *testing.T) {
+	l := NewWebTransport(basicConfig)
+	require.Equal(t, "t1", l.id)
+	require.Equal(t, testAddr, l.address)
+	require.Equal(t, "t1", l.ID())
+	require.Equal(t, testAddr, l.Address())
+	require.Equal(t, "webtransport", l.Protocol())
+}
+
+func TestWebTransportInitTLSRequired(t *testing.T) {
+	l := NewWebTransport(basicConfig)
+	require.ErrorIs(t, l.Init(logger), ErrWebTransportTLSRequired)
+}
+
+func TestWebTransportInitBadAddress(t *testing.T) {
+	l := NewWebTransport(Config{ID: "t1", Address: "bad_address", TLSConfig: tlsConfigBasic})
+	require.Error(t, l.Init(logger))
+}
+
+func TestWebTransportServeAndClose(t *testing.T) {
+	l := newTestWebTransport(t, Config{})
+
+	o := make(chan bool)
+	go func(o chan bool) {
+		l.Serve(MockEstablisher)
+		o <- true
+	}(o)
+
+	time.Sleep(time.Millisecond)
+
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+
+	require.True(t, closed)
+	<-o
+
+	l.Close(MockCloser) // coverage: close twice
+}
+
+func TestWebTransportEstablish(t *testing.T) {
+	l := newTestWebTransport(t, Config{})
+	defer l.Close(MockCloser)
+
+	established := make(chan net.Conn, 1)
+	read := make(chan struct{})
+	go l.Serve(func(id string, c net.Conn) error {
+		established <- c
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return err
+		}
+		if _, err := c.Write(buf); err != nil {
+			return err
+		}
+		<-read // closing the conn closes the session, so wait until the echo has been read
+		return nil
+	})
+
+	resp, session, err := dialTestWebTransport(t, l, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	defer session.CloseWithError(0, "")
+
+	stream, err := session.OpenStream()
+	require.NoError(t, err)
+	_, err = stream.Write([]byte{0x10, 0x02, 0x00, 0x00})
+	require.NoError(t, err)
+
+	c := <-established
+	require.NotNil(t, c.RemoteAddr())
+	require.Equal(t, l.Address(), c.LocalAddr().String())
+	require.True(t, c.(*wtConn).ConnectionState().HandshakeComplete)
+
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(stream, buf)
+	close(read)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x10, 0x02, 0x00, 0x00}, buf)
+}
+
+func TestWebTransportOriginRejected(t *testing.T) {
+	l := newTestWebTransport(t, Config{
+		Websocket: &WebsocketConfig{AllowedOrigins: []string{"https://allowed.example.com"}},
+	})
+	defer l.Close(MockCloser)
+	go l.Serve(MockEstablisher)
+
+	resp, _, err := dialTestWebTransport(t, l, http.Header{"Origin": []string{"https://evil.example.com"}})
+	require.Error(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestWebTransportHandlerLimits(t *testing.T) {
+	l := newTestWebTransport(t, Config{MaxConnections: 1, AcceptRate: 1})
+	defer l.Close(MockCloser)
+
+	require.True(t, l.limits.acquire())
+	w := httptest.NewRecorder()
+	l.handler(w, httptest.NewRequest(http.MethodConnect, "/", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	w = httptest.NewRecorder()
+	l.handler(w, httptest.NewRequest(http.MethodConnect, "/", nil))
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+}
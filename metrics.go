@@ -0,0 +1,162 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// hookLatencyBuckets is the number of latency histogram buckets of each hook event. Bucket 0
+// counts calls under 1µs, and each bucket k counts calls from 2^(k-1)µs up to 2^kµs, with the
+// last bucket counting all slower calls.
+const hookLatencyBuckets = 32
+
+// hookEventNames are the names of the hook events, keyed on event.
+var hookEventNames = [...]string{
+	OnSysInfoTick:         "OnSysInfoTick",
+	OnStarted:             "OnStarted",
+	OnStopped:             "OnStopped",
+	OnConnectAuthenticate: "OnConnectAuthenticate",
+	OnACLCheck:            "OnACLCheck",
+	OnACLActionCheck:      "OnACLActionCheck",
+	OnACLDenied:           "OnACLDenied",
+	OnPublishQuota:        "OnPublishQuota",
+	OnQuotaExceeded:       "OnQuotaExceeded",
+	OnConnect:             "OnConnect",
+	OnSessionEstablish:    "OnSessionEstablish",
+	OnSessionEstablished:  "OnSessionEstablished",
+	OnSessionTakenOver:    "OnSessionTakenOver",
+	OnDisconnect:          "OnDisconnect",
+	OnKeepAliveTimeout:    "OnKeepAliveTimeout",
+	OnAuthPacket:          "OnAuthPacket",
+	OnEnhancedAuth:        "OnEnhancedAuth",
+	OnAuthFailed:          "OnAuthFailed",
+	OnPacketRead:          "OnPacketRead",
+	OnPacketEncode:        "OnPacketEncode",
+	OnPacketSent:          "OnPacketSent",
+	OnPacketWritten:       "OnPacketWritten",
+	OnPacketProcessed:     "OnPacketProcessed",
+	OnSubscribe:           "OnSubscribe",
+	OnSubscribeFilter:     "OnSubscribeFilter",
+	OnSubscribed:          "OnSubscribed",
+	OnSelectSubscribers:   "OnSelectSubscribers",
+	OnUnsubscribe:         "OnUnsubscribe",
+	OnUnsubscribed:        "OnUnsubscribed",
+	OnPublish:             "OnPublish",
+	OnPublished:           "OnPublished",
+	OnPublishDropped:      "OnPublishDropped",
+	OnMessageDropped:      "OnMessageDropped",
+	OnRetainMessage:       "OnRetainMessage",
+	OnRetainPublished:     "OnRetainPublished",
+	OnRetainedDelivered:   "OnRetainedDelivered",
+	OnQosPublish:          "OnQosPublish",
+	OnQosComplete:         "OnQosComplete",
+	OnQosDropped:          "OnQosDropped",
+	OnQueuedMessage:       "OnQueuedMessage",
+	OnPacketIDExhausted:   "OnPacketIDExhausted",
+	OnWill:                "OnWill",
+	OnWillSent:            "OnWillSent",
+	OnClientExpired:       "OnClientExpired",
+	OnRetainedExpired:     "OnRetainedExpired",
+	OnListenerConnection:  "OnListenerConnection",
+}
+
+// HookMetrics contains the call metrics of an event of a hook. Latencies are in microseconds,
+// and the percentiles are the upper bounds of the histogram buckets they fall in.
+type HookMetrics struct {
+	Calls  int64 `json:"calls"`  // the number of calls to the hook
+	Errors int64 `json:"errors"` // the number of calls which panicked, timed out or returned an error
+	Mean   int64 `json:"mean"`   // the mean latency of the calls
+	P50    int64 `json:"p50"`    // the median latency of the calls
+	P95    int64 `json:"p95"`    // the 95th percentile latency of the calls
+	P99    int64 `json:"p99"`    // the 99th percentile latency of the calls
+}
+
+// eventMetrics records the calls of an event of a hook.
+type eventMetrics struct {
+	calls   atomic.Int64
+	errors  atomic.Int64
+	total   atomic.Int64 // the total nanoseconds of the calls
+	buckets [hookLatencyBuckets]atomic.Int64
+}
+
+// hookMetrics records the calls of each event of a hook.
+type hookMetrics struct {
+	events [len(hookEventNames)]eventMetrics
+}
+
+// record records a call of an event which took d, and whether it failed.
+func (m *hookMetrics) record(event byte, d time.Duration, failed bool) {
+	if int(event) >= len(m.events) {
+		return
+	}
+
+	e := &m.events[event]
+	e.calls.Add(1)
+	e.total.Add(int64(d))
+	e.buckets[min(bits.Len64(uint64(d/time.Microsecond)), hookLatencyBuckets-1)].Add(1)
+	if failed {
+		e.errors.Add(1)
+	}
+}
+
+// failed records a failed call of an event which has already been recorded.
+func (m *hookMetrics) failed(event byte) {
+	if int(event) < len(m.events) {
+		m.events[event].errors.Add(1)
+	}
+}
+
+// snapshot returns the metrics of each event which has been called, keyed by event name.
+func (m *hookMetrics) snapshot() map[string]HookMetrics {
+	out := make(map[string]HookMetrics)
+	for i := range m.events {
+		e := &m.events[i]
+		calls, errors := e.calls.Load(), e.errors.Load()
+		if calls == 0 && errors == 0 {
+			continue
+		}
+
+		var buckets [hookLatencyBuckets]int64
+		var n int64
+		for k := range e.buckets {
+			buckets[k] = e.buckets[k].Load()
+			n += buckets[k]
+		}
+
+		hm := HookMetrics{
+			Calls:  calls,
+			Errors: errors,
+		}
+
+		if calls > 0 { // a timed out call is counted as an error before it returns
+			hm.Mean = e.total.Load() / calls / int64(time.Microsecond)
+			hm.P50 = percentile(buckets, n, 0.50)
+			hm.P95 = percentile(buckets, n, 0.95)
+			hm.P99 = percentile(buckets, n, 0.99)
+		}
+
+		out[hookEventNames[i]] = hm
+	}
+
+	return out
+}
+
+// percentile returns the upper bound in microseconds of the latency bucket containing the
+// percentile p of n calls.
+func percentile(buckets [hookLatencyBuckets]int64, n int64, p float64) int64 {
+	rank := int64(float64(n)*p + 0.5)
+	var seen int64
+	for k, c := range buckets {
+		seen += c
+		if seen >= rank && c > 0 {
+			return int64(1) << k
+		}
+	}
+
+	return int64(1) << (hookLatencyBuckets - 1)
+}
@@ -0,0 +1,56 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHookEventNames(t *testing.T) {
+	for i := OnSysInfoTick; i <= OnListenerConnection; i++ {
+		require.NotEmpty(t, hookEventNames[i])
+	}
+}
+
+func TestHookMetricsRecord(t *testing.T) {
+	m := new(hookMetrics)
+	for i := 0; i < 90; i++ {
+		m.record(OnPublish, 500*time.Nanosecond, false)
+	}
+
+	for i := 0; i < 8; i++ {
+		m.record(OnPublish, 3*time.Millisecond, false)
+	}
+
+	m.record(OnPublish, 40*time.Millisecond, true)
+	m.record(OnPublish, 40*time.Millisecond, false)
+	m.failed(OnPublish)
+	m.record(StoredSession, time.Second, false) // not a hook event
+	m.failed(StoredSession)
+
+	require.Equal(t, map[string]HookMetrics{
+		"OnPublish": {
+			Calls:  100,
+			Errors: 2,
+			Mean:   1040,
+			P50:    1,
+			P95:    4096,
+			P99:    65536,
+		},
+	}, m.snapshot())
+}
+
+func TestPercentile(t *testing.T) {
+	var buckets [hookLatencyBuckets]int64
+	buckets[3] = 1
+	require.Equal(t, int64(8), percentile(buckets, 1, 0.5))
+	require.Equal(t, int64(8), percentile(buckets, 1, 0.99))
+
+	buckets[hookLatencyBuckets-1] = 1
+	require.Equal(t, int64(1)<<(hookLatencyBuckets-1), percentile(buckets, 2, 0.99))
+}
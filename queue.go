@@ -0,0 +1,136 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"sync/atomic"
+
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+)
+
+// QueuePolicy is the action taken when a message would exceed the queue limits of a client.
+type QueuePolicy byte
+
+const (
+	QueueDropNewest QueuePolicy = iota // the new message is dropped
+	QueueDropOldest                    // the oldest queued messages are dropped to make room for the new message
+	QueueDisconnect                    // the new message is dropped and the client is disconnected, or its session discarded if offline
+)
+
+// String returns the name of the policy.
+func (p QueuePolicy) String() string {
+	switch p {
+	case QueueDropNewest:
+		return "drop_newest"
+	case QueueDropOldest:
+		return "drop_oldest"
+	case QueueDisconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// QueueLimits limits the qos 1 and 2 messages held in the session of a client, awaiting
+// delivery or acknowledgement, including those queued while the client is offline.
+// A limit of 0 is unlimited, and MaximumInflight always applies.
+type QueueLimits struct {
+	MaximumMessages int         `yaml:"maximum_messages" json:"maximum_messages"` // maximum number of queued messages
+	MaximumBytes    int64       `yaml:"maximum_bytes" json:"maximum_bytes"`       // maximum total topic and payload size of queued messages
+	Policy          QueuePolicy `yaml:"policy" json:"policy"`                     // the action taken when a limit would be exceeded
+}
+
+// QueueLimiter is an optional interface which may be implemented by hooks to override the
+// queue limits of individual clients. QueueLimits is called with the limits from the server
+// capabilities, or from the previous hook, and returns the limits to apply to the client.
+type QueueLimiter interface {
+	QueueLimits(cl *Client, limits QueueLimits) QueueLimits
+}
+
+// QueueLimits returns the queue limits of a client, as overridden by each hook in scope of
+// the client which implements QueueLimiter. A hook which panics leaves the limits unchanged,
+// and its calls are recorded as OnQosPublish calls.
+func (h *Hooks) QueueLimits(cl *Client, limits QueueLimits) QueueLimits {
+	if atomic.LoadInt64(&h.queueLimiters) == 0 {
+		return limits
+	}
+
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if ql, ok := hook.(QueueLimiter); ok && hs.inScope(i, cl) && hs.scoped(i, cl, "") {
+			h.guard(hs, i, OnQosPublish, func() { limits = ql.QueueLimits(cl, limits) })
+		}
+	}
+
+	return limits
+}
+
+// queuedSize returns the size of a message for the byte limit of a queue.
+func queuedSize(pk packets.Packet) int64 {
+	return int64(len(pk.TopicName) + len(pk.Payload))
+}
+
+// enforceQueueLimits applies the queue limits of a client before a new qos message is held
+// in its session, returning an error if the message must be dropped.
+func (s *Server) enforceQueueLimits(cl *Client, pk packets.Packet) error {
+	limits := s.hooks.QueueLimits(cl, s.Options.Capabilities.QueueLimits)
+	if limits.MaximumMessages <= 0 && limits.MaximumBytes <= 0 {
+		return nil
+	}
+
+	size := queuedSize(pk)
+	exceeded := func() bool {
+		n, bytes := cl.State.Inflight.Size()
+		return limits.MaximumMessages > 0 && n >= limits.MaximumMessages ||
+			limits.MaximumBytes > 0 && bytes+size > limits.MaximumBytes
+	}
+
+	if !exceeded() {
+		return nil
+	}
+
+	switch limits.Policy {
+	case QueueDropOldest:
+		for exceeded() {
+			old, ok := cl.State.Inflight.Oldest()
+			if !ok {
+				break
+			}
+
+			if cl.State.Inflight.Delete(old.PacketID) {
+				atomic.AddInt64(&s.Info.Inflight, -1)
+				s.hooks.OnQosDropped(cl, old)
+			}
+			atomic.AddInt64(&s.Info.MessagesDropped, 1)
+			s.hooks.OnMessageDropped(cl, old, DropQueueLimit)
+		}
+
+		if !exceeded() {
+			return nil
+		}
+	case QueueDisconnect:
+		defer func() {
+			if cl.Net.Conn != nil && !cl.Closed() {
+				go func() { // the connection may be too slow to write to, so the publisher is not held
+					_ = s.DisconnectClient(cl, packets.ErrQuotaExceeded)
+				}()
+				return
+			}
+
+			if !s.Clients.CompareAndDelete(cl) {
+				return // the client has reconnected and taken over the session
+			}
+
+			s.UnsubscribeClient(cl)
+			s.hooks.OnClientExpired(cl)
+		}()
+	}
+
+	atomic.AddInt64(&s.Info.MessagesDropped, 1)
+	s.hooks.OnMessageDropped(cl, pk, DropQueueLimit)
+	s.Log.Warn("client queue limit reached", "client", cl.ID, "listener", cl.Net.Listener, "policy", limits.Policy.String())
+	return packets.ErrQuotaExceeded
+}
@@ -0,0 +1,209 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+type queueLimitHook struct {
+	HookBase
+	limits QueueLimits
+}
+
+func (h *queueLimitHook) ID() string {
+	return "queue-limit"
+}
+
+func (h *queueLimitHook) QueueLimits(cl *Client, limits QueueLimits) QueueLimits {
+	if cl.ID == "limited" {
+		return h.limits
+	}
+
+	return limits
+}
+
+type queueLimitPanicHook struct {
+	HookBase
+}
+
+func (h *queueLimitPanicHook) ID() string {
+	return "queue-limit-panic"
+}
+
+func (h *queueLimitPanicHook) QueueLimits(cl *Client, limits QueueLimits) QueueLimits {
+	panic("queue limits")
+}
+
+// newQueueTestClient returns an offline client with n queued messages, created in order.
+func newQueueTestClient(s *Server, n int) *Client {
+	cl, _, _ := newTestClient()
+	cl.ops.hooks = s.hooks
+	cl.Net.Conn = nil
+	s.Clients.Add(cl)
+	for i := 1; i <= n; i++ {
+		cl.State.Inflight.Set(packets.Packet{PacketID: uint16(i), TopicName: "a/b/c", Payload: []byte("hello"), Created: int64(i)})
+		atomic.AddInt64(&s.Info.Inflight, 1)
+	}
+
+	return cl
+}
+
+func TestQueuePolicyString(t *testing.T) {
+	require.Equal(t, "drop_newest", QueueDropNewest.String())
+	require.Equal(t, "drop_oldest", QueueDropOldest.String())
+	require.Equal(t, "disconnect", QueueDisconnect.String())
+	require.Equal(t, "unknown", QueuePolicy(255).String())
+}
+
+func TestHooksQueueLimits(t *testing.T) {
+	h := new(Hooks)
+	defaults := QueueLimits{MaximumMessages: 10}
+	require.Equal(t, defaults, h.QueueLimits(&Client{ID: "limited"}, defaults))
+
+	require.NoError(t, h.Add(new(HookBase), nil))
+	require.Equal(t, int64(0), atomic.LoadInt64(&h.queueLimiters))
+	require.NoError(t, h.Add(&queueLimitHook{limits: QueueLimits{MaximumMessages: 1}}, nil))
+	require.Equal(t, int64(1), atomic.LoadInt64(&h.queueLimiters))
+	require.Equal(t, QueueLimits{MaximumMessages: 1}, h.QueueLimits(&Client{ID: "limited"}, defaults))
+	require.Equal(t, defaults, h.QueueLimits(&Client{ID: "other"}, defaults))
+
+	require.NoError(t, h.Remove("queue-limit"))
+	require.Equal(t, int64(0), atomic.LoadInt64(&h.queueLimiters))
+	require.Equal(t, defaults, h.QueueLimits(&Client{ID: "limited"}, defaults))
+}
+
+func TestHooksQueueLimitsPanic(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	defaults := QueueLimits{MaximumMessages: 10}
+	require.NoError(t, h.Add(new(queueLimitPanicHook), nil))
+	require.Equal(t, defaults, h.QueueLimits(&Client{ID: "limited"}, defaults))
+	require.Equal(t, map[string]int64{"queue-limit-panic": 1}, h.Panics())
+	h.Stop()
+}
+
+func TestHooksQueueLimitsScoped(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	defaults := QueueLimits{MaximumMessages: 10}
+	require.NoError(t, h.AddScoped(&queueLimitHook{limits: QueueLimits{MaximumMessages: 1}}, nil, HookScope{Listeners: []string{"tcp"}}))
+	require.Equal(t, QueueLimits{MaximumMessages: 1}, h.QueueLimits(&Client{ID: "limited", Net: ClientConnection{Listener: "tcp"}}, defaults))
+	require.Equal(t, defaults, h.QueueLimits(&Client{ID: "limited", Net: ClientConnection{Listener: "ws"}}, defaults))
+}
+
+func TestEnforceQueueLimitsUnlimited(t *testing.T) {
+	s := newServer()
+	cl := newQueueTestClient(s, 3)
+	require.NoError(t, s.enforceQueueLimits(cl, packets.Packet{TopicName: "a/b/c"}))
+}
+
+func TestEnforceQueueLimitsDropNewest(t *testing.T) {
+	s := newServer()
+	hook := new(droppedHook)
+	require.NoError(t, s.AddHook(hook, nil))
+	s.Options.Capabilities.QueueLimits = QueueLimits{MaximumMessages: 3}
+	cl := newQueueTestClient(s, 2)
+
+	require.NoError(t, s.enforceQueueLimits(cl, packets.Packet{TopicName: "a/b/c"}))
+	cl.State.Inflight.Set(packets.Packet{PacketID: 3, Created: 3})
+
+	err := s.enforceQueueLimits(cl, packets.Packet{TopicName: "a/b/c"})
+	require.ErrorIs(t, err, packets.ErrQuotaExceeded)
+	require.Equal(t, 3, cl.State.Inflight.Len())
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.MessagesDropped))
+	require.Equal(t, []DropReason{DropQueueLimit}, hook.Reasons())
+}
+
+func TestEnforceQueueLimitsDropOldest(t *testing.T) {
+	s := newServer()
+	hook := new(droppedHook)
+	require.NoError(t, s.AddHook(hook, nil))
+	s.Options.Capabilities.QueueLimits = QueueLimits{MaximumBytes: 30, Policy: QueueDropOldest} // 10 bytes per message
+	cl := newQueueTestClient(s, 3)
+
+	require.NoError(t, s.enforceQueueLimits(cl, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello world")}))
+	require.Equal(t, 1, cl.State.Inflight.Len())
+	_, ok := cl.State.Inflight.Get(3) // the newest message is kept
+	require.True(t, ok)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.Inflight))
+	require.Equal(t, []DropReason{DropQueueLimit, DropQueueLimit}, hook.Reasons())
+
+	// a message larger than the limit is dropped after the queue is emptied
+	err := s.enforceQueueLimits(cl, packets.Packet{TopicName: "a/b/c", Payload: make([]byte, 30)})
+	require.ErrorIs(t, err, packets.ErrQuotaExceeded)
+	require.Equal(t, 0, cl.State.Inflight.Len())
+}
+
+func TestEnforceQueueLimitsDisconnectOffline(t *testing.T) {
+	s := newServer()
+	s.Options.Capabilities.QueueLimits = QueueLimits{MaximumMessages: 1, Policy: QueueDisconnect}
+	cl := newQueueTestClient(s, 1)
+	require.True(t, s.Topics.Subscribe(cl.ID, packets.Subscription{Filter: "a/b/c"}))
+	cl.State.Subscriptions.Add("a/b/c", packets.Subscription{Filter: "a/b/c"})
+
+	err := s.enforceQueueLimits(cl, packets.Packet{TopicName: "a/b/c"})
+	require.ErrorIs(t, err, packets.ErrQuotaExceeded)
+	_, ok := s.Clients.Get(cl.ID)
+	require.False(t, ok)
+	require.Empty(t, s.Topics.Subscribers("a/b/c").Subscriptions)
+}
+
+func TestEnforceQueueLimitsDisconnectOfflineTakenOver(t *testing.T) {
+	s := newServer()
+	s.Options.Capabilities.QueueLimits = QueueLimits{MaximumMessages: 1, Policy: QueueDisconnect}
+	cl := newQueueTestClient(s, 1)
+	require.True(t, s.Topics.Subscribe(cl.ID, packets.Subscription{Filter: "a/b/c"}))
+
+	live, _, _ := newTestClient() // the client reconnected after the publish selected the offline client
+	s.Clients.Add(live)
+
+	err := s.enforceQueueLimits(cl, packets.Packet{TopicName: "a/b/c"})
+	require.ErrorIs(t, err, packets.ErrQuotaExceeded)
+	v, ok := s.Clients.Get(cl.ID)
+	require.True(t, ok)
+	require.Same(t, live, v)
+	require.NotEmpty(t, s.Topics.Subscribers("a/b/c").Subscriptions)
+}
+
+func TestEnforceQueueLimitsDisconnectOnline(t *testing.T) {
+	s := newServer()
+	s.Options.Capabilities.QueueLimits = QueueLimits{MaximumMessages: 1, Policy: QueueDisconnect}
+	cl, r, _ := newTestClient()
+	s.Clients.Add(cl)
+	cl.State.Inflight.Set(packets.Packet{PacketID: 1})
+	go func() {
+		_, _ = io.ReadAll(r)
+	}()
+
+	err := s.enforceQueueLimits(cl, packets.Packet{TopicName: "a/b/c"})
+	require.ErrorIs(t, err, packets.ErrQuotaExceeded)
+	require.Eventually(t, cl.Closed, time.Second, time.Millisecond)
+	require.ErrorIs(t, cl.StopCause(), packets.ErrQuotaExceeded)
+	_, ok := s.Clients.Get(cl.ID)
+	require.True(t, ok) // the session is kept
+}
+
+func TestPublishToClientQueueLimitOverride(t *testing.T) {
+	s := newServer()
+	require.NoError(t, s.AddHook(&queueLimitHook{limits: QueueLimits{MaximumMessages: 1}}, nil))
+	cl := newQueueTestClient(s, 1)
+	cl.ID = "limited"
+
+	pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet
+	_, err := s.publishToClient(cl, packets.Subscription{Filter: pk.TopicName, Qos: 1}, pk)
+	require.ErrorIs(t, err, packets.ErrQuotaExceeded)
+
+	cl.ID = "other"
+	_, err = s.publishToClient(cl, packets.Subscription{Filter: pk.TopicName, Qos: 1}, pk)
+	require.ErrorIs(t, err, packets.CodeDisconnect) // queued for when the client reconnects
+	require.Equal(t, 2, cl.State.Inflight.Len())
+}
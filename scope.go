@@ -0,0 +1,167 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"strings"
+
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+)
+
+// HookScope restricts the events of a hook to the clients and topics which match it, so
+// multi-tenant hooks do not need to check the client and topic of every event themselves.
+// Each of the criteria which is set must match. Events which do not concern a client, such
+// as OnSysInfoTick and the Stored methods, are always called, and the topic criteria only
+// apply to events which concern a topic or a topic filter.
+type HookScope struct {
+	// Listeners are the ids of the listeners which clients must be connected to.
+	Listeners []string `yaml:"listeners" json:"listeners"`
+
+	// ClientPrefixes are the prefixes, one of which client ids must start with.
+	ClientPrefixes []string `yaml:"client_prefixes" json:"client_prefixes"`
+
+	// Topics are the topic filters, one of which the topic of an event must match. The filter
+	// of a subscription matches if it is within one of the topic filters, such as a/b/+ within a/#,
+	// and a packet with several filters matches if any of its filters match.
+	Topics []string `yaml:"topics" json:"topics"`
+}
+
+// hookScope is the scope of a hook, prepared for matching.
+type hookScope struct {
+	listeners map[string]bool // the listener ids clients must be connected to, or nil for any
+	prefixes  []string        // the prefixes client ids must start with, or nil for any
+	topics    []string        // the filters topics must match, or nil for any
+}
+
+// newHookScope returns the prepared scope of a hook, or nil if it does not restrict the hook.
+func newHookScope(s *HookScope) *hookScope {
+	if s == nil || len(s.Listeners)+len(s.ClientPrefixes)+len(s.Topics) == 0 {
+		return nil
+	}
+
+	hs := &hookScope{
+		prefixes: s.ClientPrefixes,
+		topics:   s.Topics,
+	}
+
+	if len(s.Listeners) > 0 {
+		hs.listeners = make(map[string]bool, len(s.Listeners))
+		for _, l := range s.Listeners {
+			hs.listeners[l] = true
+		}
+	}
+
+	return hs
+}
+
+// matchesClient returns true if a client is within the scope. A nil client is always within it.
+func (s *hookScope) matchesClient(cl *Client) bool {
+	if cl == nil {
+		return true
+	}
+
+	if s.listeners != nil && !s.listeners[cl.Net.Listener] {
+		return false
+	}
+
+	if s.prefixes == nil {
+		return true
+	}
+
+	for _, p := range s.prefixes {
+		if strings.HasPrefix(cl.ID, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesTopic returns true if a topic or topic filter is within the scope. An empty topic is
+// always within it.
+func (s *hookScope) matchesTopic(topic string) bool {
+	if s.topics == nil || topic == "" {
+		return true
+	}
+
+	for _, f := range s.topics {
+		if matchFilter(f, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesPacket returns true if the topic of a packet, or any of its filters, is within the scope.
+func (s *hookScope) matchesPacket(pk packets.Packet) bool {
+	if s.topics == nil || pk.TopicName != "" || len(pk.Filters) == 0 {
+		return s.matchesTopic(pk.TopicName)
+	}
+
+	for _, sub := range pk.Filters {
+		if s.matchesTopic(sub.Filter) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchFilter returns true if a topic, or every topic matched by a topic filter, matches a
+// filter. Wildcards in the topic must be matched by the same or a broader wildcard, so a/+
+// is within a/# and a/+, but not within a/b.
+func matchFilter(filter, topic string) bool {
+	for {
+		f, fnext, fmore := strings.Cut(filter, "/")
+		t, tnext, tmore := strings.Cut(topic, "/")
+
+		switch {
+		case f == "#":
+			return true
+		case t == "#":
+			return false
+		case f != "+" && f != t:
+			return false
+		case !fmore && !tmore:
+			return true
+		case !tmore:
+			return fnext == "#" // a/# also matches a
+		case !fmore:
+			return false
+		}
+
+		filter, topic = fnext, tnext
+	}
+}
+
+// scoped returns true if a client and topic are within the scope of the hook at index i. Hooks
+// without a scope apply to every client and topic.
+func (hs *hookSet) scoped(i int, cl *Client, topic string) bool {
+	if i >= len(hs.filters) || hs.filters[i] == nil {
+		return true
+	}
+
+	return hs.filters[i].matchesClient(cl) && hs.filters[i].matchesTopic(topic)
+}
+
+// scopedPacket returns true if a client and the topic or filters of a packet are within the
+// scope of the hook at index i.
+func (hs *hookSet) scopedPacket(i int, cl *Client, pk packets.Packet) bool {
+	if i >= len(hs.filters) || hs.filters[i] == nil {
+		return true
+	}
+
+	return hs.filters[i].matchesClient(cl) && hs.filters[i].matchesPacket(pk)
+}
+
+// scopedListener returns true if a listener is within the scope of the hook at index i.
+func (hs *hookSet) scopedListener(i int, listener string) bool {
+	if i >= len(hs.filters) || hs.filters[i] == nil || hs.filters[i].listeners == nil {
+		return true
+	}
+
+	return hs.filters[i].listeners[listener]
+}
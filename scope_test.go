@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHookScopeEmpty(t *testing.T) {
+	require.Nil(t, newHookScope(nil))
+	require.Nil(t, newHookScope(new(HookScope)))
+}
+
+func TestMatchFilter(t *testing.T) {
+	tt := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{filter: "#", topic: "a/b/c", want: true},
+		{filter: "a/#", topic: "a", want: true},
+		{filter: "a/#", topic: "a/b/c", want: true},
+		{filter: "a/#", topic: "b/c", want: false},
+		{filter: "a/+", topic: "a/b", want: true},
+		{filter: "a/+", topic: "a/b/c", want: false},
+		{filter: "a/+", topic: "a", want: false},
+		{filter: "a/+/c", topic: "a/b/c", want: true},
+		{filter: "a/b", topic: "a/b", want: true},
+		{filter: "a/b", topic: "a/b/c", want: false},
+		{filter: "a/b/c", topic: "a/b", want: false},
+		{filter: "a/#", topic: "a/+/c", want: true},
+		{filter: "a/+", topic: "a/#", want: false},
+		{filter: "a/b", topic: "a/+", want: false},
+	}
+
+	for _, tx := range tt {
+		require.Equal(t, tx.want, matchFilter(tx.filter, tx.topic), "%s %s", tx.filter, tx.topic)
+	}
+}
+
+func TestHookScopeMatchesClient(t *testing.T) {
+	s := newHookScope(&HookScope{
+		Listeners:      []string{"tcp"},
+		ClientPrefixes: []string{"t1-", "t2-"},
+	})
+
+	require.True(t, s.matchesClient(nil))
+	require.True(t, s.matchesClient(&Client{ID: "t2-a", Net: ClientConnection{Listener: "tcp"}}))
+	require.False(t, s.matchesClient(&Client{ID: "t3-a", Net: ClientConnection{Listener: "tcp"}}))
+	require.False(t, s.matchesClient(&Client{ID: "t1-a", Net: ClientConnection{Listener: "ws"}}))
+}
+
+func TestHookScopeMatchesPacket(t *testing.T) {
+	s := newHookScope(&HookScope{Topics: []string{"t1/#"}})
+
+	require.True(t, s.matchesPacket(packets.Packet{}))
+	require.True(t, s.matchesPacket(packets.Packet{TopicName: "t1/a"}))
+	require.False(t, s.matchesPacket(packets.Packet{TopicName: "t2/a"}))
+	require.True(t, s.matchesPacket(packets.Packet{Filters: packets.Subscriptions{{Filter: "t2/a"}, {Filter: "t1/+"}}}))
+	require.False(t, s.matchesPacket(packets.Packet{Filters: packets.Subscriptions{{Filter: "t2/a"}}}))
+}
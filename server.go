@@ -6,8 +6,11 @@
 package mqtt
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"net"
 	"os"
@@ -27,10 +30,12 @@ import (
 )
 
 const (
-	Version                       = "2.7.9" // the current server version.
-	defaultSysTopicInterval int64 = 1       // the interval between $SYS topic publishes
-	LocalListener                 = "local"
-	InlineClientId                = "inline"
+	Version                            = "2.7.9" // the current server version.
+	defaultSysTopicInterval      int64 = 1       // the interval between $SYS topic publishes
+	dynamicSubscriptionBase      int64 = 1 << 24 // the first identifier issued for dynamic inline subscriptions
+	defaultOverloadCheckInterval int64 = 1000    // the interval between overload checks in milliseconds
+	LocalListener                      = "local"
+	InlineClientId                     = "inline"
 )
 
 var (
@@ -38,9 +43,12 @@ var (
 	DefaultServerCapabilities = NewDefaultServerCapabilities()
 
 	ErrListenerIDExists       = errors.New("listener id already exists")                               // a listener with the same id already exists
+	ErrListenerNotFound       = errors.New("listener not found")                                       // no listener exists with the id
 	ErrConnectionClosed       = errors.New("connection not open")                                      // connection is closed
 	ErrInlineClientNotEnabled = errors.New("please set Options.InlineClient=true to use this feature") // inline client is not enabled by default
 	ErrOptionsUnreadable      = errors.New("unable to read options from bytes")
+	ErrNoBackupHook           = errors.New("no hook supports backups") // no hook implements BackupRestorer
+	ErrClientNotFound         = errors.New("client not found")         // no connected client exists with the id
 )
 
 // Capabilities indicates the capabilities and features provided by the server.
@@ -61,6 +69,7 @@ type Capabilities struct {
 	RetainAvailable              byte            `yaml:"retain_available" json:"retain_available"`                 // support of retain messages
 	WildcardSubAvailable         byte            `yaml:"wildcard_sub_available" json:"wildcard_sub_available"`     // support of wildcard subscriptions
 	SubIDAvailable               byte            `yaml:"sub_id_available" json:"sub_id_available"`                 // support of subscription identifiers
+	QueueLimits                  QueueLimits     `yaml:"queue_limits" json:"queue_limits"`                         // limits of the messages held for each client, unlimited if 0
 }
 
 // NewDefaultServerCapabilities defines the default features and capabilities provided by the server.
@@ -129,6 +138,56 @@ type Options struct {
 	// Enable Inline client to allow direct subscribing and publishing from the parent codebase,
 	// with negligible performance difference (disabled by default to prevent confusion in statistics).
 	InlineClient bool `yaml:"inline_client" json:"inline_client"`
+
+	// ShutdownServerReference is an optional server reference sent to MQTT v5 clients in the
+	// Server Shutting Down disconnect packet when the server is closed, so they may reconnect elsewhere.
+	ShutdownServerReference string `yaml:"shutdown_server_reference" json:"shutdown_server_reference"`
+
+	// ShutdownDrainTimeout specifies the maximum number of seconds to wait for clients to disconnect
+	// when the server is closed, after which any remaining connections are closed. Unlimited if 0.
+	ShutdownDrainTimeout int64 `yaml:"shutdown_drain_timeout" json:"shutdown_drain_timeout"`
+
+	// Overload specifies thresholds above which the server is considered overloaded. While
+	// overloaded, new connections are paced and then rejected with Server Busy. Disabled if nil.
+	Overload *OverloadOptions `yaml:"overload" json:"overload"`
+
+	// AuthCache caches the OnACLCheck decisions of connected clients for a short time, saving
+	// repeated checks against slow auth hooks on every publish. Disabled if nil or TTL is 0.
+	AuthCache *AuthCacheOptions `yaml:"auth_cache" json:"auth_cache"`
+
+	// LazySessionLoading restores the session of a client from the storage hooks when the client
+	// connects, rather than loading every stored session on start. Messages are not delivered to,
+	// or queued for, a stored session until its client reconnects, and any pending will of the
+	// session is discarded. Stored sessions which are not restored are expired by reading the
+	// stored clients each minute.
+	LazySessionLoading bool `yaml:"lazy_session_loading" json:"lazy_session_loading"`
+
+	// HookPanicLimit is the number of panics recovered from a hook after which the hook is
+	// removed from the server. Panicking hooks are never removed if 0.
+	HookPanicLimit int64 `yaml:"hook_panic_limit" json:"hook_panic_limit"`
+
+	// HookMetrics records the call counts, errors and latencies of each event of each hook,
+	// which are published to $SYS/broker/hooks/<hook id>, so slow hooks can be found.
+	HookMetrics bool `yaml:"hook_metrics" json:"hook_metrics"`
+
+	// SharedSubscriptions specifies the strategies used to select the member of each shared
+	// subscription group which receives a message. Members are selected at random if nil.
+	SharedSubscriptions *SharedSubscriptionOptions `yaml:"shared_subscriptions" json:"shared_subscriptions"`
+
+	// SessionTakeover is the action taken when a client connects with the id of a connected
+	// client. By default the existing client is disconnected, and TakeoverReject instead
+	// rejects the new client. It can be decided per client by a TakeoverDecider hook.
+	SessionTakeover TakeoverPolicy `yaml:"session_takeover" json:"session_takeover"`
+}
+
+// OverloadOptions contains the thresholds for broker-wide overload protection. A threshold is
+// disabled if 0, and the server is overloaded while any enabled threshold is exceeded.
+type OverloadOptions struct {
+	MaxMemory     int64 `yaml:"max_memory" json:"max_memory"`           // maximum bytes of heap memory in use
+	MaxGoroutines int64 `yaml:"max_goroutines" json:"max_goroutines"`   // maximum number of running goroutines
+	MaxQueueDepth int64 `yaml:"max_queue_depth" json:"max_queue_depth"` // maximum number of packets pending in client outbound queues
+	AcceptDelay   int64 `yaml:"accept_delay" json:"accept_delay"`       // milliseconds to pause new connections while overloaded before rejecting them
+	CheckInterval int64 `yaml:"check_interval" json:"check_interval"`   // milliseconds between overload checks, 1000 if 0
 }
 
 // Server is an MQTT broker server. It should be created with server.New()
@@ -136,14 +195,22 @@ type Options struct {
 type Server struct {
 	Options      *Options             // configurable server options
 	Listeners    *listeners.Listeners // listeners are network interfaces which listen for new connections
+	AuthCache    *AuthCache           // a cache of acl decisions, nil unless enabled by Options.AuthCache
 	Clients      *Clients             // clients known to the broker
 	Topics       *TopicsIndex         // an index of topic filter subscriptions and retained messages
 	Info         *system.Info         // values about the server commonly known as $SYS topics
 	loop         *loop                // loop contains tickers for the system event loop
 	done         chan bool            // indicate that the server is ending
+	ctx          context.Context      // a context which is cancelled when the server is closed
+	cancel       func(error)          // cancel function for ctx, with the cause
 	Log          *slog.Logger         // minimal no-alloc logger
 	hooks        *Hooks               // hooks contains hooks for extra functionality such as auth and persistent storage
 	inlineClient *Client              // inlineClient is a special client used for inline subscriptions and inline Publish
+	dynamicSubID int64                // the last identifier issued for a dynamic inline subscription
+	funcHooks    int64                // the number of function hooks added, used to give them unique ids
+	shared       *sharedBalancer      // selects the members of shared subscription groups, nil if random
+	load         system.Load          // the load averages published to the $SYS/broker/load topics
+	overloaded   uint32               // 1 if the server is overloaded, see Options.Overload
 }
 
 // loop contains interval tickers for the system events loop.
@@ -153,15 +220,17 @@ type loop struct {
 	inflightExpiry *time.Ticker     // interval ticker for cleaning up expired inflight messages
 	retainedExpiry *time.Ticker     // interval ticker for cleaning retained messages
 	willDelaySend  *time.Ticker     // interval ticker for sending Will Messages with a delay
+	storedExpiry   *time.Ticker     // interval ticker for cleaning expired stored sessions which were not loaded
 	willDelayed    *packets.Packets // activate LWT packets which will be sent after a delay
 }
 
 // ops contains server values which can be propagated to other structs.
 type ops struct {
-	options *Options     // a pointer to the server options and capabilities, for referencing in clients
-	info    *system.Info // pointers to server system info
-	hooks   *Hooks       // pointer to the server hooks
-	log     *slog.Logger // a structured logger for the client
+	options *Options        // a pointer to the server options and capabilities, for referencing in clients
+	info    *system.Info    // pointers to server system info
+	hooks   *Hooks          // pointer to the server hooks
+	log     *slog.Logger    // a structured logger for the client
+	ctx     context.Context // the server context, which client contexts are derived from
 }
 
 // New returns a new instance of mochi mqtt broker. Optional parameters
@@ -173,8 +242,11 @@ func New(opts *Options) *Server {
 
 	opts.ensureDefaults()
 
+	ctx, cancel := context.WithCancelCause(context.Background())
 	s := &Server{
 		done:      make(chan bool),
+		ctx:       ctx,
+		cancel:    cancel,
 		Clients:   NewClients(),
 		Topics:    NewTopicsIndex(),
 		Listeners: listeners.New(),
@@ -184,6 +256,7 @@ func New(opts *Options) *Server {
 			inflightExpiry: time.NewTicker(time.Second),
 			retainedExpiry: time.NewTicker(time.Second),
 			willDelaySend:  time.NewTicker(time.Second),
+			storedExpiry:   time.NewTicker(time.Minute),
 			willDelayed:    packets.NewPackets(),
 		},
 		Options: opts,
@@ -193,8 +266,19 @@ func New(opts *Options) *Server {
 		},
 		Log: opts.Logger,
 		hooks: &Hooks{
-			Log: opts.Logger,
+			Log:           opts.Logger,
+			PanicLimit:    opts.HookPanicLimit,
+			RecordMetrics: opts.HookMetrics,
 		},
+		dynamicSubID: dynamicSubscriptionBase,
+	}
+
+	if opts.AuthCache != nil && opts.AuthCache.TTL > 0 {
+		s.AuthCache = NewAuthCache(*opts.AuthCache)
+	}
+
+	if opts.SharedSubscriptions != nil {
+		s.shared = newSharedBalancer(*opts.SharedSubscriptions)
 	}
 
 	if s.Options.InlineClient {
@@ -233,6 +317,10 @@ func (o *Options) ensureDefaults() {
 		log := slog.New(slog.NewTextHandler(os.Stdout, nil))
 		o.Logger = log
 	}
+
+	if o.Overload != nil && o.Overload.CheckInterval <= 0 {
+		o.Overload.CheckInterval = defaultOverloadCheckInterval
+	}
 }
 
 // NewClient returns a new Client instance, populated with all the required values and
@@ -245,6 +333,7 @@ func (s *Server) NewClient(c net.Conn, listener string, id string, inline bool)
 		info:    s.Info,
 		hooks:   s.hooks,
 		log:     s.Log,
+		ctx:     s.ctx,
 	})
 
 	cl.ID = id
@@ -263,20 +352,94 @@ func (s *Server) NewClient(c net.Conn, listener string, id string, inline bool)
 // AddHook attaches a new Hook to the server. Ideally, this should be called
 // before the server is started with s.Serve().
 func (s *Server) AddHook(hook Hook, config any) error {
+	return s.AddHookForListeners(hook, config)
+}
+
+// AddHookForListeners attaches a new Hook to the server which only authenticates and authorizes
+// (OnConnectAuthenticate and OnACLCheck) clients connected to the given listener ids, allowing
+// different auth policies per listener. The hook receives all other events as normal.
+func (s *Server) AddHookForListeners(hook Hook, config any, listeners ...string) error {
+	return s.AddHookWithPriority(hook, config, 0, listeners...)
+}
+
+// AddHookWithPriority attaches a new Hook to the server which is called before hooks with a
+// lower priority, regardless of the order the hooks were added in. Hooks added with AddHook
+// have a priority of 0. If listeners are given, the hook is scoped to them as with
+// AddHookForListeners.
+func (s *Server) AddHookWithPriority(hook Hook, config any, priority int, listeners ...string) error {
+	return s.addHook(HookLoadConfig{Hook: hook, Config: config, Priority: priority, Listeners: listeners})
+}
+
+// AddHookAsync attaches a new Hook to the server whose notification events, such as OnPublished,
+// OnSysInfoTick and the storage events, are queued and called by a bounded pool of workers, so a
+// slow hook cannot stall packet processing. Events which return a value are still called inline.
+func (s *Server) AddHookAsync(hook Hook, config any, opts AsyncOptions) error {
+	return s.addHook(HookLoadConfig{Hook: hook, Config: config, Async: &opts})
+}
+
+// AddHookWithTimeout attaches a new Hook to the server whose auth and publish checks
+// (OnConnectAuthenticate, OnACLCheck and OnPublish) are abandoned if they do not return within
+// the timeout, and resolved by the timeout policy, so a hung webhook or database cannot freeze
+// clients.
+func (s *Server) AddHookWithTimeout(hook Hook, config any, opts TimeoutOptions) error {
+	return s.addHook(HookLoadConfig{Hook: hook, Config: config, Timeout: &opts})
+}
+
+// AddHookScoped attaches a new Hook to the server whose events are only called for clients
+// connected to the listeners, with client ids starting with the prefixes, and for topics
+// matching the topic filters of the scope, so a hook can serve a single tenant without
+// checking every event itself.
+func (s *Server) AddHookScoped(hook Hook, config any, scope HookScope) error {
+	return s.addHook(HookLoadConfig{Hook: hook, Config: config, Scope: &scope})
+}
+
+// addHook attaches a new Hook to the server with the options of a hook load config.
+func (s *Server) addHook(hlc HookLoadConfig) error {
+	hook := hlc.Hook
 	nl := s.Log.With("hook", hook.ID())
 	hook.SetOpts(nl, &HookOptions{
 		Capabilities: s.Options.Capabilities,
+		AuthCache:    s.AuthCache,
+		Context:      s.ctx,
 	})
 
-	s.Log.Info("added hook", "hook", hook.ID())
-	return s.hooks.Add(hook, config)
+	if len(hlc.Listeners) > 0 {
+		s.Log.Info("added hook", "hook", hook.ID(), "priority", hlc.Priority, "async", hlc.Async != nil, "timeout", hlc.Timeout != nil, "listeners", hlc.Listeners)
+	} else {
+		s.Log.Info("added hook", "hook", hook.ID(), "priority", hlc.Priority, "async", hlc.Async != nil, "timeout", hlc.Timeout != nil)
+	}
+
+	return s.hooks.add(hlc)
+}
+
+// RemoveHook detaches the hook with the given id from the server, so feature hooks can be
+// toggled or upgraded without restarting. Calls to the hook which are in progress are drained
+// before it is stopped. Clients authenticated by the hook remain connected.
+func (s *Server) RemoveHook(id string) error {
+	if err := s.hooks.Remove(id); err != nil {
+		return err
+	}
+
+	s.Log.Info("removed hook", "hook", id)
+	return nil
+}
+
+// ReloadHook applies a new config to the hook with the given id while the server is running,
+// if the hook implements Reloader, so its settings can be changed without removing it.
+func (s *Server) ReloadHook(id string, config any) error {
+	if err := s.hooks.Reload(id, config); err != nil {
+		return err
+	}
+
+	s.Log.Info("reloaded hook", "hook", id)
+	return nil
 }
 
 // AddHooksFromConfig adds hooks to the server which were specified in the hooks config (usually from a config file).
 // New built-in hooks should be added to this list.
 func (s *Server) AddHooksFromConfig(hooks []HookLoadConfig) error {
 	for _, h := range hooks {
-		if err := s.AddHook(h.Hook, h.Config); err != nil {
+		if err := s.addHook(h); err != nil {
 			return err
 		}
 	}
@@ -301,6 +464,75 @@ func (s *Server) AddListener(l listeners.Listener) error {
 	return nil
 }
 
+// Health returns an error if any critical hook is unhealthy, indicating the
+// server is not ready to serve clients.
+func (s *Server) Health() error {
+	return s.hooks.Health()
+}
+
+// Context returns a context which is cancelled when the server is closed, once its clients
+// have disconnected, with ErrServerShuttingDown as its cause. Client contexts are derived
+// from it.
+func (s *Server) Context() context.Context {
+	return s.ctx
+}
+
+// HookMetrics returns the call metrics of each event of each hook, keyed by hook id and event
+// name, if the HookMetrics option is enabled.
+func (s *Server) HookMetrics() map[string]map[string]HookMetrics {
+	return s.hooks.Metrics()
+}
+
+// HookPanics returns the number of panics recovered from each hook which has panicked, keyed
+// by hook id. A panic in a hook is logged and the call to the hook is skipped, so that it cannot
+// take down the client or the server.
+func (s *Server) HookPanics() map[string]int64 {
+	return s.hooks.Panics()
+}
+
+// AsyncDropped returns the number of events dropped by the overflow policy of each hook
+// added with AddHookAsync, keyed by hook id.
+func (s *Server) AsyncDropped() map[string]int64 {
+	return s.hooks.AsyncDropped()
+}
+
+// Snapshot writes a backup of the persisted sessions, subscriptions, and retained messages
+// to w, using the first hook which implements BackupRestorer.
+func (s *Server) Snapshot(w io.Writer) error {
+	for _, hook := range s.hooks.GetAll() {
+		if b, ok := hook.(BackupRestorer); ok {
+			return b.Backup(w)
+		}
+	}
+
+	return ErrNoBackupHook
+}
+
+// RemoveListener stops a listener from accepting new connections and removes it from the server.
+// If disconnect is true, clients connected to the listener are sent a Server Shutting Down
+// disconnect; otherwise they are left to disconnect on their own, which may take as long as
+// the clients choose. RemoveListener then waits for the clients of the listener to drain
+// before removing it. If ctx ends first the context error is returned and the closed listener
+// is kept, so RemoveListener can be called again to resume the drain.
+func (s *Server) RemoveListener(ctx context.Context, id string, disconnect bool) error {
+	if _, ok := s.Listeners.Get(id); !ok {
+		return ErrListenerNotFound
+	}
+
+	s.Listeners.Close(id, func(string) {})
+	if disconnect {
+		s.closeListenerClients(id) // called for each attempt, as a listener only calls its closer once
+	}
+	s.Log.Info("detached listener", "id", id)
+
+	if err := s.Listeners.WaitClients(ctx, id); err != nil {
+		return err
+	}
+
+	s.Listeners.Delete(id)
+	return nil
+}
+
 // AddListenersFromConfig adds listeners to the server which were specified in the listeners config (usually from a config file).
 // New built-in listeners should be added to this list.
 func (s *Server) AddListenersFromConfig(configs []listeners.Config) error {
@@ -311,12 +543,30 @@ func (s *Server) AddListenersFromConfig(configs []listeners.Config) error {
 			l = listeners.NewTCP(conf)
 		case listeners.TypeWS:
 			l = listeners.NewWebsocket(conf)
+		case listeners.TypeWebTransport:
+			l = listeners.NewWebTransport(conf)
+		case listeners.TypeMultiplex:
+			l = listeners.NewMultiplex(conf)
 		case listeners.TypeUnix:
 			l = listeners.NewUnixSock(conf)
 		case listeners.TypeHealthCheck:
-			l = listeners.NewHTTPHealthCheck(conf)
+			l = listeners.NewHTTPReadinessCheck(conf, s.Health)
 		case listeners.TypeSysInfo:
 			l = listeners.NewHTTPStats(conf, s.Info)
+		case listeners.TypeHTTPPublish:
+			l = listeners.NewHTTPPublish(conf, s.Publish, s.AuthenticateHTTP)
+		case listeners.TypeSSE:
+			l = listeners.NewSSE(conf, s.SubscribeMessages, s.AuthenticateHTTP)
+		case listeners.TypeGRPC:
+			l = listeners.NewGRPC(conf, s.Publish, s.SubscribeMessages, s.AuthenticateHTTP)
+		case listeners.TypeMQTTSN:
+			l = listeners.NewMQTTSN(conf, s.Publish, s.SubscribeMessages, s.AuthenticateHTTP)
+		case listeners.TypeSystemd:
+			sl, err := listeners.NewFromSystemd(conf.ID, conf.Address)
+			if err != nil {
+				return err
+			}
+			l = sl
 		case listeners.TypeMock:
 			l = listeners.NewMockListener(conf.ID, conf.Address)
 		default:
@@ -330,6 +580,87 @@ func (s *Server) AddListenersFromConfig(configs []listeners.Config) error {
 	return nil
 }
 
+// AuthenticateHTTP authenticates the credentials of a request made to an http listener using
+// the OnConnectAuthenticate hooks, and checks that the request may read or write to a topic
+// using the OnACLCheck hooks. It can be passed as the auth callback for http listeners.
+func (s *Server) AuthenticateHTTP(listener, remote string, username, password []byte, topic string, write bool) bool {
+	cl := s.NewClient(nil, listener, "", false)
+	defer cl.Stop(nil)
+
+	cl.Net.Remote = remote
+	cl.Properties.Username = username
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Connect,
+		},
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Connect: packets.ConnectParams{
+			Username:     username,
+			UsernameFlag: len(username) > 0,
+			Password:     password,
+			PasswordFlag: len(password) > 0,
+		},
+	}
+
+	if !s.hooks.OnConnectAuthenticate(cl, pk) {
+		s.hooks.OnAuthFailed(cl, packets.ErrBadUsernameOrPassword)
+		return false
+	}
+
+	if cl.IsSuperuser() || s.hooks.OnACLCheck(cl, topic, write) {
+		return true
+	}
+
+	s.hooks.OnACLDenied(cl, topic, aclWriteAction(write))
+	return false
+}
+
+// checkACL returns true if the OnACLCheck hooks allow a client to read or write a topic,
+// using the cached decision if the auth cache is enabled. Superusers are always allowed, and
+// denials are reported to the OnACLDenied hooks.
+func (s *Server) checkACL(cl *Client, topic string, write bool) bool {
+	if cl.IsSuperuser() {
+		return true
+	}
+
+	allow, ok := s.AuthCache.Get(cl, topic, write)
+	if !ok {
+		allow = s.hooks.OnACLCheck(cl, topic, write)
+		s.AuthCache.Set(cl, topic, write, allow)
+	}
+
+	if !allow {
+		s.hooks.OnACLDenied(cl, topic, aclWriteAction(write))
+	}
+
+	return allow
+}
+
+// aclWriteAction returns the acl action of a read or write check.
+func aclWriteAction(write bool) ACLAction {
+	if write {
+		return ACLActionWrite
+	}
+
+	return ACLActionRead
+}
+
+// checkACLAction returns true if the OnACLActionCheck hooks allow a client to retain a message
+// or register a will on a topic. Superusers are always allowed, and denials are reported to the
+// OnACLDenied hooks.
+func (s *Server) checkACLAction(cl *Client, topic string, action ACLAction) bool {
+	if cl.IsSuperuser() {
+		return true
+	}
+
+	if s.hooks.OnACLActionCheck(cl, topic, action) {
+		return true
+	}
+
+	s.hooks.OnACLDenied(cl, topic, action)
+	return false
+}
+
 // Serve starts the event loops responsible for establishing client connections
 // on all attached listeners, publishing the system topics, and starting all hooks.
 func (s *Server) Serve() error {
@@ -363,6 +694,10 @@ func (s *Server) Serve() error {
 		}
 	}
 
+	if s.Options.Overload != nil {
+		go s.overloadLoop() // begin checking the overload thresholds.
+	}
+
 	go s.eventLoop()                            // spin up event loop for issuing $SYS values and closing server.
 	s.Listeners.ServeAll(s.EstablishConnection) // start listening on all listeners.
 	s.publishSysTopics()                        // begin publishing $SYS system values.
@@ -391,32 +726,154 @@ func (s *Server) eventLoop() {
 			s.sendDelayedLWT(time.Now().Unix())
 		case <-s.loop.inflightExpiry.C:
 			s.clearExpiredInflights(time.Now().Unix())
+		case <-s.loop.storedExpiry.C:
+			s.clearExpiredStoredSessions(time.Now().Unix())
+		}
+	}
+}
+
+// overloadLoop checks the overload thresholds at the configured interval until the server is closed.
+func (s *Server) overloadLoop() {
+	ticker := time.NewTicker(time.Millisecond * time.Duration(s.Options.Overload.CheckInterval))
+	defer ticker.Stop()
+
+	s.checkOverload()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.checkOverload()
+		}
+	}
+}
+
+// checkOverload compares the memory in use, goroutine count, and client queue depth against
+// the overload thresholds, and updates the overloaded state of the server.
+func (s *Server) checkOverload() {
+	o := s.Options.Overload
+	var reason string
+	var value, limit int64
+
+	if o.MaxMemory > 0 {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		if int64(m.HeapInuse) > o.MaxMemory {
+			reason, value, limit = "memory", int64(m.HeapInuse), o.MaxMemory
+		}
+	}
+
+	if reason == "" && o.MaxGoroutines > 0 {
+		if n := int64(runtime.NumGoroutine()); n > o.MaxGoroutines {
+			reason, value, limit = "goroutines", n, o.MaxGoroutines
+		}
+	}
+
+	if reason == "" && o.MaxQueueDepth > 0 {
+		var depth int64
+		for _, cl := range s.Clients.GetAll() {
+			depth += int64(atomic.LoadInt32(&cl.State.outboundQty))
+		}
+		if depth > o.MaxQueueDepth {
+			reason, value, limit = "queue depth", depth, o.MaxQueueDepth
+		}
+	}
+
+	if reason != "" {
+		if atomic.CompareAndSwapUint32(&s.overloaded, 0, 1) {
+			s.Log.Warn("server overloaded, shedding new connections", "threshold", reason, "value", value, "limit", limit)
+		}
+		return
+	}
+
+	if atomic.CompareAndSwapUint32(&s.overloaded, 1, 0) {
+		s.Log.Info("server no longer overloaded, accepting new connections")
+	}
+}
+
+// Overloaded returns true if any of the overload thresholds in Options.Overload are exceeded.
+func (s *Server) Overloaded() bool {
+	return atomic.LoadUint32(&s.overloaded) == 1
+}
+
+// paceConnection pauses a new connection for up to the overload accept delay while the server
+// is overloaded, spreading the load of reconnecting clients before they are rejected.
+func (s *Server) paceConnection() {
+	if s.Options.Overload == nil || s.Options.Overload.AcceptDelay <= 0 || !s.Overloaded() {
+		return
+	}
+
+	interval := time.Millisecond * time.Duration(s.Options.Overload.CheckInterval)
+	deadline := time.Now().Add(time.Millisecond * time.Duration(s.Options.Overload.AcceptDelay))
+	for s.Overloaded() && time.Now().Before(deadline) {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(min(interval, time.Until(deadline))):
 		}
 	}
 }
 
 // EstablishConnection establishes a new client when a listener accepts a new connection.
 func (s *Server) EstablishConnection(listener string, c net.Conn) error {
+	s.paceConnection()
 	cl := s.NewClient(c, listener, "", false)
+
+	stats := s.Info.Listener(listener)
+	atomic.AddInt64(&stats.Accepted, 1)
+	atomic.AddInt64(&stats.Active, 1)
+	defer atomic.AddInt64(&stats.Active, -1)
+	s.hooks.OnListenerConnection(listener, ListenerConnectionAccepted, nil)
+
 	return s.attachClient(cl, listener)
 }
 
+// checkRevocation checks whether the certificate presented by a client has been revoked, if
+// the listener supports revocation checking. Clients which fail the check are denied before
+// they are authenticated.
+func (s *Server) checkRevocation(cl *Client, listener string) {
+	if cl.Net.TLS == nil {
+		return
+	}
+
+	l, ok := s.Listeners.Get(listener)
+	if !ok {
+		return
+	}
+
+	if rc, ok := l.(listeners.RevocationChecker); ok {
+		cl.Net.Revocation = rc.CheckRevocation(*cl.Net.TLS)
+		if cl.Net.Revocation != nil {
+			s.Log.Warn("client certificate revocation check failed", "error", cl.Net.Revocation, "listener", listener, "remote", cl.Net.Remote)
+		}
+	}
+}
+
 // attachClient validates an incoming client connection and if viable, attaches the client
 // to the server, performs session housekeeping, and reads incoming packets.
-func (s *Server) attachClient(cl *Client, listener string) error {
-	defer s.Listeners.ClientsWg.Done()
-	s.Listeners.ClientsWg.Add(1)
+func (s *Server) attachClient(cl *Client, listener string) (err error) {
+	done := s.Listeners.TrackClient(listener)
+	defer done()
 
 	go cl.WriteLoop()
 	defer cl.Stop(nil)
 
+	var connected bool
+	defer func() {
+		if !connected {
+			s.rejectConnection(cl, listener, err)
+		}
+	}()
+
 	pk, err := s.readConnectionPacket(cl)
 	if err != nil {
 		return fmt.Errorf("read connection: %w", err)
 	}
 
+	cl.loadTLSState() // the handshake has completed once the connect packet has been read
+	s.checkRevocation(cl, listener)
 	cl.ParseConnect(listener, pk)
-	if atomic.LoadInt64(&s.Info.ClientsConnected) >= s.Options.Capabilities.MaximumClients {
+	if atomic.LoadInt64(&s.Info.ClientsConnected) >= s.Options.Capabilities.MaximumClients || s.Overloaded() {
 		if cl.Properties.ProtocolVersion < 5 {
 			s.SendConnack(cl, packets.ErrServerUnavailable, false, nil)
 		} else {
@@ -436,11 +893,32 @@ func (s *Server) attachClient(cl *Client, listener string) error {
 
 	err = s.hooks.OnConnect(cl, pk)
 	if err != nil {
+		var code packets.Code
+		if errors.As(err, &code) && code.Code >= packets.ErrUnspecifiedError.Code {
+			_ = s.SendConnack(cl, code, false, nil) // the hook rejected the connection with a reason code
+		}
 		return err
 	}
 
+	if cl.Net.Revocation != nil { // revoked certificates are denied whichever auth hooks are used
+		s.hooks.OnAuthFailed(cl, packets.ErrNotAuthorized)
+		err := s.SendConnack(cl, packets.ErrNotAuthorized, false, nil)
+		if err != nil {
+			return fmt.Errorf("invalid connection send ack: %w", err)
+		}
+
+		return packets.ErrNotAuthorized
+	}
+
 	cl.refreshDeadline(cl.State.Keepalive)
-	if !s.hooks.OnConnectAuthenticate(cl, pk) { // [MQTT-3.1.4-2]
+	var ackProps *packets.Properties
+	if s.usesEnhancedAuth(cl) {
+		ackProps, err = s.authenticateEnhanced(cl)
+		if err != nil {
+			return err
+		}
+	} else if !s.hooks.OnConnectAuthenticate(cl, pk) { // [MQTT-3.1.4-2]
+		s.hooks.OnAuthFailed(cl, packets.ErrBadUsernameOrPassword)
 		err := s.SendConnack(cl, packets.ErrBadUsernameOrPassword, false, nil)
 		if err != nil {
 			return fmt.Errorf("invalid connection send ack: %w", err)
@@ -449,19 +927,46 @@ func (s *Server) attachClient(cl *Client, listener string) error {
 		return packets.ErrBadUsernameOrPassword
 	}
 
+	if !s.willAllowed(cl) {
+		err := s.SendConnack(cl, packets.ErrNotAuthorized, false, nil)
+		if err != nil {
+			return fmt.Errorf("invalid connection send ack: %w", err)
+		}
+
+		return packets.ErrNotAuthorized
+	}
+
+	if s.rejectTakeover(cl, pk) {
+		err := s.SendConnack(cl, packets.ErrClientIdentifierNotValid, false, nil)
+		if err != nil {
+			return fmt.Errorf("invalid connection send ack: %w", err)
+		}
+
+		return packets.ErrClientIdentifierNotValid
+	}
+
+	s.AuthCache.InvalidateClient(cl.ID)
 	atomic.AddInt64(&s.Info.ClientsConnected, 1)
 	defer atomic.AddInt64(&s.Info.ClientsConnected, -1)
 
 	s.hooks.OnSessionEstablish(cl, pk)
 
+	if err := s.loadSession(cl.ID); err != nil {
+		s.SendConnack(cl, packets.ErrServerUnavailable, false, nil)
+		return fmt.Errorf("load session: %w", err)
+	}
+
 	sessionPresent := s.inheritClientSession(pk, cl)
 	s.Clients.Add(cl) // [MQTT-4.1.0-1]
 
-	err = s.SendConnack(cl, code, sessionPresent, nil) // [MQTT-3.1.4-5] [MQTT-3.2.0-1] [MQTT-3.2.0-2] &[MQTT-3.14.0-1]
+	err = s.SendConnack(cl, code, sessionPresent, ackProps) // [MQTT-3.1.4-5] [MQTT-3.2.0-1] [MQTT-3.2.0-2] &[MQTT-3.14.0-1]
 	if err != nil {
 		return fmt.Errorf("ack connection packet: %w", err)
 	}
 
+	connected = true
+	defer s.hooks.OnListenerConnection(listener, ListenerConnectionClosed, nil)
+
 	s.loop.willDelayed.Delete(cl.ID) // [MQTT-3.1.3-9]
 
 	if sessionPresent {
@@ -475,6 +980,11 @@ func (s *Server) attachClient(cl *Client, listener string) error {
 
 	err = cl.Read(s.receivePacket)
 	if err != nil {
+		if cl.State.Keepalive > 0 && isTimeout(err) { // [MQTT-3.1.2-22]
+			s.Log.Debug("client keepalive timeout", "client", cl.ID, "keepalive", cl.State.Keepalive, "remote", cl.Net.Remote, "listener", listener)
+			s.hooks.OnKeepAliveTimeout(cl)
+			err = fmt.Errorf("%w: %w", packets.ErrKeepAliveTimeout, err)
+		}
 		s.sendLWT(cl)
 		cl.Stop(err)
 	} else {
@@ -484,6 +994,9 @@ func (s *Server) attachClient(cl *Client, listener string) error {
 
 	expire := (cl.Properties.ProtocolVersion == 5 && cl.Properties.Props.SessionExpiryInterval == 0) || (cl.Properties.ProtocolVersion < 5 && cl.Properties.Clean)
 	s.hooks.OnDisconnect(cl, err, expire)
+	if !cl.IsTakenOver() {
+		s.AuthCache.InvalidateClient(cl.ID)
+	}
 
 	if expire && !cl.IsTakenOver() {
 		cl.ClearInflights()
@@ -494,6 +1007,117 @@ func (s *Server) attachClient(cl *Client, listener string) error {
 	return err
 }
 
+// isTimeout returns true if an error is a network timeout, such as when a read deadline passes.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// usesEnhancedAuth returns true if a client connected with an authentication method and a
+// hook provides enhanced authentication. Otherwise, clients are authenticated by the
+// OnConnectAuthenticate hooks, and auth packets are only passed to the OnAuthPacket hooks.
+func (s *Server) usesEnhancedAuth(cl *Client) bool {
+	return cl.Properties.ProtocolVersion == 5 &&
+		cl.Properties.Props.AuthenticationMethod != "" &&
+		s.hooks.Provides(OnEnhancedAuth)
+}
+
+// authenticateEnhanced performs an enhanced authentication exchange with a connecting client,
+// sending auth packets and reading the responses until the hooks authenticate or reject the
+// client. The returned properties contain the final authentication data for the connack.
+func (s *Server) authenticateEnhanced(cl *Client) (*packets.Properties, error) {
+	ea := EnhancedAuth{
+		Method: cl.Properties.Props.AuthenticationMethod,
+		Data:   cl.Properties.Props.AuthenticationData,
+		Start:  true,
+	}
+
+	for {
+		code, data := s.hooks.OnEnhancedAuth(cl, ea)
+		switch code {
+		case packets.CodeSuccess:
+			return &packets.Properties{
+				AuthenticationMethod: ea.Method, // [MQTT-4.12.0-5]
+				AuthenticationData:   data,
+			}, nil
+		case packets.CodeContinueAuthentication:
+			if err := s.sendAuth(cl, code, ea.Method, data); err != nil {
+				return nil, fmt.Errorf("send auth: %w", err)
+			}
+
+			pk, err := s.readAuthPacket(cl, ea.Method)
+			if err != nil {
+				if c, ok := err.(packets.Code); ok {
+					_ = s.SendConnack(cl, c, false, nil)
+				}
+				return nil, err
+			}
+
+			ea = EnhancedAuth{Method: ea.Method, Data: pk.Properties.AuthenticationData}
+		default:
+			if code.Code < packets.ErrUnspecifiedError.Code {
+				code = packets.ErrNotAuthorized
+			}
+
+			s.hooks.OnAuthFailed(cl, code)
+			if err := s.SendConnack(cl, code, false, nil); err != nil {
+				return nil, fmt.Errorf("invalid connection send ack: %w", err)
+			}
+
+			return nil, code
+		}
+	}
+}
+
+// readAuthPacket reads an auth packet continuing an enhanced authentication exchange with a
+// connecting client.
+func (s *Server) readAuthPacket(cl *Client, method string) (pk packets.Packet, err error) {
+	cl.refreshDeadline(cl.State.Keepalive)
+	fh := new(packets.FixedHeader)
+	if err = cl.ReadFixedHeader(fh); err != nil {
+		return
+	}
+
+	if fh.Type != packets.Auth {
+		return pk, packets.ErrProtocolViolation // [MQTT-4.12.0-1]
+	}
+
+	pk, err = cl.ReadPacket(fh)
+	if err != nil {
+		return
+	}
+
+	pk, err = s.hooks.OnAuthPacket(cl, pk)
+	if err != nil {
+		return
+	}
+
+	if pk.ReasonCode != packets.CodeContinueAuthentication.Code {
+		return pk, packets.ErrProtocolViolationInvalidReason
+	}
+
+	if pk.Properties.AuthenticationMethod != method {
+		return pk, packets.ErrProtocolViolation // [MQTT-4.12.0-5]
+	}
+
+	return pk, nil
+}
+
+// sendAuth sends an auth packet with the authentication data of an enhanced authentication
+// exchange to a client.
+func (s *Server) sendAuth(cl *Client, code packets.Code, method string, data []byte) error {
+	return cl.WritePacket(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Auth,
+		},
+		ReasonCode: code.Code,
+		Properties: packets.Properties{
+			AuthenticationMethod: method,
+			AuthenticationData:   data,
+		},
+	})
+}
+
 // readConnectionPacket reads the first incoming header for a connection, and if
 // acceptable, returns the valid connection packet.
 func (s *Server) readConnectionPacket(cl *Client) (pk packets.Packet, err error) {
@@ -534,6 +1158,20 @@ func (s *Server) receivePacket(cl *Client, pk packets.Packet) error {
 	return nil
 }
 
+// rejectConnection records a connection to a listener which was closed before completing
+// the connect handshake, distinguishing connections which failed the tls handshake.
+func (s *Server) rejectConnection(cl *Client, listener string, err error) {
+	stats := s.Info.Listener(listener)
+	if cl.tlsHandshakeFailed() {
+		atomic.AddInt64(&stats.TLSHandshakeFailed, 1)
+		s.hooks.OnListenerConnection(listener, ListenerTLSHandshakeFailed, err)
+		return
+	}
+
+	atomic.AddInt64(&stats.Rejected, 1)
+	s.hooks.OnListenerConnection(listener, ListenerConnectionRejected, err)
+}
+
 // validateConnect validates that a connect packet is compliant.
 func (s *Server) validateConnect(cl *Client, pk packets.Packet) packets.Code {
 	code := pk.ConnectValidate() // [MQTT-3.1.4-1] [MQTT-3.1.4-2]
@@ -561,6 +1199,10 @@ func (s *Server) validateConnect(cl *Client, pk packets.Packet) packets.Code {
 // session is abandoned.
 func (s *Server) inheritClientSession(pk packets.Packet, cl *Client) bool {
 	if existing, ok := s.Clients.Get(cl.ID); ok {
+		if !existing.Closed() {
+			defer s.hooks.OnSessionTakenOver(existing, cl) // once the session has been inherited
+		}
+
 		_ = s.DisconnectClient(existing, packets.ErrSessionTakenOver)                                   // [MQTT-3.1.4-3]
 		if pk.Connect.Clean || (existing.Properties.Clean && existing.Properties.ProtocolVersion < 5) { // [MQTT-3.1.2-4] [MQTT-3.1.4-4]
 			s.UnsubscribeClient(existing)
@@ -808,6 +1450,23 @@ func (s *Server) Subscribe(filter string, subscriptionId int, handler InlineSubF
 	return nil
 }
 
+// SubscribeMessages adds an inline subscription for the specified topic filter using a unique
+// subscription identifier, calling handler with the contents of any matching messages. It returns
+// a function which removes the subscription. It can be passed as the subscribe callback for listeners.
+func (s *Server) SubscribeMessages(filter string, handler listeners.MessageFn) (func(), error) {
+	id := int(atomic.AddInt64(&s.dynamicSubID, 1))
+	err := s.Subscribe(filter, id, func(cl *Client, sub packets.Subscription, pk packets.Packet) {
+		handler(pk.TopicName, pk.Payload, pk.FixedHeader.Retain, pk.FixedHeader.Qos)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		_ = s.Unsubscribe(filter, id)
+	}, nil
+}
+
 // Unsubscribe removes an inline subscription for the specified subscription and topic filter.
 // It allows you to unsubscribe a specific subscription from the internal subscription
 // associated with the given topic filter.
@@ -864,7 +1523,8 @@ func (s *Server) processPublish(cl *Client, pk packets.Packet) error {
 		return s.DisconnectClient(cl, packets.ErrReceiveMaximum) // ~[MQTT-3.3.4-7] ~[MQTT-3.3.4-8]
 	}
 
-	if !cl.Net.Inline && !s.hooks.OnACLCheck(cl, pk.TopicName, true) {
+	if !cl.Net.Inline && (!s.checkACL(cl, pk.TopicName, true) ||
+		pk.FixedHeader.Retain && !s.checkACLAction(cl, pk.TopicName, ACLActionRetain)) {
 		if pk.FixedHeader.Qos == 0 {
 			return nil
 		}
@@ -882,6 +1542,24 @@ func (s *Server) processPublish(cl *Client, pk packets.Packet) error {
 		return cl.WritePacket(ack)
 	}
 
+	if !cl.Net.Inline && !s.hooks.OnPublishQuota(cl, pk) {
+		if pk.FixedHeader.Qos == 0 {
+			return nil
+		}
+
+		if cl.Properties.ProtocolVersion != 5 {
+			return s.DisconnectClient(cl, packets.ErrQuotaExceeded) // mqtt v3 has no reason codes to reject the publish
+		}
+
+		ackType := packets.Puback
+		if pk.FixedHeader.Qos == 2 {
+			ackType = packets.Pubrec
+		}
+
+		ack := s.buildAck(pk.PacketID, ackType, 0, pk.Properties, packets.ErrQuotaExceeded)
+		return cl.WritePacket(ack)
+	}
+
 	pk.Origin = cl.ID
 	pk.Created = time.Now().Unix()
 
@@ -999,10 +1677,10 @@ func (s *Server) publishToSubscribers(pk packets.Packet) {
 	}
 
 	subscribers := s.Topics.Subscribers(pk.TopicName)
-	if len(subscribers.Shared) > 0 {
+	if len(subscribers.Shared) > 0 || s.hooks.Provides(OnSelectSubscribers) {
 		subscribers = s.hooks.OnSelectSubscribers(subscribers, pk)
 		if len(subscribers.SharedSelected) == 0 {
-			subscribers.SelectShared()
+			s.selectShared(subscribers, pk)
 		}
 		subscribers.MergeSharedSelected()
 	}
@@ -1011,6 +1689,12 @@ func (s *Server) publishToSubscribers(pk packets.Packet) {
 		inlineSubscription.Handler(s.inlineClient, inlineSubscription.Subscription, pk)
 	}
 
+	if len(subscribers.Subscriptions) == 0 && len(subscribers.InlineSubscriptions) == 0 && !strings.HasPrefix(pk.TopicName, SysPrefix) {
+		if cl, ok := s.Clients.Get(pk.Origin); ok {
+			s.hooks.OnMessageDropped(cl, pk, DropNoSubscribers)
+		}
+	}
+
 	for id, subs := range subscribers.Subscriptions {
 		if cl, ok := s.Clients.Get(id); ok {
 			_, err := s.publishToClient(cl, subs, pk)
@@ -1027,7 +1711,8 @@ func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packet
 	}
 
 	out := pk.Copy(false)
-	if !s.hooks.OnACLCheck(cl, pk.TopicName, false) {
+	if !s.checkACL(cl, pk.TopicName, false) {
+		s.hooks.OnMessageDropped(cl, pk, DropNotAuthorized)
 		return out, packets.ErrNotAuthorized
 	}
 	if !sub.FwdRetainedFlag && ((cl.Properties.ProtocolVersion == 5 && !sub.RetainAsPublished) || cl.Properties.ProtocolVersion < 5) { // ![MQTT-3.3.1-13] [v3 MQTT-3.3.1-9]
@@ -1065,14 +1750,20 @@ func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packet
 		if cl.State.Inflight.Len() >= int(s.Options.Capabilities.MaximumInflight) {
 			// add hook?
 			atomic.AddInt64(&s.Info.InflightDropped, 1)
+			s.hooks.OnMessageDropped(cl, pk, DropInflightFull)
 			s.Log.Warn("client store quota reached", "client", cl.ID, "listener", cl.Net.Listener)
 			return out, packets.ErrQuotaExceeded
 		}
 
+		if err := s.enforceQueueLimits(cl, pk); err != nil {
+			return out, err
+		}
+
 		i, err := cl.NextPacketID() // [MQTT-4.3.2-1] [MQTT-4.3.3-1]
 		if err != nil {
 			s.hooks.OnPacketIDExhausted(cl, pk)
 			atomic.AddInt64(&s.Info.InflightDropped, 1)
+			s.hooks.OnMessageDropped(cl, pk, DropPacketIDsExhausted)
 			s.Log.Warn("packet ids exhausted", "error", err, "client", cl.ID, "listener", cl.Net.Listener)
 			return out, packets.ErrQuotaExceeded
 		}
@@ -1082,7 +1773,11 @@ func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packet
 
 		if ok := cl.State.Inflight.Set(out); ok { // [MQTT-4.3.2-3] [MQTT-4.3.3-3]
 			atomic.AddInt64(&s.Info.Inflight, 1)
-			s.hooks.OnQosPublish(cl, out, out.Created, 0)
+			if cl.Net.Conn == nil || cl.Closed() {
+				s.hooks.OnQueuedMessage(cl, out) // delivered when the client reconnects
+			} else {
+				s.hooks.OnQosPublish(cl, out, out.Created, 0)
+			}
 			cl.State.Inflight.DecreaseSendQuota()
 		}
 
@@ -1094,6 +1789,9 @@ func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packet
 	}
 
 	if cl.Net.Conn == nil || cl.Closed() {
+		if out.FixedHeader.Qos == 0 {
+			s.hooks.OnMessageDropped(cl, pk, DropOffline)
+		}
 		return out, packets.CodeDisconnect
 	}
 
@@ -1103,6 +1801,7 @@ func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packet
 	default:
 		atomic.AddInt64(&s.Info.MessagesDropped, 1)
 		cl.ops.hooks.OnPublishDropped(cl, pk)
+		cl.ops.hooks.OnMessageDropped(cl, pk, DropQueueFull)
 		if out.FixedHeader.Qos > 0 {
 			cl.State.Inflight.Delete(out.PacketID) // packet was dropped due to irregular circumstances, so rollback inflight.
 			cl.State.Inflight.IncreaseSendQuota()
@@ -1128,7 +1827,7 @@ func (s *Server) publishRetainedToClient(cl *Client, sub packets.Subscription, e
 		sub.Identifiers = map[string]int{sub.Filter: sub.Identifier}
 	}
 
-	
+	delivered := 0
 	for _, pkv := range s.Topics.Messages(sub.Filter) { // [MQTT-3.8.4-4]
 		_, err := s.publishToClient(cl, sub, pkv)
 		if err != nil {
@@ -1136,6 +1835,11 @@ func (s *Server) publishRetainedToClient(cl *Client, sub packets.Subscription, e
 			continue
 		}
 		s.hooks.OnRetainPublished(cl, pkv)
+		delivered++
+	}
+
+	if delivered > 0 {
+		s.hooks.OnRetainedDelivered(cl, sub.Filter, delivered)
 	}
 }
 
@@ -1257,11 +1961,17 @@ func (s *Server) processSubscribe(cl *Client, pk packets.Packet) error {
 		if code != packets.CodeSuccess {
 			reasonCodes[i] = code.Code // NB 3.9.3 Non-normative 0x91
 			continue
+		}
+
+		sub, err := s.hooks.OnSubscribeFilter(cl, sub)
+		pk.Filters[i] = sub // so the OnSubscribed hooks receive (and persist) the rewritten filter
+		if err != nil {
+			reasonCodes[i] = subscribeRejectedCode(err, s.Options.Capabilities.Compatibilities.ObscureNotAuthorized)
 		} else if !IsValidFilter(sub.Filter, false) {
 			reasonCodes[i] = packets.ErrTopicFilterInvalid.Code
 		} else if sub.NoLocal && IsSharedFilter(sub.Filter) {
 			reasonCodes[i] = packets.ErrProtocolViolationInvalidSharedNoLocal.Code // [MQTT-3.8.3-4]
-		} else if !s.hooks.OnACLCheck(cl, sub.Filter, false) {
+		} else if !s.checkACL(cl, sub.Filter, false) {
 			reasonCodes[i] = packets.ErrNotAuthorized.Code
 			if s.Options.Capabilities.Compatibilities.ObscureNotAuthorized {
 				reasonCodes[i] = packets.ErrUnspecifiedError.Code
@@ -1318,6 +2028,21 @@ func (s *Server) processSubscribe(cl *Client, pk packets.Packet) error {
 	return nil
 }
 
+// subscribeRejectedCode returns the reason code of a filter rejected by a hook, which is the
+// error if it is a failure reason code, or unspecified error otherwise.
+func subscribeRejectedCode(err error, obscure bool) byte {
+	var code packets.Code
+	if !errors.As(err, &code) || code.Code < packets.ErrUnspecifiedError.Code {
+		return packets.ErrUnspecifiedError.Code
+	}
+
+	if obscure && code.Code == packets.ErrNotAuthorized.Code {
+		return packets.ErrUnspecifiedError.Code
+	}
+
+	return code.Code
+}
+
 // processUnsubscribe processes an unsubscribe packet.
 func (s *Server) processUnsubscribe(cl *Client, pk packets.Packet) error {
 	code := packets.CodeSuccess
@@ -1385,14 +2110,53 @@ func (s *Server) UnsubscribeClient(cl *Client) {
 	s.hooks.OnUnsubscribed(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Unsubscribe}, Filters: filters})
 }
 
-// processAuth processes an Auth packet.
+// processAuth processes an Auth packet. If the client connected with an authentication method
+// and a hook provides enhanced authentication, the packet re-authenticates the client.
 func (s *Server) processAuth(cl *Client, pk packets.Packet) error {
-	_, err := s.hooks.OnAuthPacket(cl, pk)
+	pk, err := s.hooks.OnAuthPacket(cl, pk)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if !s.usesEnhancedAuth(cl) {
+		return nil
+	}
+
+	method := cl.Properties.Props.AuthenticationMethod
+	if pk.Properties.AuthenticationMethod != method {
+		return packets.ErrProtocolViolation // [MQTT-4.12.1-1]
+	}
+
+	ea := EnhancedAuth{
+		Method: method,
+		Data:   pk.Properties.AuthenticationData,
+		Reauth: true,
+	}
+
+	switch {
+	case pk.ReasonCode == packets.CodeReAuthenticate.Code:
+		ea.Start = true
+	case pk.ReasonCode != packets.CodeContinueAuthentication.Code || !cl.State.reauthenticating:
+		return packets.ErrProtocolViolationInvalidReason
+	}
+
+	code, data := s.hooks.OnEnhancedAuth(cl, ea)
+	switch code {
+	case packets.CodeSuccess, packets.CodeContinueAuthentication:
+		cl.State.reauthenticating = code == packets.CodeContinueAuthentication
+		if code == packets.CodeSuccess {
+			s.AuthCache.InvalidateClient(cl.ID)
+		}
+		return s.sendAuth(cl, code, method, data)
+	default:
+		cl.State.reauthenticating = false
+		if code.Code < packets.ErrUnspecifiedError.Code {
+			code = packets.ErrNotAuthorized
+		}
+
+		s.hooks.OnAuthFailed(cl, code)
+		return code // [MQTT-4.12.1-2]
+	}
 }
 
 // processDisconnect processes a Disconnect packet.
@@ -1418,12 +2182,40 @@ func (s *Server) processDisconnect(cl *Client, pk packets.Packet) error {
 
 // DisconnectClient sends a Disconnect packet to a client and then closes the client connection.
 func (s *Server) DisconnectClient(cl *Client, code packets.Code) error {
+	return s.disconnectClient(cl, code, packets.Properties{})
+}
+
+// DisconnectClientByID disconnects a connected client by id, so that admin tooling and hooks
+// can remove clients cleanly. Mqtt v5 clients are sent a Disconnect packet with the reason
+// code by DisconnectClient, and v3 clients, which do not support a Disconnect packet from the
+// server, are closed with the reason as the stop cause.
+func (s *Server) DisconnectClientByID(id string, reason packets.Code) error {
+	cl, ok := s.Clients.Get(id)
+	if !ok || cl.Net.Inline || cl.Closed() {
+		return ErrClientNotFound
+	}
+
+	if cl.Properties.ProtocolVersion < 5 {
+		cl.Stop(reason)
+		return nil
+	}
+
+	if err := s.DisconnectClient(cl, reason); err != nil && !errors.Is(err, reason) {
+		return err
+	}
+
+	return nil
+}
+
+// disconnectClient sends a Disconnect packet with the given properties to a client and then
+// closes the client connection.
+func (s *Server) disconnectClient(cl *Client, code packets.Code, props packets.Properties) error {
 	out := packets.Packet{
 		FixedHeader: packets.FixedHeader{
 			Type: packets.Disconnect,
 		},
 		ReasonCode: code.Code,
-		Properties: packets.Properties{},
+		Properties: props,
 	}
 
 	if code.Code >= packets.ErrUnspecifiedError.Code {
@@ -1486,6 +2278,37 @@ func (s *Server) publishSysTopics() {
 		SysPrefix + "/broker/subscriptions":        Int64toa(info.Subscriptions),
 		SysPrefix + "/broker/system/memory":        Int64toa(info.MemoryAlloc),
 		SysPrefix + "/broker/system/threads":       Int64toa(info.Threads),
+
+		// the topics of other brokers, such as mosquitto, which dashboards commonly use
+		SysPrefix + "/broker/clients/active":            Int64toa(info.ClientsConnected),
+		SysPrefix + "/broker/clients/inactive":          Int64toa(info.ClientsDisconnected),
+		SysPrefix + "/broker/bytes/received":            Int64toa(info.BytesReceived),
+		SysPrefix + "/broker/bytes/sent":                Int64toa(info.BytesSent),
+		SysPrefix + "/broker/publish/messages/received": Int64toa(info.MessagesReceived),
+		SysPrefix + "/broker/publish/messages/sent":     Int64toa(info.MessagesSent),
+		SysPrefix + "/broker/publish/messages/dropped":  Int64toa(info.MessagesDropped),
+		SysPrefix + "/broker/messages/stored":           Int64toa(info.Retained + info.Inflight),
+		SysPrefix + "/broker/retained messages/count":   Int64toa(info.Retained),
+		SysPrefix + "/broker/subscriptions/count":       Int64toa(info.Subscriptions),
+		SysPrefix + "/broker/heap/current":              Int64toa(info.MemoryAlloc),
+	}
+
+	for name, avg := range s.load.Update(s.Info, time.Now()) {
+		topics[SysPrefix+"/broker/load/"+name+"/1min"] = strconv.FormatFloat(avg.Min1, 'f', 2, 64)
+		topics[SysPrefix+"/broker/load/"+name+"/5min"] = strconv.FormatFloat(avg.Min5, 'f', 2, 64)
+		topics[SysPrefix+"/broker/load/"+name+"/15min"] = strconv.FormatFloat(avg.Min15, 'f', 2, 64)
+	}
+
+	for id, stats := range s.hooks.StorageStats() {
+		if b, err := json.Marshal(stats); err == nil {
+			topics[SysPrefix+"/broker/storage/"+id] = string(b)
+		}
+	}
+
+	for id, metrics := range s.hooks.Metrics() {
+		if b, err := json.Marshal(metrics); err == nil {
+			topics[SysPrefix+"/broker/hooks/"+id] = string(b)
+		}
 	}
 
 	for topic, payload := range topics {
@@ -1502,7 +2325,22 @@ func (s *Server) publishSysTopics() {
 func (s *Server) Close() error {
 	close(s.done)
 	s.Log.Info("gracefully stopping server")
-	s.Listeners.CloseAll(s.closeListenerClients)
+	if s.Options.ShutdownDrainTimeout > 0 {
+		timeout := time.Duration(s.Options.ShutdownDrainTimeout) * time.Second
+		if !s.Listeners.CloseAllTimeout(s.closeListenerClients, timeout) {
+			s.Log.Warn("clients did not disconnect within drain timeout", "timeout", timeout)
+			for _, cl := range s.Clients.GetAll() {
+				cl.Stop(packets.ErrServerShuttingDown)
+			}
+			s.Listeners.ClientsWg.Wait()
+		}
+	} else {
+		s.Listeners.CloseAll(s.closeListenerClients)
+	}
+
+	// the server context is cancelled once the clients have been closed, so that hook calls
+	// made for clients while they drain are not abandoned.
+	s.cancel(packets.ErrServerShuttingDown)
 	s.hooks.OnStopped()
 	s.hooks.Stop()
 
@@ -1510,12 +2348,32 @@ func (s *Server) Close() error {
 	return nil
 }
 
-// closeListenerClients closes all clients on the specified listener.
+// closeListenerClients closes all clients on the specified listener. MQTT v5 clients are first
+// sent a Server Shutting Down disconnect, including the shutdown server reference if set.
 func (s *Server) closeListenerClients(listener string) {
 	clients := s.Clients.GetByListener(listener)
 	for _, cl := range clients {
-		_ = s.DisconnectClient(cl, packets.ErrServerShuttingDown)
+		if cl.Properties.ProtocolVersion < 5 {
+			cl.Stop(packets.ErrServerShuttingDown) // the server cannot send disconnect packets before v5
+			continue
+		}
+
+		_ = s.disconnectClient(cl, packets.ErrServerShuttingDown, packets.Properties{
+			ServerReference: s.Options.ShutdownServerReference,
+		})
+	}
+}
+
+// willAllowed returns true if a connecting client has no will message, or if the OnACLActionCheck
+// hooks allow it to register the will, and to retain it if the will is to be retained.
+func (s *Server) willAllowed(cl *Client) bool {
+	if atomic.LoadUint32(&cl.Properties.Will.Flag) == 0 {
+		return true
 	}
+
+	will := cl.Properties.Will
+	return s.checkACLAction(cl, will.TopicName, ACLActionWill) &&
+		(!will.Retain || s.checkACLAction(cl, will.TopicName, ACLActionRetain))
 }
 
 // sendLWT issues an LWT message to a topic when a client disconnects.
@@ -1544,6 +2402,10 @@ func (s *Server) sendLWT(cl *Client) {
 	if cl.Properties.Will.WillDelayInterval > 0 {
 		pk.Connect.WillProperties.WillDelayInterval = cl.Properties.Will.WillDelayInterval
 		pk.Expiry = time.Now().Unix() + int64(pk.Connect.WillProperties.WillDelayInterval)
+		if cl.Properties.Will.Expiry > 0 {
+			pk.Expiry = cl.Properties.Will.Expiry // a will restored from a store keeps its original issue time
+		}
+		cl.Properties.Will.Expiry = pk.Expiry
 		s.loop.willDelayed.Add(cl.ID, pk)
 		return
 	}
@@ -1557,42 +2419,73 @@ func (s *Server) sendLWT(cl *Client) {
 	s.hooks.OnWillSent(cl, pk)
 }
 
-// readStore reads in any data from the persistent datastore (if applicable).
+// readStore reads in any data from the persistent datastore (if applicable). Values are
+// restored one at a time as they are streamed from hooks which implement StoredIterator.
 func (s *Server) readStore() error {
-	if s.hooks.Provides(StoredClients) {
-		clients, err := s.hooks.StoredClients()
+	var n int
+	if !s.Options.LazySessionLoading && s.hooks.Provides(StoredClients) {
+		n = 0
+		err := s.hooks.IterClients(func(v storage.Client) error {
+			s.loadClient(v)
+			n++
+			return nil
+		})
 		if err != nil {
 			return fmt.Errorf("failed to load clients; %w", err)
 		}
-		s.loadClients(clients)
-		s.Log.Debug("loaded clients from store", "len", len(clients))
+		s.Log.Debug("loaded clients from store", "len", n)
 	}
 
-	if s.hooks.Provides(StoredSubscriptions) {
-		subs, err := s.hooks.StoredSubscriptions()
+	if !s.Options.LazySessionLoading && s.hooks.Provides(StoredSubscriptions) {
+		n = 0
+		err := s.hooks.IterSubscriptions(func(v storage.Subscription) error {
+			s.loadSubscription(v)
+			n++
+			return nil
+		})
 		if err != nil {
 			return fmt.Errorf("load subscriptions; %w", err)
 		}
-		s.loadSubscriptions(subs)
-		s.Log.Debug("loaded subscriptions from store", "len", len(subs))
+		s.Log.Debug("loaded subscriptions from store", "len", n)
 	}
 
-	if s.hooks.Provides(StoredInflightMessages) {
-		inflight, err := s.hooks.StoredInflightMessages()
+	if !s.Options.LazySessionLoading && s.hooks.Provides(StoredInflightMessages) {
+		n = 0
+		err := s.hooks.IterInflightMessages(func(v storage.Message) error {
+			s.loadInflightMessage(v)
+			n++
+			return nil
+		})
 		if err != nil {
 			return fmt.Errorf("load inflight; %w", err)
 		}
-		s.loadInflight(inflight)
-		s.Log.Debug("loaded inflights from store", "len", len(inflight))
+		s.Log.Debug("loaded inflights from store", "len", n)
+	}
+
+	if !s.Options.LazySessionLoading && s.hooks.Provides(StoredQueuedMessages) {
+		n = 0
+		err := s.hooks.IterQueuedMessages(func(v storage.Message) error {
+			s.loadInflightMessage(v) // queued messages are resent as inflight messages when the client reconnects
+			n++
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("load queued; %w", err)
+		}
+		s.Log.Debug("loaded queued messages from store", "len", n)
 	}
 
 	if s.hooks.Provides(StoredRetainedMessages) {
-		retained, err := s.hooks.StoredRetainedMessages()
+		n = 0
+		err := s.hooks.IterRetainedMessages(func(v storage.Message) error {
+			s.loadRetainedMessage(v)
+			n++
+			return nil
+		})
 		if err != nil {
 			return fmt.Errorf("load retained; %w", err)
 		}
-		s.loadRetained(retained)
-		s.Log.Debug("loaded retained messages from store", "len", len(retained))
+		s.Log.Debug("loaded retained messages from store", "len", n)
 	}
 
 	if s.hooks.Provides(StoredSysInfo) {
@@ -1604,6 +2497,38 @@ func (s *Server) readStore() error {
 		s.Log.Debug("loaded $SYS info from store")
 	}
 
+	s.loadWills()
+
+	return nil
+}
+
+// loadSession restores the stored session of a connecting client if sessions are loaded
+// lazily and the session has not already been restored, so that it can be inherited.
+func (s *Server) loadSession(id string) error {
+	if !s.Options.LazySessionLoading || !s.hooks.Provides(StoredSession) {
+		return nil
+	}
+
+	if _, ok := s.Clients.Get(id); ok {
+		return nil
+	}
+
+	v, err := s.hooks.StoredSession(id)
+	if err != nil || v.Client.ID == "" {
+		return err
+	}
+
+	v.Client.Will = storage.ClientWill{} // the client has reconnected, so a pending will is not sent
+	s.loadClients([]storage.Client{v.Client})
+	if _, ok := s.Clients.Get(id); !ok {
+		return nil // the stored session had expired
+	}
+
+	s.loadSubscriptions(v.Subscriptions)
+	s.loadInflight(v.Inflight)
+	s.loadInflight(v.Queued)
+	s.Log.Debug("loaded session from store", "client", id, "subscriptions", len(v.Subscriptions), "inflight", len(v.Inflight)+len(v.Queued))
+
 	return nil
 }
 
@@ -1630,18 +2555,23 @@ func (s *Server) loadServerInfo(v system.Info) {
 // loadSubscriptions restores subscriptions from the datastore.
 func (s *Server) loadSubscriptions(v []storage.Subscription) {
 	for _, sub := range v {
-		sb := packets.Subscription{
-			Filter:            sub.Filter,
-			RetainHandling:    sub.RetainHandling,
-			Qos:               sub.Qos,
-			RetainAsPublished: sub.RetainAsPublished,
-			NoLocal:           sub.NoLocal,
-			Identifier:        sub.Identifier,
-		}
-		if s.Topics.Subscribe(sub.Client, sb) {
-			if cl, ok := s.Clients.Get(sub.Client); ok {
-				cl.State.Subscriptions.Add(sub.Filter, sb)
-			}
+		s.loadSubscription(sub)
+	}
+}
+
+// loadSubscription restores a subscription from the datastore.
+func (s *Server) loadSubscription(sub storage.Subscription) {
+	sb := packets.Subscription{
+		Filter:            sub.Filter,
+		RetainHandling:    sub.RetainHandling,
+		Qos:               sub.Qos,
+		RetainAsPublished: sub.RetainAsPublished,
+		NoLocal:           sub.NoLocal,
+		Identifier:        sub.Identifier,
+	}
+	if s.Topics.Subscribe(sub.Client, sb) {
+		if cl, ok := s.Clients.Get(sub.Client); ok {
+			cl.State.Subscriptions.Add(sub.Filter, sb)
 		}
 	}
 }
@@ -1649,35 +2579,71 @@ func (s *Server) loadSubscriptions(v []storage.Subscription) {
 // loadClients restores clients from the datastore.
 func (s *Server) loadClients(v []storage.Client) {
 	for _, c := range v {
-		cl := s.NewClient(nil, c.Listener, c.ID, false)
-		cl.Properties.Username = c.Username
-		cl.Properties.Clean = c.Clean
-		cl.Properties.ProtocolVersion = c.ProtocolVersion
-		cl.Properties.Props = packets.Properties{
-			SessionExpiryInterval:     c.Properties.SessionExpiryInterval,
-			SessionExpiryIntervalFlag: c.Properties.SessionExpiryIntervalFlag,
-			AuthenticationMethod:      c.Properties.AuthenticationMethod,
-			AuthenticationData:        c.Properties.AuthenticationData,
-			RequestProblemInfoFlag:    c.Properties.RequestProblemInfoFlag,
-			RequestProblemInfo:        c.Properties.RequestProblemInfo,
-			RequestResponseInfo:       c.Properties.RequestResponseInfo,
-			ReceiveMaximum:            c.Properties.ReceiveMaximum,
-			TopicAliasMaximum:         c.Properties.TopicAliasMaximum,
-			User:                      c.Properties.User,
-			MaximumPacketSize:         c.Properties.MaximumPacketSize,
-		}
-		cl.Properties.Will = Will(c.Will)
-
-		// cancel the context, update cl.State such as disconnected time and stopCause.
-		cl.Stop(packets.ErrServerShuttingDown)
+		s.loadClient(c)
+	}
+}
+
+// loadClient restores a client from the datastore.
+func (s *Server) loadClient(c storage.Client) {
+	cl := s.NewClient(nil, c.Listener, c.ID, false)
+	cl.Properties.Username = c.Username
+	cl.Properties.Clean = c.Clean
+	cl.Properties.ProtocolVersion = c.ProtocolVersion
+	cl.Properties.Props = packets.Properties{
+		SessionExpiryInterval:     c.Properties.SessionExpiryInterval,
+		SessionExpiryIntervalFlag: c.Properties.SessionExpiryIntervalFlag,
+		AuthenticationMethod:      c.Properties.AuthenticationMethod,
+		AuthenticationData:        c.Properties.AuthenticationData,
+		RequestProblemInfoFlag:    c.Properties.RequestProblemInfoFlag,
+		RequestProblemInfo:        c.Properties.RequestProblemInfo,
+		RequestResponseInfo:       c.Properties.RequestResponseInfo,
+		ReceiveMaximum:            c.Properties.ReceiveMaximum,
+		TopicAliasMaximum:         c.Properties.TopicAliasMaximum,
+		User:                      c.Properties.User,
+		MaximumPacketSize:         c.Properties.MaximumPacketSize,
+	}
+	cl.Properties.Will = Will(c.Will)
+
+	// cancel the context, update cl.State such as disconnected time and stopCause.
+	cl.Stop(packets.ErrServerShuttingDown)
+
+	expire := (cl.Properties.ProtocolVersion == 5 && cl.Properties.Props.SessionExpiryInterval == 0) || (cl.Properties.ProtocolVersion < 5 && cl.Properties.Clean)
+	if expire && atomic.LoadUint32(&cl.Properties.Will.Flag) == 1 {
+		s.Clients.Add(cl) // expired by loadWills once the pending will has been sent
+		return
+	}
+
+	s.hooks.OnDisconnect(cl, packets.ErrServerShuttingDown, expire)
+	if expire {
+		cl.ClearInflights()
+		s.UnsubscribeClient(cl)
+	} else {
+		s.Clients.Add(cl)
+	}
+}
+
+// loadWills issues or re-arms the pending will messages of restored clients, such as
+// clients which were connected when the server last stopped unexpectedly, or clients
+// whose delayed will had not yet been sent. Wills are loaded after subscriptions and
+// retained messages so that they reach any restored subscribers.
+func (s *Server) loadWills() {
+	for _, cl := range s.Clients.GetAll() {
+		if atomic.LoadUint32(&cl.Properties.Will.Flag) == 0 {
+			continue
+		}
 
 		expire := (cl.Properties.ProtocolVersion == 5 && cl.Properties.Props.SessionExpiryInterval == 0) || (cl.Properties.ProtocolVersion < 5 && cl.Properties.Clean)
-		s.hooks.OnDisconnect(cl, packets.ErrServerShuttingDown, expire)
 		if expire {
+			cl.Properties.Will.WillDelayInterval = 0 // the session has ended, so the will is sent now [MQTT-3.1.3-9]
+		}
+
+		s.sendLWT(cl)
+
+		if expire {
+			s.hooks.OnDisconnect(cl, packets.ErrServerShuttingDown, expire)
 			cl.ClearInflights()
 			s.UnsubscribeClient(cl)
-		} else {
-			s.Clients.Add(cl)
+			s.Clients.Delete(cl.ID)
 		}
 	}
 }
@@ -1685,19 +2651,29 @@ func (s *Server) loadClients(v []storage.Client) {
 // loadInflight restores inflight messages from the datastore.
 func (s *Server) loadInflight(v []storage.Message) {
 	for _, msg := range v {
-		if client, ok := s.Clients.Get(msg.Client); ok {
-			client.State.Inflight.Set(msg.ToPacket())
-		}
+		s.loadInflightMessage(msg)
+	}
+}
+
+// loadInflightMessage restores an inflight message from the datastore.
+func (s *Server) loadInflightMessage(msg storage.Message) {
+	if client, ok := s.Clients.Get(msg.Client); ok {
+		client.State.Inflight.Set(msg.ToPacket())
 	}
 }
 
 // loadRetained restores retained messages from the datastore.
 func (s *Server) loadRetained(v []storage.Message) {
 	for _, msg := range v {
-		s.Topics.RetainMessage(msg.ToPacket())
+		s.loadRetainedMessage(msg)
 	}
 }
 
+// loadRetainedMessage restores a retained message from the datastore.
+func (s *Server) loadRetainedMessage(msg storage.Message) {
+	s.Topics.RetainMessage(msg.ToPacket())
+}
+
 // clearExpiredClients deletes all clients which have been disconnected for longer
 // than their given expiry intervals.
 func (s *Server) clearExpiredClients(dt int64) {
@@ -1713,12 +2689,65 @@ func (s *Server) clearExpiredClients(dt int64) {
 		}
 
 		if disconnected+int64(expire) < dt {
+			if pk, ok := s.loop.willDelayed.Get(id); ok {
+				s.publishDelayedLWT(id, pk) // [MQTT-3.1.3-9] the session ended before the will delay interval
+			}
+
 			s.hooks.OnClientExpired(client)
 			s.Clients.Delete(id) // [MQTT-4.1.0-2]
 		}
 	}
 }
 
+// clearExpiredStoredSessions expires the stored sessions of clients which have not reconnected
+// if sessions are loaded lazily, as they are not held by the server to be expired. As with
+// sessions loaded on start, the expiry interval of a stored session begins when the server started.
+func (s *Server) clearExpiredStoredSessions(now int64) {
+	if !s.Options.LazySessionLoading || !s.hooks.Provides(StoredClients) {
+		return
+	}
+
+	started := atomic.LoadInt64(&s.Info.Started)
+	var expired []storage.Client
+	err := s.hooks.IterClients(func(v storage.Client) error {
+		if _, ok := s.Clients.Get(v.ID); ok {
+			return nil // the session has been loaded, so is expired by clearExpiredClients
+		}
+
+		expire := int64(s.Options.Capabilities.MaximumSessionExpiryInterval)
+		if v.ProtocolVersion == 5 && v.Properties.SessionExpiryIntervalFlag {
+			expire = int64(v.Properties.SessionExpiryInterval)
+		} else if v.ProtocolVersion < 5 && v.Clean {
+			expire = 0
+		}
+
+		if started+expire < now {
+			expired = append(expired, v)
+		}
+
+		return nil
+	})
+	if err != nil {
+		s.Log.Error("failed to read stored clients", "error", err)
+	}
+
+	for _, v := range expired { // expired once iterating has finished, as the hooks may write to the store
+		if _, ok := s.Clients.Get(v.ID); ok {
+			continue // the client reconnected while the stored clients were read
+		}
+
+		cl := s.NewClient(nil, v.Listener, v.ID, false)
+		cl.Properties.Username = v.Username
+		cl.Properties.ProtocolVersion = v.ProtocolVersion
+		cl.Stop(packets.ErrServerShuttingDown) // the session ended when the server last stopped
+		s.hooks.OnClientExpired(cl)
+	}
+
+	if len(expired) > 0 {
+		s.Log.Debug("expired stored sessions", "len", len(expired))
+	}
+}
+
 // clearExpiredRetainedMessage deletes retained messages from topics if they have expired.
 func (s *Server) clearExpiredRetainedMessages(now int64) {
 	for filter, pk := range s.Topics.Retained.GetAll() {
@@ -1747,23 +2776,35 @@ func (s *Server) clearExpiredInflights(now int64) {
 	}
 }
 
-// sendDelayedLWT sends any LWT messages which have reached their issue time.
+// sendDelayedLWT sends any LWT messages which have reached their issue time, unless the
+// client has reconnected to the session, in which case the LWT is cancelled.
 func (s *Server) sendDelayedLWT(dt int64) {
 	for id, pk := range s.loop.willDelayed.GetAll() {
 		if dt > pk.Expiry {
-			s.publishToSubscribers(pk) // [MQTT-3.1.2-8]
-			if cl, ok := s.Clients.Get(id); ok {
-				if pk.FixedHeader.Retain {
-					s.retainMessage(cl, pk)
-				}
-				cl.Properties.Will = Will{} // [MQTT-3.1.2-10]
-				s.hooks.OnWillSent(cl, pk)
+			if cl, ok := s.Clients.Get(id); ok && !cl.Closed() {
+				s.loop.willDelayed.Delete(id) // [MQTT-3.1.3-9]
+				continue
 			}
-			s.loop.willDelayed.Delete(id)
+
+			s.publishDelayedLWT(id, pk)
 		}
 	}
 }
 
+// publishDelayedLWT publishes a delayed LWT message of a client and removes it from the
+// delayed LWT messages.
+func (s *Server) publishDelayedLWT(id string, pk packets.Packet) {
+	s.loop.willDelayed.Delete(id)
+	s.publishToSubscribers(pk) // [MQTT-3.1.2-8]
+	if cl, ok := s.Clients.Get(id); ok {
+		if pk.FixedHeader.Retain {
+			s.retainMessage(cl, pk)
+		}
+		cl.Properties.Will = Will{} // [MQTT-3.1.2-10]
+		s.hooks.OnWillSent(cl, pk)
+	}
+}
+
 // Int64toa converts an int64 to a string.
 func Int64toa(v int64) string {
 	return strconv.FormatInt(v, 10)
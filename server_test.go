@@ -5,11 +5,17 @@
 package mqtt
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"os"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -73,6 +79,234 @@ func (h *DenyHook) Provides(b byte) bool {
 func (h *DenyHook) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool { return false }
 func (h *DenyHook) OnACLCheck(cl *Client, topic string, write bool) bool     { return false }
 
+// authFailedHook records the codes of failed authentication attempts.
+type authFailedHook struct {
+	HookBase
+	codes chan packets.Code
+}
+
+func (h *authFailedHook) ID() string {
+	return "auth-failed"
+}
+
+func (h *authFailedHook) Provides(b byte) bool {
+	return b == OnAuthFailed
+}
+
+func (h *authFailedHook) OnAuthFailed(cl *Client, code packets.Code) {
+	h.codes <- code
+}
+
+// rejectConnectHook rejects connecting clients with a reason code.
+type rejectConnectHook struct {
+	HookBase
+	code packets.Code
+}
+
+func (h *rejectConnectHook) ID() string {
+	return "reject-connect"
+}
+
+func (h *rejectConnectHook) Provides(b byte) bool {
+	return b == OnConnect
+}
+
+func (h *rejectConnectHook) OnConnect(cl *Client, pk packets.Packet) error {
+	return h.code
+}
+
+// denyActionHook allows clients to connect and access all topics, but denies an acl action.
+type denyActionHook struct {
+	HookBase
+	action ACLAction
+}
+
+func (h *denyActionHook) ID() string {
+	return "deny-action"
+}
+
+func (h *denyActionHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{OnConnectAuthenticate, OnACLCheck, OnACLActionCheck}, []byte{b})
+}
+
+func (h *denyActionHook) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool {
+	return true
+}
+
+func (h *denyActionHook) OnACLCheck(cl *Client, topic string, write bool) bool {
+	return true
+}
+
+func (h *denyActionHook) OnACLActionCheck(cl *Client, topic string, action ACLAction) bool {
+	return action != h.action
+}
+
+// aclDeniedHook records acl denials, and describes them with a rule.
+type aclDeniedHook struct {
+	HookBase
+	sync.Mutex
+	denials []ACLDenial
+}
+
+func (h *aclDeniedHook) ID() string {
+	return "acl-denied"
+}
+
+func (h *aclDeniedHook) Provides(b byte) bool {
+	return b == OnACLDenied
+}
+
+func (h *aclDeniedHook) DescribeACLDenial(cl *Client, topic string, action ACLAction) string {
+	return "rule-" + action.String()
+}
+
+func (h *aclDeniedHook) OnACLDenied(cl *Client, denial ACLDenial) {
+	h.Lock()
+	defer h.Unlock()
+	h.denials = append(h.denials, denial)
+}
+
+// quotaHook allows clients to connect and access all topics, and reports publishes to the
+// over topic as exceeding a quota, throttling them if throttle is set.
+type quotaHook struct {
+	HookBase
+	sync.Mutex
+	throttle bool
+	exceeded []QuotaExceeded
+}
+
+func (h *quotaHook) ID() string {
+	return "quota"
+}
+
+func (h *quotaHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{OnConnectAuthenticate, OnACLCheck, OnPublishQuota, OnQuotaExceeded}, []byte{b})
+}
+
+func (h *quotaHook) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool {
+	return true
+}
+
+func (h *quotaHook) OnACLCheck(cl *Client, topic string, write bool) bool {
+	return true
+}
+
+func (h *quotaHook) OnPublishQuota(cl *Client, pk packets.Packet) (QuotaExceeded, bool) {
+	if pk.TopicName != "over" {
+		return QuotaExceeded{}, false
+	}
+
+	return QuotaExceeded{Rule: "rule", Limit: "messages", Throttled: h.throttle}, true
+}
+
+func (h *quotaHook) OnQuotaExceeded(cl *Client, exceeded QuotaExceeded) {
+	h.Lock()
+	defer h.Unlock()
+	h.exceeded = append(h.exceeded, exceeded)
+}
+
+type listenerEventHook struct {
+	HookBase
+	sync.Mutex
+	events []ListenerEvent
+}
+
+func (h *listenerEventHook) ID() string {
+	return "listener-events"
+}
+
+func (h *listenerEventHook) Provides(b byte) bool {
+	return b == OnListenerConnection
+}
+
+func (h *listenerEventHook) OnListenerConnection(listener string, event ListenerEvent, err error) {
+	h.Lock()
+	defer h.Unlock()
+	h.events = append(h.events, event)
+}
+
+func (h *listenerEventHook) Events() []ListenerEvent {
+	h.Lock()
+	defer h.Unlock()
+	return append([]ListenerEvent{}, h.events...)
+}
+
+// keepaliveHook records the clients which timed out and the disconnect errors.
+type keepaliveHook struct {
+	HookBase
+	sync.Mutex
+	timeouts []string
+	errs     []error
+}
+
+func (h *keepaliveHook) ID() string {
+	return "keepalive"
+}
+
+func (h *keepaliveHook) Provides(b byte) bool {
+	return b == OnKeepAliveTimeout || b == OnDisconnect
+}
+
+func (h *keepaliveHook) OnKeepAliveTimeout(cl *Client) {
+	h.Lock()
+	defer h.Unlock()
+	h.timeouts = append(h.timeouts, cl.ID)
+}
+
+func (h *keepaliveHook) OnDisconnect(cl *Client, err error, expire bool) {
+	h.Lock()
+	defer h.Unlock()
+	h.errs = append(h.errs, err)
+}
+
+type queueHook struct {
+	HookBase
+	queued    []uint16
+	published []uint16
+}
+
+func (h *queueHook) ID() string {
+	return "queue"
+}
+
+func (h *queueHook) Provides(b byte) bool {
+	return b == OnQueuedMessage || b == OnQosPublish
+}
+
+func (h *queueHook) OnQueuedMessage(cl *Client, pk packets.Packet) {
+	h.queued = append(h.queued, pk.PacketID)
+}
+
+func (h *queueHook) OnQosPublish(cl *Client, pk packets.Packet, sent int64, resends int) {
+	h.published = append(h.published, pk.PacketID)
+}
+
+type sessionHook struct {
+	HookBase
+	session storage.Session
+	err     error
+}
+
+func (h *sessionHook) ID() string {
+	return "session"
+}
+
+func (h *sessionHook) Provides(b byte) bool {
+	return b == StoredSession
+}
+
+func (h *sessionHook) StoredSession(id string) (v storage.Session, err error) {
+	if h.err != nil {
+		return v, h.err
+	}
+
+	if id != h.session.Client.ID {
+		return v, nil
+	}
+
+	return h.session, nil
+}
+
 type DelayHook struct {
 	HookBase
 	DisconnectDelay time.Duration
@@ -107,6 +341,124 @@ func newServer() *Server {
 	return s
 }
 
+// challengeHook is an enhanced auth hook for the challenge method, which authenticates clients
+// which send hello and respond to the challenge.
+type challengeHook struct {
+	HookBase
+}
+
+func (h *challengeHook) ID() string {
+	return "challenge"
+}
+
+func (h *challengeHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{OnEnhancedAuth}, []byte{b})
+}
+
+func (h *challengeHook) OnEnhancedAuth(cl *Client, ea EnhancedAuth) (packets.Code, []byte) {
+	switch {
+	case ea.Method != "challenge":
+		return packets.ErrBadAuthenticationMethod, nil
+	case ea.Start && string(ea.Data) == "hello":
+		return packets.CodeContinueAuthentication, []byte("challenge")
+	case !ea.Start && string(ea.Data) == "response":
+		return packets.CodeSuccess, []byte("done")
+	default:
+		return packets.ErrNotAuthorized, nil
+	}
+}
+
+// newEnhancedAuthConnection establishes a connection with a server using the challenge hook,
+// returning the client side of the connection and a channel of the connection result.
+func newEnhancedAuthConnection(t *testing.T) (*Server, net.Conn, *bufio.Reader, chan error) {
+	s := New(&Options{Logger: logger})
+	require.NoError(t, s.AddHook(new(challengeHook), nil))
+	t.Cleanup(func() { _ = s.Close() })
+
+	r, w := net.Pipe()
+	t.Cleanup(func() {
+		_ = w.Close()
+		_ = r.Close()
+	})
+
+	o := make(chan error, 1)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	return s, w, bufio.NewReader(w), o
+}
+
+// writeTestPacket encodes and writes a v5 connect, auth or disconnect packet to a connection.
+func writeTestPacket(t *testing.T, w net.Conn, pk packets.Packet) {
+	pk.ProtocolVersion = 5
+	buf := new(bytes.Buffer)
+	switch pk.FixedHeader.Type {
+	case packets.Connect:
+		require.NoError(t, pk.ConnectEncode(buf))
+	case packets.Auth:
+		require.NoError(t, pk.AuthEncode(buf))
+	case packets.Disconnect:
+		require.NoError(t, pk.DisconnectEncode(buf))
+	}
+
+	_, err := w.Write(buf.Bytes())
+	require.NoError(t, err)
+}
+
+// readTestPacket reads and decodes a v5 connack, auth or disconnect packet from a connection.
+func readTestPacket(t *testing.T, r *bufio.Reader) packets.Packet {
+	hb, err := r.ReadByte()
+	require.NoError(t, err)
+
+	pk := packets.Packet{ProtocolVersion: 5}
+	require.NoError(t, pk.FixedHeader.Decode(hb))
+	n, _, err := packets.DecodeLength(r)
+	require.NoError(t, err)
+
+	buf := make([]byte, n)
+	_, err = io.ReadFull(r, buf)
+	require.NoError(t, err)
+
+	switch pk.FixedHeader.Type {
+	case packets.Connack:
+		require.NoError(t, pk.ConnackDecode(buf))
+	case packets.Auth:
+		require.NoError(t, pk.AuthDecode(buf))
+	case packets.Disconnect:
+		require.NoError(t, pk.DisconnectDecode(buf))
+	}
+
+	return pk
+}
+
+func enhancedConnectPacket(method string, data []byte) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Connect},
+		Connect: packets.ConnectParams{
+			ProtocolName:     []byte("MQTT"),
+			Clean:            true,
+			Keepalive:        30,
+			ClientIdentifier: "enhanced",
+		},
+		Properties: packets.Properties{
+			AuthenticationMethod: method,
+			AuthenticationData:   data,
+		},
+	}
+}
+
+func authPacket(code packets.Code, method string, data []byte) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Auth},
+		ReasonCode:  code.Code,
+		Properties: packets.Properties{
+			AuthenticationMethod: method,
+			AuthenticationData:   data,
+		},
+	}
+}
+
 func newServerWithInlineClient() *Server {
 	cc := NewDefaultServerCapabilities()
 	cc.MaximumMessageExpiryInterval = 0
@@ -205,6 +557,95 @@ func TestServerAddHook(t *testing.T) {
 	require.Equal(t, int64(1), s.hooks.Len())
 }
 
+func TestServerAddHookWithPriority(t *testing.T) {
+	s := New(nil)
+	s.Log = logger
+	require.NotNil(t, s)
+
+	first := new(HookBase)
+	second := new(modifiedHookBase)
+	require.NoError(t, s.AddHook(first, nil))
+	require.NoError(t, s.AddHookWithPriority(second, nil, 1, "t1"))
+	require.Equal(t, []Hook{second, first}, s.hooks.GetAll())
+}
+
+func TestServerAddHookAsync(t *testing.T) {
+	s := New(nil)
+	s.Log = logger
+	require.NotNil(t, s)
+
+	err := s.AddHookAsync(new(modifiedHookBase), nil, AsyncOptions{Overflow: OverflowDrop})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), s.hooks.Len())
+	require.Equal(t, map[string]int64{"modified": 0}, s.AsyncDropped())
+}
+
+func TestServerHookPanics(t *testing.T) {
+	s := New(&Options{Logger: logger, HookPanicLimit: 5})
+	require.Equal(t, int64(5), s.hooks.PanicLimit)
+	require.NoError(t, s.AddHook(new(panicHook), nil))
+
+	cl, _, _ := newTestClient()
+	require.False(t, s.hooks.OnConnectAuthenticate(cl, packets.Packet{}))
+	require.Equal(t, map[string]int64{"panic": 1}, s.HookPanics())
+}
+
+func TestServerAddHookWithTimeout(t *testing.T) {
+	s := New(nil)
+	s.Log = logger
+	require.NotNil(t, s)
+
+	err := s.AddHookWithTimeout(new(modifiedHookBase), nil, TimeoutOptions{Timeout: 100, Policy: TimeoutSkip})
+	require.NoError(t, err)
+	require.Equal(t, &TimeoutOptions{Timeout: 100, Policy: TimeoutSkip}, s.hooks.load().timeout(0))
+}
+
+func TestServerAddHookScoped(t *testing.T) {
+	s := New(nil)
+	s.Log = logger
+	require.NotNil(t, s)
+
+	err := s.AddHookScoped(new(modifiedHookBase), nil, HookScope{Listeners: []string{"tcp"}})
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{"tcp": true}, s.hooks.load().filters[0].listeners)
+}
+
+func TestServerRemoveHook(t *testing.T) {
+	s := New(nil)
+	s.Log = logger
+	require.NotNil(t, s)
+
+	err := s.AddHook(new(modifiedHookBase), nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), s.hooks.Len())
+
+	err = s.RemoveHook("modified")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), s.hooks.Len())
+
+	err = s.RemoveHook("modified")
+	require.ErrorIs(t, err, ErrHookNotFound)
+}
+
+func TestServerReloadHook(t *testing.T) {
+	s := New(nil)
+	s.Log = logger
+
+	hook := new(reloadHook)
+	err := s.AddHook(hook, nil)
+	require.NoError(t, err)
+
+	err = s.ReloadHook("reload", "new")
+	require.NoError(t, err)
+	require.Equal(t, "new", hook.config)
+
+	err = s.ReloadHook("reload", 1)
+	require.ErrorIs(t, err, ErrInvalidConfigType)
+
+	err = s.ReloadHook("missing", "new")
+	require.ErrorIs(t, err, ErrHookNotFound)
+}
+
 func TestServerAddListener(t *testing.T) {
 	s := newServer()
 	defer s.Close()
@@ -214,103 +655,423 @@ func TestServerAddListener(t *testing.T) {
 	err := s.AddListener(listeners.NewMockListener("t1", ":1882"))
 	require.NoError(t, err)
 
-	// add existing listener
-	err = s.AddListener(listeners.NewMockListener("t1", ":1882"))
-	require.Error(t, err)
-	require.Equal(t, ErrListenerIDExists, err)
+	// add existing listener
+	err = s.AddListener(listeners.NewMockListener("t1", ":1882"))
+	require.Error(t, err)
+	require.Equal(t, ErrListenerIDExists, err)
+}
+
+func TestServerRemoveListener(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	err := s.AddListener(listeners.NewMockListener("t1", ":1882"))
+	require.NoError(t, err)
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("t1", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectClean).RawBytes)
+	}()
+
+	go func() {
+		_, _ = io.ReadAll(w)
+	}()
+
+	require.Eventually(t, func() bool {
+		return len(s.Clients.GetByListener("t1")) == 1
+	}, time.Second, time.Millisecond)
+	cl := s.Clients.GetByListener("t1")[0]
+
+	err = s.RemoveListener(context.Background(), "t1", true)
+	require.NoError(t, err)
+	require.Error(t, <-o)
+	require.ErrorIs(t, cl.StopCause(), packets.ErrServerShuttingDown)
+	_ = r.Close()
+
+	_, ok := s.Listeners.Get("t1")
+	require.False(t, ok)
+	_ = w.Close()
+}
+
+func TestServerRemoveListenerDrainTimeout(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	err := s.AddListener(listeners.NewMockListener("t1", ":1882"))
+	require.NoError(t, err)
+
+	r, w := net.Pipe()
+	go func() {
+		_ = s.EstablishConnection("t1", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectClean).RawBytes)
+		_, _ = io.ReadAll(w)
+	}()
+
+	require.Eventually(t, func() bool {
+		return len(s.Clients.GetByListener("t1")) == 1
+	}, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = s.RemoveListener(ctx, "t1", false)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Len(t, s.Clients.GetByListener("t1"), 1)
+
+	_, ok := s.Listeners.Get("t1")
+	require.True(t, ok) // the listener is kept so the drain can be resumed
+
+	err = s.RemoveListener(context.Background(), "t1", true)
+	require.NoError(t, err)
+	require.Empty(t, s.Clients.GetByListener("t1"))
+
+	_, ok = s.Listeners.Get("t1")
+	require.False(t, ok)
+
+	_ = w.Close()
+	_ = r.Close()
+}
+
+func TestServerHealth(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	require.NoError(t, s.Health())
+
+	hook := new(healthHook)
+	require.NoError(t, s.AddHook(hook, nil))
+	hook.err = errTestHook
+	require.ErrorIs(t, s.Health(), errTestHook)
+}
+
+type backupHook struct {
+	HookBase
+	data []byte
+}
+
+func (h *backupHook) ID() string {
+	return "backup"
+}
+
+func (h *backupHook) Backup(w io.Writer) error {
+	_, err := w.Write(h.data)
+	return err
+}
+
+func (h *backupHook) Restore(r io.Reader) error {
+	var err error
+	h.data, err = io.ReadAll(r)
+	return err
+}
+
+func TestServerSnapshot(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	buf := new(bytes.Buffer)
+	require.ErrorIs(t, s.Snapshot(buf), ErrNoBackupHook)
+
+	require.NoError(t, s.AddHook(new(modifiedHookBase), nil))
+	require.NoError(t, s.AddHook(&backupHook{data: []byte("snapshot")}, nil))
+	require.NoError(t, s.Snapshot(buf))
+	require.Equal(t, "snapshot", buf.String())
+}
+
+func TestServerRemoveListenerNotFound(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	err := s.RemoveListener(context.Background(), "t1", true)
+	require.ErrorIs(t, err, ErrListenerNotFound)
+}
+
+func TestServerAddHooksFromConfig(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	require.NotNil(t, s)
+	s.Log = logger
+
+	hooks := []HookLoadConfig{
+		{Hook: new(modifiedHookBase)},
+	}
+
+	err := s.AddHooksFromConfig(hooks)
+	require.NoError(t, err)
+}
+
+func TestServerAddHooksFromConfigListeners(t *testing.T) {
+	s := New(&Options{Logger: logger})
+	defer s.Close()
+
+	hooks := []HookLoadConfig{
+		{Hook: new(AllowHook), Listeners: []string{"internal"}},
+	}
+
+	err := s.AddHooksFromConfig(hooks)
+	require.NoError(t, err)
+	require.True(t, s.AuthenticateHTTP("internal", "127.0.0.1:9999", nil, nil, "a/b", true))
+	require.False(t, s.AuthenticateHTTP("public", "127.0.0.1:9999", nil, nil, "a/b", true))
+}
+
+func TestServerAddHooksFromConfigPriority(t *testing.T) {
+	s := New(&Options{Logger: logger})
+	defer s.Close()
+
+	deny := new(DenyHook)
+	allow := new(AllowHook)
+	hooks := []HookLoadConfig{
+		{Hook: deny},
+		{Hook: allow, Priority: 10},
+	}
+
+	err := s.AddHooksFromConfig(hooks)
+	require.NoError(t, err)
+	require.Equal(t, []Hook{allow, deny}, s.hooks.GetAll())
+}
+
+func TestServerAddHookForListeners(t *testing.T) {
+	s := New(&Options{Logger: logger})
+	defer s.Close()
+
+	err := s.AddHookForListeners(new(AllowHook), nil, "internal")
+	require.NoError(t, err)
+	err = s.AddHookForListeners(new(DenyHook), nil, "public")
+	require.NoError(t, err)
+
+	cl, _, _ := newTestClient()
+	cl.Net.Listener = "internal"
+	require.True(t, s.hooks.OnConnectAuthenticate(cl, packets.Packet{}))
+	require.True(t, s.hooks.OnACLCheck(cl, "a/b", true))
+
+	cl.Net.Listener = "public"
+	require.False(t, s.hooks.OnConnectAuthenticate(cl, packets.Packet{}))
+	require.False(t, s.hooks.OnACLCheck(cl, "a/b", true))
+}
+
+func TestServerAddHooksFromConfigError(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	require.NotNil(t, s)
+	s.Log = logger
+
+	hooks := []HookLoadConfig{
+		{Hook: new(modifiedHookBase), Config: map[string]interface{}{}},
+	}
+
+	err := s.AddHooksFromConfig(hooks)
+	require.Error(t, err)
+}
+
+func TestServerAddListenerInitFailure(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	require.NotNil(t, s)
+
+	m := listeners.NewMockListener("t1", ":1882")
+	m.ErrListen = true
+	err := s.AddListener(m)
+	require.Error(t, err)
+}
+
+func TestServerAddListenersFromConfig(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	require.NotNil(t, s)
+	s.Log = logger
+
+	lc := []listeners.Config{
+		{Type: listeners.TypeTCP, ID: "tcp", Address: ":1883"},
+		{Type: listeners.TypeWS, ID: "ws", Address: ":1882"},
+		{Type: listeners.TypeHealthCheck, ID: "health", Address: ":1881"},
+		{Type: listeners.TypeSysInfo, ID: "info", Address: ":1880"},
+		{Type: listeners.TypeHTTPPublish, ID: "publish", Address: ":1879"},
+		{Type: listeners.TypeSSE, ID: "sse", Address: ":1878"},
+		{Type: listeners.TypeGRPC, ID: "grpc", Address: ":1877"},
+		{Type: listeners.TypeMQTTSN, ID: "mqttsn", Address: ":1876"},
+		{Type: listeners.TypeMultiplex, ID: "multiplex", Address: ":1875"},
+		{Type: listeners.TypeUnix, ID: "unix", Address: "mochi.sock"},
+		{Type: listeners.TypeMock, ID: "mock", Address: "0"},
+		{Type: "unknown", ID: "unknown"},
+	}
+
+	err := s.AddListenersFromConfig(lc)
+	require.NoError(t, err)
+	require.Equal(t, 11, s.Listeners.Len())
+
+	tcp, _ := s.Listeners.Get("tcp")
+	require.Equal(t, "[::]:1883", tcp.Address())
+
+	ws, _ := s.Listeners.Get("ws")
+	require.Equal(t, ":1882", ws.Address())
+
+	health, _ := s.Listeners.Get("health")
+	require.Equal(t, ":1881", health.Address())
+
+	info, _ := s.Listeners.Get("info")
+	require.Equal(t, ":1880", info.Address())
+
+	unix, _ := s.Listeners.Get("unix")
+	require.Equal(t, "mochi.sock", unix.Address())
+
+	mock, _ := s.Listeners.Get("mock")
+	require.Equal(t, "0", mock.Address())
+
+	publish, _ := s.Listeners.Get("publish")
+	require.Equal(t, ":1879", publish.Address())
+
+	sse, _ := s.Listeners.Get("sse")
+	require.Equal(t, ":1878", sse.Address())
+
+	grpc, _ := s.Listeners.Get("grpc")
+	require.Equal(t, "[::]:1877", grpc.Address())
+
+	mqttsn, _ := s.Listeners.Get("mqttsn")
+	require.Equal(t, "[::]:1876", mqttsn.Address())
+
+	multiplex, _ := s.Listeners.Get("multiplex")
+	require.Equal(t, "[::]:1875", multiplex.Address())
+}
+
+type revocationListener struct {
+	*listeners.MockListener
+	err error
+}
+
+func (l *revocationListener) CheckRevocation(state tls.ConnectionState) error {
+	return l.err
+}
+
+func TestServerCheckRevocation(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	err := s.AddListener(&revocationListener{MockListener: listeners.NewMockListener("revoked", ":1882"), err: listeners.ErrCertificateRevoked})
+	require.NoError(t, err)
+	err = s.AddListener(listeners.NewMockListener("mock", ":1883"))
+	require.NoError(t, err)
+
+	cl, _, _ := newTestClient()
+	s.checkRevocation(cl, "revoked")
+	require.NoError(t, cl.Net.Revocation) // not connected over tls
+
+	cl.Net.TLS = &tls.ConnectionState{HandshakeComplete: true}
+	s.checkRevocation(cl, "revoked")
+	require.ErrorIs(t, cl.Net.Revocation, listeners.ErrCertificateRevoked)
+
+	cl.Net.Revocation = nil
+	s.checkRevocation(cl, "mock")
+	require.NoError(t, cl.Net.Revocation)
+
+	s.checkRevocation(cl, "missing")
+	require.NoError(t, cl.Net.Revocation)
+}
+
+func TestServerEstablishConnectionRevoked(t *testing.T) {
+	s := newServer() // the allow hook does not check revocation, so the server must deny the client
+	defer s.Close()
+
+	err := s.AddListener(&revocationListener{MockListener: listeners.NewMockListener("revoked", ":1882"), err: listeners.ErrCertificateRevoked})
+	require.NoError(t, err)
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("revoked", &tlsStateConn{Conn: r, state: tls.ConnectionState{HandshakeComplete: true}})
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt5).RawBytes)
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(w)
+		require.NoError(t, err)
+		recv <- buf
+	}()
+
+	err = <-o
+	require.ErrorIs(t, err, packets.ErrNotAuthorized)
+	buf := <-recv
+	require.Equal(t, packets.Connack<<4, buf[0])
+	require.Equal(t, packets.ErrNotAuthorized.Code, buf[3])
+
+	_ = w.Close()
+	_ = r.Close()
 }
 
-func TestServerAddHooksFromConfig(t *testing.T) {
+func TestServerAuthenticateHTTP(t *testing.T) {
 	s := newServer()
 	defer s.Close()
-	require.NotNil(t, s)
-	s.Log = logger
-
-	hooks := []HookLoadConfig{
-		{Hook: new(modifiedHookBase)},
-	}
+	require.True(t, s.AuthenticateHTTP("publish", "127.0.0.1:9999", []byte("mochi"), []byte("pass"), "a/b", true))
 
-	err := s.AddHooksFromConfig(hooks)
-	require.NoError(t, err)
+	s = New(&Options{Logger: logger})
+	defer s.Close()
+	_ = s.AddHook(new(DenyHook), nil)
+	failed := &authFailedHook{codes: make(chan packets.Code, 1)}
+	_ = s.AddHook(failed, nil)
+	require.False(t, s.AuthenticateHTTP("publish", "127.0.0.1:9999", []byte("mochi"), []byte("pass"), "a/b", true))
+	require.Equal(t, packets.ErrBadUsernameOrPassword, <-failed.codes)
 }
 
-func TestServerAddHooksFromConfigError(t *testing.T) {
+func TestServerAddListenersFromConfigError(t *testing.T) {
 	s := newServer()
 	defer s.Close()
 	require.NotNil(t, s)
 	s.Log = logger
 
-	hooks := []HookLoadConfig{
-		{Hook: new(modifiedHookBase), Config: map[string]interface{}{}},
+	lc := []listeners.Config{
+		{Type: listeners.TypeTCP, ID: "tcp", Address: "x"},
 	}
 
-	err := s.AddHooksFromConfig(hooks)
+	err := s.AddListenersFromConfig(lc)
 	require.Error(t, err)
+	require.Equal(t, 0, s.Listeners.Len())
 }
 
-func TestServerAddListenerInitFailure(t *testing.T) {
+func TestServerAddListenersFromConfigWebTransport(t *testing.T) {
 	s := newServer()
 	defer s.Close()
+	s.Log = logger
 
-	require.NotNil(t, s)
-
-	m := listeners.NewMockListener("t1", ":1882")
-	m.ErrListen = true
-	err := s.AddListener(m)
-	require.Error(t, err)
+	err := s.AddListenersFromConfig([]listeners.Config{
+		{Type: listeners.TypeWebTransport, ID: "wt", Address: ":1876"},
+	})
+	require.ErrorIs(t, err, listeners.ErrWebTransportTLSRequired)
+	require.Equal(t, 0, s.Listeners.Len())
 }
 
-func TestServerAddListenersFromConfig(t *testing.T) {
+func TestServerAddListenersFromConfigInvalidTLS(t *testing.T) {
 	s := newServer()
 	defer s.Close()
-	require.NotNil(t, s)
 	s.Log = logger
 
-	lc := []listeners.Config{
-		{Type: listeners.TypeTCP, ID: "tcp", Address: ":1883"},
-		{Type: listeners.TypeWS, ID: "ws", Address: ":1882"},
-		{Type: listeners.TypeHealthCheck, ID: "health", Address: ":1881"},
-		{Type: listeners.TypeSysInfo, ID: "info", Address: ":1880"},
-		{Type: listeners.TypeUnix, ID: "unix", Address: "mochi.sock"},
-		{Type: listeners.TypeMock, ID: "mock", Address: "0"},
-		{Type: "unknown", ID: "unknown"},
-	}
-
-	err := s.AddListenersFromConfig(lc)
-	require.NoError(t, err)
-	require.Equal(t, 6, s.Listeners.Len())
-
-	tcp, _ := s.Listeners.Get("tcp")
-	require.Equal(t, "[::]:1883", tcp.Address())
-
-	ws, _ := s.Listeners.Get("ws")
-	require.Equal(t, ":1882", ws.Address())
-
-	health, _ := s.Listeners.Get("health")
-	require.Equal(t, ":1881", health.Address())
-
-	info, _ := s.Listeners.Get("info")
-	require.Equal(t, ":1880", info.Address())
-
-	unix, _ := s.Listeners.Get("unix")
-	require.Equal(t, "mochi.sock", unix.Address())
-
-	mock, _ := s.Listeners.Get("mock")
-	require.Equal(t, "0", mock.Address())
+	err := s.AddListenersFromConfig([]listeners.Config{
+		{Type: listeners.TypeTCP, ID: "tcp", Address: ":1883", TLSConfig: new(tls.Config), TLS13Only: true, TLSMaxVersion: "1.2"},
+	})
+	require.ErrorIs(t, err, listeners.ErrInvalidTLSConfig)
+	require.Equal(t, 0, s.Listeners.Len())
 }
 
-func TestServerAddListenersFromConfigError(t *testing.T) {
+func TestServerAddListenersFromConfigSystemd(t *testing.T) {
 	s := newServer()
 	defer s.Close()
-	require.NotNil(t, s)
 	s.Log = logger
 
+	t.Setenv("LISTEN_FDS", "")
 	lc := []listeners.Config{
-		{Type: listeners.TypeTCP, ID: "tcp", Address: "x"},
+		{Type: listeners.TypeSystemd, ID: "systemd", Address: "mqtt"},
 	}
 
 	err := s.AddListenersFromConfig(lc)
-	require.Error(t, err)
+	require.ErrorIs(t, err, listeners.ErrNoSocketActivation)
 	require.Equal(t, 0, s.Listeners.Len())
 }
 
@@ -418,6 +1179,65 @@ func TestServerEventLoop(t *testing.T) {
 	time.Sleep(time.Millisecond * 3)
 }
 
+func TestServerPublishSysTopicsStorageStats(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	hook := &statsHook{stats: storage.Stats{Reads: storage.OperationStats{Count: 2, Errors: 1}}}
+	require.NoError(t, s.AddHook(hook, nil))
+
+	s.publishSysTopics()
+
+	pk, ok := s.Topics.Retained.Get(SysPrefix + "/broker/storage/stats")
+	require.True(t, ok)
+
+	var stats storage.Stats
+	require.NoError(t, json.Unmarshal(pk.Payload, &stats))
+	require.Equal(t, int64(2), stats.Reads.Count)
+	require.Equal(t, int64(1), stats.Reads.Errors)
+}
+
+func TestServerPublishSysTopicsLoad(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	atomic.StoreInt64(&s.Info.ClientsConnected, 2)
+	atomic.StoreInt64(&s.Info.Retained, 3)
+	atomic.StoreInt64(&s.Info.Inflight, 4)
+	s.publishSysTopics()
+
+	for topic, want := range map[string]string{
+		SysPrefix + "/broker/clients/active":              "2",
+		SysPrefix + "/broker/messages/stored":             "7",
+		SysPrefix + "/broker/retained messages/count":     "3",
+		SysPrefix + "/broker/load/messages/received/1min": "0.00",
+		SysPrefix + "/broker/load/connections/15min":      "0.00",
+	} {
+		pk, ok := s.Topics.Retained.Get(topic)
+		require.True(t, ok, topic)
+		require.Equal(t, want, string(pk.Payload), topic)
+	}
+}
+
+func TestServerPublishSysTopicsHookMetrics(t *testing.T) {
+	s := New(&Options{Logger: logger, HookMetrics: true})
+	defer s.Close()
+
+	require.NoError(t, s.AddHook(new(modifiedHookBase), nil))
+	cl, _, _ := newTestClient()
+	require.True(t, s.hooks.OnACLCheck(cl, "a/b/c", true))
+
+	s.publishSysTopics()
+
+	pk, ok := s.Topics.Retained.Get(SysPrefix + "/broker/hooks/modified")
+	require.True(t, ok)
+
+	var metrics map[string]HookMetrics
+	require.NoError(t, json.Unmarshal(pk.Payload, &metrics))
+	require.Equal(t, int64(1), metrics["OnACLCheck"].Calls)
+	require.Equal(t, int64(1), s.HookMetrics()["modified"]["OnSysInfoTick"].Calls)
+}
+
 func TestServerReadConnectionPacket(t *testing.T) {
 	s := newServer()
 	defer s.Close()
@@ -540,6 +1360,85 @@ func TestEstablishConnection(t *testing.T) {
 	require.False(t, ok)
 }
 
+func TestEstablishConnectionListenerStats(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	hook := new(listenerEventHook)
+	require.NoError(t, s.AddHook(hook, nil))
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("t1", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectClean).RawBytes)
+		_, _ = w.Write(packets.TPacketData[packets.Disconnect].Get(packets.TDisconnect).RawBytes)
+	}()
+
+	go func() {
+		_, _ = io.ReadAll(w)
+	}()
+
+	require.NoError(t, <-o)
+	_ = w.Close()
+
+	stats := s.Info.Clone().Listeners["t1"]
+	require.Equal(t, &system.ListenerInfo{Accepted: 1}, stats)
+	require.Equal(t, []ListenerEvent{ListenerConnectionAccepted, ListenerConnectionClosed}, hook.Events())
+}
+
+func TestEstablishConnectionListenerStatsRejected(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	hook := new(listenerEventHook)
+	require.NoError(t, s.AddHook(hook, nil))
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("t1", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMalReservedBit).RawBytes)
+		_, _ = io.ReadAll(w)
+	}()
+
+	require.Error(t, <-o)
+	_ = w.Close()
+
+	stats := s.Info.Clone().Listeners["t1"]
+	require.Equal(t, &system.ListenerInfo{Accepted: 1, Rejected: 1}, stats)
+	require.Equal(t, []ListenerEvent{ListenerConnectionAccepted, ListenerConnectionRejected}, hook.Events())
+}
+
+func TestEstablishConnectionListenerStatsTLSHandshakeFailed(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	hook := new(listenerEventHook)
+	require.NoError(t, s.AddHook(hook, nil))
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("t1", tls.Server(r, new(tls.Config)))
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectClean).RawBytes) // not a tls client hello
+		_, _ = io.ReadAll(w)
+	}()
+
+	require.Error(t, <-o)
+	_ = w.Close()
+
+	stats := s.Info.Clone().Listeners["t1"]
+	require.Equal(t, &system.ListenerInfo{Accepted: 1, TLSHandshakeFailed: 1}, stats)
+	require.Equal(t, []ListenerEvent{ListenerConnectionAccepted, ListenerTLSHandshakeFailed}, hook.Events())
+}
+
 func TestEstablishConnectionAckFailure(t *testing.T) {
 	s := newServer()
 	defer s.Close()
@@ -604,6 +1503,85 @@ func TestEstablishConnectionReadError(t *testing.T) {
 	_ = r.Close()
 }
 
+func TestEstablishConnectionKeepAliveTimeout(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	hook := new(keepaliveHook)
+	require.NoError(t, s.AddHook(hook, nil))
+
+	pk := *packets.TPacketData[packets.Connect].Get(packets.TConnectClean).Packet
+	pk.Connect.Keepalive = 1
+	buf := new(bytes.Buffer)
+	require.NoError(t, pk.ConnectEncode(buf))
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(buf.Bytes()) // no further packets are sent, so the keepalive expires
+	}()
+
+	go func() {
+		_, _ = io.ReadAll(w)
+	}()
+
+	err := <-o
+	require.ErrorIs(t, err, packets.ErrKeepAliveTimeout)
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	hook.Lock()
+	defer hook.Unlock()
+	require.Equal(t, []string{pk.Connect.ClientIdentifier}, hook.timeouts)
+	require.Len(t, hook.errs, 1)
+	require.ErrorIs(t, hook.errs[0], packets.ErrKeepAliveTimeout)
+
+	_ = w.Close()
+	_ = r.Close()
+}
+
+func TestEstablishConnectionReadErrorNoKeepAliveTimeout(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	hook := new(keepaliveHook)
+	require.NoError(t, s.AddHook(hook, nil))
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt5).RawBytes)
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectClean).RawBytes) // second connect error
+	}()
+
+	go func() {
+		_, _ = io.ReadAll(w)
+	}()
+
+	err := <-o
+	require.Error(t, err)
+	require.NotErrorIs(t, err, packets.ErrKeepAliveTimeout)
+
+	hook.Lock()
+	defer hook.Unlock()
+	require.Empty(t, hook.timeouts)
+
+	_ = w.Close()
+	_ = r.Close()
+}
+
+func TestIsTimeout(t *testing.T) {
+	require.True(t, isTimeout(os.ErrDeadlineExceeded))
+	require.True(t, isTimeout(fmt.Errorf("read: %w", os.ErrDeadlineExceeded)))
+	require.False(t, isTimeout(io.EOF))
+	require.False(t, isTimeout(nil))
+}
+
 func TestEstablishConnectionInheritExisting(t *testing.T) {
 	s := newServer()
 	defer s.Close()
@@ -619,25 +1597,94 @@ func TestEstablishConnectionInheritExisting(t *testing.T) {
 	r, w := net.Pipe()
 	o := make(chan error)
 	go func() {
-		err := s.EstablishConnection("tcp", r)
-		o <- err
+		err := s.EstablishConnection("tcp", r)
+		o <- err
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt311).RawBytes)
+		time.Sleep(time.Millisecond) // we want to receive the queued inflight, so we need to wait a moment before sending the disconnect.
+		_, _ = w.Write(packets.TPacketData[packets.Disconnect].Get(packets.TDisconnect).RawBytes)
+	}()
+
+	// receive the disconnect session takeover
+	takeover := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(r0)
+		require.NoError(t, err)
+		takeover <- buf
+	}()
+
+	// receive the connack
+	recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(w)
+		require.NoError(t, err)
+		recv <- buf
+	}()
+
+	err := <-o
+	require.NoError(t, err)
+
+	// Retrieve the client corresponding to the Client Identifier.
+	retrievedCl, ok := s.Clients.Get(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt311).Packet.Connect.ClientIdentifier)
+	require.True(t, ok)
+	require.ErrorIs(t, retrievedCl.StopCause(), packets.CodeDisconnect) // true error is disconnect
+
+	connackPlusPacket := append(
+		packets.TPacketData[packets.Connack].Get(packets.TConnackAcceptedSessionExists).RawBytes,
+		packets.TPacketData[packets.Publish].Get(packets.TPublishQos1Dup).RawBytes...,
+	)
+	require.Equal(t, connackPlusPacket, <-recv)
+	require.Equal(t, packets.TPacketData[packets.Disconnect].Get(packets.TDisconnectTakeover).RawBytes, <-takeover)
+
+	time.Sleep(time.Microsecond * 100)
+	_ = w.Close()
+	_ = r.Close()
+
+	clw, ok := s.Clients.Get(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt311).Packet.Connect.ClientIdentifier)
+	require.True(t, ok)
+	require.NotEmpty(t, clw.State.Subscriptions)
+	require.True(t, cl.IsTakenOver())
+
+	// Prevent sequential takeover memory-bloom.
+	require.Empty(t, cl.State.Subscriptions.GetAll())
+}
+
+func TestEstablishConnectionInheritLazySession(t *testing.T) {
+	s := newServer()
+	s.Options.LazySessionLoading = true
+	defer s.Close()
+
+	pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet
+	_ = s.AddHook(&sessionHook{
+		session: storage.Session{
+			Client:        storage.Client{ID: "zen", ProtocolVersion: 4},
+			Subscriptions: []storage.Subscription{{Client: "zen", Filter: "a/b/c", Qos: 1}},
+			Inflight: []storage.Message{
+				{
+					Client:      "zen",
+					FixedHeader: pk.FixedHeader,
+					PacketID:    pk.PacketID,
+					TopicName:   pk.TopicName,
+					Payload:     pk.Payload,
+				},
+			},
+		},
+	}, nil)
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
 	}()
 
 	go func() {
 		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt311).RawBytes)
-		time.Sleep(time.Millisecond) // we want to receive the queued inflight, so we need to wait a moment before sending the disconnect.
+		time.Sleep(time.Millisecond)
 		_, _ = w.Write(packets.TPacketData[packets.Disconnect].Get(packets.TDisconnect).RawBytes)
 	}()
 
-	// receive the disconnect session takeover
-	takeover := make(chan []byte)
-	go func() {
-		buf, err := io.ReadAll(r0)
-		require.NoError(t, err)
-		takeover <- buf
-	}()
-
-	// receive the connack
 	recv := make(chan []byte)
 	go func() {
 		buf, err := io.ReadAll(w)
@@ -647,30 +1694,47 @@ func TestEstablishConnectionInheritExisting(t *testing.T) {
 
 	err := <-o
 	require.NoError(t, err)
-
-	// Retrieve the client corresponding to the Client Identifier.
-	retrievedCl, ok := s.Clients.Get(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt311).Packet.Connect.ClientIdentifier)
-	require.True(t, ok)
-	require.ErrorIs(t, retrievedCl.StopCause(), packets.CodeDisconnect) // true error is disconnect
+	_ = r.Close()
 
 	connackPlusPacket := append(
 		packets.TPacketData[packets.Connack].Get(packets.TConnackAcceptedSessionExists).RawBytes,
 		packets.TPacketData[packets.Publish].Get(packets.TPublishQos1Dup).RawBytes...,
 	)
 	require.Equal(t, connackPlusPacket, <-recv)
-	require.Equal(t, packets.TPacketData[packets.Disconnect].Get(packets.TDisconnectTakeover).RawBytes, <-takeover)
-
-	time.Sleep(time.Microsecond * 100)
-	_ = w.Close()
-	_ = r.Close()
 
-	clw, ok := s.Clients.Get(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt311).Packet.Connect.ClientIdentifier)
+	cl, ok := s.Clients.Get("zen")
 	require.True(t, ok)
-	require.NotEmpty(t, clw.State.Subscriptions)
-	require.True(t, cl.IsTakenOver())
+	require.NotEmpty(t, cl.State.Subscriptions.GetAll())
+}
 
-	// Prevent sequential takeover memory-bloom.
-	require.Empty(t, cl.State.Subscriptions.GetAll())
+func TestEstablishConnectionLazySessionError(t *testing.T) {
+	s := newServer()
+	s.Options.LazySessionLoading = true
+	defer s.Close()
+	_ = s.AddHook(&sessionHook{err: errTestHook}, nil)
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt311).RawBytes)
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(w)
+		require.NoError(t, err)
+		recv <- buf
+	}()
+
+	err := <-o
+	require.ErrorIs(t, err, errTestHook)
+	_ = r.Close()
+
+	require.Equal(t, []byte{packets.Connack << 4, 2, 0, packets.Err3ServerUnavailable.Code}, <-recv)
 }
 
 // See https://github.com/mochi-mqtt/server/issues/173
@@ -868,6 +1932,8 @@ func TestEstablishConnectionBadAuthentication(t *testing.T) {
 		Logger: logger,
 	})
 	defer s.Close()
+	failed := &authFailedHook{codes: make(chan packets.Code, 1)}
+	require.NoError(t, s.AddHook(failed, nil))
 
 	r, w := net.Pipe()
 	o := make(chan error)
@@ -892,6 +1958,7 @@ func TestEstablishConnectionBadAuthentication(t *testing.T) {
 	require.Error(t, err)
 	require.ErrorIs(t, err, packets.ErrBadUsernameOrPassword)
 	require.Equal(t, packets.TPacketData[packets.Connack].Get(packets.TConnackBadUsernamePasswordNoSession).RawBytes, <-recv)
+	require.Equal(t, packets.ErrBadUsernameOrPassword, <-failed.codes)
 
 	_ = w.Close()
 	_ = r.Close()
@@ -986,6 +2053,104 @@ func TestEstablishConnectionMaximumClientsReached(t *testing.T) {
 	_ = r.Close()
 }
 
+func TestEstablishConnectionOverloaded(t *testing.T) {
+	s := New(&Options{
+		Logger:   logger,
+		Overload: &OverloadOptions{MaxGoroutines: 1, AcceptDelay: 20, CheckInterval: 5},
+	})
+	_ = s.AddHook(new(AllowHook), nil)
+	defer s.Close()
+
+	s.checkOverload()
+	require.True(t, s.Overloaded())
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	start := time.Now()
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt5).RawBytes)
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(w)
+		require.NoError(t, err)
+		recv <- buf
+	}()
+
+	err := <-o
+	require.ErrorIs(t, err, packets.ErrServerBusy)
+	require.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	_ = r.Close()
+	require.Equal(t, packets.ErrServerBusy.Code, (<-recv)[3])
+}
+
+func TestServerCheckOverload(t *testing.T) {
+	s := New(&Options{
+		Logger:   logger,
+		Overload: &OverloadOptions{},
+	})
+	defer s.Close()
+	require.Equal(t, defaultOverloadCheckInterval, s.Options.Overload.CheckInterval)
+
+	s.checkOverload()
+	require.False(t, s.Overloaded())
+
+	s.Options.Overload.MaxMemory = 1
+	s.checkOverload()
+	require.True(t, s.Overloaded())
+
+	s.Options.Overload.MaxMemory = 0
+	s.checkOverload()
+	require.False(t, s.Overloaded())
+
+	cl, _, _ := newTestClient()
+	s.Clients.Add(cl)
+	atomic.StoreInt32(&cl.State.outboundQty, 3)
+	s.Options.Overload.MaxQueueDepth = 2
+	s.checkOverload()
+	require.True(t, s.Overloaded())
+
+	atomic.StoreInt32(&cl.State.outboundQty, 1)
+	s.checkOverload()
+	require.False(t, s.Overloaded())
+}
+
+func TestServerOverloadLoop(t *testing.T) {
+	s := New(&Options{
+		Logger:   logger,
+		Overload: &OverloadOptions{MaxGoroutines: 1, CheckInterval: 1},
+	})
+	require.NoError(t, s.Serve())
+	require.Eventually(t, s.Overloaded, time.Second, time.Millisecond)
+
+	s.Options.Overload.AcceptDelay = 1000
+	o := make(chan bool)
+	go func() {
+		s.paceConnection()
+		o <- true
+	}()
+
+	_ = s.Close()
+	<-o
+}
+
+func TestServerPaceConnectionNotOverloaded(t *testing.T) {
+	s := New(&Options{
+		Logger:   logger,
+		Overload: &OverloadOptions{AcceptDelay: 1000},
+	})
+	defer s.Close()
+
+	start := time.Now()
+	s.paceConnection()
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
 // See https://github.com/mochi-mqtt/server/issues/178
 func TestServerEstablishConnectionZeroByteUsernameIsValid(t *testing.T) {
 	s := newServer()
@@ -1079,6 +2244,36 @@ func TestServerEstablishConnectionOnConnectError(t *testing.T) {
 	_ = r.Close()
 }
 
+func TestServerEstablishConnectionOnConnectCode(t *testing.T) {
+	s := newServer()
+	err := s.AddHook(&rejectConnectHook{code: packets.ErrClientIdentifierNotValid}, nil)
+	require.NoError(t, err)
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectClean).RawBytes)
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(w)
+		require.NoError(t, err)
+		recv <- buf
+	}()
+
+	err = <-o
+	require.ErrorIs(t, err, packets.ErrClientIdentifierNotValid)
+	require.Equal(t, []byte{packets.Connack << 4, 2, 0, packets.Err3ClientIdentifierNotValid.Code}, <-recv)
+
+	_ = w.Close()
+	_ = r.Close()
+}
+
 func TestServerSendConnack(t *testing.T) {
 	s := newServer()
 	cl, r, w := newTestClient()
@@ -1245,6 +2440,68 @@ func TestInheritClientSession(t *testing.T) {
 	require.Equal(t, 0, cl.State.Subscriptions.Len())
 }
 
+// takeoverHook records the clients of each session takeover.
+type takeoverHook struct {
+	HookBase
+	sync.Mutex
+	takeovers [][2]*Client
+}
+
+func (h *takeoverHook) ID() string {
+	return "takeover"
+}
+
+func (h *takeoverHook) Provides(b byte) bool {
+	return b == OnSessionTakenOver
+}
+
+func (h *takeoverHook) OnSessionTakenOver(evicted, cl *Client) {
+	h.Lock()
+	defer h.Unlock()
+	h.takeovers = append(h.takeovers, [2]*Client{evicted, cl})
+}
+
+func TestInheritClientSessionTakenOver(t *testing.T) {
+	s := newServer()
+	hook := new(takeoverHook)
+	require.NoError(t, s.AddHook(hook, nil))
+
+	existing, r, _ := newTestClient()
+	existing.ID = "mochi"
+	existing.Net.Remote = "10.0.0.1:1883"
+	existing.State.Subscriptions.Add("a/b/c", packets.Subscription{Filter: "a/b/c", Qos: 1})
+	s.Clients.Add(existing)
+	go func() {
+		_, _ = io.ReadAll(r)
+	}()
+
+	cl, _, _ := newTestClient()
+	cl.ID = "mochi"
+	cl.Net.Remote = "10.0.0.2:1883"
+	b := s.inheritClientSession(packets.Packet{Connect: packets.ConnectParams{ClientIdentifier: "mochi"}}, cl)
+	require.True(t, b)
+
+	hook.Lock()
+	require.Len(t, hook.takeovers, 1)
+	require.Same(t, existing, hook.takeovers[0][0])
+	require.Same(t, cl, hook.takeovers[0][1])
+	require.True(t, hook.takeovers[0][0].IsTakenOver())
+	require.Equal(t, 1, hook.takeovers[0][1].State.Subscriptions.Len())
+	hook.Unlock()
+
+	// a session which is no longer connected is resumed rather than taken over
+	s.Clients.Add(cl)
+	cl.Stop(nil)
+	next, _, _ := newTestClient()
+	next.ID = "mochi"
+	b = s.inheritClientSession(packets.Packet{Connect: packets.ConnectParams{ClientIdentifier: "mochi"}}, next)
+	require.True(t, b)
+
+	hook.Lock()
+	defer hook.Unlock()
+	require.Len(t, hook.takeovers, 1)
+}
+
 func TestServerUnsubscribeClient(t *testing.T) {
 	s := newServer()
 	cl, _, _ := newTestClient()
@@ -1726,17 +2983,178 @@ func TestServerProcessPublishACLCheckDeny(t *testing.T) {
 				_ = w.Close()
 			}()
 
-			buf, err := io.ReadAll(r)
-			require.NoError(t, err)
+			buf, err := io.ReadAll(r)
+			require.NoError(t, err)
+
+			if tx.expectReponse != nil {
+				require.Equal(t, tx.expectReponse, buf)
+			}
+
+			require.Equal(t, tx.expectDisconnect, cl.Closed())
+			wg.Wait()
+		})
+	}
+}
+
+func TestServerProcessPublishRetainDenied(t *testing.T) {
+	s := New(&Options{Logger: logger})
+	_ = s.AddHook(&denyActionHook{action: ACLActionRetain}, nil)
+	_ = s.Serve()
+	defer s.Close()
+
+	cl, r, w := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	s.Clients.Add(cl)
+
+	pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1Mqtt5).Packet
+	pk.FixedHeader.Retain = true
+
+	go func() {
+		err := s.processPublish(cl, pk)
+		require.NoError(t, err)
+		_ = w.Close()
+	}()
+
+	buf, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, packets.Puback<<4, buf[0])
+	require.Equal(t, packets.ErrNotAuthorized.Code, buf[4])
+	require.Equal(t, 0, len(s.Topics.Messages(pk.TopicName)))
+
+	cl.SetSuperuser(true)
+	require.True(t, s.checkACLAction(cl, pk.TopicName, ACLActionRetain))
+}
+
+func TestServerProcessPublishQuotaExceeded(t *testing.T) {
+	tt := []struct {
+		name            string
+		protocolVersion byte
+		qos             byte
+		throttle        bool
+		expectType      byte
+		expectCode      byte
+		expectErr       error
+	}{
+		{name: "v4_QOS0", protocolVersion: 4, qos: 0},
+		{name: "v3_QOS1", protocolVersion: 3, qos: 1, expectErr: packets.ErrQuotaExceeded},
+		{name: "v4_QOS1", protocolVersion: 4, qos: 1, expectErr: packets.ErrQuotaExceeded},
+		{name: "v4_QOS2", protocolVersion: 4, qos: 2, expectErr: packets.ErrQuotaExceeded},
+		{name: "v5_QOS1", protocolVersion: 5, qos: 1, expectType: packets.Puback, expectCode: packets.ErrQuotaExceeded.Code},
+		{name: "v5_QOS2", protocolVersion: 5, qos: 2, expectType: packets.Pubrec, expectCode: packets.ErrQuotaExceeded.Code},
+		{name: "v5_QOS1_throttled", protocolVersion: 5, qos: 1, throttle: true, expectType: packets.Puback, expectCode: packets.CodeSuccess.Code},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.name, func(t *testing.T) {
+			s := New(&Options{Logger: logger})
+			hook := &quotaHook{throttle: tx.throttle}
+			_ = s.AddHook(hook, nil)
+			_ = s.Serve()
+			defer s.Close()
+
+			cl, r, w := newTestClient()
+			cl.Properties.ProtocolVersion = tx.protocolVersion
+			s.Clients.Add(cl)
+
+			pk := packets.Packet{
+				FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: tx.qos},
+				TopicName:   "over",
+				PacketID:    7,
+			}
+
+			go func() {
+				err := s.processPublish(cl, pk)
+				require.ErrorIs(t, err, tx.expectErr)
+				_ = w.Close()
+			}()
+
+			buf, err := io.ReadAll(r)
+			require.NoError(t, err)
+			if tx.expectErr != nil {
+				require.Equal(t, []byte{packets.Disconnect << 4, 0}, buf)
+				require.True(t, cl.Closed())
+			} else if tx.expectType == 0 {
+				require.Empty(t, buf)
+				require.False(t, cl.Closed())
+			} else {
+				require.Equal(t, tx.expectType<<4, buf[0])
+				if tx.expectCode == packets.CodeSuccess.Code {
+					require.Equal(t, byte(2), buf[1]) // a successful v5 ack omits the reason code
+				} else {
+					require.Equal(t, tx.expectCode, buf[4])
+				}
+				require.False(t, cl.Closed())
+			}
+
+			require.Len(t, hook.exceeded, 1)
+			require.Equal(t, tx.throttle, hook.exceeded[0].Throttled)
+		})
+	}
+}
+
+func TestServerEstablishConnectionWillDenied(t *testing.T) {
+	s := newServer()
+	err := s.AddHook(&denyActionHook{action: ACLActionWill}, nil)
+	require.NoError(t, err)
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt5LWT).RawBytes)
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(w)
+		require.NoError(t, err)
+		recv <- buf
+	}()
+
+	err = <-o
+	require.ErrorIs(t, err, packets.ErrNotAuthorized)
+	buf := <-recv
+	require.Equal(t, packets.Connack<<4, buf[0])
+	require.Equal(t, packets.ErrNotAuthorized.Code, buf[3])
+
+	_ = w.Close()
+	_ = r.Close()
+}
+
+func TestServerACLDenied(t *testing.T) {
+	s := New(&Options{Logger: logger, AuthCache: &AuthCacheOptions{TTL: 60000}})
+	require.NoError(t, s.AddHook(&denyActionHook{action: ACLActionWill}, nil))
+	require.NoError(t, s.AddHook(new(countingACLHook), nil))
+	h := new(aclDeniedHook)
+	require.NoError(t, s.AddHook(h, nil))
 
-			if tx.expectReponse != nil {
-				require.Equal(t, tx.expectReponse, buf)
-			}
+	cl := newAuthCacheClient("cl1", "")
+	require.False(t, s.checkACLAction(cl, "a/b", ACLActionWill))
+	require.True(t, s.checkACLAction(cl, "a/b", ACLActionRetain))
+	require.Equal(t, []ACLDenial{
+		{Topic: "a/b", Action: ACLActionWill, Hook: "acl-denied", Rule: "rule-will"},
+	}, h.denials)
 
-			require.Equal(t, tx.expectDisconnect, cl.Closed())
-			wg.Wait()
-		})
-	}
+	cl.SetSuperuser(true)
+	require.True(t, s.checkACLAction(cl, "a/b", ACLActionWill))
+	require.Len(t, h.denials, 1)
+}
+
+func TestServerWillAllowed(t *testing.T) {
+	s := newServer()
+	require.NoError(t, s.AddHook(&denyActionHook{action: ACLActionRetain}, nil))
+
+	cl, _, _ := newTestClient()
+	require.True(t, s.willAllowed(cl))
+
+	cl.Properties.Will = Will{Flag: 1, TopicName: "a/b"}
+	require.True(t, s.willAllowed(cl))
+
+	cl.Properties.Will.Retain = true
+	require.False(t, s.willAllowed(cl))
 }
 
 func TestServerProcessPublishOnMessageRecvRejected(t *testing.T) {
@@ -1940,6 +3358,60 @@ func TestPublishToSubscribers(t *testing.T) {
 	require.True(t, ok)
 }
 
+type routeHook struct {
+	HookBase
+}
+
+func (h *routeHook) ID() string {
+	return "route"
+}
+
+func (h *routeHook) Provides(b byte) bool {
+	return b == OnSelectSubscribers
+}
+
+func (h *routeHook) OnSelectSubscribers(subs *Subscribers, pk packets.Packet) *Subscribers {
+	subs.Remove("cl1")
+	subs.Add("cl2", packets.Subscription{Filter: pk.TopicName})
+	return subs
+}
+
+func TestPublishToSubscribersSelectHook(t *testing.T) {
+	s := newServer()
+	require.NoError(t, s.AddHook(new(routeHook), nil))
+	cl, r1, w1 := newTestClient()
+	cl.ID = "cl1"
+	cl2, r2, w2 := newTestClient()
+	cl2.ID = "cl2"
+	s.Clients.Add(cl)
+	s.Clients.Add(cl2)
+	require.True(t, s.Topics.Subscribe(cl.ID, packets.Subscription{Filter: "a/b/c"}))
+
+	cl1Recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(r1)
+		require.NoError(t, err)
+		cl1Recv <- buf
+	}()
+
+	cl2Recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(r2)
+		require.NoError(t, err)
+		cl2Recv <- buf
+	}()
+
+	go func() {
+		s.publishToSubscribers(*packets.TPacketData[packets.Publish].Get(packets.TPublishBasic).Packet)
+		time.Sleep(time.Millisecond)
+		_ = w1.Close()
+		_ = w2.Close()
+	}()
+
+	require.Equal(t, []byte{}, <-cl1Recv)
+	require.Equal(t, packets.TPacketData[packets.Publish].Get(packets.TPublishBasic).RawBytes, <-cl2Recv)
+}
+
 func TestPublishToSubscribersMessageExpiryDelta(t *testing.T) {
 	s := newServer()
 	s.Options.Capabilities.MaximumMessageExpiryInterval = 86400
@@ -2123,6 +3595,91 @@ func TestPublishToClientExceedClientWritesPending(t *testing.T) {
 	require.Equal(t, int32(sendQuota), atomic.LoadInt32(&cl.State.Inflight.sendQuota))
 }
 
+// droppedHook records the reasons messages were dropped.
+type droppedHook struct {
+	HookBase
+	sync.Mutex
+	reasons []DropReason
+}
+
+func (h *droppedHook) ID() string {
+	return "dropped"
+}
+
+func (h *droppedHook) Provides(b byte) bool {
+	return b == OnMessageDropped
+}
+
+func (h *droppedHook) OnMessageDropped(cl *Client, pk packets.Packet, reason DropReason) {
+	h.Lock()
+	defer h.Unlock()
+	h.reasons = append(h.reasons, reason)
+}
+
+func (h *droppedHook) Reasons() []DropReason {
+	h.Lock()
+	defer h.Unlock()
+	return h.reasons
+}
+
+func TestPublishToClientDroppedQueueFull(t *testing.T) {
+	s := newServer()
+	hook := new(droppedHook)
+	require.NoError(t, s.AddHook(hook, nil))
+	cl, _, _ := newTestClient()
+	cl.ops.hooks = s.hooks
+	s.Clients.Add(cl)
+
+	for i := int32(0); i < cl.ops.options.Capabilities.MaximumClientWritesPending; i++ {
+		cl.State.outbound <- new(packets.Packet)
+		atomic.AddInt32(&cl.State.outboundQty, 1)
+	}
+
+	_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b/c"}, packets.Packet{TopicName: "a/b/c"})
+	require.ErrorIs(t, err, packets.ErrPendingClientWritesExceeded)
+	require.Equal(t, []DropReason{DropQueueFull}, hook.Reasons())
+}
+
+func TestPublishToClientDroppedOffline(t *testing.T) {
+	s := newServer()
+	hook := new(droppedHook)
+	require.NoError(t, s.AddHook(hook, nil))
+	cl, _, _ := newTestClient()
+	cl.Net.Conn = nil
+
+	_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b/c", Qos: 1}, packets.Packet{TopicName: "a/b/c"})
+	require.ErrorIs(t, err, packets.CodeDisconnect)
+
+	// qos 1 messages are kept for when the client reconnects
+	_, err = s.publishToClient(cl, packets.Subscription{Filter: "a/b/c", Qos: 1}, packets.Packet{TopicName: "a/b/c", FixedHeader: packets.FixedHeader{Qos: 1}})
+	require.ErrorIs(t, err, packets.CodeDisconnect)
+	require.Equal(t, []DropReason{DropOffline}, hook.Reasons())
+}
+
+func TestPublishToClientDroppedNotAuthorized(t *testing.T) {
+	s := New(&Options{Logger: logger})
+	hook := new(droppedHook)
+	require.NoError(t, s.AddHook(hook, nil))
+	cl, _, _ := newTestClient()
+
+	_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b/c"}, packets.Packet{TopicName: "a/b/c"})
+	require.ErrorIs(t, err, packets.ErrNotAuthorized)
+	require.Equal(t, []DropReason{DropNotAuthorized}, hook.Reasons())
+}
+
+func TestPublishToSubscribersDroppedNoSubscribers(t *testing.T) {
+	s := newServer()
+	hook := new(droppedHook)
+	require.NoError(t, s.AddHook(hook, nil))
+	cl, _, _ := newTestClient()
+	s.Clients.Add(cl)
+
+	s.publishToSubscribers(packets.Packet{TopicName: "a/b/c", Origin: cl.ID})
+	s.publishToSubscribers(packets.Packet{TopicName: "a/b/c", Origin: "unknown"})
+	s.publishToSubscribers(packets.Packet{TopicName: SysPrefix + "/broker/uptime", Origin: cl.ID})
+	require.Equal(t, []DropReason{DropNoSubscribers}, hook.Reasons())
+}
+
 func TestPublishToClientServerTopicAlias(t *testing.T) {
 	s := newServer()
 	cl, r, w := newTestClient()
@@ -2179,6 +3736,8 @@ func TestPublishToClientMqtt5RetainAsPublishedTrueLeverageNoConn(t *testing.T) {
 func TestPublishToClientExceedMaximumInflight(t *testing.T) {
 	const MaxInflight uint16 = 5
 	s := newServer()
+	hook := new(droppedHook)
+	require.NoError(t, s.AddHook(hook, nil))
 	cl, _, _ := newTestClient()
 	s.Options.Capabilities.MaximumInflight = uint32(MaxInflight)
 	cl.ops.options.Capabilities.MaximumInflight = uint32(MaxInflight)
@@ -2190,10 +3749,13 @@ func TestPublishToClientExceedMaximumInflight(t *testing.T) {
 	require.Error(t, err)
 	require.ErrorIs(t, err, packets.ErrQuotaExceeded)
 	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.InflightDropped))
+	require.Equal(t, []DropReason{DropInflightFull}, hook.Reasons())
 }
 
 func TestPublishToClientExhaustedPacketID(t *testing.T) {
 	s := newServer()
+	hook := new(droppedHook)
+	require.NoError(t, s.AddHook(hook, nil))
 	cl, _, _ := newTestClient()
 	for i := uint32(0); i <= cl.ops.options.Capabilities.maximumPacketID; i++ {
 		cl.State.Inflight.Set(packets.Packet{PacketID: uint16(i)})
@@ -2203,6 +3765,7 @@ func TestPublishToClientExhaustedPacketID(t *testing.T) {
 	require.Error(t, err)
 	require.ErrorIs(t, err, packets.ErrQuotaExceeded)
 	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.InflightDropped))
+	require.Equal(t, []DropReason{DropPacketIDsExhausted}, hook.Reasons())
 }
 
 func TestPublishToClientACLNotAuthorized(t *testing.T) {
@@ -2228,6 +3791,24 @@ func TestPublishToClientNoConn(t *testing.T) {
 	require.ErrorIs(t, err, packets.CodeDisconnect)
 }
 
+func TestPublishToClientNoConnQueued(t *testing.T) {
+	s := newServer()
+	hook := new(queueHook)
+	require.NoError(t, s.AddHook(hook, nil))
+
+	cl, _, _ := newTestClient()
+	cl.Net.Conn = nil
+
+	pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet
+	out, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b/c", Qos: 1}, pk)
+	require.ErrorIs(t, err, packets.CodeDisconnect)
+	require.Equal(t, []uint16{out.PacketID}, hook.queued)
+	require.Empty(t, hook.published)
+
+	_, ok := cl.State.Inflight.Get(out.PacketID)
+	require.True(t, ok)
+}
+
 func TestProcessPublishWithTopicAlias(t *testing.T) {
 	s := newServer()
 	cl, r, w := newTestClient()
@@ -2881,6 +4462,63 @@ func TestServerProcessSubscribeWithRetain(t *testing.T) {
 	), buf)
 }
 
+// retainedHook records the filters and counts of delivered retained messages.
+type retainedHook struct {
+	HookBase
+	sync.Mutex
+	filters []string
+	counts  []int
+}
+
+func (h *retainedHook) ID() string {
+	return "retained"
+}
+
+func (h *retainedHook) Provides(b byte) bool {
+	return b == OnRetainedDelivered
+}
+
+func (h *retainedHook) OnRetainedDelivered(cl *Client, filter string, count int) {
+	h.Lock()
+	defer h.Unlock()
+	h.filters = append(h.filters, filter)
+	h.counts = append(h.counts, count)
+}
+
+func TestServerProcessSubscribeRetainedDelivered(t *testing.T) {
+	s := newServer()
+	hook := new(retainedHook)
+	require.NoError(t, s.AddHook(hook, nil))
+	cl, r, w := newTestClient()
+
+	retained := s.Topics.RetainMessage(*packets.TPacketData[packets.Publish].Get(packets.TPublishRetain).Packet)
+	require.Equal(t, int64(1), retained)
+
+	go func() {
+		err := s.processPacket(cl, *packets.TPacketData[packets.Subscribe].Get(packets.TSubscribe).Packet)
+		require.NoError(t, err)
+
+		// no retained messages match the filter
+		err = s.processPacket(cl, packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Subscribe, Qos: 1},
+			PacketID:    16,
+			Filters:     packets.Subscriptions{{Filter: "d/e/f"}},
+		})
+		require.NoError(t, err)
+
+		time.Sleep(time.Millisecond)
+		_ = w.Close()
+	}()
+
+	_, err := io.ReadAll(r)
+	require.NoError(t, err)
+
+	hook.Lock()
+	defer hook.Unlock()
+	require.Equal(t, []string{packets.TPacketData[packets.Subscribe].Get(packets.TSubscribe).Packet.Filters[0].Filter}, hook.filters)
+	require.Equal(t, []int{1}, hook.counts)
+}
+
 func TestServerProcessSubscribeDowngradeQos(t *testing.T) {
 	s := newServer()
 	s.Options.Capabilities.MaximumQos = 1
@@ -2899,6 +4537,72 @@ func TestServerProcessSubscribeDowngradeQos(t *testing.T) {
 	require.Equal(t, []byte{0, 1, 1}, buf[4:])
 }
 
+func TestServerProcessSubscribeFilterHook(t *testing.T) {
+	s := newServer()
+	err := s.AddHook(&filterHook{prefix: "tenant/", qos: 1}, nil)
+	require.NoError(t, err)
+	cl, r, w := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+
+	pk := *packets.TPacketData[packets.Subscribe].Get(packets.TSubscribeMany).Packet
+	pk.Filters = packets.Subscriptions{
+		{Filter: "a/b", Qos: 0},
+		{Filter: "deny/e", Qos: 1},
+		{Filter: "x/y/z", Qos: 2},
+	}
+
+	go func() {
+		err := s.processPacket(cl, pk)
+		require.NoError(t, err)
+
+		time.Sleep(time.Millisecond)
+		_ = w.Close()
+	}()
+
+	buf, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 0x87, 1}, buf[len(buf)-3:])
+
+	require.Contains(t, cl.State.Subscriptions.GetAll(), "tenant/a/b")
+	require.Contains(t, cl.State.Subscriptions.GetAll(), "tenant/x/y/z")
+	require.NotContains(t, cl.State.Subscriptions.GetAll(), "x/y/z")
+	require.NotContains(t, cl.State.Subscriptions.GetAll(), "deny/e")
+	require.Equal(t, byte(1), cl.State.Subscriptions.GetAll()["tenant/x/y/z"].Qos)
+	require.Len(t, s.Topics.Subscribers("tenant/x/y/z").Subscriptions, 1)
+}
+
+func TestServerProcessSubscribeFilterHookObscure(t *testing.T) {
+	s := newServer()
+	s.Options.Capabilities.Compatibilities.ObscureNotAuthorized = true
+	err := s.AddHook(&filterHook{prefix: "tenant/", qos: 2}, nil)
+	require.NoError(t, err)
+	cl, r, w := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+
+	pk := *packets.TPacketData[packets.Subscribe].Get(packets.TSubscribe).Packet
+	pk.Filters = packets.Subscriptions{{Filter: "deny/e", Qos: 1}}
+
+	go func() {
+		err := s.processPacket(cl, pk)
+		require.NoError(t, err)
+
+		time.Sleep(time.Millisecond)
+		_ = w.Close()
+	}()
+
+	buf, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, packets.ErrUnspecifiedError.Code, buf[len(buf)-1])
+}
+
+func TestSubscribeRejectedCode(t *testing.T) {
+	require.Equal(t, packets.ErrNotAuthorized.Code, subscribeRejectedCode(packets.ErrNotAuthorized, false))
+	require.Equal(t, packets.ErrUnspecifiedError.Code, subscribeRejectedCode(packets.ErrNotAuthorized, true))
+	require.Equal(t, packets.ErrQuotaExceeded.Code, subscribeRejectedCode(packets.ErrQuotaExceeded, true))
+	require.Equal(t, packets.ErrUnspecifiedError.Code, subscribeRejectedCode(errTestHook, false))
+	require.Equal(t, packets.ErrUnspecifiedError.Code, subscribeRejectedCode(packets.CodeGrantedQos1, false))
+}
+
 func TestServerProcessSubscribeWithRetainHandling1(t *testing.T) {
 	s := newServer()
 	cl, r, w := newTestClient()
@@ -3115,6 +4819,46 @@ func TestServerRecievePacketDisconnectClient(t *testing.T) {
 	require.Equal(t, packets.TPacketData[packets.Disconnect].Get(packets.TDisconnect).RawBytes, buf)
 }
 
+func TestServerDisconnectClientByID(t *testing.T) {
+	s := newServer()
+	cl, r, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	s.Clients.Add(cl)
+
+	go func() {
+		err := s.DisconnectClientByID(cl.ID, packets.ErrServerShuttingDown)
+		require.NoError(t, err)
+	}()
+
+	buf, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, packets.TPacketData[packets.Disconnect].Get(packets.TDisconnectShuttingDown).RawBytes, buf)
+	require.True(t, cl.Closed())
+	require.ErrorIs(t, cl.StopCause(), packets.ErrServerShuttingDown)
+
+	require.ErrorIs(t, s.DisconnectClientByID(cl.ID, packets.ErrServerShuttingDown), ErrClientNotFound)
+}
+
+func TestServerDisconnectClientByIDMqtt3(t *testing.T) {
+	s := newServer()
+	cl, r, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 4
+	s.Clients.Add(cl)
+
+	require.NoError(t, s.DisconnectClientByID(cl.ID, packets.ErrAdministrativeAction))
+	buf, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Empty(t, buf) // v3 clients are not sent a disconnect packet
+	require.True(t, cl.Closed())
+	require.ErrorIs(t, cl.StopCause(), packets.ErrAdministrativeAction)
+}
+
+func TestServerDisconnectClientByIDNotFound(t *testing.T) {
+	s := newServer()
+	require.ErrorIs(t, s.DisconnectClientByID("missing", packets.ErrAdministrativeAction), ErrClientNotFound)
+	require.ErrorIs(t, s.DisconnectClientByID(InlineClientId, packets.ErrAdministrativeAction), ErrClientNotFound)
+}
+
 func TestServerProcessPacketDisconnect(t *testing.T) {
 	s := newServer()
 	cl, _, _ := newTestClient()
@@ -3195,9 +4939,141 @@ func TestServerProcessPacketAuthFailure(t *testing.T) {
 	err := s.AddHook(hook, nil)
 	require.NoError(t, err)
 
-	err = s.processAuth(cl, *packets.TPacketData[packets.Auth].Get(packets.TAuth).Packet)
-	require.Error(t, err)
-	require.ErrorIs(t, errTestHook, err)
+	err = s.processAuth(cl, *packets.TPacketData[packets.Auth].Get(packets.TAuth).Packet)
+	require.Error(t, err)
+	require.ErrorIs(t, errTestHook, err)
+}
+
+func TestServerProcessAuthNotEnhanced(t *testing.T) {
+	s := newServer()
+	cl, _, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Props.AuthenticationMethod = "challenge"
+
+	err := s.processAuth(cl, authPacket(packets.CodeReAuthenticate, "challenge", []byte("hello")))
+	require.NoError(t, err) // no hook provides enhanced auth
+}
+
+func TestServerProcessAuthMethodMismatch(t *testing.T) {
+	s := newServer()
+	require.NoError(t, s.AddHook(new(challengeHook), nil))
+	cl, _, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Props.AuthenticationMethod = "challenge"
+
+	err := s.processAuth(cl, authPacket(packets.CodeReAuthenticate, "other", []byte("hello")))
+	require.ErrorIs(t, err, packets.ErrProtocolViolation)
+}
+
+func TestServerProcessAuthContinueWithoutExchange(t *testing.T) {
+	s := newServer()
+	require.NoError(t, s.AddHook(new(challengeHook), nil))
+	cl, _, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Props.AuthenticationMethod = "challenge"
+
+	err := s.processAuth(cl, authPacket(packets.CodeContinueAuthentication, "challenge", []byte("response")))
+	require.ErrorIs(t, err, packets.ErrProtocolViolationInvalidReason)
+
+	err = s.processAuth(cl, authPacket(packets.CodeSuccess, "challenge", nil))
+	require.ErrorIs(t, err, packets.ErrProtocolViolationInvalidReason)
+}
+
+func TestServerProcessAuthReauthenticateFailure(t *testing.T) {
+	s := newServer()
+	require.NoError(t, s.AddHook(new(challengeHook), nil))
+	cl, _, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Props.AuthenticationMethod = "challenge"
+
+	err := s.processAuth(cl, authPacket(packets.CodeReAuthenticate, "challenge", []byte("goodbye")))
+	require.ErrorIs(t, err, packets.ErrNotAuthorized)
+	require.False(t, cl.State.reauthenticating)
+}
+
+func TestEstablishConnectionEnhancedAuth(t *testing.T) {
+	s, w, r, o := newEnhancedAuthConnection(t)
+	writeTestPacket(t, w, enhancedConnectPacket("challenge", []byte("hello")))
+
+	pk := readTestPacket(t, r)
+	require.Equal(t, packets.Auth, pk.FixedHeader.Type)
+	require.Equal(t, packets.CodeContinueAuthentication.Code, pk.ReasonCode)
+	require.Equal(t, "challenge", pk.Properties.AuthenticationMethod)
+	require.Equal(t, []byte("challenge"), pk.Properties.AuthenticationData)
+
+	writeTestPacket(t, w, authPacket(packets.CodeContinueAuthentication, "challenge", []byte("response")))
+	pk = readTestPacket(t, r)
+	require.Equal(t, packets.Connack, pk.FixedHeader.Type)
+	require.Equal(t, packets.CodeSuccess.Code, pk.ReasonCode)
+	require.Equal(t, "challenge", pk.Properties.AuthenticationMethod)
+	require.Equal(t, []byte("done"), pk.Properties.AuthenticationData)
+
+	_, ok := s.Clients.Get("enhanced")
+	require.True(t, ok)
+
+	// re-authenticate the connected client
+	writeTestPacket(t, w, authPacket(packets.CodeReAuthenticate, "challenge", []byte("hello")))
+	pk = readTestPacket(t, r)
+	require.Equal(t, packets.Auth, pk.FixedHeader.Type)
+	require.Equal(t, packets.CodeContinueAuthentication.Code, pk.ReasonCode)
+	require.Equal(t, []byte("challenge"), pk.Properties.AuthenticationData)
+
+	writeTestPacket(t, w, authPacket(packets.CodeContinueAuthentication, "challenge", []byte("response")))
+	pk = readTestPacket(t, r)
+	require.Equal(t, packets.Auth, pk.FixedHeader.Type)
+	require.Equal(t, packets.CodeSuccess.Code, pk.ReasonCode)
+	require.Equal(t, []byte("done"), pk.Properties.AuthenticationData)
+
+	writeTestPacket(t, w, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Disconnect}})
+	require.NoError(t, <-o)
+}
+
+func TestEstablishConnectionEnhancedAuthFailure(t *testing.T) {
+	s, w, r, o := newEnhancedAuthConnection(t)
+	failed := &authFailedHook{codes: make(chan packets.Code, 1)}
+	require.NoError(t, s.AddHook(failed, nil))
+	writeTestPacket(t, w, enhancedConnectPacket("challenge", []byte("hello")))
+	require.Equal(t, packets.Auth, readTestPacket(t, r).FixedHeader.Type)
+
+	writeTestPacket(t, w, authPacket(packets.CodeContinueAuthentication, "challenge", []byte("wrong")))
+	pk := readTestPacket(t, r)
+	require.Equal(t, packets.Connack, pk.FixedHeader.Type)
+	require.Equal(t, packets.ErrNotAuthorized.Code, pk.ReasonCode)
+	require.ErrorIs(t, <-o, packets.ErrNotAuthorized)
+	require.Equal(t, packets.ErrNotAuthorized, <-failed.codes)
+}
+
+func TestEstablishConnectionEnhancedAuthBadMethod(t *testing.T) {
+	_, w, r, o := newEnhancedAuthConnection(t)
+	writeTestPacket(t, w, enhancedConnectPacket("other", nil))
+
+	pk := readTestPacket(t, r)
+	require.Equal(t, packets.Connack, pk.FixedHeader.Type)
+	require.Equal(t, packets.ErrBadAuthenticationMethod.Code, pk.ReasonCode)
+	require.ErrorIs(t, <-o, packets.ErrBadAuthenticationMethod)
+}
+
+func TestEstablishConnectionEnhancedAuthUnexpectedPacket(t *testing.T) {
+	_, w, r, o := newEnhancedAuthConnection(t)
+	writeTestPacket(t, w, enhancedConnectPacket("challenge", []byte("hello")))
+	require.Equal(t, packets.Auth, readTestPacket(t, r).FixedHeader.Type)
+
+	writeTestPacket(t, w, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Disconnect}})
+	pk := readTestPacket(t, r)
+	require.Equal(t, packets.Connack, pk.FixedHeader.Type)
+	require.Equal(t, packets.ErrProtocolViolation.Code, pk.ReasonCode)
+	require.ErrorIs(t, <-o, packets.ErrProtocolViolation)
+}
+
+func TestEstablishConnectionEnhancedAuthMethodMismatch(t *testing.T) {
+	_, w, r, o := newEnhancedAuthConnection(t)
+	writeTestPacket(t, w, enhancedConnectPacket("challenge", []byte("hello")))
+	require.Equal(t, packets.Auth, readTestPacket(t, r).FixedHeader.Type)
+
+	writeTestPacket(t, w, authPacket(packets.CodeContinueAuthentication, "other", []byte("response")))
+	pk := readTestPacket(t, r)
+	require.Equal(t, packets.ErrProtocolViolation.Code, pk.ReasonCode)
+	require.ErrorIs(t, <-o, packets.ErrProtocolViolation)
 }
 
 func TestServerSendLWT(t *testing.T) {
@@ -3290,6 +5166,7 @@ func TestServerSendLWTDelayed(t *testing.T) {
 		Retain:            true,
 		WillDelayInterval: 2,
 	}
+	cl1.State.cancelOpen() // the client has disconnected
 	s.Clients.Add(cl1)
 
 	cl2, r, w := newTestClient()
@@ -3320,6 +5197,99 @@ func TestServerSendLWTDelayed(t *testing.T) {
 	require.Equal(t, packets.TPacketData[packets.Publish].Get(packets.TPublishBasic).RawBytes, <-recv)
 }
 
+func TestServerSendLWTDelayedExpiry(t *testing.T) {
+	s := newServer()
+	cl, _, _ := newTestClient()
+	cl.Properties.Will = Will{
+		Flag:              1,
+		TopicName:         "a/b/c",
+		Payload:           []byte("hello mochi"),
+		WillDelayInterval: 2,
+	}
+
+	s.sendLWT(cl)
+	pk, ok := s.loop.willDelayed.Get(cl.ID)
+	require.True(t, ok)
+	require.Equal(t, pk.Expiry, cl.Properties.Will.Expiry)
+	require.Equal(t, uint32(1), cl.Properties.Will.Flag)
+
+	cl.Properties.Will.Expiry = 1234
+	s.sendLWT(cl)
+	pk, ok = s.loop.willDelayed.Get(cl.ID)
+	require.True(t, ok)
+	require.Equal(t, int64(1234), pk.Expiry)
+}
+
+type willSentHook struct {
+	HookBase
+	sync.Mutex
+	sent []string
+}
+
+func (h *willSentHook) ID() string {
+	return "will-sent"
+}
+
+func (h *willSentHook) Provides(b byte) bool {
+	return b == OnWillSent
+}
+
+func (h *willSentHook) OnWillSent(cl *Client, pk packets.Packet) {
+	h.Lock()
+	defer h.Unlock()
+	h.sent = append(h.sent, cl.ID)
+}
+
+func (h *willSentHook) Sent() []string {
+	h.Lock()
+	defer h.Unlock()
+	return h.sent
+}
+
+func TestServerSendDelayedLWTReconnected(t *testing.T) {
+	s := newServer()
+	hook := new(willSentHook)
+	require.NoError(t, s.AddHook(hook, nil))
+
+	cl, _, _ := newTestClient() // the client has reconnected to the session
+	s.Clients.Add(cl)
+	s.loop.willDelayed.Add(cl.ID, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello"), Expiry: time.Now().Unix() - 1})
+
+	s.sendDelayedLWT(time.Now().Unix())
+	require.Equal(t, 0, s.loop.willDelayed.Len())
+	require.Empty(t, hook.Sent())
+}
+
+func TestServerClearExpiredClientsDelayedLWT(t *testing.T) {
+	s := newServer()
+	hook := new(willSentHook)
+	require.NoError(t, s.AddHook(hook, nil))
+
+	n := time.Now().Unix()
+	cl, _, _ := newTestClient()
+	cl.State.disconnected = n - 10
+	cl.State.cancelOpen()
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Props.SessionExpiryInterval = 5
+	cl.Properties.Props.SessionExpiryIntervalFlag = true
+	s.Clients.Add(cl)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   "a/b/c",
+		Payload:     []byte("hello"),
+		Expiry:      n + 60, // the will delay interval is longer than the session expiry interval
+	}
+	s.loop.willDelayed.Add(cl.ID, pk)
+
+	s.clearExpiredClients(n)
+	require.Equal(t, 0, s.loop.willDelayed.Len())
+	require.Equal(t, []string{cl.ID}, hook.Sent())
+	require.Len(t, s.Topics.Retained.GetAll(), 1)
+	_, ok := s.Clients.Get(cl.ID)
+	require.False(t, ok)
+}
+
 func TestServerReadStore(t *testing.T) {
 	s := newServer()
 	hook := new(modifiedHookBase)
@@ -3344,6 +5314,109 @@ func TestServerReadStore(t *testing.T) {
 	hook.failAt = 5 // sys info
 	err = s.readStore()
 	require.Error(t, err)
+
+	hook.failAt = 6 // queued
+	err = s.readStore()
+	require.Error(t, err)
+}
+
+func TestServerReadStoreIter(t *testing.T) {
+	s := newServer()
+	hook := new(iterHook)
+	_ = s.AddHook(hook, nil)
+
+	err := s.readStore()
+	require.NoError(t, err)
+	require.Equal(t, 2, s.Clients.Len()) // streamed from the hook
+
+	hook.fail = true
+	err = s.readStore()
+	require.Error(t, err)
+}
+
+func TestServerReadStoreLazySessionLoading(t *testing.T) {
+	s := newServer()
+	s.Options.LazySessionLoading = true
+	hook := new(modifiedHookBase)
+	_ = s.AddHook(hook, nil)
+
+	hook.failAt = 1 // clients are not loaded
+	err := s.readStore()
+	require.NoError(t, err)
+	require.Equal(t, 0, s.Clients.Len())
+
+	hook.failAt = 3 // retained messages are still loaded
+	err = s.readStore()
+	require.Error(t, err)
+}
+
+func TestServerLoadSession(t *testing.T) {
+	s := newServer()
+	hook := &sessionHook{
+		session: storage.Session{
+			Client: storage.Client{
+				ID:              "mochi",
+				ProtocolVersion: 5,
+				Properties:      storage.ClientProperties{SessionExpiryInterval: 30},
+				Will:            storage.ClientWill{Flag: 1, TopicName: "a/b/c"},
+			},
+			Subscriptions: []storage.Subscription{
+				{Client: "mochi", Filter: "a/b/c", Qos: 1},
+				{Client: "mochi", Filter: "d/e/f", Qos: 2},
+			},
+			Inflight: []storage.Message{
+				{Client: "mochi", PacketID: 1, FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}},
+			},
+			Queued: []storage.Message{
+				{Client: "mochi", PacketID: 2, FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}},
+			},
+		},
+	}
+	_ = s.AddHook(hook, nil)
+
+	err := s.loadSession("mochi")
+	require.NoError(t, err)
+	_, ok := s.Clients.Get("mochi")
+	require.False(t, ok) // sessions are only loaded lazily if enabled
+
+	s.Options.LazySessionLoading = true
+	err = s.loadSession("zen")
+	require.NoError(t, err)
+	_, ok = s.Clients.Get("zen")
+	require.False(t, ok)
+
+	err = s.loadSession("mochi")
+	require.NoError(t, err)
+	cl, ok := s.Clients.Get("mochi")
+	require.True(t, ok)
+	require.Equal(t, uint32(0), cl.Properties.Will.Flag)
+	require.Len(t, cl.State.Subscriptions.GetAll(), 2)
+	require.Len(t, s.Topics.Subscribers("d/e/f").Subscriptions, 1)
+	require.Equal(t, 2, cl.State.Inflight.Len())
+
+	hook.err = errTestHook
+	err = s.loadSession("mochi")
+	require.NoError(t, err) // already loaded
+
+	err = s.loadSession("mochi-co")
+	require.ErrorIs(t, err, errTestHook)
+}
+
+func TestServerLoadSessionExpired(t *testing.T) {
+	s := newServer()
+	s.Options.LazySessionLoading = true
+	_ = s.AddHook(&sessionHook{
+		session: storage.Session{
+			Client:        storage.Client{ID: "mochi", ProtocolVersion: 4, Clean: true},
+			Subscriptions: []storage.Subscription{{Client: "mochi", Filter: "a/b/c"}},
+		},
+	}, nil)
+
+	err := s.loadSession("mochi")
+	require.NoError(t, err)
+	_, ok := s.Clients.Get("mochi")
+	require.False(t, ok)
+	require.Empty(t, s.Topics.Subscribers("a/b/c").Subscriptions)
 }
 
 func TestServerLoadClients(t *testing.T) {
@@ -3397,6 +5470,48 @@ func TestServerLoadClients(t *testing.T) {
 	require.True(t, ok)
 }
 
+func TestServerLoadWills(t *testing.T) {
+	s := newServer()
+	s.loadClients([]storage.Client{
+		{
+			ID:              "v5-will",
+			ProtocolVersion: 5,
+			Properties:      storage.ClientProperties{SessionExpiryInterval: 10},
+			Will:            storage.ClientWill{Flag: 1, TopicName: "a/b/c", Payload: []byte("hello"), Retain: true},
+		},
+		{
+			ID:              "v5-will-delayed",
+			ProtocolVersion: 5,
+			Properties:      storage.ClientProperties{SessionExpiryInterval: 10},
+			Will:            storage.ClientWill{Flag: 1, TopicName: "d/e/f", Payload: []byte("hello"), WillDelayInterval: 5, Expiry: 1234},
+		},
+		{
+			ID:              "v3-clean-will",
+			ProtocolVersion: 4,
+			Clean:           true,
+			Will:            storage.ClientWill{Flag: 1, TopicName: "g/h/i", Payload: []byte("hello"), Retain: true, WillDelayInterval: 5},
+		},
+		{ID: "v5-no-will", ProtocolVersion: 5, Properties: storage.ClientProperties{SessionExpiryInterval: 10}},
+	})
+	require.Equal(t, 4, s.Clients.Len())
+
+	s.loadWills()
+	require.Equal(t, 3, s.Clients.Len())
+
+	cl, ok := s.Clients.Get("v5-will")
+	require.True(t, ok)
+	require.Equal(t, uint32(0), cl.Properties.Will.Flag)
+	require.Equal(t, 1, len(s.Topics.Messages("a/b/c")))
+
+	pk, ok := s.loop.willDelayed.Get("v5-will-delayed")
+	require.True(t, ok)
+	require.Equal(t, int64(1234), pk.Expiry)
+
+	_, ok = s.Clients.Get("v3-clean-will")
+	require.False(t, ok)
+	require.Equal(t, 1, len(s.Topics.Messages("g/h/i")))
+}
+
 func TestServerLoadSubscriptions(t *testing.T) {
 	v := []storage.Subscription{
 		{ID: "sub1", Client: "mochi", Filter: "a/b/c"},
@@ -3496,6 +5611,148 @@ func TestServerClose(t *testing.T) {
 	require.Equal(t, packets.TPacketData[packets.Disconnect].Get(packets.TDisconnectShuttingDown).RawBytes, <-recv)
 }
 
+func TestServerCloseServerReference(t *testing.T) {
+	s := newServer()
+	s.Options.ShutdownServerReference = "mqtt://backup:1883"
+
+	cl, r, _ := newTestClient()
+	cl.Net.Listener = "t1"
+	cl.Properties.ProtocolVersion = 5
+	s.Clients.Add(cl)
+
+	err := s.AddListener(listeners.NewMockListener("t1", ":1882"))
+	require.NoError(t, err)
+	_ = s.Serve()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(r)
+		require.NoError(t, err)
+		recv <- buf
+	}()
+
+	time.Sleep(time.Millisecond)
+	_ = s.Close()
+
+	buf := <-recv
+	require.Equal(t, packets.Disconnect<<4, buf[0])
+	require.Equal(t, packets.ErrServerShuttingDown.Code, buf[2])
+	require.True(t, bytes.Contains(buf, []byte("mqtt://backup:1883")))
+}
+
+func TestServerCloseContext(t *testing.T) {
+	s := newServer()
+	r, w := net.Pipe()
+	defer w.Close()
+	cl := s.NewClient(r, "testing", "test", false)
+	require.NoError(t, s.Context().Err())
+	require.NoError(t, cl.Context().Err())
+
+	_ = s.Close()
+	require.ErrorIs(t, context.Cause(s.Context()), packets.ErrServerShuttingDown)
+	require.ErrorIs(t, context.Cause(cl.Context()), packets.ErrServerShuttingDown)
+}
+
+type contextACLHook struct {
+	HookBase
+}
+
+func (h *contextACLHook) ID() string {
+	return "context-acl"
+}
+
+func (h *contextACLHook) Provides(b byte) bool {
+	return b == OnACLCheck
+}
+
+func (h *contextACLHook) OnACLCheck(cl *Client, topic string, write bool) bool {
+	return cl.Context().Err() == nil // as a hook calling a backend with the client context
+}
+
+func TestPublishToSubscribersOfflineContextACL(t *testing.T) {
+	s := New(&Options{Logger: logger})
+	require.NoError(t, s.AddHook(new(contextACLHook), nil))
+	dropped := new(droppedHook)
+	require.NoError(t, s.AddHook(dropped, nil))
+
+	cl, _, _ := newTestClient()
+	cl.Properties.Clean = false
+	s.Clients.Add(cl)
+	require.True(t, s.Topics.Subscribe(cl.ID, packets.Subscription{Filter: "a/b/c", Qos: 1}))
+	cl.Stop(packets.CodeDisconnect) // the client is offline with a persistent session
+
+	pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet
+	s.publishToSubscribers(pk)
+	require.Equal(t, 1, cl.State.Inflight.Len()) // queued for when the client reconnects
+	require.Empty(t, dropped.Reasons())
+}
+
+func TestServerAddHookContext(t *testing.T) {
+	s := newServer()
+	hook := new(HookBase)
+	err := s.AddHook(hook, nil)
+	require.NoError(t, err)
+	require.Equal(t, s.Context(), hook.Opts.Context)
+}
+
+func TestServerCloseV3Client(t *testing.T) {
+	s := newServer()
+
+	cl, r, _ := newTestClient()
+	cl.Net.Listener = "t1"
+	cl.Properties.ProtocolVersion = 4
+	s.Clients.Add(cl)
+
+	err := s.AddListener(listeners.NewMockListener("t1", ":1882"))
+	require.NoError(t, err)
+	_ = s.Serve()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(r)
+		require.NoError(t, err)
+		recv <- buf
+	}()
+
+	time.Sleep(time.Millisecond)
+	_ = s.Close()
+	require.Empty(t, <-recv) // no disconnect packet is sent to v3 clients
+	require.ErrorIs(t, cl.StopCause(), packets.ErrServerShuttingDown)
+}
+
+func TestServerCloseDrainTimeout(t *testing.T) {
+	s := newServer()
+	s.Options.ShutdownDrainTimeout = 1
+	s.Options.Capabilities.Compatibilities.PassiveClientDisconnect = true
+
+	err := s.AddListener(listeners.NewMockListener("t1", ":1882"))
+	require.NoError(t, err)
+	_ = s.Serve()
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("t1", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt5).RawBytes)
+		_, _ = io.ReadAll(w)
+	}()
+
+	require.Eventually(t, func() bool {
+		return len(s.Clients.GetByListener("t1")) == 1
+	}, time.Second, time.Millisecond)
+	cl := s.Clients.GetByListener("t1")[0]
+
+	start := time.Now()
+	_ = s.Close()
+	require.GreaterOrEqual(t, time.Since(start), time.Second)
+	require.Error(t, <-o)
+	require.ErrorIs(t, cl.StopCause(), packets.ErrServerShuttingDown)
+	_ = w.Close()
+}
+
 func TestServerClearExpiredInflights(t *testing.T) {
 	s := New(nil)
 	require.NotNil(t, s)
@@ -3600,6 +5857,59 @@ func TestServerClearExpiredClients(t *testing.T) {
 	require.Equal(t, 2, s.Clients.Len())
 }
 
+type storedClientsHook struct {
+	HookBase
+	clients []storage.Client
+	expired []string
+}
+
+func (h *storedClientsHook) ID() string {
+	return "stored-clients"
+}
+
+func (h *storedClientsHook) Provides(b byte) bool {
+	return b == StoredClients || b == OnClientExpired
+}
+
+func (h *storedClientsHook) StoredClients() ([]storage.Client, error) {
+	return h.clients, nil
+}
+
+func (h *storedClientsHook) OnClientExpired(cl *Client) {
+	h.expired = append(h.expired, cl.ID)
+}
+
+func TestServerClearExpiredStoredSessions(t *testing.T) {
+	s := New(&Options{Logger: logger})
+	s.Options.Capabilities.MaximumSessionExpiryInterval = 100
+	s.Info.Started = 1000
+	hook := &storedClientsHook{
+		clients: []storage.Client{
+			{ID: "v5-expired", ProtocolVersion: 5, Properties: storage.ClientProperties{SessionExpiryInterval: 10, SessionExpiryIntervalFlag: true}},
+			{ID: "v5-live", ProtocolVersion: 5, Properties: storage.ClientProperties{SessionExpiryInterval: 1000, SessionExpiryIntervalFlag: true}},
+			{ID: "v3-clean", ProtocolVersion: 4, Clean: true},
+			{ID: "v3-persistent", ProtocolVersion: 4},
+			{ID: "loaded", ProtocolVersion: 5, Properties: storage.ClientProperties{SessionExpiryIntervalFlag: true}},
+		},
+	}
+	require.NoError(t, s.AddHook(hook, nil))
+
+	cl, _, _ := newTestClient()
+	cl.ID = "loaded"
+	s.Clients.Add(cl)
+
+	s.clearExpiredStoredSessions(1050)
+	require.Empty(t, hook.expired) // stored sessions are loaded and expired on start
+
+	s.Options.LazySessionLoading = true
+	s.clearExpiredStoredSessions(1050)
+	require.ElementsMatch(t, []string{"v5-expired", "v3-clean"}, hook.expired)
+
+	hook.expired = nil
+	s.clearExpiredStoredSessions(1101)
+	require.ElementsMatch(t, []string{"v5-expired", "v3-clean", "v3-persistent"}, hook.expired)
+}
+
 func TestLoadServerInfoRestoreOnRestart(t *testing.T) {
 	s := New(nil)
 	s.Options.Capabilities.Compatibilities.RestoreSysInfoOnRestart = true
@@ -3739,6 +6049,42 @@ func TestServerUnsubscribeNoInlineClient(t *testing.T) {
 	require.ErrorIs(t, err, ErrInlineClientNotEnabled)
 }
 
+func TestServerSubscribeMessages(t *testing.T) {
+	s := newServerWithInlineClient()
+	first := make(chan string, 2)
+	second := make(chan string, 2)
+
+	unsubFirst, err := s.SubscribeMessages("a/+/c", func(topic string, payload []byte, retain bool, qos byte) {
+		first <- topic + ":" + string(payload)
+	})
+	require.NoError(t, err)
+
+	unsubSecond, err := s.SubscribeMessages("a/+/c", func(topic string, payload []byte, retain bool, qos byte) {
+		second <- topic + ":" + string(payload)
+	})
+	require.NoError(t, err)
+	defer unsubSecond()
+
+	require.NoError(t, s.Publish("a/b/c", []byte("hello"), false, 0))
+	require.Equal(t, "a/b/c:hello", <-first)
+	require.Equal(t, "a/b/c:hello", <-second)
+
+	unsubFirst()
+	require.NoError(t, s.Publish("a/d/c", []byte("again"), false, 0))
+	require.Equal(t, "a/d/c:again", <-second)
+	require.Len(t, first, 0)
+}
+
+func TestServerSubscribeMessagesInvalid(t *testing.T) {
+	s := newServerWithInlineClient()
+	_, err := s.SubscribeMessages("###", func(topic string, payload []byte, retain bool, qos byte) {})
+	require.ErrorIs(t, err, packets.ErrTopicFilterInvalid)
+
+	s = newServer()
+	_, err = s.SubscribeMessages("a/b/c", func(topic string, payload []byte, retain bool, qos byte) {})
+	require.ErrorIs(t, err, ErrInlineClientNotEnabled)
+}
+
 func TestPublishToInlineSubscriber(t *testing.T) {
 	s := newServerWithInlineClient()
 	finishCh := make(chan bool)
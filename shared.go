@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"strings"
+	"sync"
+
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+)
+
+// SharedStrategy is the strategy used to select the member of a shared subscription group
+// which receives a message.
+type SharedStrategy byte
+
+const (
+	SharedRandom        SharedStrategy = iota // a random member
+	SharedRoundRobin                          // each member in turn
+	SharedSticky                              // the same member for each publishing client, while the members of the group are unchanged
+	SharedLeastInflight                       // the member with the fewest unacknowledged qos 1 and 2 messages
+)
+
+// SharedSubscriptionOptions contains the strategies used to select the member of each shared
+// subscription group which receives a message. The selection can also be made by an
+// OnSelectSubscribers hook, using Subscribers.SelectSharedBy.
+type SharedSubscriptionOptions struct {
+	Strategy SharedStrategy            `yaml:"strategy" json:"strategy"` // the strategy of groups without their own strategy
+	Groups   map[string]SharedStrategy `yaml:"groups" json:"groups"`     // the strategies of groups, keyed on group name
+}
+
+// sharedBalancer selects the members of shared subscription groups according to their strategies.
+type sharedBalancer struct {
+	sync.Mutex
+	opts SharedSubscriptionOptions
+	next map[string]uint64 // the round robin position of each group, keyed on group filter
+}
+
+// newSharedBalancer returns a new shared subscription balancer.
+func newSharedBalancer(opts SharedSubscriptionOptions) *sharedBalancer {
+	return &sharedBalancer{
+		opts: opts,
+		next: map[string]uint64{},
+	}
+}
+
+// strategy returns the strategy of a shared subscription group, from its filter such as
+// $share/group/a/b.
+func (b *sharedBalancer) strategy(group string) SharedStrategy {
+	if len(b.opts.Groups) > 0 {
+		if parts := strings.SplitN(group, "/", 3); len(parts) > 1 {
+			if st, ok := b.opts.Groups[parts[1]]; ok {
+				return st
+			}
+		}
+	}
+
+	return b.opts.Strategy
+}
+
+// selectMember returns the id of the member of a shared subscription group which receives a
+// message, from the sorted ids of its members.
+func (b *sharedBalancer) selectMember(s *Server, group string, members []string, pk packets.Packet) string {
+	switch b.strategy(group) {
+	case SharedRoundRobin:
+		b.Lock()
+		n := b.next[group]
+		b.next[group] = n + 1
+		b.Unlock()
+		return members[n%uint64(len(members))]
+	case SharedSticky:
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(pk.Origin))
+		return members[h.Sum32()%uint32(len(members))]
+	case SharedLeastInflight:
+		id, least := members[0], -1
+		for _, m := range members {
+			cl, ok := s.Clients.Get(m)
+			if !ok {
+				continue
+			}
+
+			if n := cl.State.Inflight.Len(); least == -1 || n < least {
+				id, least = m, n
+			}
+		}
+		return id
+	default:
+		return members[rand.IntN(len(members))]
+	}
+}
+
+// selectShared selects the member of each shared subscription group which receives a message,
+// using the configured strategies, or at random if none are configured.
+func (s *Server) selectShared(subs *Subscribers, pk packets.Packet) {
+	if s.shared == nil {
+		subs.SelectShared()
+		return
+	}
+
+	subs.SelectSharedBy(func(group string, members []string) string {
+		return s.shared.selectMember(s, group, members, pk)
+	})
+}
@@ -0,0 +1,110 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+var testSharedGroup = SharePrefix + "/grp/a/b/c"
+
+func TestSharedBalancerStrategy(t *testing.T) {
+	b := newSharedBalancer(SharedSubscriptionOptions{
+		Strategy: SharedRoundRobin,
+		Groups: map[string]SharedStrategy{
+			"grp": SharedSticky,
+		},
+	})
+
+	require.Equal(t, SharedSticky, b.strategy(testSharedGroup))
+	require.Equal(t, SharedRoundRobin, b.strategy(SharePrefix+"/other/a/b/c"))
+	require.Equal(t, SharedRoundRobin, b.strategy("invalid"))
+}
+
+func TestSharedBalancerRoundRobin(t *testing.T) {
+	s := New(nil)
+	b := newSharedBalancer(SharedSubscriptionOptions{Strategy: SharedRoundRobin})
+	members := []string{"cl1", "cl2", "cl3"}
+
+	var selected []string
+	for i := 0; i < 4; i++ {
+		selected = append(selected, b.selectMember(s, testSharedGroup, members, packets.Packet{}))
+	}
+
+	require.Equal(t, []string{"cl1", "cl2", "cl3", "cl1"}, selected)
+	require.Equal(t, "cl1", b.selectMember(s, SharePrefix+"/other/a", members, packets.Packet{}))
+}
+
+func TestSharedBalancerSticky(t *testing.T) {
+	s := New(nil)
+	b := newSharedBalancer(SharedSubscriptionOptions{Strategy: SharedSticky})
+	members := []string{"cl1", "cl2", "cl3", "cl4", "cl5"}
+
+	seen := map[string]bool{}
+	for _, origin := range []string{"pub1", "pub2", "pub3", "pub4", "pub5", "pub6"} {
+		pk := packets.Packet{Origin: origin}
+		id := b.selectMember(s, testSharedGroup, members, pk)
+		for i := 0; i < 3; i++ {
+			require.Equal(t, id, b.selectMember(s, testSharedGroup, members, pk))
+		}
+		seen[id] = true
+	}
+
+	require.Greater(t, len(seen), 1) // different publishers are spread across the members
+}
+
+func TestSharedBalancerLeastInflight(t *testing.T) {
+	s := New(nil)
+	b := newSharedBalancer(SharedSubscriptionOptions{Strategy: SharedLeastInflight})
+
+	for id, n := range map[string]int{"cl1": 2, "cl2": 1, "cl3": 3} {
+		cl, _, _ := newTestClient()
+		cl.ID = id
+		for i := 1; i <= n; i++ {
+			cl.State.Inflight.Set(packets.Packet{PacketID: uint16(i)})
+		}
+		s.Clients.Add(cl)
+	}
+
+	require.Equal(t, "cl2", b.selectMember(s, testSharedGroup, []string{"cl1", "cl2", "cl3"}, packets.Packet{}))
+	require.Equal(t, "cl1", b.selectMember(s, testSharedGroup, []string{"cl1", "cl3"}, packets.Packet{}))
+	require.Equal(t, "cl3", b.selectMember(s, testSharedGroup, []string{"missing", "cl3"}, packets.Packet{}))
+	require.Equal(t, "missing", b.selectMember(s, testSharedGroup, []string{"missing"}, packets.Packet{}))
+}
+
+func TestSharedBalancerRandom(t *testing.T) {
+	s := New(nil)
+	b := newSharedBalancer(SharedSubscriptionOptions{})
+	members := []string{"cl1", "cl2"}
+	for i := 0; i < 10; i++ {
+		require.Contains(t, members, b.selectMember(s, testSharedGroup, members, packets.Packet{}))
+	}
+}
+
+func TestServerSelectShared(t *testing.T) {
+	s := New(&Options{
+		SharedSubscriptions: &SharedSubscriptionOptions{Strategy: SharedRoundRobin},
+	})
+	require.NotNil(t, s.shared)
+	require.True(t, s.Topics.Subscribe("cl1", packets.Subscription{Filter: testSharedGroup}))
+	require.True(t, s.Topics.Subscribe("cl2", packets.Subscription{Filter: testSharedGroup}))
+
+	for _, want := range []string{"cl1", "cl2", "cl1"} {
+		subs := s.Topics.Subscribers("a/b/c")
+		s.selectShared(subs, packets.Packet{TopicName: "a/b/c"})
+		require.Len(t, subs.SharedSelected, 1)
+		require.Contains(t, subs.SharedSelected, want)
+	}
+
+	s = New(nil)
+	require.Nil(t, s.shared)
+	require.True(t, s.Topics.Subscribe("cl1", packets.Subscription{Filter: testSharedGroup}))
+	subs := s.Topics.Subscribers("a/b/c")
+	s.selectShared(subs, packets.Packet{TopicName: "a/b/c"})
+	require.Contains(t, subs.SharedSelected, "cl1")
+}
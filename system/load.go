@@ -0,0 +1,87 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package system
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LoadAverage contains the exponentially weighted moving averages of the rate of a counter,
+// in events per minute, over 1, 5 and 15 minutes.
+type LoadAverage struct {
+	Min1  float64 `json:"1min"`  // the average over 1 minute
+	Min5  float64 `json:"5min"`  // the average over 5 minutes
+	Min15 float64 `json:"15min"` // the average over 15 minutes
+	last  int64   // the value of the counter when the averages were last updated
+}
+
+// update updates the averages with the value of the counter after elapsed seconds.
+func (l *LoadAverage) update(value int64, elapsed float64) {
+	rate := float64(value-l.last) / elapsed * 60
+	l.Min1 = rate + math.Exp(-elapsed/60)*(l.Min1-rate)
+	l.Min5 = rate + math.Exp(-elapsed/300)*(l.Min5-rate)
+	l.Min15 = rate + math.Exp(-elapsed/900)*(l.Min15-rate)
+	l.last = value
+}
+
+// Load contains the load averages of the server counters, as published in the
+// $SYS/broker/load topics.
+type Load struct {
+	sync.Mutex
+	updated  time.Time               // the time the averages were last updated
+	averages map[string]*LoadAverage // the averages of each counter, keyed on topic name
+}
+
+// loadCounters returns the current values of the counters which load averages are kept for,
+// keyed on the topic name of the average.
+func loadCounters(i *Info) map[string]int64 {
+	var connections int64
+	listenersMu.RLock()
+	for _, l := range i.Listeners {
+		connections += atomic.LoadInt64(&l.Accepted)
+	}
+	listenersMu.RUnlock()
+
+	return map[string]int64{
+		"messages/received": atomic.LoadInt64(&i.PacketsReceived),
+		"messages/sent":     atomic.LoadInt64(&i.PacketsSent),
+		"publish/received":  atomic.LoadInt64(&i.MessagesReceived),
+		"publish/sent":      atomic.LoadInt64(&i.MessagesSent),
+		"publish/dropped":   atomic.LoadInt64(&i.MessagesDropped),
+		"bytes/received":    atomic.LoadInt64(&i.BytesReceived),
+		"bytes/sent":        atomic.LoadInt64(&i.BytesSent),
+		"connections":       connections,
+	}
+}
+
+// Update updates the load averages with the counters of the server at time now, and returns
+// a copy of the averages. The first update only records the counters.
+func (l *Load) Update(i *Info, now time.Time) map[string]LoadAverage {
+	l.Lock()
+	defer l.Unlock()
+
+	counters := loadCounters(i)
+	if l.averages == nil {
+		l.averages = make(map[string]*LoadAverage, len(counters))
+		for name, value := range counters {
+			l.averages[name] = &LoadAverage{last: value}
+		}
+	} else if elapsed := now.Sub(l.updated).Seconds(); elapsed > 0 {
+		for name, value := range counters {
+			l.averages[name].update(value, elapsed)
+		}
+	}
+
+	l.updated = now
+	out := make(map[string]LoadAverage, len(l.averages))
+	for name, avg := range l.averages {
+		out[name] = *avg
+	}
+
+	return out
+}
@@ -0,0 +1,47 @@
+package system
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadAverageUpdate(t *testing.T) {
+	l := new(LoadAverage)
+	l.update(60, 60) // 60 events per minute
+	require.InDelta(t, 60*(1-math.Exp(-1)), l.Min1, 0.001)
+	require.InDelta(t, 60*(1-math.Exp(-0.2)), l.Min5, 0.001)
+	require.InDelta(t, 60*(1-math.Exp(-1.0/15)), l.Min15, 0.001)
+	require.Equal(t, int64(60), l.last)
+
+	for i := int64(2); i < 100; i++ {
+		l.update(i*60, 60)
+	}
+	require.InDelta(t, 60, l.Min1, 0.001)
+	require.InDelta(t, 60, l.Min5, 0.1)
+	require.Less(t, l.Min15, 60.0)
+}
+
+func TestLoadUpdate(t *testing.T) {
+	i := new(Info)
+	i.Listener("t1").Accepted = 10
+	i.PacketsReceived = 100
+
+	var l Load
+	now := time.Now()
+	avgs := l.Update(i, now)
+	require.Len(t, avgs, 8)
+	require.Equal(t, 0.0, avgs["messages/received"].Min1) // the first update only records the counters
+
+	i.PacketsReceived = 160
+	i.Listener("t1").Accepted = 16
+	avgs = l.Update(i, now.Add(time.Minute))
+	require.InDelta(t, 60*(1-math.Exp(-1)), avgs["messages/received"].Min1, 0.001)
+	require.InDelta(t, 6*(1-math.Exp(-1)), avgs["connections"].Min1, 0.001)
+	require.Equal(t, 0.0, avgs["bytes/sent"].Min1)
+
+	// updates without elapsed time are ignored
+	require.Equal(t, avgs, l.Update(i, now.Add(time.Minute)))
+}
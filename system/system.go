@@ -4,7 +4,13 @@
 
 package system
 
-import "sync/atomic"
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// listenersMu guards the listeners map of all Info values, allowing Info to remain copyable.
+var listenersMu sync.RWMutex
 
 // Info contains atomic counters and values for various server statistics
 // commonly found in $SYS topics (and others).
@@ -31,6 +37,66 @@ type Info struct {
 	PacketsSent         int64  `json:"packets_sent"`         // total number of messages of any type sent since the broker started
 	MemoryAlloc         int64  `json:"memory_alloc"`         // memory currently allocated
 	Threads             int64  `json:"threads"`              // number of active goroutines, named as threads for platform ambiguity
+
+	Listeners map[string]*ListenerInfo `json:"listeners,omitempty"` // connection counters for each listener, keyed on listener id
+}
+
+// ListenerInfo contains atomic counters for the connections made to a single listener.
+type ListenerInfo struct {
+	Accepted           int64 `json:"accepted"`             // total number of connections accepted by the listener
+	TLSHandshakeFailed int64 `json:"tls_handshake_failed"` // total number of connections which failed the tls handshake
+	Rejected           int64 `json:"rejected"`             // total number of connections which did not complete the connect handshake
+	Active             int64 `json:"active"`               // number of currently open connections
+}
+
+// Clone makes a copy of ListenerInfo using atomic operation
+func (l *ListenerInfo) Clone() *ListenerInfo {
+	return &ListenerInfo{
+		Accepted:           atomic.LoadInt64(&l.Accepted),
+		TLSHandshakeFailed: atomic.LoadInt64(&l.TLSHandshakeFailed),
+		Rejected:           atomic.LoadInt64(&l.Rejected),
+		Active:             atomic.LoadInt64(&l.Active),
+	}
+}
+
+// Listener returns the connection counters for a listener, adding them if they do not exist.
+func (i *Info) Listener(id string) *ListenerInfo {
+	listenersMu.RLock()
+	l, ok := i.Listeners[id]
+	listenersMu.RUnlock()
+	if ok {
+		return l
+	}
+
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	if l, ok = i.Listeners[id]; ok {
+		return l
+	}
+
+	if i.Listeners == nil {
+		i.Listeners = map[string]*ListenerInfo{}
+	}
+
+	l = new(ListenerInfo)
+	i.Listeners[id] = l
+	return l
+}
+
+// cloneListeners makes a copy of the listener counters using atomic operation.
+func (i *Info) cloneListeners() map[string]*ListenerInfo {
+	listenersMu.RLock()
+	defer listenersMu.RUnlock()
+	if i.Listeners == nil {
+		return nil
+	}
+
+	m := make(map[string]*ListenerInfo, len(i.Listeners))
+	for id, l := range i.Listeners {
+		m[id] = l.Clone()
+	}
+
+	return m
 }
 
 // Clone makes a copy of Info using atomic operation
@@ -57,5 +123,6 @@ func (i *Info) Clone() *Info {
 		PacketsSent:         atomic.LoadInt64(&i.PacketsSent),
 		MemoryAlloc:         atomic.LoadInt64(&i.MemoryAlloc),
 		Threads:             atomic.LoadInt64(&i.Threads),
+		Listeners:           i.cloneListeners(),
 	}
 }
@@ -35,3 +35,27 @@ func TestClone(t *testing.T) {
 
 	require.Equal(t, o, n)
 }
+
+func TestCloneListeners(t *testing.T) {
+	o := new(Info)
+	l := o.Listener("t1")
+	l.Accepted = 4
+	l.TLSHandshakeFailed = 1
+	l.Rejected = 2
+	l.Active = 1
+
+	n := o.Clone()
+	require.Equal(t, o, n)
+
+	n.Listeners["t1"].Accepted = 5
+	require.Equal(t, int64(4), o.Listeners["t1"].Accepted) // the clone does not share counters
+}
+
+func TestListener(t *testing.T) {
+	o := new(Info)
+	l := o.Listener("t1")
+	require.NotNil(t, l)
+	require.Same(t, l, o.Listener("t1"))
+	require.NotSame(t, l, o.Listener("t2"))
+	require.Len(t, o.Listeners, 2)
+}
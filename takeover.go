@@ -0,0 +1,67 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import "github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+
+// TakeoverPolicy is the action taken when a client connects with the id of a client which
+// is already connected.
+type TakeoverPolicy byte
+
+const (
+	TakeoverEvict  TakeoverPolicy = iota // the existing client is disconnected and the new client takes over its session
+	TakeoverReject                       // the new client is rejected and the existing client stays connected
+)
+
+// String returns the name of the policy.
+func (p TakeoverPolicy) String() string {
+	switch p {
+	case TakeoverEvict:
+		return "evict"
+	case TakeoverReject:
+		return "reject"
+	default:
+		return "unknown"
+	}
+}
+
+// TakeoverDecider is an optional interface which may be implemented by hooks to decide
+// whether a connecting client may take over the session of a connected client with the
+// same id. DecideTakeover is called with the policy from the server options, or from the
+// previous hook, and returns the policy to apply.
+type TakeoverDecider interface {
+	DecideTakeover(existing *Client, cl *Client, pk packets.Packet, policy TakeoverPolicy) TakeoverPolicy
+}
+
+// TakeoverPolicy returns the takeover policy for a connecting client, as decided by each
+// hook in scope of the client which implements TakeoverDecider. A hook which panics leaves
+// the policy unchanged, and its calls are recorded as OnSessionEstablish calls.
+func (h *Hooks) TakeoverPolicy(existing *Client, cl *Client, pk packets.Packet, policy TakeoverPolicy) TakeoverPolicy {
+	hs := h.acquire()
+	defer hs.release()
+	for i, hook := range hs.hooks {
+		if d, ok := hook.(TakeoverDecider); ok && hs.inScope(i, cl) && hs.scoped(i, cl, "") {
+			h.guard(hs, i, OnSessionEstablish, func() { policy = d.DecideTakeover(existing, cl, pk, policy) })
+		}
+	}
+
+	return policy
+}
+
+// rejectTakeover returns true if a connecting client must be rejected because a client with
+// the same id is connected and the takeover policy rejects new connections.
+func (s *Server) rejectTakeover(cl *Client, pk packets.Packet) bool {
+	existing, ok := s.Clients.Get(cl.ID)
+	if !ok || existing.Closed() {
+		return false
+	}
+
+	if s.hooks.TakeoverPolicy(existing, cl, pk, s.Options.SessionTakeover) != TakeoverReject {
+		return false
+	}
+
+	s.Log.Warn("session takeover rejected", "client", cl.ID, "remote", cl.Net.Remote, "existing_remote", existing.Net.Remote, "listener", cl.Net.Listener)
+	return true
+}
@@ -0,0 +1,142 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/AMuzykus/mochi-mqtt-server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+type takeoverDeciderHook struct {
+	HookBase
+	policy TakeoverPolicy
+}
+
+func (h *takeoverDeciderHook) ID() string {
+	return "takeover-decider"
+}
+
+func (h *takeoverDeciderHook) DecideTakeover(existing *Client, cl *Client, pk packets.Packet, policy TakeoverPolicy) TakeoverPolicy {
+	return h.policy
+}
+
+type takeoverPanicHook struct {
+	HookBase
+}
+
+func (h *takeoverPanicHook) ID() string {
+	return "takeover-panic"
+}
+
+func (h *takeoverPanicHook) DecideTakeover(existing *Client, cl *Client, pk packets.Packet, policy TakeoverPolicy) TakeoverPolicy {
+	panic("takeover")
+}
+
+func TestTakeoverPolicyString(t *testing.T) {
+	require.Equal(t, "evict", TakeoverEvict.String())
+	require.Equal(t, "reject", TakeoverReject.String())
+	require.Equal(t, "unknown", TakeoverPolicy(255).String())
+}
+
+func TestHooksTakeoverPolicy(t *testing.T) {
+	h := new(Hooks)
+	require.Equal(t, TakeoverReject, h.TakeoverPolicy(new(Client), new(Client), packets.Packet{}, TakeoverReject))
+
+	require.NoError(t, h.Add(new(HookBase), nil))
+	require.NoError(t, h.Add(&takeoverDeciderHook{policy: TakeoverEvict}, nil))
+	require.Equal(t, TakeoverEvict, h.TakeoverPolicy(new(Client), new(Client), packets.Packet{}, TakeoverReject))
+}
+
+func TestHooksTakeoverPolicyPanic(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	require.NoError(t, h.Add(new(takeoverPanicHook), nil))
+	require.Equal(t, TakeoverReject, h.TakeoverPolicy(new(Client), new(Client), packets.Packet{}, TakeoverReject))
+	require.Equal(t, map[string]int64{"takeover-panic": 1}, h.Panics())
+	h.Stop()
+}
+
+func TestHooksTakeoverPolicyScoped(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+	require.NoError(t, h.AddScoped(&takeoverDeciderHook{policy: TakeoverReject}, nil, HookScope{Listeners: []string{"tcp"}}))
+
+	tcp := &Client{ID: "cl1", Net: ClientConnection{Listener: "tcp"}}
+	ws := &Client{ID: "cl1", Net: ClientConnection{Listener: "ws"}}
+	require.Equal(t, TakeoverReject, h.TakeoverPolicy(new(Client), tcp, packets.Packet{}, TakeoverEvict))
+	require.Equal(t, TakeoverEvict, h.TakeoverPolicy(new(Client), ws, packets.Packet{}, TakeoverEvict))
+}
+
+func TestServerRejectTakeover(t *testing.T) {
+	s := newServer()
+	s.Options.SessionTakeover = TakeoverReject
+	cl, _, _ := newTestClient()
+	require.False(t, s.rejectTakeover(cl, packets.Packet{})) // no existing client
+
+	existing, _, _ := newTestClient()
+	s.Clients.Add(existing)
+	require.True(t, s.rejectTakeover(cl, packets.Packet{}))
+
+	existing.Stop(packets.CodeDisconnect)
+	require.False(t, s.rejectTakeover(cl, packets.Packet{})) // disconnected sessions are always resumed
+
+	s.Options.SessionTakeover = TakeoverEvict
+	s.Clients.Add(cl)
+	require.False(t, s.rejectTakeover(cl, packets.Packet{}))
+}
+
+// establishTakeover connects a client with the id of a connected client, returning the
+// existing client, the bytes received by the new client, and the connection error.
+func establishTakeover(t *testing.T, s *Server) (*Client, []byte, error) {
+	existing, _, _ := newTestClient()
+	existing.ID = packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt311).Packet.Connect.ClientIdentifier
+	s.Clients.Add(existing)
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt311).RawBytes)
+		buf, err := io.ReadAll(w)
+		require.NoError(t, err)
+		recv <- buf
+	}()
+
+	err := <-o
+	_ = w.Close()
+	return existing, <-recv, err
+}
+
+func TestEstablishConnectionTakeoverReject(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	s.Options.SessionTakeover = TakeoverReject
+
+	existing, buf, err := establishTakeover(t, s)
+	require.ErrorIs(t, err, packets.ErrClientIdentifierNotValid)
+	require.Equal(t, []byte{packets.Connack << 4, 2, 0, packets.Err3ClientIdentifierNotValid.Code}, buf)
+	require.False(t, existing.Closed())
+	cl, ok := s.Clients.Get(existing.ID)
+	require.True(t, ok)
+	require.Same(t, existing, cl)
+}
+
+func TestEstablishConnectionTakeoverDecider(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	require.NoError(t, s.AddHook(&takeoverDeciderHook{policy: TakeoverReject}, nil))
+
+	existing, _, err := establishTakeover(t, s)
+	require.ErrorIs(t, err, packets.ErrClientIdentifierNotValid)
+	require.False(t, existing.Closed())
+}
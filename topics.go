@@ -5,6 +5,8 @@
 package mqtt
 
 import (
+	"maps"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -308,7 +310,9 @@ type InlineSubscription struct {
 	Handler InlineSubFn
 }
 
-// Subscribers contains the shared and non-shared subscribers matching a topic.
+// Subscribers contains the shared and non-shared subscribers matching a topic. OnSelectSubscribers
+// hooks can change which clients receive a message with the Add, Remove, Filter, SetQos and
+// SelectSharedBy methods, without depending on how the subscribers are stored.
 type Subscribers struct {
 	Shared              map[string]map[string]packets.Subscription
 	SharedSelected      map[string]packets.Subscription
@@ -346,6 +350,120 @@ func (s *Subscribers) MergeSharedSelected() {
 	}
 }
 
+// Clients returns the sorted ids of the clients which may receive the message, being the
+// non-shared subscribers, the selected shared subscribers, and the members of each shared
+// subscription group.
+func (s *Subscribers) Clients() []string {
+	ids := make(map[string]struct{}, len(s.Subscriptions)+len(s.SharedSelected))
+	for id := range s.Subscriptions {
+		ids[id] = struct{}{}
+	}
+
+	for id := range s.SharedSelected {
+		ids[id] = struct{}{}
+	}
+
+	for _, members := range s.Shared {
+		for id := range members {
+			ids[id] = struct{}{}
+		}
+	}
+
+	return slices.Sorted(maps.Keys(ids))
+}
+
+// Add delivers the message to a client as if it had the subscription, merging the subscription
+// with any non-shared subscription the client already has.
+func (s *Subscribers) Add(id string, sub packets.Subscription) {
+	if s.Subscriptions == nil {
+		s.Subscriptions = map[string]packets.Subscription{}
+	}
+
+	if existing, ok := s.Subscriptions[id]; ok {
+		sub = existing.Merge(sub)
+	}
+
+	s.Subscriptions[id] = sub
+}
+
+// Remove prevents the message from being delivered to a client, removing it from the non-shared
+// subscribers, the selected shared subscribers, and every shared subscription group. A shared
+// group with no remaining members is removed.
+func (s *Subscribers) Remove(id string) {
+	s.Filter(func(cl string, _ packets.Subscription) bool {
+		return cl != id
+	})
+}
+
+// Filter removes each client subscription for which fn returns false, from the non-shared
+// subscribers, the selected shared subscribers, and the members of each shared subscription
+// group. A shared group with no remaining members is removed.
+func (s *Subscribers) Filter(fn func(id string, sub packets.Subscription) bool) {
+	maps.DeleteFunc(s.Subscriptions, func(id string, sub packets.Subscription) bool {
+		return !fn(id, sub)
+	})
+
+	maps.DeleteFunc(s.SharedSelected, func(id string, sub packets.Subscription) bool {
+		return !fn(id, sub)
+	})
+
+	for group, members := range s.Shared {
+		maps.DeleteFunc(members, func(id string, sub packets.Subscription) bool {
+			return !fn(id, sub)
+		})
+
+		if len(members) == 0 {
+			delete(s.Shared, group)
+		}
+	}
+}
+
+// SetQos sets the qos of the subscriptions of a client, so the message is delivered to it at the
+// lower of the qos and the qos of the message. The qos is still limited by the maximum qos
+// of the server.
+func (s *Subscribers) SetQos(id string, qos byte) {
+	if sub, ok := s.Subscriptions[id]; ok {
+		sub.Qos = qos
+		s.Subscriptions[id] = sub
+	}
+
+	if sub, ok := s.SharedSelected[id]; ok {
+		sub.Qos = qos
+		s.SharedSelected[id] = sub
+	}
+
+	for _, members := range s.Shared {
+		if sub, ok := members[id]; ok {
+			sub.Qos = qos
+			members[id] = sub
+		}
+	}
+}
+
+// SelectSharedBy selects the client which receives the message for each shared subscription
+// group, replacing any previous selection. fn is called with the filter of each group and the
+// sorted ids of its members, and returns the id of the member to select. If fn returns an id
+// which is not a member of the group, such as an empty string, the group is removed and none
+// of its members receive the message.
+func (s *Subscribers) SelectSharedBy(fn func(group string, members []string) string) {
+	s.SharedSelected = map[string]packets.Subscription{}
+	for _, group := range slices.Sorted(maps.Keys(s.Shared)) {
+		members := s.Shared[group]
+		id := fn(group, slices.Sorted(maps.Keys(members)))
+		sub, ok := members[id]
+		if !ok {
+			delete(s.Shared, group)
+			continue
+		}
+
+		if selected, ok := s.SharedSelected[id]; ok {
+			sub = selected.Merge(sub)
+		}
+
+		s.SharedSelected[id] = sub
+	}
+}
+
 // TopicsIndex is a prefix/trie tree containing topic subscribers and retained messages.
 type TopicsIndex struct {
 	Retained *packets.Packets
@@ -587,6 +587,102 @@ func TestMergeSharedSelected(t *testing.T) {
 	}, s.Subscriptions["cl2"].Identifiers)
 }
 
+func newTestSubscribers() *Subscribers {
+	return &Subscribers{
+		Shared: map[string]map[string]packets.Subscription{
+			SharePrefix + "/tmp/a/b/c": {
+				"cl2": {Qos: 1, Filter: SharePrefix + "/tmp/a/b/c"},
+				"cl3": {Qos: 1, Filter: SharePrefix + "/tmp/a/b/c"},
+			},
+			SharePrefix + "/tmp2/a/b/c": {
+				"cl3": {Qos: 2, Filter: SharePrefix + "/tmp2/a/b/c"},
+			},
+		},
+		SharedSelected: map[string]packets.Subscription{},
+		Subscriptions: map[string]packets.Subscription{
+			"cl1": {Qos: 1, Filter: "a/b/c"},
+		},
+	}
+}
+
+func TestSubscribersClients(t *testing.T) {
+	s := newTestSubscribers()
+	s.SharedSelected["cl4"] = packets.Subscription{Filter: SharePrefix + "/tmp3/a/b/c"}
+	require.Equal(t, []string{"cl1", "cl2", "cl3", "cl4"}, s.Clients())
+	require.Empty(t, new(Subscribers).Clients())
+}
+
+func TestSubscribersAdd(t *testing.T) {
+	s := newTestSubscribers()
+	s.Add("cl1", packets.Subscription{Qos: 2, Filter: "a/+/c", Identifier: 2})
+	s.Add("cl5", packets.Subscription{Filter: "a/#"})
+	require.Equal(t, byte(2), s.Subscriptions["cl1"].Qos)
+	require.Equal(t, map[string]int{"a/b/c": 0, "a/+/c": 2}, s.Subscriptions["cl1"].Identifiers)
+	require.Equal(t, packets.Subscription{Filter: "a/#"}, s.Subscriptions["cl5"])
+
+	s = new(Subscribers)
+	s.Add("cl1", packets.Subscription{Filter: "a/#"})
+	require.Len(t, s.Subscriptions, 1)
+}
+
+func TestSubscribersRemove(t *testing.T) {
+	s := newTestSubscribers()
+	s.SharedSelected["cl3"] = s.Shared[SharePrefix+"/tmp2/a/b/c"]["cl3"]
+	s.Remove("cl3")
+	s.Remove("cl1")
+	require.Empty(t, s.Subscriptions)
+	require.Empty(t, s.SharedSelected)
+	require.Len(t, s.Shared, 1)
+	require.Equal(t, []string{"cl2"}, s.Clients())
+}
+
+func TestSubscribersFilter(t *testing.T) {
+	s := newTestSubscribers()
+	s.Filter(func(id string, sub packets.Subscription) bool {
+		return sub.Qos == 1
+	})
+	require.Contains(t, s.Subscriptions, "cl1")
+	require.Len(t, s.Shared, 1)
+	require.Equal(t, []string{"cl1", "cl2", "cl3"}, s.Clients())
+}
+
+func TestSubscribersSetQos(t *testing.T) {
+	s := newTestSubscribers()
+	s.SharedSelected["cl3"] = s.Shared[SharePrefix+"/tmp2/a/b/c"]["cl3"]
+	s.SetQos("cl3", 0)
+	s.SetQos("cl1", 2)
+	s.SetQos("cl9", 2)
+	require.Equal(t, byte(2), s.Subscriptions["cl1"].Qos)
+	require.Equal(t, byte(0), s.SharedSelected["cl3"].Qos)
+	require.Equal(t, byte(0), s.Shared[SharePrefix+"/tmp/a/b/c"]["cl3"].Qos)
+	require.Equal(t, byte(0), s.Shared[SharePrefix+"/tmp2/a/b/c"]["cl3"].Qos)
+	require.NotContains(t, s.Subscriptions, "cl9")
+}
+
+func TestSubscribersSelectSharedBy(t *testing.T) {
+	s := newTestSubscribers()
+	var groups []string
+	s.SelectSharedBy(func(group string, members []string) string {
+		groups = append(groups, group)
+		return members[len(members)-1]
+	})
+
+	require.Equal(t, []string{SharePrefix + "/tmp/a/b/c", SharePrefix + "/tmp2/a/b/c"}, groups)
+	require.Len(t, s.SharedSelected, 1)
+	require.Equal(t, byte(2), s.SharedSelected["cl3"].Qos)
+
+	s = newTestSubscribers()
+	s.SelectSharedBy(func(group string, members []string) string {
+		if group == SharePrefix+"/tmp/a/b/c" {
+			return ""
+		}
+		return members[0]
+	})
+	require.Len(t, s.Shared, 1)
+	require.Contains(t, s.SharedSelected, "cl3")
+	require.Equal(t, []string{"cl1", "cl3"}, s.Clients())
+}
+
 func TestSubscribersFind(t *testing.T) {
 	tt := []struct {
 		filter  string